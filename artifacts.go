@@ -0,0 +1,622 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/truncindex"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// An Artifact is a manifest, which describes content that isn't a container
+// image, along with the blobs which it refers to.  The manifest and the blobs
+// are stored by digest, so artifacts which share contents share the copies of
+// them which are kept on disk.
+type Artifact struct {
+	// ID is either one which was specified at create-time, or a random
+	// value which was generated by the library.
+	ID string `json:"id"`
+
+	// Digest is the digest of the artifact's manifest.
+	Digest digest.Digest `json:"digest"`
+
+	// MediaType is the media type of the artifact's manifest, if one was
+	// specified at creation-time.
+	MediaType string `json:"media-type,omitempty"`
+
+	// ArtifactType is the type of the artifact, if one was specified at
+	// creation-time.
+	ArtifactType string `json:"artifact-type,omitempty"`
+
+	// Names is an optional set of user-defined convenience values.  The
+	// artifact can be referred to by its ID or any of its names.  Names
+	// are unique among artifacts, but not among artifacts and images.
+	Names []string `json:"names,omitempty"`
+
+	// Annotations are key/value pairs which we keep for the convenience
+	// of the caller.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ManifestSize is the size of the artifact's manifest.
+	ManifestSize int64 `json:"manifest-size"`
+
+	// Blobs describes the blobs which have been added to the artifact, in
+	// the order in which they were added.
+	Blobs []ArtifactBlob `json:"blobs,omitempty"`
+
+	// Created is the datestamp for when this artifact was created.
+	Created time.Time `json:"created,omitempty"`
+}
+
+// ArtifactBlob describes a blob which has been added to an artifact.
+type ArtifactBlob struct {
+	// Digest is the digest of the blob's contents.
+	Digest digest.Digest `json:"digest"`
+	// Size is the size of the blob's contents.
+	Size int64 `json:"size"`
+	// MediaType is the media type of the blob, if one was specified when
+	// it was added.
+	MediaType string `json:"media-type,omitempty"`
+}
+
+// ArtifactOptions is used for passing options to a Store's CreateArtifact()
+// method.
+type ArtifactOptions struct {
+	// MediaType is the media type of the artifact's manifest.
+	MediaType string
+	// ArtifactType is the type of the artifact.
+	ArtifactType string
+	// Annotations are the artifact's initial annotations.
+	Annotations map[string]string
+	// Created is the artifact's creation time.  If it is not set, the
+	// current time is used.
+	Created time.Time
+}
+
+// artifactStore keeps records of artifacts in a directory alongside those of
+// images, along with the blobs which they refer to.
+type artifactStore struct {
+	lockfile  Locker
+	dir       string
+	artifacts []*Artifact
+	idindex   *truncindex.TruncIndex
+	byid      map[string]*Artifact
+	byname    map[string]*Artifact
+	// blobrefs counts the artifacts which refer to each blob, either as
+	// their manifest or as one of their blobs.
+	blobrefs map[digest.Digest]int
+	loadMut  sync.Mutex
+	// records reads and writes the file which holds the records.
+	records recordsFile
+}
+
+func copyArtifact(a *Artifact) *Artifact {
+	return &Artifact{
+		ID:           a.ID,
+		Digest:       a.Digest,
+		MediaType:    a.MediaType,
+		ArtifactType: a.ArtifactType,
+		Names:        copyStringSlice(a.Names),
+		Annotations:  copyStringStringMap(a.Annotations),
+		ManifestSize: a.ManifestSize,
+		Blobs:        append([]ArtifactBlob(nil), a.Blobs...),
+		Created:      a.Created,
+	}
+}
+
+func newArtifactStore(dir string, lockfile Locker, writerOptions ioutils.AtomicFileWriterOptions) (*artifactStore, error) {
+	if lockfile.IsReadWrite() {
+		lockfile.Lock()
+	} else {
+		lockfile.RLock()
+	}
+	defer lockfile.Unlock()
+	astore := artifactStore{
+		lockfile: lockfile,
+		dir:      dir,
+		records:  recordsFile{options: writerOptions},
+	}
+	if err := astore.Load(); err != nil {
+		return nil, err
+	}
+	return &astore, nil
+}
+
+func (r *artifactStore) artifactspath() string {
+	return filepath.Join(r.dir, "artifacts.json")
+}
+
+// blobpath returns the location of the blob whose contents have the digest d.
+func (r *artifactStore) blobpath(d digest.Digest) string {
+	return filepath.Join(r.dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func (r *artifactStore) Load() error {
+	var artifacts []*Artifact
+	if _, err := r.records.decode(r.artifactspath(), func() interface{} {
+		artifacts = []*Artifact{}
+		return &artifacts
+	}); err != nil {
+		return err
+	}
+	idlist := make([]string, 0, len(artifacts))
+	ids := make(map[string]*Artifact)
+	names := make(map[string]*Artifact)
+	blobrefs := make(map[digest.Digest]int)
+	for _, artifact := range artifacts {
+		ids[artifact.ID] = artifact
+		idlist = append(idlist, artifact.ID)
+		for _, name := range artifact.Names {
+			names[name] = artifact
+		}
+		blobrefs[artifact.Digest]++
+		for _, blob := range artifact.Blobs {
+			blobrefs[blob.Digest]++
+		}
+	}
+	r.artifacts = artifacts
+	r.idindex = truncindex.NewTruncIndex(idlist)
+	r.byid = ids
+	r.byname = names
+	r.blobrefs = blobrefs
+	return nil
+}
+
+func (r *artifactStore) Save() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the artifact store at %q", r.artifactspath())
+	}
+	if !r.Locked() {
+		return errors.New("artifact store is not locked for writing")
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	jdata, err := json.Marshal(&r.artifacts)
+	if err != nil {
+		return err
+	}
+	defer r.Touch()
+	return r.records.write(r.artifactspath(), jdata)
+}
+
+func (r *artifactStore) lookup(id string) (*Artifact, bool) {
+	if artifact, ok := r.byid[id]; ok {
+		return artifact, ok
+	} else if artifact, ok := r.byname[id]; ok {
+		return artifact, ok
+	} else if longid, err := r.idindex.Get(id); err == nil {
+		artifact, ok := r.byid[longid]
+		return artifact, ok
+	}
+	return nil, false
+}
+
+// writeBlob stores the contents of a blob, if it isn't already stored, and
+// returns its digest and size.  If expected is set, the contents must match
+// it.
+func (r *artifactStore) writeBlob(data io.Reader, expected digest.Digest) (digest.Digest, int64, error) {
+	algorithm := digest.Canonical
+	if expected != "" {
+		if err := expected.Validate(); err != nil {
+			return "", -1, err
+		}
+		algorithm = expected.Algorithm()
+	}
+	tmpdir := filepath.Join(r.dir, "blobs")
+	if err := os.MkdirAll(tmpdir, 0700); err != nil {
+		return "", -1, err
+	}
+	f, err := ioutil.TempFile(tmpdir, ".tmp-")
+	if err != nil {
+		return "", -1, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	digester := algorithm.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), data)
+	if err != nil {
+		return "", -1, err
+	}
+	d := digester.Digest()
+	if expected != "" && d != expected {
+		return "", -1, errors.Wrapf(ErrDigestMismatch, "blob digest %s does not match expected digest %s", d, expected)
+	}
+	blob := r.blobpath(d)
+	if _, err := os.Stat(blob); err == nil {
+		return d, size, nil
+	} else if !os.IsNotExist(err) {
+		return "", -1, err
+	}
+	if err := f.Sync(); err != nil {
+		return "", -1, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		return "", -1, err
+	}
+	if err := os.Rename(f.Name(), blob); err != nil {
+		return "", -1, err
+	}
+	f.Close()
+	f = nil
+	return d, size, nil
+}
+
+// releaseBlob notes that an artifact no longer refers to a blob, and removes
+// the blob if nothing else refers to it.
+func (r *artifactStore) releaseBlob(d digest.Digest) {
+	r.blobrefs[d]--
+	if r.blobrefs[d] > 0 {
+		return
+	}
+	delete(r.blobrefs, d)
+	if err := os.Remove(r.blobpath(d)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error removing unused artifact blob %q: %v", r.blobpath(d), err)
+	}
+}
+
+func (r *artifactStore) Create(id string, names []string, manifest []byte, options *ArtifactOptions) (*Artifact, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new artifacts at %q", r.artifactspath())
+	}
+	if options == nil {
+		options = &ArtifactOptions{}
+	}
+	if id == "" {
+		id = generateID(nil, func(id string) bool {
+			_, ok := r.lookup(id)
+			return ok
+		})
+	} else if err := validateID(id); err != nil {
+		return nil, err
+	}
+	if _, idInUse := r.byid[id]; idInUse {
+		return nil, errors.Wrapf(ErrDuplicateID, "an artifact with ID %q already exists", id)
+	}
+	names = dedupeNames(names)
+	for _, name := range names {
+		if artifact, nameInUse := r.byname[name]; nameInUse {
+			return nil, errors.Wrapf(ErrDuplicateName, "artifact name %q is already associated with artifact %q", name, artifact.ID)
+		}
+	}
+	created := options.Created
+	if created.IsZero() {
+		created = time.Now().UTC()
+	}
+	d, size, err := r.writeBlob(bytes.NewReader(manifest), "")
+	if err != nil {
+		return nil, err
+	}
+	artifact := &Artifact{
+		ID:           id,
+		Digest:       d,
+		MediaType:    options.MediaType,
+		ArtifactType: options.ArtifactType,
+		Names:        names,
+		Annotations:  copyStringStringMap(options.Annotations),
+		ManifestSize: size,
+		Created:      created,
+	}
+	r.artifacts = append(r.artifacts, artifact)
+	r.idindex.Add(id)
+	r.byid[id] = artifact
+	for _, name := range names {
+		r.byname[name] = artifact
+	}
+	r.blobrefs[d]++
+	return copyArtifact(artifact), r.Save()
+}
+
+func (r *artifactStore) PutBlob(id, mediaType string, data io.Reader, expected digest.Digest) (*ArtifactBlob, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to add blobs to artifacts at %q", r.artifactspath())
+	}
+	artifact, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+	}
+	d, size, err := r.writeBlob(data, expected)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range artifact.Blobs {
+		if blob.Digest == d {
+			return &blob, nil
+		}
+	}
+	blob := ArtifactBlob{
+		Digest:    d,
+		Size:      size,
+		MediaType: mediaType,
+	}
+	artifact.Blobs = append(artifact.Blobs, blob)
+	r.blobrefs[d]++
+	return &blob, r.Save()
+}
+
+// BlobReader opens the artifact's manifest, if d is its digest, or one of its
+// blobs.
+func (r *artifactStore) BlobReader(id string, d digest.Digest) (io.ReadCloser, error) {
+	artifact, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+	}
+	found := artifact.Digest == d
+	for _, blob := range artifact.Blobs {
+		found = found || blob.Digest == d
+	}
+	if !found {
+		return nil, errors.Wrapf(ErrArtifactBlobUnknown, "artifact %q has no blob with digest %q", artifact.ID, d)
+	}
+	return os.Open(r.blobpath(d))
+}
+
+func (r *artifactStore) UpdateAnnotations(id string, set map[string]string, remove []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify artifact annotations at %q", r.artifactspath())
+	}
+	if artifact, ok := r.lookup(id); ok {
+		if updateAnnotations(&artifact.Annotations, set, remove) {
+			return r.Save()
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+}
+
+func (r *artifactStore) updateNames(id string, names []string, op updateNameOperation) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to change artifact name assignments at %q", r.artifactspath())
+	}
+	artifact, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+	}
+	oldNames := artifact.Names
+	names, err := applyNameOperation(oldNames, dedupeNames(names), op)
+	if err != nil {
+		return err
+	}
+	for _, name := range oldNames {
+		delete(r.byname, name)
+	}
+	for _, name := range names {
+		if other, ok := r.byname[name]; ok {
+			other.Names = stringSliceWithoutValue(other.Names, name)
+		}
+		r.byname[name] = artifact
+	}
+	artifact.Names = names
+	return r.Save()
+}
+
+func (r *artifactStore) Delete(id string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete artifacts at %q", r.artifactspath())
+	}
+	artifact, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+	}
+	delete(r.byid, artifact.ID)
+	r.idindex.Delete(artifact.ID)
+	for _, name := range artifact.Names {
+		delete(r.byname, name)
+	}
+	for i, candidate := range r.artifacts {
+		if candidate == artifact {
+			r.artifacts = append(r.artifacts[:i], r.artifacts[i+1:]...)
+			break
+		}
+	}
+	if err := r.Save(); err != nil {
+		return err
+	}
+	r.releaseBlob(artifact.Digest)
+	for _, blob := range artifact.Blobs {
+		r.releaseBlob(blob.Digest)
+	}
+	return nil
+}
+
+func (r *artifactStore) Wipe() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete artifacts at %q", r.artifactspath())
+	}
+	ids := make([]string, 0, len(r.byid))
+	for id := range r.byid {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := r.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *artifactStore) Get(id string) (*Artifact, error) {
+	if artifact, ok := r.lookup(id); ok {
+		return copyArtifact(artifact), nil
+	}
+	return nil, errors.Wrapf(ErrArtifactUnknown, "error locating artifact with ID %q", id)
+}
+
+func (r *artifactStore) Artifacts() ([]Artifact, error) {
+	artifacts := make([]Artifact, len(r.artifacts))
+	for i := range r.artifacts {
+		artifacts[i] = *copyArtifact(r.artifacts[i])
+	}
+	return artifacts, nil
+}
+
+func (r *artifactStore) Lock() {
+	r.lockfile.Lock()
+}
+
+func (r *artifactStore) RLock() {
+	r.lockfile.RLock()
+}
+
+func (r *artifactStore) Unlock() {
+	r.lockfile.Unlock()
+}
+
+func (r *artifactStore) Touch() error {
+	return r.lockfile.Touch()
+}
+
+func (r *artifactStore) Modified() (bool, error) {
+	return r.lockfile.Modified()
+}
+
+func (r *artifactStore) IsReadWrite() bool {
+	return r.lockfile.IsReadWrite()
+}
+
+func (r *artifactStore) Locked() bool {
+	return r.lockfile.Locked()
+}
+
+func (r *artifactStore) ReloadIfChanged() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	modified, err := r.Modified()
+	if err == nil && modified {
+		return r.Load()
+	}
+	return err
+}
+
+func (s *store) CreateArtifact(id string, names []string, manifest []byte, options *ArtifactOptions) (*Artifact, error) {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return nil, err
+	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = generateID(s.idGenerator, func(id string) bool {
+			_, ok := astore.lookup(id)
+			return ok
+		})
+	}
+	return astore.Create(id, names, manifest, options)
+}
+
+func (s *store) PutArtifactBlob(id, mediaType string, blob io.Reader, expected digest.Digest) (*ArtifactBlob, error) {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return nil, err
+	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return astore.PutBlob(id, mediaType, blob, expected)
+}
+
+func (s *store) ArtifactBlob(id string, d digest.Digest) (io.ReadCloser, error) {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return nil, err
+	}
+	// Blobs are never modified once they're stored, so the lock doesn't
+	// need to be held while the blob is being read.
+	astore.RLock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return astore.BlobReader(id, d)
+}
+
+func (s *store) Artifact(id string) (*Artifact, error) {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return nil, err
+	}
+	astore.RLock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return astore.Get(id)
+}
+
+func (s *store) Artifacts() ([]Artifact, error) {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return nil, err
+	}
+	astore.RLock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return astore.Artifacts()
+}
+
+func (s *store) updateArtifactNames(id string, names []string, op updateNameOperation) error {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return err
+	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return astore.updateNames(id, names, op)
+}
+
+func (s *store) AddArtifactNames(id string, names []string) error {
+	return s.updateArtifactNames(id, names, addNames)
+}
+
+func (s *store) RemoveArtifactNames(id string, names []string) error {
+	return s.updateArtifactNames(id, names, removeNames)
+}
+
+func (s *store) UpdateArtifactAnnotations(id string, set map[string]string, remove []string) error {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return err
+	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return astore.UpdateAnnotations(id, set, remove)
+}
+
+func (s *store) DeleteArtifact(id string) error {
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return err
+	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return astore.Delete(id)
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+const changeJournalSuffix = ".changes.json"
+
+// layerChangeJournal is a record of the paths in a read-write layer which
+// might have been modified since the layer was created.  We only keep one
+// for a layer if every change made to it was made while it was mounted by a
+// process which was tracking changes to it, so that we can use it to find
+// out what changed without comparing all of the layer's contents to those of
+// its parent.
+type layerChangeJournal struct {
+	// Tracking is set while the layer is mounted and a process is
+	// tracking changes to it.  A journal which is left in that state, as
+	// it would be if that process exited without unmounting the layer,
+	// can't be trusted.
+	Tracking bool     `json:"tracking,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
+	Subtrees []string `json:"subtrees,omitempty"`
+}
+
+// changeTrackers holds the trackers for the layers which this process
+// mounted, indexed by the locations of their journals.  They're kept here
+// instead of in the layer store, which can be replaced with a new one which
+// we've just reloaded while a layer is mounted.
+var (
+	changeTrackers     = make(map[string]*changeTracker)
+	changeTrackersLock sync.Mutex
+)
+
+func (r *layerStore) changejournalpath(id string) string {
+	return filepath.Join(r.layerdir, id+changeJournalSuffix)
+}
+
+// readChangeJournal reads the layer's change journal, if it has one.
+func (r *layerStore) readChangeJournal(id string) (*layerChangeJournal, error) {
+	data, err := ioutil.ReadFile(r.changejournalpath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	journal := &layerChangeJournal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (r *layerStore) writeChangeJournal(id string, journal *layerChangeJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(r.changejournalpath(id), data, 0600)
+}
+
+// startChangeJournal gives a newly-created read-write layer an empty change
+// journal, if we've been asked to track changes to layers.  The journal is
+// only an optimization, so failing to create it isn't treated as an error.
+func (r *layerStore) startChangeJournal(id string) {
+	if !r.trackChanges {
+		return
+	}
+	if err := r.writeChangeJournal(id, &layerChangeJournal{}); err != nil {
+		logrus.Debugf("error creating change journal for layer %q: %v", id, err)
+		r.discardChangeJournal(id)
+	}
+}
+
+// discardChangeJournal stops tracking changes to the layer, if we were, and
+// removes its change journal, if it has one, so that we'll compare its
+// contents to its parent's when asked what changed.
+func (r *layerStore) discardChangeJournal(id string) {
+	changeTrackersLock.Lock()
+	tracker := changeTrackers[r.changejournalpath(id)]
+	delete(changeTrackers, r.changejournalpath(id))
+	changeTrackersLock.Unlock()
+	if tracker != nil {
+		tracker.stopTracking()
+	}
+	if err := os.Remove(r.changejournalpath(id)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error removing change journal for layer %q: %v", id, err)
+	}
+}
+
+// startTrackingChanges starts tracking changes to a layer which we've just
+// mounted read-write, if it has a change journal which we can trust.  If it
+// doesn't, or we can't track changes to it, we discard its journal.
+func (r *layerStore) startTrackingChanges(layer *Layer) {
+	journal, err := r.readChangeJournal(layer.ID)
+	if journal == nil && err == nil {
+		return
+	}
+	r.discardChangeJournal(layer.ID)
+	if err != nil || journal.Tracking || !r.trackChanges {
+		return
+	}
+	tracker, err := newChangeTracker(layer.MountPoint)
+	if err != nil {
+		logrus.Debugf("not tracking changes to layer %q: %v", layer.ID, err)
+		return
+	}
+	journal.Tracking = true
+	if err := r.writeChangeJournal(layer.ID, journal); err != nil {
+		logrus.Debugf("error updating change journal for layer %q: %v", layer.ID, err)
+		tracker.stopTracking()
+		r.discardChangeJournal(layer.ID)
+		return
+	}
+	changeTrackersLock.Lock()
+	changeTrackers[r.changejournalpath(layer.ID)] = tracker
+	changeTrackersLock.Unlock()
+}
+
+// stopTrackingChanges stops tracking changes to a layer which is about to be
+// unmounted for the last time.  It returns a function which should be called
+// to record them in the layer's journal after the layer has been unmounted,
+// and which discards the journal if we weren't the ones tracking changes to
+// it, if we missed any, or if the layer couldn't be unmounted.
+func (r *layerStore) stopTrackingChanges(id string) func(unmounted bool) {
+	changeTrackersLock.Lock()
+	tracker := changeTrackers[r.changejournalpath(id)]
+	delete(changeTrackers, r.changejournalpath(id))
+	changeTrackersLock.Unlock()
+	var paths, subtrees []string
+	ok := false
+	if tracker != nil {
+		paths, subtrees, ok = tracker.stopTracking()
+	}
+	return func(unmounted bool) {
+		journal, err := r.readChangeJournal(id)
+		if journal == nil && err == nil {
+			return
+		}
+		if err != nil || !ok || !unmounted || !journal.Tracking {
+			r.discardChangeJournal(id)
+			return
+		}
+		journal.Tracking = false
+		journal.Paths = mergePaths(journal.Paths, paths)
+		journal.Subtrees = mergePaths(journal.Subtrees, subtrees)
+		if err := r.writeChangeJournal(id, journal); err != nil {
+			logrus.Debugf("error updating change journal for layer %q: %v", id, err)
+			r.discardChangeJournal(id)
+		}
+	}
+}
+
+// mergePaths returns a sorted list of the paths which are in either list.
+func mergePaths(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var merged []string
+	for _, list := range [][]string{a, b} {
+		for _, path := range list {
+			if !seen[path] {
+				seen[path] = true
+				merged = append(merged, path)
+			}
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// journaledChanges uses the layer's change journal to find out what changed
+// in it relative to its parent, if it has a journal which we can trust.  The
+// returned function must be called to unmount the layer after we're done
+// with its contents.
+func (r *layerStore) journaledChanges(layer, parent *Layer) (changes []archive.Change, layerFs string, unmount func(), ok bool) {
+	journal, err := r.readChangeJournal(layer.ID)
+	if journal == nil || err != nil {
+		return nil, "", nil, false
+	}
+	if journal.Tracking {
+		changeTrackersLock.Lock()
+		tracker := changeTrackers[r.changejournalpath(layer.ID)]
+		changeTrackersLock.Unlock()
+		if tracker == nil {
+			return nil, "", nil, false
+		}
+		paths, subtrees, ok := tracker.changes()
+		if !ok {
+			return nil, "", nil, false
+		}
+		journal.Paths = mergePaths(journal.Paths, paths)
+		journal.Subtrees = mergePaths(journal.Subtrees, subtrees)
+	}
+	layerFs, err = r.driver.Get(layer.ID, drivers.MountOpts{MountLabel: layer.MountLabel})
+	if err != nil {
+		return nil, "", nil, false
+	}
+	unmount = func() {
+		if err := r.driver.Put(layer.ID); err != nil {
+			logrus.Debugf("error unmounting layer %q: %v", layer.ID, err)
+		}
+	}
+	parentFs := ""
+	if parent != nil {
+		parentFs, err = r.driver.Get(parent.ID, drivers.MountOpts{MountLabel: layer.MountLabel, Options: []string{"ro"}})
+		if err != nil {
+			unmount()
+			return nil, "", nil, false
+		}
+		defer func() {
+			if err := r.driver.Put(parent.ID); err != nil {
+				logrus.Debugf("error unmounting layer %q: %v", parent.ID, err)
+			}
+		}()
+	}
+	changes, err = archive.ChangesPaths(layerFs, r.layerMappings(layer), parentFs, r.layerMappings(parent), journal.Paths, journal.Subtrees)
+	if err != nil {
+		logrus.Debugf("error using change journal for layer %q: %v", layer.ID, err)
+		unmount()
+		return nil, "", nil, false
+	}
+	// Changing one of a file's hard links changes all of them, but we
+	// only know about the ones which were used.
+	for _, change := range changes {
+		if change.Kind == archive.ChangeDelete {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(layerFs, change.Path))
+		if err != nil || (!fi.IsDir() && hasOtherLinks(fi)) {
+			unmount()
+			return nil, "", nil, false
+		}
+	}
+	return changes, layerFs, unmount, true
+}
+
+// journaledDiff produces a diff for the layer relative to its parent using its
+// change journal, if it has a journal which we can trust.  If sparse is set,
+// files which have holes in them are stored as sparse entries.
+func (r *layerStore) journaledDiff(layer, parent *Layer, sparse bool) (io.ReadCloser, bool) {
+	changes, layerFs, unmount, ok := r.journaledChanges(layer, parent)
+	if !ok {
+		return nil, false
+	}
+	mappings := r.layerMappings(layer)
+	exportChanges := archive.ExportChanges
+	if sparse {
+		exportChanges = archive.ExportSparseChanges
+	}
+	diff, err := exportChanges(layerFs, changes, mappings.UIDs(), mappings.GIDs())
+	if err != nil {
+		unmount()
+		return nil, false
+	}
+	return ioutils.NewReadCloserWrapper(diff, func() error {
+		defer unmount()
+		return diff.Close()
+	}), true
+}
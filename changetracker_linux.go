@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// changeTrackerMask selects the events which indicate that something in a
+// directory tree was created, modified, removed, or renamed.
+const changeTrackerMask = unix.FAN_MODIFY | unix.FAN_ATTRIB | unix.FAN_CREATE | unix.FAN_DELETE |
+	unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO | unix.FAN_ONDIR
+
+// sizeofFanotifyEventMetadata is the size of the metadata which precedes the
+// information about each event.
+const sizeofFanotifyEventMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+// changeTracker uses fanotify to keep a list of the paths under a layer's
+// mount point which are modified while the layer is mounted.  Events for the
+// whole filesystem are reported to us, and the directory which each one
+// happened in is identified by a file handle, so we need to be able to look
+// up directories using file handles, and we ignore events which happen
+// outside of the mount point.
+type changeTracker struct {
+	root    string
+	fd      int
+	mountFD int
+	stop    [2]int
+	done    chan struct{}
+	mu      sync.Mutex
+	// paths maps the paths which were modified to whether or not they're
+	// directories which were created or moved into place.
+	paths  map[string]bool
+	broken bool
+}
+
+// newChangeTracker starts tracking changes under root.  It fails if
+// fanotify isn't available, if we're not allowed to use it, or if the
+// filesystem doesn't support looking things up using file handles.
+func newChangeTracker(root string) (*changeTracker, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	t := &changeTracker{
+		root:    root,
+		fd:      -1,
+		mountFD: -1,
+		stop:    [2]int{-1, -1},
+		done:    make(chan struct{}),
+		paths:   make(map[string]bool),
+	}
+	if t.fd, err = unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_UNLIMITED_QUEUE|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_LARGEFILE); err != nil {
+		t.closeFDs()
+		return nil, errors.Wrapf(err, "error initializing fanotify")
+	}
+	if err := unix.FanotifyMark(t.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, changeTrackerMask, unix.AT_FDCWD, root); err != nil {
+		t.closeFDs()
+		return nil, errors.Wrapf(err, "error watching the filesystem which contains %q", root)
+	}
+	if t.mountFD, err = unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0); err != nil {
+		t.closeFDs()
+		return nil, errors.Wrapf(err, "error opening %q", root)
+	}
+	// Make sure that we'll be able to figure out where events happened.
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, root, 0)
+	if err == nil {
+		var fd int
+		if fd, err = unix.OpenByHandleAt(t.mountFD, handle, unix.O_PATH|unix.O_CLOEXEC); err == nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		t.closeFDs()
+		return nil, errors.Wrapf(err, "error looking up %q using a file handle", root)
+	}
+	if err := unix.Pipe2(t.stop[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		t.closeFDs()
+		return nil, errors.Wrapf(err, "error creating pipe")
+	}
+	go t.run()
+	return t, nil
+}
+
+// run processes events as they arrive, until the tracker is stopped, so that
+// they don't pile up in the kernel.
+func (t *changeTracker) run() {
+	defer close(t.done)
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}, {Fd: int32(t.stop[0]), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			t.mu.Lock()
+			t.broken = true
+			t.mu.Unlock()
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		t.mu.Lock()
+		t.drain()
+		t.mu.Unlock()
+	}
+}
+
+// drain reads and records all of the events which are waiting to be read.
+// The caller should be holding the tracker's mutex.
+func (t *changeTracker) drain() {
+	buf := make([]byte, 64*1024)
+	for !t.broken {
+		n, err := unix.Read(t.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if err != unix.EAGAIN {
+				t.broken = true
+			}
+			return
+		}
+		for offset := 0; offset+sizeofFanotifyEventMetadata <= n; {
+			event := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+			if event.Vers != unix.FANOTIFY_METADATA_VERSION || event.Mask&unix.FAN_Q_OVERFLOW != 0 ||
+				int(event.Event_len) < sizeofFanotifyEventMetadata || offset+int(event.Event_len) > n {
+				t.broken = true
+				return
+			}
+			if err := t.record(event.Mask, buf[offset+int(event.Metadata_len):offset+int(event.Event_len)]); err != nil {
+				t.broken = true
+				return
+			}
+			offset += int(event.Event_len)
+		}
+	}
+}
+
+// record notes the location of an event, which is described by the
+// information records which followed its metadata.
+func (t *changeTracker) record(mask uint64, info []byte) error {
+	// struct fanotify_event_info_fid starts with a header, which is
+	// followed by the filesystem ID, and then a struct file_handle, and
+	// then, for DFID_NAME records, the name of the directory entry.
+	const headerLen, fsidLen, handleHeaderLen = 4, 8, 8
+	for len(info) >= headerLen {
+		infoType, infoLen := info[0], int(*(*uint16)(unsafe.Pointer(&info[2])))
+		if infoLen < headerLen || infoLen > len(info) {
+			return errors.New("malformed fanotify event")
+		}
+		record := info[:infoLen]
+		info = info[infoLen:]
+		if infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+			continue
+		}
+		record = record[headerLen:]
+		if len(record) < fsidLen+handleHeaderLen {
+			return errors.New("malformed fanotify event")
+		}
+		record = record[fsidLen:]
+		handleBytes := int(*(*uint32)(unsafe.Pointer(&record[0])))
+		handleType := *(*int32)(unsafe.Pointer(&record[4]))
+		if len(record) < handleHeaderLen+handleBytes {
+			return errors.New("malformed fanotify event")
+		}
+		handle := unix.NewFileHandle(handleType, record[handleHeaderLen:handleHeaderLen+handleBytes])
+		name := string(record[handleHeaderLen+handleBytes:])
+		if i := strings.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		fd, err := unix.OpenByHandleAt(t.mountFD, handle, unix.O_PATH|unix.O_CLOEXEC)
+		if err != nil {
+			if err == unix.ESTALE {
+				// The directory has already been removed, and
+				// we'll have been told about that.
+				continue
+			}
+			return err
+		}
+		dir, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		unix.Close(fd)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, filepath.Join(dir, name))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		subtree := mask&unix.FAN_ONDIR != 0 && mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0
+		t.paths[rel] = t.paths[rel] || subtree
+	}
+	return nil
+}
+
+// changes returns the lists of paths which have been modified and of
+// directories which were created or moved into place, after processing any
+// events which were waiting to be read.  It returns false if some events may
+// have been missed.
+func (t *changeTracker) changes() (paths, subtrees []string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drain()
+	if t.broken {
+		return nil, nil, false
+	}
+	for path, subtree := range t.paths {
+		if subtree {
+			subtrees = append(subtrees, path)
+		} else {
+			paths = append(paths, path)
+		}
+	}
+	return paths, subtrees, true
+}
+
+// stopTracking stops tracking changes, and returns the same information
+// that changes() does.
+func (t *changeTracker) stopTracking() (paths, subtrees []string, ok bool) {
+	if _, err := unix.Write(t.stop[1], []byte{0}); err == nil {
+		<-t.done
+	}
+	paths, subtrees, ok = t.changes()
+	t.closeFDs()
+	return paths, subtrees, ok
+}
+
+func (t *changeTracker) closeFDs() {
+	for _, fd := range []*int{&t.fd, &t.mountFD, &t.stop[0], &t.stop[1]} {
+		if *fd != -1 {
+			unix.Close(*fd)
+			*fd = -1
+		}
+	}
+}
+
+// hasOtherLinks returns true if the file has more than one hard link.
+func hasOtherLinks(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
@@ -0,0 +1,37 @@
+// +build !linux
+
+package storage
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// changeTracker would keep a list of the paths under a layer's mount point
+// which are modified while the layer is mounted, but we don't know how to do
+// that here.
+type changeTracker struct{}
+
+// newChangeTracker always fails here, so layers' contents are always compared
+// to their parents' contents to find out what changed.
+func newChangeTracker(root string) (*changeTracker, error) {
+	return nil, errors.New("tracking changes to layers is not supported on this platform")
+}
+
+// changes would return the lists of paths which have been modified and of
+// directories which were created or moved into place.
+func (t *changeTracker) changes() (paths, subtrees []string, ok bool) {
+	return nil, nil, false
+}
+
+// stopTracking stops tracking changes, and returns the same information
+// that changes() does.
+func (t *changeTracker) stopTracking() (paths, subtrees []string, ok bool) {
+	return nil, nil, false
+}
+
+// hasOtherLinks returns true if the file has more than one hard link.
+func hasOtherLinks(fi os.FileInfo) bool {
+	return false
+}
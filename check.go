@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// CheckProblemKind identifies a type of inconsistency which Check can find.
+type CheckProblemKind string
+
+const (
+	// CheckOrphanedLayer is reported for data which the storage driver
+	// has for a layer which no layer store knows about.  It is removed
+	// during repair.
+	CheckOrphanedLayer CheckProblemKind = "orphaned-layer"
+	// CheckMissingLayerData is reported for a layer whose data the
+	// storage driver doesn't have.  The layer is deleted during repair
+	// if no other layer, image, or container depends on it.
+	CheckMissingLayerData CheckProblemKind = "missing-layer-data"
+	// CheckMissingParent is reported for a layer whose parent layer
+	// isn't known.  It can't be repaired.
+	CheckMissingParent CheckProblemKind = "missing-parent"
+	// CheckBadTarSplit is reported for a layer whose tar-split data, which
+	// is used to reproduce the diff that it was populated from, can't be
+	// read.  The data is removed during repair, after which diffs for the
+	// layer are generated from its contents.
+	CheckBadTarSplit CheckProblemKind = "bad-tar-split"
+	// CheckMissingLink is reported for a layer which the storage driver
+	// has no short link for.  Links are rebuilt during repair.
+	CheckMissingLink CheckProblemKind = "missing-link"
+	// CheckDanglingLink is reported for a short link which doesn't point
+	// to a layer.  Links are rebuilt during repair.
+	CheckDanglingLink CheckProblemKind = "dangling-link"
+	// CheckMissingImageLayer is reported for an image whose top layer
+	// isn't known.  It can't be repaired.
+	CheckMissingImageLayer CheckProblemKind = "missing-image-layer"
+	// CheckMissingContainerLayer is reported for a container whose layer
+	// isn't known.  It can't be repaired.
+	CheckMissingContainerLayer CheckProblemKind = "missing-container-layer"
+	// CheckLeakedMount is reported for a file system which is mounted
+	// under the storage driver's home directory, but which isn't where
+	// any layer is recorded as being mounted.  It is unmounted during
+	// repair.
+	CheckLeakedMount CheckProblemKind = "leaked-mount"
+)
+
+// CheckProblem describes an inconsistency which Check found.
+type CheckProblem struct {
+	// Kind is the type of the problem.
+	Kind CheckProblemKind `json:"kind"`
+	// ID is the ID of the layer, image, or container which has the
+	// problem, or the name of a link.
+	ID string `json:"id"`
+	// Message describes the problem.
+	Message string `json:"message"`
+	// Fixed is true if the problem was repaired.
+	Fixed bool `json:"fixed,omitempty"`
+	// RepairError describes why an attempt to repair the problem failed.
+	RepairError string `json:"repairError,omitempty"`
+}
+
+// String formats the problem for display.
+func (p CheckProblem) String() string {
+	s := fmt.Sprintf("%s %s: %s", p.Kind, p.ID, p.Message)
+	if p.Fixed {
+		s += " (fixed)"
+	} else if p.RepairError != "" {
+		s += " (repair failed: " + p.RepairError + ")"
+	}
+	return s
+}
+
+// CheckOptions controls what Check does.
+type CheckOptions struct {
+	// Repair, if set, causes Check to try to fix the problems that it
+	// finds.
+	Repair bool
+}
+
+// CheckReport lists the problems which Check found.
+type CheckReport struct {
+	Problems []CheckProblem `json:"problems"`
+}
+
+// checker accumulates the problems which Check finds, and attempts to repair
+// them if it was asked to.
+type checker struct {
+	repair bool
+	report CheckReport
+}
+
+// add records a problem.  If repairs were requested and fix is not nil, it is
+// called to repair the problem.
+func (c *checker) add(kind CheckProblemKind, id string, fix func() error, format string, args ...interface{}) {
+	problem := CheckProblem{
+		Kind:    kind,
+		ID:      id,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if c.repair && fix != nil {
+		if err := fix(); err != nil {
+			problem.RepairError = err.Error()
+		} else {
+			problem.Fixed = true
+		}
+	}
+	c.report.Problems = append(c.report.Problems, problem)
+}
+
+func (s *store) Check(options *CheckOptions) (*CheckReport, error) {
+	if options == nil {
+		options = &CheckOptions{}
+	}
+	c := &checker{repair: options.Repair}
+
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	ristores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Repair {
+		rlstore.Lock()
+	} else {
+		rlstore.RLock()
+	}
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	// Note which layers are known, and which layers other layers, images,
+	// and containers depend on.
+	known := make(map[string]bool)
+	for _, layer := range layers {
+		known[layer.ID] = true
+	}
+	for _, store := range rlstores {
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		roLayers, err := store.Layers()
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range roLayers {
+			known[layer.ID] = true
+		}
+	}
+	used := make(map[string]bool)
+	for _, layer := range layers {
+		if layer.Parent != "" {
+			used[layer.Parent] = true
+		}
+	}
+	for _, store := range append([]ROImageStore{ristore}, ristores...) {
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		images, err := store.Images()
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			for _, layerID := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
+				if layerID == "" {
+					continue
+				}
+				used[layerID] = true
+				if !known[layerID] {
+					c.add(CheckMissingImageLayer, image.ID, nil, "image's layer %q is missing", layerID)
+				}
+			}
+		}
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		used[container.LayerID] = true
+		if !known[container.LayerID] {
+			c.add(CheckMissingContainerLayer, container.ID, nil, "container's layer %q is missing", container.LayerID)
+		}
+	}
+
+	// Check each of the layers in the read-write store.  Layers which are
+	// still being created or deleted are left alone.
+	ls, _ := rlstore.(*layerStore)
+	for i := range layers {
+		layer := &layers[i]
+		if layerHasIncompleteFlag(layer) {
+			continue
+		}
+		if layer.Parent != "" && !known[layer.Parent] {
+			c.add(CheckMissingParent, layer.ID, nil, "parent layer %q is missing", layer.Parent)
+		}
+		if !driver.Exists(layer.ID) {
+			var fix func() error
+			if !used[layer.ID] {
+				id := layer.ID
+				fix = func() error { return rlstore.Delete(id) }
+			}
+			c.add(CheckMissingLayerData, layer.ID, fix, "the storage driver has no data for the layer")
+			continue
+		}
+		if ls != nil {
+			if _, err := ls.walkTarSplit(layer.ID, func(*storage.Entry) {}); err != nil {
+				tspath := ls.tspath(layer.ID)
+				c.add(CheckBadTarSplit, layer.ID, func() error { return os.Remove(tspath) }, "reading tar-split data: %v", err)
+			}
+		}
+	}
+
+	// Look for data which the driver has for layers which we don't know
+	// about.
+	if lister, ok := driver.(drivers.LayerListerDriver); ok {
+		ids, err := lister.ListLayers()
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing the storage driver's layers")
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if known[id] {
+				continue
+			}
+			id := id
+			c.add(CheckOrphanedLayer, id, func() error { return driver.Remove(id) }, "the storage driver has data for an unknown layer")
+		}
+	}
+
+	// Look for mounts which were left behind under the driver's home
+	// directory.  Not being able to read the mount table isn't fatal.
+	if ls != nil {
+		leaked, err := ls.unrecordedMounts()
+		if err != nil {
+			logrus.Debugf("Unable to check for leaked mounts: %v", err)
+		}
+		for _, mountPoint := range leaked {
+			mountPoint := mountPoint
+			c.add(CheckLeakedMount, mountPoint, func() error { return ls.unmountUnrecorded(mountPoint) }, "file system is mounted, but no layer is recorded as being mounted there")
+		}
+	}
+
+	// Check that every layer has a link, and that every link points to a
+	// layer.  Rebuilding the links fixes both kinds of problem, so we only
+	// do that once.
+	if linker, ok := driver.(drivers.LinkManagerDriver); ok {
+		links, err := linker.Links()
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing the storage driver's links")
+		}
+		linked := make(map[string]bool)
+		var names []string
+		for name, id := range links {
+			linked[id] = true
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var rebuilt bool
+		var rebuildErr error
+		rebuild := func() error {
+			if !rebuilt {
+				rebuildErr = linker.RebuildLinks()
+				rebuilt = true
+			}
+			return rebuildErr
+		}
+		for _, name := range names {
+			if links[name] == "" {
+				c.add(CheckDanglingLink, name, rebuild, "link doesn't point to a layer")
+			}
+		}
+		for i := range layers {
+			layer := &layers[i]
+			if layerHasIncompleteFlag(layer) || linked[layer.ID] || !driver.Exists(layer.ID) {
+				continue
+			}
+			c.add(CheckMissingLink, layer.ID, rebuild, "layer has no link")
+		}
+	}
+
+	return &c.report, nil
+}
@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CloneOptions is used for passing options to a Store's CloneTo() method.
+type CloneOptions struct {
+	// Images, if set, lists the names or IDs of the images to copy.  Only
+	// those images and the layers which they use are copied.  By default,
+	// every layer, image, container, and artifact is copied.
+	Images []string
+	// NoReflink forces the contents of layers to be copied by extracting
+	// their diffs, even if the stores are on the same filesystem.
+	NoReflink bool
+}
+
+// CloneTo creates a new Store using options, and copies the store's layers,
+// images, containers, and artifacts, or just the images which cloneOptions lists
+// and the layers which they use, into it, keeping their IDs.  If options
+// doesn't specify a graph driver, the new Store uses the same graph driver
+// and graph driver options as this one.  Items which the new Store already
+// has are not copied again, unless an earlier attempt to copy them was
+// interrupted, in which case they are copied again.  The caller is
+// responsible for shutting down the new Store.
+func (s *store) CloneTo(options types.StoreOptions, cloneOptions *CloneOptions) (Store, error) {
+	if cloneOptions == nil {
+		cloneOptions = &CloneOptions{}
+	}
+	if options.GraphRoot == "" || options.RunRoot == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no storage root or runroot specified for the new store")
+	}
+	if options.GraphRoot == s.graphRoot || options.RunRoot == s.runRoot {
+		return nil, errors.Errorf("can't clone a store into the locations which it's already using")
+	}
+	if options.GraphDriverName == "" {
+		options.GraphDriverName = s.graphDriverName
+		if options.GraphDriverOptions == nil {
+			options.GraphDriverOptions = append([]string{}, s.graphOptions...)
+		}
+	}
+	if options.IDGenerator == nil {
+		options.IDGenerator = s.idGenerator
+	}
+	dest, err := GetStore(options)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := dest.(*store)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "copying to a %T", dest)
+	}
+	if err := s.cloneInto(d, cloneOptions); err != nil {
+		if _, err2 := d.Shutdown(false); err2 != nil {
+			logrus.Debugf("error shutting down store at %q: %v", d.graphRoot, err2)
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// cloneInto copies the items which cloneOptions selects into d.
+func (s *store) cloneInto(d *store, cloneOptions *CloneOptions) error {
+	transferOptions := &TransferLayerOptions{NoReflink: cloneOptions.NoReflink}
+	var images []Image
+	if len(cloneOptions.Images) > 0 {
+		for _, name := range cloneOptions.Images {
+			image, err := s.Image(name)
+			if err != nil {
+				return errors.Wrapf(err, "locating image %q", name)
+			}
+			images = append(images, *image)
+		}
+	} else {
+		layers, err := s.Layers()
+		if err != nil {
+			return err
+		}
+		for _, layer := range layers {
+			if _, err := s.TransferLayer(layer.ID, d, transferOptions); err != nil {
+				return errors.Wrapf(err, "copying layer %q", layer.ID)
+			}
+		}
+		if images, err = s.Images(); err != nil {
+			return err
+		}
+	}
+	for i := range images {
+		if err := s.cloneImage(&images[i], d, transferOptions); err != nil {
+			return errors.Wrapf(err, "copying image %q", images[i].ID)
+		}
+	}
+	if len(cloneOptions.Images) > 0 {
+		return nil
+	}
+	containers, err := s.Containers()
+	if err != nil {
+		return err
+	}
+	for i := range containers {
+		if err := s.cloneContainer(&containers[i], d, transferOptions); err != nil {
+			return errors.Wrapf(err, "copying container %q", containers[i].ID)
+		}
+	}
+	artifacts, err := s.Artifacts()
+	if err != nil {
+		return err
+	}
+	for i := range artifacts {
+		if err := s.cloneArtifact(&artifacts[i], d); err != nil {
+			return errors.Wrapf(err, "copying artifact %q", artifacts[i].ID)
+		}
+	}
+	return nil
+}
+
+// MoveContainerLayer moves a container, along with the contents of its layer,
+// into dest, copying its image first if dest doesn't already have it.
+func (s *store) MoveContainerLayer(id string, dest Store) (*Container, error) {
+	d, ok := dest.(*store)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "moving containers to a %T", dest)
+	}
+	if d == s || s.sameLocation(d) {
+		return nil, errors.Errorf("can't move container %q to the store which it's already in", id)
+	}
+	if s.readOnly {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to move containers out of %q", s.graphRoot)
+	}
+	container, err := s.Container(id)
+	if err != nil {
+		return nil, err
+	}
+	mounted, err := s.Mounted(container.LayerID)
+	if err != nil {
+		return nil, err
+	}
+	if mounted > 0 {
+		return nil, errors.Wrapf(ErrLayerMounted, "layer %v of container %v", container.LayerID, container.ID)
+	}
+	if _, err := d.Container(container.ID); err == nil {
+		return nil, errors.Wrapf(ErrDuplicateID, "container %q already exists in %q", container.ID, d.graphRoot)
+	}
+	transferOptions := &TransferLayerOptions{}
+	if container.ImageID != "" {
+		image, err := s.Image(container.ImageID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "locating image %q", container.ImageID)
+		}
+		if err := s.cloneImage(image, d, transferOptions); err != nil {
+			return nil, errors.Wrapf(err, "copying image %q", image.ID)
+		}
+	}
+	if err := s.cloneContainer(container, d, transferOptions); err != nil {
+		if _, err2 := d.Container(container.ID); err2 == nil {
+			if err2 := d.DeleteContainer(container.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure moving container %q, error deleting its copy: %v", container.ID, err2)
+			}
+		}
+		return nil, errors.Wrapf(err, "copying container %q", container.ID)
+	}
+	if err := s.DeleteContainer(container.ID); err != nil {
+		return nil, errors.Wrapf(err, "removing container %q after copying it to %q", container.ID, d.graphRoot)
+	}
+	return d.Container(container.ID)
+}
+
+// incompleteCopyPath returns the location of the marker which records that an
+// item is being copied into the store, which isn't complete until the marker
+// is removed.
+func (s *store) incompleteCopyPath(kind, id string) string {
+	return filepath.Join(s.graphRoot, s.graphDriverName+"-incomplete", kind+"-"+id)
+}
+
+// beginCopy records that an item is about to be copied into the store.  It
+// returns false if the store already has the item and no attempt to copy it
+// was interrupted.  If the store has the item, but an attempt to copy it was
+// interrupted, remove is called to discard what that attempt copied.
+func (s *store) beginCopy(kind, id string, exists bool, remove func() error) (bool, error) {
+	marker := s.incompleteCopyPath(kind, id)
+	if exists {
+		if _, err := os.Stat(marker); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		logrus.Debugf("Discarding incomplete copy of %s %q", kind, id)
+		if err := remove(); err != nil {
+			return false, errors.Wrapf(err, "discarding incomplete copy of %s %q", kind, id)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(marker), 0700); err != nil {
+		return false, err
+	}
+	if err := ioutils.AtomicWriteFile(marker, []byte{}, 0600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// finishCopy records that an item has been copied into the store completely.
+func (s *store) finishCopy(kind, id string) error {
+	if err := os.Remove(s.incompleteCopyPath(kind, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cloneImage copies an image, its layers, and its big data items into d.
+func (s *store) cloneImage(image *Image, d *store, transferOptions *TransferLayerOptions) error {
+	ristore, err := d.ImageStore()
+	if err != nil {
+		return err
+	}
+	_, err = d.Image(image.ID)
+	copying, err := d.beginCopy("image", image.ID, err == nil, func() error {
+		ristore.Lock()
+		defer ristore.Unlock()
+		if err := ristore.ReloadIfChanged(); err != nil {
+			return err
+		}
+		return ristore.Delete(image.ID)
+	})
+	if err != nil || !copying {
+		return err
+	}
+	if err := s.copyImage(image, d, ristore, transferOptions); err != nil {
+		return err
+	}
+	return d.finishCopy("image", image.ID)
+}
+
+// copyImage does the work of cloneImage.
+func (s *store) copyImage(image *Image, d *store, ristore ImageStore, transferOptions *TransferLayerOptions) error {
+	for _, layer := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
+		if layer == "" {
+			continue
+		}
+		if _, err := s.TransferLayer(layer, d, transferOptions); err != nil {
+			return errors.Wrapf(err, "copying layer %q", layer)
+		}
+	}
+	if _, err := d.CreateImage(image.ID, image.Names, image.TopLayer, image.Metadata, &ImageOptions{CreationDate: image.Created, Digest: image.Digest}); err != nil {
+		return err
+	}
+	for _, key := range image.BigDataNames {
+		data, err := s.ImageBigData(image.ID, key)
+		if err != nil {
+			return errors.Wrapf(err, "reading data item %q", key)
+		}
+		recorded := image.BigDataDigests[key]
+		digestManifest := func([]byte) (digest.Digest, error) {
+			return recorded, nil
+		}
+		if err := d.SetImageBigData(image.ID, key, data, digestManifest); err != nil {
+			return errors.Wrapf(err, "copying data item %q", key)
+		}
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	if dstImages, ok := ristore.(*imageStore); ok {
+		copied, ok := dstImages.lookup(image.ID)
+		if !ok {
+			return ErrImageUnknown
+		}
+		copied.NamesHistory = append([]string{}, image.NamesHistory...)
+		copied.MappedTopLayers = append([]string{}, image.MappedTopLayers...)
+		copied.Attachments = append([]ImageAttachment{}, image.Attachments...)
+		copied.Annotations = copyStringStringMap(image.Annotations)
+		copied.Flags = copyStringInterfaceMap(image.Flags)
+		return dstImages.Save()
+	}
+	return nil
+}
+
+// cloneContainer copies a container, its layer, its big data items, and the
+// contents of its directory into d.
+func (s *store) cloneContainer(container *Container, d *store, transferOptions *TransferLayerOptions) error {
+	rcstore, err := d.ContainerStore()
+	if err != nil {
+		return err
+	}
+	_, err = d.Container(container.ID)
+	copying, err := d.beginCopy("container", container.ID, err == nil, func() error {
+		rcstore.Lock()
+		defer rcstore.Unlock()
+		if err := rcstore.ReloadIfChanged(); err != nil {
+			return err
+		}
+		return rcstore.Delete(container.ID)
+	})
+	if err != nil || !copying {
+		return err
+	}
+	if err := s.copyContainer(container, d, rcstore, transferOptions); err != nil {
+		return err
+	}
+	return d.finishCopy("container", container.ID)
+}
+
+// copyContainer does the work of cloneContainer.
+func (s *store) copyContainer(container *Container, d *store, rcstore ContainerStore, transferOptions *TransferLayerOptions) error {
+	if _, err := s.TransferLayer(container.LayerID, d, transferOptions); err != nil {
+		return errors.Wrapf(err, "copying layer %q", container.LayerID)
+	}
+	if err := func() error {
+		rcstore.Lock()
+		defer rcstore.Unlock()
+		if err := rcstore.ReloadIfChanged(); err != nil {
+			return err
+		}
+		containerOptions := &ContainerOptions{
+			IDMappingOptions: types.IDMappingOptions{
+				UIDMap: copyIDMap(container.UIDMap),
+				GIDMap: copyIDMap(container.GIDMap),
+			},
+			Flags: copyStringInterfaceMap(container.Flags),
+		}
+		if _, err := rcstore.Create(container.ID, container.Names, container.ImageID, container.LayerID, container.Metadata, containerOptions); err != nil {
+			return err
+		}
+		for _, key := range container.BigDataNames {
+			data, err := s.ContainerBigData(container.ID, key)
+			if err != nil {
+				return errors.Wrapf(err, "reading data item %q", key)
+			}
+			if err := rcstore.SetBigData(container.ID, key, data); err != nil {
+				return errors.Wrapf(err, "copying data item %q", key)
+			}
+		}
+		if dstContainers, ok := rcstore.(*containerStore); ok {
+			copied, ok := dstContainers.lookup(container.ID)
+			if !ok {
+				return ErrContainerUnknown
+			}
+			copied.Created = container.Created
+			copied.Annotations = copyStringStringMap(container.Annotations)
+			return dstContainers.Save()
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+	srcDir, err := s.ContainerDirectory(container.ID)
+	if err != nil {
+		return err
+	}
+	dstDir, err := d.ContainerDirectory(container.ID)
+	if err != nil {
+		return err
+	}
+	if err := copy.DirCopy(srcDir, dstDir, copy.Content, true); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "copying contents of %q", srcDir)
+	}
+	return nil
+}
+
+// cloneArtifact copies an artifact and its blobs into d.
+func (s *store) cloneArtifact(artifact *Artifact, d *store) error {
+	_, err := d.Artifact(artifact.ID)
+	copying, err := d.beginCopy("artifact", artifact.ID, err == nil, func() error {
+		return d.DeleteArtifact(artifact.ID)
+	})
+	if err != nil || !copying {
+		return err
+	}
+	if err := s.copyArtifact(artifact, d); err != nil {
+		return err
+	}
+	return d.finishCopy("artifact", artifact.ID)
+}
+
+// copyArtifact does the work of cloneArtifact.
+func (s *store) copyArtifact(artifact *Artifact, d *store) error {
+	manifest, err := s.ArtifactBlob(artifact.ID, artifact.Digest)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := ioutil.ReadAll(manifest)
+	manifest.Close()
+	if err != nil {
+		return err
+	}
+	artifactOptions := &ArtifactOptions{
+		MediaType:    artifact.MediaType,
+		ArtifactType: artifact.ArtifactType,
+		Annotations:  copyStringStringMap(artifact.Annotations),
+		Created:      artifact.Created,
+	}
+	if _, err := d.CreateArtifact(artifact.ID, artifact.Names, manifestBytes, artifactOptions); err != nil {
+		return err
+	}
+	for _, blob := range artifact.Blobs {
+		if err := func() error {
+			rc, err := s.ArtifactBlob(artifact.ID, blob.Digest)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = d.PutArtifactBlob(artifact.ID, blob.MediaType, rc, blob.Digest)
+			return err
+		}(); err != nil {
+			return errors.Wrapf(err, "copying blob %q", blob.Digest)
+		}
+	}
+	return nil
+}
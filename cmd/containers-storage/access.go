@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var paramAccessExpires = ""
+
+func grantImageStoreAccess(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	expires := time.Time{}
+	if paramAccessExpires != "" {
+		d, err := time.ParseDuration(paramAccessExpires)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+			return 1
+		}
+		expires = time.Now().Add(d)
+	}
+	token, err := storage.GrantImageStoreAccess(args[0], args[1], expires)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	fmt.Printf("%s\n", token)
+	return 0
+}
+
+func revokeImageStoreAccess(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if err := storage.RevokeImageStoreAccess(args[0], args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func listImageStoreAccess(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	tokens, err := storage.ImageStoreAccessTokens(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(tokens) != nil {
+			return 1
+		}
+		return 0
+	}
+	for _, token := range tokens {
+		state := "valid"
+		switch {
+		case token.Revoked:
+			state = "revoked"
+		case !token.Expires.IsZero() && time.Now().After(token.Expires):
+			state = "expired"
+		case !token.Expires.IsZero():
+			state = "expires " + token.Expires.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\n", token.Name, token.Created.Format(time.RFC3339), state)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"grant-image-store-access"},
+		optionsHelp: "[options [...]] imageStorePath tokenName",
+		usage:       "Create a token for accessing an additional image store",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      grantImageStoreAccess,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&paramAccessExpires, []string{"-expires", "e"}, "", "Duration after which the token expires")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"revoke-image-store-access"},
+		optionsHelp: "imageStorePath tokenName",
+		usage:       "Revoke a token for accessing an additional image store",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      revokeImageStoreAccess,
+	})
+	commands = append(commands, command{
+		names:       []string{"list-image-store-access"},
+		optionsHelp: "[options [...]] imageStorePath",
+		usage:       "List tokens for accessing an additional image store",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      listImageStoreAccess,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
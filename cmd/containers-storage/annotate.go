@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+// parseAnnotationChanges interprets arguments of the form "key=value", which
+// set an annotation, and "key-", which remove one.
+func parseAnnotationChanges(args []string) (map[string]string, []string, error) {
+	set := make(map[string]string)
+	var remove []string
+	for _, arg := range args {
+		if i := strings.Index(arg, "="); i > 0 {
+			set[arg[:i]] = arg[i+1:]
+			continue
+		}
+		if strings.HasSuffix(arg, "-") && len(arg) > 1 {
+			remove = append(remove, strings.TrimSuffix(arg, "-"))
+			continue
+		}
+		return nil, nil, fmt.Errorf("expected %q to be in the form key=value or key-", arg)
+	}
+	return set, remove, nil
+}
+
+// annotationsOf returns the annotations of a layer, image, or container.
+func annotationsOf(m storage.Store, id string) (map[string]string, error) {
+	if layer, err := m.Layer(id); err == nil {
+		return layer.Annotations, nil
+	}
+	if image, err := m.Image(id); err == nil {
+		return image.Annotations, nil
+	}
+	container, err := m.Container(id)
+	if err != nil {
+		return nil, storage.ErrNotAnID
+	}
+	return container.Annotations, nil
+}
+
+func annotate(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	set, remove, err := parseAnnotationChanges(args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if len(set) > 0 || len(remove) > 0 {
+		if err := m.UpdateAnnotations(args[0], set, remove); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	annotations, err := annotationsOf(m, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		if writeStructured(annotations) != nil {
+			return 1
+		}
+		return 0
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%s=%s\n", key, annotations[key])
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"annotate"},
+		optionsHelp: "[options [...]] layerOrImageOrContainerNameOrID [key=value | key- [...]]",
+		usage:       "Set, remove, or list layer, image, or container annotations",
+		minArgs:     1,
+		action:      annotate,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	paramArtifactFile         = ""
+	paramArtifactMediaType    = ""
+	paramArtifactArtifactType = ""
+	paramArtifactDigest       = ""
+)
+
+func artifacts(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	artifacts, err := m.Artifacts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(artifacts) != nil {
+			return 1
+		}
+	} else {
+		for _, artifact := range artifacts {
+			fmt.Printf("%s\n", artifact.ID)
+			for _, name := range artifact.Names {
+				fmt.Printf("\tname: %s\n", name)
+			}
+		}
+	}
+	return 0
+}
+
+func artifact(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	matched := []*storage.Artifact{}
+	for _, arg := range args {
+		artifact, err := m.Artifact(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+		matched = append(matched, artifact)
+	}
+	if structuredOutput() {
+		if writeStructured(matched) != nil {
+			return 1
+		}
+	} else {
+		for _, artifact := range matched {
+			fmt.Printf("ID: %s\n", artifact.ID)
+			for _, name := range artifact.Names {
+				fmt.Printf("Name: %s\n", name)
+			}
+			fmt.Printf("Manifest: %s\n", artifact.Digest)
+			if artifact.MediaType != "" {
+				fmt.Printf("Media Type: %s\n", artifact.MediaType)
+			}
+			if artifact.ArtifactType != "" {
+				fmt.Printf("Artifact Type: %s\n", artifact.ArtifactType)
+			}
+			for _, blob := range artifact.Blobs {
+				fmt.Printf("Blob: %s\t%d\t%s\n", blob.Digest, blob.Size, blob.MediaType)
+			}
+		}
+	}
+	return 0
+}
+
+// artifactInput returns the file named using --file, or stdin.
+func artifactInput() (io.ReadCloser, error) {
+	if paramArtifactFile != "" {
+		return os.Open(paramArtifactFile)
+	}
+	return os.Stdin, nil
+}
+
+func createArtifact(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	input, err := artifactInput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	manifest, err := ioutil.ReadAll(input)
+	input.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	options := storage.ArtifactOptions{
+		MediaType:    paramArtifactMediaType,
+		ArtifactType: paramArtifactArtifactType,
+	}
+	artifact, err := m.CreateArtifact(paramID, paramNames, manifest, &options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(artifact) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", artifact.ID)
+	}
+	return 0
+}
+
+func addArtifactBlob(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	input, err := artifactInput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer input.Close()
+	blob, err := m.PutArtifactBlob(args[0], paramArtifactMediaType, input, digest.Digest(paramArtifactDigest))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(blob) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", blob.Digest)
+	}
+	return 0
+}
+
+func getArtifactBlob(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	d, err := digest.Parse(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	rc, err := m.ArtifactBlob(args[0], d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	defer rc.Close()
+	output := os.Stdout
+	if paramArtifactFile != "" {
+		f, err := os.Create(paramArtifactFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		output = f
+	}
+	_, err = io.Copy(output, rc)
+	output.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func deleteArtifact(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.DeleteArtifact(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"artifacts"},
+		optionsHelp: "[options [...]]",
+		usage:       "List artifacts",
+		action:      artifacts,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"artifact"},
+		optionsHelp: "[options [...]] artifactNameOrID [...]",
+		usage:       "Examine an artifact",
+		action:      artifact,
+		minArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"create-artifact", "createartifact"},
+		optionsHelp: "[options [...]]",
+		usage:       "Create a new artifact from a manifest",
+		action:      createArtifact,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Artifact name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Artifact ID")
+			flags.StringVar(&paramArtifactFile, []string{"-file", "f"}, "", "Read the manifest from file instead of stdin")
+			flags.StringVar(&paramArtifactMediaType, []string{"-media-type", "m"}, "", "Media type of the manifest")
+			flags.StringVar(&paramArtifactArtifactType, []string{"-artifact-type", "t"}, "", "Type of the artifact")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"add-artifact-blob", "addartifactblob"},
+		optionsHelp: "[options [...]] artifactNameOrID",
+		usage:       "Add a blob to an artifact",
+		action:      addArtifactBlob,
+		minArgs:     1,
+		maxArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&paramArtifactFile, []string{"-file", "f"}, "", "Read the blob from file instead of stdin")
+			flags.StringVar(&paramArtifactMediaType, []string{"-media-type", "m"}, "", "Media type of the blob")
+			flags.StringVar(&paramArtifactDigest, []string{"-digest", "d"}, "", "Expected digest of the blob")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"get-artifact-blob", "getartifactblob"},
+		optionsHelp: "[options [...]] artifactNameOrID digest",
+		usage:       "Retrieve an artifact's manifest or one of its blobs",
+		action:      getArtifactBlob,
+		minArgs:     2,
+		maxArgs:     2,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&paramArtifactFile, []string{"-file", "f"}, "", "Write to file instead of stdout")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"delete-artifact", "deleteartifact"},
+		optionsHelp: "[options [...]] artifactNameOrID [...]",
+		usage:       "Delete an artifact",
+		action:      deleteArtifact,
+		minArgs:     1,
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var paramCheckRepair = false
+
+func check(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.Check(&storage.CheckOptions{Repair: paramCheckRepair})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(report) != nil {
+			return 1
+		}
+	} else {
+		if len(report.Problems) == 0 {
+			fmt.Printf("no problems found\n")
+		}
+		for _, problem := range report.Problems {
+			fmt.Printf("%s\n", problem.String())
+		}
+	}
+	for _, problem := range report.Problems {
+		if !problem.Fixed {
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"check", "fsck"},
+		optionsHelp: "[options [...]]",
+		usage:       "Check the store for inconsistencies",
+		action:      check,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&paramCheckRepair, []string{"-repair", "r"}, paramCheckRepair, "Try to fix the problems that are found")
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+	"github.com/containers/storage/types"
+)
+
+var (
+	paramCloneImages        = []string{}
+	paramCloneDriver        = ""
+	paramCloneDriverOptions = []string{}
+	paramCloneNoReflink     = false
+	paramMoveDriver         = ""
+	paramMoveDriverOptions  = []string{}
+)
+
+func clone(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	options := types.StoreOptions{
+		GraphRoot:       args[0],
+		RunRoot:         args[1],
+		GraphDriverName: paramCloneDriver,
+	}
+	if len(paramCloneDriverOptions) > 0 {
+		options.GraphDriverOptions = paramCloneDriverOptions
+	}
+	cloneOptions := storage.CloneOptions{
+		Images:    paramCloneImages,
+		NoReflink: paramCloneNoReflink,
+	}
+	dest, err := m.CloneTo(options, &cloneOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if _, err := dest.Shutdown(false); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func moveContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	options := types.StoreOptions{
+		GraphRoot:       args[1],
+		RunRoot:         args[2],
+		GraphDriverName: paramMoveDriver,
+	}
+	if options.GraphDriverName == "" {
+		options.GraphDriverName = m.GraphDriverName()
+		options.GraphDriverOptions = m.GraphOptions()
+	}
+	if len(paramMoveDriverOptions) > 0 {
+		options.GraphDriverOptions = paramMoveDriverOptions
+	}
+	dest, err := storage.GetStore(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	defer func() {
+		if _, err := dest.Shutdown(false); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+		}
+	}()
+	container, err := m.MoveContainerLayer(args[0], dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(container) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", container.ID)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"clone"},
+		optionsHelp: "[options [...]] graphRoot runRoot",
+		usage:       "Copy the store's contents into a new store",
+		action:      clone,
+		minArgs:     2,
+		maxArgs:     2,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramCloneImages, nil), []string{"-image", "i"}, "Only copy the specified image and its layers")
+			flags.StringVar(&paramCloneDriver, []string{"-storage-driver", "s"}, "", "Storage driver for the new store")
+			flags.Var(opts.NewListOptsRef(&paramCloneDriverOptions, nil), []string{"-storage-opt"}, "Storage driver option for the new store")
+			flags.BoolVar(&paramCloneNoReflink, []string{"-no-reflink"}, paramCloneNoReflink, "Extract layer diffs instead of cloning layer contents")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"move-container"},
+		optionsHelp: "[options [...]] containerNameOrID graphRoot runRoot",
+		usage:       "Move a container and its layer into another store",
+		action:      moveContainer,
+		minArgs:     3,
+		maxArgs:     3,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&paramMoveDriver, []string{"-storage-driver", "s"}, "", "Storage driver for the other store")
+			flags.Var(opts.NewListOptsRef(&paramMoveDriverOptions, nil), []string{"-storage-opt"}, "Storage driver option for the other store")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
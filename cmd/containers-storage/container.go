@@ -1,9 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 
 	"github.com/containers/storage"
@@ -26,8 +25,10 @@ func container(flags *mflag.FlagSet, action string, m storage.Store, args []stri
 			matches = append(matches, container)
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(matches)
+	if structuredOutput() {
+		if writeStructured(matches) != nil {
+			return 1
+		}
 	} else {
 		for _, container := range matches {
 			fmt.Printf("ID: %s\n", container.ID)
@@ -68,8 +69,10 @@ func listContainerBigData(flags *mflag.FlagSet, action string, m storage.Store,
 		return 1
 	}
 	d, err := m.ListContainerBigData(container.ID)
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(d)
+	if structuredOutput() {
+		if writeStructured(d) != nil {
+			return 1
+		}
 	} else {
 		for _, name := range d {
 			fmt.Printf("%s\n", name)
@@ -93,13 +96,18 @@ func getContainerBigData(flags *mflag.FlagSet, action string, m storage.Store, a
 		}
 		output = f
 	}
-	b, err := m.ContainerBigData(container.ID, args[1])
+	rc, err := m.ContainerBigDataReader(container.ID, args[1])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	output.Write(b)
+	defer rc.Close()
+	_, err = io.Copy(output, rc)
 	output.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
 	return 0
 }
 
@@ -152,12 +160,7 @@ func setContainerBigData(flags *mflag.FlagSet, action string, m storage.Store, a
 		}
 		input = f
 	}
-	b, err := ioutil.ReadAll(input)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		return 1
-	}
-	err = m.SetContainerBigData(container.ID, args[1], b)
+	err = m.SetContainerBigDataFromReader(container.ID, args[1], input)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
@@ -198,7 +201,7 @@ func containerParentOwners(flags *mflag.FlagSet, action string, m storage.Store,
 			fmt.Fprintf(os.Stderr, "ContainerParentOwner: %+v\n", err)
 			return 1
 		}
-		if jsonOutput {
+		if structuredOutput() {
 			mappings := struct {
 				ID   string
 				UIDs []int
@@ -208,7 +211,9 @@ func containerParentOwners(flags *mflag.FlagSet, action string, m storage.Store,
 				UIDs: uids,
 				GIDs: gids,
 			}
-			json.NewEncoder(os.Stdout).Encode(mappings)
+			if writeStructured(mappings) != nil {
+				return 1
+			}
 		} else {
 			fmt.Printf("ID: %s\n", container.ID)
 			fmt.Printf("UIDs: %v\n", uids)
@@ -230,7 +235,7 @@ func init() {
 			action:      container,
 			minArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -241,7 +246,7 @@ func init() {
 			minArgs:     1,
 			maxArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -299,7 +304,7 @@ func init() {
 			action:      containerParentOwners,
 			minArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		})
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -15,8 +14,10 @@ func containers(flags *mflag.FlagSet, action string, m storage.Store, args []str
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(containers)
+	if structuredOutput() {
+		if writeStructured(containers) != nil {
+			return 1
+		}
 	} else {
 		for _, container := range containers {
 			fmt.Printf("%s\n", container.ID)
@@ -39,7 +40,7 @@ func init() {
 		action:      containers,
 		maxArgs:     0,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	paramConvertDriverOptions = []string{}
+	paramConvertRemove        = false
+	paramConvertQuiet         = false
+)
+
+func convertDriver(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	options := storage.ConvertDriverOptions{
+		DriverOptions: paramConvertDriverOptions,
+		RemoveSource:  paramConvertRemove,
+	}
+	if !paramConvertQuiet {
+		options.Progress = func(p storage.ConvertDriverProgress) {
+			fmt.Printf("[%d/%d] %s %s\n", p.Completed, p.Total, p.Kind, p.ID)
+		}
+	}
+	dest, err := m.ConvertDriver(args[0], &options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if _, err := dest.Shutdown(false); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"convert-driver"},
+		optionsHelp: "[options [...]] driver",
+		usage:       "Re-create the store's layers, images, and containers using another storage driver",
+		action:      convertDriver,
+		minArgs:     1,
+		maxArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramConvertDriverOptions, nil), []string{"-storage-opt"}, "Option for the new storage driver")
+			flags.BoolVar(&paramConvertRemove, []string{"-remove", "r"}, paramConvertRemove, "Remove everything from the current storage driver afterward")
+			flags.BoolVar(&paramConvertQuiet, []string{"-quiet", "q"}, paramConvertQuiet, "Don't report progress")
+		},
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -33,8 +32,25 @@ var (
 	paramSubGIDMap    = ""
 	paramReadOnly     = false
 	paramVolatile     = false
+	paramImageStore   = ""
+	paramSource       = ""
+	paramOperation    = ""
+	paramParent       = ""
 )
 
+// paramProvenance returns the provenance of a new layer, if --source or
+// --operation was used.
+func paramProvenance() *storage.LayerProvenance {
+	if paramSource == "" && paramOperation == "" {
+		return nil
+	}
+	return &storage.LayerProvenance{
+		Source:    paramSource,
+		Operation: paramOperation,
+		Tool:      "containers-storage",
+	}
+}
+
 func paramIDMapping() (*types.IDMappingOptions, error) {
 	options := types.IDMappingOptions{
 		HostUIDMapping: paramHostUIDMap,
@@ -83,14 +99,16 @@ func createLayer(flags *mflag.FlagSet, action string, m storage.Store, args []st
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return 1
 	}
-	options := &storage.LayerOptions{IDMappingOptions: *mappings}
+	options := &storage.LayerOptions{IDMappingOptions: *mappings, ImageStore: paramImageStore, Provenance: paramProvenance()}
 	layer, err := m.CreateLayer(paramID, parent, paramNames, paramMountLabel, !paramCreateRO, options)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(layer)
+	if structuredOutput() {
+		if writeStructured(layer) != nil {
+			return 1
+		}
 	} else {
 		fmt.Printf("%s\n", layer.ID)
 		for _, name := range layer.Names {
@@ -100,14 +118,37 @@ func createLayer(flags *mflag.FlagSet, action string, m storage.Store, args []st
 	return 0
 }
 
-func importLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	parent := ""
-	if len(args) > 0 {
+// importLayerSource sorts out which layer import-layer should use as the new
+// layer's parent, and where it should read the diff from, with "" or "-"
+// meaning stdin.  If the parent is specified using --parent, the argument, if
+// there is one, names the diff.  Otherwise it names the parent, unless it's
+// "-".
+func importLayerSource(parentFlag, file string, args []string) (parent, input string, err error) {
+	parent, input = parentFlag, file
+	if len(args) == 0 {
+		return parent, input, nil
+	}
+	switch {
+	case args[0] == "-" || parentFlag != "":
+		if input != "" && input != args[0] {
+			return "", "", fmt.Errorf("diff specified both as %q and using --file", args[0])
+		}
+		input = args[0]
+	default:
 		parent = args[0]
 	}
+	return parent, input, nil
+}
+
+func importLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	parent, input, err := importLayerSource(paramParent, applyDiffFile, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
 	diffStream := io.Reader(os.Stdin)
-	if applyDiffFile != "" {
-		f, err := os.Open(applyDiffFile)
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			return 1
@@ -120,19 +161,24 @@ func importLayer(flags *mflag.FlagSet, action string, m storage.Store, args []st
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return 1
 	}
-	options := &storage.LayerOptions{IDMappingOptions: *mappings}
+	options := &storage.LayerOptions{IDMappingOptions: *mappings, ImageStore: paramImageStore, Provenance: paramProvenance()}
 	layer, _, err := m.PutLayer(paramID, parent, paramNames, paramMountLabel, !paramCreateRO, options, diffStream)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(layer)
+	if structuredOutput() {
+		if writeStructured(layer) != nil {
+			return 1
+		}
 	} else {
 		fmt.Printf("%s\n", layer.ID)
 		for _, name := range layer.Names {
 			fmt.Printf("\t%s\n", name)
 		}
+		if layer.UncompressedDigest != "" {
+			fmt.Printf("\tdiff-id: %s\n", layer.UncompressedDigest)
+		}
 	}
 	return 0
 }
@@ -163,8 +209,10 @@ func createImage(flags *mflag.FlagSet, action string, m storage.Store, args []st
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(image)
+	if structuredOutput() {
+		if writeStructured(image) != nil {
+			return 1
+		}
 	} else {
 		fmt.Printf("%s\n", image.ID)
 		for _, name := range image.Names {
@@ -200,8 +248,10 @@ func createContainer(flags *mflag.FlagSet, action string, m storage.Store, args
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(container)
+	if structuredOutput() {
+		if writeStructured(container) != nil {
+			return 1
+		}
 	} else {
 		fmt.Printf("%s\n", container.ID)
 		for _, name := range container.Names {
@@ -211,6 +261,37 @@ func createContainer(flags *mflag.FlagSet, action string, m storage.Store, args
 	return 0
 }
 
+func snapshotContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	layer, err := m.SnapshotContainer(args[0], paramNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(layer) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", layer.ID)
+		for _, name := range layer.Names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+	return 0
+}
+
+func resetContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	snapshot := ""
+	if len(args) > 1 {
+		snapshot = args[1]
+	}
+	if err := m.ResetContainerLayer(args[0], snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
 func init() {
 	commands = append(commands, command{
 		names:       []string{"create-layer", "createlayer"},
@@ -223,7 +304,10 @@ func init() {
 			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
 			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Layer ID")
 			flags.BoolVar(&paramCreateRO, []string{"-readonly", "r"}, false, "Mark as read-only")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.StringVar(&paramImageStore, []string{"-image-store"}, "", "Writable image store to create the layer in")
+			flags.StringVar(&paramSource, []string{"-source"}, "", "Record where the layer's contents came from")
+			flags.StringVar(&paramOperation, []string{"-operation"}, "", "Record the operation which created the layer")
+			addOutputFlags(flags)
 			flags.BoolVar(&paramHostUIDMap, []string{"-hostuidmap"}, paramHostUIDMap, "Force host UID map")
 			flags.BoolVar(&paramHostGIDMap, []string{"-hostgidmap"}, paramHostGIDMap, "Force host GID map")
 			flags.StringVar(&paramUIDMap, []string{"-uidmap"}, "", "UID map")
@@ -234,7 +318,7 @@ func init() {
 	})
 	commands = append(commands, command{
 		names:       []string{"import-layer", "importlayer"},
-		optionsHelp: "[options [...]] [parentLayerNameOrID]",
+		optionsHelp: "[options [...]] [parentLayerNameOrID | -]",
 		usage:       "Import a new layer",
 		maxArgs:     1,
 		action:      importLayer,
@@ -243,8 +327,12 @@ func init() {
 			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
 			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Layer ID")
 			flags.BoolVar(&paramCreateRO, []string{"-readonly", "r"}, false, "Mark as read-only")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.StringVar(&paramImageStore, []string{"-image-store"}, "", "Writable image store to create the layer in")
+			flags.StringVar(&paramSource, []string{"-source"}, "", "Record where the layer's contents came from")
+			flags.StringVar(&paramOperation, []string{"-operation"}, "", "Record the operation which created the layer")
+			addOutputFlags(flags)
 			flags.StringVar(&applyDiffFile, []string{"-file", "f"}, "", "Read from file instead of stdin")
+			flags.StringVar(&paramParent, []string{"-parent", "p"}, "", "Parent layer")
 			flags.BoolVar(&paramHostUIDMap, []string{"-hostuidmap"}, paramHostUIDMap, "Force host UID map")
 			flags.BoolVar(&paramHostGIDMap, []string{"-hostgidmap"}, paramHostGIDMap, "Force host GID map")
 			flags.StringVar(&paramUIDMap, []string{"-uidmap"}, "", "UID map")
@@ -266,7 +354,7 @@ func init() {
 			flags.StringVar(&paramDigest, []string{"-digest", "d"}, "", "Image Digest")
 			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
 			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -282,7 +370,7 @@ func init() {
 			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Container ID")
 			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
 			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 			flags.BoolVar(&paramHostUIDMap, []string{"-hostuidmap"}, paramHostUIDMap, "Force host UID map")
 			flags.BoolVar(&paramHostGIDMap, []string{"-hostgidmap"}, paramHostGIDMap, "Force host GID map")
 			flags.StringVar(&paramUIDMap, []string{"-uidmap"}, "", "UID map")
@@ -291,4 +379,24 @@ func init() {
 			flags.StringVar(&paramSubGIDMap, []string{"-subgidmap"}, "", "subgid GID map for a group")
 		},
 	})
+	commands = append(commands, command{
+		names:       []string{"snapshot-container", "snapshotcontainer"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Move a container's changes into a new layer",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      snapshotContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Layer name")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"reset-container", "resetcontainer"},
+		optionsHelp: "containerNameOrID [snapshotLayerNameOrID]",
+		usage:       "Discard a container's changes",
+		minArgs:     1,
+		maxArgs:     2,
+		action:      resetContainer,
+	})
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportLayerSource(t *testing.T) {
+	for _, c := range []struct {
+		parentFlag, file string
+		args             []string
+		parent, input    string
+	}{
+		{},
+		{args: []string{"base"}, parent: "base"},
+		{args: []string{"-"}, input: "-"},
+		{file: "layer.tar", args: []string{"base"}, parent: "base", input: "layer.tar"},
+		{parentFlag: "base", parent: "base"},
+		{parentFlag: "base", args: []string{"-"}, parent: "base", input: "-"},
+		{parentFlag: "base", args: []string{"layer.tar"}, parent: "base", input: "layer.tar"},
+		{parentFlag: "base", file: "layer.tar", args: []string{"layer.tar"}, parent: "base", input: "layer.tar"},
+	} {
+		parent, input, err := importLayerSource(c.parentFlag, c.file, c.args)
+		require.NoError(t, err, "%+v", c)
+		assert.Equal(t, c.parent, parent, "%+v", c)
+		assert.Equal(t, c.input, input, "%+v", c)
+	}
+
+	_, _, err := importLayerSource("", "layer.tar", []string{"-"})
+	assert.Error(t, err)
+	_, _, err = importLayerSource("base", "layer.tar", []string{"other.tar"})
+	assert.Error(t, err)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -24,8 +23,10 @@ func deleteThing(flags *mflag.FlagSet, action string, m storage.Store, args []st
 			deleted[what] = ""
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(deleted)
+	if structuredOutput() {
+		if writeStructured(deleted) != nil {
+			return 1
+		}
 	} else {
 		for what, err := range deleted {
 			if err != "" {
@@ -54,8 +55,10 @@ func deleteLayer(flags *mflag.FlagSet, action string, m storage.Store, args []st
 			deleted[what] = ""
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(deleted)
+	if structuredOutput() {
+		if writeStructured(deleted) != nil {
+			return 1
+		}
 	} else {
 		for what, err := range deleted {
 			if err != "" {
@@ -92,8 +95,10 @@ func deleteImage(flags *mflag.FlagSet, action string, m storage.Store, args []st
 			Error:         errText,
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(deleted)
+	if structuredOutput() {
+		if writeStructured(deleted) != nil {
+			return 1
+		}
 	} else {
 		for what, record := range deleted {
 			if record.Error != "" {
@@ -126,8 +131,10 @@ func deleteContainer(flags *mflag.FlagSet, action string, m storage.Store, args
 			deleted[what] = ""
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(deleted)
+	if structuredOutput() {
+		if writeStructured(deleted) != nil {
+			return 1
+		}
 	} else {
 		for what, err := range deleted {
 			if err != "" {
@@ -151,7 +158,7 @@ func init() {
 		minArgs:     1,
 		action:      deleteThing,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -161,7 +168,7 @@ func init() {
 		minArgs:     1,
 		action:      deleteLayer,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -172,7 +179,7 @@ func init() {
 		action:      deleteImage,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&testDeleteImage, []string{"-test", "t"}, jsonOutput, "Only test removal")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -182,7 +189,7 @@ func init() {
 		minArgs:     1,
 		action:      deleteContainer,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
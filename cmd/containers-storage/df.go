@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+	units "github.com/docker/go-units"
+)
+
+// dfLayer describes the disk space used by a layer.
+type dfLayer struct {
+	ID      string `json:"id"`
+	Parent  string `json:"parent,omitempty"`
+	Size    int64  `json:"size"`
+	Users   int    `json:"users"`
+	Mounted bool   `json:"mounted"`
+}
+
+// dfUser describes the disk space used by the layers that an image or a
+// container depends on.  Space used by layers which nothing else depends on
+// is "exclusive", and would be freed if the image or container was deleted,
+// while space used by layers which other images or containers also depend on
+// is "shared".
+type dfUser struct {
+	ID        string   `json:"id"`
+	Names     []string `json:"names,omitempty"`
+	Image     string   `json:"image,omitempty"`
+	Layers    int      `json:"layers"`
+	Size      int64    `json:"size"`
+	Shared    int64    `json:"shared"`
+	Exclusive int64    `json:"exclusive"`
+	Mounted   bool     `json:"mounted"`
+}
+
+// dfSummary describes the disk space used by everything in the store.
+type dfSummary struct {
+	Images     []dfUser  `json:"images"`
+	Containers []dfUser  `json:"containers"`
+	Layers     []dfLayer `json:"layers"`
+	Total      int64     `json:"total"`
+	// Unused is the space used by layers which no image or container
+	// depends on.
+	Unused int64 `json:"unused"`
+}
+
+// layerDiskUsage returns the size of the layer's contents, or -1 if it can't
+// be computed.
+func layerDiskUsage(m storage.Store, layer *storage.Layer) int64 {
+	// The UncompressedSize is only valid if there's a digest to go with it.
+	if layer.UncompressedDigest != "" && layer.UncompressedSize >= 0 {
+		return layer.UncompressedSize
+	}
+	if size, err := m.LayerSize(layer.ID); err == nil && size >= 0 {
+		return size
+	}
+	if size, err := m.DiffSize("", layer.ID); err == nil {
+		return size
+	}
+	return -1
+}
+
+// diskUsage computes how the space used by the layers is divided among the
+// images and containers.  Layers whose sizes are unknown are treated as if
+// they were empty.
+func diskUsage(layers []storage.Layer, images []storage.Image, containers []storage.Container, layerSize func(*storage.Layer) int64) *dfSummary {
+	byID := make(map[string]*storage.Layer)
+	for i := range layers {
+		byID[layers[i].ID] = &layers[i]
+	}
+	sizes := make(map[string]int64)
+	for i := range layers {
+		if size := layerSize(&layers[i]); size > 0 {
+			sizes[layers[i].ID] = size
+		}
+	}
+
+	// chain returns the set of layers which a list of top layers depend on.
+	chain := func(topLayers ...string) map[string]struct{} {
+		set := make(map[string]struct{})
+		for _, id := range topLayers {
+			for id != "" {
+				if _, ok := set[id]; ok {
+					break
+				}
+				layer, ok := byID[id]
+				if !ok {
+					break
+				}
+				set[id] = struct{}{}
+				id = layer.Parent
+			}
+		}
+		return set
+	}
+
+	users := make(map[string]int)
+	imageLayers := make([]map[string]struct{}, len(images))
+	for i, image := range images {
+		imageLayers[i] = chain(append([]string{image.TopLayer}, image.MappedTopLayers...)...)
+		for id := range imageLayers[i] {
+			users[id]++
+		}
+	}
+	containerLayers := make([]map[string]struct{}, len(containers))
+	for i, container := range containers {
+		containerLayers[i] = chain(container.LayerID)
+		for id := range containerLayers[i] {
+			users[id]++
+		}
+	}
+
+	account := func(user *dfUser, set map[string]struct{}) {
+		user.Layers = len(set)
+		for id := range set {
+			size := sizes[id]
+			user.Size += size
+			if users[id] > 1 {
+				user.Shared += size
+			} else {
+				user.Exclusive += size
+			}
+		}
+	}
+
+	summary := &dfSummary{
+		Images:     make([]dfUser, 0, len(images)),
+		Containers: make([]dfUser, 0, len(containers)),
+		Layers:     make([]dfLayer, 0, len(layers)),
+	}
+	for i, image := range images {
+		user := dfUser{ID: image.ID, Names: image.Names}
+		account(&user, imageLayers[i])
+		if layer, ok := byID[image.TopLayer]; ok && layer.MountCount > 0 {
+			user.Mounted = true
+		}
+		summary.Images = append(summary.Images, user)
+	}
+	for i, container := range containers {
+		user := dfUser{ID: container.ID, Names: container.Names, Image: container.ImageID}
+		account(&user, containerLayers[i])
+		if layer, ok := byID[container.LayerID]; ok && layer.MountCount > 0 {
+			user.Mounted = true
+		}
+		summary.Containers = append(summary.Containers, user)
+	}
+	for _, layer := range layers {
+		size := sizes[layer.ID]
+		summary.Layers = append(summary.Layers, dfLayer{
+			ID:      layer.ID,
+			Parent:  layer.Parent,
+			Size:    size,
+			Users:   users[layer.ID],
+			Mounted: layer.MountCount > 0,
+		})
+		summary.Total += size
+		if users[layer.ID] == 0 {
+			summary.Unused += size
+		}
+	}
+	sort.Slice(summary.Layers, func(i, j int) bool {
+		return summary.Layers[i].Size > summary.Layers[j].Size
+	})
+	return summary
+}
+
+func df(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	layers, err := m.Layers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	images, err := m.Images()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	containers, err := m.Containers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	summary := diskUsage(layers, images, containers, func(layer *storage.Layer) int64 {
+		return layerDiskUsage(m, layer)
+	})
+	if structuredOutput() {
+		if writeStructured(summary) != nil {
+			return 1
+		}
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	size := func(n int64) string {
+		return units.HumanSize(float64(n))
+	}
+	mounted := func(isMounted bool) string {
+		if isMounted {
+			return "yes"
+		}
+		return "no"
+	}
+	name := func(names []string) string {
+		if len(names) == 0 {
+			return "<none>"
+		}
+		return names[0]
+	}
+	fmt.Fprintf(w, "IMAGE ID\tNAME\tLAYERS\tSIZE\tSHARED\tEXCLUSIVE\tMOUNTED\n")
+	for _, image := range summary.Images {
+		fmt.Fprintf(w, "%.12s\t%s\t%d\t%s\t%s\t%s\t%s\n", image.ID, name(image.Names), image.Layers, size(image.Size), size(image.Shared), size(image.Exclusive), mounted(image.Mounted))
+	}
+	fmt.Fprintf(w, "\nCONTAINER ID\tNAME\tIMAGE ID\tSIZE\tSHARED\tEXCLUSIVE\tMOUNTED\n")
+	for _, container := range summary.Containers {
+		fmt.Fprintf(w, "%.12s\t%s\t%.12s\t%s\t%s\t%s\t%s\n", container.ID, name(container.Names), container.Image, size(container.Size), size(container.Shared), size(container.Exclusive), mounted(container.Mounted))
+	}
+	fmt.Fprintf(w, "\nLAYER ID\tPARENT ID\tSIZE\tUSERS\tMOUNTED\n")
+	for _, layer := range summary.Layers {
+		fmt.Fprintf(w, "%.12s\t%.12s\t%s\t%d\t%s\n", layer.ID, layer.Parent, size(layer.Size), layer.Users, mounted(layer.Mounted))
+	}
+	fmt.Fprintf(w, "\nTOTAL\t%s\n", size(summary.Total))
+	fmt.Fprintf(w, "UNUSED\t%s\n", size(summary.Unused))
+	w.Flush()
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"df"},
+		optionsHelp: "[options [...]]",
+		usage:       "Show disk usage of images, containers, and layers",
+		action:      df,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/containers/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskUsage(t *testing.T) {
+	layers := []storage.Layer{
+		{ID: "base"},
+		{ID: "app", Parent: "base"},
+		{ID: "other", Parent: "base"},
+		{ID: "rw", Parent: "app", MountCount: 1},
+		{ID: "orphan"},
+	}
+	images := []storage.Image{
+		{ID: "image1", Names: []string{"app"}, TopLayer: "app"},
+		{ID: "image2", TopLayer: "other"},
+	}
+	containers := []storage.Container{
+		{ID: "container", ImageID: "image1", LayerID: "rw"},
+	}
+	sizes := map[string]int64{"base": 100, "app": 20, "other": 30, "rw": 4, "orphan": 5}
+	summary := diskUsage(layers, images, containers, func(layer *storage.Layer) int64 {
+		return sizes[layer.ID]
+	})
+
+	assert.Equal(t, []dfUser{
+		{ID: "image1", Names: []string{"app"}, Layers: 2, Size: 120, Shared: 120},
+		{ID: "image2", Layers: 2, Size: 130, Shared: 100, Exclusive: 30},
+	}, summary.Images)
+	assert.Equal(t, []dfUser{
+		{ID: "container", Image: "image1", Layers: 3, Size: 124, Shared: 120, Exclusive: 4, Mounted: true},
+	}, summary.Containers)
+	assert.Equal(t, int64(159), summary.Total)
+	assert.Equal(t, int64(5), summary.Unused)
+	users := make(map[string]int)
+	for _, layer := range summary.Layers {
+		users[layer.ID] = layer.Users
+		assert.Equal(t, layer.ID == "rw", layer.Mounted, layer.ID)
+	}
+	assert.Equal(t, map[string]int{"base": 3, "app": 2, "other": 1, "rw": 1, "orphan": 0}, users)
+	assert.Equal(t, "base", summary.Layers[0].ID, "layers should be sorted by size")
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/archive"
@@ -13,11 +14,17 @@ import (
 
 var (
 	applyDiffFile    = ""
+	applyDirMove     = false
+	changesFile      = ""
 	diffFile         = ""
 	diffUncompressed = false
 	diffGzip         = false
 	diffBzip2        = false
 	diffXz           = false
+	diffZstd         = false
+	diffLevel        = 0
+	diffReproducible = false
+	diffEpoch        = ""
 )
 
 func changes(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
@@ -28,14 +35,29 @@ func changes(flags *mflag.FlagSet, action string, m storage.Store, args []string
 	from := ""
 	if len(args) >= 2 {
 		from = args[1]
+		// The library quietly compares the layer to its parent if it
+		// doesn't know about the reference layer, but someone who
+		// named one wouldn't expect that.
+		if _, err := m.Layer(from); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
 	}
 	changes, err := m.Changes(from, to)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(changes)
+	if changesFile != "" {
+		if err := writeChanges(m, from, to, changesFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	if structuredOutput() {
+		if writeStructured(changes) != nil {
+			return 1
+		}
 	} else {
 		for _, change := range changes {
 			what := "?"
@@ -53,6 +75,26 @@ func changes(flags *mflag.FlagSet, action string, m storage.Store, args []string
 	return 0
 }
 
+// writeChanges writes an uncompressed tarstream which contains the changes
+// between two layers to a file.
+func writeChanges(m storage.Store, from, to, file string) error {
+	uncompressed := archive.Uncompressed
+	reader, err := m.Diff(from, to, &storage.DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, reader); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func diff(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
 	if len(args) < 1 {
 		return 1
@@ -74,7 +116,7 @@ func diff(flags *mflag.FlagSet, action string, m storage.Store, args []string) i
 	}
 
 	options := storage.DiffOptions{}
-	if diffUncompressed || diffGzip || diffBzip2 || diffXz {
+	if diffUncompressed || diffGzip || diffBzip2 || diffXz || diffZstd {
 		c := archive.Uncompressed
 		if diffGzip {
 			c = archive.Gzip
@@ -85,8 +127,29 @@ func diff(flags *mflag.FlagSet, action string, m storage.Store, args []string) i
 		if diffXz {
 			c = archive.Xz
 		}
+		if diffZstd {
+			c = archive.Zstd
+		}
 		options.Compression = &c
 	}
+	if diffLevel != 0 {
+		options.CompressionOptions = &archive.CompressionOptions{Level: diffLevel}
+	}
+	if diffReproducible {
+		options.Reproducible = true
+		if diffEpoch == "" {
+			diffEpoch = os.Getenv("SOURCE_DATE_EPOCH")
+		}
+		if diffEpoch != "" {
+			seconds, err := strconv.ParseInt(diffEpoch, 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error parsing source date epoch %q: %v\n", diffEpoch, err)
+				return 1
+			}
+			epoch := time.Unix(seconds, 0)
+			options.SourceDateEpoch = &epoch
+		}
+	}
 
 	reader, err := m.Diff(from, to, &options)
 	if err != nil {
@@ -124,6 +187,21 @@ func applyDiff(flags *mflag.FlagSet, action string, m storage.Store, args []stri
 	return 0
 }
 
+func applyDirectory(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if len(args) < 2 {
+		return 1
+	}
+	options := storage.ApplyDirectoryOptions{
+		Move: applyDirMove,
+	}
+	_, err := m.ApplyDirectory(args[0], args[1], &options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
 func diffSize(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
 	if len(args) < 1 {
 		return 1
@@ -151,7 +229,8 @@ func init() {
 		maxArgs:     2,
 		action:      changes,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.StringVar(&changesFile, []string{"-file", "f"}, "", "Also write the changes to file as a tar archive")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -175,6 +254,10 @@ func init() {
 			flags.BoolVar(&diffGzip, []string{"-gzip", "c"}, diffGzip, "Compress using gzip")
 			flags.BoolVar(&diffBzip2, []string{"-bzip2", "-bz2", "b"}, diffBzip2, "Compress using bzip2 (not currently supported)")
 			flags.BoolVar(&diffXz, []string{"-xz", "x"}, diffXz, "Compress using xz (not currently supported)")
+			flags.BoolVar(&diffZstd, []string{"-zstd", "z"}, diffZstd, "Compress using zstd")
+			flags.IntVar(&diffLevel, []string{"-level"}, diffLevel, "Compression level for gzip or zstd")
+			flags.BoolVar(&diffReproducible, []string{"-reproducible"}, diffReproducible, "Normalize timestamps and ownership names for reproducible output")
+			flags.StringVar(&diffEpoch, []string{"-source-date-epoch"}, "", "Clamp timestamps to this many seconds since the epoch (default $SOURCE_DATE_EPOCH)")
 		},
 	})
 	commands = append(commands, command{
@@ -188,4 +271,15 @@ func init() {
 			flags.StringVar(&applyDiffFile, []string{"-file", "f"}, "", "Read from file instead of stdin")
 		},
 	})
+	commands = append(commands, command{
+		names:       []string{"applydirectory", "apply-directory"},
+		optionsHelp: "[options [...]] layerNameOrID directory",
+		usage:       "Apply the contents of a directory to a layer",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      applyDirectory,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&applyDirMove, []string{"-move", "m"}, applyDirMove, "Move the directory's contents into the layer instead of copying them")
+		},
+	})
 }
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 
 	"github.com/containers/storage"
 	"github.com/containers/storage/pkg/mflag"
@@ -44,8 +42,10 @@ func exist(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			anyMissing = true
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(existDict)
+	if structuredOutput() {
+		if writeStructured(existDict) != nil {
+			return 1
+		}
 	} else {
 		if !existQuiet {
 			for what, exists := range existDict {
@@ -71,7 +71,7 @@ func init() {
 			flags.BoolVar(&existLayer, []string{"-layer", "l"}, existQuiet, "Only succeed if the match is a layer")
 			flags.BoolVar(&existImage, []string{"-image", "i"}, existQuiet, "Only succeed if the match is an image")
 			flags.BoolVar(&existContainer, []string{"-container", "c"}, existQuiet, "Only succeed if the match is a container")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
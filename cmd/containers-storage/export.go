@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	exportImageFile = ""
+	importImageFile = ""
+)
+
+func exportImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if len(args) < 1 {
+		return 1
+	}
+	output := io.Writer(os.Stdout)
+	if exportImageFile != "" {
+		f, err := os.Create(exportImageFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+		output = f
+		defer f.Close()
+	}
+	if err := m.ExportImage(args[0], output); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func importImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	input := io.Reader(os.Stdin)
+	if importImageFile != "" {
+		f, err := os.Open(importImageFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		input = f
+		defer f.Close()
+	}
+	image, err := m.ImportImage(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(image) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", image.ID)
+		for _, name := range image.Names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"export-image", "exportimage"},
+		usage:       "Write an image and its layers to an OCI image layout archive",
+		optionsHelp: "[options [...]] imageNameOrID",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      exportImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&exportImageFile, []string{"-file", "f"}, "", "Write to file instead of stdout")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"import-image", "importimage"},
+		usage:       "Read an image and its layers from an OCI image layout archive",
+		optionsHelp: "[options [...]]",
+		maxArgs:     0,
+		action:      importImage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&importImageFile, []string{"-file", "f"}, "", "Read from file instead of stdin")
+			addOutputFlags(flags)
+		},
+	})
+}
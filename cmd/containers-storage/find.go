@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func findPath(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	changes, err := m.FindPath(args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(changes) != nil {
+			return 1
+		}
+		return 0
+	}
+	for _, change := range changes {
+		what := "modified"
+		switch change.Kind {
+		case archive.ChangeAdd:
+			what = "added"
+		case archive.ChangeDelete:
+			what = "removed"
+		}
+		fmt.Printf("%s %s %s\n", change.Layer, what, change.Path)
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"find"},
+		optionsHelp: "[options [...]] ImageOrContainerOrLayerNameOrID PathPattern",
+		usage:       "Find the layers which add, modify, or remove paths",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      findPath,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 
@@ -12,7 +12,8 @@ import (
 )
 
 var (
-	paramImageDataFile = ""
+	paramImageDataFile       = ""
+	paramAttachmentMediaType = ""
 )
 
 func image(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
@@ -22,8 +23,10 @@ func image(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			matched = append(matched, image)
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(matched)
+	if structuredOutput() {
+		if writeStructured(matched) != nil {
+			return 1
+		}
 	} else {
 		for _, image := range matched {
 			fmt.Printf("ID: %s\n", image.ID)
@@ -64,8 +67,10 @@ func listImageBigData(flags *mflag.FlagSet, action string, m storage.Store, args
 		return 1
 	}
 	d, err := m.ListImageBigData(image.ID)
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(d)
+	if structuredOutput() {
+		if writeStructured(d) != nil {
+			return 1
+		}
 	} else {
 		for _, name := range d {
 			fmt.Printf("%s\n", name)
@@ -89,13 +94,18 @@ func getImageBigData(flags *mflag.FlagSet, action string, m storage.Store, args
 		}
 		output = f
 	}
-	b, err := m.ImageBigData(image.ID, args[1])
+	rc, err := m.ImageBigDataReader(image.ID, args[1])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	output.Write(b)
+	defer rc.Close()
+	_, err = io.Copy(output, rc)
 	output.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
 	return 0
 }
 
@@ -152,12 +162,104 @@ func setImageBigData(flags *mflag.FlagSet, action string, m storage.Store, args
 		}
 		input = f
 	}
-	b, err := ioutil.ReadAll(input)
+	err = m.SetImageBigDataFromReader(image.ID, args[1], input, wrongManifestDigest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func listImageAttachments(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	image, err := m.Image(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	kind := storage.ImageAttachmentKind("")
+	if len(args) > 1 {
+		kind = storage.ImageAttachmentKind(args[1])
+	}
+	attachments, err := m.ImageAttachments(image.ID, kind)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(attachments) != nil {
+			return 1
+		}
+	} else {
+		for _, attachment := range attachments {
+			fmt.Printf("%s\t%s\t%d\t%s\n", attachment.Kind, attachment.Digest, attachment.Size, attachment.MediaType)
+		}
+	}
+	return 0
+}
+
+func addImageAttachment(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	image, err := m.Image(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	input := os.Stdin
+	if paramImageDataFile != "" {
+		f, err := os.Open(paramImageDataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		input = f
+	}
+	data, err := ioutil.ReadAll(input)
+	input.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	attachment, err := m.AddImageAttachment(image.ID, storage.ImageAttachmentKind(args[1]), paramAttachmentMediaType, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(attachment) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", attachment.Digest)
+	}
+	return 0
+}
+
+func getImageAttachment(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	image, err := m.Image(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	d, err := digest.Parse(args[2])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return 1
 	}
-	err = m.SetImageBigData(image.ID, args[1], b, wrongManifestDigest)
+	data, err := m.ImageAttachmentData(image.ID, storage.ImageAttachmentKind(args[1]), d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	output := os.Stdout
+	if paramImageDataFile != "" {
+		f, err := os.Create(paramImageDataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		output = f
+	}
+	_, err = output.Write(data)
+	output.Close()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return 1
@@ -165,6 +267,24 @@ func setImageBigData(flags *mflag.FlagSet, action string, m storage.Store, args
 	return 0
 }
 
+func removeImageAttachment(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	image, err := m.Image(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	d, err := digest.Parse(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if err := m.RemoveImageAttachment(image.ID, storage.ImageAttachmentKind(args[1]), d); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
 func init() {
 	commands = append(commands,
 		command{
@@ -174,7 +294,7 @@ func init() {
 			action:      image,
 			minArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -185,7 +305,7 @@ func init() {
 			minArgs:     1,
 			maxArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -221,5 +341,48 @@ func init() {
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
 				flags.StringVar(&paramImageDataFile, []string{"-file", "f"}, paramImageDataFile, "Read data from file")
 			},
+		},
+		command{
+			names:       []string{"list-image-attachments", "listimageattachments"},
+			optionsHelp: "[options [...]] imageNameOrID [kind]",
+			usage:       "List signatures, SBOMs, and other attachments of an image",
+			action:      listImageAttachments,
+			minArgs:     1,
+			maxArgs:     2,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				addOutputFlags(flags)
+			},
+		},
+		command{
+			names:       []string{"add-image-attachment", "addimageattachment"},
+			optionsHelp: "[options [...]] imageNameOrID kind",
+			usage:       "Add a signature, SBOM, or other attachment to an image",
+			action:      addImageAttachment,
+			minArgs:     2,
+			maxArgs:     2,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				flags.StringVar(&paramImageDataFile, []string{"-file", "f"}, paramImageDataFile, "Read data from file")
+				flags.StringVar(&paramAttachmentMediaType, []string{"-media-type", "m"}, paramAttachmentMediaType, "Media type of the data")
+				addOutputFlags(flags)
+			},
+		},
+		command{
+			names:       []string{"get-image-attachment", "getimageattachment"},
+			optionsHelp: "[options [...]] imageNameOrID kind digest",
+			usage:       "Get an attachment of an image",
+			action:      getImageAttachment,
+			minArgs:     3,
+			maxArgs:     3,
+			addFlags: func(flags *mflag.FlagSet, cmd *command) {
+				flags.StringVar(&paramImageDataFile, []string{"-file", "f"}, paramImageDataFile, "Write data to file")
+			},
+		},
+		command{
+			names:       []string{"remove-image-attachment", "removeimageattachment"},
+			optionsHelp: "[options [...]] imageNameOrID kind digest",
+			usage:       "Remove an attachment from an image",
+			action:      removeImageAttachment,
+			minArgs:     3,
+			maxArgs:     3,
 		})
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -20,8 +19,10 @@ func images(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(images)
+	if structuredOutput() {
+		if writeStructured(images) != nil {
+			return 1
+		}
 	} else {
 		for _, image := range images {
 			fmt.Printf("%s\n", image.ID)
@@ -59,8 +60,10 @@ func imagesByDigest(flags *mflag.FlagSet, action string, m storage.Store, args [
 			images = append(images, match)
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(images)
+	if structuredOutput() {
+		if writeStructured(images) != nil {
+			return 1
+		}
 	} else {
 		for _, image := range images {
 			fmt.Printf("%s\n", image.ID)
@@ -89,7 +92,7 @@ func init() {
 		action:      images,
 		maxArgs:     0,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 			flags.BoolVar(&imagesQuiet, []string{"-quiet", "q"}, imagesQuiet, "Only print IDs")
 		},
 	})
@@ -101,7 +104,7 @@ func init() {
 		minArgs:     1,
 		maxArgs:     1,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 			flags.BoolVar(&imagesQuiet, []string{"-quiet", "q"}, imagesQuiet, "Only print IDs")
 		},
 	})
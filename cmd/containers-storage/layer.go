@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -21,8 +20,10 @@ func listLayerBigData(flags *mflag.FlagSet, action string, m storage.Store, args
 		return 1
 	}
 	d, err := m.ListLayerBigData(layer.ID)
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(d)
+	if structuredOutput() {
+		if writeStructured(d) != nil {
+			return 1
+		}
 	} else {
 		for _, name := range d {
 			fmt.Printf("%s\n", name)
@@ -89,8 +90,10 @@ func layer(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			matched = append(matched, layer)
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(matched)
+	if structuredOutput() {
+		if writeStructured(matched) != nil {
+			return 1
+		}
 	} else {
 		for _, layer := range matched {
 			fmt.Printf("ID: %s\n", layer.ID)
@@ -109,6 +112,17 @@ func layer(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			if layer.ReadOnly {
 				fmt.Printf("Read Only: true\n")
 			}
+			if p := layer.Provenance; p != nil {
+				if p.Source != "" {
+					fmt.Printf("Source: %s\n", p.Source)
+				}
+				if p.Operation != "" {
+					fmt.Printf("Operation: %s\n", p.Operation)
+				}
+				if p.Tool != "" {
+					fmt.Printf("Tool: %s\n", p.Tool)
+				}
+			}
 		}
 	}
 	if len(matched) != len(args) {
@@ -130,7 +144,7 @@ func layerParentOwners(flags *mflag.FlagSet, action string, m storage.Store, arg
 			fmt.Fprintf(os.Stderr, "LayerParentOwner: %+v\n", err)
 			return 1
 		}
-		if jsonOutput {
+		if structuredOutput() {
 			mappings := struct {
 				ID   string
 				UIDs []int
@@ -140,7 +154,9 @@ func layerParentOwners(flags *mflag.FlagSet, action string, m storage.Store, arg
 				UIDs: uids,
 				GIDs: gids,
 			}
-			json.NewEncoder(os.Stdout).Encode(mappings)
+			if writeStructured(mappings) != nil {
+				return 1
+			}
 		} else {
 			fmt.Printf("ID: %s\n", layer.ID)
 			if len(uids) > 0 {
@@ -166,7 +182,7 @@ func init() {
 			action:      layer,
 			minArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -176,7 +192,7 @@ func init() {
 			action:      layerParentOwners,
 			minArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
@@ -187,7 +203,7 @@ func init() {
 			minArgs:     1,
 			maxArgs:     1,
 			addFlags: func(flags *mflag.FlagSet, cmd *command) {
-				flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+				addOutputFlags(flags)
 			},
 		},
 		command{
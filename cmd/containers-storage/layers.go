@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -17,8 +16,10 @@ func layers(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(layers)
+	if structuredOutput() {
+		if writeStructured(layers) != nil {
+			return 1
+		}
 		return 0
 	}
 	imageMap := make(map[string]*[]storage.Image)
@@ -109,7 +110,7 @@ func init() {
 		maxArgs:     0,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&listLayersTree, []string{"-tree", "t"}, listLayersTree, "Use a tree")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
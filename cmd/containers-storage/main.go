@@ -40,6 +40,8 @@ func main() {
 		flags := mflag.NewFlagSet(command, eh)
 		flags.StringVar(&options.RunRoot, []string{"-run", "R"}, options.RunRoot, "Root of the runtime state tree")
 		flags.StringVar(&options.GraphRoot, []string{"-graph", "g"}, options.GraphRoot, "Root of the storage tree")
+		flags.StringVar(&options.TempDir, []string{"-tempdir"}, options.TempDir, "Location for temporary files")
+		flags.StringVar(&options.Namespace, []string{"-namespace"}, options.Namespace, "Namespace for image and container records")
 		flags.StringVar(&options.GraphDriverName, []string{"-storage-driver", "s"}, options.GraphDriverName, "Storage driver to use ($STORAGE_DRIVER)")
 		flags.Var(opts.NewListOptsRef(&options.GraphDriverOptions, nil), []string{"-storage-opt"}, "Set storage driver options ($STORAGE_OPTS)")
 		flags.BoolVar(&debug, []string{"-debug", "D"}, debug, "Print debugging information")
@@ -68,7 +70,14 @@ func main() {
 	}
 
 	if options.GraphRoot == "" && options.RunRoot == "" && options.GraphDriverName == "" && len(options.GraphDriverOptions) == 0 {
+		tempDir, namespace := options.TempDir, options.Namespace
 		options, _ = types.DefaultStoreOptionsAutoDetectUID()
+		if tempDir != "" {
+			options.TempDir = tempDir
+		}
+		if namespace != "" {
+			options.Namespace = namespace
+		}
 	}
 	args := flags.Args()
 	if len(args) < 1 {
@@ -111,6 +120,9 @@ func main() {
 					logrus.SetLevel(logrus.DebugLevel)
 					logrus.Debugf("Root: %s", options.GraphRoot)
 					logrus.Debugf("Run Root: %s", options.RunRoot)
+					if options.TempDir != "" {
+						logrus.Debugf("Temporary Directory: %s", options.TempDir)
+					}
 					logrus.Debugf("Driver Name: %s", options.GraphDriverName)
 					logrus.Debugf("Driver Options: %s", options.GraphDriverOptions)
 				} else {
@@ -122,7 +134,9 @@ func main() {
 					os.Exit(1)
 				}
 				store.Free()
-				os.Exit(command.action(flags, cmd, store, args))
+				status := command.action(flags, cmd, store, args)
+				store.WaitForDeletions()
+				os.Exit(status)
 				break
 			}
 		}
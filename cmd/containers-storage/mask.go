@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func maskImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.MaskImage(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func unmaskImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.UnmaskImage(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func maskedImages(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	masked, err := m.MaskedImages()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(masked) != nil {
+			return 1
+		}
+	} else {
+		for _, id := range masked {
+			fmt.Printf("%s\n", id)
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"mask-image", "maskimage"},
+		optionsHelp: "imageNameOrID [...]",
+		usage:       "Hide images which are in additional image stores",
+		minArgs:     1,
+		action:      maskImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"unmask-image", "unmaskimage"},
+		optionsHelp: "imageID [...]",
+		usage:       "Stop hiding images which are in additional image stores",
+		minArgs:     1,
+		action:      unmaskImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"masked-images", "maskedimages"},
+		optionsHelp: "[options [...]]",
+		usage:       "List images in additional image stores which are hidden",
+		action:      maskedImages,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -26,8 +25,10 @@ func metadata(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 			missingAny = true
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(metadataDict)
+	if structuredOutput() {
+		if writeStructured(metadataDict) != nil {
+			return 1
+		}
 	} else {
 		for _, what := range args {
 			if metadataQuiet {
@@ -80,7 +81,7 @@ func init() {
 		action:      metadata,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&metadataQuiet, []string{"-quiet", "q"}, metadataQuiet, "Omit names and IDs")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
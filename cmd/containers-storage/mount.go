@@ -1,11 +1,11 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
 	"github.com/containers/storage/pkg/mflag"
 )
 
@@ -19,6 +19,13 @@ type mountPointError struct {
 	Error string `json:"error"`
 }
 
+var (
+	paramUnmountAll  = false
+	paramLowers      = []string{}
+	paramPropagation = ""
+	paramRelabel     = ""
+)
+
 func mount(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
 	moes := []mountPointOrError{}
 	for _, arg := range args {
@@ -30,7 +37,13 @@ func mount(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			}
 			moes = append(moes, mountPointOrError{arg, result, errText})
 		} else {
-			result, err := m.Mount(arg, paramMountLabel)
+			options := storage.MountOptions{
+				MountLabel:       paramMountLabel,
+				AdditionalLowers: paramLowers,
+				Propagation:      paramPropagation,
+				Relabel:          paramRelabel,
+			}
+			result, err := m.MountWithOptions(arg, &options)
 			errText := ""
 			if err != nil {
 				errText = err.Error()
@@ -38,8 +51,10 @@ func mount(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			moes = append(moes, mountPointOrError{arg, result, errText})
 		}
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(moes)
+	if structuredOutput() {
+		if writeStructured(moes) != nil {
+			return 1
+		}
 	} else {
 		for _, mountOrError := range moes {
 			if mountOrError.Error != "" {
@@ -56,9 +71,42 @@ func mount(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 	return 0
 }
 
+// mountedLayers returns the IDs of the layers which are recorded as being
+// mounted, including any whose mounts were leaked by processes which exited
+// without unmounting them.
+func mountedLayers(m storage.Store) ([]string, error) {
+	layers, err := m.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, layer := range layers {
+		if layer.MountCount > 0 {
+			ids = append(ids, layer.ID)
+		}
+	}
+	return ids, nil
+}
+
 func unmount(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
 	mes := []mountPointError{}
 	errors := false
+	if paramUnmountAll {
+		if len(args) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: --all can not be used with a list of items to unmount\n", action)
+			return 1
+		}
+		ids, err := mountedLayers(m)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+		args = ids
+	} else if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: more arguments required.\n", action)
+		flags.Usage()
+		return 1
+	}
 	for _, arg := range args {
 		mounted, err := m.Unmount(arg, force)
 		errText := ""
@@ -76,8 +124,10 @@ func unmount(flags *mflag.FlagSet, action string, m storage.Store, args []string
 		}
 		mes = append(mes, mountPointError{arg, errText})
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(mes)
+	if structuredOutput() {
+		if writeStructured(mes) != nil {
+			return 1
+		}
 	} else {
 		for _, me := range mes {
 			if me.Error != "" {
@@ -107,8 +157,10 @@ func mounted(flags *mflag.FlagSet, action string, m storage.Store, args []string
 		}
 		mes = append(mes, mountPointError{arg, errText})
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(mes)
+	if structuredOutput() {
+		if writeStructured(mes) != nil {
+			return 1
+		}
 	} else {
 		for _, me := range mes {
 			if me.Error != "" {
@@ -133,18 +185,21 @@ func init() {
 			flags.StringVar(&paramMountOptions, []string{"-opt", "o"}, "", "Mount Options")
 			flags.StringVar(&paramMountLabel, []string{"-label", "l"}, "", "Mount Label")
 			flags.BoolVar(&paramReadOnly, []string{"-ro", "r"}, paramReadOnly, "Mount image readonly")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.Var(opts.NewListOptsRef(&paramLowers, nil), []string{"-lower"}, "Additional lower directory to include in the mount")
+			flags.StringVar(&paramPropagation, []string{"-propagation"}, "", "Mount propagation (private, rshared, or rslave)")
+			flags.StringVar(&paramRelabel, []string{"-relabel"}, "", "Relabel the layer's contents with the mount label (private or shared)")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
 		names:       []string{"unmount", "umount"},
-		optionsHelp: "LayerOrContainerNameOrID",
+		optionsHelp: "[options [...]] {--all | LayerOrContainerNameOrID ...}",
 		usage:       "Unmount an image, layer or container",
-		minArgs:     1,
 		action:      unmount,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 			flags.BoolVar(&force, []string{"-force", "f"}, jsonOutput, "Force the umount")
+			flags.BoolVar(&paramUnmountAll, []string{"-all", "a"}, paramUnmountAll, "Unmount every mounted layer; with --force, even if it is still in use")
 		},
 	})
 	commands = append(commands, command{
@@ -154,7 +209,7 @@ func init() {
 		minArgs:     1,
 		action:      mounted,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
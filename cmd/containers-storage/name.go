@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -24,8 +23,10 @@ func getNames(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(append([]string{}, names...))
+	if structuredOutput() {
+		if writeStructured(append([]string{}, names...)) != nil {
+			return 1
+		}
 	} else {
 		for _, name := range names {
 			fmt.Printf("%s\n", name)
@@ -43,19 +44,33 @@ func addNames(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	oldnames, err := m.Names(id)
+	if err := m.AddNames(id, paramNames); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	names, err := m.Names(id)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	newNames := []string{}
-	if oldnames != nil {
-		newNames = append(newNames, oldnames...)
+	if structuredOutput() {
+		if writeStructured(names) != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+func removeNames(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	if len(args) < 1 {
+		return 1
 	}
-	if paramNames != nil {
-		newNames = append(newNames, paramNames...)
+	id, err := m.Lookup(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
 	}
-	if err := m.SetNames(id, newNames); err != nil {
+	if err := m.RemoveNames(id, paramNames); err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
@@ -64,8 +79,10 @@ func addNames(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(names)
+	if structuredOutput() {
+		if writeStructured(append([]string{}, names...)) != nil {
+			return 1
+		}
 	}
 	return 0
 }
@@ -88,8 +105,10 @@ func setNames(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(names)
+	if structuredOutput() {
+		if writeStructured(names) != nil {
+			return 1
+		}
 	}
 	return 0
 }
@@ -102,7 +121,7 @@ func init() {
 		minArgs:     1,
 		action:      getNames,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -113,7 +132,18 @@ func init() {
 		action:      addNames,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "New name")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"remove-names", "removenames"},
+		optionsHelp: "[options [...]] imageOrContainerNameOrID",
+		usage:       "Remove layer, image, or container name or names",
+		minArgs:     1,
+		action:      removeNames,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Name to remove")
+			addOutputFlags(flags)
 		},
 	})
 	commands = append(commands, command{
@@ -124,7 +154,7 @@ func init() {
 		action:      setNames,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "New name")
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/containers/storage/pkg/mflag"
+)
+
+// outputFormat, if set, is a Go template which is used to format the results
+// of a command instead of its usual output.
+var outputFormat = ""
+
+// addOutputFlags adds the flags which select structured output to a
+// command's flags.
+func addOutputFlags(flags *mflag.FlagSet) {
+	flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+	flags.StringVar(&outputFormat, []string{"-format"}, outputFormat, "Format output using a Go template")
+}
+
+// structuredOutput returns true if either JSON output or formatted output was
+// requested.
+func structuredOutput() bool {
+	return jsonOutput || outputFormat != ""
+}
+
+// outputTemplateFuncs are the functions which --format templates can use, in
+// addition to the ones which text/template provides.
+var outputTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// writeStructured writes v to stdout as JSON, or formatted using the
+// --format template.  If v is a slice or an array, the template is used to
+// format each of its items on a line of its own.  Any error is reported
+// before it is returned.
+func writeStructured(v interface{}) error {
+	err := func() error {
+		if outputFormat == "" {
+			return json.NewEncoder(os.Stdout).Encode(v)
+		}
+		tmpl, err := template.New("format").Funcs(outputTemplateFuncs).Parse(outputFormat)
+		if err != nil {
+			return fmt.Errorf("parsing --format template: %w", err)
+		}
+		items := []interface{}{v}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			items = make([]interface{}, rv.Len())
+			for i := range items {
+				items[i] = rv.Index(i).Interface()
+			}
+		}
+		for _, item := range items {
+			if err := tmpl.Execute(os.Stdout, item); err != nil {
+				return fmt.Errorf("formatting output: %w", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	return err
+}
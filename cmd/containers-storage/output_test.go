@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureStructured returns what writeStructured writes for v using the
+// specified --format template.
+func captureStructured(t *testing.T, format string, v interface{}) (string, error) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	stdout, savedFormat := os.Stdout, outputFormat
+	os.Stdout, outputFormat = w, format
+	err = writeStructured(v)
+	os.Stdout, outputFormat = stdout, savedFormat
+	w.Close()
+	output, readErr := ioutil.ReadAll(r)
+	require.NoError(t, readErr)
+	return string(output), err
+}
+
+func TestWriteStructured(t *testing.T) {
+	type item struct {
+		ID    string
+		Names []string
+	}
+	items := []item{
+		{ID: "a", Names: []string{"one", "two"}},
+		{ID: "b"},
+	}
+
+	output, err := captureStructured(t, "", items)
+	require.NoError(t, err)
+	assert.Equal(t, `[{"ID":"a","Names":["one","two"]},{"ID":"b","Names":null}]`+"\n", output)
+
+	output, err = captureStructured(t, `{{.ID}} {{join .Names ","}}`, items)
+	require.NoError(t, err)
+	assert.Equal(t, "a one,two\nb \n", output)
+
+	output, err = captureStructured(t, `{{upper .ID}} {{json .Names}}`, items[0])
+	require.NoError(t, err)
+	assert.Equal(t, "A [\"one\",\"two\"]\n", output)
+
+	_, err = captureStructured(t, `{{.ID`, items)
+	assert.Error(t, err)
+}
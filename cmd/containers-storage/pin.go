@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func pinImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.PinImage(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func unpinImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.UnpinImage(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func pinLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.PinLayer(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func unpinLayer(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.UnpinLayer(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"pin-image", "pinimage"},
+		optionsHelp: "imageNameOrID [...]",
+		usage:       "Protect images from being deleted",
+		minArgs:     1,
+		action:      pinImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"unpin-image", "unpinimage"},
+		optionsHelp: "imageNameOrID [...]",
+		usage:       "Stop protecting images from being deleted",
+		minArgs:     1,
+		action:      unpinImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"pin-layer", "pinlayer"},
+		optionsHelp: "layerNameOrID [...]",
+		usage:       "Protect layers from being deleted",
+		minArgs:     1,
+		action:      pinLayer,
+	})
+	commands = append(commands, command{
+		names:       []string{"unpin-layer", "unpinlayer"},
+		optionsHelp: "layerNameOrID [...]",
+		usage:       "Stop protecting layers from being deleted",
+		minArgs:     1,
+		action:      unpinLayer,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+	units "github.com/docker/go-units"
+)
+
+var (
+	policyQuota            = ""
+	policyPruneDangling    = false
+	policyPruneUnusedAfter = ""
+	policyPruneToQuota     = false
+)
+
+// namespacePolicyInfo is what the namespace-policy command reports.
+type namespacePolicyInfo struct {
+	Namespace string                   `json:"namespace"`
+	Policy    *storage.NamespacePolicy `json:"policy"`
+	Usage     int64                    `json:"usage"`
+}
+
+func namespacePolicy(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	policy, err := m.NamespacePolicy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	changed := false
+	if flags.IsSet("-quota") {
+		quota := int64(0)
+		if policyQuota != "" {
+			if quota, err = units.RAMInBytes(policyQuota); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: parsing quota %q: %v\n", action, policyQuota, err)
+				return 1
+			}
+		}
+		policy.Quota = quota
+		changed = true
+	}
+	if flags.IsSet("-prune-dangling") {
+		policy.PruneDangling = policyPruneDangling
+		changed = true
+	}
+	if flags.IsSet("-prune-unused-after") {
+		after := time.Duration(0)
+		if policyPruneUnusedAfter != "" {
+			if after, err = time.ParseDuration(policyPruneUnusedAfter); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: parsing duration %q: %v\n", action, policyPruneUnusedAfter, err)
+				return 1
+			}
+		}
+		policy.PruneUnusedAfter = after
+		changed = true
+	}
+	if flags.IsSet("-prune-to-quota") {
+		policy.PruneToQuota = policyPruneToQuota
+		changed = true
+	}
+	if changed {
+		if err := m.SetNamespacePolicy(policy); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+			return 1
+		}
+	}
+	usage, err := m.NamespaceUsage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	info := namespacePolicyInfo{Namespace: m.Namespace(), Policy: policy, Usage: usage}
+	if structuredOutput() {
+		if writeStructured(info) != nil {
+			return 1
+		}
+		return 0
+	}
+	name := info.Namespace
+	if name == "" {
+		name = "(default)"
+	}
+	fmt.Printf("Namespace: %s\n", name)
+	fmt.Printf("Usage: %s\n", units.HumanSize(float64(usage)))
+	if policy.Quota != 0 {
+		fmt.Printf("Quota: %s\n", units.HumanSize(float64(policy.Quota)))
+	} else {
+		fmt.Printf("Quota: none\n")
+	}
+	fmt.Printf("Prune dangling images: %v\n", policy.PruneDangling)
+	if policy.PruneUnusedAfter != 0 {
+		fmt.Printf("Prune images unused after: %s\n", policy.PruneUnusedAfter)
+	}
+	fmt.Printf("Prune to fit quota: %v\n", policy.PruneToQuota)
+	return 0
+}
+
+func prune(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.Prune()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(report) != nil {
+			return 1
+		}
+		return 0
+	}
+	for _, image := range report.Images {
+		fmt.Printf("image: %s\n", image)
+	}
+	for _, layer := range report.Layers {
+		fmt.Printf("layer: %s\n", layer)
+	}
+	fmt.Printf("usage: %s\n", units.HumanSize(float64(report.Usage)))
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"namespace-policy"},
+		optionsHelp: "[options [...]]",
+		usage:       "Show or change the quota and pruning policy of a namespace",
+		action:      namespacePolicy,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&policyQuota, []string{"-quota"}, "", "Limit the space used by the namespace's layers (\"\" for no limit)")
+			flags.BoolVar(&policyPruneDangling, []string{"-prune-dangling"}, false, "Prune images which have no names")
+			flags.StringVar(&policyPruneUnusedAfter, []string{"-prune-unused-after"}, "", "Prune images which haven't been used for longer than this (\"\" to never)")
+			flags.BoolVar(&policyPruneToQuota, []string{"-prune-to-quota"}, false, "Prune the oldest unused images until the namespace fits in its quota")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"prune"},
+		optionsHelp: "[options [...]]",
+		usage:       "Delete unused images according to the namespace's pruning policy",
+		action:      prune,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
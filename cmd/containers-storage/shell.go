@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+	"github.com/containers/storage/pkg/unshare"
+)
+
+var paramShellChroot = false
+
+func shell(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	// A rootless user needs to be in a user namespace to mount anything.
+	unshare.MaybeReexecUsingUserNamespace(false)
+	options := storage.EnterMountOptions{
+		Command:    args[1:],
+		Chroot:     paramShellChroot,
+		MountLabel: paramMountLabel,
+	}
+	if paramReadOnly {
+		options.MountOptions = []string{"noexec", "nosuid"}
+	}
+	if err := m.EnterMount(args[0], &options); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"shell"},
+		optionsHelp: "[options [...]] ImageOrLayerOrContainerNameOrID [command [arg ...]]",
+		usage:       "Mount an image, layer, or container and run a shell in it",
+		minArgs:     1,
+		action:      shell,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&paramMountLabel, []string{"-label", "l"}, "", "Mount Label")
+			flags.BoolVar(&paramReadOnly, []string{"-ro", "r"}, paramReadOnly, "Mount image with noexec and nosuid")
+			flags.BoolVar(&paramShellChroot, []string{"-chroot", "c"}, paramShellChroot, "Use the mounted filesystem as the root directory")
+		},
+	})
+}
@@ -14,7 +14,7 @@ var (
 )
 
 func shutdown(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
-	_, err := m.Shutdown(forceShutdown)
+	mounted, err := m.Shutdown(forceShutdown)
 	if jsonOutput {
 		if err == nil {
 			json.NewEncoder(os.Stdout).Encode(string(""))
@@ -23,6 +23,9 @@ func shutdown(flags *mflag.FlagSet, action string, m storage.Store, args []strin
 		}
 	} else {
 		if err != nil {
+			for _, layer := range mounted {
+				fmt.Fprintf(os.Stderr, "%s: layer %s is still mounted\n", action, layer)
+			}
 			fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
 		}
 	}
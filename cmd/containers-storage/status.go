@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -22,8 +21,10 @@ func status(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 		{"Driver Options", fmt.Sprintf("%v", m.GraphOptions())},
 	}
 	status = append(basics, status...)
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(status)
+	if structuredOutput() {
+		if writeStructured(status) != nil {
+			return 1
+		}
 	} else {
 		for _, pair := range status {
 			fmt.Fprintf(os.Stderr, "%s: %s\n", pair[0], pair[1])
@@ -32,6 +33,33 @@ func status(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 	return 0
 }
 
+func capabilities(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	capabilities, err := m.DriverCapabilities()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(capabilities) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("Reflinks: %t\n", capabilities.Reflinks)
+		fmt.Printf("Snapshots: %t\n", capabilities.Snapshots)
+		fmt.Printf("Native Diff: %t\n", capabilities.NativeDiff)
+		fmt.Printf("Supports Shifting: %t\n", capabilities.SupportsShifting)
+		fmt.Printf("Quota: %t\n", capabilities.Quota)
+		if capabilities.MaxLowers != 0 {
+			fmt.Printf("Max Lowers: %d\n", capabilities.MaxLowers)
+		}
+		if capabilities.WhiteoutFormat != "" {
+			fmt.Printf("Whiteout Format: %s\n", capabilities.WhiteoutFormat)
+		}
+		fmt.Printf("Reproduces Exact Diffs: %t\n", capabilities.ReproducesExactDiffs)
+	}
+	return 0
+}
+
 func init() {
 	commands = append(commands, command{
 		names:   []string{"status"},
@@ -39,7 +67,17 @@ func init() {
 		minArgs: 0,
 		action:  status,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:   []string{"capabilities"},
+		usage:   "List the optional features which the graph driver provides",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  capabilities,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
 		},
 	})
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func verifyImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	report, err := m.VerifyImage(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", action, err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(report) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("config: %s\n", report.Config)
+		for _, layer := range report.Layers {
+			fmt.Printf("%s\n", layer.String())
+		}
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"verify-image", "verifyimage"},
+		optionsHelp: "[options [...]] imageNameOrID",
+		usage:       "Compare the diffs of an image's layers with its configuration's DiffIDs",
+		action:      verifyImage,
+		minArgs:     1,
+		maxArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -15,8 +14,10 @@ func version(flags *mflag.FlagSet, action string, m storage.Store, args []string
 		fmt.Fprintf(os.Stderr, "version: %+v\n", err)
 		return 1
 	}
-	if jsonOutput {
-		json.NewEncoder(os.Stdout).Encode(version)
+	if structuredOutput() {
+		if writeStructured(version) != nil {
+			return 1
+		}
 	} else {
 		for _, pair := range version {
 			fmt.Fprintf(os.Stderr, "%s: %s\n", pair[0], pair[1])
@@ -32,7 +33,7 @@ func init() {
 		minArgs: 0,
 		action:  version,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
-			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			addOutputFlags(flags)
 		},
 	})
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	paramVolumeDriver  = ""
+	paramVolumeOptions = []string{}
+	paramVolumeLabels  = []string{}
+)
+
+// keyValueMap converts a list of "key=value" strings into a map.
+func keyValueMap(what string, list []string) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(list))
+	for _, item := range list {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s %q is not in key=value form", what, item)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+func volumes(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	volumes, err := m.Volumes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(volumes) != nil {
+			return 1
+		}
+	} else {
+		for _, volume := range volumes {
+			fmt.Printf("%s\n", volume.ID)
+			for _, name := range volume.Names {
+				fmt.Printf("\tname: %s\n", name)
+			}
+		}
+	}
+	return 0
+}
+
+func volume(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	matched := []*storage.Volume{}
+	for _, arg := range args {
+		volume, err := m.Volume(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+		matched = append(matched, volume)
+	}
+	if structuredOutput() {
+		if writeStructured(matched) != nil {
+			return 1
+		}
+	} else {
+		printMap := func(what string, m map[string]string) {
+			keys := make([]string, 0, len(m))
+			for key := range m {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("%s: %s=%s\n", what, key, m[key])
+			}
+		}
+		for _, volume := range matched {
+			fmt.Printf("ID: %s\n", volume.ID)
+			for _, name := range volume.Names {
+				fmt.Printf("Name: %s\n", name)
+			}
+			fmt.Printf("Driver: %s\n", volume.Driver)
+			printMap("Option", volume.Options)
+			printMap("Label", volume.Labels)
+			fmt.Printf("Mount Count: %d\n", volume.MountCount)
+		}
+	}
+	return 0
+}
+
+func createVolume(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	options, err := keyValueMap("option", paramVolumeOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	labels, err := keyValueMap("label", paramVolumeLabels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	volume, err := m.CreateVolume(paramID, paramNames, &storage.VolumeOptions{
+		Driver:  paramVolumeDriver,
+		Options: options,
+		Labels:  labels,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	if structuredOutput() {
+		if writeStructured(volume) != nil {
+			return 1
+		}
+	} else {
+		fmt.Printf("%s\n", volume.ID)
+	}
+	return 0
+}
+
+func mountVolume(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	moes := []mountPointOrError{}
+	for _, arg := range args {
+		result, err := m.MountVolume(arg)
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+		moes = append(moes, mountPointOrError{arg, result, errText})
+	}
+	if structuredOutput() {
+		if writeStructured(moes) != nil {
+			return 1
+		}
+	} else {
+		for _, mountOrError := range moes {
+			if mountOrError.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s while mounting %s\n", mountOrError.Error, mountOrError.ID)
+			}
+			fmt.Printf("%s\n", mountOrError.MountPoint)
+		}
+	}
+	for _, mountOrErr := range moes {
+		if mountOrErr.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+func unmountVolume(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if _, err := m.UnmountVolume(arg, force); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func deleteVolume(flags *mflag.FlagSet, action string, m storage.Store, args []string) int {
+	for _, arg := range args {
+		if err := m.DeleteVolume(arg); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", arg, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"volumes"},
+		optionsHelp: "[options [...]]",
+		usage:       "List volumes",
+		action:      volumes,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"volume"},
+		optionsHelp: "[options [...]] volumeNameOrID [...]",
+		usage:       "Examine a volume",
+		action:      volume,
+		minArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"create-volume", "createvolume"},
+		optionsHelp: "[options [...]]",
+		usage:       "Create a new volume",
+		action:      createVolume,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Volume name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Volume ID")
+			flags.StringVar(&paramVolumeDriver, []string{"-driver", "d"}, "", "Volume driver (default \"local\")")
+			flags.Var(opts.NewListOptsRef(&paramVolumeOptions, nil), []string{"-opt", "o"}, "Volume driver option, as key=value")
+			flags.Var(opts.NewListOptsRef(&paramVolumeLabels, nil), []string{"-label", "l"}, "Volume label, as key=value")
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"mount-volume", "mountvolume"},
+		optionsHelp: "[options [...]] volumeNameOrID [...]",
+		usage:       "Mount a volume",
+		action:      mountVolume,
+		minArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			addOutputFlags(flags)
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"unmount-volume", "unmountvolume", "umount-volume"},
+		optionsHelp: "[options [...]] volumeNameOrID [...]",
+		usage:       "Unmount a volume",
+		action:      unmountVolume,
+		minArgs:     1,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&force, []string{"-force", "f"}, false, "Undo every mount of the volume")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"delete-volume", "deletevolume"},
+		optionsHelp: "[options [...]] volumeNameOrID [...]",
+		usage:       "Delete a volume and its contents",
+		action:      deleteVolume,
+		minArgs:     1,
+	})
+}
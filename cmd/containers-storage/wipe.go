@@ -31,7 +31,7 @@ func wipe(flags *mflag.FlagSet, action string, m storage.Store, args []string) i
 func init() {
 	commands = append(commands, command{
 		names:   []string{"wipe"},
-		usage:   "Wipe all layers, images, and containers",
+		usage:   "Wipe all layers, images, containers, and volumes",
 		minArgs: 0,
 		action:  wipe,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
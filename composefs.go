@@ -0,0 +1,50 @@
+package storage
+
+import (
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LayerVerityDigest describes one layer in the chain of layers which make up
+// an image.
+type LayerVerityDigest struct {
+	// LayerID is the ID of the layer.
+	LayerID string `json:"layer"`
+	// UncompressedDigest is the digest of the layer's diff, if it is known.
+	UncompressedDigest digest.Digest `json:"diff-digest,omitempty"`
+	// ComposefsDigest is the fs-verity digest of the composefs image
+	// which was built from the layer's contents, if there is one.
+	ComposefsDigest digest.Digest `json:"composefs-digest,omitempty"`
+}
+
+func (s *store) SetLayerComposefsDigest(id string, d digest.Digest) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layers in %q", s.graphRoot)
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return rlstore.SetComposefsDigest(id, d)
+}
+
+func (s *store) ImageVerityDigests(id string) ([]LayerVerityDigest, error) {
+	history, err := s.ImageHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]LayerVerityDigest, 0, len(history))
+	for _, layer := range history {
+		digests = append(digests, LayerVerityDigest{
+			LayerID:            layer.ID,
+			UncompressedDigest: layer.UncompressedDigest,
+			ComposefsDigest:    layer.ComposefsDigest,
+		})
+	}
+	return digests, nil
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,7 +12,6 @@ import (
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/ioutils"
-	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/pkg/truncindex"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -52,6 +53,11 @@ type Container struct {
 	// data that has been stored, if they're known.
 	BigDataDigests map[string]digest.Digest `json:"big-data-digests,omitempty"`
 
+	// Annotations are key/value pairs which we keep for the convenience
+	// of the caller.  Unlike Metadata, they can be updated individually,
+	// and used to search for containers.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
 	// Created is the datestamp for when this container was created.  Older
 	// versions of the library did not track this information, so callers
 	// will likely want to use the IsZero() method to verify that a value
@@ -73,6 +79,7 @@ type ContainerStore interface {
 	MetadataStore
 	ContainerBigDataStore
 	FlaggableStore
+	AnnotatedStore
 
 	// Create creates a container that has a specified ID (or generates a
 	// random one if an empty value is supplied) and optional names,
@@ -124,6 +131,21 @@ type containerStore struct {
 	bylayer    map[string]*Container
 	byname     map[string]*Container
 	loadMut    sync.Mutex
+	// records reads and writes the file which holds the records.
+	records recordsFile
+	// logRecords is set if changes to the records should be appended to
+	// containers.log instead of rewriting containers.json every time.
+	// changed holds the IDs of containers whose records were changed
+	// since they were last loaded or saved, recordsDigest is the digest of
+	// containers.json as it was then, and logEntries and logBytes describe
+	// the log as it was then.  A log is replayed when the records are
+	// loaded, whether or not logRecords is set.
+	logRecords    bool
+	changed       map[string]struct{}
+	recordsDigest digest.Digest
+	logEntries    int
+	logBytes      int64
+	logDamaged    bool
 }
 
 func copyContainer(c *Container) *Container {
@@ -140,6 +162,7 @@ func copyContainer(c *Container) *Container {
 		UIDMap:         copyIDMap(c.UIDMap),
 		GIDMap:         copyIDMap(c.GIDMap),
 		Flags:          copyStringInterfaceMap(c.Flags),
+		Annotations:    copyStringStringMap(c.Annotations),
 	}
 }
 
@@ -197,16 +220,28 @@ func (r *containerStore) datapath(id, key string) string {
 func (r *containerStore) Load() error {
 	needSave := false
 	rpath := r.containerspath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	var containers []*Container
+	recordsDigest, err := r.records.decode(rpath, func() interface{} {
+		containers = []*Container{}
+		return &containers
+	})
+	if err != nil && !errors.Is(err, ErrStoreCorrupt) {
 		return err
 	}
-	containers := []*Container{}
 	layers := make(map[string]*Container)
 	idlist := []string{}
 	ids := make(map[string]*Container)
 	names := make(map[string]*Container)
-	if err = json.Unmarshal(data, &containers); len(data) == 0 || err == nil {
+	r.recordsDigest = recordsDigest
+	r.changed = nil
+	if err == nil {
+		logEntries, logDamaged := 0, false
+		if containers, logEntries, logDamaged, err = r.replayLog(containers, r.recordsDigest); err != nil {
+			return err
+		}
+		if r.logEntries, r.logDamaged = logEntries, logDamaged; logDamaged && r.IsReadWrite() && r.Locked() {
+			needSave = true
+		}
 		idlist = make([]string, 0, len(containers))
 		for n, container := range containers {
 			idlist = append(idlist, container.ID)
@@ -215,6 +250,7 @@ func (r *containerStore) Load() error {
 			for _, name := range container.Names {
 				if conflict, ok := names[name]; ok {
 					r.removeName(conflict, name)
+					r.markChanged(conflict.ID)
 					needSave = true
 				}
 				names[name] = containers[n]
@@ -226,6 +262,12 @@ func (r *containerStore) Load() error {
 	r.byid = ids
 	r.bylayer = layers
 	r.byname = names
+	if err != nil {
+		return err
+	}
+	if r.logBytes, err = r.logSize(); err != nil {
+		return err
+	}
 	if needSave {
 		return r.Save()
 	}
@@ -233,6 +275,9 @@ func (r *containerStore) Load() error {
 }
 
 func (r *containerStore) Save() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the container store at %q", r.containerspath())
+	}
 	if !r.Locked() {
 		return errors.New("container store is not locked")
 	}
@@ -240,15 +285,28 @@ func (r *containerStore) Save() error {
 	if err := os.MkdirAll(filepath.Dir(rpath), 0700); err != nil {
 		return err
 	}
+	defer r.Touch()
+	if !r.needCompaction() {
+		return r.appendLog()
+	}
 	jdata, err := json.Marshal(&r.containers)
 	if err != nil {
 		return err
 	}
-	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jdata, 0600)
+	if err := r.records.write(rpath, jdata); err != nil {
+		return err
+	}
+	r.recordsDigest = digest.FromBytes(jdata)
+	// Everything in the log is now in containers.json.
+	if err := os.Remove(r.logpath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.changed = nil
+	r.logEntries, r.logBytes, r.logDamaged = 0, 0, false
+	return nil
 }
 
-func newContainerStore(dir string) (ContainerStore, error) {
+func newContainerStore(dir string, logRecords bool, writerOptions ioutils.AtomicFileWriterOptions) (ContainerStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -258,6 +316,35 @@ func newContainerStore(dir string) (ContainerStore, error) {
 	}
 	lockfile.Lock()
 	defer lockfile.Unlock()
+	cstore := containerStore{
+		lockfile:   lockfile,
+		dir:        dir,
+		containers: []*Container{},
+		byid:       make(map[string]*Container),
+		bylayer:    make(map[string]*Container),
+		byname:     make(map[string]*Container),
+		logRecords: logRecords,
+		records:    recordsFile{options: writerOptions},
+	}
+	if err := cstore.Load(); err != nil {
+		return nil, err
+	}
+	return &cstore, nil
+}
+
+// newReadOnlyContainerStore opens the container store of a read-only Store,
+// which uses the store's own lock file if it has one, and otherwise keeps its
+// lock file in rundir.
+func newReadOnlyContainerStore(dir, rundir string) (ContainerStore, error) {
+	if err := os.MkdirAll(rundir, 0700); err != nil {
+		return nil, err
+	}
+	lockfile, err := getReadOnlyStoreLockfile(filepath.Join(dir, "containers.lock"), filepath.Join(rundir, "containers.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lockfile.RLock()
+	defer lockfile.Unlock()
 	cstore := containerStore{
 		lockfile:   lockfile,
 		dir:        dir,
@@ -288,15 +375,22 @@ func (r *containerStore) lookup(id string) (*Container, bool) {
 }
 
 func (r *containerStore) ClearFlag(id string, flag string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to clear flags on containers at %q", r.containerspath())
+	}
 	container, ok := r.lookup(id)
 	if !ok {
 		return ErrContainerUnknown
 	}
 	delete(container.Flags, flag)
+	r.markChanged(container.ID)
 	return r.Save()
 }
 
 func (r *containerStore) SetFlag(id string, flag string, value interface{}) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to set flags on containers at %q", r.containerspath())
+	}
 	container, ok := r.lookup(id)
 	if !ok {
 		return ErrContainerUnknown
@@ -305,17 +399,18 @@ func (r *containerStore) SetFlag(id string, flag string, value interface{}) erro
 		container.Flags = make(map[string]interface{})
 	}
 	container.Flags[flag] = value
+	r.markChanged(container.ID)
 	return r.Save()
 }
 
 func (r *containerStore) Create(id string, names []string, image, layer, metadata string, options *ContainerOptions) (container *Container, err error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new containers at %q", r.containerspath())
+	}
 	if id == "" {
-		id = stringid.GenerateRandomID()
-		_, idInUse := r.byid[id]
-		for idInUse {
-			id = stringid.GenerateRandomID()
-			_, idInUse = r.byid[id]
-		}
+		id = generateID(nil, r.Exists)
+	} else if err := validateID(id); err != nil {
+		return nil, err
 	}
 	if _, idInUse := r.byid[id]; idInUse {
 		return nil, ErrDuplicateID
@@ -361,6 +456,7 @@ func (r *containerStore) Create(id string, names []string, image, layer, metadat
 		for _, name := range names {
 			r.byname[name] = container
 		}
+		r.markChanged(id)
 		err = r.Save()
 		container = copyContainer(container)
 	}
@@ -375,13 +471,31 @@ func (r *containerStore) Metadata(id string) (string, error) {
 }
 
 func (r *containerStore) SetMetadata(id, metadata string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify container metadata at %q", r.containerspath())
+	}
 	if container, ok := r.lookup(id); ok {
 		container.Metadata = metadata
+		r.markChanged(container.ID)
 		return r.Save()
 	}
 	return ErrContainerUnknown
 }
 
+func (r *containerStore) UpdateAnnotations(id string, set map[string]string, remove []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify container annotations at %q", r.containerspath())
+	}
+	if container, ok := r.lookup(id); ok {
+		if updateAnnotations(&container.Annotations, set, remove) {
+			r.markChanged(container.ID)
+			return r.Save()
+		}
+		return nil
+	}
+	return ErrContainerUnknown
+}
+
 func (r *containerStore) removeName(container *Container, name string) {
 	container.Names = stringSliceWithoutValue(container.Names, name)
 }
@@ -400,6 +514,9 @@ func (r *containerStore) RemoveNames(id string, names []string) error {
 }
 
 func (r *containerStore) updateNames(id string, names []string, op updateNameOperation) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to change container name assignments at %q", r.containerspath())
+	}
 	container, ok := r.lookup(id)
 	if !ok {
 		return ErrContainerUnknown
@@ -415,14 +532,19 @@ func (r *containerStore) updateNames(id string, names []string, op updateNameOpe
 	for _, name := range names {
 		if otherContainer, ok := r.byname[name]; ok {
 			r.removeName(otherContainer, name)
+			r.markChanged(otherContainer.ID)
 		}
 		r.byname[name] = container
 	}
 	container.Names = names
+	r.markChanged(container.ID)
 	return r.Save()
 }
 
 func (r *containerStore) Delete(id string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete containers at %q", r.containerspath())
+	}
 	container, ok := r.lookup(id)
 	if !ok {
 		return ErrContainerUnknown
@@ -449,6 +571,7 @@ func (r *containerStore) Delete(id string) error {
 			r.containers = append(r.containers[:toDeleteIndex], r.containers[toDeleteIndex+1:]...)
 		}
 	}
+	r.markChanged(id)
 	if err := r.Save(); err != nil {
 		return err
 	}
@@ -488,6 +611,17 @@ func (r *containerStore) BigData(id, key string) ([]byte, error) {
 	return ioutil.ReadFile(r.datapath(c.ID, key))
 }
 
+func (r *containerStore) BigDataReader(id, key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve container big data value for empty name")
+	}
+	c, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrContainerUnknown
+	}
+	return os.Open(r.datapath(c.ID, key))
+}
+
 func (r *containerStore) BigDataSize(id, key string) (int64, error) {
 	if key == "" {
 		return -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve size of container big data with empty name")
@@ -557,6 +691,13 @@ func (r *containerStore) BigDataNames(id string) ([]string, error) {
 }
 
 func (r *containerStore) SetBigData(id, key string, data []byte) error {
+	return r.SetBigDataFromReader(id, key, bytes.NewReader(data))
+}
+
+func (r *containerStore) SetBigDataFromReader(id, key string, data io.Reader) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to save data items associated with containers at %q", r.containerspath())
+	}
 	if key == "" {
 		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for container big data item")
 	}
@@ -567,19 +708,20 @@ func (r *containerStore) SetBigData(id, key string, data []byte) error {
 	if err := os.MkdirAll(r.datadir(c.ID), 0700); err != nil {
 		return err
 	}
-	err := ioutils.AtomicWriteFile(r.datapath(c.ID, key), data, 0600)
+	digester := digest.Canonical.Digester()
+	size, err := ioutils.AtomicWriteFileFromReaderWithOpts(r.datapath(c.ID, key), io.TeeReader(data, digester.Hash()), 0600, r.records.bigDataWriterOptions())
 	if err == nil {
 		save := false
 		if c.BigDataSizes == nil {
 			c.BigDataSizes = make(map[string]int64)
 		}
 		oldSize, sizeOk := c.BigDataSizes[key]
-		c.BigDataSizes[key] = int64(len(data))
+		c.BigDataSizes[key] = size
 		if c.BigDataDigests == nil {
 			c.BigDataDigests = make(map[string]digest.Digest)
 		}
 		oldDigest, digestOk := c.BigDataDigests[key]
-		newDigest := digest.Canonical.FromBytes(data)
+		newDigest := digester.Digest()
 		c.BigDataDigests[key] = newDigest
 		if !sizeOk || oldSize != c.BigDataSizes[key] || !digestOk || oldDigest != newDigest {
 			save = true
@@ -596,6 +738,7 @@ func (r *containerStore) SetBigData(id, key string, data []byte) error {
 			save = true
 		}
 		if save {
+			r.markChanged(c.ID)
 			err = r.Save()
 		}
 	}
@@ -603,6 +746,9 @@ func (r *containerStore) SetBigData(id, key string, data []byte) error {
 }
 
 func (r *containerStore) Wipe() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete containers at %q", r.containerspath())
+	}
 	ids := make([]string, 0, len(r.byid))
 	for id := range r.byid {
 		ids = append(ids, id)
@@ -651,6 +797,19 @@ func (r *containerStore) Locked() bool {
 	return r.lockfile.Locked()
 }
 
+// forceReload reloads the store's contents, whether or not its lock file
+// indicates that it was modified.  It should be called with the lock held.
+func (r *containerStore) forceReload() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	// Note that we've seen the current version of the lock file.
+	if _, err := r.Modified(); err != nil {
+		return err
+	}
+	return r.Load()
+}
+
 func (r *containerStore) ReloadIfChanged() error {
 	r.loadMut.Lock()
 	defer r.loadMut.Unlock()
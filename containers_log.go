@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// containerLogPut records the current state of a container.
+	containerLogPut = "put"
+	// containerLogDelete records that a container was deleted.
+	containerLogDelete = "delete"
+	// containerLogBase is the first entry in the log, and records the
+	// digest of the containers.json which the log's changes were made to.
+	containerLogBase = "base"
+
+	// containerLogCompactionThreshold is the number of entries which we'll
+	// let accumulate in the log, or the number of containers if there are
+	// more of them, before folding the log back into containers.json.
+	containerLogCompactionThreshold = 1000
+)
+
+// containerLogEntry is one line of a container store's log, which records a
+// change made to the records in containers.json since it was last written.
+type containerLogEntry struct {
+	Op        string        `json:"op"`
+	ID        string        `json:"id,omitempty"`
+	Container *Container    `json:"container,omitempty"`
+	Digest    digest.Digest `json:"digest,omitempty"`
+}
+
+func (r *containerStore) logpath() string {
+	return filepath.Join(r.dir, "containers.log")
+}
+
+// replayLog applies the changes recorded in the log, if there is one, to a
+// list of containers which was read from containers.json.  It returns the
+// updated list, the number of entries which it applied, and whether or not it
+// found an entry which it couldn't read, as it might if the system crashed
+// while one was being written.
+//
+// A log which wasn't started for the version of containers.json whose digest
+// is base, as would be the case if containers.json was rewritten by a process
+// which didn't know about the log, is discarded without being replayed.
+func (r *containerStore) replayLog(containers []*Container, base digest.Digest) ([]*Container, int, bool, error) {
+	f, err := os.Open(r.logpath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return containers, 0, false, nil
+		}
+		return nil, 0, false, err
+	}
+	defer f.Close()
+	index := make(map[string]int, len(containers))
+	for i, container := range containers {
+		index[container.ID] = i
+	}
+	entries := 0
+	damaged := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var entry containerLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logrus.Warnf("%s is damaged after %d entries, ignoring the rest of it", r.logpath(), entries)
+			damaged = true
+			break
+		}
+		if entries == 0 && (entry.Op != containerLogBase || entry.Digest != base) {
+			logrus.Warnf("%s was not started for the current version of %s, ignoring it", r.logpath(), r.containerspath())
+			damaged = true
+			break
+		}
+		switch entry.Op {
+		case containerLogPut:
+			if entry.Container == nil {
+				continue
+			}
+			if i, ok := index[entry.Container.ID]; ok {
+				containers[i] = entry.Container
+			} else {
+				index[entry.Container.ID] = len(containers)
+				containers = append(containers, entry.Container)
+			}
+		case containerLogDelete:
+			if i, ok := index[entry.ID]; ok {
+				containers[i] = nil
+				delete(index, entry.ID)
+			}
+		}
+		entries++
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.Warnf("error reading %s after %d entries, ignoring the rest of it: %v", r.logpath(), entries, err)
+		damaged = true
+	}
+	// Drop the records of deleted containers.
+	kept := containers[:0]
+	for _, container := range containers {
+		if container != nil {
+			kept = append(kept, container)
+		}
+	}
+	return kept, entries, damaged, nil
+}
+
+// markChanged notes that the records of the containers with the specified IDs
+// were added, modified, or removed, so that the changes will be logged when we
+// next save them.
+func (r *containerStore) markChanged(ids ...string) {
+	if r.changed == nil {
+		r.changed = make(map[string]struct{})
+	}
+	for _, id := range ids {
+		r.changed[id] = struct{}{}
+	}
+}
+
+// logSize returns the size of the log, or 0 if there isn't one.
+func (r *containerStore) logSize() (int64, error) {
+	st, err := os.Stat(r.logpath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return -1, err
+	}
+	return st.Size(), nil
+}
+
+// needCompaction returns true if containers.json should be rewritten instead
+// of appending to the log.  That's the case if we're not logging changes,
+// if the log has grown long enough, or if it isn't the one which we last
+// read or wrote, as it wouldn't be if a process was interrupted while it was
+// appending to it.
+func (r *containerStore) needCompaction() bool {
+	if !r.logRecords || r.logDamaged {
+		return true
+	}
+	threshold := containerLogCompactionThreshold
+	if len(r.containers) > threshold {
+		threshold = len(r.containers)
+	}
+	if r.logEntries >= threshold {
+		return true
+	}
+	size, err := r.logSize()
+	return err != nil || size != r.logBytes
+}
+
+// appendLog records the changes made to the containers since they were last
+// loaded or saved by adding entries to the log, starting a new log if there
+// isn't one.
+func (r *containerStore) appendLog() error {
+	var entries []containerLogEntry
+	if len(r.changed) > 0 && r.logBytes == 0 {
+		entries = append(entries, containerLogEntry{Op: containerLogBase, Digest: r.recordsDigest})
+	}
+	ids := make([]string, 0, len(r.changed))
+	for id := range r.changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if container, ok := r.byid[id]; ok {
+			entries = append(entries, containerLogEntry{Op: containerLogPut, Container: container})
+		} else {
+			entries = append(entries, containerLogEntry{Op: containerLogDelete, ID: id})
+		}
+	}
+	if len(entries) > 0 {
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			data, err := json.Marshal(&entry)
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+		f, err := os.OpenFile(r.logpath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(buf.Bytes())
+		if err == nil {
+			err = f.Sync()
+		}
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error appending to %q", r.logpath())
+		}
+	}
+	r.changed = nil
+	r.logEntries += len(entries)
+	size, err := r.logSize()
+	if err != nil {
+		return err
+	}
+	r.logBytes = size
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"github.com/containers/storage/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ConvertDriverOptions is used for passing options to a Store's
+// ConvertDriver() method.
+type ConvertDriverOptions struct {
+	// DriverOptions are the options for the new graph driver.  By
+	// default, none are used.
+	DriverOptions []string
+	// Progress, if set, is called after each layer, image, and container
+	// has been converted.
+	Progress func(ConvertDriverProgress)
+	// RemoveSource, if set, removes every layer, image, and container
+	// from the current graph driver once all of them have been
+	// converted.
+	RemoveSource bool
+}
+
+// ConvertDriverProgress describes how far a call to ConvertDriver() has
+// gotten.
+type ConvertDriverProgress struct {
+	// Kind is "layer", "image", or "container".
+	Kind string
+	// ID is the ID of the item which was just converted.
+	ID string
+	// Completed counts the items which have been converted so far,
+	// including any which were converted by an earlier attempt.
+	Completed int
+	// Total counts all of the items which are being converted.
+	Total int
+}
+
+// ConvertDriver opens a Store which uses the same graph root and run root as
+// this one, but a different graph driver, and re-creates the layers, images,
+// and containers in it, keeping their IDs.
+func (s *store) ConvertDriver(target string, options *ConvertDriverOptions) (Store, error) {
+	if options == nil {
+		options = &ConvertDriverOptions{}
+	}
+	if s.readOnly {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to convert %q", s.graphRoot)
+	}
+	if target == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no graph driver specified to convert to")
+	}
+	if _, err := s.GraphDriver(); err != nil {
+		return nil, err
+	}
+	if target == s.graphDriverName {
+		return nil, errors.Errorf("store at %q already uses the %s driver", s.graphRoot, target)
+	}
+	dest, err := GetStore(types.StoreOptions{
+		RunRoot:            s.runRoot,
+		GraphRoot:          s.graphRoot,
+		TempDir:            s.tempDir,
+		GraphDriverName:    target,
+		GraphDriverOptions: options.DriverOptions,
+		UIDMap:             copyIDMap(s.uidMap),
+		GIDMap:             copyIDMap(s.gidMap),
+		Namespace:          s.namespace,
+		IDGenerator:        s.idGenerator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d, ok := dest.(*store)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "converting to a %T", dest)
+	}
+	if err := s.convertInto(d, options); err != nil {
+		if _, err2 := d.Shutdown(false); err2 != nil {
+			logrus.Debugf("error shutting down %s driver at %q: %v", target, d.graphRoot, err2)
+		}
+		return nil, err
+	}
+	if options.RemoveSource {
+		if err := s.Wipe(); err != nil {
+			return d, errors.Wrapf(err, "removing layers, images, and containers from the %s driver", s.graphDriverName)
+		}
+	}
+	return d, nil
+}
+
+// convertInto copies every layer, image, and container into d, skipping any
+// which d already has, unless an earlier attempt to copy them was
+// interrupted, and reports progress as it goes.
+func (s *store) convertInto(d *store, options *ConvertDriverOptions) error {
+	layers, err := s.Layers()
+	if err != nil {
+		return err
+	}
+	images, err := s.Images()
+	if err != nil {
+		return err
+	}
+	containers, err := s.Containers()
+	if err != nil {
+		return err
+	}
+	progress := ConvertDriverProgress{Total: len(layers) + len(images) + len(containers)}
+	report := func(kind, id string) {
+		progress.Kind = kind
+		progress.ID = id
+		progress.Completed++
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+	}
+	transferOptions := &TransferLayerOptions{}
+	for _, layer := range layers {
+		if _, err := s.TransferLayer(layer.ID, d, transferOptions); err != nil {
+			return errors.Wrapf(err, "converting layer %q", layer.ID)
+		}
+		report("layer", layer.ID)
+	}
+	for i := range images {
+		if err := s.cloneImage(&images[i], d, transferOptions); err != nil {
+			return errors.Wrapf(err, "converting image %q", images[i].ID)
+		}
+		report("image", images[i].ID)
+	}
+	for i := range containers {
+		if err := s.cloneContainer(&containers[i], d, transferOptions); err != nil {
+			return errors.Wrapf(err, "converting container %q", containers[i].ID)
+		}
+		report("container", containers[i].ID)
+	}
+	return nil
+}
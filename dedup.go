@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/sirupsen/logrus"
+)
+
+// dedupIndexFile is the name of the file, in the layer store's directory,
+// which records where files with particular contents and attributes can be
+// found, so that identical files in layers which are added later can be
+// replaced with hard links to them.
+const dedupIndexFile = "dedup.json"
+
+// dedupLocation is the location of a file which is listed in the dedup index.
+type dedupLocation struct {
+	Layer string `json:"layer"`
+	Path  string `json:"path"`
+}
+
+// dedupIndex maps keys computed by dedupFileKey() to the files which have them.
+type dedupIndex map[string][]dedupLocation
+
+// dedupFile is a file in a new layer which might be shared with other layers.
+type dedupFile struct {
+	path string
+	info os.FileInfo
+	key  string
+}
+
+func (r *layerStore) dedupIndexPath() string {
+	return filepath.Join(r.layerdir, dedupIndexFile)
+}
+
+// resetDedupIndex discards our copy of the dedup index, which will be read
+// again when it's next needed.
+func (r *layerStore) resetDedupIndex() {
+	r.dedupIndex = nil
+	r.dedupIndexChanged = false
+}
+
+// loadDedupIndex returns the dedup index, reading it if we haven't already.
+// If it's missing or damaged, we start with an empty index, since the worst
+// that can happen is that we miss a chance to share a file.
+func (r *layerStore) loadDedupIndex() dedupIndex {
+	if r.dedupIndex != nil {
+		return r.dedupIndex
+	}
+	r.dedupIndex = make(dedupIndex)
+	data, err := ioutil.ReadFile(r.dedupIndexPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("Error reading %s: %v", r.dedupIndexPath(), err)
+		}
+		return r.dedupIndex
+	}
+	if err := json.Unmarshal(data, &r.dedupIndex); err != nil {
+		logrus.Warnf("Error parsing %s, starting over: %v", r.dedupIndexPath(), err)
+		r.dedupIndex = make(dedupIndex)
+	}
+	return r.dedupIndex
+}
+
+// saveDedupIndex writes the dedup index, if we've changed it since it was
+// read or last written.  It's written along with the layer records, so that
+// creating or deleting several layers doesn't mean writing it for each of
+// them.  The index is only an optimization, so failing to save it isn't
+// treated as an error.
+func (r *layerStore) saveDedupIndex() {
+	if !r.dedupIndexChanged {
+		return
+	}
+	data, err := json.Marshal(&r.dedupIndex)
+	if err == nil {
+		err = ioutils.AtomicWriteFile(r.dedupIndexPath(), data, 0600)
+	}
+	if err != nil {
+		logrus.Warnf("Error saving %s: %v", r.dedupIndexPath(), err)
+		return
+	}
+	r.dedupIndexChanged = false
+}
+
+// scanDedupFiles computes keys for the files in a newly-populated layer which
+// could be shared with other layers.  Reading every file can take a while, but
+// this doesn't look at the layer store's state, so the caller doesn't need to
+// hold the layer store's lock.
+func (r *layerStore) scanDedupFiles(id string) ([]dedupFile, error) {
+	driver, ok := r.driver.(drivers.LayerDiffPathDriver)
+	if !ok {
+		return nil, nil
+	}
+	diffPath, err := driver.LayerDiffPath(id)
+	if err != nil {
+		return nil, err
+	}
+	var files []dedupFile
+	err = filepath.Walk(diffPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		key, ok, err := dedupFileKey(p, info)
+		if err != nil {
+			logrus.Debugf("Error checking %s for duplicates: %v", p, err)
+			return nil
+		}
+		if ok {
+			files = append(files, dedupFile{path: p, info: info, key: key})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// dedupLayer replaces files in a newly-populated layer, which were found by
+// scanDedupFiles(), with hard links to identical files in other layers, and
+// adds them to the dedup index so that layers which are added later can share
+// them.  Only layers which are never modified after they're populated should
+// be passed to it, since modifying a shared file would modify it in every
+// layer which uses it.  The caller must hold the layer store's lock, and save
+// the layer records afterward.
+func (r *layerStore) dedupLayer(id string, files []dedupFile) error {
+	driver, ok := r.driver.(drivers.LayerDiffPathDriver)
+	if !ok {
+		return nil
+	}
+	diffPath, err := driver.LayerDiffPath(id)
+	if err != nil {
+		return err
+	}
+	index := r.loadDedupIndex()
+	diffPaths := map[string]string{id: diffPath}
+	layerDiffPath := func(layerID string) string {
+		if p, ok := diffPaths[layerID]; ok {
+			return p
+		}
+		p := ""
+		if _, ok := r.lookup(layerID); ok {
+			if lp, err := driver.LayerDiffPath(layerID); err == nil {
+				p = lp
+			}
+		}
+		diffPaths[layerID] = p
+		return p
+	}
+	linked := 0
+	for _, file := range files {
+		p, info, key := file.path, file.info, file.key
+		rel, err := filepath.Rel(diffPath, p)
+		if err != nil {
+			return err
+		}
+		var kept []dedupLocation
+		shared := false
+		for _, location := range index[key] {
+			// Drop entries for files which have gone away, or
+			// which don't look the way they did when we added them.
+			sourceDiffPath := layerDiffPath(location.Layer)
+			if sourceDiffPath == "" {
+				continue
+			}
+			source := filepath.Join(sourceDiffPath, location.Path)
+			sourceInfo, err := os.Lstat(source)
+			if err != nil || !dedupFileMatches(sourceInfo, info) {
+				continue
+			}
+			kept = append(kept, location)
+			if shared {
+				continue
+			}
+			if os.SameFile(sourceInfo, info) {
+				shared = true
+				continue
+			}
+			tmp := p + ".dedup"
+			if err := os.Link(source, tmp); err != nil {
+				logrus.Debugf("Error linking %s to %s: %v", source, p, err)
+				continue
+			}
+			if err := os.Rename(tmp, p); err != nil {
+				logrus.Debugf("Error replacing %s with a link to %s: %v", p, source, err)
+				os.Remove(tmp)
+				continue
+			}
+			shared = true
+			linked++
+		}
+		index[key] = append(kept, dedupLocation{Layer: id, Path: rel})
+		r.dedupIndexChanged = true
+	}
+	logrus.Debugf("Replaced %d files in layer %s with links to files in other layers", linked, id)
+	return nil
+}
+
+// forgetDedupLayer removes a layer's files from the dedup index.  Files in
+// other layers which were linked to them aren't affected when the layer is
+// removed, and they're still listed in the index.  The caller must hold the
+// layer store's lock, and save the layer records afterward.
+func (r *layerStore) forgetDedupLayer(id string) {
+	if r.dedupIndex == nil {
+		if _, err := os.Stat(r.dedupIndexPath()); err != nil {
+			return
+		}
+	}
+	index := r.loadDedupIndex()
+	changed := false
+	for key, locations := range index {
+		kept := locations[:0]
+		for _, location := range locations {
+			if location.Layer != id {
+				kept = append(kept, location)
+			}
+		}
+		if len(kept) == len(locations) {
+			continue
+		}
+		changed = true
+		if len(kept) == 0 {
+			delete(index, key)
+		} else {
+			index[key] = kept
+		}
+	}
+	if changed {
+		r.dedupIndexChanged = true
+	}
+}
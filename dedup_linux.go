@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/containers/storage/pkg/system"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// dedupFileKey computes a key which is the same for files which could be
+// replaced with hard links to one another: regular files with the same
+// contents, permissions, ownership, modification times, and extended
+// attributes, since files which are linked share all of them.  Empty files,
+// and files which are already hard links, aren't worth considering, and for
+// them, false is returned.
+func dedupFileKey(path string, info os.FileInfo) (string, bool, error) {
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		return "", false, nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink != 1 {
+		return "", false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), f); err != nil {
+		return "", false, err
+	}
+	attrs, err := system.Llistxattr(path)
+	if err != nil {
+		return "", false, err
+	}
+	sort.Strings(attrs)
+	var xattrs strings.Builder
+	for _, attr := range attrs {
+		value, err := system.Lgetxattr(path, attr)
+		if err != nil {
+			return "", false, err
+		}
+		fmt.Fprintf(&xattrs, "%s=%x;", attr, value)
+	}
+	key := fmt.Sprintf("%s:%o:%d:%d:%d:%s", digester.Digest(), st.Mode, st.Uid, st.Gid, info.ModTime().UnixNano(), xattrs.String())
+	return digest.FromString(key).String(), true, nil
+}
+
+// dedupFileMatches returns true if a file which is listed in the dedup index
+// still looks like a file with the same key as another file would.
+func dedupFileMatches(source, info os.FileInfo) bool {
+	sourceSt, ok := source.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return source.Mode().IsRegular() && source.Size() == info.Size() && source.ModTime().Equal(info.ModTime()) && sourceSt.Mode == st.Mode && sourceSt.Uid == st.Uid && sourceSt.Gid == st.Gid
+}
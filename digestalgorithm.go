@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// digestAlgorithmFile is the name of the file, at the top of the graph root,
+// in which we record the algorithm which is used to compute the digests of
+// the uncompressed contents of layers, if it isn't digest.Canonical.
+const digestAlgorithmFile = "digest-algorithm"
+
+// chooseDigestAlgorithm returns the algorithm which the store uses to compute
+// the digests of the uncompressed contents of layers.  A store keeps using
+// the algorithm which it started out with, so the requested one is only
+// recorded and used if the store doesn't have any layers yet.  The caller
+// should be holding the graph lock.
+func (s *store) chooseDigestAlgorithm(requested string) (digest.Algorithm, error) {
+	algorithm := digest.Canonical
+	if requested != "" {
+		algorithm = digest.Algorithm(requested)
+		if !algorithm.Available() {
+			return "", errors.Wrapf(ErrNotSupported, "digest algorithm %q is not available", requested)
+		}
+	}
+	path := filepath.Join(s.graphRoot, digestAlgorithmFile)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		recorded := digest.Algorithm(strings.TrimSpace(string(data)))
+		if !recorded.Available() {
+			return "", errors.Wrapf(ErrNotSupported, "the store at %q uses digest algorithm %q, which is not available", s.graphRoot, recorded)
+		}
+		if requested != "" && recorded != algorithm {
+			logrus.Debugf("Store at %q uses digest algorithm %q, not %q", s.graphRoot, recorded, algorithm)
+		}
+		return recorded, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	// Stores which don't have a record of their algorithm use the
+	// canonical one.
+	if algorithm == digest.Canonical || s.readOnly {
+		return digest.Canonical, nil
+	}
+	hasLayers, err := s.hasLayerRecords()
+	if err != nil {
+		return "", err
+	}
+	if hasLayers {
+		logrus.Warnf("Not switching the store at %q, which already has layers, to digest algorithm %q", s.graphRoot, algorithm)
+		return digest.Canonical, nil
+	}
+	if err := ioutils.AtomicWriteFile(path, []byte(algorithm.String()+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return algorithm, nil
+}
+
+// hasLayerRecords returns true if any graph driver's layer store in the graph
+// root has records of layers.
+func (s *store) hasLayerRecords() (bool, error) {
+	matches, err := filepath.Glob(filepath.Join(s.graphRoot, "*-layers", "layers.json"))
+	if err != nil {
+		return false, err
+	}
+	for _, match := range matches {
+		data, err := ioutil.ReadFile(match)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return false, err
+		}
+		var layers []Layer
+		if err := json.Unmarshal(data, &layers); err != nil || len(layers) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *store) DigestAlgorithm() digest.Algorithm {
+	return s.digestAlgorithm
+}
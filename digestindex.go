@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// A layer store's indexes of layers by digest are saved in digests.json, so
+// that we don't have to rebuild them from scratch every time we load the layer
+// records.  Rather than rewriting the whole file every time the records are
+// saved, the changes which were made to the indexes are appended to
+// digests.log, which is folded back into digests.json once it's grown long
+// enough, the next time that a process which has loaded the indexes saves the
+// records.  Both files identify the versions of layers.json which they
+// describe by digest, so that indexes which don't describe the records which
+// we've read, as would be the case if layers.json was rewritten by a process
+// which didn't know about them, are ignored.
+
+// layerDigestLogCompactionThreshold is the number of entries which we'll let
+// accumulate in digests.log, or the number of layers if there are more of
+// them, before folding it back into digests.json.
+const layerDigestLogCompactionThreshold = 1000
+
+// layerDigestIndex is the contents of digests.json.
+type layerDigestIndex struct {
+	// Records is the digest of the version of layers.json which the
+	// indexes describe.
+	Records      digest.Digest              `json:"records"`
+	Compressed   map[digest.Digest][]string `json:"compressed,omitempty"`
+	Uncompressed map[digest.Digest][]string `json:"uncompressed,omitempty"`
+}
+
+// layerDigestLogEntry is one line of digests.log, which records the changes
+// made to the indexes between two versions of layers.json.
+type layerDigestLogEntry struct {
+	Previous digest.Digest       `json:"previous"`
+	Records  digest.Digest       `json:"records"`
+	Changes  []layerDigestChange `json:"changes,omitempty"`
+}
+
+// layerDigestChange records that a layer was added to or removed from the
+// indexes of layers by digest, along with the digests it was indexed under.
+type layerDigestChange struct {
+	ID           string          `json:"id"`
+	Remove       bool            `json:"remove,omitempty"`
+	Compressed   digest.Digest   `json:"compressed,omitempty"`
+	Uncompressed []digest.Digest `json:"uncompressed,omitempty"`
+}
+
+func (r *layerStore) digestindexpath() string {
+	return filepath.Join(r.layerdir, "digests.json")
+}
+
+func (r *layerStore) digestlogpath() string {
+	return filepath.Join(r.layerdir, "digests.log")
+}
+
+// loadDigestIndex reads the saved indexes of layers by digest, and applies
+// the changes in the log to them, until they describe the version of the
+// layer records whose digest is records.  It returns the number of entries
+// in the log, and whether or not the indexes could be brought up to date.
+func (r *layerStore) loadDigestIndex(records digest.Digest) (compressed, uncompressed map[digest.Digest][]string, entries int, ok bool) {
+	data, err := ioutil.ReadFile(r.digestindexpath())
+	if err != nil {
+		return nil, nil, 0, false
+	}
+	var index layerDigestIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		logrus.Debugf("error decoding %q: %v", r.digestindexpath(), err)
+		return nil, nil, 0, false
+	}
+	if index.Compressed == nil {
+		index.Compressed = make(map[digest.Digest][]string)
+	}
+	if index.Uncompressed == nil {
+		index.Uncompressed = make(map[digest.Digest][]string)
+	}
+	f, err := os.Open(r.digestlogpath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("error reading %q: %v", r.digestlogpath(), err)
+		}
+		return index.Compressed, index.Uncompressed, 0, index.Records == records
+	}
+	defer f.Close()
+	current := index.Records
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var entry layerDigestLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The rest of the log can't be trusted.
+			logrus.Debugf("%s is damaged after %d entries", r.digestlogpath(), entries)
+			break
+		}
+		entries++
+		if current == records {
+			continue
+		}
+		if entry.Previous != current {
+			// The entry was made by a process which didn't
+			// start with the records which the indexes describe.
+			continue
+		}
+		for _, change := range entry.Changes {
+			change.apply(index.Compressed, index.Uncompressed)
+		}
+		current = entry.Records
+	}
+	return index.Compressed, index.Uncompressed, entries, current == records
+}
+
+// apply makes the change to the indexes.
+func (c *layerDigestChange) apply(compressed, uncompressed map[digest.Digest][]string) {
+	if c.Remove {
+		updateDigestMap(&compressed, c.Compressed, "", c.ID)
+		for _, d := range c.Uncompressed {
+			updateDigestMap(&uncompressed, d, "", c.ID)
+		}
+		return
+	}
+	updateDigestMap(&compressed, "", c.Compressed, c.ID)
+	for _, d := range c.Uncompressed {
+		updateDigestMap(&uncompressed, "", d, c.ID)
+	}
+}
+
+// newLayerDigestChange describes adding the layer to the indexes, or removing
+// it from them.
+func newLayerDigestChange(layer *Layer, remove bool) layerDigestChange {
+	change := layerDigestChange{
+		ID:         layer.ID,
+		Remove:     remove,
+		Compressed: layer.CompressedDigest,
+	}
+	if layer.UncompressedDigest != "" {
+		change.Uncompressed = append(change.Uncompressed, layer.UncompressedDigest)
+	}
+	change.Uncompressed = append(change.Uncompressed, layer.AdditionalUncompressedDigests...)
+	return change
+}
+
+// resetDigests discards our indexes of layers by digest, which will be loaded
+// or built again when they're next needed.  records is the digest of the layer
+// records which we just read.
+func (r *layerStore) resetDigests(records digest.Digest) {
+	r.digestsMut.Lock()
+	defer r.digestsMut.Unlock()
+	r.digestsLoaded = false
+	r.digestsRecords = records
+	r.digestsChanges = nil
+	r.digestsCompact = false
+	r.bycompressedsum = nil
+	r.byuncompressedsum = nil
+}
+
+// loadDigests makes sure that our indexes of layers by digest are ready to be
+// used, reading the ones which were saved along with the layer records if they
+// can be brought up to date, and building them otherwise.
+func (r *layerStore) loadDigests() {
+	r.digestsMut.Lock()
+	defer r.digestsMut.Unlock()
+	if r.digestsLoaded {
+		return
+	}
+	r.digestsLoaded = true
+	threshold := layerDigestLogCompactionThreshold
+	if len(r.layers) > threshold {
+		threshold = len(r.layers)
+	}
+	if r.digestsRecords != "" {
+		if compressed, uncompressed, entries, ok := r.loadDigestIndex(r.digestsRecords); ok {
+			r.bycompressedsum, r.byuncompressedsum = compressed, uncompressed
+			r.digestsCompact = entries >= threshold
+			// Changes which we've made since we read the
+			// records aren't in the saved indexes yet.
+			for _, change := range r.digestsChanges {
+				change.apply(r.bycompressedsum, r.byuncompressedsum)
+			}
+			return
+		}
+	}
+	r.bycompressedsum = make(map[digest.Digest][]string)
+	r.byuncompressedsum = make(map[digest.Digest][]string)
+	for _, layer := range r.layers {
+		change := newLayerDigestChange(layer, false)
+		change.apply(r.bycompressedsum, r.byuncompressedsum)
+	}
+	r.digestsCompact = true
+}
+
+// indexDigests updates the indexes of layers by digest after the layer was
+// added, or after its digests were changed.  The change is remembered so that
+// it can be added to the saved indexes, even if we haven't loaded them.
+func (r *layerStore) indexDigests(layer *Layer) {
+	r.digestsMut.Lock()
+	defer r.digestsMut.Unlock()
+	change := newLayerDigestChange(layer, false)
+	r.digestsChanges = append(r.digestsChanges, change)
+	if r.digestsLoaded {
+		change.apply(r.bycompressedsum, r.byuncompressedsum)
+	}
+}
+
+// unindexDigests updates the indexes of layers by digest before the layer is
+// removed, or before its digests are changed.
+func (r *layerStore) unindexDigests(layer *Layer) {
+	r.digestsMut.Lock()
+	defer r.digestsMut.Unlock()
+	change := newLayerDigestChange(layer, true)
+	r.digestsChanges = append(r.digestsChanges, change)
+	if r.digestsLoaded {
+		change.apply(r.bycompressedsum, r.byuncompressedsum)
+	}
+}
+
+// saveDigestIndex updates the saved indexes of layers by digest after we've
+// written the version of the layer records whose digest is records.  The
+// changes which we've made since we read or wrote the previous version are
+// appended to the log, unless we've loaded the indexes and the log should be
+// folded into digests.json, in which case all of the indexes are written.
+// Nothing is saved if nothing has been saved before and we haven't loaded the
+// indexes.  The indexes are only an optimization, so failing to save them
+// isn't treated as an error.
+func (r *layerStore) saveDigestIndex(records digest.Digest) {
+	r.digestsMut.Lock()
+	defer r.digestsMut.Unlock()
+	entry := layerDigestLogEntry{
+		Previous: r.digestsRecords,
+		Records:  records,
+		Changes:  r.digestsChanges,
+	}
+	r.digestsRecords, r.digestsChanges = records, nil
+	_, err := os.Stat(r.digestindexpath())
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error checking for %q: %v", r.digestindexpath(), err)
+		return
+	}
+	if r.digestsLoaded && (r.digestsCompact || err != nil) {
+		if err := r.writeDigestIndex(records); err != nil {
+			logrus.Debugf("error saving %q: %v", r.digestindexpath(), err)
+		}
+		r.digestsCompact = false
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err := r.appendDigestLog(&entry); err != nil {
+		logrus.Debugf("error appending to %q: %v", r.digestlogpath(), err)
+	}
+}
+
+// writeDigestIndex writes all of the indexes to digests.json, and removes the
+// log, whose changes are included in them.
+func (r *layerStore) writeDigestIndex(records digest.Digest) error {
+	index := layerDigestIndex{
+		Records:      records,
+		Compressed:   r.bycompressedsum,
+		Uncompressed: r.byuncompressedsum,
+	}
+	data, err := json.Marshal(&index)
+	if err == nil {
+		err = ioutils.AtomicWriteFile(r.digestindexpath(), data, 0600)
+	}
+	if err != nil {
+		// Don't leave indexes for an older version of the records
+		// where the log might still bring them up to date.
+		if err := os.Remove(r.digestindexpath()); err != nil && !os.IsNotExist(err) {
+			logrus.Debugf("error removing %q: %v", r.digestindexpath(), err)
+		}
+		return err
+	}
+	if err := os.Remove(r.digestlogpath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// appendDigestLog adds the entry to the end of the log.  The entry is written
+// all at once, so that a process which is interrupted can't leave part of it
+// in the log to be mistaken for a complete entry.
+func (r *layerStore) appendDigestLog(entry *layerDigestLogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(data)
+	buf.WriteByte('\n')
+	f, err := os.OpenFile(r.digestlogpath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
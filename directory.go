@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"os"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ApplyDirectoryOptions is used for passing options to a Store's
+// ApplyDirectory() method.
+type ApplyDirectoryOptions struct {
+	// Move, if set, moves the directory's contents into the layer instead
+	// of copying them, leaving the directory empty.  Contents which can't
+	// be moved, because they're on a different filesystem, are copied and
+	// then removed.
+	Move bool
+}
+
+func (r *layerStore) ApplyDirectory(to, dir string, options *ApplyDirectoryOptions) (int64, error) {
+	if !r.IsReadWrite() {
+		return -1, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
+	}
+	if options == nil {
+		options = &ApplyDirectoryOptions{}
+	}
+	layer, ok := r.lookup(to)
+	if !ok {
+		return -1, ErrLayerUnknown
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		return -1, err
+	}
+	if !st.IsDir() {
+		return -1, errors.Errorf("%q is not a directory", dir)
+	}
+	r.discardChangeJournal(layer.ID)
+
+	var result *layerDiffResult
+	if driver, ok := r.driver.(drivers.LayerDiffPathDriver); ok {
+		diffPath, err := driver.LayerDiffPath(layer.ID)
+		if err != nil {
+			return -1, err
+		}
+		if result, err = applyDirectoryInPlace(dir, diffPath, options.Move); err != nil {
+			if errors.Cause(err) != ErrNotSupported {
+				return -1, errors.Wrapf(err, "error populating layer %q from %q", layer.ID, dir)
+			}
+			result = nil
+		}
+	}
+	if result == nil {
+		// Fall back to making a diff out of the directory's contents.
+		// Its contents are already owned by the IDs that they should
+		// have in the layer, so they don't need to be mapped.
+		logrus.Debugf("Populating layer %q from %q by extracting a diff of it", layer.ID, dir)
+		uncompressed := archive.Uncompressed
+		diff, err := archive.Tar(dir, uncompressed)
+		if err != nil {
+			return -1, err
+		}
+		defer diff.Close()
+		if result, err = r.extractDiff(layer, &idtools.IDMappings{}, nil, diff); err != nil {
+			return -1, err
+		}
+		if options.Move {
+			if err := removeDirectoryContents(dir); err != nil {
+				return -1, err
+			}
+		}
+	} else {
+		// We don't have a diff, so there's nothing to reassemble one
+		// from, and the digests of the one we had no longer apply.
+		if err := os.Remove(r.tspath(layer.ID)); err != nil && !os.IsNotExist(err) {
+			return -1, err
+		}
+	}
+	r.recordDiffResult(layer, result)
+	return result.size, r.Save()
+}
+
+// removeDirectoryContents removes everything in a directory, but not the
+// directory itself.
+func removeDirectoryContents(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(dir + string(os.PathSeparator) + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
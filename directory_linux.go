@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/system"
+)
+
+// applyDirectoryInPlace moves or copies the contents of dir into diffPath, the
+// directory in which a driver keeps the files which a layer adds or changes,
+// cloning the contents of files instead of copying them where the filesystem
+// allows it.  Items which are already present in diffPath are replaced, except
+// for directories, whose contents are merged.
+func applyDirectoryInPlace(dir, diffPath string, move bool) (*layerDiffResult, error) {
+	result := &layerDiffResult{}
+	uids := make(map[uint32]struct{})
+	gids := make(map[uint32]struct{})
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uids[st.Uid] = struct{}{}
+			gids[st.Gid] = struct{}{}
+		}
+		if info.Mode().IsRegular() {
+			result.size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := transferDirectory(dir, diffPath, move); err != nil {
+		return nil, err
+	}
+	// Without a diff, the best size we have is that of its contents.
+	result.uncompressedSize = result.size
+	for uid := range uids {
+		result.uids = append(result.uids, uid)
+	}
+	sort.Slice(result.uids, func(i, j int) bool {
+		return result.uids[i] < result.uids[j]
+	})
+	for gid := range gids {
+		result.gids = append(result.gids, gid)
+	}
+	sort.Slice(result.gids, func(i, j int) bool {
+		return result.gids[i] < result.gids[j]
+	})
+	return result, nil
+}
+
+// transferDirectory moves or copies the contents of src into dest.
+func transferDirectory(src, dest string, move bool) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		destPath := filepath.Join(dest, entry.Name())
+		if existing, err := os.Lstat(destPath); err == nil {
+			if entry.IsDir() && existing.IsDir() {
+				if err := transferDirectory(srcPath, destPath, move); err != nil {
+					return err
+				}
+				if err := copyDirectoryAttributes(srcPath, entry, destPath); err != nil {
+					return err
+				}
+				if move {
+					if err := os.Remove(srcPath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := os.RemoveAll(destPath); err != nil {
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if move {
+			if err := os.Rename(srcPath, destPath); err == nil {
+				continue
+			}
+		}
+		if err := copy.DirCopy(srcPath, destPath, copy.Content, true); err != nil {
+			return err
+		}
+		if move {
+			if err := os.RemoveAll(srcPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyDirectoryAttributes gives dest, a directory whose contents were merged
+// with those of src, the ownership, permissions, and timestamps of src.
+func copyDirectoryAttributes(src string, info os.FileInfo, dest string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := idtools.SafeLchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dest, info.Mode()); err != nil {
+		return err
+	}
+	return system.Chtimes(dest, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package storage
+
+import "github.com/pkg/errors"
+
+// applyDirectoryInPlace moves or copies the contents of dir into diffPath.  We
+// don't know how to do that here, so the caller has to make a diff instead.
+func applyDirectoryInPlace(dir, diffPath string, move bool) (*layerDiffResult, error) {
+	return nil, errors.Wrapf(ErrNotSupported, "populating layers directly from directories")
+}
@@ -65,8 +65,15 @@ var (
 
 const defaultPerms = os.FileMode(0555)
 
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"aufs"},
+	Names:    []string{"mountopt"},
+}
+
 func init() {
 	graphdriver.Register("aufs", Init)
+	graphdriver.RegisterOptionNames("aufs", OptionNames)
 }
 
 // Driver contains information about the filesystem mounted.
@@ -760,6 +767,14 @@ func (a *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMapp
 	return fmt.Errorf("aufs doesn't support changing ID mappings")
 }
 
+// Capabilities reports which optional features the driver provides.
+func (a *Driver) Capabilities() graphdriver.Capabilities {
+	return graphdriver.Capabilities{
+		NativeDiff:     true,
+		WhiteoutFormat: graphdriver.WhiteoutFormatAUFS,
+	}
+}
+
 // SupportsShifting tells whether the driver support shifting of the UIDs/GIDs in an userNS
 func (a *Driver) SupportsShifting() bool {
 	return false
@@ -0,0 +1,101 @@
+package graphdriver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// BackupFile describes one of the files which hold a frozen layer's data.
+type BackupFile struct {
+	// Path is the location of the file, which remains valid until the
+	// layer is thawed.
+	Path string `json:"path"`
+	// Name is the location of the file relative to the directory which
+	// holds the layer's data.
+	Name string `json:"name"`
+	// Mode is the file's type and permissions.
+	Mode os.FileMode `json:"mode"`
+	// Size is the size of a regular file.
+	Size int64 `json:"size,omitempty"`
+	// Digest is the digest of the contents of a regular file.
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+// BackupDriver is the interface for drivers which can hold the data for a
+// layer still, so that backup tools can copy it without racing against
+// changes which are being made to it, or to the layers which are being
+// created on top of it.
+// This API is experimental and can be changed without bumping the major version number.
+type BackupDriver interface {
+	Driver
+	// FreezeLayer arranges for the layer's data to stop changing until
+	// ThawLayer() is called, either by preventing it from being changed
+	// or by taking a snapshot of it.  It fails with ErrLayerFrozen if the
+	// layer is already frozen.
+	FreezeLayer(id string) error
+	// ThawLayer undoes the effect of FreezeLayer().
+	ThawLayer(id string) error
+	// BackupFiles lists the files which hold a frozen layer's data, with
+	// digests of the contents of the regular files, in order of their
+	// names.
+	BackupFiles(id string) ([]BackupFile, error)
+}
+
+// ListBackupFiles lists the contents of dir for a BackupDriver's BackupFiles()
+// method, leaving out the entries at the top level of dir which skip returns
+// true for, if skip is not nil.
+func ListBackupFiles(dir string, skip func(name string) bool) ([]BackupFile, error) {
+	var files []BackupFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if skip != nil && filepath.Dir(name) == "." && skip(name) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		file := BackupFile{
+			Path: path,
+			Name: name,
+			Mode: info.Mode(),
+		}
+		if info.Mode().IsRegular() {
+			file.Size = info.Size()
+			if file.Digest, err = digestFile(path); err != nil {
+				return err
+			}
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// digestFile computes the digest of the contents of a file.
+func digestFile(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), f); err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
@@ -0,0 +1,64 @@
+// +build linux,cgo
+
+package btrfs
+
+import (
+	"os"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+)
+
+func (d *Driver) backupsDir() string {
+	return path.Join(d.home, "backups")
+}
+
+func (d *Driver) backupsDirID(id string) string {
+	return path.Join(d.backupsDir(), id)
+}
+
+// FreezeLayer takes a snapshot of the layer's subvolume, which is kept until
+// ThawLayer() is called.  The layer itself can go on being used normally.
+func (d *Driver) FreezeLayer(id string) error {
+	if _, err := os.Stat(d.subvolumesDirID(id)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(d.backupsDirID(id)); err == nil {
+		return errors.Wrapf(graphdriver.ErrLayerFrozen, "btrfs: layer %s", id)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(d.backupsDir(), 0700); err != nil {
+		return err
+	}
+	return subvolSnapshot(d.subvolumesDirID(id), d.backupsDir(), id)
+}
+
+// ThawLayer removes the snapshot which FreezeLayer() took.
+func (d *Driver) ThawLayer(id string) error {
+	dir := d.backupsDirID(id)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("btrfs: layer %s is not frozen", id)
+		}
+		return err
+	}
+	if err := subvolDelete(d.backupsDir(), id, d.quotaEnabled); err != nil && d.quotaEnabled {
+		return err
+	}
+	return system.EnsureRemoveAll(dir)
+}
+
+// BackupFiles lists the files in the snapshot which FreezeLayer() took.
+func (d *Driver) BackupFiles(id string) ([]graphdriver.BackupFile, error) {
+	dir := d.backupsDirID(id)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("btrfs: layer %s is not frozen", id)
+		}
+		return nil, err
+	}
+	return graphdriver.ListBackupFiles(dir, nil)
+}
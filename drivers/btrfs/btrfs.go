@@ -41,8 +41,15 @@ import (
 
 const defaultPerms = os.FileMode(0555)
 
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"btrfs"},
+	Names:    []string{"min_space", "mountopt"},
+}
+
 func init() {
 	graphdriver.Register("btrfs", Init)
+	graphdriver.RegisterOptionNames("btrfs", OptionNames)
 }
 
 type btrfsOptions struct {
@@ -138,6 +145,16 @@ func (d *Driver) String() string {
 	return "btrfs"
 }
 
+// Capabilities reports which optional features the driver provides.  Layers
+// are subvolume snapshots of their parents.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	d.updateQuotaStatus()
+	return graphdriver.Capabilities{
+		Snapshots: true,
+		Quota:     d.quotaEnabled,
+	}
+}
+
 // Status returns current driver information in a two dimensional string array.
 // Output contains "Build Version" and "Library Version" of the btrfs libraries used.
 // Version information can be used to check compatibility with your kernel.
@@ -544,6 +561,13 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) error {
 	return label.Relabel(path.Join(subvolumes, id), mountLabel, false)
 }
 
+// SnapshotLayer creates a layer which holds a snapshot of the contents of the
+// layer with the specified ID.  Since every layer is a complete subvolume, the
+// layer itself doesn't need to be modified.
+func (d *Driver) SnapshotLayer(id, parent, snapshotID string) error {
+	return subvolSnapshot(d.subvolumesDirID(id), d.subvolumesDir(), snapshotID)
+}
+
 // Parse btrfs storage options
 func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) error {
 	// Read size to change the subvolume disk quota per container
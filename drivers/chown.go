@@ -7,7 +7,6 @@ import (
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/reexec"
-	"github.com/opencontainers/selinux/pkg/pwalk"
 )
 
 const (
@@ -51,15 +50,7 @@ func chownByMapsMain() {
 		toHost = nil
 	}
 
-	chowner := newLChowner()
-
-	chown := func(path string, info os.FileInfo, _ error) error {
-		if path == "." {
-			return nil
-		}
-		return chowner.LChown(path, info, toHost, toContainer)
-	}
-	if err := pwalk.Walk(".", chown); err != nil {
+	if err := chownTree(".", newLChowner(), toHost, toContainer); err != nil {
 		fmt.Fprintf(os.Stderr, "error during chown: %v", err)
 		os.Exit(1)
 	}
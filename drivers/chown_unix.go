@@ -22,33 +22,43 @@ type inode struct {
 type platformChowner struct {
 	mutex  sync.Mutex
 	inodes map[inode]bool
+	// mapped caches the results of mapping on-disk ID pairs, since most
+	// files in a layer share a handful of owners.
+	mapped map[idtools.IDPair]idtools.IDPair
 }
 
 func newLChowner() *platformChowner {
 	return &platformChowner{
 		inodes: make(map[inode]bool),
+		mapped: make(map[idtools.IDPair]idtools.IDPair),
 	}
 }
 
-func (c *platformChowner) LChown(path string, info os.FileInfo, toHost, toContainer *idtools.IDMappings) error {
-	st, ok := info.Sys().(*syscall.Stat_t)
-	if !ok {
-		return nil
-	}
-
+// seen checks if we've already processed the inode, and marks it as processed
+// if we haven't.
+func (c *platformChowner) seen(st *syscall.Stat_t) bool {
 	i := inode{
 		Dev: uint64(st.Dev),
 		Ino: uint64(st.Ino),
 	}
 	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	_, found := c.inodes[i]
 	if !found {
 		c.inodes[i] = true
 	}
-	c.mutex.Unlock()
+	return found
+}
 
-	if found {
-		return nil
+// mapIDs computes the ownership that a file which is currently owned by uid
+// and gid should have.
+func (c *platformChowner) mapIDs(path string, uid, gid int, toHost, toContainer *idtools.IDMappings) (int, int, error) {
+	onDisk := idtools.IDPair{UID: uid, GID: gid}
+	c.mutex.Lock()
+	mapped, ok := c.mapped[onDisk]
+	c.mutex.Unlock()
+	if ok {
+		return mapped.UID, mapped.GID, nil
 	}
 
 	// Map an on-disk UID/GID pair from host to container
@@ -56,7 +66,6 @@ func (c *platformChowner) LChown(path string, info os.FileInfo, toHost, toContai
 	// second map.  Skip that first step if they're 0, to
 	// compensate for cases where a parent layer should
 	// have had a mapped value, but didn't.
-	uid, gid := int(st.Uid), int(st.Gid)
 	if toContainer != nil {
 		pair := idtools.IDPair{
 			UID: uid,
@@ -65,7 +74,7 @@ func (c *platformChowner) LChown(path string, info os.FileInfo, toHost, toContai
 		mappedUID, mappedGID, err := toContainer.ToContainer(pair)
 		if err != nil {
 			if (uid != 0) || (gid != 0) {
-				return fmt.Errorf("error mapping host ID pair %#v for %q to container: %v", pair, path, err)
+				return -1, -1, fmt.Errorf("error mapping host ID pair %#v for %q to container: %v", pair, path, err)
 			}
 			mappedUID, mappedGID = uid, gid
 		}
@@ -78,10 +87,31 @@ func (c *platformChowner) LChown(path string, info os.FileInfo, toHost, toContai
 		}
 		mappedPair, err := toHost.ToHost(pair)
 		if err != nil {
-			return fmt.Errorf("error mapping container ID pair %#v for %q to host: %v", pair, path, err)
+			return -1, -1, fmt.Errorf("error mapping container ID pair %#v for %q to host: %v", pair, path, err)
 		}
 		uid, gid = mappedPair.UID, mappedPair.GID
 	}
+
+	c.mutex.Lock()
+	c.mapped[onDisk] = idtools.IDPair{UID: uid, GID: gid}
+	c.mutex.Unlock()
+	return uid, gid, nil
+}
+
+func (c *platformChowner) LChown(path string, info os.FileInfo, toHost, toContainer *idtools.IDMappings) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if c.seen(st) {
+		return nil
+	}
+
+	uid, gid, err := c.mapIDs(path, int(st.Uid), int(st.Gid), toHost, toContainer)
+	if err != nil {
+		return err
+	}
 	if uid != int(st.Uid) || gid != int(st.Gid) {
 		cap, err := system.Lgetxattr(path, "security.capability")
 		if err != nil && !errors.Is(err, system.EOPNOTSUPP) && err != system.ErrNotSupportedPlatform {
@@ -0,0 +1,198 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+// chownDirentBufferSize is the size of the buffer which each worker reads
+// directory entries into.  It's large enough that most directories can be
+// read with a single call to getdents64.
+const chownDirentBufferSize = 128 * 1024
+
+// dirQueue is the list of directories which chownTree's workers have yet to
+// process, along with a count of directories which are either queued or being
+// processed, so that idle workers can tell when there's nothing left to do.
+type dirQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	dirs    []string
+	pending int
+	err     error
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *dirQueue) push(dir string) {
+	q.mutex.Lock()
+	q.dirs = append(q.dirs, dir)
+	q.pending++
+	q.cond.Signal()
+	q.mutex.Unlock()
+}
+
+// pop waits for a directory to process, and returns false when there are
+// none left or an error has been recorded.
+func (q *dirQueue) pop() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.dirs) == 0 && q.pending > 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil || len(q.dirs) == 0 {
+		return "", false
+	}
+	dir := q.dirs[len(q.dirs)-1]
+	q.dirs = q.dirs[:len(q.dirs)-1]
+	return dir, true
+}
+
+// done marks a directory which was returned by pop as processed.
+func (q *dirQueue) done(err error) {
+	q.mutex.Lock()
+	q.pending--
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	if q.pending == 0 || q.err != nil {
+		q.cond.Broadcast()
+	}
+	q.mutex.Unlock()
+}
+
+// chownTree changes the ownership of everything under dir, except for dir
+// itself.  Directories are read in large batches using getdents64, entries
+// are examined relative to their directory's descriptor, and several
+// directories are processed in parallel.  Entries whose ownership is already
+// correct are left alone, so that they aren't needlessly copied up if dir is
+// an overlay mount.
+func chownTree(dir string, chowner *platformChowner, toHost, toContainer *idtools.IDMappings) error {
+	queue := newDirQueue()
+	queue.push(dir)
+
+	workers := runtime.NumCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chownDirentBufferSize)
+			for {
+				dir, ok := queue.pop()
+				if !ok {
+					return
+				}
+				queue.done(chowner.chownDir(dir, buf, queue, toHost, toContainer))
+			}
+		}()
+	}
+	wg.Wait()
+	return queue.err
+}
+
+// chownDir changes the ownership of the entries in a directory, adding any
+// subdirectories to the queue.
+func (c *platformChowner) chownDir(dir string, buf []byte, queue *dirQueue, toHost, toContainer *idtools.IDMappings) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	defer unix.Close(fd)
+
+	var names []string
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return &os.PathError{Op: "getdents64", Path: dir, Err: err}
+		}
+		if n <= 0 {
+			break
+		}
+		_, _, names = unix.ParseDirent(buf[:n], -1, names[:0])
+		for _, name := range names {
+			var st unix.Stat_t
+			if err := unix.Fstatat(fd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				if err == unix.ENOENT {
+					continue
+				}
+				return &os.PathError{Op: "fstatat", Path: filepath.Join(dir, name), Err: err}
+			}
+			path := filepath.Join(dir, name)
+			if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+				queue.push(path)
+			}
+			if err := c.lchownAt(fd, name, path, &st, toHost, toContainer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lchownAt changes the ownership of the entry named name in the directory
+// open as dirfd, which is at path and which has the attributes in st.
+func (c *platformChowner) lchownAt(dirfd int, name, path string, st *unix.Stat_t, toHost, toContainer *idtools.IDMappings) error {
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	isLink := st.Mode&unix.S_IFMT == unix.S_IFLNK
+	// Only entries with more than one link can be reached more than once.
+	if !isDir && st.Nlink > 1 {
+		i := inode{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+		c.mutex.Lock()
+		found := c.inodes[i]
+		c.inodes[i] = true
+		c.mutex.Unlock()
+		if found {
+			return nil
+		}
+	}
+
+	uid, gid, err := c.mapIDs(path, int(st.Uid), int(st.Gid), toHost, toContainer)
+	if err != nil {
+		return err
+	}
+	if uid == int(st.Uid) && gid == int(st.Gid) {
+		return nil
+	}
+
+	var cap []byte
+	if !isLink && !isDir {
+		cap, err = system.Lgetxattr(path, "security.capability")
+		if err != nil && !errors.Is(err, system.EOPNOTSUPP) {
+			return fmt.Errorf("%s: %v", os.Args[0], err)
+		}
+	}
+	// Make the change.
+	if err := unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("%s: %v", os.Args[0], &os.PathError{Op: "lchown", Path: path, Err: err})
+	}
+	// Restore the SUID and SGID bits if they were originally set.
+	if !isLink && st.Mode&(unix.S_ISUID|unix.S_ISGID) != 0 {
+		if err := unix.Fchmodat(dirfd, name, st.Mode&07777, 0); err != nil {
+			return fmt.Errorf("%s: %v", os.Args[0], &os.PathError{Op: "chmod", Path: path, Err: err})
+		}
+	}
+	if cap != nil {
+		if err := system.Lsetxattr(path, "security.capability", cap, 0); err != nil {
+			return fmt.Errorf("%s: %v", os.Args[0], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestChownTree(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	dir, err := ioutil.TempDir("", "storage-chown-tree")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Build a tree that's wide and deep enough to keep several workers busy.
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, "dir", string(rune('a'+i)), "nested")
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		for j := 0; j < 50; j++ {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(sub, string(rune('a'+j%26))+string(rune('a'+j/26))), nil, 0644))
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "setuid"), nil, 0755))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "setuid"), 0755|os.ModeSetuid))
+	require.NoError(t, os.Link(filepath.Join(dir, "setuid"), filepath.Join(dir, "hardlink")))
+	require.NoError(t, os.Symlink("setuid", filepath.Join(dir, "symlink")))
+	require.NoError(t, os.Lchown(filepath.Join(dir, "symlink"), 5, 5))
+
+	toHost := idtools.NewIDMappingsFromMaps([]idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}, []idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}})
+	require.NoError(t, chownTree(dir, newLChowner(), toHost, nil))
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Lstat(dir, &st))
+	require.Equal(t, uint32(0), st.Uid, "the top directory should have been left alone")
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		require.NoError(t, unix.Lstat(path, &st))
+		if filepath.Base(path) == "symlink" {
+			require.Equal(t, uint32(100005), st.Uid, path)
+			require.Equal(t, uint32(200005), st.Gid, path)
+			return nil
+		}
+		require.Equal(t, uint32(100000), st.Uid, path)
+		require.Equal(t, uint32(200000), st.Gid, path)
+		return nil
+	})
+	require.NoError(t, err)
+	fi, err := os.Stat(filepath.Join(dir, "setuid"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeSetuid)
+}
@@ -0,0 +1,21 @@
+// +build !linux
+
+package graphdriver
+
+import (
+	"os"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/opencontainers/selinux/pkg/pwalk"
+)
+
+// chownTree changes the ownership of everything under dir, except for dir
+// itself.
+func chownTree(dir string, chowner *platformChowner, toHost, toContainer *idtools.IDMappings) error {
+	return pwalk.Walk(dir, func(path string, info os.FileInfo, _ error) error {
+		if path == dir {
+			return nil
+		}
+		return chowner.LChown(path, info, toHost, toContainer)
+	})
+}
@@ -15,6 +15,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -22,6 +23,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/pools"
 	"github.com/containers/storage/pkg/system"
@@ -40,8 +42,65 @@ const (
 	Hardlink
 )
 
+// Stats counts how the contents of regular files were copied.
+type Stats struct {
+	// ClonedFiles and ClonedBytes count files which were cloned, sharing
+	// their contents with the originals.
+	ClonedFiles int64 `json:"cloned-files,omitempty"`
+	ClonedBytes int64 `json:"cloned-bytes,omitempty"`
+	// RangeCopiedFiles and RangeCopiedBytes count files which were copied
+	// using copy_file_range(), which lets the kernel, or the filesystem,
+	// copy the data without passing it through userspace.
+	RangeCopiedFiles int64 `json:"range-copied-files,omitempty"`
+	RangeCopiedBytes int64 `json:"range-copied-bytes,omitempty"`
+	// CopiedFiles and CopiedBytes count files which were copied by reading
+	// and writing their contents.
+	CopiedFiles int64 `json:"copied-files,omitempty"`
+	CopiedBytes int64 `json:"copied-bytes,omitempty"`
+	// HoleBytes counts bytes in holes in sparse files which were preserved
+	// rather than being copied.
+	HoleBytes int64 `json:"hole-bytes,omitempty"`
+}
+
+// Add adds the counts in other to s.
+func (s *Stats) Add(other Stats) {
+	s.ClonedFiles += other.ClonedFiles
+	s.ClonedBytes += other.ClonedBytes
+	s.RangeCopiedFiles += other.RangeCopiedFiles
+	s.RangeCopiedBytes += other.RangeCopiedBytes
+	s.CopiedFiles += other.CopiedFiles
+	s.CopiedBytes += other.CopiedBytes
+	s.HoleBytes += other.HoleBytes
+}
+
+// SupportsReflinks returns true if the file system which holds dir can share
+// the contents of files using reflinks.
+func SupportsReflinks(dir string) bool {
+	src, err := ioutil.TempFile(dir, ".reflink-check")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	if _, err := src.Write([]byte{0}); err != nil {
+		return false
+	}
+	dst, err := ioutil.TempFile(dir, ".reflink-check")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), C.FICLONE, src.Fd())
+	return errno == 0
+}
+
 // CopyRegularToFile copies the content of a file to another
 func CopyRegularToFile(srcPath string, dstFile *os.File, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool) error { // nolint: golint
+	return copyRegularToFile(srcPath, dstFile, fileinfo, copyWithFileRange, copyWithFileClone, &Stats{})
+}
+
+func copyRegularToFile(srcPath string, dstFile *os.File, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool, stats *Stats) error {
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
 		return err
@@ -49,31 +108,70 @@ func CopyRegularToFile(srcPath string, dstFile *os.File, fileinfo os.FileInfo, c
 	defer srcFile.Close()
 
 	if *copyWithFileClone {
-		_, _, err = unix.Syscall(unix.SYS_IOCTL, dstFile.Fd(), C.FICLONE, srcFile.Fd())
-		if err == nil {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, dstFile.Fd(), C.FICLONE, srcFile.Fd())
+		if errno == 0 {
+			stats.ClonedFiles++
+			stats.ClonedBytes += fileinfo.Size()
 			return nil
 		}
 
 		*copyWithFileClone = false
-		if err == unix.EXDEV {
+		if errno == unix.EXDEV {
 			*copyWithFileRange = false
 		}
 	}
+
+	// Copy only the data in sparse files, leaving their holes alone.
+	segments := []dataSegment{{0, fileinfo.Size()}}
+	if st, ok := fileinfo.Sys().(*syscall.Stat_t); ok && st.Blocks*512 < fileinfo.Size() {
+		if s, err := findDataSegments(srcFile, fileinfo.Size()); err == nil {
+			segments = s
+		}
+	}
+	data := int64(0)
+	for _, segment := range segments {
+		data += segment.length
+	}
+
 	if *copyWithFileRange {
-		err = doCopyWithFileRange(srcFile, dstFile, fileinfo)
+		err = copySegments(segments, func(offset, length int64) error {
+			return doCopyWithFileRange(srcFile, dstFile, offset, length)
+		})
 		// Trying the file_clone may not have caught the exdev case
 		// as the ioctl may not have been available (therefore EINVAL)
 		if err == unix.EXDEV || err == unix.ENOSYS {
 			*copyWithFileRange = false
 		} else {
+			if err == nil {
+				stats.RangeCopiedFiles++
+				stats.RangeCopiedBytes += data
+				stats.HoleBytes += fileinfo.Size() - data
+				err = dstFile.Truncate(fileinfo.Size())
+			}
+			return err
+		}
+	}
+	err = copySegments(segments, func(offset, length int64) error {
+		if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
 			return err
 		}
+		return legacyCopy(io.NewSectionReader(srcFile, offset, length), dstFile)
+	})
+	if err != nil {
+		return err
 	}
-	return legacyCopy(srcFile, dstFile)
+	stats.CopiedFiles++
+	stats.CopiedBytes += data
+	stats.HoleBytes += fileinfo.Size() - data
+	return dstFile.Truncate(fileinfo.Size())
 }
 
 // CopyRegular copies the content of a file to another
 func CopyRegular(srcPath, dstPath string, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool) error { // nolint: golint
+	return copyRegular(srcPath, dstPath, fileinfo, copyWithFileRange, copyWithFileClone, &Stats{})
+}
+
+func copyRegular(srcPath, dstPath string, fileinfo os.FileInfo, copyWithFileRange, copyWithFileClone *bool, stats *Stats) error {
 	// If the destination file already exists, we shouldn't blow it away
 	dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileinfo.Mode())
 	if err != nil {
@@ -81,17 +179,60 @@ func CopyRegular(srcPath, dstPath string, fileinfo os.FileInfo, copyWithFileRang
 	}
 	defer dstFile.Close()
 
-	return CopyRegularToFile(srcPath, dstFile, fileinfo, copyWithFileRange, copyWithFileClone)
+	return copyRegularToFile(srcPath, dstFile, fileinfo, copyWithFileRange, copyWithFileClone, stats)
 }
 
-func doCopyWithFileRange(srcFile, dstFile *os.File, fileinfo os.FileInfo) error {
-	amountLeftToCopy := fileinfo.Size()
+// dataSegment is a range of a file which contains data, rather than a hole.
+type dataSegment struct {
+	offset, length int64
+}
 
-	for amountLeftToCopy > 0 {
-		n, err := unix.CopyFileRange(int(srcFile.Fd()), nil, int(dstFile.Fd()), nil, int(amountLeftToCopy), 0)
+// findDataSegments returns the parts of the file which contain data.
+func findDataSegments(f *os.File, size int64) ([]dataSegment, error) {
+	var segments []dataSegment
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
 		if err != nil {
+			if err == unix.ENXIO {
+				// There's no more data after offset.
+				break
+			}
+			return nil, err
+		}
+		end, err := unix.Seek(int(f.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		segments = append(segments, dataSegment{start, end - start})
+		offset = end
+	}
+	return segments, nil
+}
+
+// copySegments calls copyFn for each of the segments.
+func copySegments(segments []dataSegment, copyFn func(offset, length int64) error) error {
+	for _, segment := range segments {
+		if err := copyFn(segment.offset, segment.length); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+func doCopyWithFileRange(srcFile, dstFile *os.File, offset, length int64) error {
+	roff, woff := offset, offset
+	for amountLeftToCopy := length; amountLeftToCopy > 0; {
+		n, err := unix.CopyFileRange(int(srcFile.Fd()), &roff, int(dstFile.Fd()), &woff, int(amountLeftToCopy), 0)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// The file was truncated while we were copying it.
+			break
+		}
 
 		amountLeftToCopy = amountLeftToCopy - int64(n)
 	}
@@ -133,6 +274,21 @@ type dirMtimeInfo struct {
 //
 // Copying xattrs can be opted out of by passing false for copyXattrs.
 func DirCopy(srcDir, dstDir string, copyMode Mode, copyXattrs bool) error {
+	_, err := DirCopyWithStats(srcDir, dstDir, copyMode, copyXattrs)
+	return err
+}
+
+// DirCopyWithStats is like DirCopy, but also returns statistics about how the
+// contents of regular files were copied.
+func DirCopyWithStats(srcDir, dstDir string, copyMode Mode, copyXattrs bool) (*Stats, error) {
+	return DirCopyWithProgress(srcDir, dstDir, copyMode, copyXattrs, nil)
+}
+
+// DirCopyWithProgress is like DirCopyWithStats, but also calls progress, if
+// it isn't nil, after each item in srcDir has been copied.
+func DirCopyWithProgress(srcDir, dstDir string, copyMode Mode, copyXattrs bool, progress archive.ProgressFunc) (*Stats, error) {
+	stats := &Stats{}
+	var copied archive.Progress
 	copyWithFileRange := true
 	copyWithFileClone := true
 
@@ -172,7 +328,7 @@ func DirCopy(srcDir, dstDir string, copyMode Mode, copyXattrs bool) error {
 					return err2
 				}
 			} else {
-				if err2 := CopyRegular(srcPath, dstPath, f, &copyWithFileRange, &copyWithFileClone); err2 != nil {
+				if err2 := copyRegular(srcPath, dstPath, f, &copyWithFileRange, &copyWithFileClone, stats); err2 != nil {
 					return err2
 				}
 				copiedFiles[id] = dstPath
@@ -218,6 +374,15 @@ func DirCopy(srcDir, dstDir string, copyMode Mode, copyXattrs bool) error {
 			return fmt.Errorf("unknown file type with mode %v for %s", mode, srcPath)
 		}
 
+		if progress != nil && srcPath != srcDir {
+			copied.Entries++
+			if f.Mode().IsRegular() {
+				copied.Bytes += f.Size()
+			}
+			copied.Entry = relPath
+			progress(copied)
+		}
+
 		// Everything below is copying metadata from src to dst. All this metadata
 		// already shares an inode for hardlinks.
 		if isHardlink {
@@ -263,17 +428,17 @@ func DirCopy(srcDir, dstDir string, copyMode Mode, copyXattrs bool) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for e := dirsToSetMtimes.Front(); e != nil; e = e.Next() {
 		mtimeInfo := e.Value.(*dirMtimeInfo)
 		ts := []syscall.Timespec{mtimeInfo.stat.Atim, mtimeInfo.stat.Mtim}
 		if err := system.LUtimesNano(*mtimeInfo.dstPath, ts); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return stats, nil
 }
 
 func doCopyXattrs(srcPath, dstPath string) error {
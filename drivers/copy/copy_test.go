@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/system"
 	"golang.org/x/sys/unix"
 	"gotest.tools/assert"
@@ -157,3 +158,117 @@ func TestCopyHardlink(t *testing.T) {
 	assert.NilError(t, unix.Stat(dstFile2, &dstFile2FileInfo))
 	assert.Check(t, is.Equal(dstFile1FileInfo.Ino, dstFile2FileInfo.Ino))
 }
+
+func TestCopySparse(t *testing.T) {
+	for _, useRange := range []bool{true, false} {
+		srcDir, err := ioutil.TempDir("", "srcDir")
+		assert.NilError(t, err)
+		defer os.RemoveAll(srcDir)
+
+		dstDir, err := ioutil.TempDir("", "dstDir")
+		assert.NilError(t, err)
+		defer os.RemoveAll(dstDir)
+
+		const size = 4 << 20
+		data := []byte("some data in the middle of a sparse file")
+		srcPath := filepath.Join(srcDir, "sparse")
+		f, err := os.Create(srcPath)
+		assert.NilError(t, err)
+		_, err = f.WriteAt(data, size/2)
+		assert.NilError(t, err)
+		assert.NilError(t, f.Truncate(size))
+		assert.NilError(t, f.Close())
+
+		srcFileInfo, err := os.Stat(srcPath)
+		assert.NilError(t, err)
+		if srcFileInfo.Sys().(*syscall.Stat_t).Blocks*512 >= size {
+			t.Skip("filesystem does not support sparse files")
+		}
+
+		copyWithFileRange := useRange
+		copyWithFileClone := false
+		stats := &Stats{}
+		dstPath := filepath.Join(dstDir, "sparse")
+		assert.NilError(t, copyRegular(srcPath, dstPath, srcFileInfo, &copyWithFileRange, &copyWithFileClone, stats))
+
+		contents, err := ioutil.ReadFile(dstPath)
+		assert.NilError(t, err)
+		assert.Equal(t, len(contents), size)
+		assert.Check(t, is.DeepEqual(contents[size/2:size/2+len(data)], data))
+
+		dstFileInfo, err := os.Stat(dstPath)
+		assert.NilError(t, err)
+		assert.Check(t, dstFileInfo.Sys().(*syscall.Stat_t).Blocks*512 < size, "holes were filled in")
+		assert.Check(t, stats.HoleBytes > 0)
+		assert.Equal(t, stats.RangeCopiedFiles+stats.CopiedFiles, int64(1))
+		assert.Equal(t, stats.RangeCopiedBytes+stats.CopiedBytes+stats.HoleBytes, int64(size))
+	}
+}
+
+func TestCopyDirWithStats(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "srcDir")
+	assert.NilError(t, err)
+	defer os.RemoveAll(srcDir)
+	populateSrcDir(t, srcDir, 2)
+
+	dstDir, err := ioutil.TempDir("", "testdst")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dstDir)
+
+	stats, err := DirCopyWithStats(srcDir, dstDir, Content, false)
+	assert.NilError(t, err)
+
+	var files, bytes int64
+	assert.NilError(t, filepath.Walk(srcDir, func(srcPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.Mode().IsRegular() {
+			files++
+			bytes += f.Size()
+		}
+		return nil
+	}))
+	assert.Equal(t, stats.ClonedFiles+stats.RangeCopiedFiles+stats.CopiedFiles, files)
+	assert.Equal(t, stats.ClonedBytes+stats.RangeCopiedBytes+stats.CopiedBytes+stats.HoleBytes, bytes)
+}
+
+func TestCopyDirWithProgress(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "srcDir")
+	assert.NilError(t, err)
+	defer os.RemoveAll(srcDir)
+	populateSrcDir(t, srcDir, 2)
+
+	dstDir, err := ioutil.TempDir("", "testdst")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dstDir)
+
+	var reports []archive.Progress
+	_, err = DirCopyWithProgress(srcDir, dstDir, Content, false, func(p archive.Progress) {
+		reports = append(reports, p)
+	})
+	assert.NilError(t, err)
+
+	var entries, bytes int64
+	assert.NilError(t, filepath.Walk(srcDir, func(srcPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if srcPath == srcDir {
+			return nil
+		}
+		entries++
+		if f.Mode().IsRegular() {
+			bytes += f.Size()
+		}
+		return nil
+	}))
+	assert.Assert(t, len(reports) > 0)
+	last := reports[len(reports)-1]
+	assert.Equal(t, last.Entries, entries)
+	assert.Equal(t, last.Bytes, bytes)
+	for i, p := range reports {
+		assert.Equal(t, p.Entries, int64(i+1))
+		assert.Assert(t, p.Entry != "")
+	}
+}
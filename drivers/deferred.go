@@ -0,0 +1,51 @@
+package graphdriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DeferredRemoveDriver is the interface for drivers which can make a layer's
+// data disappear quickly, and leave removing it, which can take a long time
+// for large layers, for later.
+// This API is experimental and can be changed without bumping the major version number.
+type DeferredRemoveDriver interface {
+	Driver
+	// DeferredRemove does what Remove() does, except that the layer's
+	// data is moved out of the way instead of being removed, and it
+	// returns the location which the caller should remove, or "" if
+	// there's nothing left to remove.
+	DeferredRemove(id string) (string, error)
+	// DeferredRemovalDirs returns the directories into which
+	// DeferredRemove() moves data, so that data which was never removed,
+	// for example because the process which moved it exited first, can be
+	// found.
+	DeferredRemovalDirs() []string
+}
+
+// DeferRemoveDir moves dir into a uniquely-named directory in trashDir, which
+// should be on the same file system, and returns the location of that
+// directory.  If dir doesn't exist, it returns "".
+func DeferRemoveDir(dir, trashDir string) (string, error) {
+	if _, err := os.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(trashDir, filepath.Base(dir)+"-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(dir, filepath.Join(tmp, "data")); err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrapf(err, "moving %q out of the way", dir)
+	}
+	return tmp, nil
+}
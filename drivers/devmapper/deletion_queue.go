@@ -0,0 +1,236 @@
+// +build linux,cgo
+
+package devmapper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minDeletionRetryDelay is how long we wait before retrying the
+	// deletion of a device which was busy the first time we tried to
+	// delete it.  The delay doubles after each failed attempt, up to
+	// maxDeletionRetryDelay.
+	minDeletionRetryDelay = time.Second
+	maxDeletionRetryDelay = 5 * time.Minute
+	// shutdownDeletionDrainTimeout is how long Shutdown() spends trying to
+	// delete devices which are waiting for deferred deletion.
+	shutdownDeletionDrainTimeout = 5 * time.Second
+)
+
+// pendingDeletion is a device which is waiting to be deleted.
+type pendingDeletion struct {
+	attempts int
+	next     time.Time
+}
+
+// deletionQueueStats counts what a deletionQueue has done.
+type deletionQueueStats struct {
+	Deleted   uint64
+	Retries   uint64
+	Errors    uint64
+	LastError string
+}
+
+// deletionQueue retries the deletion of devices which couldn't be deleted
+// because they were busy, backing off after each failed attempt, in a
+// background goroutine.
+type deletionQueue struct {
+	lock sync.Mutex
+	// attempt tries to delete a device, and returns true if the device
+	// is gone.
+	attempt func(hash string) (bool, error)
+	pending map[string]*pendingDeletion
+	stats   deletionQueueStats
+	// changed is closed and replaced whenever the list of pending
+	// deletions gets shorter.
+	changed chan struct{}
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+	stopped bool
+}
+
+func newDeletionQueue(attempt func(hash string) (bool, error)) *deletionQueue {
+	return &deletionQueue{
+		attempt: attempt,
+		pending: make(map[string]*pendingDeletion),
+		changed: make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// retryDelay returns how long to wait before trying to delete a device again
+// after the specified number of attempts have failed.
+func retryDelay(attempts int) time.Duration {
+	delay := minDeletionRetryDelay
+	for i := 1; i < attempts && delay < maxDeletionRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDeletionRetryDelay {
+		delay = maxDeletionRetryDelay
+	}
+	return delay
+}
+
+// add queues the deletion of a device, which is attempted right away.
+func (q *deletionQueue) add(hash string) {
+	q.lock.Lock()
+	if _, ok := q.pending[hash]; !ok {
+		q.pending[hash] = &pendingDeletion{next: time.Now()}
+	}
+	q.lock.Unlock()
+	q.poke()
+}
+
+// poke wakes the worker, if it's waiting.
+func (q *deletionQueue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// len returns the number of devices which are waiting to be deleted.
+func (q *deletionQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// counters returns a copy of the queue's statistics.
+func (q *deletionQueue) counters() deletionQueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.stats
+}
+
+// start starts the worker.
+func (q *deletionQueue) start() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.started || q.stopped {
+		return
+	}
+	q.started = true
+	go q.run()
+}
+
+// Stop stops the worker, waiting for it to finish any attempt that it is
+// making.  Devices which are still waiting to be deleted are left marked as
+// deleted, and are queued again when the driver is next initialized.
+func (q *deletionQueue) Stop() {
+	q.lock.Lock()
+	started, stopped := q.started, q.stopped
+	q.stopped = true
+	q.lock.Unlock()
+	if !started || stopped {
+		return
+	}
+	close(q.stop)
+	<-q.done
+}
+
+// Drain makes an attempt to delete each of the devices which are waiting to
+// be deleted right away, and keeps trying until none are left, or the
+// timeout expires, in which case it returns an error.
+func (q *deletionQueue) Drain(timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	q.lock.Lock()
+	for _, p := range q.pending {
+		p.next = time.Time{}
+	}
+	for len(q.pending) > 0 {
+		changed := q.changed
+		q.lock.Unlock()
+		q.poke()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return errors.Errorf("devmapper: %d devices are still waiting to be deleted", q.len())
+		}
+		q.lock.Lock()
+	}
+	q.lock.Unlock()
+	return nil
+}
+
+// run attempts each deletion when it's due, until the queue is stopped.
+func (q *deletionQueue) run() {
+	defer close(q.done)
+	logrus.Debug("devmapper: Worker to cleanup deleted devices started")
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		q.processDue(time.Now())
+
+		q.lock.Lock()
+		next := time.Now().Add(maxDeletionRetryDelay)
+		for _, p := range q.pending {
+			if p.next.Before(next) {
+				next = p.next
+			}
+		}
+		q.lock.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// processDue attempts the deletions which are due at the specified time.
+func (q *deletionQueue) processDue(now time.Time) {
+	q.lock.Lock()
+	var due []string
+	for hash, p := range q.pending {
+		if !p.next.After(now) {
+			due = append(due, hash)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, hash := range due {
+		deleted, err := q.attempt(hash)
+		q.lock.Lock()
+		p, ok := q.pending[hash]
+		if !ok {
+			q.lock.Unlock()
+			continue
+		}
+		if err != nil {
+			logrus.Warnf("devmapper: Deletion of device %s failed: %v", hash, err)
+			q.stats.Errors++
+			q.stats.LastError = err.Error()
+		}
+		if deleted {
+			delete(q.pending, hash)
+			q.stats.Deleted++
+			close(q.changed)
+			q.changed = make(chan struct{})
+		} else {
+			p.attempts++
+			p.next = time.Now().Add(retryDelay(p.attempts))
+			q.stats.Retries++
+		}
+		q.lock.Unlock()
+	}
+}
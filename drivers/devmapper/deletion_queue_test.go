@@ -0,0 +1,54 @@
+// +build linux,cgo
+
+package devmapper
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, minDeletionRetryDelay, retryDelay(1))
+	assert.Equal(t, 2*minDeletionRetryDelay, retryDelay(2))
+	assert.Equal(t, 4*minDeletionRetryDelay, retryDelay(3))
+	assert.Equal(t, maxDeletionRetryDelay, retryDelay(100))
+}
+
+func TestDeletionQueue(t *testing.T) {
+	var lock sync.Mutex
+	attempts := make(map[string]int)
+	q := newDeletionQueue(func(hash string) (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts[hash]++
+		switch hash {
+		case "busy-once":
+			return attempts[hash] > 1, nil
+		case "broken":
+			return false, errors.New("broken")
+		}
+		return true, nil
+	})
+	q.add("busy-once")
+	q.add("free")
+	q.start()
+	defer q.Stop()
+
+	require.NoError(t, q.Drain(10*time.Second))
+	stats := q.counters()
+	assert.Equal(t, uint64(2), stats.Deleted)
+	assert.Equal(t, uint64(1), stats.Retries)
+	assert.Zero(t, stats.Errors)
+
+	q.add("broken")
+	assert.Error(t, q.Drain(100*time.Millisecond))
+	assert.Equal(t, 1, q.len())
+	stats = q.counters()
+	assert.NotZero(t, stats.Errors)
+	assert.Equal(t, "broken", stats.LastError)
+}
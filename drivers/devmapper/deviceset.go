@@ -120,7 +120,8 @@ type DeviceSet struct {
 	BaseDeviceUUID        string // save UUID of base device
 	BaseDeviceFilesystem  string // save filesystem of base device
 	nrDeletedDevices      uint   // number of deleted devices
-	deletionWorkerTicker  *time.Ticker
+	deletionQueue         *deletionQueue
+	poolMonitor           *poolMonitor
 	uidMaps               []idtools.IDMap
 	gidMaps               []idtools.IDMap
 	minFreeSpacePercent   uint32 //min free space percentage in thinpool
@@ -171,7 +172,18 @@ type Status struct {
 	// thin pool and it can't be activated again.
 	DeferredDeleteEnabled      bool
 	DeferredDeletedDeviceCount uint
-	MinFreeSpace               uint64
+	// DeferredDeletionsCompleted is the number of devices which were
+	// deleted after their deletion was deferred.
+	DeferredDeletionsCompleted uint64
+	// DeferredDeletionRetries is the number of times that we tried to
+	// delete a device whose deletion was deferred, and it was still busy.
+	DeferredDeletionRetries uint64
+	// DeferredDeletionErrors is the number of times that trying to delete
+	// a device whose deletion was deferred failed with an error, and
+	// DeferredDeletionLastError describes the most recent one.
+	DeferredDeletionErrors    uint64
+	DeferredDeletionLastError string
+	MinFreeSpace              uint64
 }
 
 // Structure used to export image/container metadata in inspect.
@@ -658,39 +670,19 @@ func (devices *DeviceSet) migrateOldMetaData() error {
 	return nil
 }
 
-// Cleanup deleted devices. It assumes that all the devices have been
-// loaded in the hash table.
-func (devices *DeviceSet) cleanupDeletedDevices() error {
+// retryDeletion tries again to delete a device whose deletion was deferred,
+// and returns true if the device is gone.  It is called by the deletion
+// queue without devices.Lock() held, since DeleteDevice() takes the info
+// lock before it takes devices.Lock().
+func (devices *DeviceSet) retryDeletion(hash string) (bool, error) {
+	// This will again try deferred deletion, so if the device is still
+	// busy, it will remain marked as deleted.
+	err := devices.DeleteDevice(hash, false)
 	devices.Lock()
-
-	// If there are no deleted devices, there is nothing to do.
-	if devices.nrDeletedDevices == 0 {
-		devices.Unlock()
-		return nil
-	}
-
-	var deletedDevices []*devInfo
-
-	for _, info := range devices.Devices {
-		if !info.Deleted {
-			continue
-		}
-		logrus.Debugf("devmapper: Found deleted device %s.", info.Hash)
-		deletedDevices = append(deletedDevices, info)
-	}
-
-	// Delete the deleted devices. DeleteDevice() first takes the info lock
-	// and then devices.Lock(). So drop it to avoid deadlock.
+	info, ok := devices.Devices[hash]
+	deleted := !ok || !info.Deleted
 	devices.Unlock()
-
-	for _, info := range deletedDevices {
-		// This will again try deferred deletion.
-		if err := devices.DeleteDevice(info.Hash, false); err != nil {
-			logrus.Warnf("devmapper: Deletion of device %s, device_id=%v failed:%v", info.Hash, info.DeviceID, err)
-		}
-	}
-
-	return nil
+	return deleted, err
 }
 
 func (devices *DeviceSet) countDeletedDevices() {
@@ -702,20 +694,34 @@ func (devices *DeviceSet) countDeletedDevices() {
 	}
 }
 
+// startDeviceDeletionWorker queues the deletion of devices which were left
+// marked as deleted, and starts the worker which deletes the devices in the
+// deletion queue.  It assumes that all the devices have been loaded in the
+// hash table.
 func (devices *DeviceSet) startDeviceDeletionWorker() {
 	// Deferred deletion is not enabled. Don't do anything.
 	if !devices.deferredDelete {
 		return
 	}
 
-	// Cleanup right away if there are any leaked devices.  Note this
-	// could cause some slowdown for process startup, if there were
-	// Leaked devices
-	devices.cleanupDeletedDevices()
-	logrus.Debug("devmapper: Worker to cleanup deleted devices started")
-	for range devices.deletionWorkerTicker.C {
-		devices.cleanupDeletedDevices()
+	devices.Lock()
+	for _, info := range devices.Devices {
+		if !info.Deleted {
+			continue
+		}
+		logrus.Debugf("devmapper: Found deleted device %s.", info.Hash)
+		devices.deletionQueue.add(info.Hash)
 	}
+	devices.Unlock()
+
+	devices.deletionQueue.start()
+}
+
+// DrainDeferredDeletions tries to delete all of the devices whose deletion
+// was deferred because they were busy, and returns an error if any of them
+// are still waiting to be deleted when the timeout expires.
+func (devices *DeviceSet) DrainDeferredDeletions(timeout time.Duration) error {
+	return devices.deletionQueue.Drain(timeout)
 }
 
 func (devices *DeviceSet) initMetaData() error {
@@ -2006,6 +2012,7 @@ func (devices *DeviceSet) markForDeferredDeletion(info *devInfo) error {
 	}
 
 	devices.nrDeletedDevices++
+	devices.deletionQueue.add(info.Hash)
 	return nil
 }
 
@@ -2298,12 +2305,16 @@ func (devices *DeviceSet) Shutdown(home string) error {
 	logrus.Debugf("devmapper: Shutting down DeviceSet: %s", devices.root)
 	defer logrus.Debugf("devmapper: [deviceset %s] Shutdown() END", devices.devicePrefix)
 
-	// Stop deletion worker. This should start delivering new events to
-	// ticker channel. That means no new instance of cleanupDeletedDevice()
-	// will run after this call. If one instance is already running at
-	// the time of the call, it must be holding devices.Lock() and
-	// we will block on this lock till cleanup function exits.
-	devices.deletionWorkerTicker.Stop()
+	devices.stopPoolMonitor()
+
+	// Give the deletion worker a chance to delete devices which are no
+	// longer busy, and then stop it.  Stop() waits for any deletion that
+	// the worker is attempting to finish, so no deletions will be
+	// attempted after this.
+	if err := devices.deletionQueue.Drain(shutdownDeletionDrainTimeout); err != nil {
+		logrus.Debugf("devmapper: Shutdown: %v", err)
+	}
+	devices.deletionQueue.Stop()
 
 	devices.Lock()
 	// Save DeviceSet Metadata first. Docker kills all threads if they
@@ -2592,6 +2603,11 @@ func (devices *DeviceSet) Status() *Status {
 	status.DeferredRemoveEnabled = devices.deferredRemove
 	status.DeferredDeleteEnabled = devices.deferredDelete
 	status.DeferredDeletedDeviceCount = devices.nrDeletedDevices
+	stats := devices.deletionQueue.counters()
+	status.DeferredDeletionsCompleted = stats.Deleted
+	status.DeferredDeletionRetries = stats.Retries
+	status.DeferredDeletionErrors = stats.Errors
+	status.DeferredDeletionLastError = stats.LastError
 	status.BaseDeviceSize = devices.getBaseDeviceSize()
 	status.BaseDeviceFS = devices.getBaseDeviceFS()
 
@@ -2660,11 +2676,12 @@ func NewDeviceSet(root string, doInit bool, options []string, uidMaps, gidMaps [
 		doBlkDiscard:          true,
 		thinpBlockSize:        defaultThinpBlockSize,
 		deviceIDMap:           make([]byte, deviceIDMapSz),
-		deletionWorkerTicker:  time.NewTicker(time.Second * 30),
 		uidMaps:               uidMaps,
 		gidMaps:               gidMaps,
 		minFreeSpacePercent:   defaultMinFreeSpacePercent,
+		poolMonitor:           newPoolMonitor(),
 	}
+	devices.deletionQueue = newDeletionQueue(devices.retryDeletion)
 
 	version, err := devicemapper.GetDriverVersion()
 	if err != nil {
@@ -2826,6 +2843,33 @@ func NewDeviceSet(root string, doInit bool, options []string, uidMaps, gidMaps [
 				return nil, errors.New("dm.thinp_autoextend_threshold must be greater than 0 and less than 100")
 			}
 			lvmSetupConfig.AutoExtendThreshold = per
+		case "dm.pool_monitor_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse `dm.pool_monitor_interval=%s`", val)
+			}
+			if interval < 0 {
+				return nil, errors.New("dm.pool_monitor_interval must not be negative")
+			}
+			devices.poolMonitor.interval = interval
+		case "dm.pool_data_watermark", "dm.pool_metadata_watermark":
+			per, err := strconv.ParseUint(strings.TrimSuffix(val, "%"), 10, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse `%s=%s`", key, val)
+			}
+			if per == 0 || per >= 100 {
+				return nil, errors.Errorf("%s must be greater than 0 and less than 100", key)
+			}
+			if key == "dm.pool_data_watermark" {
+				devices.poolMonitor.dataWatermark = per
+			} else {
+				devices.poolMonitor.metadataWatermark = per
+			}
+		case "dm.pool_autoextend":
+			devices.poolMonitor.autoExtend, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, err
+			}
 		case "dm.libdm_log_level":
 			level, err := strconv.ParseInt(val, 10, 32)
 			if err != nil {
@@ -2856,6 +2900,10 @@ func NewDeviceSet(root string, doInit bool, options []string, uidMaps, gidMaps [
 
 	devices.lvmSetupConfig = lvmSetupConfig
 
+	if devices.poolMonitor.autoExtend && devices.thinPoolDevice == "" && lvmSetupConfig.Device == "" {
+		return nil, errors.New("dm.pool_autoextend requires an LVM thin pool, set using `dm.thinpooldev` or `dm.directlvm_device`")
+	}
+
 	// By default, don't do blk discard hack on raw devices, its rarely useful and is expensive
 	if !foundBlkDiscard && (devices.dataDevice != "" || devices.thinPoolDevice != "") {
 		devices.doBlkDiscard = false
@@ -2865,5 +2913,7 @@ func NewDeviceSet(root string, doInit bool, options []string, uidMaps, gidMaps [
 		return nil, err
 	}
 
+	devices.startPoolMonitor()
+
 	return devices, nil
 }
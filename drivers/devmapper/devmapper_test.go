@@ -136,14 +136,16 @@ func testChangeLoopBackSize(t *testing.T, delta, expectDataSize, expectMetaDataS
 	}
 }
 
-// Make sure devices.Lock() has been release upon return from cleanupDeletedDevices() function
+// Make sure devices.Lock() has been release upon return from DrainDeferredDeletions() function
 func TestDevmapperLockReleasedDeviceDeletion(t *testing.T) {
 	driver := graphtest.GetDriver(t, "devicemapper", "test=1").(*graphtest.Driver).Driver.(*graphdriver.NaiveDiffDriver).ProtoDriver.(*Driver)
 	defer graphtest.PutDriver(t)
 
-	// Call cleanupDeletedDevices() and after the call take and release
+	// Call DrainDeferredDeletions() and after the call take and release
 	// DeviceSet Lock. If lock has not been released, this will hang.
-	driver.DeviceSet.cleanupDeletedDevices()
+	if err := driver.DeviceSet.DrainDeferredDeletions(time.Second); err != nil {
+		t.Fatal(err)
+	}
 
 	doneChan := make(chan bool)
 
@@ -159,7 +161,7 @@ func TestDevmapperLockReleasedDeviceDeletion(t *testing.T) {
 		// function return and we are deadlocked. Release lock
 		// here so that cleanup could succeed and fail the test.
 		driver.DeviceSet.Unlock()
-		t.Fatal("Could not acquire devices lock after call to cleanupDeletedDevices()")
+		t.Fatal("Could not acquire devices lock after call to DrainDeferredDeletions()")
 	case <-doneChan:
 	}
 }
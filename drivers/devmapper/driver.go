@@ -22,8 +22,23 @@ import (
 
 const defaultPerms = os.FileMode(0555)
 
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"dm", "devicemapper"},
+	Names: []string{
+		"basesize", "blkdiscard", "blocksize", "datadev", "directlvm_device",
+		"directlvm_device_force", "fs", "libdm_log_level", "loopdatasize",
+		"loopmetadatasize", "metadata_size", "metadatadev", "metadatasize", "min_free_space",
+		"mkfsarg", "mountopt", "override_udev_sync_check", "pool_autoextend", "pool_data_watermark",
+		"pool_metadata_watermark", "pool_monitor_interval", "thinp_autoextend_percent",
+		"thinp_autoextend_threshold", "thinp_metapercent", "thinp_percent", "thinpooldev",
+		"use_deferred_deletion", "use_deferred_removal", "xfs_nospace_max_retries",
+	},
+}
+
 func init() {
 	graphdriver.Register("devicemapper", Init)
+	graphdriver.RegisterOptionNames("devicemapper", OptionNames)
 }
 
 // Driver contains the device set mounted and the home directory
@@ -63,6 +78,16 @@ func (d *Driver) String() string {
 	return "devicemapper"
 }
 
+// Capabilities reports which optional features the driver provides.  Layers
+// are thin snapshots of their parents, with sizes that can be set when they're
+// created.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	return graphdriver.Capabilities{
+		Snapshots: true,
+		Quota:     true,
+	}
+}
+
 // Status returns the status about the driver in a printable format.
 // Information returned contains Pool Name, Data File, Metadata file, disk usage by
 // the data and metadata, etc.
@@ -87,6 +112,12 @@ func (d *Driver) Status() [][2]string {
 		{"Deferred Removal Enabled", fmt.Sprintf("%v", s.DeferredRemoveEnabled)},
 		{"Deferred Deletion Enabled", fmt.Sprintf("%v", s.DeferredDeleteEnabled)},
 		{"Deferred Deleted Device Count", fmt.Sprintf("%v", s.DeferredDeletedDeviceCount)},
+		{"Deferred Deletions Completed", fmt.Sprintf("%v", s.DeferredDeletionsCompleted)},
+		{"Deferred Deletion Retries", fmt.Sprintf("%v", s.DeferredDeletionRetries)},
+		{"Deferred Deletion Errors", fmt.Sprintf("%v", s.DeferredDeletionErrors)},
+	}
+	if s.DeferredDeletionLastError != "" {
+		status = append(status, [2]string{"Deferred Deletion Last Error", s.DeferredDeletionLastError})
 	}
 	if len(s.DataLoopback) > 0 {
 		status = append(status, [2]string{"Data loop file", s.DataLoopback})
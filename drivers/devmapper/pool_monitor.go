@@ -0,0 +1,212 @@
+// +build linux,cgo
+
+package devmapper
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultPoolWatermark is the percentage of the thin pool's data or
+	// metadata space which has to be used before the pool monitor reports
+	// that the pool is filling up.
+	defaultPoolWatermark = 80
+)
+
+// PoolSpace identifies one of the kinds of space in a thin pool.
+type PoolSpace string
+
+const (
+	// PoolData is the space in the pool which holds the devices' contents.
+	PoolData PoolSpace = "data"
+	// PoolMetadata is the space in the pool which holds its metadata.
+	PoolMetadata PoolSpace = "metadata"
+)
+
+// PoolWatermarkEvent is passed to the pool monitor's handler when the usage of
+// one of the kinds of space in the thin pool rises above its watermark, or
+// falls back below it.
+type PoolWatermarkEvent struct {
+	// Pool is the name of the thin pool.
+	Pool string
+	// Space is the kind of space whose usage crossed its watermark.
+	Space PoolSpace
+	// Used and Total are the number of blocks of the space which are used,
+	// and which are available in total.
+	Used  uint64
+	Total uint64
+	// Watermark is the percentage of the space which has to be used for
+	// it to be considered to be filling up.
+	Watermark uint64
+	// Above is true if the usage rose above the watermark, and false if
+	// it fell back below it.
+	Above bool
+}
+
+// PoolWatermarkHandler is called when the usage of the thin pool crosses a
+// watermark.
+type PoolWatermarkHandler func(PoolWatermarkEvent)
+
+// poolMonitor periodically checks how much of the thin pool is being used.
+type poolMonitor struct {
+	lock sync.Mutex
+	// interval is how often the pool is checked.  The monitor isn't
+	// started if it is 0.
+	interval          time.Duration
+	dataWatermark     uint64
+	metadataWatermark uint64
+	// autoExtend is true if "lvextend" should be run when the pool's
+	// usage rises above a watermark.
+	autoExtend bool
+	handler    PoolWatermarkHandler
+	// above records which kinds of space were above their watermarks
+	// when the pool was last checked.
+	above map[PoolSpace]bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newPoolMonitor() *poolMonitor {
+	return &poolMonitor{
+		dataWatermark:     defaultPoolWatermark,
+		metadataWatermark: defaultPoolWatermark,
+		above:             make(map[PoolSpace]bool),
+	}
+}
+
+// aboveWatermark returns true if used is more than watermark percent of total.
+func aboveWatermark(used, total, watermark uint64) bool {
+	return total > 0 && used*100 > total*watermark
+}
+
+// update records the pool's current usage, and returns events for the kinds
+// of space whose usage crossed a watermark since the last update.
+func (m *poolMonitor) update(pool string, dataUsed, dataTotal, metadataUsed, metadataTotal uint64) []PoolWatermarkEvent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var events []PoolWatermarkEvent
+	for _, space := range []struct {
+		space            PoolSpace
+		used, total, max uint64
+	}{
+		{PoolData, dataUsed, dataTotal, m.dataWatermark},
+		{PoolMetadata, metadataUsed, metadataTotal, m.metadataWatermark},
+	} {
+		above := aboveWatermark(space.used, space.total, space.max)
+		if above == m.above[space.space] {
+			continue
+		}
+		m.above[space.space] = above
+		events = append(events, PoolWatermarkEvent{
+			Pool:      pool,
+			Space:     space.space,
+			Used:      space.used,
+			Total:     space.total,
+			Watermark: space.max,
+			Above:     above,
+		})
+	}
+	return events
+}
+
+// logPoolWatermarkEvent is the handler which is used if none is set.
+func logPoolWatermarkEvent(event PoolWatermarkEvent) {
+	if event.Above {
+		logrus.Warnf("devmapper: Thin pool %s has used %d of %d %s blocks, which is more than %d%%", event.Pool, event.Used, event.Total, event.Space, event.Watermark)
+	} else {
+		logrus.Infof("devmapper: Thin pool %s has used %d of %d %s blocks, which is no longer more than %d%%", event.Pool, event.Used, event.Total, event.Space, event.Watermark)
+	}
+}
+
+// SetPoolWatermarkHandler sets the function which is called when the usage of
+// the thin pool's data or metadata space crosses its watermark.  By default,
+// the events are logged.  The handler is only called if monitoring was
+// enabled using the "dm.pool_monitor_interval" option.
+func (devices *DeviceSet) SetPoolWatermarkHandler(handler PoolWatermarkHandler) {
+	devices.poolMonitor.lock.Lock()
+	defer devices.poolMonitor.lock.Unlock()
+	devices.poolMonitor.handler = handler
+}
+
+// checkPool checks how much of the thin pool is being used, calls the
+// watermark handler for any watermarks which were crossed, and extends the
+// pool if it's filling up and that was requested.
+func (devices *DeviceSet) checkPool() {
+	devices.Lock()
+	pool := devices.getPoolName()
+	_, _, dataUsed, dataTotal, metadataUsed, metadataTotal, err := devices.poolStatus()
+	devices.Unlock()
+	if err != nil {
+		logrus.Debugf("devmapper: Error checking thin pool %s: %v", pool, err)
+		return
+	}
+	m := devices.poolMonitor
+	events := m.update(pool, dataUsed, dataTotal, metadataUsed, metadataTotal)
+	m.lock.Lock()
+	handler := m.handler
+	m.lock.Unlock()
+	if handler == nil {
+		handler = logPoolWatermarkEvent
+	}
+	extend := false
+	for _, event := range events {
+		handler(event)
+		extend = extend || event.Above
+	}
+	if extend && m.autoExtend {
+		devices.extendPool()
+	}
+}
+
+// extendPool runs "lvextend" to grow the thin pool, according to the policy
+// that is set in its LVM profile.
+func (devices *DeviceSet) extendPool() {
+	if devices.thinPoolDevice == "" {
+		logrus.Warn("devmapper: Not extending the thin pool, since it is not an LVM thin pool")
+		return
+	}
+	lv := "/dev/mapper/" + devices.thinPoolDevice
+	logrus.Infof("devmapper: Extending thin pool %s", lv)
+	if out, err := exec.Command("lvextend", "--use-policies", lv).CombinedOutput(); err != nil {
+		logrus.Warnf("devmapper: Error extending thin pool %s: %v: %s", lv, err, string(out))
+	}
+}
+
+// startPoolMonitor starts checking the thin pool periodically, if that was
+// requested.
+func (devices *DeviceSet) startPoolMonitor() {
+	m := devices.poolMonitor
+	if m.interval <= 0 {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			devices.checkPool()
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopPoolMonitor stops checking the thin pool.
+func (devices *DeviceSet) stopPoolMonitor() {
+	m := devices.poolMonitor
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+}
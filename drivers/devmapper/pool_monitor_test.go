@@ -0,0 +1,28 @@
+// +build linux,cgo
+
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolMonitorUpdate(t *testing.T) {
+	m := newPoolMonitor()
+	m.metadataWatermark = 50
+
+	assert.Empty(t, m.update("pool", 10, 100, 10, 100))
+
+	events := m.update("pool", 81, 100, 10, 100)
+	assert.Equal(t, []PoolWatermarkEvent{{Pool: "pool", Space: PoolData, Used: 81, Total: 100, Watermark: 80, Above: true}}, events)
+	assert.Empty(t, m.update("pool", 90, 100, 10, 100), "staying above a watermark shouldn't be reported again")
+
+	events = m.update("pool", 50, 100, 51, 100)
+	assert.Equal(t, []PoolWatermarkEvent{
+		{Pool: "pool", Space: PoolData, Used: 50, Total: 100, Watermark: 80, Above: false},
+		{Pool: "pool", Space: PoolMetadata, Used: 51, Total: 100, Watermark: 50, Above: true},
+	}, events)
+
+	assert.Empty(t, m.update("pool", 0, 0, 51, 100), "an unknown total shouldn't be treated as being above the watermark")
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/vbatts/tar-split/tar/storage"
 
+	"github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/directory"
 	"github.com/containers/storage/pkg/idtools"
@@ -37,6 +38,9 @@ var (
 	ErrIncompatibleFS = errors.New("backing file system is unsupported for this graph driver")
 	// ErrLayerUnknown returned when the specified layer is unknown by the driver.
 	ErrLayerUnknown = errors.New("unknown layer")
+	// ErrLayerFrozen returned when a layer can't be changed because it was
+	// frozen using FreezeLayer().
+	ErrLayerFrozen = errors.New("layer is frozen")
 )
 
 //CreateOpts contains optional arguments for Create() and CreateReadWrite()
@@ -46,6 +50,20 @@ type CreateOpts struct {
 	StorageOpt map[string]string
 	*idtools.IDMappings
 	ignoreChownErrors bool
+	// Progress, if set, is called as the contents of the parent layer
+	// are copied into the new layer, by drivers which do that.
+	Progress archive.ProgressFunc
+	// ImageStore, if set, is the location of one of the driver's writable
+	// image stores, in which the layer should be created instead of in
+	// the driver's home directory.
+	ImageStore string
+	// EncryptionKey, if set, is a key which the layer's contents are
+	// encrypted with, by drivers which implement EncryptionDriver.
+	EncryptionKey []byte
+	// ParentMounted is set if the parent layer is mounted, possibly by
+	// another process, so drivers shouldn't change how its contents are
+	// stored.
+	ParentMounted bool
 }
 
 // MountOpts contains optional arguments for LayerStope.Mount() methods.
@@ -55,6 +73,10 @@ type MountOpts struct {
 	// UidMaps & GidMaps are the User Namespace mappings to be assigned to content in the mount point
 	UidMaps []idtools.IDMap // nolint: golint
 	GidMaps []idtools.IDMap // nolint: golint
+	// Options are mount options to be used for the mount point.  Drivers
+	// which mount layers should enforce "nosuid", "nodev", and "noexec"
+	// if they are included, for use when the layer's contents aren't
+	// trusted.
 	Options []string
 
 	// Volatile specifies whether the container storage can be optimized
@@ -63,8 +85,50 @@ type MountOpts struct {
 
 	// DisableShifting forces the driver to not do any ID shifting at runtime.
 	DisableShifting bool
+
+	// AdditionalLowers is a list of directories which should be included
+	// in the mount as if they were layers below the layer being mounted
+	// and above its parent, with earlier entries taking precedence over
+	// later ones.  Only drivers which implement AdditionalLowersDriver
+	// can honor it.
+	AdditionalLowers []string
+
+	// Propagation is the mount propagation, one of MountPropagationPrivate,
+	// MountPropagationRShared, or MountPropagationRSlave, to set on the
+	// mountpoint.  If it is not set, the driver's default is used.
+	// Drivers which don't mount layers ignore it.
+	Propagation string
+
+	// Relabel, if set to MountRelabelPrivate or MountRelabelShared, asks
+	// the driver to relabel the contents of the mountpoint with
+	// MountLabel, or with a version of it which any container can use,
+	// so that callers don't have to do it themselves.  Drivers which
+	// apply MountLabel to the mountpoint using mount options ignore it.
+	Relabel string
 }
 
+const (
+	// MountPropagationPrivate keeps mounts and unmounts below a mountpoint
+	// from being seen in other mount namespaces, and vice versa.
+	MountPropagationPrivate = "private"
+	// MountPropagationRShared lets mounts and unmounts below a mountpoint
+	// be seen in other mount namespaces, and vice versa.
+	MountPropagationRShared = "rshared"
+	// MountPropagationRSlave lets mounts and unmounts which are made in
+	// other mount namespaces be seen below a mountpoint, but not the
+	// other way around.
+	MountPropagationRSlave = "rslave"
+)
+
+const (
+	// MountRelabelPrivate relabels a mountpoint's contents with the mount
+	// label, so that only containers which use that label can use them.
+	MountRelabelPrivate = "private"
+	// MountRelabelShared relabels a mountpoint's contents with a version
+	// of the mount label which any container can use.
+	MountRelabelShared = "shared"
+)
+
 // ApplyDiffOpts contains optional arguments for ApplyDiff methods.
 type ApplyDiffOpts struct {
 	Diff              io.Reader
@@ -72,6 +136,9 @@ type ApplyDiffOpts struct {
 	MountLabel        string
 	IgnoreChownErrors bool
 	ForceMask         *os.FileMode
+	// Sparse, if set, causes runs of zeroes in regular files to be left
+	// as holes, and sparse entries to be extracted as sparse files.
+	Sparse bool
 }
 
 // InitFunc initializes the storage driver.
@@ -181,6 +248,18 @@ type DriverWithDifferOutput struct {
 	UncompressedDigest digest.Digest
 	Metadata           string
 	BigData            map[string][]byte
+	// ComposefsDigest, if the differ converted the layer into a composefs
+	// image, is that image's fs-verity digest.
+	ComposefsDigest digest.Digest
+}
+
+// EncryptionDriver is the interface for drivers which can encrypt the contents
+// of layers using the file system's encryption support.
+type EncryptionDriver interface {
+	// AddEncryptionKey adds a key to the file system which holds the
+	// layer's contents, so that the contents of layers which were
+	// encrypted with it can be used.
+	AddEncryptionKey(id string, key []byte) error
 }
 
 // Differ defines the interface for using a custom differ.
@@ -212,15 +291,69 @@ type Capabilities struct {
 	// diffs for read-only layers. If set, clients can rely on the driver
 	// for consistent tar streams, and avoid extra processing to account
 	// for potential differences (eg: the layer store's use of tar-split).
-	ReproducesExactDiffs bool
+	ReproducesExactDiffs bool `json:"reproducesExactDiffs"`
+	// Reflinks is true if the file system which holds the driver's data
+	// can share the contents of files using reflinks, which the driver
+	// uses when it has to copy files from one layer to another.
+	Reflinks bool `json:"reflinks"`
+	// Snapshots is true if new layers are created as copy-on-write
+	// snapshots of their parents, so that their parents' contents are
+	// neither copied nor stacked under them when they're mounted.
+	Snapshots bool `json:"snapshots"`
+	// NativeDiff is true if the driver computes differences between
+	// layers and their parents without comparing their contents.
+	NativeDiff bool `json:"nativeDiff"`
+	// SupportsShifting is true if the driver can shift the ownership of
+	// the contents of layers when mounting them.
+	SupportsShifting bool `json:"supportsShifting"`
+	// Quota is true if the driver can limit the size of layers.
+	Quota bool `json:"quota"`
+	// MaxLowers is the largest number of layers which can be stacked
+	// under a layer, or 0 if there is no limit.
+	MaxLowers int `json:"maxLowers,omitempty"`
+	// WhiteoutFormat is the way that layers record that files which are
+	// present in their parents have been removed, either
+	// WhiteoutFormatOverlay or WhiteoutFormatAUFS, or "" if the files are
+	// actually removed.
+	WhiteoutFormat string `json:"whiteoutFormat,omitempty"`
 }
 
+const (
+	// WhiteoutFormatOverlay indicates that removed files are recorded
+	// using character devices, as the kernel's overlay file system does.
+	WhiteoutFormatOverlay = "overlay"
+	// WhiteoutFormatAUFS indicates that removed files are recorded using
+	// ".wh." files, as the aufs file system does.
+	WhiteoutFormatAUFS = "aufs"
+)
+
 // CapabilityDriver is the interface for layered file system drivers that
 // can report on their Capabilities.
 type CapabilityDriver interface {
 	Capabilities() Capabilities
 }
 
+// GetCapabilities returns the capabilities of the driver.  If the driver
+// doesn't implement CapabilityDriver, only the capabilities which can be
+// determined using the Driver interface are reported.
+func GetCapabilities(driver Driver) Capabilities {
+	if c, ok := driver.(CapabilityDriver); ok {
+		return c.Capabilities()
+	}
+	if naive, ok := driver.(*NaiveDiffDriver); ok {
+		if c, ok := naive.ProtoDriver.(CapabilityDriver); ok {
+			capabilities := c.Capabilities()
+			capabilities.NativeDiff = false
+			return capabilities
+		}
+		return Capabilities{SupportsShifting: driver.SupportsShifting()}
+	}
+	return Capabilities{
+		NativeDiff:       true,
+		SupportsShifting: driver.SupportsShifting(),
+	}
+}
+
 // AdditionalLayer reprents a layer that is stored in the additional layer store
 // This API is experimental and can be changed without bumping the major version number.
 type AdditionalLayer interface {
@@ -252,6 +385,171 @@ type AdditionalLayerStoreDriver interface {
 	LookupAdditionalLayerByID(id string) (AdditionalLayer, error)
 }
 
+// LinkManagerDriver is the interface for drivers which keep a directory of
+// short symbolic links to layers' contents, which they use to keep the lists
+// of lower layers that they pass to the kernel short.
+// This API is experimental and can be changed without bumping the major version number.
+type LinkManagerDriver interface {
+	Driver
+
+	// Links returns a map from the names of the links to the IDs of the
+	// layers they point to.  Links which don't point to a layer are
+	// included, with an empty ID.
+	Links() (map[string]string, error)
+
+	// RebuildLinks removes links which don't point to a layer, and
+	// recreates or corrects the links for every layer.
+	RebuildLinks() error
+}
+
+// LayerListerDriver is the interface for drivers which can list the layers
+// that they have data for, so that data which was left behind for layers
+// which are no longer known can be found.
+type LayerListerDriver interface {
+	Driver
+
+	// ListLayers returns the IDs of the layers which the driver has data
+	// for in its own home directory.
+	ListLayers() ([]string, error)
+}
+
+// LayerDiffPathDriver is the interface for drivers which keep the files which
+// are added or changed by a layer's diff, and nothing else, in a directory of
+// their own, using the names which they have in the diff.
+type LayerDiffPathDriver interface {
+	Driver
+	// LayerDiffPath returns the location of the directory which holds
+	// the files which were added or changed by the specified layer.
+	LayerDiffPath(id string) (string, error)
+}
+
+// ImageStoreDriver is the interface for drivers which can create layers in
+// writable image stores which are separate from their home directory.
+type ImageStoreDriver interface {
+	Driver
+	// WritableImageStores returns the locations of the image stores in
+	// which layers can be created, which can be passed to Create() as
+	// the ImageStore in CreateOpts.
+	WritableImageStores() []string
+}
+
+// LayerCopierDriver is the interface for drivers which can populate a layer
+// by copying the contents of a layer which another instance of the same
+// driver manages, cloning files where the filesystem allows it, rather than
+// by applying a diff.
+type LayerCopierDriver interface {
+	Driver
+	// CopyLayer replaces the contents of the layer with the specified ID,
+	// which must have been created with the same parent which srcID has
+	// in src, with the contents of srcID.  It returns a wrapped
+	// ErrNotSupported if src's layers can't be copied this way.
+	CopyLayer(id string, src Driver, srcID string) error
+}
+
+// LayerSnapshotterDriver is the interface for drivers which can cheaply turn
+// the current contents of a layer into a new layer, on top of which the layer
+// continues to record changes.
+type LayerSnapshotterDriver interface {
+	Driver
+	// SnapshotLayer creates a layer with the ID snapshotID, whose parent
+	// is parent, which holds the current contents of the layer with the
+	// specified ID, whose parent must also be parent.  The new layer
+	// becomes the parent of the layer, which should not be mounted.
+	SnapshotLayer(id, parent, snapshotID string) error
+}
+
+// LayerResetterDriver is the interface for drivers which can discard the
+// contents of a layer without removing and recreating it.
+type LayerResetterDriver interface {
+	Driver
+	// ResetLayer discards the contents of the layer with the specified
+	// ID, which should not be mounted, leaving it with the contents of
+	// parent, which must be either the layer's parent or one of its
+	// ancestors.  Any options which were used when the layer was created
+	// remain in effect.
+	ResetLayer(id, parent string) error
+}
+
+// LayerRenamerDriver is the interface for drivers which can change the IDs of
+// layers.
+type LayerRenamerDriver interface {
+	Driver
+	// RenameLayer changes the ID of the layer with the specified ID,
+	// which should not be mounted, to newID, which must not already be
+	// in use.
+	RenameLayer(id, newID string) error
+}
+
+// AdditionalLowersDriver is the interface for drivers which can include
+// directories which don't belong to any layer in a layer's mount, as
+// requested using the AdditionalLowers field of MountOpts.
+type AdditionalLowersDriver interface {
+	Driver
+	// SupportsAdditionalLowers returns true if the driver will honor
+	// AdditionalLowers when mounting layers.
+	SupportsAdditionalLowers() bool
+}
+
+// WhiteoutConverterDriver is the interface for drivers which can convert the
+// whiteouts in a layer's contents, in place, from another format to the one
+// which they use, so that layers which were populated by a driver which uses
+// a different format can be adopted.
+type WhiteoutConverterDriver interface {
+	Driver
+	// WhiteoutFormat returns the format of the whiteouts in the contents
+	// of the driver's layers.
+	WhiteoutFormat() archive.WhiteoutFormat
+	// ConvertWhiteouts converts whiteouts in the layer with the specified
+	// ID, which are in the specified format, to the driver's format.
+	ConvertWhiteouts(id string, from archive.WhiteoutFormat) error
+}
+
+// ForceMaskDriver is the interface for drivers which can be configured to
+// force a permissions mask on the files in their layers, recording the
+// ownership and permissions which the files would otherwise have had in an
+// extended attribute.
+type ForceMaskDriver interface {
+	Driver
+	// ForceMask returns the permissions mask which the driver forces on
+	// the files in its layers, or nil if it doesn't force one.
+	ForceMask() *os.FileMode
+	// OverriddenFiles lists the files in the layer with the specified ID
+	// whose ownership and permissions were overridden, with both the
+	// values they have on disk and the ones they're supposed to have.
+	OverriddenFiles(id string) ([]archive.OverriddenFile, error)
+	// RestoreOverriddenFiles gives the files in the layer with the
+	// specified ID the ownership and permissions which they're supposed
+	// to have, and discards the record of them.
+	RestoreOverriddenFiles(id string) error
+}
+
+// StructuredStatusDriver is the interface for drivers which can report their
+// status in a structured form, rather than only as key-value pairs.
+type StructuredStatusDriver interface {
+	Driver
+	// StructuredStatus returns structured diagnostic information about
+	// the driver.  Its Details field should hold the same values which
+	// Status() returns.
+	StructuredStatus() *DriverStatus
+}
+
+// SparseDiffDriver is the interface for drivers which can produce diffs in
+// which regular files that have holes in them are stored as sparse entries.
+type SparseDiffDriver interface {
+	// SparseDiff is like Diff, but regular files which have holes in
+	// them are stored as sparse entries.
+	SparseDiff(id string, idMappings *idtools.IDMappings, parent string, parentIDMappings *idtools.IDMappings, mountLabel string) (io.ReadCloser, error)
+}
+
+// CopyStatsDriver is the interface for drivers which populate new layers by
+// copying the contents of files from their parents or from other layers.
+type CopyStatsDriver interface {
+	// TakeCopyStats returns statistics about how the contents of files
+	// were copied into the layer when it was last populated, and forgets
+	// them.  It returns nil if nothing was copied into the layer.
+	TakeCopyStats(id string) *copy.Stats
+}
+
 // DiffGetterDriver is the interface for layered file system drivers that
 // provide a specialized function for getting file contents for tar-split.
 type DiffGetterDriver interface {
@@ -275,10 +573,67 @@ type Checker interface {
 	IsMounted(path string) bool
 }
 
+// ClearFeatureCacheFunc discards the results of checks for the features of
+// the filesystem under home which a driver has cached, so that they will be
+// checked again the next time the driver is initialized.
+type ClearFeatureCacheFunc func(home string, options Options) error
+
+var featureCaches = make(map[string]ClearFeatureCacheFunc)
+
 func init() {
 	drivers = make(map[string]InitFunc)
 }
 
+// RegisterFeatureCache registers a ClearFeatureCacheFunc for the driver.
+func RegisterFeatureCache(name string, clearFunc ClearFeatureCacheFunc) error {
+	if _, exists := featureCaches[name]; exists {
+		return fmt.Errorf("Feature cache already registered for %s", name)
+	}
+	featureCaches[name] = clearFunc
+	return nil
+}
+
+// ClearFeatureCache discards the results of checks for filesystem features
+// which the named driver, or every driver if name is "", has cached for the
+// specified configuration.
+func ClearFeatureCache(name string, config Options) error {
+	for driver, clearFunc := range featureCaches {
+		if name != "" && driver != name {
+			continue
+		}
+		if err := clearFunc(filepath.Join(config.Root, driver), config); err != nil {
+			return errors.Wrapf(err, "error clearing cached features for driver %s", driver)
+		}
+	}
+	return nil
+}
+
+// OptionNames lists the prefixes which a driver's options can have, and the
+// names of the options which it accepts, without their prefixes.
+type OptionNames struct {
+	Prefixes []string
+	Names    []string
+}
+
+var optionNames = make(map[string]OptionNames)
+
+// RegisterOptionNames registers the names of the options which the driver
+// accepts, so that configurations can be checked without initializing it.
+func RegisterOptionNames(name string, names OptionNames) error {
+	if _, exists := optionNames[name]; exists {
+		return fmt.Errorf("Option names already registered for %s", name)
+	}
+	optionNames[name] = names
+	return nil
+}
+
+// GetOptionNames returns the names of the options which the named driver
+// accepts, if it has registered them.
+func GetOptionNames(name string) (OptionNames, bool) {
+	names, ok := optionNames[name]
+	return names, ok
+}
+
 // Register registers an InitFunc for the driver.
 func Register(name string, initFunc InitFunc) error {
 	if _, exists := drivers[name]; exists {
@@ -316,6 +671,14 @@ type Options struct {
 	UIDMaps             []idtools.IDMap
 	GIDMaps             []idtools.IDMap
 	ExperimentalEnabled bool
+	// Degraded, if set, explains why the driver is being used in place
+	// of the one which was configured.  Drivers which can be used that
+	// way include it in their status.
+	Degraded string
+	// TempDir, if set, is a directory in which drivers can create
+	// staging directories, in place of their home directory.  It may be
+	// on a different file system than the home directory.
+	TempDir string
 }
 
 // New creates the driver and initializes it at the specified root.
@@ -0,0 +1,29 @@
+package graphdriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type capableDriver struct {
+	statusOnlyDriver
+}
+
+func (capableDriver) Capabilities() Capabilities {
+	return Capabilities{
+		NativeDiff: true,
+		Snapshots:  true,
+		Quota:      true,
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	assert.Equal(t, Capabilities{NativeDiff: true, SupportsShifting: true}, GetCapabilities(statusOnlyDriver{}))
+	assert.Equal(t, Capabilities{NativeDiff: true, Snapshots: true, Quota: true}, GetCapabilities(capableDriver{}))
+
+	// A driver which is wrapped in a NaiveDiffDriver is asked for its
+	// capabilities, but it doesn't compute diffs itself.
+	naive := NewNaiveDiffDriver(capableDriver{}, NewNaiveLayerIDMapUpdater(capableDriver{}))
+	assert.Equal(t, Capabilities{Snapshots: true, Quota: true}, GetCapabilities(naive))
+}
@@ -42,6 +42,16 @@ func NewNaiveDiffDriver(driver ProtoDriver, updater LayerIDMapUpdater) Driver {
 // Diff produces an archive of the changes between the specified
 // layer and its parent layer which may be "".
 func (gdw *NaiveDiffDriver) Diff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string) (arch io.ReadCloser, err error) {
+	return gdw.diff(id, idMappings, parent, parentMappings, mountLabel, false)
+}
+
+// SparseDiff is like Diff, but regular files which have holes in them are
+// stored as sparse entries.
+func (gdw *NaiveDiffDriver) SparseDiff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string) (arch io.ReadCloser, err error) {
+	return gdw.diff(id, idMappings, parent, parentMappings, mountLabel, true)
+}
+
+func (gdw *NaiveDiffDriver) diff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string, sparse bool) (arch io.ReadCloser, err error) {
 	startTime := time.Now()
 	driver := gdw.ProtoDriver
 
@@ -71,6 +81,7 @@ func (gdw *NaiveDiffDriver) Diff(id string, idMappings *idtools.IDMappings, pare
 			Compression: archive.Uncompressed,
 			UIDMaps:     idMappings.UIDs(),
 			GIDMaps:     idMappings.GIDs(),
+			Sparse:      sparse,
 		})
 		if err != nil {
 			return nil, err
@@ -94,7 +105,11 @@ func (gdw *NaiveDiffDriver) Diff(id string, idMappings *idtools.IDMappings, pare
 		return nil, err
 	}
 
-	archive, err := archive.ExportChanges(layerFs, changes, idMappings.UIDs(), idMappings.GIDs())
+	exportChanges := archive.ExportChanges
+	if sparse {
+		exportChanges = archive.ExportSparseChanges
+	}
+	archive, err := exportChanges(layerFs, changes, idMappings.UIDs(), idMappings.GIDs())
 	if err != nil {
 		return nil, err
 	}
@@ -173,6 +188,7 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, options ApplyDiffOpts)
 	tarOptions := &archive.TarOptions{
 		InUserNS:          userns.RunningInUserNS(),
 		IgnoreChownErrors: options.IgnoreChownErrors,
+		Sparse:            options.Sparse,
 	}
 	if options.Mappings != nil {
 		tarOptions.UIDMaps = options.Mappings.UIDs()
@@ -0,0 +1,95 @@
+// +build linux
+
+package overlay
+
+import (
+	"os"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+)
+
+// frozenFile is the name of the file which is present in the directory of a
+// layer which has been frozen.  Keeping it on disk lets other processes
+// which use the same home directory know not to change the layer.
+const frozenFile = "frozen"
+
+// FreezeLayer prevents the layer from being mounted, changed, or removed
+// until ThawLayer() is called.  Layers which are mounted can't be frozen,
+// since their contents can be changed through their mounts.
+func (d *Driver) FreezeLayer(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	inUse, err := layerInUse(id, dir)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return errors.Errorf("overlay: layer %s is mounted, not freezing it", id)
+	}
+	f, err := os.OpenFile(path.Join(dir, frozenFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.Wrapf(graphdriver.ErrLayerFrozen, "overlay: layer %s", id)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// ThawLayer allows a layer which was frozen to be used normally again.
+func (d *Driver) ThawLayer(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	if err := os.Remove(path.Join(d.dir(id), frozenFile)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("overlay: layer %s is not frozen", id)
+		}
+		return err
+	}
+	return nil
+}
+
+// BackupFiles lists the files in a frozen layer's directory, other than the
+// ones which are only used while the layer is mounted.
+func (d *Driver) BackupFiles(id string) ([]graphdriver.BackupFile, error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	dir := d.dir(id)
+	if err := checkFrozen(id, dir); err != nil {
+		return nil, err
+	}
+	return graphdriver.ListBackupFiles(dir, func(name string) bool {
+		return name == "merged" || name == "work" || name == frozenFile
+	})
+}
+
+// checkFrozen returns an error if the layer in dir hasn't been frozen.
+func checkFrozen(id, dir string) error {
+	if _, err := os.Stat(path.Join(dir, frozenFile)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("overlay: layer %s is not frozen", id)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkNotFrozen returns an error wrapping ErrLayerFrozen if the layer in dir
+// has been frozen.
+func checkNotFrozen(id, dir string) error {
+	if _, err := os.Stat(path.Join(dir, frozenFile)); err == nil {
+		return errors.Wrapf(graphdriver.ErrLayerFrozen, "overlay: layer %s", id)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
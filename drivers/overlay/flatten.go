@@ -0,0 +1,383 @@
+//go:build linux
+// +build linux
+
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// flattenedPrefix starts the names of the directories which hold
+	// flattened lower layers, which are shared by every layer whose chain
+	// of lower layers ends with the same layers.
+	flattenedPrefix = "flat-"
+	// flattenStagingPrefix starts the names of the directories in which
+	// flattened lower layers are assembled.
+	flattenStagingPrefix = ".flatten-"
+)
+
+// flattenLowers shortens a chain of lower layers, ordered from uppermost to
+// lowermost and separated by ":", if it has more entries than the configured
+// flattening depth, or if it's too long to pass to mount(2), by merging its
+// lowermost entries into a single flattened layer and referencing that
+// instead.
+func (d *Driver) flattenLowers(lower string) (string, error) {
+	depth := d.options.flattenDepth
+	if depth == 0 {
+		depth = maxDepth
+	}
+	lowers := strings.Split(lower, ":")
+	if len(lowers) <= depth && len(lower) <= unix.Getpagesize()-512 {
+		return lower, nil
+	}
+	// Keep the upper half of the chain separate, so that layers built on
+	// top of this one won't need to be flattened again right away.
+	keep := depth / 2
+	if keep < 1 {
+		keep = 1
+	}
+	link, err := d.flatten(lowers[keep:])
+	if err != nil {
+		return "", errors.Wrapf(err, "flattening %d lower layers", len(lowers)-keep)
+	}
+	return strings.Join(append(lowers[:keep:keep], path.Join(linkDir, link)), ":"), nil
+}
+
+// flattenedID returns the name of the directory which holds the flattened
+// version of a chain of lower layers.
+func flattenedID(lowers []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lowers, ":")))
+	return flattenedPrefix + hex.EncodeToString(sum[:])
+}
+
+// flatten merges a chain of lower layers, ordered from uppermost to
+// lowermost, into a single flattened layer, reusing one which was already
+// built for the same chain if there is one, and returns the name of its link.
+func (d *Driver) flatten(lowers []string) (string, error) {
+	id := flattenedID(lowers)
+	dir := path.Join(d.home, id)
+	if link, err := ioutil.ReadFile(path.Join(dir, "link")); err == nil {
+		return string(link), nil
+	}
+
+	// Build the list of directories to merge, from lowermost to
+	// uppermost, including each layer's additional diffN directories.
+	var dirs []string
+	for i := len(lowers) - 1; i >= 0; i-- {
+		lower, err := d.resolveLower(lowers[i])
+		if err != nil {
+			return "", err
+		}
+		var layerDirs []string
+		for diffN := 1; ; diffN++ {
+			extra := dumbJoin(lower, "..", nameWithSuffix("diff", diffN))
+			if _, err := os.Stat(extra); err != nil {
+				break
+			}
+			layerDirs = append([]string{extra}, layerDirs...)
+		}
+		dirs = append(dirs, layerDirs...)
+		dirs = append(dirs, lower)
+	}
+
+	rootUID, rootGID, err := idtools.GetRootUIDGID(d.uidMaps, d.gidMaps)
+	if err != nil {
+		return "", err
+	}
+	staging, err := ioutil.TempDir(d.home, flattenStagingPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if staging != "" {
+			if err := system.EnsureRemoveAll(staging); err != nil {
+				logrus.Debugf("Failed to remove %q: %v", staging, err)
+			}
+		}
+	}()
+	if err := os.Chown(staging, rootUID, rootGID); err != nil {
+		return "", err
+	}
+	diff := path.Join(staging, "diff")
+	if err := idtools.MkdirAs(diff, defaultPerms, rootUID, rootGID); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	for _, dir := range dirs {
+		if err := mergeLayerDir(dir, diff); err != nil {
+			return "", errors.Wrapf(err, "merging %q", dir)
+		}
+	}
+	if err := idtools.MkdirAs(path.Join(staging, "empty"), 0700, rootUID, rootGID); err != nil {
+		return "", err
+	}
+	link := generateID(idLength)
+	if err := ioutil.WriteFile(path.Join(staging, "link"), []byte(link), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		if existing, err2 := ioutil.ReadFile(path.Join(dir, "link")); err2 == nil {
+			// Someone else flattened the same chain first.
+			return string(existing), nil
+		}
+		return "", err
+	}
+	staging = ""
+	if err := os.Symlink(path.Join("..", id, "diff"), path.Join(d.home, linkDir, link)); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	logrus.Debugf("overlay: flattened %d lower layers into %q in %v", len(lowers), id, time.Since(start))
+	return link, nil
+}
+
+// resolveLower returns the location of the "diff" directory which a lower
+// layer's entry in a "lower" file refers to.
+func (d *Driver) resolveLower(lower string) (string, error) {
+	candidates := []string{path.Join(d.home, lower)}
+	for _, p := range d.AdditionalImageStores() {
+		candidates = append(candidates, path.Join(p, d.name, lower))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			target, err := filepath.EvalSymlinks(candidate)
+			if err != nil {
+				return "", err
+			}
+			return target, nil
+		}
+	}
+	return "", errors.Wrapf(os.ErrNotExist, "locating lower layer %q", lower)
+}
+
+// isWhiteout returns true if the file is an overlay whiteout, a character
+// device with device number 0/0.
+func isWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// mergeLayerDir merges the contents of src, a layer's diff directory, into
+// dst, which holds the merged contents of the layers below it.  Since the
+// merged layer will be the lowest one in any chain that uses it, whiteouts
+// and opaque directory markers are applied rather than copied.  Files are
+// hard linked into place when possible, and cloned or copied when not.
+func mergeLayerDir(src, dst string) error {
+	opaqueXattr := archive.GetOverlayXattrName("opaque")
+	type dirTimes struct {
+		path string
+		st   *syscall.Stat_t
+	}
+	var dirs []dirTimes
+	copyWithFileRange, copyWithFileClone := true, true
+	err := filepath.Walk(src, func(srcPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+		st := fi.Sys().(*syscall.Stat_t)
+		for _, xattr := range []string{archive.GetOverlayXattrName("metacopy"), archive.GetOverlayXattrName("redirect")} {
+			if value, _ := system.Lgetxattr(srcPath, xattr); value != nil {
+				return errors.Errorf("%q has the %q attribute, which can't be preserved when flattening", srcPath, xattr)
+			}
+		}
+		base := filepath.Base(rel)
+		switch {
+		case rel == ".":
+			dirs = append(dirs, dirTimes{dstPath, st})
+			return nil
+		case isWhiteout(fi):
+			return os.RemoveAll(dstPath)
+		case base == archive.WhiteoutOpaqueDir:
+			// AUFS-style opaque directory marker: discard everything
+			// which the layers below put in the directory.
+			return clearDir(filepath.Dir(dstPath), dst)
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			return os.RemoveAll(filepath.Join(filepath.Dir(dstPath), strings.TrimPrefix(base, archive.WhiteoutPrefix)))
+		case fi.IsDir():
+			if existing, err := os.Lstat(dstPath); err == nil && !existing.IsDir() {
+				if err := os.Remove(dstPath); err != nil {
+					return err
+				}
+			}
+			if err := os.Mkdir(dstPath, fi.Mode()); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if opaque, _ := system.Lgetxattr(srcPath, opaqueXattr); len(opaque) == 1 && opaque[0] == 'y' {
+				if err := clearDir(dstPath, dst); err != nil {
+					return err
+				}
+			}
+			if err := os.Lchown(dstPath, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+			if err := os.Chmod(dstPath, fi.Mode()); err != nil {
+				return err
+			}
+			if err := copyUserXattrs(srcPath, dstPath); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTimes{dstPath, st})
+			return nil
+		}
+		if err := os.RemoveAll(dstPath); err != nil {
+			return err
+		}
+		if err := os.Link(srcPath, dstPath); err == nil {
+			return nil
+		}
+		// We couldn't link it, most likely because the source is in
+		// an additional image store on another filesystem.
+		switch {
+		case fi.Mode().IsRegular():
+			if err := copy.CopyRegular(srcPath, dstPath, fi, &copyWithFileRange, &copyWithFileClone); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dstPath); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(dstPath, st.Mode, int(st.Rdev)); err != nil {
+				return err
+			}
+		}
+		if err := os.Lchown(dstPath, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(dstPath, fi.Mode()); err != nil {
+				return err
+			}
+			if err := copyUserXattrs(srcPath, dstPath); err != nil {
+				return err
+			}
+		}
+		return system.LUtimesNano(dstPath, []syscall.Timespec{st.Atim, st.Mtim})
+	})
+	if err != nil {
+		return err
+	}
+	// Set directory timestamps last, since adding entries changes them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := system.LUtimesNano(dirs[i].path, []syscall.Timespec{dirs[i].st.Atim, dirs[i].st.Mtim}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDir removes the contents of dir, which must be inside of root.
+func clearDir(dir, root string) error {
+	if !strings.HasPrefix(dir, root) {
+		return fmt.Errorf("%q is not inside of %q", dir, root)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUserXattrs copies the extended attributes which describe the contents
+// of a file, rather than its role in an overlay, from src to dst.
+func copyUserXattrs(src, dst string) error {
+	xattrs, err := system.Llistxattr(src)
+	if err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return nil
+		}
+		return err
+	}
+	for _, xattr := range xattrs {
+		if strings.HasPrefix(xattr, "trusted.overlay.") || strings.HasPrefix(xattr, "user.overlay.") {
+			continue
+		}
+		value, err := system.Lgetxattr(src, xattr)
+		if err != nil {
+			return err
+		}
+		if err := system.Lsetxattr(dst, xattr, value, 0); err != nil && !errors.Is(err, unix.EOPNOTSUPP) {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFlattened removes flattened layers which no layer's chain of lower
+// layers refers to any more, and returns the number which were removed.
+func (d *Driver) pruneFlattened() (int, error) {
+	entries, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return 0, err
+	}
+	used := make(map[string]bool)
+	var flattened []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == linkDir {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), flattenedPrefix) {
+			flattened = append(flattened, entry.Name())
+			continue
+		}
+		lower, err := ioutil.ReadFile(path.Join(d.home, entry.Name(), lowerFile))
+		if err != nil {
+			continue
+		}
+		for _, l := range strings.Split(string(lower), ":") {
+			used[strings.TrimPrefix(l, linkDir+"/")] = true
+		}
+	}
+	pruned := 0
+	for _, id := range flattened {
+		link, err := ioutil.ReadFile(path.Join(d.home, id, "link"))
+		if err != nil || used[string(link)] {
+			continue
+		}
+		if err := os.Remove(path.Join(d.home, linkDir, string(link))); err != nil && !os.IsNotExist(err) {
+			return pruned, err
+		}
+		if err := system.EnsureRemoveAll(path.Join(d.home, id)); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
@@ -0,0 +1,201 @@
+//go:build linux
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+)
+
+// imageStoreMount is the mount program and mount options which are used for
+// layers whose lower layers are in an additional image store, which may be on
+// a file system, like NFS or squashfs, which needs a different mount helper
+// than the rest of the driver's layers.
+type imageStoreMount struct {
+	mountProgram string
+	mountOptions string
+	// features records which optional parts of the mount_program
+	// contract mountProgram implements.
+	features mountProgramFeatures
+}
+
+// parseImageStoreMount parses the value of an "imagestore_mount_program" or
+// "imagestore_mountopt" option, which is the location of an additional image
+// store and the setting for it, separated by "=".
+func (o *overlayOptions) parseImageStoreMount(key, val string) error {
+	parts := strings.SplitN(val, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("overlay: %s value %q is not in the form IMAGESTORE=VALUE", key, val)
+	}
+	store := filepath.Clean(parts[0])
+	if !filepath.IsAbs(store) {
+		return fmt.Errorf("overlay: image path %q is not absolute.  Can not be relative", store)
+	}
+	if o.imageStoreMounts == nil {
+		o.imageStoreMounts = make(map[string]*imageStoreMount)
+	}
+	m := o.imageStoreMounts[store]
+	if m == nil {
+		m = &imageStoreMount{}
+		o.imageStoreMounts[store] = m
+	}
+	switch key {
+	case "imagestore_mount_program":
+		if parts[1] != "" {
+			if _, err := os.Stat(parts[1]); err != nil {
+				return errors.Wrapf(err, "overlay: can't stat program %q", parts[1])
+			}
+		}
+		m.mountProgram = parts[1]
+	case "imagestore_mountopt":
+		m.mountOptions = parts[1]
+	}
+	return nil
+}
+
+// checkImageStoreMounts makes sure that the image stores which have their
+// own mount programs or mount options are additional image stores, and
+// checks which features their mount programs implement.
+func (o *overlayOptions) checkImageStoreMounts(runhome string) error {
+	for store, m := range o.imageStoreMounts {
+		known := false
+		for _, s := range o.imageStores {
+			if s == store {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("overlay: mount settings were given for %q, which is not an additional image store", store)
+		}
+		if m.mountProgram == "" {
+			continue
+		}
+		features, err := checkMountProgram(m.mountProgram, runhome)
+		if err != nil {
+			return err
+		}
+		if o.forceMask != nil && !features.xattrPermissions {
+			return errors.Errorf("'force_mask' requires a 'mount_program' which supports %q, and %q, for image store %q, does not", mountProgramFeatureXattrPermissions, m.mountProgram, store)
+		}
+		m.features = features
+	}
+	return nil
+}
+
+// usesImageStoreMountPrograms returns true if any additional image store has
+// its own mount program.
+func (o *overlayOptions) usesImageStoreMountPrograms() bool {
+	for _, m := range o.imageStoreMounts {
+		if m.mountProgram != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// imageStoreMountFor returns the mount settings to use for a layer whose
+// lower layers are in the listed additional image stores, combining the mount
+// options of all of them, or nil if none of them have settings of their own.
+// Layers can't be mounted if their lower layers are in image stores which
+// need different mount programs.
+func (d *Driver) imageStoreMountFor(stores []string) (*imageStoreMount, error) {
+	var combined *imageStoreMount
+	programStore := ""
+	seen := make(map[string]bool)
+	for _, store := range stores {
+		m := d.options.imageStoreMounts[store]
+		if m == nil || seen[store] {
+			continue
+		}
+		seen[store] = true
+		if combined == nil {
+			combined = &imageStoreMount{}
+		}
+		if m.mountProgram != "" {
+			if combined.mountProgram != "" && combined.mountProgram != m.mountProgram {
+				return nil, errors.Errorf("lower layers are in image stores %q and %q, which use different mount programs", programStore, store)
+			}
+			combined.mountProgram, combined.features, programStore = m.mountProgram, m.features, store
+		}
+		if m.mountOptions != "" {
+			if combined.mountOptions != "" {
+				combined.mountOptions += ","
+			}
+			combined.mountOptions += m.mountOptions
+		}
+	}
+	return combined, nil
+}
+
+// fsMagicsChecker reports that a path is mounted if any of several types of
+// file system is mounted there, for when layers are mounted using both the
+// kernel and a mount program.
+type fsMagicsChecker []graphdriver.FsMagic
+
+func (c fsMagicsChecker) IsMounted(path string) bool {
+	for _, t := range c {
+		if mounted, _ := graphdriver.Mounted(t, path); mounted {
+			return true
+		}
+	}
+	return false
+}
+
+// imageStoreHome returns the directory in the writable image store which
+// holds the directories of layers which were placed there, or "" if no
+// writable image store was configured.
+func (d *Driver) imageStoreHome() string {
+	if d.options.writableImageStore == "" {
+		return ""
+	}
+	return path.Join(d.options.writableImageStore, d.name)
+}
+
+// WritableImageStores returns the locations of the image stores, other than
+// the driver's home directory, in which layers can be created.
+func (d *Driver) WritableImageStores() []string {
+	if d.options.writableImageStore == "" {
+		return nil
+	}
+	return []string{d.options.writableImageStore}
+}
+
+// linkTarget returns the target for the symbolic link, in the link directory,
+// to the diff directory of the layer whose directory is dir.  Layers in the
+// home directory use relative links, so that the home directory can be moved,
+// but layers in the writable image store need absolute ones.
+func (d *Driver) linkTarget(id, dir string) string {
+	if path.Dir(dir) == d.home {
+		return path.Join("..", id, "diff")
+	}
+	return path.Join(dir, "diff")
+}
+
+// linkTargetID returns the ID of the layer which a symbolic link in the link
+// directory points to, if its target looks like one that we would have
+// created.
+func (d *Driver) linkTargetID(target string) (string, bool) {
+	if imageStoreHome := d.imageStoreHome(); imageStoreHome != "" && filepath.IsAbs(target) {
+		dir, diff := path.Split(path.Clean(target))
+		if diff != "diff" {
+			return "", false
+		}
+		if parent, id := path.Split(path.Clean(dir)); path.Clean(parent) == imageStoreHome && id != "" {
+			return id, true
+		}
+		return "", false
+	}
+	targetComponents := strings.Split(target, "/")
+	if len(targetComponents) != 3 || targetComponents[0] != ".." || targetComponents[2] != "diff" {
+		return "", false
+	}
+	return targetComponents[1], true
+}
@@ -0,0 +1,110 @@
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// originXattrs are the attributes which the kernel sets on the root of an
+// upper directory when the "index" feature is on, to record which lower
+// directory it was first used with.  The kernel refuses to mount the upper
+// directory with any other lower directory while "index" is on.
+var originXattrs = []string{"trusted.overlay.origin", "user.overlay.origin"}
+
+// isStaleIndexError returns true if err looks like the error which the
+// kernel returns when it's asked to mount an upper directory whose work
+// directory's "index" was created with a different lower directory, or with
+// different settings for the "index" or "nfs_export" features than the ones
+// which are now in effect, which can happen after the overlay module's
+// options are changed.
+func isStaleIndexError(err error) bool {
+	if errors.Is(err, unix.ESTALE) || errors.Is(err, unix.EEXIST) {
+		return true
+	}
+	// Mounts which are made using mountFrom() only give us the text of
+	// the error.
+	msg := err.Error()
+	return strings.Contains(msg, unix.ESTALE.Error()) || strings.Contains(msg, unix.EEXIST.Error())
+}
+
+// layerInUse returns true if the layer's upper or work directory is being
+// used by any overlay mount, including ones which we don't know about.
+func layerInUse(id, dir string) (bool, error) {
+	mergedDir := path.Join(dir, "merged")
+	if _, err := os.Lstat(mergedDir); err == nil {
+		mounted, err := mount.Mounted(mergedDir)
+		if err != nil {
+			return false, err
+		}
+		if mounted {
+			return true, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	infos, err := mount.GetMountsByFSType("overlay")
+	if err != nil {
+		return false, err
+	}
+	for _, info := range infos {
+		for _, option := range strings.Split(info.VFSOptions, ",") {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 || (kv[0] != "upperdir" && kv[0] != "workdir") {
+				continue
+			}
+			for _, name := range []string{"diff", "work"} {
+				if kv[1] == path.Join(dir, name) || kv[1] == path.Join(id, name) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// clearStaleIndex discards the contents of a layer's work directory,
+// including the "index" which records which lower directories its upper
+// directory was used with, and the record of that which the kernel stored on
+// the upper directory itself, so that the layer can be mounted again.  It
+// refuses to do so while anything is still using the layer.
+func (d *Driver) clearStaleIndex(id, dir string) error {
+	inUse, err := layerInUse(id, dir)
+	if err != nil {
+		return errors.Wrapf(err, "checking if layer %s is in use", id)
+	}
+	if inUse {
+		return fmt.Errorf("layer %s is still mounted, not clearing its work directory", id)
+	}
+	rootUID, rootGID, err := idtools.GetRootUIDGID(d.uidMaps, d.gidMaps)
+	if err != nil {
+		return err
+	}
+	workDir := path.Join(dir, "work")
+	if err := os.RemoveAll(workDir); err != nil {
+		return err
+	}
+	if err := idtools.MkdirAs(workDir, 0700, rootUID, rootGID); err != nil {
+		return err
+	}
+	diffDir := path.Join(dir, "diff")
+	for _, attr := range originXattrs {
+		// Unprivileged processes can't remove trusted.* attributes,
+		// but in that case the kernel couldn't have set them either.
+		if err := system.Lremovexattr(diffDir, attr); err != nil && !errors.Is(err, unix.EOPNOTSUPP) && !errors.Is(err, unix.EPERM) {
+			return errors.Wrapf(err, "removing %q from %q", attr, diffDir)
+		}
+	}
+	logrus.Warnf("Cleared the work directory of layer %s, which was created with different overlay index settings", id)
+	return nil
+}
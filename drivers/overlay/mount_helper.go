@@ -0,0 +1,216 @@
+//go:build linux
+// +build linux
+
+package overlay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// A mount_program like fuse-overlayfs daemonizes once the file system is
+// mounted, and the daemon keeps running until the file system is unmounted.
+// Since the daemon isn't our child, and the process which mounted the layer
+// may not be the one which unmounts it, we record which process is serving
+// each mount in the layer's directory, so that we can tell if it has died, in
+// which case the mount is replaced with a new one the next time the layer is
+// mounted, and so that we can make sure that it exits when the layer is
+// unmounted.
+const (
+	// mountHelperFile is the name of the file, in the layer's directory,
+	// in which the mount helper for the layer's mount is recorded.
+	mountHelperFile = "mount-helper"
+)
+
+// mountHelperExitTimeout is how long we wait for a mount helper to exit by
+// itself after its file system has been unmounted, and then again after
+// asking it to exit, before killing it.
+var mountHelperExitTimeout = 5 * time.Second
+
+// mountHelper describes the process which serves a layer's mount.
+type mountHelper struct {
+	// PID is the process ID of the daemon, or 0 if it couldn't be found.
+	PID int `json:"pid,omitempty"`
+	// StartTime is when the daemon started, in clock ticks after boot,
+	// so that we can tell if its process ID has been reused.
+	StartTime uint64 `json:"start-time,omitempty"`
+	// Target is the mount point.
+	Target string `json:"target"`
+	// Options are the options which the mount program was run with.
+	Options string `json:"options"`
+}
+
+// alive returns true if the daemon is still running.
+func (h *mountHelper) alive() bool {
+	if h.PID <= 0 {
+		return false
+	}
+	// If the daemon was reparented to us because we're a subreaper, it
+	// can only finish exiting once we've waited for it.
+	var status unix.WaitStatus
+	unix.Wait4(h.PID, &status, unix.WNOHANG, nil)
+	start := system.ProcessStartTime(h.PID)
+	return start != 0 && (h.StartTime == 0 || start == h.StartTime)
+}
+
+// check returns an error if the daemon has exited, or if its file system is
+// no longer usable.
+func (h *mountHelper) check() error {
+	if h.PID > 0 && !h.alive() {
+		return errors.Errorf("mount program process %d has exited", h.PID)
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(h.Target, &fs); err != nil {
+		return errors.Wrapf(err, "checking the file system mounted at %q", h.Target)
+	}
+	return nil
+}
+
+// findMountHelper looks for the process which is running the program to serve
+// a mount at target.
+func findMountHelper(program, target string) (int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		// If the program is a script, its interpreter is the first
+		// argument, and the script is the second.
+		args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+		if len(args) < 2 || args[len(args)-1] != target {
+			continue
+		}
+		if filepath.Base(args[0]) == filepath.Base(program) || args[1] == program {
+			return pid, nil
+		}
+	}
+	return 0, errors.Errorf("no %q process is serving %q", program, target)
+}
+
+// readMountHelper reads the record of the mount helper for the layer in dir,
+// returning nil if there isn't one.
+func readMountHelper(dir string) (*mountHelper, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, mountHelperFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var h mountHelper
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, errors.Wrapf(err, "decoding %q", path.Join(dir, mountHelperFile))
+	}
+	return &h, nil
+}
+
+// startMountHelper runs the mount program to mount the layer in dir at
+// target, and records which process is serving the mount.
+func (d *Driver) startMountHelper(program, dir, target, options string) error {
+	mountProgram := exec.Command(program, "-o", options, target)
+	mountProgram.Dir = d.home
+	var b bytes.Buffer
+	mountProgram.Stderr = &b
+	if err := mountProgram.Run(); err != nil {
+		output := b.String()
+		if output == "" {
+			output = "<stderr empty>"
+		}
+		return errors.Wrapf(err, "using mount program %s: %s", program, output)
+	}
+	h := mountHelper{
+		Target:  target,
+		Options: options,
+	}
+	if pid, err := findMountHelper(program, target); err == nil {
+		h.PID = pid
+		h.StartTime = system.ProcessStartTime(pid)
+	} else {
+		logrus.Debugf("overlay: %v", err)
+	}
+	data, err := json.Marshal(&h)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(path.Join(dir, mountHelperFile), data, 0600)
+}
+
+// hasMountHelper returns true if the layer in dir was mounted using a mount
+// program, which may not be the driver's own if its lower layers are in an
+// additional image store which has one.
+func hasMountHelper(dir string) bool {
+	_, err := os.Stat(path.Join(dir, mountHelperFile))
+	return err == nil
+}
+
+// cleanupMountHelper is called before the layer in dir is mounted.  If its
+// previous mount helper is still recorded, the layer was last unmounted by
+// something other than Put(), or the helper died and left its mount unusable.
+// Either way, anything left of the old mount is removed so that it can be
+// replaced.
+func (d *Driver) cleanupMountHelper(dir string) {
+	h, err := readMountHelper(dir)
+	if err != nil {
+		logrus.Debugf("overlay: %v", err)
+	}
+	if h == nil {
+		return
+	}
+	if err := h.check(); err != nil {
+		logrus.Warnf("overlay: restarting mount program for %q: %v", h.Target, err)
+	}
+	if err := unix.Unmount(h.Target, unix.MNT_DETACH); err != nil && err != unix.EINVAL && !os.IsNotExist(err) {
+		logrus.Debugf("overlay: removing stale mount at %q: %v", h.Target, err)
+	}
+	d.stopMountHelper(dir)
+}
+
+// stopMountHelper is called after the layer in dir is unmounted.  It waits for
+// the layer's mount helper to exit, asking it to exit if it doesn't do so by
+// itself, and killing it if that doesn't work either.
+func (d *Driver) stopMountHelper(dir string) {
+	h, err := readMountHelper(dir)
+	if err != nil {
+		logrus.Debugf("overlay: %v", err)
+	}
+	if h != nil && h.PID > 0 {
+		for _, signal := range []unix.Signal{0, unix.SIGTERM, unix.SIGKILL} {
+			if !h.alive() {
+				break
+			}
+			if signal != 0 {
+				logrus.Debugf("overlay: sending %v to mount program process %d serving %q", signal, h.PID, h.Target)
+				if err := unix.Kill(h.PID, signal); err != nil {
+					break
+				}
+			}
+			for deadline := time.Now().Add(mountHelperExitTimeout); h.alive() && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	if err := os.Remove(path.Join(dir, mountHelperFile)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("overlay: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+//go:build linux
+// +build linux
+
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The mount_program contract, version 1
+//
+// A mount_program is run, with the driver's home directory as its working
+// directory, as
+//
+//	<mount_program> -o <options> <target>
+//
+// where <options> is a comma-separated list which always includes "lowerdir="
+// (a colon-separated list of layer directories, topmost first) and, for
+// writable mounts, "upperdir=" and "workdir=".  It can also include:
+//
+//   - "context=" and any options set using mountopt or by the caller;
+//   - "uidmapping=" and "gidmapping=", each a colon-separated list of
+//     containerID:hostID:size triples, when IDs need to be shifted;
+//   - "squash_to_uid=" and "squash_to_gid=", in place of the mappings, when
+//     only one ID is mapped, so every file should appear to be owned by it;
+//   - "xattr_permissions=2", when force_mask is set, so that the ownership and
+//     permissions recorded in the "user.containers.override_stat" attribute
+//     are presented instead of the ones on disk;
+//   - "nosuid", "nodev" and "noexec".
+//
+// The program must exit with status 0 once the file system is mounted at
+// <target>, and otherwise describe the problem on stderr.  The file system is
+// unmounted using "fusermount3 -u" or "fusermount -u", or umount(2).
+//
+// A program advertises which of the optional parts of the contract it
+// implements when it's run with "--storage-features", by printing
+// "contract=1" and then the names of the features that it supports
+// ("uidmapping", "squash_to_uid", and "xattr_permissions"), one per line, and
+// exiting with status 0.  A program which doesn't recognize that flag is
+// identified by its "--version" output: releases of fuse-overlayfs are
+// checked against the versions which added each feature, and any other
+// program is assumed to implement all of them, as was always assumed before.
+const (
+	mountProgramContractVersion = 1
+	mountProgramFeaturesFlag    = "--storage-features"
+	mountProgramProbeTimeout    = 10 * time.Second
+
+	mountProgramFeatureUIDMapping       = "uidmapping"
+	mountProgramFeatureSquash           = "squash_to_uid"
+	mountProgramFeatureXattrPermissions = "xattr_permissions"
+)
+
+// mountProgramFeatures records which optional parts of the mount_program
+// contract a mount_program implements.
+type mountProgramFeatures struct {
+	uidMapping       bool
+	squash           bool
+	xattrPermissions bool
+}
+
+// allMountProgramFeatures is what we assume about programs which we can't
+// identify.
+var allMountProgramFeatures = mountProgramFeatures{
+	uidMapping:       true,
+	squash:           true,
+	xattrPermissions: true,
+}
+
+// fuseOverlayfsVersion matches the first line of "fuse-overlayfs --version".
+var fuseOverlayfsVersion = regexp.MustCompile(`^fuse-overlayfs: version ([0-9]+)\.([0-9]+)`)
+
+// String formats the features the same way a mount_program lists them in
+// response to mountProgramFeaturesFlag.
+func (f mountProgramFeatures) String() string {
+	lines := []string{fmt.Sprintf("contract=%d", mountProgramContractVersion)}
+	for _, feature := range []struct {
+		set  bool
+		name string
+	}{
+		{f.uidMapping, mountProgramFeatureUIDMapping},
+		{f.squash, mountProgramFeatureSquash},
+		{f.xattrPermissions, mountProgramFeatureXattrPermissions},
+	} {
+		if feature.set {
+			lines = append(lines, feature.name)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// parseMountProgramFeatures parses a list of features, as printed by a
+// mount_program which was run with mountProgramFeaturesFlag.  Features which
+// we don't know about are ignored, but a contract version which we don't
+// implement is an error.
+func parseMountProgramFeatures(text string) (mountProgramFeatures, error) {
+	var features mountProgramFeatures
+	contract := -1
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "contract="):
+			v, err := strconv.Atoi(strings.TrimPrefix(line, "contract="))
+			if err != nil {
+				return features, errors.Wrapf(err, "parsing mount_program contract version %q", line)
+			}
+			contract = v
+		case line == mountProgramFeatureUIDMapping:
+			features.uidMapping = true
+		case line == mountProgramFeatureSquash:
+			features.squash = true
+		case line == mountProgramFeatureXattrPermissions:
+			features.xattrPermissions = true
+		default:
+			logrus.Debugf("overlay: ignoring unrecognized mount_program feature %q", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return features, err
+	}
+	if contract == -1 {
+		return features, errors.New("mount_program feature list doesn't include a contract version")
+	}
+	if contract != mountProgramContractVersion {
+		return features, errors.Errorf("mount_program implements contract version %d, but only version %d is supported", contract, mountProgramContractVersion)
+	}
+	return features, nil
+}
+
+// fuseOverlayfsFeatures returns the features implemented by a version of
+// fuse-overlayfs, if versionOutput is the output of "fuse-overlayfs --version".
+func fuseOverlayfsFeatures(versionOutput string) (mountProgramFeatures, bool) {
+	m := fuseOverlayfsVersion.FindStringSubmatch(strings.TrimSpace(versionOutput))
+	if m == nil {
+		return mountProgramFeatures{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	atLeast := func(wantMajor, wantMinor int) bool {
+		return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+	}
+	return mountProgramFeatures{
+		uidMapping:       true,
+		squash:           atLeast(0, 7),
+		xattrPermissions: atLeast(1, 5),
+	}, true
+}
+
+// runMountProgramProbe runs the program with a single argument and returns
+// what it printed to stdout, or an error if it didn't exit successfully.
+func runMountProgramProbe(program, arg string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mountProgramProbeTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, program, arg)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// probeMountProgram determines which optional parts of the mount_program
+// contract the program implements.
+func probeMountProgram(program string) (mountProgramFeatures, error) {
+	if output, err := runMountProgramProbe(program, mountProgramFeaturesFlag); err == nil {
+		features, err := parseMountProgramFeatures(output)
+		if err != nil {
+			return features, errors.Wrapf(err, "mount_program %q", program)
+		}
+		return features, nil
+	}
+	if output, err := runMountProgramProbe(program, "--version"); err == nil {
+		if features, ok := fuseOverlayfsFeatures(output); ok {
+			return features, nil
+		}
+	}
+	logrus.Debugf("overlay: unable to determine which features mount_program %q supports, assuming all of them", program)
+	return allMountProgramFeatures, nil
+}
+
+// checkMountProgram returns the features implemented by the program, probing
+// it if the results of an earlier probe of this version of it aren't cached.
+func checkMountProgram(program, runhome string) (mountProgramFeatures, error) {
+	st, err := os.Stat(program)
+	if err != nil {
+		return mountProgramFeatures{}, errors.Wrapf(err, "overlay: can't stat program %q", program)
+	}
+	if !st.Mode().IsRegular() || st.Mode().Perm()&0111 == 0 {
+		return mountProgramFeatures{}, errors.Errorf("overlay: mount_program %q is not an executable file", program)
+	}
+	feature := fmt.Sprintf("mount_program(%x)", sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", program, st.Size(), st.ModTime().UnixNano()))))
+	if supported, text, err := cachedFeatureCheck(runhome, feature); err == nil && supported {
+		if features, err := parseMountProgramFeatures(text); err == nil {
+			return features, nil
+		}
+	}
+	features, err := probeMountProgram(program)
+	if err != nil {
+		return features, err
+	}
+	if err := cachedFeatureRecord(runhome, feature, true, features.String()); err != nil {
+		return features, errors.Wrap(err, "recording mount_program features")
+	}
+	logrus.Debugf("overlay: mount_program %q supports %s", program, strings.Join(strings.Fields(features.String())[1:], ", "))
+	return features, nil
+}
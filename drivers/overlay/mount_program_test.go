@@ -0,0 +1,145 @@
+// +build linux
+
+package overlay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMountProgramFeatures(t *testing.T) {
+	features, err := parseMountProgramFeatures("contract=1\nuidmapping\nsomething-new\nxattr_permissions\n")
+	require.NoError(t, err)
+	assert.Equal(t, mountProgramFeatures{uidMapping: true, xattrPermissions: true}, features)
+
+	roundTrip, err := parseMountProgramFeatures(allMountProgramFeatures.String())
+	require.NoError(t, err)
+	assert.Equal(t, allMountProgramFeatures, roundTrip)
+
+	_, err = parseMountProgramFeatures("uidmapping\n")
+	assert.Error(t, err, "a feature list without a contract version should be rejected")
+	_, err = parseMountProgramFeatures("contract=2\nuidmapping\n")
+	assert.Error(t, err, "a feature list for a different contract version should be rejected")
+}
+
+func TestFuseOverlayfsFeatures(t *testing.T) {
+	for _, c := range []struct {
+		output   string
+		features mountProgramFeatures
+		ok       bool
+	}{
+		{"fuse-overlayfs: version 0.3\nFUSE library version 3.2.1\n", mountProgramFeatures{uidMapping: true}, true},
+		{"fuse-overlayfs: version 1.4.0\nFUSE library version 3.9.1\n", mountProgramFeatures{uidMapping: true, squash: true}, true},
+		{"fuse-overlayfs: version 1.9\nFUSE library version 3.10.5\n", allMountProgramFeatures, true},
+		{"some-other-program 2.0\n", mountProgramFeatures{}, false},
+	} {
+		features, ok := fuseOverlayfsFeatures(c.output)
+		assert.Equal(t, c.ok, ok, c.output)
+		assert.Equal(t, c.features, features, c.output)
+	}
+}
+
+func TestCheckMountProgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay-mount-program")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeProgram := func(name, script string) string {
+		program := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(program, []byte("#!/bin/sh\n"+script), 0755))
+		return program
+	}
+
+	program := writeProgram("features", `test "$1" = --storage-features || exit 1
+echo contract=1
+echo uidmapping
+`)
+	features, err := checkMountProgram(program, dir)
+	require.NoError(t, err)
+	assert.Equal(t, mountProgramFeatures{uidMapping: true}, features)
+	records, err := filepath.Glob(filepath.Join(dir, cachedFeatureSet("mount_program(*)", true)))
+	require.NoError(t, err)
+	assert.Len(t, records, 1, "the probe's results should have been cached")
+	features, err = checkMountProgram(program, dir)
+	require.NoError(t, err)
+	assert.Equal(t, mountProgramFeatures{uidMapping: true}, features)
+
+	program = writeProgram("fuse-overlayfs", `test "$1" = --version || exit 1
+echo "fuse-overlayfs: version 1.1"
+`)
+	features, err = checkMountProgram(program, dir)
+	require.NoError(t, err)
+	assert.Equal(t, mountProgramFeatures{uidMapping: true, squash: true}, features)
+
+	program = writeProgram("unknown", "exit 1\n")
+	features, err = checkMountProgram(program, dir)
+	require.NoError(t, err)
+	assert.Equal(t, allMountProgramFeatures, features)
+
+	program = writeProgram("future", "echo contract=99\n")
+	_, err = checkMountProgram(program, dir)
+	assert.Error(t, err)
+
+	notExecutable := filepath.Join(dir, "not-executable")
+	require.NoError(t, ioutil.WriteFile(notExecutable, nil, 0644))
+	_, err = checkMountProgram(notExecutable, dir)
+	assert.Error(t, err)
+}
+
+func TestOptsAppendMappings(t *testing.T) {
+	single := []idtools.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}}
+	ranges := []idtools.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}}
+
+	d := &Driver{mountProgramFeatures: allMountProgramFeatures}
+	assert.Equal(t, "lowerdir=l,squash_to_uid=1000,squash_to_gid=1000", d.optsAppendMappings("lowerdir=l", single, single))
+	assert.Equal(t, "lowerdir=l,uidmapping=0:1000:1:1:100000:65536,squash_to_gid=1000", d.optsAppendMappings("lowerdir=l", ranges, single))
+
+	d = &Driver{mountProgramFeatures: mountProgramFeatures{uidMapping: true}}
+	assert.Equal(t, "lowerdir=l,uidmapping=0:1000:1,gidmapping=0:1000:1", d.optsAppendMappings("lowerdir=l", single, single))
+}
+
+func TestMountHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay-mount-helper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake mount program starts a "daemon" which ignores SIGTERM, so
+	// that it has to be killed, and exits.
+	program := filepath.Join(dir, "fake-fuse-overlayfs")
+	require.NoError(t, ioutil.WriteFile(program, []byte(`#!/bin/sh
+if test "$1" = --serve; then
+	trap "" TERM
+	while :; do sleep 0.1; done
+fi
+"$0" --serve "$@" < /dev/null > /dev/null 2>&1 &
+`), 0755))
+	target := filepath.Join(dir, "merged")
+	require.NoError(t, os.Mkdir(target, 0700))
+
+	defer func(timeout time.Duration) { mountHelperExitTimeout = timeout }(mountHelperExitTimeout)
+	mountHelperExitTimeout = time.Second
+
+	d := &Driver{home: dir, options: overlayOptions{mountProgram: program}}
+	require.NoError(t, d.startMountHelper(program, dir, target, "lowerdir=l"))
+	h, err := readMountHelper(dir)
+	require.NoError(t, err)
+	require.NotNil(t, h)
+	assert.Equal(t, target, h.Target)
+	assert.Equal(t, "lowerdir=l", h.Options)
+	require.NotZero(t, h.PID, "the daemon should have been found")
+	assert.True(t, h.alive())
+	assert.NoError(t, h.check())
+
+	d.stopMountHelper(dir)
+	assert.False(t, h.alive(), "the daemon should have been killed")
+	h, err = readMountHelper(dir)
+	require.NoError(t, err)
+	assert.Nil(t, h)
+}
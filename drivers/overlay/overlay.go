@@ -17,15 +17,20 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/drivers/overlayutils"
 	"github.com/containers/storage/drivers/quota"
+	"github.com/containers/storage/drivers/vfs"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/chrootarchive"
 	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/fsutils"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/locker"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
@@ -66,7 +71,12 @@ const (
 // changes to the layer. The "lower" file contains all the lower layer
 // mounts separated by ":" and ordered from uppermost to lowermost
 // layers. The overlay itself is mounted in the "merged" directory,
-// and the "work" dir is needed for overlay to work.
+// and the "work" dir is needed for overlay to work.  The kernel refuses
+// to mount an overlay whose "work" dir is on a different file system
+// than its upper ("diff") dir, since files are prepared in the "work"
+// dir and then renamed into the upper dir, and fuse-overlayfs works the
+// same way, so the "work" dir can't be moved to a tmpfs, and has to be
+// kept next to the "diff" directory.
 
 // The "link" file for each layer contains a unique string for the layer.
 // Under the "l" directory at the root there will be a symbolic link
@@ -81,9 +91,10 @@ const (
 // that mounts do not fail due to length.
 
 const (
-	linkDir   = "l"
-	lowerFile = "lower"
-	maxDepth  = 128
+	linkDir    = "l"
+	deletedDir = ".deleted"
+	lowerFile  = "lower"
+	maxDepth   = 128
 
 	// idLength represents the number of random characters
 	// which can be used to create the unique link identifier
@@ -96,14 +107,41 @@ const (
 )
 
 type overlayOptions struct {
-	imageStores       []string
-	layerStores       []additionalLayerStore
-	quota             quota.Quota
-	mountProgram      string
-	skipMountHome     bool
+	imageStores []string
+	// imageStoreMounts holds the mount program and mount options to use
+	// for layers whose lower layers are in particular additional image
+	// stores, keyed by the locations of those stores.
+	imageStoreMounts map[string]*imageStoreMount
+	// writableImageStore is a directory, separate from the driver's home
+	// directory, in which layers can be created if the caller asks.
+	writableImageStore string
+	layerStores        []additionalLayerStore
+	quota              quota.Quota
+	mountProgram       string
+	skipMountHome      bool
+	// mountPropagation is the propagation to set on the home directory
+	// and, unless the caller asks for something else, the mountpoints
+	// of layers.  If it isn't set, the home directory is made private.
+	mountPropagation  string
 	mountOptions      string
 	ignoreChownErrors bool
 	forceMask         *os.FileMode
+	flattenDepth      int
+	// networkFSFallback and networkFSMountProgram control what we do
+	// if the backing file system is a network file system and no
+	// mount_program is configured.
+	networkFSFallback     string
+	networkFSMountProgram string
+	// fallback lists what we try, in order, if native overlay can't be
+	// used for some other reason, and fallbackMountProgram is the mount
+	// program which we try.
+	fallback             []string
+	fallbackMountProgram string
+	// quotaFallback, quotaPollInterval, and quotaHook control how we
+	// enforce size limits if project quotas aren't available.
+	quotaFallback     string
+	quotaPollInterval time.Duration
+	quotaHook         string
 }
 
 // Driver contains information about the home directory and the list of active mounts that are created using this driver.
@@ -115,12 +153,28 @@ type Driver struct {
 	gidMaps          []idtools.IDMap
 	ctr              *graphdriver.RefCounter
 	quotaCtl         *quota.Control
+	quotaPolling     bool
 	options          overlayOptions
 	naiveDiff        graphdriver.DiffDriver
 	supportsDType    bool
 	supportsVolatile *bool
 	usingMetacopy    bool
+	// supportsReflinks is set if the file system which holds our home
+	// directory can share the contents of files using reflinks.
+	// Checking means writing to it, so it's only checked once, when
+	// it's first needed.
+	reflinksOnce     sync.Once
+	supportsReflinks bool
 	locker           *locker.Locker
+	// mountProgramFeatures records which optional parts of the
+	// mount_program contract the mount program implements.
+	mountProgramFeatures mountProgramFeatures
+	// degraded describes the fallback which we're using because of the
+	// backing file system, if we're using one.
+	degraded string
+	// tempDir, if set, is where staging directories are created, in
+	// place of the driver's home directory.
+	tempDir string
 }
 
 type additionalLayerStore struct {
@@ -142,9 +196,24 @@ var (
 	useNaiveDiffOnly bool
 )
 
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"overlay", "overlay2"},
+	Names: []string{
+		"additionalimagestore", "additionallayerstore", "fallback", "fallback_mount_program",
+		"flatten_depth", "force_mask", "ignore_chown_errors", "imagestore", "imagestore_mount_program",
+		"imagestore_mountopt", "inodes", "mount_program", "mount_propagation", "mountopt",
+		"network_fs_fallback", "network_fs_mount_program", "override_kernel_check", "quota_fallback",
+		"quota_hook", "quota_poll_interval", "size", "skip_mount_home", "writable_imagestore",
+	},
+}
+
 func init() {
 	graphdriver.Register("overlay", Init)
 	graphdriver.Register("overlay2", Init)
+	graphdriver.RegisterOptionNames("overlay", OptionNames)
+	graphdriver.RegisterFeatureCache("overlay", clearFeatureCache)
+	graphdriver.RegisterFeatureCache("overlay2", clearFeatureCache)
 }
 
 func hasMetacopyOption(opts []string) bool {
@@ -178,6 +247,12 @@ func getMountProgramFlagFile(path string) string {
 	return filepath.Join(path, ".has-mount-program")
 }
 
+// getFallbackFile returns the location of the file which records the fallback
+// which was chosen when native overlay couldn't be used.
+func getFallbackFile(path string) string {
+	return filepath.Join(path, ".fallback")
+}
+
 func checkSupportVolatile(home, runhome string) (bool, error) {
 	feature := fmt.Sprintf("volatile")
 	volatileCacheResult, _, err := cachedFeatureCheck(runhome, feature)
@@ -222,7 +297,7 @@ func checkAndRecordOverlaySupport(fsMagic graphdriver.FsMagic, home, runhome str
 		}
 		supportsDType = overlayCacheResult
 		if !supportsDType {
-			return false, errors.New(overlayCacheText)
+			return false, errors.Wrap(graphdriver.ErrNotSupported, overlayCacheText)
 		}
 	} else {
 		supportsDType, err = supportsOverlay(home, fsMagic, 0, 0)
@@ -275,9 +350,73 @@ func isNetworkFileSystem(fsMagic graphdriver.FsMagic) bool {
 	return false
 }
 
+// Values of the network_fs_fallback option.
+const (
+	// networkFSFallbackNone keeps the default behavior, which is to fail
+	// to initialize if overlay can't be used over the network file system.
+	networkFSFallbackNone = "none"
+	// networkFSFallbackMountProgram uses a mount program.
+	networkFSFallbackMountProgram = "mount_program"
+	// networkFSFallbackVFS uses the vfs driver in place of overlay.
+	networkFSFallbackVFS = "vfs"
+)
+
+// Values which can be listed in the fallback option.
+const (
+	// fallbackMountProgram uses a mount program.
+	fallbackMountProgram = "mount_program"
+	// fallbackVFS uses the vfs driver in place of overlay.
+	fallbackVFS = "vfs"
+)
+
+// Values of the quota_fallback option.
+const (
+	// quotaFallbackNone keeps the default behavior, which is to refuse to
+	// set size limits if project quotas aren't available.
+	quotaFallbackNone = "none"
+	// quotaFallbackPoll periodically measures the disk usage of mounted
+	// read/write layers, and runs quota_hook for those which are over
+	// their limits.
+	quotaFallbackPoll = "poll"
+)
+
+// defaultQuotaPollInterval is how often we measure the disk usage of layers
+// when the quota_fallback option is "poll" and quota_poll_interval isn't set.
+const defaultQuotaPollInterval = 10 * time.Second
+
+// quotaFile is the name of the file in a layer's directory which records the
+// limits which are enforced by polling.
+const quotaFile = "quota"
+
+// defaultMountProgram is the mount program which we look for if we're falling
+// back to using a mount program, but no program is set using the
+// network_fs_mount_program or fallback_mount_program options.
+const defaultMountProgram = "fuse-overlayfs"
+
+// initVFSFallback initializes the vfs driver, with its data next to home, for
+// use in place of the overlay driver, for the reason which why gives.
+// Additional image stores aren't passed along, since the layers in them are
+// laid out for overlay, which vfs can't read.
+func initVFSFallback(home string, opts *overlayOptions, options graphdriver.Options, why string) (graphdriver.Driver, error) {
+	reason := "using the vfs driver in place of overlay, since " + why
+	if len(opts.imageStores) > 0 {
+		reason += ", without the additional image stores " + strings.Join(opts.imageStores, ", ")
+	}
+	logrus.Warnf("overlay: %s", reason)
+	return vfs.Init(filepath.Join(filepath.Dir(home), "vfs"), graphdriver.Options{
+		Root:          options.Root,
+		RunRoot:       options.RunRoot,
+		DriverOptions: []string{fmt.Sprintf("vfs.ignore_chown_errors=%t", opts.ignoreChownErrors)},
+		UIDMaps:       options.UIDMaps,
+		GIDMaps:       options.GIDMaps,
+		Degraded:      reason,
+	})
+}
+
 // Init returns the a native diff driver for overlay filesystem.
 // If overlay filesystem is not supported on the host, a wrapped graphdriver.ErrNotSupported is returned as error.
 // If an overlay filesystem is not supported over an existing filesystem then a wrapped graphdriver.ErrIncompatibleFS is returned.
+// In either case, the fallbacks which the fallback option lists are tried first.
 func Init(home string, options graphdriver.Options) (graphdriver.Driver, error) {
 	opts, err := parseOptions(options.DriverOptions)
 	if err != nil {
@@ -292,6 +431,146 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		backingFs = fsName
 	}
 
+	// Overlay can't use most network file systems for its upper layers,
+	// so use the fallback which was configured, if there is one.
+	var degraded string
+	if opts.mountProgram == "" && isNetworkFileSystem(fsMagic) {
+		switch opts.networkFSFallback {
+		case networkFSFallbackMountProgram:
+			program := opts.networkFSMountProgram
+			if program == "" {
+				if program, err = exec.LookPath(defaultMountProgram); err != nil {
+					return nil, errors.Wrapf(err, "overlay: the backing file system is %s, and no network_fs_mount_program is set", backingFs)
+				}
+			}
+			opts.mountProgram = program
+			degraded = fmt.Sprintf("using mount_program %q, since the backing file system is %s", program, backingFs)
+			logrus.Warnf("overlay: %s", degraded)
+		case networkFSFallbackVFS:
+			return initVFSFallback(home, opts, options, "the backing file system is "+backingFs)
+		}
+	}
+
+	// Once a fallback has been chosen, the layers which we've created are
+	// stored in its format, so keep using it even if native overlay would
+	// now work, or if the fallback option has since been changed.
+	if opts.mountProgram == "" {
+		fallback, program, reason, err := readFallback(home)
+		if err != nil {
+			return nil, err
+		}
+		switch fallback {
+		case fallbackMountProgram:
+			degraded = fmt.Sprintf("using mount_program %q, since %s", program, reason)
+			opts.mountProgram = program
+			d, err := initOverlay(home, options, opts, fsMagic, degraded)
+			if err != nil {
+				return nil, errors.Wrapf(err, "overlay: mount_program %q was chosen as a fallback when the store was first used, but it can't be used now", program)
+			}
+			logrus.Warnf("overlay: %s", degraded)
+			return d, nil
+		case fallbackVFS:
+			return initVFSFallback(home, opts, options, reason)
+		}
+	}
+
+	d, err := initOverlay(home, options, opts, fsMagic, degraded)
+	if err != nil && opts.mountProgram == "" && len(opts.fallback) > 0 && isUnsupported(err) {
+		return initFallback(home, options, opts, fsMagic, err)
+	}
+	return d, err
+}
+
+// isUnsupported returns true if err indicates that overlay can't be used with
+// the kernel or the backing file system, so that a fallback can be tried.
+func isUnsupported(err error) bool {
+	return errors.Is(err, graphdriver.ErrNotSupported) || errors.Is(err, graphdriver.ErrPrerequisites) || errors.Is(err, graphdriver.ErrIncompatibleFS)
+}
+
+// readFallback returns the fallback which was recorded in home, along with the
+// mount program it uses and the reason it was chosen, or an empty fallback if
+// none was recorded.
+func readFallback(home string) (fallback, program, reason string, err error) {
+	data, err := ioutil.ReadFile(getFallbackFile(home))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", "", nil
+		}
+		return "", "", "", err
+	}
+	fields := strings.SplitN(string(data), "\n", 3)
+	if len(fields) != 3 {
+		return "", "", "", errors.Errorf("overlay: %s is not formatted correctly", getFallbackFile(home))
+	}
+	fallback, program, reason = fields[0], fields[1], strings.TrimSuffix(fields[2], "\n")
+	switch {
+	case fallback == fallbackVFS:
+	case fallback == fallbackMountProgram && program != "":
+	default:
+		return "", "", "", errors.Errorf("overlay: %s records an unknown fallback %q", getFallbackFile(home), fallback)
+	}
+	return fallback, program, reason, nil
+}
+
+// recordFallback records the fallback which was chosen in home, so that we
+// keep using it after the layers we create are stored in its format.
+func recordFallback(home, fallback, program, reason string) error {
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(getFallbackFile(home), []byte(fallback+"\n"+program+"\n"+reason+"\n"), 0600)
+}
+
+// initFallback tries the fallbacks which the fallback option lists, in order,
+// after native overlay failed to initialize with nativeErr.  The driver's
+// status describes the fallback which was chosen, and why the ones before it
+// couldn't be used.  The choice is recorded in home, so that Init keeps
+// using it.
+func initFallback(home string, options graphdriver.Options, opts *overlayOptions, fsMagic graphdriver.FsMagic, nativeErr error) (graphdriver.Driver, error) {
+	reasons := []string{fmt.Sprintf("native overlay can't be used: %v", nativeErr)}
+	for _, fallback := range opts.fallback {
+		switch fallback {
+		case fallbackMountProgram:
+			program := opts.fallbackMountProgram
+			if program == "" {
+				var err error
+				if program, err = exec.LookPath(defaultMountProgram); err != nil {
+					reasons = append(reasons, fmt.Sprintf("no mount_program is available: %v", err))
+					continue
+				}
+			}
+			degraded := fmt.Sprintf("using mount_program %q, since %s", program, strings.Join(reasons, "; "))
+			programOpts := *opts
+			programOpts.mountProgram = program
+			d, err := initOverlay(home, options, &programOpts, fsMagic, degraded)
+			if err == nil {
+				if err := recordFallback(home, fallbackMountProgram, program, strings.Join(reasons, "; ")); err != nil {
+					d.Cleanup()
+					return nil, err
+				}
+				logrus.Warnf("overlay: %s", degraded)
+				return d, nil
+			}
+			reasons = append(reasons, fmt.Sprintf("mount_program %q can't be used: %v", program, err))
+		case fallbackVFS:
+			d, err := initVFSFallback(home, opts, options, strings.Join(reasons, "; "))
+			if err != nil {
+				return nil, err
+			}
+			if err := recordFallback(home, fallbackVFS, "", strings.Join(reasons, "; ")); err != nil {
+				d.Cleanup()
+				return nil, err
+			}
+			return d, nil
+		}
+	}
+	return nil, errors.Wrapf(nativeErr, "overlay: no fallback could be used (%s)", strings.Join(reasons[1:], "; "))
+}
+
+// initOverlay initializes the overlay driver using opts, which may or may not
+// set a mount program.  If degraded is set, it describes the fallback which
+// opts represent.
+func initOverlay(home string, options graphdriver.Options, opts *overlayOptions, fsMagic graphdriver.FsMagic, degraded string) (graphdriver.Driver, error) {
 	if opts.mountProgram != "" {
 		if unshare.IsRootless() && isNetworkFileSystem(fsMagic) && opts.forceMask == nil {
 			m := os.FileMode(0700)
@@ -333,7 +612,18 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 	var usingMetacopy bool
 	var supportsDType bool
 	var supportsVolatile *bool
+	var programFeatures mountProgramFeatures
 	if opts.mountProgram != "" {
+		programFeatures, err = checkMountProgram(opts.mountProgram, runhome)
+		if err != nil {
+			return nil, err
+		}
+		if opts.forceMask != nil && !programFeatures.xattrPermissions {
+			return nil, errors.Errorf("'force_mask' requires a 'mount_program' which supports %q, and %q does not", mountProgramFeatureXattrPermissions, opts.mountProgram)
+		}
+		if len(options.UIDMaps) > 0 && !programFeatures.uidMapping {
+			logrus.Warnf("overlay: mount_program %q doesn't support %q, so layers will not be mounted with ID shifting", opts.mountProgram, mountProgramFeatureUIDMapping)
+		}
 		supportsDType = true
 		t := true
 		supportsVolatile = &t
@@ -370,15 +660,29 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 	}
 
 	if !opts.skipMountHome {
-		if err := mount.MakePrivate(home); err != nil {
+		propagation := opts.mountPropagation
+		if propagation == "" {
+			propagation = graphdriver.MountPropagationPrivate
+		}
+		if err := setMountPropagation(home, propagation); err != nil {
 			return nil, err
 		}
 	}
 
+	if err := opts.checkImageStoreMounts(runhome); err != nil {
+		return nil, err
+	}
+
 	fileSystemType := graphdriver.FsMagicOverlay
 	if opts.mountProgram != "" {
 		fileSystemType = graphdriver.FsMagicFUSE
 	}
+	checker := graphdriver.NewFsChecker(fileSystemType)
+	if opts.mountProgram == "" && opts.usesImageStoreMountPrograms() {
+		// Layers whose lower layers are in some image stores are
+		// mounted using mount programs.
+		checker = fsMagicsChecker{graphdriver.FsMagicOverlay, graphdriver.FsMagicFUSE}
+	}
 
 	d := &Driver{
 		name:             "overlay",
@@ -386,26 +690,44 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		runhome:          runhome,
 		uidMaps:          options.UIDMaps,
 		gidMaps:          options.GIDMaps,
-		ctr:              graphdriver.NewRefCounter(graphdriver.NewFsChecker(fileSystemType)),
+		ctr:              graphdriver.NewRefCounter(checker),
 		supportsDType:    supportsDType,
 		usingMetacopy:    usingMetacopy,
 		supportsVolatile: supportsVolatile,
 		locker:           locker.New(),
 		options:          *opts,
+
+		mountProgramFeatures: programFeatures,
+		degraded:             degraded,
+		tempDir:              options.TempDir,
+	}
+
+	if d.imageStoreHome() != "" {
+		if err := idtools.MkdirAllAs(d.imageStoreHome(), 0700, rootUID, rootGID); err != nil {
+			return nil, err
+		}
 	}
 
 	d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, graphdriver.NewNaiveLayerIDMapUpdater(d))
+	polling := opts.quotaFallback == quotaFallbackPoll
 	if backingFs == "xfs" {
 		// Try to enable project quota support over xfs.
 		if d.quotaCtl, err = quota.NewControl(home); err == nil {
 			projectQuotaSupported = true
-		} else if opts.quota.Size > 0 || opts.quota.Inodes > 0 {
+		} else if !polling && (opts.quota.Size > 0 || opts.quota.Inodes > 0) {
 			return nil, fmt.Errorf("Storage options overlay.size and overlay.inodes not supported. Filesystem does not support Project Quota: %v", err)
 		}
-	} else if opts.quota.Size > 0 || opts.quota.Inodes > 0 {
+	} else if !polling && (opts.quota.Size > 0 || opts.quota.Inodes > 0) {
 		// if xfs is not the backing fs then error out if the storage-opt overlay.size is used.
 		return nil, fmt.Errorf("Storage option overlay.size and overlay.inodes only supported for backingFS XFS. Found %v", backingFs)
 	}
+	if d.quotaCtl == nil && polling {
+		if d.options.quotaPollInterval == 0 {
+			d.options.quotaPollInterval = defaultQuotaPollInterval
+		}
+		d.quotaPolling = true
+		logrus.Debugf("overlay: enforcing layer size limits by checking disk usage every %s", d.options.quotaPollInterval)
+	}
 
 	logrus.Debugf("backingFs=%s, projectQuotaSupported=%v, useNativeDiff=%v, usingMetacopy=%v", backingFs, projectQuotaSupported, !d.useNaiveDiff(), d.usingMetacopy)
 
@@ -462,6 +784,24 @@ func parseOptions(options []string) (*overlayOptions, error) {
 				}
 				o.imageStores = append(o.imageStores, store)
 			}
+		case "imagestore_mount_program", "imagestore_mountopt":
+			logrus.Debugf("overlay: %s=%s", trimkey, val)
+			if val == "" {
+				continue
+			}
+			if err := o.parseImageStoreMount(trimkey, val); err != nil {
+				return nil, err
+			}
+		case "writable_imagestore":
+			logrus.Debugf("overlay: writable_imagestore=%s", val)
+			if val == "" {
+				continue
+			}
+			store := filepath.Clean(val)
+			if !filepath.IsAbs(store) {
+				return nil, fmt.Errorf("overlay: writable image store path %q is not absolute.  Can not be relative", store)
+			}
+			o.writableImageStore = store
 		case "additionallayerstore":
 			logrus.Debugf("overlay: additionallayerstore=%s", val)
 			// Additional read only layer stores to use for lower paths
@@ -510,6 +850,12 @@ func parseOptions(options []string) (*overlayOptions, error) {
 		case "skip_mount_home":
 			logrus.Debugf("overlay: skip_mount_home=%s", val)
 			o.skipMountHome, err = strconv.ParseBool(val)
+		case "mount_propagation":
+			logrus.Debugf("overlay: mount_propagation=%s", val)
+			if err := checkMountPropagation(val); err != nil {
+				return nil, err
+			}
+			o.mountPropagation = val
 		case "ignore_chown_errors":
 			logrus.Debugf("overlay: ignore_chown_errors=%s", val)
 			o.ignoreChownErrors, err = strconv.ParseBool(val)
@@ -532,6 +878,82 @@ func parseOptions(options []string) (*overlayOptions, error) {
 			}
 			m := os.FileMode(mask)
 			o.forceMask = &m
+		case "flatten_depth":
+			logrus.Debugf("overlay: flatten_depth=%s", val)
+			depth, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, err
+			}
+			if depth < 2 || depth > maxDepth {
+				return nil, fmt.Errorf("overlay: flatten_depth must be between 2 and %d", maxDepth)
+			}
+			o.flattenDepth = depth
+		case "network_fs_fallback":
+			logrus.Debugf("overlay: network_fs_fallback=%s", val)
+			switch val {
+			case "", networkFSFallbackNone, networkFSFallbackMountProgram, networkFSFallbackVFS:
+				o.networkFSFallback = val
+			default:
+				return nil, fmt.Errorf("overlay: network_fs_fallback must be %q, %q, or %q", networkFSFallbackNone, networkFSFallbackMountProgram, networkFSFallbackVFS)
+			}
+		case "network_fs_mount_program":
+			logrus.Debugf("overlay: network_fs_mount_program=%s", val)
+			if val != "" {
+				if _, err := os.Stat(val); err != nil {
+					return nil, errors.Wrapf(err, "overlay: can't stat program %q", val)
+				}
+			}
+			o.networkFSMountProgram = val
+		case "fallback":
+			logrus.Debugf("overlay: fallback=%s", val)
+			o.fallback = nil
+			if val == "" || val == "none" {
+				break
+			}
+			for _, fallback := range strings.Split(val, ",") {
+				fallback = strings.TrimSpace(fallback)
+				switch {
+				case fallback != fallbackMountProgram && fallback != fallbackVFS:
+					return nil, fmt.Errorf("overlay: fallback must be a comma-separated list of %q and %q", fallbackMountProgram, fallbackVFS)
+				case len(o.fallback) > 0 && o.fallback[len(o.fallback)-1] == fallbackVFS:
+					return nil, fmt.Errorf("overlay: nothing can be tried after %q in fallback", fallbackVFS)
+				}
+				o.fallback = append(o.fallback, fallback)
+			}
+		case "fallback_mount_program":
+			logrus.Debugf("overlay: fallback_mount_program=%s", val)
+			if val != "" {
+				if _, err := os.Stat(val); err != nil {
+					return nil, errors.Wrapf(err, "overlay: can't stat program %q", val)
+				}
+			}
+			o.fallbackMountProgram = val
+		case "quota_fallback":
+			logrus.Debugf("overlay: quota_fallback=%s", val)
+			switch val {
+			case "", quotaFallbackNone, quotaFallbackPoll:
+				o.quotaFallback = val
+			default:
+				return nil, fmt.Errorf("overlay: quota_fallback must be %q or %q", quotaFallbackNone, quotaFallbackPoll)
+			}
+		case "quota_poll_interval":
+			logrus.Debugf("overlay: quota_poll_interval=%s", val)
+			interval, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, err
+			}
+			if interval <= 0 {
+				return nil, fmt.Errorf("overlay: quota_poll_interval must be positive")
+			}
+			o.quotaPollInterval = interval
+		case "quota_hook":
+			logrus.Debugf("overlay: quota_hook=%s", val)
+			if val != "" {
+				if _, err := os.Stat(val); err != nil {
+					return nil, errors.Wrapf(err, "overlay: can't stat program %q", val)
+				}
+			}
+			o.quotaHook = val
 		default:
 			return nil, fmt.Errorf("overlay: Unknown option %s", key)
 		}
@@ -539,6 +961,13 @@ func parseOptions(options []string) (*overlayOptions, error) {
 	return o, nil
 }
 
+// ValidateOptions checks if the options are ones which the driver accepts,
+// without initializing it.
+func ValidateOptions(options []string) error {
+	_, err := parseOptions(options)
+	return err
+}
+
 func cachedFeatureSet(feature string, set bool) string {
 	if set {
 		return fmt.Sprintf("%s-true", feature)
@@ -569,6 +998,24 @@ func cachedFeatureRecord(runhome, feature string, supported bool, text string) (
 	return err
 }
 
+// clearFeatureCache removes the records of which features we found to be
+// supported, so that they'll be checked again.
+func clearFeatureCache(home string, options graphdriver.Options) error {
+	runhome := filepath.Join(options.RunRoot, filepath.Base(home))
+	for _, pattern := range []string{cachedFeatureSet("*", true), cachedFeatureSet("*", false)} {
+		records, err := filepath.Glob(filepath.Join(runhome, pattern))
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := os.Remove(record); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func SupportsNativeOverlay(graphroot, rundir string) (bool, error) {
 	if os.Geteuid() != 0 || graphroot == "" || rundir == "" {
 		return false, nil
@@ -743,12 +1190,61 @@ func (d *Driver) String() string {
 // Status returns current driver information in a two dimensional string array.
 // Output contains "Backing Filesystem" used in this implementation.
 func (d *Driver) Status() [][2]string {
-	return [][2]string{
+	status := [][2]string{
 		{"Backing Filesystem", backingFs},
 		{"Supports d_type", strconv.FormatBool(d.supportsDType)},
 		{"Native Overlay Diff", strconv.FormatBool(!d.useNaiveDiff())},
 		{"Using metacopy", strconv.FormatBool(d.usingMetacopy)},
 	}
+	if d.degraded != "" {
+		status = append(status, [2]string{"Degraded Mode", d.degraded})
+	}
+	if d.quotaPolling {
+		status = append(status, [2]string{"Quota Enforcement", "polling"})
+	}
+	for _, store := range d.options.imageStores {
+		if m := d.options.imageStoreMounts[store]; m != nil && m.mountProgram != "" {
+			status = append(status, [2]string{"Image Store Mount Program", fmt.Sprintf("%s: %s", store, m.mountProgram)})
+		}
+	}
+	if links, err := d.Links(); err == nil {
+		dangling := 0
+		for _, id := range links {
+			if id == "" {
+				dangling++
+			}
+		}
+		status = append(status, [2]string{"Layer Links", strconv.Itoa(len(links))})
+		status = append(status, [2]string{"Dangling Layer Links", strconv.Itoa(dangling)})
+	}
+	return status
+}
+
+// StructuredStatus returns structured diagnostic information about the driver.
+func (d *Driver) StructuredStatus() *graphdriver.DriverStatus {
+	status := &graphdriver.DriverStatus{
+		Name:              d.String(),
+		BackingFilesystem: backingFs,
+		Features: map[string]bool{
+			"d_type": d.supportsDType,
+		},
+		SupportsShifting: d.SupportsShifting(),
+		UsingMetacopy:    d.usingMetacopy,
+		NativeDiff:       !d.useNaiveDiff(),
+		QuotaSupported:   projectQuotaSupported,
+		MountProgram:     d.options.mountProgram,
+		Degraded:         d.degraded,
+		Details:          d.Status(),
+	}
+	if d.supportsVolatile != nil {
+		status.Features["volatile"] = *d.supportsVolatile
+	}
+	if d.options.mountProgram != "" {
+		status.Features[mountProgramFeatureUIDMapping] = d.mountProgramFeatures.uidMapping
+		status.Features[mountProgramFeatureSquash] = d.mountProgramFeatures.squash
+		status.Features[mountProgramFeatureXattrPermissions] = d.mountProgramFeatures.xattrPermissions
+	}
+	return status
 }
 
 // Metadata returns meta data about the overlay driver such as
@@ -778,9 +1274,19 @@ func (d *Driver) Metadata(id string) (map[string]string, error) {
 
 // Cleanup any state created by overlay which should be cleaned when daemon
 // is being shutdown. For now, we just have to unmount the bind mounted
-// we had created.
+// we had created, and remove any links to layers which no longer exist.
 func (d *Driver) Cleanup() error {
 	_ = os.RemoveAll(d.getStagingDir())
+	if pruned, err := d.pruneLinks(); err != nil {
+		logrus.Debugf("Failed to prune dangling links: %v", err)
+	} else if pruned > 0 {
+		logrus.Debugf("Pruned %d dangling links from %q", pruned, filepath.Join(d.home, linkDir))
+	}
+	if pruned, err := d.pruneFlattened(); err != nil {
+		logrus.Debugf("Failed to prune unused flattened layers: %v", err)
+	} else if pruned > 0 {
+		logrus.Debugf("Pruned %d unused flattened layers from %q", pruned, d.home)
+	}
 	return mount.Unmount(d.home)
 }
 
@@ -833,7 +1339,7 @@ func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idt
 // CreateReadWrite creates a layer that is writable for use as a container
 // file system.
 func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
-	if opts != nil && len(opts.StorageOpt) != 0 && !projectQuotaSupported {
+	if opts != nil && len(opts.StorageOpt) != 0 && !projectQuotaSupported && !d.quotaPolling {
 		return fmt.Errorf("--storage-opt is supported only for overlay over xfs with 'pquota' mount option")
 	}
 
@@ -878,6 +1384,15 @@ func (d *Driver) Create(id, parent string, opts *graphdriver.CreateOpts) (retErr
 
 func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disableQuota bool) (retErr error) {
 	dir := d.dir(id)
+	if opts != nil && opts.ImageStore != "" {
+		if !disableQuota {
+			return fmt.Errorf("overlay: only read-only layers can be placed in an image store")
+		}
+		if filepath.Clean(opts.ImageStore) != d.options.writableImageStore {
+			return fmt.Errorf("overlay: %q is not a writable image store", opts.ImageStore)
+		}
+		dir = path.Join(d.imageStoreHome(), id)
+	}
 
 	uidMaps := d.uidMaps
 	gidMaps := d.gidMaps
@@ -926,7 +1441,14 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disable
 		}
 	}()
 
-	if d.quotaCtl != nil && !disableQuota {
+	encrypted := opts != nil && len(opts.EncryptionKey) > 0
+	if encrypted {
+		if err := fscrypt.EncryptDirectory(dir, opts.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	if (d.quotaCtl != nil || d.quotaPolling) && !disableQuota {
 		quota := quota.Quota{}
 		if opts != nil && len(opts.StorageOpt) > 0 {
 			driver := &Driver{}
@@ -940,10 +1462,22 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disable
 				quota.Inodes = driver.options.quota.Inodes
 			}
 		}
-		// Set container disk quota limit
-		// If it is set to 0, we will track the disk usage, but not enforce a limit
-		if err := d.quotaCtl.SetQuota(dir, quota); err != nil {
-			return err
+		if d.quotaCtl != nil {
+			// Set container disk quota limit
+			// If it is set to 0, we will track the disk usage, but not enforce a limit
+			if err := d.quotaCtl.SetQuota(dir, quota); err != nil {
+				return err
+			}
+		} else if quota.Size > 0 || quota.Inodes > 0 {
+			// Record the limits, so that we can start checking
+			// them whenever the layer is mounted.
+			data, err := json.Marshal(&quota)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(path.Join(dir, quotaFile), data, 0600); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -964,7 +1498,7 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disable
 	}
 
 	lid := generateID(idLength)
-	if err := os.Symlink(path.Join("..", id, "diff"), path.Join(d.home, linkDir, lid)); err != nil {
+	if err := os.Symlink(d.linkTarget(id, dir), path.Join(d.home, linkDir, lid)); err != nil {
 		return err
 	}
 
@@ -989,6 +1523,13 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disable
 	if err != nil {
 		return err
 	}
+	// Flattened layers would hold unencrypted copies of the contents of
+	// the layers which they replaced.
+	if !encrypted {
+		if lower, err = d.flattenLowers(lower); err != nil {
+			return err
+		}
+	}
 	if lower != "" {
 		if err := ioutil.WriteFile(path.Join(dir, lowerFile), []byte(lower), 0666); err != nil {
 			return err
@@ -998,6 +1539,13 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, disable
 	return nil
 }
 
+// AddEncryptionKey adds a key to the file system which holds the layer's
+// contents.
+func (d *Driver) AddEncryptionKey(id string, key []byte) error {
+	_, err := fscrypt.AddKey(path.Dir(d.dir(id)), key)
+	return err
+}
+
 // Parse overlay storage options
 func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) error {
 	// Read size to set the disk project quota per container
@@ -1024,6 +1572,26 @@ func (d *Driver) parseStorageOpt(storageOpt map[string]string, driver *Driver) e
 	return nil
 }
 
+// watchQuota starts checking the disk usage of a layer, if we're enforcing
+// size limits by polling and limits were set for it when it was created.  The
+// layer is checked by a separate process, which keeps checking it for as long
+// as it stays mounted, even after this process exits.
+func (d *Driver) watchQuota(id string) {
+	if !d.quotaPolling {
+		return
+	}
+	dir := d.dir(id)
+	if _, err := os.Stat(path.Join(dir, quotaFile)); err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("overlay: error checking for size limits of layer %s: %v", id, err)
+		}
+		return
+	}
+	if err := startQuotaWatcher(dir, d.options.quotaPollInterval, d.options.quotaHook); err != nil {
+		logrus.Warnf("overlay: error starting to check the disk usage of layer %s: %v", id, err)
+	}
+}
+
 func (d *Driver) getLower(parent string) (string, error) {
 	parentDir := d.dir(parent)
 
@@ -1065,6 +1633,12 @@ func (d *Driver) dir(id string) string {
 func (d *Driver) dir2(id string) (string, bool) {
 	newpath := path.Join(d.home, id)
 	if _, err := os.Stat(newpath); err != nil {
+		if imageStoreHome := d.imageStoreHome(); imageStoreHome != "" {
+			l := path.Join(imageStoreHome, id)
+			if _, err := os.Stat(l); err == nil {
+				return l, false
+			}
+		}
 		for _, p := range d.AdditionalImageStores() {
 			l := path.Join(p, d.name, id)
 			_, err = os.Stat(l)
@@ -1109,6 +1683,12 @@ func (d *Driver) getLowerDirs(id string) ([]string, error) {
 }
 
 func (d *Driver) optsAppendMappings(opts string, uidMaps, gidMaps []idtools.IDMap) string {
+	return d.optsAppendMappingsFor(d.mountProgramFeatures, opts, uidMaps, gidMaps)
+}
+
+// optsAppendMappingsFor adds the ID mappings to opts in the form that a mount
+// program with the specified features expects.
+func (d *Driver) optsAppendMappingsFor(features mountProgramFeatures, opts string, uidMaps, gidMaps []idtools.IDMap) string {
 	if uidMaps == nil {
 		uidMaps = d.uidMaps
 	}
@@ -1117,23 +1697,26 @@ func (d *Driver) optsAppendMappings(opts string, uidMaps, gidMaps []idtools.IDMa
 	}
 	if uidMaps != nil {
 		var uids, gids bytes.Buffer
-		if len(uidMaps) == 1 && uidMaps[0].Size == 1 {
+		// Squash everything to a single ID if that's all that's mapped,
+		// and the mount program knows how to do that.
+		squash := features.squash
+		if squash && len(uidMaps) == 1 && uidMaps[0].Size == 1 {
 			uids.WriteString(fmt.Sprintf("squash_to_uid=%d", uidMaps[0].HostID))
 		} else {
 			uids.WriteString("uidmapping=")
-			for _, i := range uidMaps {
-				if uids.Len() > 0 {
+			for n, i := range uidMaps {
+				if n > 0 {
 					uids.WriteString(":")
 				}
 				uids.WriteString(fmt.Sprintf("%d:%d:%d", i.ContainerID, i.HostID, i.Size))
 			}
 		}
-		if len(gidMaps) == 1 && gidMaps[0].Size == 1 {
+		if squash && len(gidMaps) == 1 && gidMaps[0].Size == 1 {
 			gids.WriteString(fmt.Sprintf("squash_to_gid=%d", gidMaps[0].HostID))
 		} else {
 			gids.WriteString("gidmapping=")
-			for _, i := range gidMaps {
-				if gids.Len() > 0 {
+			for n, i := range gidMaps {
+				if n > 0 {
 					gids.WriteString(":")
 				}
 				gids.WriteString(fmt.Sprintf("%d:%d:%d", i.ContainerID, i.HostID, i.Size))
@@ -1149,7 +1732,54 @@ func (d *Driver) Remove(id string) error {
 	d.locker.Lock(id)
 	defer d.locker.Unlock(id)
 
+	dir, err := d.prepareRemove(id)
+	if err != nil {
+		return err
+	}
+	if err := system.EnsureRemoveAll(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeferredRemove removes the layer's link and moves its directory into a
+// directory of deleted layers, and returns its new location.
+func (d *Driver) DeferredRemove(id string) (string, error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	dir, err := d.prepareRemove(id)
+	if err != nil {
+		return "", err
+	}
+	moved, err := graphdriver.DeferRemoveDir(dir, path.Join(path.Dir(dir), deletedDir))
+	if err != nil {
+		logrus.Debugf("Removing layer %s now: %v", id, err)
+		if err := system.EnsureRemoveAll(dir); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		return "", nil
+	}
+	return moved, nil
+}
+
+// DeferredRemovalDirs returns the directories of deleted layers into which
+// DeferredRemove() moves layers' directories.
+func (d *Driver) DeferredRemovalDirs() []string {
+	dirs := []string{path.Join(d.home, deletedDir)}
+	if imageStoreHome := d.imageStoreHome(); imageStoreHome != "" {
+		dirs = append(dirs, path.Join(imageStoreHome, deletedDir))
+	}
+	return dirs
+}
+
+// prepareRemove removes the layer's link and stops tracking it, and returns
+// the location of its directory.  The layer should be locked.
+func (d *Driver) prepareRemove(id string) (string, error) {
 	dir := d.dir(id)
+	if err := checkNotFrozen(id, dir); err != nil {
+		return "", err
+	}
 	lid, err := ioutil.ReadFile(path.Join(dir, "link"))
 	if err == nil {
 		if err := os.RemoveAll(path.Join(d.home, linkDir, string(lid))); err != nil {
@@ -1158,11 +1788,7 @@ func (d *Driver) Remove(id string) error {
 	}
 
 	d.releaseAdditionalLayerByID(id)
-
-	if err := system.EnsureRemoveAll(dir); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	return nil
+	return dir, nil
 }
 
 // recreateSymlinks goes through the driver's home directory and checks if the diff directory
@@ -1172,11 +1798,19 @@ func (d *Driver) recreateSymlinks() error {
 	// We have at most 3 corrective actions per layer, so 10 iterations is plenty.
 	const maxIterations = 10
 
-	// List all the directories under the home directory
+	// List all the directories under the home directory, and the
+	// writable image store, if we have one
 	dirs, err := ioutil.ReadDir(d.home)
 	if err != nil {
 		return fmt.Errorf("reading driver home directory %q: %v", d.home, err)
 	}
+	if imageStoreHome := d.imageStoreHome(); imageStoreHome != "" {
+		imageStoreDirs, err := ioutil.ReadDir(imageStoreHome)
+		if err != nil {
+			return fmt.Errorf("reading image store directory %q: %v", imageStoreHome, err)
+		}
+		dirs = append(dirs, imageStoreDirs...)
+	}
 	linksDir := filepath.Join(d.home, "l")
 	// This makes the link directory if it doesn't exist
 	rootUID, rootGID, err := idtools.GetRootUIDGID(d.uidMaps, d.gidMaps)
@@ -1196,8 +1830,9 @@ func (d *Driver) recreateSymlinks() error {
 		// Check that for each layer, there's a link in "l" with the name in
 		// the layer's "link" file that points to the layer's "diff" directory.
 		for _, dir := range dirs {
-			// Skip over the linkDir and anything that is not a directory
-			if dir.Name() == linkDir || !dir.Mode().IsDir() {
+			// Skip over the linkDir, flattened layers which are still being
+			// assembled, and anything that is not a directory
+			if dir.Name() == linkDir || dir.Name() == deletedDir || strings.HasPrefix(dir.Name(), flattenStagingPrefix) || !dir.Mode().IsDir() {
 				continue
 			}
 			// Read the "link" file under each layer to get the name of the symlink
@@ -1211,7 +1846,7 @@ func (d *Driver) recreateSymlinks() error {
 			// name we got from the "link" file
 			_, err = os.Lstat(linkPath)
 			if err != nil && os.IsNotExist(err) {
-				if err := os.Symlink(path.Join("..", dir.Name(), "diff"), linkPath); err != nil {
+				if err := os.Symlink(d.linkTarget(dir.Name(), d.dir(dir.Name())), linkPath); err != nil {
 					errs = multierror.Append(errs, err)
 					continue
 				}
@@ -1230,14 +1865,15 @@ func (d *Driver) recreateSymlinks() error {
 		}
 		// Go through all of the symlinks in the "l" directory
 		for _, link := range links {
-			// Read the symlink's target, which should be "../$layer/diff"
+			// Read the symlink's target, which should be "../$layer/diff",
+			// or the layer's diff directory in the writable image store
 			target, err := os.Readlink(filepath.Join(linksDir, link.Name()))
 			if err != nil {
 				errs = multierror.Append(errs, err)
 				continue
 			}
-			targetComponents := strings.Split(target, string(os.PathSeparator))
-			if len(targetComponents) != 3 || targetComponents[0] != ".." || targetComponents[2] != "diff" {
+			targetID, ok := d.linkTargetID(target)
+			if !ok {
 				errs = multierror.Append(errs, errors.Errorf("link target of %q looks weird: %q", link, target))
 				// force the link to be recreated on the next pass
 				if err := os.Remove(filepath.Join(linksDir, link.Name())); err != nil {
@@ -1251,7 +1887,6 @@ func (d *Driver) recreateSymlinks() error {
 			}
 			// Reconstruct the name of the target's link file and check that
 			// it has the basename of our symlink in it.
-			targetID := targetComponents[1]
 			linkFile := filepath.Join(d.dir(targetID), "link")
 			data, err := ioutil.ReadFile(linkFile)
 			if err != nil || string(data) != link.Name() {
@@ -1276,9 +1911,143 @@ func (d *Driver) recreateSymlinks() error {
 	return nil
 }
 
+// Links returns a map from the names of the symbolic links in the driver's
+// link directory to the IDs of the layers whose diff directories they point
+// to.  Links which don't point to an existing layer are included, with an
+// empty ID.
+func (d *Driver) Links() (map[string]string, error) {
+	linksDir := filepath.Join(d.home, linkDir)
+	links, err := ioutil.ReadDir(linksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	result := make(map[string]string, len(links))
+	for _, link := range links {
+		result[link.Name()] = ""
+		target, err := os.Readlink(filepath.Join(linksDir, link.Name()))
+		if err != nil {
+			continue
+		}
+		targetID, ok := d.linkTargetID(target)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(linksDir, link.Name())); err == nil {
+			result[link.Name()] = targetID
+		}
+	}
+	return result, nil
+}
+
+// ListLayers returns the IDs of the layers which have directories in the
+// driver's home directory or its writable image store.  Flattened layers,
+// which are managed by the driver itself, aren't included.
+func (d *Driver) ListLayers() ([]string, error) {
+	homes := []string{d.home}
+	if imageStoreHome := d.imageStoreHome(); imageStoreHome != "" {
+		homes = append(homes, imageStoreHome)
+	}
+	var layers []string
+	for _, home := range homes {
+		entries, err := ioutil.ReadDir(home)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() || name == linkDir || strings.HasPrefix(name, flattenedPrefix) || strings.HasPrefix(name, ".") {
+				continue
+			}
+			// Every layer directory has a "link" file, which other
+			// directories that we create here don't.
+			if _, err := os.Lstat(path.Join(home, name, "link")); err != nil {
+				continue
+			}
+			layers = append(layers, name)
+		}
+	}
+	return layers, nil
+}
+
+// pruneLinks removes symbolic links in the driver's link directory which no
+// longer point to a layer's diff directory, and returns the number of links
+// that it removed.
+func (d *Driver) pruneLinks() (int, error) {
+	linksDir := filepath.Join(d.home, linkDir)
+	links, err := ioutil.ReadDir(linksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var errs *multierror.Error
+	pruned := 0
+	for _, link := range links {
+		linkPath := filepath.Join(linksDir, link.Name())
+		if _, err := os.Stat(linkPath); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Remove(linkPath); err != nil && !os.IsNotExist(err) {
+			errs = multierror.Append(errs, errors.Wrapf(err, "removing dangling link %q", linkPath))
+			continue
+		}
+		pruned++
+	}
+	return pruned, errs.ErrorOrNil()
+}
+
+// RebuildLinks removes symbolic links in the driver's link directory which no
+// longer point to a layer, and then recreates or corrects the links for every
+// layer that we have.
+func (d *Driver) RebuildLinks() error {
+	if _, err := d.pruneLinks(); err != nil {
+		return err
+	}
+	return d.recreateSymlinks()
+}
+
 // Get creates and mounts the required file system for the given id and returns the mount path.
 func (d *Driver) Get(id string, options graphdriver.MountOpts) (_ string, retErr error) {
-	return d.get(id, false, options)
+	mergedDir, err := d.get(id, false, options)
+	if err == nil {
+		d.watchQuota(id)
+	}
+	return mergedDir, err
+}
+
+// SupportsAdditionalLowers returns true, since the driver can include
+// additional lower directories in a layer's mount.
+func (d *Driver) SupportsAdditionalLowers() bool {
+	return true
+}
+
+// checkAdditionalLowers makes sure that the additional lower directories
+// requested for mounting the layer in dir can be passed to the kernel or the
+// mount program, and that none of them are part of the layer itself.
+func checkAdditionalLowers(dir string, lowers []string) error {
+	for _, lower := range lowers {
+		if !filepath.IsAbs(lower) || filepath.Clean(lower) != lower {
+			return fmt.Errorf("overlay: additional lower directory %q is not a clean, absolute path", lower)
+		}
+		if strings.ContainsAny(lower, ":,") {
+			return fmt.Errorf("overlay: additional lower directory %q contains characters which can't be used in mount options", lower)
+		}
+		if lower == dir || strings.HasPrefix(lower, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("overlay: additional lower directory %q is part of the layer being mounted", lower)
+		}
+		st, err := os.Stat(lower)
+		if err != nil {
+			return err
+		}
+		if !st.IsDir() {
+			return fmt.Errorf("overlay: additional lower directory %q is not a directory", lower)
+		}
+	}
+	return nil
 }
 
 func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountOpts) (_ string, retErr error) {
@@ -1288,6 +2057,9 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 	if _, err := os.Stat(dir); err != nil {
 		return "", err
 	}
+	if err := checkNotFrozen(id, dir); err != nil {
+		return "", err
+	}
 	readWrite := !inAdditionalStore
 
 	if !d.SupportsShifting() || options.DisableShifting {
@@ -1330,14 +2102,32 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		return "", err
 	}
 	splitLowers := strings.Split(string(lowers), ":")
-	if len(splitLowers) > maxDepth {
+	if len(splitLowers)+len(options.AdditionalLowers) > maxDepth {
 		return "", errors.New("max depth exceeded")
 	}
+	if err := checkAdditionalLowers(dir, options.AdditionalLowers); err != nil {
+		return "", err
+	}
+	propagation := options.Propagation
+	if propagation == "" {
+		propagation = d.options.mountPropagation
+	}
+	if propagation != "" {
+		if err := checkMountPropagation(propagation); err != nil {
+			return "", err
+		}
+	}
 
 	// absLowers is the list of lowers as absolute paths, which works well with additional stores.
 	absLowers := []string{}
 	// relLowers is the list of lowers as paths relative to the driver's home directory.
 	relLowers := []string{}
+	// lowerStores lists the additional image stores which the layer and
+	// its lowers are in.
+	lowerStores := []string{}
+	if inAdditionalStore {
+		lowerStores = append(lowerStores, path.Dir(path.Dir(dir)))
+	}
 
 	// Check if $link/../diff{1-*} exist.  If they do, add them, in order, as the front of the lowers
 	// lists that we're building.  "diff" itself is the upper, so it won't be in the lists.
@@ -1377,6 +2167,11 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		}
 	}
 
+	// Directories that the caller supplied go below the layer's own
+	// contents, and above those of its parents.
+	absLowers = append(absLowers, options.AdditionalLowers...)
+	relLowers = append(relLowers, options.AdditionalLowers...)
+
 	// For each lower, resolve its path, and append it and any additional diffN
 	// directories to the lowers list.
 	for _, l := range splitLowers {
@@ -1393,6 +2188,7 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 						perms = os.FileMode(st2.Mode())
 						permsKnown = true
 					}
+					lowerStores = append(lowerStores, p)
 					break
 				}
 				lower = ""
@@ -1432,6 +2228,36 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		absLowers = append(absLowers, path.Join(dir, "empty"))
 		relLowers = append(relLowers, path.Join(id, "empty"))
 	}
+
+	// Lowers in some additional image stores need to be mounted using
+	// their own mount program, or with additional options.
+	mountProgram := d.options.mountProgram
+	programFeatures := d.mountProgramFeatures
+	storeMount, err := d.imageStoreMountFor(lowerStores)
+	if err != nil {
+		return "", err
+	}
+	if storeMount != nil {
+		if storeMount.mountProgram != "" {
+			mountProgram = storeMount.mountProgram
+			programFeatures = storeMount.features
+			if !disableShifting && !programFeatures.uidMapping {
+				return "", errors.Errorf("mount program %q, which layer %q needs to be mounted using, doesn't support %q", mountProgram, id, mountProgramFeatureUIDMapping)
+			}
+		}
+		if storeMount.mountOptions != "" {
+			storeOptsList := strings.Split(storeMount.mountOptions, ",")
+			if !d.usingMetacopy {
+				storeOptsList = stripOption(storeOptsList, "metacopy=on")
+			}
+			for _, o := range storeOptsList {
+				if o == "ro" {
+					readWrite = false
+				}
+			}
+			optsList = append(optsList, storeOptsList...)
+		}
+	}
 	// user namespace requires this to move a directory from lower to upper.
 	rootUID, rootGID, err := idtools.GetRootUIDGID(d.uidMaps, d.gidMaps)
 	if err != nil {
@@ -1462,7 +2288,7 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 
 	workdir := path.Join(dir, "work")
 
-	if d.options.mountProgram == "" && unshare.IsRootless() {
+	if mountProgram == "" && unshare.IsRootless() {
 		optsList = append(optsList, "userxattr")
 	}
 
@@ -1493,10 +2319,10 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 
 	pageSize := unix.Getpagesize()
 
-	if d.options.mountProgram != "" {
+	if mountProgram != "" {
 		mountFunc = func(source string, target string, mType string, flags uintptr, label string) error {
 			if !disableShifting {
-				label = d.optsAppendMappings(label, options.UidMaps, options.GidMaps)
+				label = d.optsAppendMappingsFor(programFeatures, label, options.UidMaps, options.GidMaps)
 			}
 
 			// if forceMask is in place, tell fuse-overlayfs to write the permissions mask to an unprivileged xattr as well.
@@ -1504,19 +2330,23 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 				label = label + ",xattr_permissions=2"
 			}
 
-			mountProgram := exec.Command(d.options.mountProgram, "-o", label, target)
-			mountProgram.Dir = d.home
-			var b bytes.Buffer
-			mountProgram.Stderr = &b
-			err := mountProgram.Run()
-			if err != nil {
-				output := b.String()
-				if output == "" {
-					output = "<stderr empty>"
+			// The mount program only sees the data, so pass along
+			// the flags that ParseOptions separated out of it.
+			for _, f := range []struct {
+				flag   uintptr
+				option string
+			}{
+				{unix.MS_NOSUID, "nosuid"},
+				{unix.MS_NODEV, "nodev"},
+				{unix.MS_NOEXEC, "noexec"},
+			} {
+				if flags&f.flag != 0 {
+					label = label + "," + f.option
 				}
-				return errors.Wrapf(err, "using mount program %s: %s", d.options.mountProgram, output)
 			}
-			return nil
+
+			d.cleanupMountHelper(dir)
+			return d.startMountHelper(mountProgram, dir, target, label)
 		}
 	} else if len(mountData) >= pageSize {
 		// Use relative paths and mountFrom when the mount data has exceeded
@@ -1554,13 +2384,59 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 
 	flags, data := mount.ParseOptions(mountData)
 	logrus.Debugf("overlay: mount_data=%s", mountData)
-	if err := mountFunc("overlay", mountTarget, "overlay", uintptr(flags), data); err != nil {
+	err = mountFunc("overlay", mountTarget, "overlay", uintptr(flags), data)
+	if err != nil && readWrite && mountProgram == "" && isStaleIndexError(err) {
+		// The work directory may have been populated while the
+		// kernel's "index" or "nfs_export" features were set
+		// differently.  Clear it out, if we can, and try again.
+		logrus.Debugf("overlay: mounting %s failed, possibly because of a stale index: %v", mountTarget, err)
+		if clearErr := d.clearStaleIndex(id, dir); clearErr != nil {
+			return "", fmt.Errorf("creating overlay mount to %s failed, possibly because layer %s's work directory was created with different overlay \"index\" or \"nfs_export\" settings, and it could not be cleared: %v: %v", mountTarget, id, clearErr, err)
+		}
+		err = mountFunc("overlay", mountTarget, "overlay", uintptr(flags), data)
+	}
+	if err != nil {
 		return "", fmt.Errorf("creating overlay mount to %s, mount_data=%q: %v", mountTarget, mountData, err)
 	}
 
+	// New mounts inherit the propagation of the home directory, so only
+	// change it if we've been asked to.
+	if propagation != "" {
+		if err := setMountPropagation(mergedDir, propagation); err != nil {
+			// The deferred cleanup unmounts it.
+			return "", errors.Wrapf(err, "setting mount propagation of %s to %q", mergedDir, propagation)
+		}
+	}
+
 	return mergedDir, nil
 }
 
+// checkMountPropagation returns an error if propagation isn't one of the
+// mount propagation types which we know how to set.
+func checkMountPropagation(propagation string) error {
+	switch propagation {
+	case graphdriver.MountPropagationPrivate, graphdriver.MountPropagationRShared, graphdriver.MountPropagationRSlave:
+		return nil
+	}
+	return fmt.Errorf("overlay: mount propagation must be %q, %q, or %q, not %q", graphdriver.MountPropagationPrivate, graphdriver.MountPropagationRShared, graphdriver.MountPropagationRSlave, propagation)
+}
+
+// setMountPropagation sets the propagation of the mountpoint at target, bind
+// mounting it on itself first if it isn't already a mountpoint.  If setting
+// it fails, that bind mount is removed, but an existing mount is left for the
+// caller to clean up.
+func setMountPropagation(target, propagation string) error {
+	switch propagation {
+	case graphdriver.MountPropagationPrivate:
+		return mount.MakePrivate(target)
+	case graphdriver.MountPropagationRShared:
+		return mount.MakeRShared(target)
+	case graphdriver.MountPropagationRSlave:
+		return mount.MakeRSlave(target)
+	}
+	return checkMountPropagation(propagation)
+}
+
 // Put unmounts the mount path created for the give id.
 func (d *Driver) Put(id string) error {
 	d.locker.Lock(id)
@@ -1578,8 +2454,9 @@ func (d *Driver) Put(id string) error {
 	}
 
 	unmounted := false
+	usingMountProgram := d.options.mountProgram != "" || hasMountHelper(dir)
 
-	if d.options.mountProgram != "" {
+	if usingMountProgram {
 		// Attempt to unmount the FUSE mount using either fusermount or fusermount3.
 		// If they fail, fallback to unix.Unmount
 		for _, v := range []string{"fusermount3", "fusermount"} {
@@ -1611,6 +2488,10 @@ func (d *Driver) Put(id string) error {
 		}
 	}
 
+	if usingMountProgram {
+		d.stopMountHelper(dir)
+	}
+
 	if err := unix.Rmdir(mountpoint); err != nil && !os.IsNotExist(err) {
 		logrus.Debugf("Failed to remove mountpoint %s overlay: %s - %v", id, mountpoint, err)
 	}
@@ -1665,9 +2546,155 @@ func (f fileGetNilCloser) Close() error {
 }
 
 func (d *Driver) getStagingDir() string {
+	if d.tempDir != "" {
+		return filepath.Join(d.tempDir, "overlay-staging")
+	}
 	return filepath.Join(d.home, "staging")
 }
 
+// CopyLayer replaces the contents of a layer with those of a layer which
+// another overlay driver manages.
+func (d *Driver) CopyLayer(id string, src graphdriver.Driver, srcID string) error {
+	srcDriver, ok := src.(*Driver)
+	if !ok {
+		return errors.Wrapf(graphdriver.ErrNotSupported, "copying layers from %s driver", src.String())
+	}
+	if srcDriver.getWhiteoutFormat() == archive.OverlayWhiteoutFormat && d.getWhiteoutFormat() != archive.OverlayWhiteoutFormat {
+		// We'd need to be able to create the whiteout devices before
+		// converting them, and we probably can't.
+		return errors.Wrapf(graphdriver.ErrNotSupported, "copying layers with overlay whiteouts to a driver which uses a mount program")
+	}
+	if d.options.forceMask != nil && (srcDriver.options.forceMask == nil || *srcDriver.options.forceMask != *d.options.forceMask) {
+		// The files would need to be masked as they were copied.
+		return errors.Wrapf(graphdriver.ErrNotSupported, "copying layers to a driver which forces a different permissions mask")
+	}
+	if _, err := os.Stat(path.Join(srcDriver.dir(srcID), nameWithSuffix("diff", 1))); err == nil {
+		return errors.Wrapf(graphdriver.ErrNotSupported, "copying layer %q, which has more than one diff directory", srcID)
+	}
+	srcDiff, err := srcDriver.getDiffPath(srcID)
+	if err != nil {
+		return err
+	}
+	diff, err := d.getDiffPath(id)
+	if err != nil {
+		return err
+	}
+	if err := copy.DirCopy(srcDiff, diff, copy.Content, true); err != nil {
+		return err
+	}
+	// DirCopy only preserves "user." extended attributes, so copy the
+	// ones which mark directories as opaque ourselves.
+	opaque := archive.GetOverlayXattrName("opaque")
+	if err := filepath.Walk(srcDiff, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		value, err := system.Lgetxattr(p, opaque)
+		if err != nil {
+			if errors.Is(err, unix.EOPNOTSUPP) {
+				return nil
+			}
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDiff, p)
+		if err != nil {
+			return err
+		}
+		return system.Lsetxattr(filepath.Join(diff, rel), opaque, value, 0)
+	}); err != nil {
+		return err
+	}
+	if srcDriver.options.forceMask != nil && d.options.forceMask == nil {
+		if err := archive.RestoreOverriddenFiles(diff); err != nil {
+			return err
+		}
+	}
+	return d.ConvertWhiteouts(id, srcDriver.getWhiteoutFormat())
+}
+
+// WhiteoutFormat returns the format of the whiteouts in the driver's layers.
+func (d *Driver) WhiteoutFormat() archive.WhiteoutFormat {
+	return d.getWhiteoutFormat()
+}
+
+// ConvertWhiteouts converts the whiteouts in a layer's diff directories from
+// the specified format to the one that the driver uses.
+func (d *Driver) ConvertWhiteouts(id string, from archive.WhiteoutFormat) error {
+	to := d.getWhiteoutFormat()
+	if from == to {
+		return nil
+	}
+	diffs, err := d.getDiffPaths(id)
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		if err := archive.ConvertWhiteouts(diff, from, to); err != nil {
+			return errors.Wrapf(err, "converting whiteouts in layer %q", id)
+		}
+	}
+	return nil
+}
+
+// getDiffPaths returns the locations of all of a layer's diff directories.
+func (d *Driver) getDiffPaths(id string) ([]string, error) {
+	diff, err := d.getDiffPath(id)
+	if err != nil {
+		return nil, err
+	}
+	diffs := []string{diff}
+	for i := 1; ; i++ {
+		extra := path.Join(d.dir(id), nameWithSuffix("diff", i))
+		if _, err := os.Stat(extra); err != nil {
+			break
+		}
+		diffs = append(diffs, extra)
+	}
+	return diffs, nil
+}
+
+// ForceMask returns the permissions mask that the driver forces on files in
+// its layers, if one was configured.
+func (d *Driver) ForceMask() *os.FileMode {
+	return d.options.forceMask
+}
+
+// OverriddenFiles lists the files in a layer whose ownership and permissions
+// were overridden because a permissions mask was forced on them.
+func (d *Driver) OverriddenFiles(id string) ([]archive.OverriddenFile, error) {
+	diffs, err := d.getDiffPaths(id)
+	if err != nil {
+		return nil, err
+	}
+	var files []archive.OverriddenFile
+	for _, diff := range diffs {
+		overridden, err := archive.ListOverriddenFiles(diff)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, overridden...)
+	}
+	return files, nil
+}
+
+// RestoreOverriddenFiles gives the files in a layer whose ownership and
+// permissions were overridden their original ownership and permissions.
+func (d *Driver) RestoreOverriddenFiles(id string) error {
+	diffs, err := d.getDiffPaths(id)
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		if err := archive.RestoreOverriddenFiles(diff); err != nil {
+			return errors.Wrapf(err, "restoring permissions in layer %q", id)
+		}
+	}
+	return nil
+}
+
 // DiffGetter returns a FileGetCloser that can read files from the directory that
 // contains files for the layer differences. Used for direct access for tar-split.
 func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
@@ -1678,6 +2705,15 @@ func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
 
+// LayerDiffPath returns the location of the layer's upper directory, which
+// holds the files which were added or changed by the layer.
+func (d *Driver) LayerDiffPath(id string) (string, error) {
+	if _, inAdditionalStore := d.dir2(id); inAdditionalStore {
+		return "", fmt.Errorf("overlay: layer %s is in a read-only image store", id)
+	}
+	return d.getDiffPath(id)
+}
+
 // CleanupStagingDirectory cleanups the staging directory.
 func (d *Driver) CleanupStagingDirectory(stagingDirectory string) error {
 	return os.RemoveAll(stagingDirectory)
@@ -1731,6 +2767,9 @@ func (d *Driver) ApplyDiffFromStagingDirectory(id, parent, stagingDirectory stri
 	if filepath.Dir(stagingDirectory) != d.getStagingDir() {
 		return fmt.Errorf("%q is not a staging directory", stagingDirectory)
 	}
+	if err := checkNotFrozen(id, d.dir(id)); err != nil {
+		return err
+	}
 
 	diff, err := d.getDiffPath(id)
 	if err != nil {
@@ -1739,7 +2778,16 @@ func (d *Driver) ApplyDiffFromStagingDirectory(id, parent, stagingDirectory stri
 	if err := os.RemoveAll(diff); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return os.Rename(stagingDirectory, diff)
+	if err := os.Rename(stagingDirectory, diff); !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	// The staging directory is on a different file system than the
+	// layer, so its contents have to be copied.
+	if err := copy.DirCopy(stagingDirectory, diff, copy.Content, true); err != nil {
+		os.RemoveAll(diff)
+		return errors.Wrapf(err, "copying %q to %q", stagingDirectory, diff)
+	}
+	return os.RemoveAll(stagingDirectory)
 }
 
 // DifferTarget gets the location where files are stored for the layer.
@@ -1749,6 +2797,9 @@ func (d *Driver) DifferTarget(id string) (string, error) {
 
 // ApplyDiff applies the new layer into a root
 func (d *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts) (size int64, err error) {
+	if err := checkNotFrozen(id, d.dir(id)); err != nil {
+		return 0, err
+	}
 
 	if !d.isParent(id, parent) {
 		if d.options.ignoreChownErrors {
@@ -1779,6 +2830,7 @@ func (d *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 		ForceMask:         d.options.forceMask,
 		WhiteoutFormat:    d.getWhiteoutFormat(),
 		InUserNS:          userns.RunningInUserNS(),
+		Sparse:            options.Sparse,
 	}); err != nil {
 		return 0, err
 	}
@@ -1823,7 +2875,20 @@ func (d *Driver) DiffSize(id string, idMappings *idtools.IDMappings, parent stri
 // Diff produces an archive of the changes between the specified
 // layer and its parent layer which may be "".
 func (d *Driver) Diff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string) (io.ReadCloser, error) {
+	return d.diff(id, idMappings, parent, parentMappings, mountLabel, false)
+}
+
+// SparseDiff is like Diff, but regular files which have holes in them are
+// stored as sparse entries.
+func (d *Driver) SparseDiff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string) (io.ReadCloser, error) {
+	return d.diff(id, idMappings, parent, parentMappings, mountLabel, true)
+}
+
+func (d *Driver) diff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string, sparse bool) (io.ReadCloser, error) {
 	if d.useNaiveDiff() || !d.isParent(id, parent) {
+		if sparse {
+			return d.naiveDiff.(graphdriver.SparseDiffDriver).SparseDiff(id, idMappings, parent, parentMappings, mountLabel)
+		}
 		return d.naiveDiff.Diff(id, idMappings, parent, parentMappings, mountLabel)
 	}
 
@@ -1847,6 +2912,7 @@ func (d *Driver) Diff(id string, idMappings *idtools.IDMappings, parent string,
 		GIDMaps:        idMappings.GIDs(),
 		WhiteoutFormat: d.getWhiteoutFormat(),
 		WhiteoutData:   lowerDirs,
+		Sparse:         sparse,
 	})
 }
 
@@ -1880,6 +2946,9 @@ func (d *Driver) AdditionalImageStores() []string {
 func (d *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMappings, mountLabel string) error {
 	var err error
 	dir := d.dir(id)
+	if err := checkNotFrozen(id, dir); err != nil {
+		return err
+	}
 	diffDir := filepath.Join(dir, "diff")
 
 	rootUID, rootGID := 0, 0
@@ -1950,12 +3019,32 @@ func (d *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMapp
 	return nil
 }
 
+// Capabilities reports which optional features the driver and the file
+// system that it uses provide.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	whiteoutFormat := graphdriver.WhiteoutFormatOverlay
+	if d.getWhiteoutFormat() == archive.AUFSWhiteoutFormat {
+		whiteoutFormat = graphdriver.WhiteoutFormatAUFS
+	}
+	d.reflinksOnce.Do(func() {
+		d.supportsReflinks = copy.SupportsReflinks(d.home)
+	})
+	return graphdriver.Capabilities{
+		Reflinks:         d.supportsReflinks,
+		NativeDiff:       !d.useNaiveDiff(),
+		SupportsShifting: d.SupportsShifting(),
+		Quota:            d.quotaCtl != nil || d.quotaPolling,
+		MaxLowers:        maxDepth,
+		WhiteoutFormat:   whiteoutFormat,
+	}
+}
+
 // SupportsShifting tells whether the driver support shifting of the UIDs/GIDs in an userNS
 func (d *Driver) SupportsShifting() bool {
 	if os.Getenv("_TEST_FORCE_SUPPORT_SHIFTING") == "yes-please" {
 		return true
 	}
-	return d.options.mountProgram != ""
+	return d.options.mountProgram != "" && d.mountProgramFeatures.uidMapping
 }
 
 // dumbJoin is more or less a dumber version of filepath.Join, but one which
@@ -6,16 +6,22 @@ import (
 	"path"
 
 	"github.com/containers/storage/pkg/directory"
+	"github.com/sirupsen/logrus"
 )
 
 // ReadWriteDiskUsage returns the disk usage of the writable directory for the ID.
 // For Overlay, it attempts to check the XFS quota for size, and falls back to
 // finding the size of the "diff" directory.
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
-	usage := &directory.DiskUsage{}
 	if d.quotaCtl != nil {
-		err := d.quotaCtl.GetDiskUsage(d.dir(id), usage)
-		return usage, err
+		usage, err := d.quotaCtl.GetUsage(d.dir(id))
+		if err == nil {
+			return &directory.DiskUsage{
+				Size:       int64(usage.Size),
+				InodeCount: int64(usage.Inodes),
+			}, nil
+		}
+		logrus.Debugf("overlay: error reading quota usage of layer %s, measuring it instead: %v", id, err)
 	}
 	return directory.Usage(path.Join(d.dir(id), "diff"))
 }
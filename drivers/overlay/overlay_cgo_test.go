@@ -0,0 +1,47 @@
+// +build linux,cgo
+
+package overlay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/drivers/quota"
+)
+
+func TestOverlayReadWriteDiskUsageFallback(t *testing.T) {
+	home, err := ioutil.TempDir("", "overlay-disk-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	diff := filepath.Join(home, "layer", "diff")
+	if err := os.MkdirAll(filepath.Join(diff, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(diff, "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(diff, "subdir", "file"), []byte("world!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layer's directory has no quota, so looking it up fails, and
+	// the contents of the diff directory are measured instead.
+	d := &Driver{home: home, quotaCtl: &quota.Control{}}
+	if _, err := d.quotaCtl.GetUsage(d.dir("layer")); err == nil {
+		t.Fatal("expected looking up the usage of a directory without a quota to fail")
+	}
+	usage, err := d.ReadWriteDiskUsage("layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Size != 11 {
+		t.Fatalf("expected a size of 11 bytes, got %d", usage.Size)
+	}
+	if usage.InodeCount != 4 {
+		t.Fatalf("expected 4 inodes, got %d", usage.InodeCount)
+	}
+}
@@ -3,14 +3,22 @@
 package overlay
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/drivers/graphtest"
 	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/reexec"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
 )
 
 const driverName = "overlay"
@@ -72,6 +80,79 @@ func TestOverlayChanges(t *testing.T) {
 	graphtest.DriverTestChanges(t, driverName)
 }
 
+func TestOverlayLinks(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d, ok := driver.(*graphtest.Driver).Driver.(graphdriver.LinkManagerDriver)
+	if !ok {
+		t.Fatalf("overlay driver doesn't manage its links")
+	}
+	home := driver.(*graphtest.Driver).Driver.(*Driver).home
+
+	if err := d.Create("links-base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Remove("links-base")
+	data, err := ioutil.ReadFile(filepath.Join(home, "links-base", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lid := string(data)
+
+	layers, err := driver.(*graphtest.Driver).Driver.(graphdriver.LayerListerDriver).ListLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, layer := range layers {
+		listed = listed || layer == "links-base"
+		if layer == linkDir {
+			t.Fatalf("expected the link directory not to be listed as a layer")
+		}
+	}
+	if !listed {
+		t.Fatalf("expected %q to be listed, got %v", "links-base", layers)
+	}
+
+	links, err := d.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[lid] != "links-base" {
+		t.Fatalf("expected link %q to point to %q, got %q", lid, "links-base", links[lid])
+	}
+
+	// Lose the layer's link, and add one that doesn't point anywhere.
+	if err := os.Remove(filepath.Join(home, linkDir, lid)); err != nil {
+		t.Fatal(err)
+	}
+	dangling := filepath.Join(home, linkDir, "DANGLING")
+	if err := os.Symlink(filepath.Join("..", "no-such-layer", "diff"), dangling); err != nil {
+		t.Fatal(err)
+	}
+	links, err = d.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := links["DANGLING"]; !ok || id != "" {
+		t.Fatalf("expected dangling link to be reported without a layer, got %q, %v", id, ok)
+	}
+
+	if err := d.RebuildLinks(); err != nil {
+		t.Fatal(err)
+	}
+	links, err = d.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[lid] != "links-base" {
+		t.Fatalf("expected link %q to be recreated, got %q", lid, links[lid])
+	}
+	if _, ok := links["DANGLING"]; ok {
+		t.Fatalf("expected dangling link to be removed")
+	}
+}
+
 func TestOverlayTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -117,3 +198,908 @@ func BenchmarkDiff20Layers(b *testing.B) {
 func BenchmarkRead20Layers(b *testing.B) {
 	graphtest.DriverBenchDeepLayerRead(b, 20, driverName)
 }
+
+func TestOverlayFlatten(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName, "overlay.flatten_depth=4")
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	// Build a chain of layers which each add a file, with one of them
+	// also removing the file added by the layer below it.
+	parent := ""
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("flatten-%d", i)
+		if err := d.Create(id, parent, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		dir, err := d.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", i)), []byte(id), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			if err := os.Remove(filepath.Join(dir, "file-2")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Put(id); err != nil {
+			t.Fatal(err)
+		}
+		parent = id
+	}
+
+	lower, err := ioutil.ReadFile(filepath.Join(d.home, parent, lowerFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Split(string(lower), ":")); n > 4 {
+		t.Fatalf("expected at most 4 lower layers, got %d: %q", n, lower)
+	}
+
+	dir, err := d.Get(parent, graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("file-%d", i)))
+		if i == 2 {
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected file-2 to have been removed, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put(parent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once no layer uses them, flattened layers should be pruned.
+	for i := len(ids) - 1; i >= 0; i-- {
+		if err := d.Remove(ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruned, err := d.pruneFlattened()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned == 0 {
+		t.Fatalf("expected unused flattened layers to be pruned")
+	}
+	entries, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), flattenedPrefix) {
+			t.Fatalf("expected flattened layer %q to have been removed", entry.Name())
+		}
+	}
+}
+
+func TestOverlaySnapshotLayer(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	writeFile := func(id, name string) {
+		dir, err := d.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Create("snapshot-base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("snapshot-base", "base")
+	if err := d.CreateReadWrite("snapshot-container", "snapshot-base", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("snapshot-container", "before")
+
+	if err := d.SnapshotLayer("snapshot-container", "snapshot-base", "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.isParent("snapshot-container", "snapshot") || !d.isParent("snapshot", "snapshot-base") {
+		t.Fatalf("expected the snapshot to be between the layer and its old parent")
+	}
+	changes, err := d.Changes("snapshot", nil, "snapshot-base", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/before" {
+		t.Fatalf("expected the snapshot to hold the layer's changes, got %v", changes)
+	}
+
+	// The layer only records changes made after the snapshot, but its
+	// contents still include the ones made before it.
+	writeFile("snapshot-container", "after")
+	changes, err = d.Changes("snapshot-container", nil, "snapshot", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/after" {
+		t.Fatalf("expected the layer to hold only later changes, got %v", changes)
+	}
+	dir, err := d.Get("snapshot-container", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"base", "before", "after"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mounted layers can't be snapshotted.
+	if err := d.SnapshotLayer("snapshot-container", "snapshot", "snapshot-2"); err == nil {
+		t.Fatalf("expected snapshotting a mounted layer to fail")
+	}
+	if d.Exists("snapshot-2") {
+		t.Fatalf("expected a failed snapshot to be cleaned up")
+	}
+	if err := d.Put("snapshot-container"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayResetLayer(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	writeFile := func(id, name string) {
+		dir, err := d.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFiles := func(id string, present, absent []string) {
+		dir, err := d.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if err := d.Put(id); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		for _, name := range present {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range absent {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Fatalf("expected %q to be gone from layer %s: %v", name, id, err)
+			}
+		}
+	}
+	if err := d.Create("reset-base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("reset-base", "base")
+	if err := d.CreateReadWrite("reset-container", "reset-base", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("reset-container", "before")
+	if err := d.SnapshotLayer("reset-container", "reset-base", "reset-snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("reset-container", "after")
+
+	// Going back to the last snapshot only discards later changes.
+	if err := d.ResetLayer("reset-container", "reset-snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles("reset-container", []string{"base", "before"}, []string{"after"})
+
+	// Going back further skips the snapshot.
+	if err := d.ResetLayer("reset-container", "reset-base"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.isParent("reset-container", "reset-base") {
+		t.Fatalf("expected the layer's parent to be reset-base")
+	}
+	checkFiles("reset-container", []string{"base"}, []string{"before", "after"})
+
+	// Going back to nothing at all leaves the layer empty.
+	if err := d.ResetLayer("reset-container", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles("reset-container", nil, []string{"base", "before", "after"})
+
+	// Mounted layers can't be reset.
+	if _, err := d.Get("reset-container", graphdriver.MountOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ResetLayer("reset-container", ""); err == nil {
+		t.Fatalf("expected resetting a mounted layer to fail")
+	}
+	if err := d.Put("reset-container"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayClearStaleIndex(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	if err := d.CreateReadWrite("stale-index", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir := d.dir("stale-index")
+	index := filepath.Join(dir, "work", "index")
+	if err := os.MkdirAll(index, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(index, "stale"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The work directory isn't touched while the layer is mounted.
+	if _, err := d.Get("stale-index", graphdriver.MountOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.clearStaleIndex("stale-index", dir); err == nil {
+		t.Fatalf("expected clearing the index of a mounted layer to fail")
+	}
+	if err := d.Put("stale-index"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.clearStaleIndex("stale-index", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(index); !os.IsNotExist(err) {
+		t.Fatalf("expected the index to be removed: %v", err)
+	}
+	if _, err := d.Get("stale-index", graphdriver.MountOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("stale-index"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsStaleIndexError(t *testing.T) {
+	for _, err := range []error{
+		unix.ESTALE,
+		&os.PathError{Op: "mount", Path: "merged", Err: unix.EEXIST},
+		fmt.Errorf("mountfrom re-exec error: exit status 1: output: %v", unix.ESTALE),
+	} {
+		if !isStaleIndexError(err) {
+			t.Errorf("expected %v to be recognized", err)
+		}
+	}
+	if isStaleIndexError(unix.EINVAL) {
+		t.Errorf("expected %v not to be recognized", unix.EINVAL)
+	}
+}
+
+func TestOverlayFreezeLayer(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	if err := d.Create("freeze", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := d.Get("freeze", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Mounted layers can't be frozen.
+	if err := d.FreezeLayer("freeze"); err == nil {
+		t.Fatalf("expected freezing a mounted layer to fail")
+	}
+	if err := d.Put("freeze"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.BackupFiles("freeze"); err == nil {
+		t.Fatalf("expected listing the files of a layer which isn't frozen to fail")
+	}
+	if err := d.FreezeLayer("freeze"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.FreezeLayer("freeze"); !errors.Is(err, graphdriver.ErrLayerFrozen) {
+		t.Fatalf("expected freezing a frozen layer to fail with %v: %v", graphdriver.ErrLayerFrozen, err)
+	}
+	if _, err := d.Get("freeze", graphdriver.MountOpts{}); !errors.Is(err, graphdriver.ErrLayerFrozen) {
+		t.Fatalf("expected mounting a frozen layer to fail with %v: %v", graphdriver.ErrLayerFrozen, err)
+	}
+	if err := d.Remove("freeze"); !errors.Is(err, graphdriver.ErrLayerFrozen) {
+		t.Fatalf("expected removing a frozen layer to fail with %v: %v", graphdriver.ErrLayerFrozen, err)
+	}
+
+	files, err := d.BackupFiles("freeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, file := range files {
+		switch file.Name {
+		case filepath.Join("diff", "file"):
+			found = true
+			if file.Digest != digest.FromString("contents") {
+				t.Fatalf("expected digest %s for %s, got %s", digest.FromString("contents"), file.Name, file.Digest)
+			}
+		case "merged", "work", frozenFile:
+			t.Fatalf("did not expect %s to be listed", file.Name)
+		}
+	}
+	if !found {
+		t.Fatalf("expected diff/file to be listed in %+v", files)
+	}
+
+	if err := d.ThawLayer("freeze"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ThawLayer("freeze"); err == nil {
+		t.Fatalf("expected thawing a layer which isn't frozen to fail")
+	}
+	if err := d.Remove("freeze"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayWritableImageStore(t *testing.T) {
+	imageStore, err := ioutil.TempDir("", "overlay-imagestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(imageStore)
+	driver := graphtest.GetDriver(t, driverName, "overlay.writable_imagestore="+imageStore)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	if err := d.Create("imagestore-base", "", &graphdriver.CreateOpts{ImageStore: imageStore}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(imageStore, "overlay", "imagestore-base", "diff")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("imagestore-container", "imagestore-base", &graphdriver.CreateOpts{ImageStore: imageStore}); err == nil {
+		t.Fatalf("expected creating a read-write layer in the image store to fail")
+	}
+	if err := d.CreateReadWrite("imagestore-container", "imagestore-base", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := d.Get("imagestore-container", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("imagestore-container"); err != nil {
+		t.Fatal(err)
+	}
+	if dir == "" {
+		t.Fatalf("expected a mount point")
+	}
+
+	// Its link survives being rebuilt, and it's listed.
+	if err := d.RebuildLinks(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(imageStore, "overlay", "imagestore-base", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, err := d.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links[string(data)] != "imagestore-base" {
+		t.Fatalf("expected link %q to point to %q, got %q", string(data), "imagestore-base", links[string(data)])
+	}
+	layers, err := d.ListLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, layer := range layers {
+		listed = listed || layer == "imagestore-base"
+	}
+	if !listed {
+		t.Fatalf("expected %q to be listed, got %v", "imagestore-base", layers)
+	}
+
+	if err := d.Remove("imagestore-container"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("imagestore-base"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(imageStore, "overlay", "imagestore-base")); !os.IsNotExist(err) {
+		t.Fatalf("expected the layer to be removed from the image store: %v", err)
+	}
+}
+
+func TestOverlayAdditionalLowers(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	if err := d.Create("lowers-base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := d.Get("lowers-base", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "shared"), []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("lowers-base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("lowers-container", "lowers-base", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	extra, err := ioutil.TempDir("", "overlay-lowers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(extra)
+	for name, content := range map[string]string{"shared": "extra", "extra": "extra"} {
+		if err := ioutil.WriteFile(filepath.Join(extra, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, bad := range []string{
+		"relative",
+		extra + "/../" + filepath.Base(extra),
+		extra + ":" + extra,
+		filepath.Join(extra, "extra"),
+		filepath.Join(d.dir("lowers-container"), "diff"),
+	} {
+		if _, err := d.Get("lowers-container", graphdriver.MountOpts{AdditionalLowers: []string{bad}}); err == nil {
+			d.Put("lowers-container")
+			t.Fatalf("expected mounting with additional lower %q to fail", bad)
+		}
+	}
+
+	dir, err = d.Get("lowers-container", graphdriver.MountOpts{AdditionalLowers: []string{extra}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"shared": "extra", "extra": "extra"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected %q to contain %q, got %q", name, expected, string(content))
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "extra"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("lowers-container"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(extra, "extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "extra" {
+		t.Fatalf("expected changes to be made in the layer, not the additional lower directory")
+	}
+
+	// Without the additional lower, only the layers' contents are visible.
+	dir, err = d.Get("lowers-container", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("lowers-container")
+	if content, err = ioutil.ReadFile(filepath.Join(dir, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "base" {
+		t.Fatalf("expected %q to contain %q, got %q", "shared", "base", string(content))
+	}
+}
+
+func TestOverlayMountPropagation(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName, "overlay.mount_propagation=rshared")
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	propagation := func(mountpoint string) string {
+		mounts, err := mount.GetMounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range mounts {
+			if m.Mountpoint == mountpoint {
+				return m.Optional
+			}
+		}
+		t.Fatalf("%s is not mounted", mountpoint)
+		return ""
+	}
+	if optional := propagation(d.home); !strings.Contains(optional, "shared:") {
+		t.Fatalf("expected the driver's home directory to be shared, got %q", optional)
+	}
+
+	if err := d.Create("propagation", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("propagation", graphdriver.MountOpts{Propagation: "bogus"}); err == nil {
+		d.Put("propagation")
+		t.Fatalf("expected an error for an unknown mount propagation")
+	}
+	dir, err := d.Get("propagation", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if optional := propagation(dir); !strings.Contains(optional, "shared:") {
+		t.Fatalf("expected the mountpoint to be shared, got %q", optional)
+	}
+	if err := d.Put("propagation"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err = d.Get("propagation", graphdriver.MountOpts{Propagation: graphdriver.MountPropagationPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Put("propagation")
+	if optional := propagation(dir); strings.Contains(optional, "shared:") || strings.Contains(optional, "master:") {
+		t.Fatalf("expected the mountpoint to be private, got %q", optional)
+	}
+}
+
+func TestOverlayStagingTempDir(t *testing.T) {
+	driver := graphtest.GetDriver(t, driverName)
+	defer graphtest.PutDriver(t)
+	d := driver.(*graphtest.Driver).Driver.(*Driver)
+
+	// /dev/shm is usually on a different file system, which forces the
+	// staging directory to be copied into place instead of being renamed.
+	tempDir, err := ioutil.TempDir("/dev/shm", "overlay-staging-")
+	if err != nil {
+		t.Skipf("can't create a directory in /dev/shm: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	d.tempDir = tempDir
+	defer func() { d.tempDir = "" }()
+
+	if err := d.Create("staged", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(d.getStagingDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	staging, err := ioutil.TempDir(d.getStagingDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, "staged-file"), []byte("staged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ApplyDiffFromStagingDirectory("staged", "", staging, &graphdriver.DriverWithDifferOutput{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := d.getDiffPath("staged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(diff, "staged-file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "staged" {
+		t.Fatalf("expected the staged file to be moved into the layer, got %q", contents)
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Fatalf("expected the staging directory to be removed, got %v", err)
+	}
+	if err := d.Remove("staged"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseNetworkFSFallbackOptions(t *testing.T) {
+	for _, value := range []string{"", "none", "mount_program", "vfs"} {
+		opts, err := parseOptions([]string{"overlay.network_fs_fallback=" + value})
+		if err != nil {
+			t.Fatalf("network_fs_fallback=%q: %v", value, err)
+		}
+		if opts.networkFSFallback != value {
+			t.Fatalf("network_fs_fallback=%q was parsed as %q", value, opts.networkFSFallback)
+		}
+	}
+	if _, err := parseOptions([]string{"overlay.network_fs_fallback=btrfs"}); err == nil {
+		t.Fatalf("expected an error for an unknown network_fs_fallback")
+	}
+	if _, err := parseOptions([]string{"overlay.network_fs_mount_program=/nonexistent/program"}); err == nil {
+		t.Fatalf("expected an error for a network_fs_mount_program which doesn't exist")
+	}
+}
+
+func TestParseFallbackOptions(t *testing.T) {
+	for value, expected := range map[string][]string{
+		"":                   nil,
+		"none":               nil,
+		"vfs":                {"vfs"},
+		"mount_program, vfs": {"mount_program", "vfs"},
+	} {
+		opts, err := parseOptions([]string{"overlay.fallback=" + value})
+		if err != nil {
+			t.Fatalf("fallback=%q: %v", value, err)
+		}
+		if fmt.Sprint(opts.fallback) != fmt.Sprint(expected) {
+			t.Fatalf("fallback=%q was parsed as %q", value, opts.fallback)
+		}
+	}
+	for _, option := range []string{
+		"overlay.fallback=btrfs",
+		"overlay.fallback=vfs,mount_program",
+		"overlay.fallback_mount_program=/nonexistent/program",
+	} {
+		if _, err := parseOptions([]string{option}); err == nil {
+			t.Fatalf("expected an error for %q", option)
+		}
+	}
+}
+
+func TestOverlayFallback(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-fallback-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	options := graphdriver.Options{Root: root, RunRoot: filepath.Join(root, "run")}
+	nativeErr := fmt.Errorf("test: %w", graphdriver.ErrIncompatibleFS)
+
+	// A mount program which can't be used is skipped.
+	opts := &overlayOptions{
+		fallback:             []string{fallbackMountProgram, fallbackVFS},
+		fallbackMountProgram: "/nonexistent/program",
+	}
+	driver, err := initFallback(filepath.Join(root, "overlay"), options, opts, graphdriver.FsMagicUnsupported, nativeErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.String() != "vfs" {
+		t.Fatalf("expected to fall back to vfs, got %q", driver.String())
+	}
+	var degraded string
+	for _, entry := range driver.Status() {
+		if entry[0] == "Degraded Mode" {
+			degraded = entry[1]
+		}
+	}
+	if !strings.Contains(degraded, "native overlay can't be used") || !strings.Contains(degraded, "/nonexistent/program") {
+		t.Fatalf("expected the status to explain the fallback, got %q", degraded)
+	}
+	driver.Cleanup()
+
+	// The choice is remembered, even if the fallback option is dropped.
+	driver, err = Init(filepath.Join(root, "overlay"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.String() != "vfs" {
+		t.Fatalf("expected to keep using vfs, got %q", driver.String())
+	}
+	driver.Cleanup()
+
+	// If nothing else can be used, the original error is kept.
+	opts.fallback = []string{fallbackMountProgram}
+	if _, err = initFallback(filepath.Join(root, "overlay"), options, opts, graphdriver.FsMagicUnsupported, nativeErr); !isUnsupported(err) {
+		t.Fatalf("expected an unsupported error, got %v", err)
+	}
+}
+
+func TestParseQuotaFallbackOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"overlay.quota_fallback=poll", "overlay.quota_poll_interval=30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.quotaFallback != quotaFallbackPoll || opts.quotaPollInterval.String() != "30s" {
+		t.Fatalf("quota options were parsed as %q, %v", opts.quotaFallback, opts.quotaPollInterval)
+	}
+	for _, option := range []string{
+		"overlay.quota_fallback=loopback",
+		"overlay.quota_poll_interval=0s",
+		"overlay.quota_poll_interval=often",
+		"overlay.quota_hook=/nonexistent/program",
+	} {
+		if _, err := parseOptions([]string{option}); err == nil {
+			t.Fatalf("expected an error for %q", option)
+		}
+	}
+}
+
+func TestQuotaWatcher(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	dir, err := ioutil.TempDir("", "overlay-quotawatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, subdir := range []string{"diff", "merged"} {
+		if err := os.Mkdir(filepath.Join(dir, subdir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, quotaFile), []byte(`{"Size":1}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "diff", "file"), []byte("contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	exceeded := filepath.Join(dir, "exceeded")
+	hook := filepath.Join(dir, "hook")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" > "+exceeded+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	merged := filepath.Join(dir, "merged")
+	if err := unix.Mount(filepath.Join(dir, "diff"), merged, "", unix.MS_BIND, ""); err != nil {
+		t.Skipf("can't bind mount: %v", err)
+	}
+	defer unix.Unmount(merged, unix.MNT_DETACH)
+
+	// The watcher should keep running after the process which started it
+	// is gone, and run the hook once the layer is over its limits.
+	if err := startQuotaWatcher(dir, 10*time.Millisecond, hook); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := os.Open(filepath.Join(dir, quotaFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(exceeded); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the quota hook was never run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err == nil {
+		t.Fatal("nothing is checking the layer")
+	}
+
+	// Once the layer is unmounted, the watcher should exit.
+	if err := unix.Unmount(merged, 0); err != nil {
+		t.Fatal(err)
+	}
+	for unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the layer is still being checked after it was unmounted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseImageStoreMountOptions(t *testing.T) {
+	store, err := ioutil.TempDir("", "overlay-imagestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	opts, err := parseOptions([]string{
+		"overlay.imagestore=" + store,
+		"overlay.imagestore_mount_program=" + store + "/=/bin/sh",
+		"overlay.imagestore_mountopt=" + store + "=nodev,noexec",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := opts.imageStoreMounts[store]
+	if m == nil || m.mountProgram != "/bin/sh" || m.mountOptions != "nodev,noexec" {
+		t.Fatalf("image store mount options were parsed as %+v", opts.imageStoreMounts)
+	}
+	for _, option := range []string{
+		"overlay.imagestore_mountopt=nodev",
+		"overlay.imagestore_mountopt=relative=nodev",
+		"overlay.imagestore_mount_program=" + store + "=/nonexistent/program",
+	} {
+		if _, err := parseOptions([]string{option}); err == nil {
+			t.Fatalf("expected an error for %q", option)
+		}
+	}
+
+	opts, err = parseOptions([]string{"overlay.imagestore_mountopt=/not/a/store=nodev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.checkImageStoreMounts(store); err == nil {
+		t.Fatalf("expected an error for settings for a store which isn't an additional image store")
+	}
+}
+
+func TestImageStoreMountFor(t *testing.T) {
+	d := &Driver{options: overlayOptions{imageStoreMounts: map[string]*imageStoreMount{
+		"/a": {mountProgram: "/usr/bin/fuse-overlayfs", mountOptions: "nodev"},
+		"/b": {mountOptions: "noexec"},
+		"/c": {mountProgram: "/usr/bin/squashfuse-overlay"},
+	}}}
+	m, err := d.imageStoreMountFor([]string{"/elsewhere"})
+	if err != nil || m != nil {
+		t.Fatalf("expected no settings for a store without any, got %+v, %v", m, err)
+	}
+	m, err = d.imageStoreMountFor([]string{"/b", "/a", "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.mountProgram != "/usr/bin/fuse-overlayfs" || m.mountOptions != "noexec,nodev" {
+		t.Fatalf("settings were combined as %+v", m)
+	}
+	if _, err := d.imageStoreMountFor([]string{"/a", "/c"}); err == nil {
+		t.Fatalf("expected an error for stores with different mount programs")
+	}
+}
+
+func TestParseInodesOptions(t *testing.T) {
+	opts, err := parseOptions([]string{"overlay.inodes=1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.quota.Inodes != 1000 {
+		t.Fatalf("inodes=1000 was parsed as %d", opts.quota.Inodes)
+	}
+	if _, err := parseOptions([]string{"overlay.inodes=many"}); err == nil {
+		t.Fatalf("expected an error for a non-numeric inodes option")
+	}
+
+	d := &Driver{}
+	driver := &Driver{}
+	if err := d.parseStorageOpt(map[string]string{"size": "10m", "Inodes": "500"}, driver); err != nil {
+		t.Fatal(err)
+	}
+	if driver.options.quota.Inodes != 500 || driver.options.quota.Size != 10*1024*1024 {
+		t.Fatalf("storage options were parsed as %+v", driver.options.quota)
+	}
+	if err := d.parseStorageOpt(map[string]string{"inodes": "-1"}, driver); err == nil {
+		t.Fatalf("expected an error for a negative inodes storage option")
+	}
+}
+
+func TestParseMountPropagationOptions(t *testing.T) {
+	for _, value := range []string{"private", "rshared", "rslave"} {
+		opts, err := parseOptions([]string{"overlay.mount_propagation=" + value})
+		if err != nil {
+			t.Fatalf("mount_propagation=%q: %v", value, err)
+		}
+		if opts.mountPropagation != value {
+			t.Fatalf("mount_propagation=%q was parsed as %q", value, opts.mountPropagation)
+		}
+	}
+	if _, err := parseOptions([]string{"overlay.mount_propagation=shared"}); err == nil {
+		t.Fatalf("expected an error for an unknown mount_propagation")
+	}
+}
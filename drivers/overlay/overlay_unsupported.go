@@ -5,3 +5,9 @@ package overlay
 func SupportsNativeOverlay(graphroot, rundir string) (bool, error) {
 	return false, nil
 }
+
+// ValidateOptions does nothing, since the driver isn't available on this
+// platform.
+func ValidateOptions(options []string) error {
+	return nil
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/containers/storage/drivers/quota"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/reexec"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	reexec.Register("storage-quotawatch-start", quotaWatchStartMain)
+	reexec.Register("storage-quotawatch", quotaWatchMain)
+}
+
+// startQuotaWatcher starts a process which checks the disk usage of the layer
+// in dir every interval, and runs hook when it finds that the layer is over
+// the limits which are recorded in its quotaFile, for as long as the layer is
+// mounted.  The process is started by an intermediate process which exits
+// right away, so that it isn't our child, and it keeps running after we exit.
+func startQuotaWatcher(dir string, interval time.Duration, hook string) error {
+	cmd := reexec.Command("storage-quotawatch-start", dir, interval.String(), hook)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, string(out))
+	}
+	return nil
+}
+
+// quotaWatchStartMain is the entry-point for storage-quotawatch-start on
+// re-exec.  It starts storage-quotawatch in a new session, without tying its
+// lifetime to ours, and exits.
+func quotaWatchStartMain() {
+	cmd := reexec.Command(append([]string{"storage-quotawatch"}, os.Args[1:]...)...)
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fatal(err)
+	}
+	os.Exit(0)
+}
+
+// quotaWatchMain is the entry-point for storage-quotawatch on re-exec.  It
+// holds a lock on the layer's quotaFile while it runs, so that only one
+// process checks each layer, and exits once the layer is no longer mounted.
+func quotaWatchMain() {
+	if len(os.Args) != 4 {
+		fatal(fmt.Errorf("usage: %s layer-directory interval hook", os.Args[0]))
+	}
+	dir, hook := os.Args[1], os.Args[3]
+	interval, err := time.ParseDuration(os.Args[2])
+	if err != nil {
+		fatal(err)
+	}
+	f, err := os.Open(path.Join(dir, quotaFile))
+	if err != nil {
+		fatal(err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		// Someone else is already checking this layer.
+		os.Exit(0)
+	}
+	var limits quota.Quota
+	if err := json.NewDecoder(f).Decode(&limits); err != nil {
+		fatal(err)
+	}
+
+	poller := quota.NewPoller(0, quota.HookExceededFunc(hook))
+	poller.Add(path.Join(dir, "diff"), limits)
+	for {
+		time.Sleep(interval)
+		if mounted, err := mount.Mounted(path.Join(dir, "merged")); err != nil || !mounted {
+			os.Exit(0)
+		}
+		poller.Check()
+	}
+}
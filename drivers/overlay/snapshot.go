@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/system"
+	"github.com/sirupsen/logrus"
+)
+
+// SnapshotLayer moves the contents of the layer's upper directory into a new
+// layer which has the same parent, gives the layer a new, empty, upper
+// directory, and adds the new layer to the top of the layer's list of lower
+// layers.
+func (d *Driver) SnapshotLayer(id, parent, snapshotID string) (retErr error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	dir, inAdditionalStore := d.dir2(id)
+	if inAdditionalStore {
+		return fmt.Errorf("overlay: layer %s is in a read-only image store", id)
+	}
+	if err := checkNotMounted(id, dir); err != nil {
+		return err
+	}
+	if !d.isParent(id, parent) {
+		return fmt.Errorf("overlay: layer %s is not a child of layer %q", id, parent)
+	}
+
+	if err := d.create(snapshotID, parent, nil, true); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := d.Remove(snapshotID); err != nil {
+				logrus.Errorf("While recovering from a failure snapshotting layer %s, error deleting %s: %v", id, snapshotID, err)
+			}
+		}
+	}()
+
+	// Prepare the layer's new upper directory, which looks like the old
+	// one did, since it's the root directory of the layer's contents.
+	diff := path.Join(dir, "diff")
+	newDiff := path.Join(dir, "diff.new")
+	st, err := system.Stat(diff)
+	if err != nil {
+		return err
+	}
+	if err := idtools.MkdirAs(newDiff, os.FileMode(st.Mode()), int(st.UID()), int(st.GID())); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(newDiff)
+		}
+	}()
+	copyRootXattrs(diff, newDiff)
+
+	// Move the layer's changes into the new layer, and start over.
+	snapshotDiff := path.Join(d.dir(snapshotID), "diff")
+	if err := os.Remove(snapshotDiff); err != nil {
+		return err
+	}
+	if err := os.Rename(diff, snapshotDiff); err != nil {
+		return err
+	}
+	if err := os.Rename(newDiff, diff); err != nil {
+		if err2 := os.Rename(snapshotDiff, diff); err2 != nil {
+			logrus.Errorf("While recovering from a failure snapshotting layer %s, error restoring %s: %v", id, diff, err2)
+		}
+		return err
+	}
+
+	lower, err := d.getLower(snapshotID)
+	if err == nil {
+		lower, err = d.flattenLowers(lower)
+	}
+	if err == nil {
+		err = ioutils.AtomicWriteFile(path.Join(dir, lowerFile), []byte(lower), 0666)
+	}
+	if err != nil {
+		// Put the layer's changes back where they were.
+		if err2 := os.Rename(diff, newDiff); err2 == nil {
+			if err2 = os.Rename(snapshotDiff, diff); err2 != nil {
+				logrus.Errorf("While recovering from a failure snapshotting layer %s, error restoring %s: %v", id, diff, err2)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// ResetLayer discards the contents of the layer's upper directory, and
+// rewrites its list of lower layers to match parent, which should be either
+// the layer's parent or one of its ancestors.  The layer directory itself is
+// kept, so any quota which was set up for it when it was created still applies.
+func (d *Driver) ResetLayer(id, parent string) (retErr error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+
+	dir, inAdditionalStore := d.dir2(id)
+	if inAdditionalStore {
+		return fmt.Errorf("overlay: layer %s is in a read-only image store", id)
+	}
+	if err := checkNotMounted(id, dir); err != nil {
+		return err
+	}
+	if err := checkNotFrozen(id, dir); err != nil {
+		return err
+	}
+
+	// Work out what the list of lower layers should look like.
+	lower := ""
+	if parent != "" {
+		l, err := d.getLower(parent)
+		if err == nil {
+			l, err = d.flattenLowers(l)
+		}
+		if err != nil {
+			return err
+		}
+		lower = l
+	}
+	lowerPath := path.Join(dir, lowerFile)
+	oldLower, err := ioutil.ReadFile(lowerPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	haveOldLower := err == nil
+
+	// Prepare the layer's new upper directory, which looks like the old
+	// one did, since it's the root directory of the layer's contents.
+	diff := path.Join(dir, "diff")
+	newDiff := path.Join(dir, "diff.new")
+	oldDiff := path.Join(dir, "diff.old")
+	st, err := system.Stat(diff)
+	if err != nil {
+		return err
+	}
+	if err := idtools.MkdirAs(newDiff, os.FileMode(st.Mode()), int(st.UID()), int(st.GID())); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(newDiff)
+		}
+	}()
+	copyRootXattrs(diff, newDiff)
+	if lower == "" {
+		// Layers without lower layers are mounted using an empty one.
+		if err := idtools.MkdirAllAs(path.Join(dir, "empty"), 0700, int(st.UID()), int(st.GID())); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(diff, oldDiff); err != nil {
+		return err
+	}
+	if err := os.Rename(newDiff, diff); err != nil {
+		if err2 := os.Rename(oldDiff, diff); err2 != nil {
+			logrus.Errorf("While recovering from a failure resetting layer %s, error restoring %s: %v", id, diff, err2)
+		}
+		return err
+	}
+	if lower != "" {
+		err = ioutils.AtomicWriteFile(lowerPath, []byte(lower), 0666)
+	} else if err = os.Remove(lowerPath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		// Put the layer's contents back the way they were.
+		if err2 := os.Rename(diff, newDiff); err2 == nil {
+			if err2 = os.Rename(oldDiff, diff); err2 != nil {
+				logrus.Errorf("While recovering from a failure resetting layer %s, error restoring %s: %v", id, diff, err2)
+			}
+		}
+		if haveOldLower {
+			if err2 := ioutils.AtomicWriteFile(lowerPath, oldLower, 0666); err2 != nil {
+				logrus.Errorf("While recovering from a failure resetting layer %s, error restoring %s: %v", id, lowerPath, err2)
+			}
+		}
+		return err
+	}
+
+	if err := system.EnsureRemoveAll(oldDiff); err != nil {
+		logrus.Warnf("overlay: error removing the old contents of layer %s: %v", id, err)
+	}
+	return nil
+}
+
+// checkNotMounted returns an error if the layer whose directory is dir is
+// currently mounted.
+func checkNotMounted(id, dir string) error {
+	mergedDir := path.Join(dir, "merged")
+	if _, err := os.Lstat(mergedDir); err == nil {
+		mounted, err := mount.Mounted(mergedDir)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			return fmt.Errorf("overlay: layer %s is mounted", id)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyRootXattrs copies the extended attributes of one layer's upper
+// directory, other than the ones which the kernel uses to keep track of how
+// the directory's contents were copied up, to another, as far as it can.
+func copyRootXattrs(src, dest string) {
+	attrs, err := system.Llistxattr(src)
+	if err != nil {
+		logrus.Debugf("overlay: error listing extended attributes of %s: %v", src, err)
+		return
+	}
+	for _, attr := range attrs {
+		if strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.") {
+			continue
+		}
+		value, err := system.Lgetxattr(src, attr)
+		if err == nil {
+			err = system.Lsetxattr(dest, attr, value, 0)
+		}
+		if err != nil {
+			logrus.Debugf("overlay: error copying extended attribute %s of %s: %v", attr, src, err)
+		}
+	}
+}
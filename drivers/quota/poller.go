@@ -0,0 +1,175 @@
+package quota
+
+import (
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/directory"
+	"github.com/sirupsen/logrus"
+)
+
+// ExceededFunc is called by a Poller when the disk usage of a directory rises
+// above the limits which were set for it.
+type ExceededFunc func(dir string, quota Quota, usage *directory.DiskUsage)
+
+// Poller enforces limits on the disk usage of directories on file systems
+// which don't support project quotas, by periodically measuring their usage.
+// Since usage is only measured periodically, a directory can grow beyond its
+// limits between checks.  Directories are only checked while the process which
+// added them is running, so callers which exit while the directories are still
+// in use should leave the checking to a process which doesn't.
+type Poller struct {
+	lock     sync.Mutex
+	interval time.Duration
+	exceeded ExceededFunc
+	quotas   map[string]Quota
+	// over records which directories were over their limits when they
+	// were last checked, so that exceeded is only called once each time
+	// a directory goes over its limits.
+	over map[string]bool
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPoller returns a Poller which checks the directories which are added to
+// it every interval, and calls exceeded when one of them is found to be over
+// its limits.  If interval is 0, directories are only checked when Check() is
+// called.
+func NewPoller(interval time.Duration, exceeded ExceededFunc) *Poller {
+	return &Poller{
+		interval: interval,
+		exceeded: exceeded,
+		quotas:   make(map[string]Quota),
+		over:     make(map[string]bool),
+	}
+}
+
+// exceededBy returns true if usage is over either of the quota's limits.  A
+// limit of 0 means that there is no limit.
+func (q Quota) exceededBy(usage *directory.DiskUsage) bool {
+	if q.Size > 0 && uint64(usage.Size) > q.Size {
+		return true
+	}
+	return q.Inodes > 0 && uint64(usage.InodeCount) > q.Inodes
+}
+
+// Add starts checking the disk usage of dir against the limits in quota.
+func (p *Poller) Add(dir string, quota Quota) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.quotas[dir] = quota
+	if p.stop == nil && p.interval > 0 {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.run(p.stop, p.done)
+	}
+}
+
+// Remove stops checking the disk usage of dir.
+func (p *Poller) Remove(dir string) {
+	p.lock.Lock()
+	delete(p.quotas, dir)
+	delete(p.over, dir)
+	var stop, done chan struct{}
+	if len(p.quotas) == 0 {
+		stop, done = p.stop, p.done
+		p.stop, p.done = nil, nil
+	}
+	p.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Stop stops checking the disk usage of all directories.
+func (p *Poller) Stop() {
+	p.lock.Lock()
+	p.quotas = make(map[string]Quota)
+	p.over = make(map[string]bool)
+	stop, done := p.stop, p.done
+	p.stop, p.done = nil, nil
+	p.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (p *Poller) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.Check()
+		}
+	}
+}
+
+// Check measures the disk usage of all of the directories, calls the
+// ExceededFunc for the ones which have gone over their limits since they were
+// last checked, and returns the list of directories which are over their
+// limits.
+func (p *Poller) Check() []string {
+	p.lock.Lock()
+	quotas := make(map[string]Quota, len(p.quotas))
+	for dir, quota := range p.quotas {
+		quotas[dir] = quota
+	}
+	p.lock.Unlock()
+
+	var exceeded []string
+	for dir, quota := range quotas {
+		usage, err := directory.Usage(dir)
+		if err != nil {
+			logrus.Debugf("Error measuring disk usage of %s: %v", dir, err)
+			continue
+		}
+		over := quota.exceededBy(usage)
+		p.lock.Lock()
+		_, watched := p.quotas[dir]
+		crossed := watched && over && !p.over[dir]
+		if watched {
+			p.over[dir] = over
+		}
+		p.lock.Unlock()
+		if over {
+			exceeded = append(exceeded, dir)
+		}
+		if crossed && p.exceeded != nil {
+			p.exceeded(dir, quota, usage)
+		}
+	}
+	sort.Strings(exceeded)
+	return exceeded
+}
+
+// HookExceededFunc returns an ExceededFunc which logs a warning, and if hook
+// is set, runs it with the directory, its size limit and usage in bytes, and
+// its inode limit and usage as arguments.  The hook is expected to stop
+// whatever is writing to the directory.
+func HookExceededFunc(hook string) ExceededFunc {
+	return func(dir string, quota Quota, usage *directory.DiskUsage) {
+		logrus.Warnf("Disk usage of %s (%d bytes, %d inodes) exceeds its limits (%d bytes, %d inodes)", dir, usage.Size, usage.InodeCount, quota.Size, quota.Inodes)
+		if hook == "" {
+			return
+		}
+		args := []string{
+			dir,
+			strconv.FormatUint(quota.Size, 10),
+			strconv.FormatInt(usage.Size, 10),
+			strconv.FormatUint(quota.Inodes, 10),
+			strconv.FormatInt(usage.InodeCount, 10),
+		}
+		if out, err := exec.Command(hook, args...).CombinedOutput(); err != nil {
+			logrus.Warnf("Error running quota hook %s for %s: %v: %s", hook, dir, err, string(out))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/directory"
+)
+
+func TestPoller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	p := NewPoller(0, func(exceededDir string, quota Quota, usage *directory.DiskUsage) {
+		if exceededDir != dir {
+			t.Errorf("expected %q to be over its limits, got %q", dir, exceededDir)
+		}
+		calls++
+	})
+	defer p.Stop()
+	p.Add(dir, Quota{Size: 1024})
+
+	if exceeded := p.Check(); len(exceeded) != 0 || calls != 0 {
+		t.Fatalf("empty directory was reported as being over its limits: %v", exceeded)
+	}
+	big := filepath.Join(dir, "big")
+	if err := ioutil.WriteFile(big, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if exceeded := p.Check(); len(exceeded) != 1 || exceeded[0] != dir {
+			t.Fatalf("directory wasn't reported as being over its limits: %v", exceeded)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the exceeded function to be called once, got %d", calls)
+	}
+
+	// Once usage has dropped, going over the limits again is reported.
+	if err := os.Remove(big); err != nil {
+		t.Fatal(err)
+	}
+	p.Check()
+	if err := ioutil.WriteFile(big, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p.Check()
+	if calls != 2 {
+		t.Fatalf("expected the exceeded function to be called twice, got %d", calls)
+	}
+
+	p.Remove(dir)
+	if exceeded := p.Check(); len(exceeded) != 0 {
+		t.Fatalf("directory was checked after being removed: %v", exceeded)
+	}
+}
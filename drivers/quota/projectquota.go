@@ -56,6 +56,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -72,9 +73,23 @@ type Quota struct {
 	Inodes uint64
 }
 
+// Usage is the current disk usage of a directory that was configured with
+// SetQuota, along with its limits
+type Usage struct {
+	// Limits are the limits which are set for the directory.  A limit
+	// of 0 means that there is no limit.
+	Limits Quota
+	// Size is the number of bytes which are used.
+	Size uint64
+	// Inodes is the number of inodes which are used.
+	Inodes uint64
+}
+
 // Control - Context to be used by storage driver (e.g. overlay)
 // who wants to apply project quotas to container dirs
 type Control struct {
+	// lock protects nextProjectID and quotas
+	lock              sync.Mutex
 	backingFsBlockDev string
 	nextProjectID     uint32
 	quotas            map[string]uint32
@@ -185,6 +200,8 @@ func NewControl(basePath string) (*Control, error) {
 // SetQuota - assign a unique project id to directory and set the quota limits
 // for that project id
 func (q *Control) SetQuota(targetPath string, quota Quota) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 
 	projectID, ok := q.quotas[targetPath]
 	if !ok {
@@ -264,12 +281,40 @@ func (q *Control) GetDiskUsage(targetPath string, usage *directory.DiskUsage) er
 	return nil
 }
 
+// GetUsage - get the current disk usage and the quota limits of a directory
+// that was configured with SetQuota, using a single quotactl call
+func (q *Control) GetUsage(targetPath string) (*Usage, error) {
+	d, err := q.fsDiskQuotaFromPath(targetPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Usage{
+		Limits: Quota{
+			Size:   uint64(d.d_blk_hardlimit) * 512,
+			Inodes: uint64(d.d_ino_hardlimit),
+		},
+		Size:   uint64(d.d_bcount) * 512,
+		Inodes: uint64(d.d_icount),
+	}, nil
+}
+
 func (q *Control) fsDiskQuotaFromPath(targetPath string) (C.fs_disk_quota_t, error) {
 	var d C.fs_disk_quota_t
 
+	q.lock.Lock()
 	projectID, ok := q.quotas[targetPath]
+	q.lock.Unlock()
 	if !ok {
-		return d, fmt.Errorf("quota not found for path : %s", targetPath)
+		// The directory may have been configured by another process
+		// after we scanned the driver's home directory.
+		projid, err := getProjectID(targetPath)
+		if err != nil || projid == 0 {
+			return d, fmt.Errorf("quota not found for path : %s", targetPath)
+		}
+		projectID = projid
+		q.lock.Lock()
+		q.quotas[targetPath] = projectID
+		q.lock.Unlock()
 	}
 
 	//
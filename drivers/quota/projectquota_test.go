@@ -0,0 +1,27 @@
+// +build linux,!exclude_disk_quota,cgo
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetUsageWithoutQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Directories which weren't given a quota, by us or by another
+	// process, don't have a project ID, so there's nothing to report.
+	q := &Control{quotas: make(map[string]uint32)}
+	if _, err := q.GetUsage(dir); err == nil {
+		t.Fatalf("expected looking up the usage of %q, which has no quota, to fail", dir)
+	}
+	if _, ok := q.quotas[dir]; ok {
+		t.Fatalf("expected %q not to be remembered as having a quota", dir)
+	}
+}
@@ -3,6 +3,7 @@
 package quota
 
 import (
+	"github.com/containers/storage/pkg/directory"
 	"github.com/pkg/errors"
 )
 
@@ -12,6 +13,14 @@ type Quota struct {
 	Inodes uint64
 }
 
+// Usage is the current disk usage of a directory that was configured with
+// SetQuota, along with its limits
+type Usage struct {
+	Limits Quota
+	Size   uint64
+	Inodes uint64
+}
+
 // Control - Context to be used by storage driver (e.g. overlay)
 // who wants to apply project quotas to container dirs
 type Control struct {
@@ -31,3 +40,14 @@ func (q *Control) SetQuota(targetPath string, quota Quota) error {
 func (q *Control) GetQuota(targetPath string, quota *Quota) error {
 	return errors.New("filesystem does not support, or has not enabled quotas")
 }
+
+// GetDiskUsage - get the current disk usage of a directory that was configured with SetQuota
+func (q *Control) GetDiskUsage(targetPath string, usage *directory.DiskUsage) error {
+	return errors.New("filesystem does not support, or has not enabled quotas")
+}
+
+// GetUsage - get the current disk usage and the quota limits of a directory
+// that was configured with SetQuota
+func (q *Control) GetUsage(targetPath string) (*Usage, error) {
+	return nil, errors.New("filesystem does not support, or has not enabled quotas")
+}
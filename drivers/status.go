@@ -0,0 +1,73 @@
+package graphdriver
+
+import (
+	"strconv"
+)
+
+// DriverStatus is a structured form of the diagnostic information which a
+// driver reports using its Status() method.
+type DriverStatus struct {
+	// Name is the name of the driver.
+	Name string `json:"name"`
+	// BackingFilesystem is the name of the file system which holds the
+	// driver's data, if the driver reports it.
+	BackingFilesystem string `json:"backingFilesystem,omitempty"`
+	// Features lists optional features of the driver or the file system
+	// it uses, and whether or not they're available.
+	Features map[string]bool `json:"features,omitempty"`
+	// SupportsShifting is true if the driver can shift the ownership of
+	// the contents of layers when mounting them.
+	SupportsShifting bool `json:"supportsShifting"`
+	// UsingMetacopy is true if the driver's layers use metadata-only
+	// copy-ups.
+	UsingMetacopy bool `json:"usingMetacopy,omitempty"`
+	// NativeDiff is true if the driver computes differences between
+	// layers without comparing their contents to those of their parents.
+	NativeDiff bool `json:"nativeDiff"`
+	// QuotaSupported is true if the driver can limit the size of layers.
+	QuotaSupported bool `json:"quotaSupported,omitempty"`
+	// MountProgram is the helper which the driver uses to mount layers,
+	// if it uses one.
+	MountProgram string `json:"mountProgram,omitempty"`
+	// Degraded, if set, describes how the driver is working around a
+	// limitation of the system, for example by using a slower way to
+	// mount layers, or by being used in place of another driver.
+	Degraded string `json:"degraded,omitempty"`
+	// Details holds the key-value pairs which the driver's Status()
+	// method returns.
+	Details [][2]string `json:"details,omitempty"`
+}
+
+// GetDriverStatus returns structured status information for the driver.  If
+// the driver doesn't implement StructuredStatusDriver, the information is
+// derived from the values that its Status() method returns.
+func GetDriverStatus(driver Driver) *DriverStatus {
+	if s, ok := driver.(StructuredStatusDriver); ok {
+		return s.StructuredStatus()
+	}
+	status := &DriverStatus{
+		Name:             driver.String(),
+		SupportsShifting: driver.SupportsShifting(),
+		Details:          driver.Status(),
+	}
+	for _, pair := range status.Details {
+		switch pair[0] {
+		case "Backing Filesystem":
+			status.BackingFilesystem = pair[1]
+		case "Supports d_type":
+			if supported, err := strconv.ParseBool(pair[1]); err == nil {
+				if status.Features == nil {
+					status.Features = make(map[string]bool)
+				}
+				status.Features["d_type"] = supported
+			}
+		case "Native Overlay Diff":
+			status.NativeDiff, _ = strconv.ParseBool(pair[1])
+		case "Using metacopy":
+			status.UsingMetacopy, _ = strconv.ParseBool(pair[1])
+		case "Degraded Mode":
+			status.Degraded = pair[1]
+		}
+	}
+	return status
+}
@@ -0,0 +1,44 @@
+package graphdriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type statusOnlyDriver struct {
+	Driver
+}
+
+func (statusOnlyDriver) String() string {
+	return "status-only"
+}
+
+func (statusOnlyDriver) SupportsShifting() bool {
+	return true
+}
+
+func (statusOnlyDriver) Status() [][2]string {
+	return [][2]string{
+		{"Backing Filesystem", "xfs"},
+		{"Supports d_type", "true"},
+		{"Native Overlay Diff", "true"},
+		{"Using metacopy", "false"},
+		{"Degraded Mode", "using vfs"},
+		{"Something Else", "42"},
+	}
+}
+
+func TestGetDriverStatusFromStatus(t *testing.T) {
+	driver := statusOnlyDriver{}
+	status := GetDriverStatus(driver)
+	assert.Equal(t, &DriverStatus{
+		Name:              "status-only",
+		BackingFilesystem: "xfs",
+		Features:          map[string]bool{"d_type": true},
+		SupportsShifting:  true,
+		NativeDiff:        true,
+		Degraded:          "using vfs",
+		Details:           driver.Status(),
+	}, status)
+}
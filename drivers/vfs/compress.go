@@ -0,0 +1,239 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/fscrypt"
+	"github.com/containers/storage/pkg/system"
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/sirupsen/logrus"
+)
+
+// Values of the pristine_compression option.
+const (
+	// pristineCompressionNone keeps the contents of all layers in
+	// directories.
+	pristineCompressionNone = "none"
+	// pristineCompressionGzip and pristineCompressionZstd replace the
+	// directories of read-only layers with compressed archives once new
+	// layers have been created from them.
+	pristineCompressionGzip = "gzip"
+	pristineCompressionZstd = "zstd"
+)
+
+const (
+	// compressedDir is where the archives of compressed layers are kept.
+	compressedDir = "compressed"
+	// pristineDir is where we record which layers were created read-only,
+	// and which can therefore be compressed.
+	pristineDir = "pristine"
+	// compressedSuffix is the suffix of the names of compressed layers'
+	// archives.
+	compressedSuffix = ".tar"
+	// compressedRoot is the name of the layer's directory in the archive,
+	// which is included so that its ownership and permissions are kept.
+	compressedRoot = "layer"
+)
+
+// parsePristineCompression converts a value of the pristine_compression option
+// to the compression algorithm which it selects.
+func parsePristineCompression(val string) (archive.Compression, error) {
+	switch strings.ToLower(val) {
+	case "", pristineCompressionNone:
+		return archive.Uncompressed, nil
+	case pristineCompressionGzip:
+		return archive.Gzip, nil
+	case pristineCompressionZstd:
+		return archive.Zstd, nil
+	}
+	return archive.Uncompressed, fmt.Errorf("vfs: pristine_compression must be %q, %q, or %q", pristineCompressionNone, pristineCompressionGzip, pristineCompressionZstd)
+}
+
+// compressedLayer returns the location of the archive which holds the contents
+// of a compressed layer, if the layer has been compressed.
+func (d *Driver) compressedLayer(id string) (string, bool) {
+	for i, home := range d.homes {
+		if i > 0 {
+			home = filepath.Join(home, d.String())
+		}
+		candidate := filepath.Join(home, compressedDir, filepath.Base(id)+compressedSuffix)
+		if fi, err := os.Stat(candidate); err == nil && fi.Mode().IsRegular() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func (d *Driver) pristineMarker(id string) string {
+	return filepath.Join(d.homes[0], pristineDir, filepath.Base(id))
+}
+
+// markPristine records that a layer was created read-only, so that it can be
+// compressed once new layers have been created from it.
+func (d *Driver) markPristine(id string) error {
+	if d.pristineCompression == archive.Uncompressed {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Join(d.homes[0], pristineDir), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.pristineMarker(id), nil, 0600)
+}
+
+// compressPristine replaces the directory of a read-only layer in our home
+// directory with a compressed archive of its contents, if compression is
+// enabled and nothing in this process is using the layer.  The archive is
+// written to a temporary file first, and the layer is locked, and checked to
+// make sure that it wasn't mounted or removed in the meantime, before the
+// archive is put in place of the directory.
+func (d *Driver) compressPristine(id string) error {
+	if d.pristineCompression == archive.Uncompressed {
+		return nil
+	}
+	if _, err := os.Stat(d.pristineMarker(id)); err != nil {
+		return nil
+	}
+	dir := filepath.Join(d.homes[0], "dir", filepath.Base(id))
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil
+	}
+	if _, encrypted, err := fscrypt.Policy(dir); err != nil || encrypted {
+		return nil
+	}
+	if d.mounted(dir) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(d.homes[0], compressedDir), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(d.homes[0], compressedDir), filepath.Base(id)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	// The archive is only ever unpacked by us, so keep timestamps with
+	// full precision, as a copy would, so that comparing a new layer's
+	// contents with an unpacked copy of its parent still works, and keep
+	// the holes in sparse files.
+	rc, err := archive.TarWithOptions(filepath.Dir(dir), &archive.TarOptions{
+		Compression:  d.pristineCompression,
+		IncludeFiles: []string{filepath.Base(dir)},
+		RebaseNames:  map[string]string{filepath.Base(dir): compressedRoot},
+		CopyPass:     true,
+		Sparse:       true,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	if _, err := os.Stat(d.pristineMarker(id)); err != nil {
+		return nil
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil
+	}
+	if d.mounted(dir) {
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(d.homes[0], compressedDir, filepath.Base(id)+compressedSuffix)); err != nil {
+		return err
+	}
+	logrus.Debugf("vfs: compressed layer %s", id)
+	return system.EnsureRemoveAll(dir)
+}
+
+// mounted returns true if Get() has been called for the layer whose directory
+// is dir, and Put() hasn't yet been called as many times.
+func (d *Driver) mounted(dir string) bool {
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	_, ok := d.mounts[dir]
+	return ok
+}
+
+// extractCompressed unpacks the archive of a compressed layer into a directory
+// in the cache directory, which should be removed using removeExtracted() when
+// it is no longer needed.
+func (d *Driver) extractCompressed(id, archivePath string) (string, error) {
+	if err := os.MkdirAll(d.pristineCacheDir, 0700); err != nil {
+		return "", err
+	}
+	dest, err := ioutil.TempDir(d.pristineCacheDir, filepath.Base(id)+"-")
+	if err != nil {
+		return "", err
+	}
+	root, err := d.untarCompressed(archivePath, dest)
+	if err != nil {
+		system.EnsureRemoveAll(dest)
+		return "", err
+	}
+	return root, nil
+}
+
+// removeExtracted removes a directory which extractCompressed() created.
+func removeExtracted(root string) error {
+	return system.EnsureRemoveAll(filepath.Dir(root))
+}
+
+// untarCompressed unpacks the archive of a compressed layer into dest, and
+// returns the location of the layer's directory in it.
+func (d *Driver) untarCompressed(archivePath, dest string) (string, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := archive.Untar(f, dest, &archive.TarOptions{IgnoreChownErrors: d.ignoreChownErrors, Sparse: true}); err != nil {
+		return "", err
+	}
+	root := filepath.Join(dest, compressedRoot)
+	if _, mountLabel, err := label.InitLabels([]string{"level:s0"}); err == nil {
+		label.SetFileLabel(root, mountLabel)
+	}
+	return root, nil
+}
+
+// expand replaces the archive of a compressed layer with a directory, so that
+// the layer's contents can be modified.
+func (d *Driver) expand(id string) error {
+	archivePath, compressed := d.compressedLayer(id)
+	if !compressed {
+		return nil
+	}
+	if !strings.HasPrefix(archivePath, filepath.Join(d.homes[0], compressedDir)+string(os.PathSeparator)) {
+		return fmt.Errorf("vfs: layer %s is compressed in a read-only image store", id)
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(d.homes[0], compressedDir), filepath.Base(id)+"-")
+	if err != nil {
+		return err
+	}
+	defer system.EnsureRemoveAll(tmp)
+	root, err := d.untarCompressed(archivePath, tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(root, filepath.Join(d.homes[0], "dir", filepath.Base(id))); err != nil {
+		return err
+	}
+	return os.Remove(archivePath)
+}
@@ -1,7 +1,14 @@
 package vfs
 
-import "github.com/containers/storage/drivers/copy"
+import (
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
+)
 
 func dirCopy(srcDir, dstDir string) error {
 	return copy.DirCopy(srcDir, dstDir, copy.Content, true)
 }
+
+func dirCopyWithStats(srcDir, dstDir string, progress archive.ProgressFunc) (*copy.Stats, error) {
+	return copy.DirCopyWithProgress(srcDir, dstDir, copy.Content, true, progress)
+}
@@ -2,8 +2,16 @@
 
 package vfs // import "github.com/containers/storage/drivers/vfs"
 
-import "github.com/containers/storage/pkg/chrootarchive"
+import (
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/chrootarchive"
+)
 
 func dirCopy(srcDir, dstDir string) error {
 	return chrootarchive.NewArchiver(nil).CopyWithTar(srcDir, dstDir)
 }
+
+func dirCopyWithStats(srcDir, dstDir string, progress archive.ProgressFunc) (*copy.Stats, error) {
+	return &copy.Stats{}, dirCopy(srcDir, dstDir)
+}
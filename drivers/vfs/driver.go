@@ -3,18 +3,25 @@ package vfs
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/locker"
+	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
 	"github.com/containers/storage/pkg/system"
 	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/vbatts/tar-split/tar/storage"
 )
@@ -26,8 +33,19 @@ var (
 
 const defaultPerms = os.FileMode(0555)
 
+// deletedDir is where DeferredRemove() moves the directories of layers which
+// are being removed.
+const deletedDir = "deleted"
+
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"vfs"},
+	Names:    []string{"ignore_chown_errors", "imagestore", "pristine_cache_dir", "pristine_compression"},
+}
+
 func init() {
 	graphdriver.Register("vfs", Init)
+	graphdriver.RegisterOptionNames("vfs", OptionNames)
 }
 
 // Init returns a new VFS driver.
@@ -37,6 +55,11 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		name:       "vfs",
 		homes:      []string{home},
 		idMappings: idtools.NewIDMappingsFromMaps(options.UIDMaps, options.GIDMaps),
+		mounts:     make(map[string]*bindMount),
+		locker:     locker.New(),
+		degraded:   options.Degraded,
+
+		pristineCacheDir: filepath.Join(home, "cache"),
 	}
 
 	rootIDs := d.idMappings.RootPair()
@@ -63,6 +86,19 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 			if err != nil {
 				return nil, err
 			}
+		case ".pristine_compression", "vfs.pristine_compression":
+			logrus.Debugf("vfs: pristine_compression=%s", val)
+			var err error
+			d.pristineCompression, err = parsePristineCompression(val)
+			if err != nil {
+				return nil, err
+			}
+		case ".pristine_cache_dir", "vfs.pristine_cache_dir":
+			logrus.Debugf("vfs: pristine_cache_dir=%s", val)
+			if !filepath.IsAbs(val) {
+				return nil, fmt.Errorf("vfs: pristine_cache_dir %q is not absolute", val)
+			}
+			d.pristineCacheDir = val
 		default:
 			return nil, fmt.Errorf("vfs driver does not support %s options", key)
 		}
@@ -84,15 +120,92 @@ type Driver struct {
 	ignoreChownErrors bool
 	naiveDiff         graphdriver.DiffDriver
 	updater           graphdriver.LayerIDMapUpdater
+	mountsLock        sync.Mutex
+	mounts            map[string]*bindMount
+	// locker is held for a layer while it's being mounted, unmounted,
+	// removed, renamed, or having its directory replaced with an archive.
+	locker         *locker.Locker
+	copyStatsLock  sync.Mutex
+	copyStats      copy.Stats
+	layerCopyStats map[string]copy.Stats
+	// degraded is set if we're being used in place of another driver.
+	degraded string
+	// pristineCompression is how read-only layers are compressed once
+	// new layers have been created from them, and pristineCacheDir is
+	// where they're unpacked when they're needed.
+	pristineCompression archive.Compression
+	pristineCacheDir    string
+	// reflinks is set if the file system which holds our home directory
+	// can share the contents of files using reflinks.  Checking means
+	// writing to it, so it's only checked once, when it's first needed.
+	reflinksOnce sync.Once
+	reflinks     bool
+}
+
+// bindMount tracks our use of a layer's directory, which we may have bind
+// mounted on top of itself in order to apply mount flags to it.
+type bindMount struct {
+	count int
+	bound bool
+	// path is where the layer's contents are, which is a directory in
+	// the cache directory if the layer is compressed.
+	path      string
+	extracted bool
 }
 
 func (d *Driver) String() string {
 	return "vfs"
 }
 
-// Status is used for implementing the graphdriver.ProtoDriver interface. VFS does not currently have any status information.
+// Status is used for implementing the graphdriver.ProtoDriver interface.  It
+// reports how the contents of files have been copied from parent layers into
+// new layers by this process, and why the driver is being used, if it's being
+// used in place of another one.
 func (d *Driver) Status() [][2]string {
-	return nil
+	d.copyStatsLock.Lock()
+	stats := d.copyStats
+	d.copyStatsLock.Unlock()
+	var status [][2]string
+	if d.degraded != "" {
+		status = append(status, [2]string{"Degraded Mode", d.degraded})
+	}
+	if d.pristineCompression != archive.Uncompressed {
+		status = append(status, [2]string{"Pristine Compression", d.pristineCompression.Extension()})
+	}
+	return append(status, [][2]string{
+		{"Cloned Files", strconv.FormatInt(stats.ClonedFiles, 10)},
+		{"Cloned Bytes", strconv.FormatInt(stats.ClonedBytes, 10)},
+		{"Range-Copied Files", strconv.FormatInt(stats.RangeCopiedFiles, 10)},
+		{"Range-Copied Bytes", strconv.FormatInt(stats.RangeCopiedBytes, 10)},
+		{"Copied Files", strconv.FormatInt(stats.CopiedFiles, 10)},
+		{"Copied Bytes", strconv.FormatInt(stats.CopiedBytes, 10)},
+		{"Preserved Hole Bytes", strconv.FormatInt(stats.HoleBytes, 10)},
+	}...)
+}
+
+// TakeCopyStats returns statistics about how the contents of files were
+// copied into the layer when it was created from its parent, or populated
+// with CopyLayer(), and forgets them.
+func (d *Driver) TakeCopyStats(id string) *copy.Stats {
+	d.copyStatsLock.Lock()
+	defer d.copyStatsLock.Unlock()
+	stats, ok := d.layerCopyStats[id]
+	if !ok {
+		return nil
+	}
+	delete(d.layerCopyStats, id)
+	return &stats
+}
+
+// addCopyStats records statistics about copying files into a layer.
+func (d *Driver) addCopyStats(id string, stats copy.Stats) {
+	d.copyStatsLock.Lock()
+	defer d.copyStatsLock.Unlock()
+	d.copyStats.Add(stats)
+	if d.layerCopyStats == nil {
+		d.layerCopyStats = make(map[string]copy.Stats)
+	}
+	d.layerCopyStats[id] = stats
 }
 
 // Metadata is used for implementing the graphdriver.ProtoDriver interface. VFS does not currently have any meta data.
@@ -116,10 +229,28 @@ func (f fileGetNilCloser) Close() error {
 // DiffGetter returns a FileGetCloser that can read files from the directory that
 // contains files for the layer differences. Used for direct access for tar-split.
 func (d *Driver) DiffGetter(id string) (graphdriver.FileGetCloser, error) {
+	if _, compressed := d.compressedLayer(id); compressed {
+		p, err := d.Get(id, graphdriver.MountOpts{})
+		if err != nil {
+			return nil, err
+		}
+		return fileGetPutCloser{storage.NewPathFileGetter(p), func() error { return d.Put(id) }}, nil
+	}
 	p := d.dir(id)
 	return fileGetNilCloser{storage.NewPathFileGetter(p)}, nil
 }
 
+// fileGetPutCloser reads files from a compressed layer which has been unpacked
+// for it, and releases the unpacked copy when it's closed.
+type fileGetPutCloser struct {
+	storage.FileGetter
+	put func() error
+}
+
+func (f fileGetPutCloser) Close() error {
+	return f.put()
+}
+
 // CreateFromTemplate creates a layer with the same contents and parent as another layer.
 func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idtools.IDMappings, parent string, parentIDMappings *idtools.IDMappings, opts *graphdriver.CreateOpts, readWrite bool) error {
 	if readWrite {
@@ -133,6 +264,9 @@ func (d *Driver) ApplyDiff(id, parent string, options graphdriver.ApplyDiffOpts)
 	if d.ignoreChownErrors {
 		options.IgnoreChownErrors = d.ignoreChownErrors
 	}
+	if err := d.expand(id); err != nil {
+		return -1, err
+	}
 	return d.naiveDiff.ApplyDiff(id, parent, options)
 }
 
@@ -170,8 +304,18 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, ro bool
 	}()
 
 	rootPerms := defaultPerms
+	parentDir := ""
 	if parent != "" {
-		st, err := system.Stat(d.dir(parent))
+		var err error
+		if parentDir, err = d.Get(parent, graphdriver.MountOpts{}); err != nil {
+			return fmt.Errorf("%s: %s", parent, err)
+		}
+		defer func() {
+			if parentDir != "" {
+				d.Put(parent)
+			}
+		}()
+		st, err := system.Stat(parentDir)
 		if err != nil {
 			return err
 		}
@@ -182,24 +326,95 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, ro bool
 	if err := idtools.MkdirAndChown(dir, rootPerms, rootIDs); err != nil {
 		return err
 	}
+	if opts != nil && len(opts.EncryptionKey) > 0 {
+		if err := fscrypt.EncryptDirectory(dir, opts.EncryptionKey); err != nil {
+			return err
+		}
+	}
 	labelOpts := []string{"level:s0"}
 	if _, mountLabel, err := label.InitLabels(labelOpts); err == nil {
 		label.SetFileLabel(dir, mountLabel)
 	}
+	// Encrypted layers are never compressed, since their contents would
+	// be written to the archive in the clear.
+	if ro && (opts == nil || len(opts.EncryptionKey) == 0) {
+		if err := d.markPristine(id); err != nil {
+			return err
+		}
+	}
 	if parent != "" {
-		parentDir, err := d.Get(parent, graphdriver.MountOpts{})
-		if err != nil {
-			return fmt.Errorf("%s: %s", parent, err)
+		var progress archive.ProgressFunc
+		if opts != nil {
+			progress = opts.Progress
 		}
-		if err := dirCopy(parentDir, dir); err != nil {
+		stats, err := dirCopyWithStats(parentDir, dir, progress)
+		if err != nil {
 			return err
 		}
+		logrus.Debugf("vfs: copied %s into %s: cloned %d files (%d bytes), range-copied %d files (%d bytes), copied %d files (%d bytes), preserved %d bytes of holes",
+			parent, id, stats.ClonedFiles, stats.ClonedBytes, stats.RangeCopiedFiles, stats.RangeCopiedBytes, stats.CopiedFiles, stats.CopiedBytes, stats.HoleBytes)
+		d.addCopyStats(id, *stats)
+
+		// Now that the parent's contents have been copied, it only
+		// needs to be read occasionally, so compress it if we can,
+		// unless someone else may be using its directory.
+		parentDir = ""
+		if err := d.Put(parent); err != nil {
+			logrus.Debugf("vfs: error releasing layer %s: %v", parent, err)
+		}
+		if opts == nil || !opts.ParentMounted {
+			if err := d.compressPristine(parent); err != nil {
+				logrus.Warnf("vfs: error compressing layer %s: %v", parent, err)
+			}
+		}
 	}
 
 	return nil
 
 }
 
+// AddEncryptionKey adds a key to the file system which holds the layer's
+// contents.
+func (d *Driver) AddEncryptionKey(id string, key []byte) error {
+	_, err := fscrypt.AddKey(filepath.Dir(d.dir(id)), key)
+	return err
+}
+
+// CopyLayer replaces the contents of a layer with those of a layer which
+// another vfs driver manages.
+func (d *Driver) CopyLayer(id string, src graphdriver.Driver, srcID string) error {
+	srcDriver, ok := src.(*Driver)
+	if !ok {
+		return errors.Wrapf(graphdriver.ErrNotSupported, "copying layers from %s driver", src.String())
+	}
+	if err := d.expand(id); err != nil {
+		return err
+	}
+	dir := d.dir(id)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	srcDir, err := srcDriver.Get(srcID, graphdriver.MountOpts{})
+	if err != nil {
+		return err
+	}
+	defer srcDriver.Put(srcID)
+	stats, err := dirCopyWithStats(srcDir, dir, nil)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("vfs: copied %s from %s: cloned %d files (%d bytes), range-copied %d files (%d bytes), copied %d files (%d bytes), preserved %d bytes of holes",
+		id, srcDriver.homes[0], stats.ClonedFiles, stats.ClonedBytes, stats.RangeCopiedFiles, stats.RangeCopiedBytes, stats.CopiedFiles, stats.CopiedBytes, stats.HoleBytes)
+	d.addCopyStats(id, *stats)
+	return nil
+}
+
 func (d *Driver) dir(id string) string {
 	for i, home := range d.homes {
 		if i > 0 {
@@ -214,48 +429,248 @@ func (d *Driver) dir(id string) string {
 	return filepath.Join(d.homes[0], "dir", filepath.Base(id))
 }
 
+// ListLayers returns the IDs of the layers which have directories in the
+// driver's home directory.
+func (d *Driver) ListLayers() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(d.homes[0], "dir"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var layers []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			layers = append(layers, entry.Name())
+		}
+	}
+	compressed, err := ioutil.ReadDir(filepath.Join(d.homes[0], compressedDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range compressed {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), compressedSuffix) {
+			layers = append(layers, strings.TrimSuffix(entry.Name(), compressedSuffix))
+		}
+	}
+	return layers, nil
+}
+
 // Remove deletes the content from the directory for a given id.
 func (d *Driver) Remove(id string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	d.TakeCopyStats(id)
+	if err := os.Remove(filepath.Join(d.homes[0], compressedDir, filepath.Base(id)+compressedSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(d.pristineMarker(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return system.EnsureRemoveAll(d.dir(id))
 }
 
-// Get returns the directory for the given id.
+// RenameLayer changes the ID of a layer which isn't mounted.
+func (d *Driver) RenameLayer(id, newID string) error {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	d.locker.Lock(newID)
+	defer d.locker.Unlock(newID)
+	if err := d.expand(id); err != nil {
+		return err
+	}
+	dir := d.dir(id)
+	if filepath.Dir(dir) != filepath.Join(d.homes[0], "dir") {
+		return fmt.Errorf("vfs: layer %s is in a read-only image store", id)
+	}
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	if m, ok := d.mounts[dir]; ok && m.count > 0 {
+		return fmt.Errorf("vfs: layer %s is mounted", id)
+	}
+	newDir := filepath.Join(d.homes[0], "dir", filepath.Base(newID))
+	if _, err := os.Lstat(newDir); err == nil {
+		return fmt.Errorf("vfs: layer %s already exists", newID)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(dir, newDir); err != nil {
+		return err
+	}
+	if err := os.Rename(d.pristineMarker(id), d.pristineMarker(newID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.copyStatsLock.Lock()
+	if stats, ok := d.layerCopyStats[id]; ok {
+		delete(d.layerCopyStats, id)
+		d.layerCopyStats[newID] = stats
+	}
+	d.copyStatsLock.Unlock()
+	return nil
+}
+
+// DeferredRemove does what Remove() does, except that the layer's directory
+// is moved out of the way, and its new location is returned so that the
+// caller can remove it.
+func (d *Driver) DeferredRemove(id string) (string, error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	d.TakeCopyStats(id)
+	if err := os.Remove(filepath.Join(d.homes[0], compressedDir, filepath.Base(id)+compressedSuffix)); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.Remove(d.pristineMarker(id)); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	dir := d.dir(id)
+	moved, err := graphdriver.DeferRemoveDir(dir, filepath.Join(filepath.Dir(filepath.Dir(dir)), deletedDir))
+	if err != nil {
+		logrus.Debugf("Removing layer %s now: %v", id, err)
+		if err := system.EnsureRemoveAll(dir); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	return moved, nil
+}
+
+// DeferredRemovalDirs returns the directory into which DeferredRemove() moves
+// layer directories.
+func (d *Driver) DeferredRemovalDirs() []string {
+	return []string{filepath.Join(d.homes[0], deletedDir)}
+}
+
+// Get returns the directory for the given id.  If the "nosuid", "nodev", or
+// "noexec" options are requested, the directory is bind mounted on top of
+// itself with those flags set.
 func (d *Driver) Get(id string, options graphdriver.MountOpts) (_ string, retErr error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
 	dir := d.dir(id)
-	switch len(options.Options) {
-	case 0:
-	case 1:
-		if options.Options[0] == "ro" {
+	var bindOptions []string
+	for _, option := range options.Options {
+		switch {
+		case option == "ro":
 			// ignore "ro" option
-			break
+		case bindMountFlags[option] != 0:
+			bindOptions = append(bindOptions, option)
+		default:
+			return "", fmt.Errorf("vfs driver does not support mount option %q", option)
 		}
-		fallthrough
-	default:
-		return "", fmt.Errorf("vfs driver does not support mount options")
 	}
-	if st, err := os.Stat(dir); err != nil {
-		return "", err
-	} else if !st.IsDir() {
-		return "", fmt.Errorf("%s: not a directory", dir)
+	archivePath, compressed := d.compressedLayer(id)
+	if !compressed {
+		if st, err := os.Stat(dir); err != nil {
+			return "", err
+		} else if !st.IsDir() {
+			return "", fmt.Errorf("%s: not a directory", dir)
+		}
 	}
-	return dir, nil
+
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	m, ok := d.mounts[dir]
+	if !ok {
+		m = &bindMount{path: dir}
+		if compressed {
+			extracted, err := d.extractCompressed(id, archivePath)
+			if err != nil {
+				return "", err
+			}
+			m.path = extracted
+			m.extracted = true
+		}
+		d.mounts[dir] = m
+	}
+	if m.count == 0 && len(bindOptions) > 0 {
+		if err := bindMountWithOptions(m.path, bindOptions); err != nil {
+			if !ok {
+				delete(d.mounts, dir)
+				if m.extracted {
+					removeExtracted(m.path)
+				}
+			}
+			return "", err
+		}
+		m.bound = true
+	}
+	if options.Relabel != "" && options.MountLabel != "" {
+		if err := label.Relabel(m.path, options.MountLabel, options.Relabel == graphdriver.MountRelabelShared); err != nil {
+			if !ok {
+				delete(d.mounts, dir)
+				if m.bound {
+					if err := unmountBind(m.path); err != nil {
+						logrus.Debugf("vfs: error unmounting %s: %v", m.path, err)
+					}
+				}
+				if m.extracted {
+					removeExtracted(m.path)
+				}
+			}
+			return "", errors.Wrapf(err, "relabeling %q", m.path)
+		}
+	}
+	m.count++
+	return m.path, nil
 }
 
-// Put is a noop for vfs that return nil for the error, since this driver has no runtime resources to clean up.
+// Put removes the bind mount that Get may have created for the given id, once
+// nothing in this process is using it any more.
 func (d *Driver) Put(id string) error {
-	// The vfs driver has no runtime resources (e.g. mounts)
-	// to clean up, so we don't need anything here
-	return nil
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	dir := d.dir(id)
+
+	d.mountsLock.Lock()
+	defer d.mountsLock.Unlock()
+	m, ok := d.mounts[dir]
+	if ok {
+		if m.count > 1 {
+			m.count--
+			return nil
+		}
+		delete(d.mounts, dir)
+		if m.extracted {
+			defer func() {
+				if err := removeExtracted(m.path); err != nil {
+					logrus.Debugf("vfs: error removing unpacked copy of layer %s: %v", id, err)
+				}
+			}()
+		}
+		if !m.bound {
+			return nil
+		}
+		dir = m.path
+	} else {
+		// We didn't call Get() for this layer, so if it's mounted,
+		// the layer store is asking us to clean up after another
+		// process.
+		if mounted, err := mount.Mounted(dir); err != nil || !mounted {
+			return err
+		}
+	}
+	return unmountBind(dir)
 }
 
 // ReadWriteDiskUsage returns the disk usage of the writable directory for the ID.
 // For VFS, it queries the directory for this ID.
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
+	if archivePath, compressed := d.compressedLayer(id); compressed {
+		st, err := os.Stat(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		return &directory.DiskUsage{Size: st.Size(), InodeCount: 1}, nil
+	}
 	return directory.Usage(d.dir(id))
 }
 
 // Exists checks to see if the directory exists for the given id.
 func (d *Driver) Exists(id string) bool {
+	if _, compressed := d.compressedLayer(id); compressed {
+		return true
+	}
 	_, err := os.Stat(d.dir(id))
 	return err == nil
 }
@@ -268,6 +683,19 @@ func (d *Driver) AdditionalImageStores() []string {
 	return nil
 }
 
+// Capabilities reports which optional features the driver and the file
+// system that it uses provide.  Layers are full copies of their parents, so
+// the contents of files are shared only if reflinks can be used.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	d.reflinksOnce.Do(func() {
+		d.reflinks = copy.SupportsReflinks(d.homes[0])
+	})
+	return graphdriver.Capabilities{
+		Reflinks:         d.reflinks,
+		SupportsShifting: d.SupportsShifting(),
+	}
+}
+
 // SupportsShifting tells whether the driver support shifting of the UIDs/GIDs in an userNS
 func (d *Driver) SupportsShifting() bool {
 	return d.updater.SupportsShifting()
@@ -276,6 +704,9 @@ func (d *Driver) SupportsShifting() bool {
 // UpdateLayerIDMap updates ID mappings in a from matching the ones specified
 // by toContainer to those specified by toHost.
 func (d *Driver) UpdateLayerIDMap(id string, toContainer, toHost *idtools.IDMappings, mountLabel string) error {
+	if err := d.expand(id); err != nil {
+		return err
+	}
 	return d.updater.UpdateLayerIDMap(id, toContainer, toHost, mountLabel)
 }
 
@@ -291,6 +722,12 @@ func (d *Driver) Diff(id string, idMappings *idtools.IDMappings, parent string,
 	return d.naiveDiff.Diff(id, idMappings, parent, parentMappings, mountLabel)
 }
 
+// SparseDiff is like Diff, but regular files which have holes in them are
+// stored as sparse entries.
+func (d *Driver) SparseDiff(id string, idMappings *idtools.IDMappings, parent string, parentMappings *idtools.IDMappings, mountLabel string) (io.ReadCloser, error) {
+	return d.naiveDiff.(graphdriver.SparseDiffDriver).SparseDiff(id, idMappings, parent, parentMappings, mountLabel)
+}
+
 // DiffSize calculates the changes between the specified id
 // and its parent and returns the size in bytes of the changes
 // relative to its base filesystem directory.
@@ -0,0 +1,41 @@
+package vfs
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bindMountFlags maps the mount options which we can enforce on a layer's
+// directory by bind mounting it to the corresponding mount flags.
+var bindMountFlags = map[string]uintptr{
+	"nosuid": unix.MS_NOSUID,
+	"nodev":  unix.MS_NODEV,
+	"noexec": unix.MS_NOEXEC,
+}
+
+// bindMountWithOptions bind mounts dir on top of itself, and then remounts
+// the bind mount with the flags that correspond to options.
+func bindMountWithOptions(dir string, options []string) error {
+	var flags uintptr
+	for _, option := range options {
+		flags |= bindMountFlags[option]
+	}
+	if err := unix.Mount(dir, dir, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "bind mounting %q", dir)
+	}
+	if err := unix.Mount("", dir, "", unix.MS_BIND|unix.MS_REMOUNT|flags, ""); err != nil {
+		if err2 := unix.Unmount(dir, unix.MNT_DETACH); err2 != nil {
+			return errors.Wrapf(err, "remounting %q (and unmounting it: %v)", dir, err2)
+		}
+		return errors.Wrapf(err, "remounting %q", dir)
+	}
+	return nil
+}
+
+// unmountBind removes a bind mount created by bindMountWithOptions.
+func unmountBind(dir string) error {
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return errors.Wrapf(err, "unmounting %q", dir)
+	}
+	return nil
+}
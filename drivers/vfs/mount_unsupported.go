@@ -0,0 +1,17 @@
+// +build !linux
+
+package vfs
+
+import "fmt"
+
+// bindMountFlags maps the mount options which we can enforce on a layer's
+// directory by bind mounting it to the corresponding mount flags.
+var bindMountFlags = map[string]uintptr{}
+
+func bindMountWithOptions(dir string, options []string) error {
+	return fmt.Errorf("vfs driver does not support mount options %v on this platform", options)
+}
+
+func unmountBind(dir string) error {
+	return nil
+}
@@ -3,11 +3,16 @@
 package vfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/drivers/graphtest"
-
+	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/reexec"
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -36,6 +41,51 @@ func TestVfsCreateFromTemplate(t *testing.T) {
 	graphtest.DriverTestCreateFromTemplate(t, "vfs")
 }
 
+func TestVfsMountFlags(t *testing.T) {
+	driver := graphtest.GetDriver(t, "vfs")
+	defer graphtest.PutDriver(t)
+	if unix.Geteuid() != 0 {
+		t.Skip("bind mounting requires root")
+	}
+
+	if err := driver.Create("mount-flags", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Remove("mount-flags")
+
+	if _, err := driver.Get("mount-flags", graphdriver.MountOpts{Options: []string{"suid"}}); err == nil {
+		t.Fatalf("expected an unsupported mount option to be rejected")
+	}
+
+	dir, err := driver.Get("mount-flags", graphdriver.MountOpts{Options: []string{"nosuid", "nodev", "noexec"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second, plain user of the layer mustn't remove the bind mount.
+	if _, err := driver.Get("mount-flags", graphdriver.MountOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Put("mount-flags"); err != nil {
+		t.Fatal(err)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []int64{unix.ST_NOSUID, unix.ST_NODEV, unix.ST_NOEXEC} {
+		if int64(st.Flags)&flag == 0 {
+			t.Errorf("expected %q to be mounted with flag %#x, flags are %#x", dir, flag, st.Flags)
+		}
+	}
+
+	if err := driver.Put("mount-flags"); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, err := mount.Mounted(dir); err != nil || mounted {
+		t.Fatalf("expected %q to be unmounted: %v, %v", dir, mounted, err)
+	}
+}
+
 func TestVfsTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -51,3 +101,98 @@ func TestVfsChanges(t *testing.T) {
 func TestVfsEcho(t *testing.T) {
 	graphtest.DriverTestEcho(t, "vfs")
 }
+
+func TestVfsCompressedCreateSnap(t *testing.T) {
+	graphtest.DriverTestCreateSnap(t, "vfs", "vfs.pristine_compression=zstd")
+}
+
+func TestVfsCompressedDiffApply10Files(t *testing.T) {
+	graphtest.DriverTestDiffApply(t, 10, "vfs", "vfs.pristine_compression=gzip")
+}
+
+func TestVfsCompressedChanges(t *testing.T) {
+	graphtest.DriverTestChanges(t, "vfs", "vfs.pristine_compression=zstd")
+}
+
+func TestVfsPristineCompression(t *testing.T) {
+	home, err := ioutil.TempDir("", "vfs-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	driver, err := Init(home, graphdriver.Options{DriverOptions: []string{"vfs.pristine_compression=zstd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := driver.(*Driver)
+
+	if err := d.Create("base", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := d.Get("base", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("base"); err != nil {
+		t.Fatal(err)
+	}
+	if _, compressed := d.compressedLayer("base"); compressed {
+		t.Fatalf("layer was compressed before anything was created from it")
+	}
+
+	// Once a layer has been created from it, the read-only layer is
+	// compressed, but its contents are still available.
+	if err := d.CreateReadWrite("container", "base", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, compressed := d.compressedLayer("base"); !compressed {
+		t.Fatalf("layer was not compressed after a layer was created from it")
+	}
+	if _, compressed := d.compressedLayer("container"); compressed {
+		t.Fatalf("read/write layer was compressed")
+	}
+	if !d.Exists("base") {
+		t.Fatalf("compressed layer does not exist")
+	}
+	layers, err := d.ListLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("expected 2 layers, got %v", layers)
+	}
+	dir, err = d.Get("base", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(data) != "contents" {
+		t.Fatalf("unexpected contents of compressed layer: %q, %v", string(data), err)
+	}
+	if err := d.Put("base"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("unpacked copy of compressed layer was not removed: %v", err)
+	}
+
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Exists("base") {
+		t.Fatalf("compressed layer still exists after being removed")
+	}
+
+	// A layer which someone else has mounted is left alone.
+	if err := d.Create("mounted", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("other", "mounted", &graphdriver.CreateOpts{ParentMounted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, compressed := d.compressedLayer("mounted"); compressed {
+		t.Fatalf("mounted layer was compressed")
+	}
+}
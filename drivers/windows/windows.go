@@ -51,9 +51,15 @@ var (
 	noreexec = false
 )
 
+// OptionNames lists the options which the driver accepts, which is none.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"windowsfilter"},
+}
+
 // init registers the windows graph drivers to the register.
 func init() {
 	graphdriver.Register("windowsfilter", InitFilter)
+	graphdriver.RegisterOptionNames("windowsfilter", OptionNames)
 	// DOCKER_WINDOWSFILTER_NOREEXEC allows for inline processing which makes
 	// debugging issues in the re-exec codepath significantly easier.
 	if os.Getenv("DOCKER_WINDOWSFILTER_NOREEXEC") != "" {
@@ -0,0 +1,99 @@
+// +build linux freebsd
+
+package zfs
+
+import (
+	"os"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/mistifyio/go-zfs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// backupSnapshot is the name of the snapshot which FreezeLayer() takes.
+const backupSnapshot = "backup"
+
+// backupPath is where the snapshot of a frozen layer is mounted.  It exists
+// for as long as the layer is frozen.
+func (d *Driver) backupPath(id string) string {
+	return path.Join(d.options.mountPath, "backups", id)
+}
+
+// FreezeLayer takes a snapshot of the layer's dataset and mounts it, until
+// ThawLayer() is called.  The layer itself can go on being used normally, but
+// it can't be removed while the snapshot exists.
+func (d *Driver) FreezeLayer(id string) (retErr error) {
+	if !d.Exists(id) {
+		return errors.Wrapf(graphdriver.ErrLayerUnknown, "zfs: layer %s", id)
+	}
+	mountpoint := d.backupPath(id)
+	if err := os.MkdirAll(path.Dir(mountpoint), 0700); err != nil {
+		return err
+	}
+	if err := os.Mkdir(mountpoint, 0700); err != nil {
+		if os.IsExist(err) {
+			return errors.Wrapf(graphdriver.ErrLayerFrozen, "zfs: layer %s", id)
+		}
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := unix.Rmdir(mountpoint); err != nil {
+				logrus.WithField("storage-driver", "zfs").Debugf("Failed to remove %s: %v", mountpoint, err)
+			}
+		}
+	}()
+	dataset := zfs.Dataset{Name: d.zfsPath(id)}
+	snapshot, err := dataset.Snapshot(backupSnapshot, false)
+	if err != nil {
+		return err
+	}
+	if err := mount.Mount(snapshot.Name, mountpoint, "zfs", "ro"); err != nil {
+		if err2 := snapshot.Destroy(zfs.DestroyDefault); err2 != nil {
+			logrus.WithField("storage-driver", "zfs").Errorf("Failed to destroy snapshot %s: %v", snapshot.Name, err2)
+		}
+		return errors.Wrapf(err, "mounting snapshot %s", snapshot.Name)
+	}
+	return nil
+}
+
+// ThawLayer unmounts and destroys the snapshot which FreezeLayer() took.
+func (d *Driver) ThawLayer(id string) error {
+	mountpoint := d.backupPath(id)
+	if err := checkFrozen(id, mountpoint); err != nil {
+		return err
+	}
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return errors.Wrapf(err, "unmounting %s", mountpoint)
+	}
+	snapshot := zfs.Dataset{Name: d.zfsPath(id) + "@" + backupSnapshot}
+	if err := snapshot.Destroy(zfs.DestroyDefault); err != nil {
+		return err
+	}
+	return unix.Rmdir(mountpoint)
+}
+
+// BackupFiles lists the files in the snapshot which FreezeLayer() took.
+func (d *Driver) BackupFiles(id string) ([]graphdriver.BackupFile, error) {
+	mountpoint := d.backupPath(id)
+	if err := checkFrozen(id, mountpoint); err != nil {
+		return nil, err
+	}
+	return graphdriver.ListBackupFiles(mountpoint, nil)
+}
+
+// checkFrozen returns an error if there is no snapshot of the layer mounted
+// at mountpoint.
+func checkFrozen(id, mountpoint string) error {
+	if _, err := os.Stat(mountpoint); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("zfs: layer %s is not frozen", id)
+		}
+		return err
+	}
+	return nil
+}
@@ -32,8 +32,15 @@ type zfsOptions struct {
 
 const defaultPerms = os.FileMode(0555)
 
+// OptionNames lists the options which the driver accepts.
+var OptionNames = graphdriver.OptionNames{
+	Prefixes: []string{"zfs"},
+	Names:    []string{"fsname", "mountopt"},
+}
+
 func init() {
 	graphdriver.Register("zfs", Init)
+	graphdriver.RegisterOptionNames("zfs", OptionNames)
 }
 
 // Logger returns a zfs logger implementation.
@@ -186,6 +193,16 @@ func (d *Driver) String() string {
 	return "zfs"
 }
 
+// Capabilities reports which optional features the driver provides.  Layers
+// are clones of snapshots of their parents, and their sizes can be limited
+// using quotas.
+func (d *Driver) Capabilities() graphdriver.Capabilities {
+	return graphdriver.Capabilities{
+		Snapshots: true,
+		Quota:     true,
+	}
+}
+
 // Cleanup is called on when program exits, it is a no-op for ZFS.
 func (d *Driver) Cleanup() error {
 	return nil
@@ -369,6 +386,23 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts) error {
 	return err
 }
 
+// SnapshotLayer creates a layer which is a clone of a snapshot of the layer
+// with the specified ID, and then promotes it, so that the layer becomes a
+// clone of the new one, and can be removed before it is.
+func (d *Driver) SnapshotLayer(id, parent, snapshotID string) error {
+	name := d.zfsPath(snapshotID)
+	if err := d.cloneFilesystem(name, d.zfsPath(id)); err != nil {
+		return err
+	}
+	if out, err := exec.Command("zfs", "promote", name).CombinedOutput(); err != nil {
+		if err2 := d.Remove(snapshotID); err2 != nil {
+			logrus.Errorf("While recovering from a failure promoting %s, error deleting it: %v", name, err2)
+		}
+		return errors.Wrapf(err, "promoting %s: %s", name, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
 func parseStorageOpt(storageOpt map[string]string) (string, error) {
 	// Read size to change the disk quota per container
 	for k, v := range storageOpt {
@@ -396,6 +430,9 @@ func setQuota(name string, quota string) error {
 
 // Remove deletes the dataset, filesystem and the cache for the given id.
 func (d *Driver) Remove(id string) error {
+	if _, err := os.Stat(d.backupPath(id)); err == nil {
+		return errors.Wrapf(graphdriver.ErrLayerFrozen, "zfs: layer %s", id)
+	}
 	name := d.zfsPath(id)
 	dataset := zfs.Dataset{Name: name}
 	err := dataset.Destroy(zfs.DestroyRecursive)
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	drivers "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// newLayerKeyID returns the ID of the key which a new layer's contents should
+// be encrypted with: the one which the caller specified, or the one which its
+// parent's contents are encrypted with, or the store's default, if any.
+func (r *layerStore) newLayerKeyID(parent *Layer, moreOptions *LayerOptions) string {
+	switch {
+	case moreOptions != nil && moreOptions.EncryptionKeyID != "":
+		return moreOptions.EncryptionKeyID
+	case parent != nil && parent.EncryptionKeyID != "":
+		return parent.EncryptionKeyID
+	}
+	return r.encryptionKeyID
+}
+
+// encryptionKey obtains the key with the specified ID from the store's key
+// provider, after checking that the driver can use it.
+func (r *layerStore) encryptionKey(keyID string) ([]byte, error) {
+	if r.keyProvider == nil {
+		return nil, errors.Wrapf(ErrIncompleteOptions, "no encryption key provider was set, so encryption key %q can't be used", keyID)
+	}
+	if _, ok := r.driver.(drivers.EncryptionDriver); !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "the %q driver can't encrypt the contents of layers", r.driver.String())
+	}
+	key, err := r.keyProvider(keyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "obtaining encryption key %q", keyID)
+	}
+	return key, nil
+}
+
+// loadedKeyName returns the name under which we record that the key which a
+// layer's contents are encrypted with has been added to the file system
+// which holds them.
+func loadedKeyName(layer *Layer) string {
+	return layer.ImageStore + "\x00" + layer.EncryptionKeyID
+}
+
+// loadEncryptionKeys adds the keys which the contents of layers are encrypted
+// with to the file systems which hold them, if they haven't been added
+// already, so that the layers can be used.  A key which can't be added only
+// keeps the layers which were encrypted with it from being used, so failures
+// are logged rather than returned.
+func (r *layerStore) loadEncryptionKeys() {
+	if r.keyProvider == nil {
+		return
+	}
+	driver, ok := r.driver.(drivers.EncryptionDriver)
+	if !ok {
+		return
+	}
+	tried := make(map[string]bool)
+	for _, layer := range r.layers {
+		name := loadedKeyName(layer)
+		if layer.EncryptionKeyID == "" || r.loadedKeys[name] || tried[name] {
+			continue
+		}
+		tried[name] = true
+		key, err := r.encryptionKey(layer.EncryptionKeyID)
+		if err == nil {
+			err = driver.AddEncryptionKey(layer.ID, key)
+		}
+		if err != nil {
+			logrus.Warnf("Layers encrypted with key %q can't be used: %v", layer.EncryptionKeyID, err)
+			continue
+		}
+		r.loadedKeys[name] = true
+	}
+}
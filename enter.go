@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// EnterMountOptions controls how EnterMount runs a command in a mounted
+// image, layer, or container.
+type EnterMountOptions struct {
+	// Command is the command to run, along with its arguments.  If it is
+	// not set, $SHELL, or /bin/sh if $SHELL is not set, is run.
+	Command []string
+	// Chroot runs the command with the mounted filesystem as its root
+	// directory, so the command is looked up inside of it, rather than
+	// only as its working directory.
+	Chroot bool
+	// MountOptions are passed to MountImage when mounting an image.
+	MountOptions []string
+	// MountLabel is the SELinux label to mount the filesystem with.
+	MountLabel string
+	// Stdin, Stdout, and Stderr are connected to the command.  If they
+	// are not set, the calling process's own are used.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (s *store) EnterMount(id string, options *EnterMountOptions) (err error) {
+	if options == nil {
+		options = &EnterMountOptions{}
+	}
+	command := options.Command
+	if len(command) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		command = []string{shell}
+	}
+
+	var mountPoint string
+	var unmount func() error
+	if image, err2 := s.Image(id); err2 == nil {
+		if mountPoint, err = s.MountImage(image.ID, options.MountOptions, options.MountLabel); err != nil {
+			return err
+		}
+		unmount = func() error {
+			_, err := s.UnmountImage(image.ID, false)
+			return err
+		}
+	} else {
+		if mountPoint, err = s.Mount(id, options.MountLabel); err != nil {
+			return err
+		}
+		unmount = func() error {
+			_, err := s.Unmount(id, false)
+			return err
+		}
+	}
+	defer func() {
+		if err2 := unmount(); err2 != nil {
+			if err == nil {
+				err = err2
+			} else {
+				err = errors.Wrapf(err, "unmounting %q: %v", id, err2)
+			}
+		}
+	}()
+
+	return runInMount(mountPoint, command, options)
+}
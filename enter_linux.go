@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const enterMountCommand = "storage-enter-mount"
+
+func init() {
+	reexec.Register(enterMountCommand, enterMountMain)
+}
+
+// runInMount runs the command in a child process in a new mount namespace,
+// with the mount point as its working directory or root directory.
+func runInMount(mountPoint string, command []string, options *EnterMountOptions) error {
+	if os.Geteuid() != 0 {
+		return errors.Wrapf(ErrNotSupported, "entering a mount requires running as root or in a user namespace")
+	}
+	chroot := "0"
+	if options.Chroot {
+		chroot = "1"
+	}
+	cmd := unshare.Command(append([]string{enterMountCommand, mountPoint, chroot}, command...)...)
+	cmd.UnshareFlags = syscall.CLONE_NEWNS
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if options.Stdin != nil {
+		cmd.Stdin = options.Stdin
+	}
+	if options.Stdout != nil {
+		cmd.Stdout = options.Stdout
+	}
+	if options.Stderr != nil {
+		cmd.Stderr = options.Stderr
+	}
+	// Keep signals which would otherwise kill us from preventing our
+	// caller from unmounting the filesystem once the command exits.
+	// Signals which a terminal sends to its foreground process group
+	// already reach the command, so we only pass the others along to it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGQUIT, unix.SIGTERM, unix.SIGHUP)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "running %v in %q", command, mountPoint)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == unix.SIGTERM || sig == unix.SIGHUP {
+					if err := cmd.Process.Signal(sig); err != nil {
+						logrus.Debugf("passing signal %v to %v: %v", sig, command, err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "running %v in %q", command, mountPoint)
+	}
+	return nil
+}
+
+// enterMountMain runs in the child process, in its new mount namespace.  It
+// keeps the mounts which the command might make from propagating back to the
+// host, moves into the mounted filesystem, and then execs the command.
+func enterMountMain() {
+	fatal := func(err error) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if len(os.Args) < 4 {
+		fatal(errors.Errorf("usage: %s mountpoint chroot command [args ...]", os.Args[0]))
+	}
+	mountPoint, chroot, command := os.Args[1], os.Args[2] == "1", os.Args[3:]
+
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		fatal(errors.Wrapf(err, "making mounts private"))
+	}
+	if chroot {
+		if err := unix.Chroot(mountPoint); err != nil {
+			fatal(errors.Wrapf(err, "changing root directory to %q", mountPoint))
+		}
+		mountPoint = "/"
+	}
+	if err := os.Chdir(mountPoint); err != nil {
+		fatal(errors.Wrapf(err, "changing working directory to %q", mountPoint))
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		fatal(err)
+	}
+	if err := unix.Exec(path, command, os.Environ()); err != nil {
+		fatal(errors.Wrapf(err, "running %q", path))
+	}
+}
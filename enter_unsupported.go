@@ -0,0 +1,11 @@
+// +build !linux
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+func runInMount(mountPoint string, command []string, options *EnterMountOptions) error {
+	return errors.Wrapf(ErrNotSupported, "entering a mount")
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"errors"
 
+	drivers "github.com/containers/storage/drivers"
 	"github.com/containers/storage/types"
 )
 
@@ -27,6 +28,8 @@ var (
 	ErrIncompleteOptions = types.ErrIncompleteOptions
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = types.ErrInvalidBigDataName
+	// ErrInvalidID indicates that an ID which is to be assigned to a new item is not acceptable.
+	ErrInvalidID = types.ErrInvalidID
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = types.ErrLayerHasChildren
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
@@ -59,7 +62,102 @@ var (
 	ErrNotSupported = types.ErrNotSupported
 	// ErrInvalidMappings is returned when the specified mappings are invalid.
 	ErrInvalidMappings = types.ErrInvalidMappings
+	// ErrInvalidNamespace is returned when the specified store namespace can't be used.
+	ErrInvalidNamespace = types.ErrInvalidNamespace
+	// ErrNamespaceQuotaExceeded is returned when creating an image or container would take a store namespace's usage over its quota.
+	ErrNamespaceQuotaExceeded = types.ErrNamespaceQuotaExceeded
+	// ErrLayerMountedReadOnly is returned when a layer which is mounted read-only is to be mounted for writing.
+	ErrLayerMountedReadOnly = types.ErrLayerMountedReadOnly
+	// ErrLayerMountedByOthers is returned when a process tries to unmount a read-only mount of a layer which only other processes are using.
+	ErrLayerMountedByOthers = types.ErrLayerMountedByOthers
+	// ErrImageStoreAccessDenied is returned when an additional image store requires an access token which wasn't supplied or isn't valid.
+	ErrImageStoreAccessDenied = types.ErrImageStoreAccessDenied
+	// ErrGraphRootChanged is returned when the filesystem which holds the graph root is not the one which was recorded for it.
+	ErrGraphRootChanged = types.ErrGraphRootChanged
+	// ErrAttachmentUnknown indicates that an image has no attachment of the specified kind with the specified digest.
+	ErrAttachmentUnknown = types.ErrAttachmentUnknown
+	// ErrImagePinned is returned when the caller attempts to delete an image which has been pinned.
+	ErrImagePinned = types.ErrImagePinned
+	// ErrLayerPinned is returned when the caller attempts to delete a layer which has been pinned.
+	ErrLayerPinned = types.ErrLayerPinned
+	// ErrLayerMountMismatch is returned when a layer which is already mounted is to be mounted with a different set of additional lower directories.
+	ErrLayerMountMismatch = types.ErrLayerMountMismatch
+	// ErrArtifactUnknown indicates that there was no artifact with the specified name or ID.
+	ErrArtifactUnknown = types.ErrArtifactUnknown
+	// ErrArtifactBlobUnknown indicates that an artifact does not include a blob with the specified digest.
+	ErrArtifactBlobUnknown = types.ErrArtifactBlobUnknown
+	// ErrVolumeUnknown indicates that there was no volume with the specified name or ID.
+	ErrVolumeUnknown = types.ErrVolumeUnknown
+	// ErrVolumeDriverUnknown indicates that no volume driver with the specified name has been registered.
+	ErrVolumeDriverUnknown = types.ErrVolumeDriverUnknown
+	// ErrVolumeMounted is returned when an operation can't be performed on a volume because it is mounted.
+	ErrVolumeMounted = types.ErrVolumeMounted
+	// ErrNoSpace is returned when there isn't enough free space left to add to a layer's contents without using up the space which is to be kept free.
+	ErrNoSpace = types.ErrNoSpace
+	// ErrLayerMounted is returned when an operation can't be performed on a layer because it is mounted.
+	ErrLayerMounted = types.ErrLayerMounted
+	// ErrDigestMismatch is returned when content doesn't match the digest which it was expected to have.
+	ErrDigestMismatch = types.ErrDigestMismatch
+	// ErrStoreCorrupt is returned when the metadata which a store keeps can't be parsed.
+	ErrStoreCorrupt = types.ErrStoreCorrupt
+	// ErrIncompatibleDriver is returned when a graph driver can't be used with the storage which it was asked to manage.
+	ErrIncompatibleDriver = types.ErrIncompatibleDriver
+	// ErrStoreOptionsConflict is returned when a Store which is already open is asked for again using options which it can't honor.
+	ErrStoreOptionsConflict = types.ErrStoreOptionsConflict
 	// ErrInvalidNameOperation is returned when updateName is called with invalid operation.
 	// Internal error
 	errInvalidUpdateNameOperation = errors.New("invalid update name operation")
+	// errLayerReplaced is returned when a layer which we were populating
+	// was removed, and possibly replaced, by someone else while we weren't
+	// holding the lock.
+	// Internal error
+	errLayerReplaced = errors.New("layer was removed while its contents were being extracted")
 )
+
+// driverError is an error which was returned by a graph driver.  errors.Is()
+// matches it against both the driver's error and the corresponding error from
+// this package, so that callers don't need to know about both.
+type driverError struct {
+	err  error
+	kind error
+}
+
+func (e *driverError) Error() string {
+	return e.err.Error()
+}
+
+func (e *driverError) Unwrap() error {
+	return e.err
+}
+
+func (e *driverError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *driverError) Cause() error {
+	return e.kind
+}
+
+// wrapDriverError wraps an error which was returned by a graph driver so that
+// it matches the corresponding error from this package, if there is one.
+func wrapDriverError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, drivers.ErrLayerUnknown):
+		return &driverError{err: err, kind: ErrLayerUnknown}
+	case errors.Is(err, drivers.ErrNotSupported):
+		return &driverError{err: err, kind: ErrNotSupported}
+	}
+	return err
+}
+
+// wrapDriverInitError wraps an error which was returned when initializing a
+// graph driver so that it matches ErrIncompatibleDriver if the driver
+// couldn't be used.
+func wrapDriverInitError(err error) error {
+	if errors.Is(err, drivers.ErrNotSupported) || errors.Is(err, drivers.ErrPrerequisites) || errors.Is(err, drivers.ErrIncompatibleFS) {
+		return &driverError{err: err, kind: ErrIncompatibleDriver}
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// LayerPathChange records a change which a layer makes to a path.
+type LayerPathChange struct {
+	// Layer is the ID of the layer which makes the change.
+	Layer string `json:"layer"`
+	// Path is the absolute path, inside of the layer, which is changed.
+	Path string `json:"path"`
+	// Kind indicates whether the path is added by the layer, modified by
+	// it after having been added by one of its parents, or removed using
+	// a whiteout.
+	Kind archive.ChangeType `json:"kind"`
+}
+
+// matchLayerPath checks if p, an absolute path, matches the pattern.  Patterns
+// which contain a "/" are matched against the whole path, and others are
+// matched against its last component.
+func matchLayerPath(pattern, p string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(p))
+		return matched
+	}
+	matched, _ := path.Match(path.Clean("/"+pattern), p)
+	return matched
+}
+
+// layerPathTracker follows the paths which match a pattern through a chain of
+// layers, starting at the base layer, so that paths which a layer adds can be
+// told apart from paths which it modifies.
+type layerPathTracker struct {
+	pattern string
+	present map[string]bool
+	changes []LayerPathChange
+}
+
+func (t *layerPathTracker) add(layer, p string) {
+	if !matchLayerPath(t.pattern, p) {
+		return
+	}
+	kind := archive.ChangeType(archive.ChangeAdd)
+	if t.present[p] {
+		kind = archive.ChangeModify
+	}
+	t.present[p] = true
+	t.changes = append(t.changes, LayerPathChange{Layer: layer, Path: p, Kind: kind})
+}
+
+// remove records that the path, and anything under it, was removed.
+func (t *layerPathTracker) remove(layer, p string, includeSelf bool) {
+	var removed []string
+	for present := range t.present {
+		if (includeSelf && present == p) || strings.HasPrefix(present, strings.TrimSuffix(p, "/")+"/") {
+			removed = append(removed, present)
+		}
+	}
+	if includeSelf && !t.present[p] && matchLayerPath(t.pattern, p) {
+		removed = append(removed, p)
+	}
+	sort.Strings(removed)
+	for _, r := range removed {
+		delete(t.present, r)
+		t.changes = append(t.changes, LayerPathChange{Layer: layer, Path: r, Kind: archive.ChangeDelete})
+	}
+}
+
+// entry interprets a name from a layer's tar-split data.
+func (t *layerPathTracker) entry(layer, name string) {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return
+	}
+	dir, base := path.Split(p)
+	switch {
+	case base == archive.WhiteoutOpaqueDir:
+		t.remove(layer, dir, false)
+	case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+		// Other metadata, like the directory of hard link targets
+		// which aufs uses, doesn't correspond to any path.
+	case strings.HasPrefix(base, archive.WhiteoutPrefix):
+		t.remove(layer, path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)), true)
+	default:
+		t.add(layer, p)
+	}
+}
+
+// change interprets a change which the storage driver computed.
+func (t *layerPathTracker) change(layer string, change archive.Change) {
+	p := path.Clean("/" + change.Path)
+	if change.Kind == archive.ChangeDelete {
+		t.remove(layer, p, true)
+		return
+	}
+	t.add(layer, p)
+}
+
+func (s *store) FindPath(id, pattern string) ([]LayerPathChange, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+	}
+	layerID := id
+	if image, err := s.Image(id); err == nil {
+		layerID = image.TopLayer
+	} else if container, err := s.Container(id); err == nil {
+		layerID = container.LayerID
+	}
+
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	stores := append([]ROLayerStore{lstore}, lstores...)
+	for _, s := range stores {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	lookup := func(id string) (ROLayerStore, *Layer) {
+		for _, store := range stores {
+			if layer, err := store.Get(id); err == nil {
+				return store, layer
+			}
+		}
+		return nil, nil
+	}
+
+	// Build the list of layers, starting with the base layer.
+	type chainLink struct {
+		store ROLayerStore
+		layer *Layer
+	}
+	var chain []chainLink
+	for next := layerID; next != ""; {
+		store, layer := lookup(next)
+		if layer == nil {
+			return nil, errors.Wrapf(ErrLayerUnknown, "locating layer %q", next)
+		}
+		chain = append([]chainLink{{store, layer}}, chain...)
+		next = layer.Parent
+	}
+
+	tracker := &layerPathTracker{pattern: pattern, present: make(map[string]bool)}
+	for _, link := range chain {
+		// Prefer reading the list of paths from the layer's tar-split
+		// data, which doesn't require mounting the layer.
+		if ls, ok := link.store.(*layerStore); ok {
+			found, err := ls.walkTarSplit(link.layer.ID, func(entry *storage.Entry) {
+				if entry.Type == storage.FileType {
+					tracker.entry(link.layer.ID, entry.GetName())
+				}
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading tar-split data for layer %q", link.layer.ID)
+			}
+			if found {
+				continue
+			}
+		}
+		changes, err := link.store.Changes("", link.layer.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "computing changes made by layer %q", link.layer.ID)
+		}
+		for _, change := range changes {
+			tracker.change(link.layer.ID, change)
+		}
+	}
+	return tracker.changes, nil
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// filesystemIdentityFile is the name of the file, at the top of the
+	// graph root, in which we record the identity of the filesystem that
+	// it's on.
+	filesystemIdentityFile = "filesystem.json"
+	// filesystemProbeFile is the name of the file, at the top of the run
+	// root, in which we cache the results of probing the filesystem, so
+	// that we don't have to create files on it every time the store is
+	// opened.
+	filesystemProbeFile = "filesystem-probe.json"
+)
+
+// FilesystemIdentity describes the filesystem which holds a store's graph
+// root, and the features which we found it to have.
+type FilesystemIdentity struct {
+	// Type is the name of the filesystem's type, for example "xfs".
+	Type string `json:"type,omitempty"`
+	// Magic is the filesystem's type, as reported by statfs(2).
+	Magic string `json:"magic,omitempty"`
+	// UUID is the UUID of the block device which holds the filesystem,
+	// if we could determine it.
+	UUID string `json:"uuid,omitempty"`
+	// Label is the label of the block device which holds the filesystem,
+	// if it has one and we could determine it.
+	Label string `json:"label,omitempty"`
+	// FSID is the filesystem ID reported by statfs(2).  It is recorded
+	// for diagnostic purposes, but never compared, since for many
+	// filesystems it is derived from a device number which can change
+	// when the system is rebooted or the filesystem is remounted.
+	FSID string `json:"fsid,omitempty"`
+	// Features lists the optional features which the filesystem was
+	// found to support, or not support.
+	Features map[string]bool `json:"features,omitempty"`
+}
+
+// differences returns descriptions of the ways in which two identities
+// differ, if they do, which would mean that the filesystem was replaced.  Only
+// identifiers which don't change when the system is rebooted are compared, and
+// only if both identities include them, since whether or not we can find them
+// depends on udev.  Features are compared by featureChanges(), since they can
+// change without the filesystem being replaced, for example when the kernel
+// is upgraded.
+func (f FilesystemIdentity) differences(other FilesystemIdentity) []string {
+	var diffs []string
+	if f.Magic != other.Magic {
+		diffs = append(diffs, fmt.Sprintf("type changed from %s (%s) to %s (%s)", f.Type, f.Magic, other.Type, other.Magic))
+	}
+	if f.UUID != "" && other.UUID != "" && f.UUID != other.UUID {
+		diffs = append(diffs, fmt.Sprintf("UUID changed from %s to %s", f.UUID, other.UUID))
+	}
+	if f.Label != "" && other.Label != "" && f.Label != other.Label {
+		diffs = append(diffs, fmt.Sprintf("label changed from %s to %s", f.Label, other.Label))
+	}
+	return diffs
+}
+
+// featureChanges returns descriptions of the features which one identity says
+// the filesystem supports and the other says it doesn't, or vice versa.
+func (f FilesystemIdentity) featureChanges(other FilesystemIdentity) []string {
+	var changes []string
+	var features []string
+	for feature := range f.Features {
+		features = append(features, feature)
+	}
+	for feature := range other.Features {
+		if _, ok := f.Features[feature]; !ok {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		before, ok := f.Features[feature]
+		after, ok2 := other.Features[feature]
+		if ok && ok2 && before != after {
+			changes = append(changes, fmt.Sprintf("support for %s changed from %v to %v", feature, before, after))
+		}
+	}
+	return changes
+}
+
+// GraphRootChangedError is returned when the filesystem which holds a store's
+// graph root isn't the one that it was on when the store was created, for
+// example because a disk was replaced or the filesystem was converted.  Until
+// Store.AdoptNewFilesystem() is called, the store refuses to operate on its
+// contents, since assumptions that it and its graph driver made about the
+// filesystem may no longer hold.
+type GraphRootChangedError struct {
+	// GraphRoot is the store's graph root.
+	GraphRoot string
+	// Recorded is the identity that was recorded for the filesystem.
+	Recorded FilesystemIdentity
+	// Current is the identity of the filesystem which is there now.
+	Current FilesystemIdentity
+}
+
+func (e *GraphRootChangedError) Error() string {
+	return fmt.Sprintf("%v: %s: %s", ErrGraphRootChanged, e.GraphRoot, strings.Join(e.Recorded.differences(e.Current), ", "))
+}
+
+// Unwrap returns ErrGraphRootChanged, so that errors.Is() can be used to
+// check for this type of error.
+func (e *GraphRootChangedError) Unwrap() error {
+	return ErrGraphRootChanged
+}
+
+// Cause returns ErrGraphRootChanged, so that errors.Cause() can be used to
+// check for this type of error.
+func (e *GraphRootChangedError) Cause() error {
+	return ErrGraphRootChanged
+}
+
+func readFilesystemIdentity(graphRoot string) (*FilesystemIdentity, error) {
+	data, err := ioutil.ReadFile(filepath.Join(graphRoot, filesystemIdentityFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	identity := FilesystemIdentity{}
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %q", filepath.Join(graphRoot, filesystemIdentityFile))
+	}
+	return &identity, nil
+}
+
+func writeFilesystemIdentity(graphRoot string, identity FilesystemIdentity) error {
+	data, err := json.Marshal(&identity)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(graphRoot, filesystemIdentityFile), data, 0600)
+}
+
+// filesystemProbe is a cached result of probing the filesystem which holds the
+// graph root.
+type filesystemProbe struct {
+	// Device identifies the mounted filesystem which was probed, in a
+	// way which is only meaningful until it's unmounted.
+	Device string `json:"device"`
+	// Identity is what we found.
+	Identity FilesystemIdentity `json:"identity"`
+}
+
+// probeFilesystemCached returns the identity of the filesystem which holds the
+// graph root, reusing the result of probing it which is cached in the run
+// root, if it's the same mounted filesystem that we probed before.  The run
+// root is usually cleared when the system is rebooted.
+func (s *store) probeFilesystemCached() (FilesystemIdentity, error) {
+	cacheFile := filepath.Join(s.runRoot, filesystemProbeFile)
+	device, err := filesystemDevice(s.graphRoot)
+	if err != nil {
+		return FilesystemIdentity{}, err
+	}
+	if device != "" {
+		if data, err := ioutil.ReadFile(cacheFile); err == nil {
+			var cached filesystemProbe
+			if err := json.Unmarshal(data, &cached); err == nil && cached.Device == device {
+				return cached.Identity, nil
+			}
+		}
+	}
+	identity, err := probeFilesystem(s.graphRoot)
+	if err != nil {
+		return FilesystemIdentity{}, err
+	}
+	if device != "" {
+		if data, err := json.Marshal(&filesystemProbe{Device: device, Identity: identity}); err == nil {
+			if err := ioutils.AtomicWriteFile(cacheFile, data, 0600); err != nil {
+				logrus.Debugf("Error caching the identity of the filesystem at %q: %v", s.graphRoot, err)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// checkFilesystemIdentity compares the identity of the filesystem which holds
+// the graph root with the one which we recorded, recording it if we hadn't
+// yet, and returns a *GraphRootChangedError if they don't match.  If only the
+// filesystem's features changed, it probes them again, warns about them, and
+// records them, discarding what the graph driver had cached about them.  The
+// caller should be holding the graph lock.
+func (s *store) checkFilesystemIdentity() error {
+	// Probing the filesystem requires creating files on it, which we
+	// can't do if the store is read-only.
+	if s.readOnly {
+		return nil
+	}
+	current, err := s.probeFilesystemCached()
+	if err != nil {
+		return errors.Wrapf(err, "error probing the filesystem at %q", s.graphRoot)
+	}
+	recorded, err := readFilesystemIdentity(s.graphRoot)
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		return writeFilesystemIdentity(s.graphRoot, current)
+	}
+	if len(recorded.differences(current)) > 0 {
+		return &GraphRootChangedError{GraphRoot: s.graphRoot, Recorded: *recorded, Current: current}
+	}
+	if len(recorded.featureChanges(current)) == 0 {
+		return nil
+	}
+	// Don't trust a cached probe to tell us that the features changed.
+	if err := os.Remove(filepath.Join(s.runRoot, filesystemProbeFile)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("Error discarding the cached identity of the filesystem at %q: %v", s.graphRoot, err)
+	}
+	if current, err = s.probeFilesystemCached(); err != nil {
+		return errors.Wrapf(err, "error probing the filesystem at %q", s.graphRoot)
+	}
+	changes := recorded.featureChanges(current)
+	if len(changes) == 0 {
+		return nil
+	}
+	logrus.Warnf("The filesystem at %q has changed: %s", s.graphRoot, strings.Join(changes, ", "))
+	config := drivers.Options{
+		Root:          s.graphRoot,
+		RunRoot:       s.runRoot,
+		DriverOptions: s.graphOptions,
+	}
+	if err := drivers.ClearFeatureCache(s.graphDriverName, config); err != nil {
+		return err
+	}
+	// Keep the identifiers which we found before, in case we can't find
+	// them now.
+	updated := *recorded
+	updated.Features = current.Features
+	return writeFilesystemIdentity(s.graphRoot, updated)
+}
+
+// AdoptNewFilesystem accepts the filesystem which currently holds the graph
+// root as the store's filesystem, after it has been replaced.
+func (s *store) AdoptNewFilesystem() error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to record the identity of the filesystem at %q", s.graphRoot)
+	}
+	s.graphLock.Lock()
+	current, err := probeFilesystem(s.graphRoot)
+	if err != nil {
+		s.graphLock.Unlock()
+		return errors.Wrapf(err, "error probing the filesystem at %q", s.graphRoot)
+	}
+	// Discard any results of the driver's checks of the old filesystem's
+	// features before recording the new one's identity, so that we
+	// don't end up trusting them if we're interrupted.
+	if s.graphDriver != nil {
+		if err := s.graphDriver.Cleanup(); err != nil {
+			logrus.Debugf("Error cleaning up graph driver: %v", err)
+		}
+		s.graphDriver = nil
+		s.layerStore = nil
+		s.roLayerStores = nil
+	}
+	config := drivers.Options{
+		Root:          s.graphRoot,
+		RunRoot:       s.runRoot,
+		DriverOptions: s.graphOptions,
+	}
+	if err := drivers.ClearFeatureCache(s.graphDriverName, config); err != nil {
+		s.graphLock.Unlock()
+		return err
+	}
+	if err := writeFilesystemIdentity(s.graphRoot, current); err != nil {
+		s.graphLock.Unlock()
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.runRoot, filesystemProbeFile)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("Error discarding the cached identity of the filesystem at %q: %v", s.graphRoot, err)
+	}
+	s.graphRootChanged = nil
+	s.graphLock.Touch()
+	s.storesLock.Lock()
+	loaded := s.loaded
+	s.storesLock.Unlock()
+	s.graphLock.Unlock()
+	if loaded {
+		return nil
+	}
+	return s.load()
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/fsutils"
+	"github.com/containers/storage/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+// probeFilesystem returns the identity of the filesystem on which path is
+// located, and checks which optional features it supports.
+func probeFilesystem(path string) (FilesystemIdentity, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return FilesystemIdentity{}, err
+	}
+	identity := FilesystemIdentity{
+		Type:     "<unknown>",
+		Magic:    fmt.Sprintf("0x%x", uint32(fs.Type)),
+		FSID:     fmt.Sprintf("%08x%08x", uint32(fs.Fsid.Val[0]), uint32(fs.Fsid.Val[1])),
+		Features: make(map[string]bool),
+	}
+	if name, ok := drivers.FsNames[drivers.FsMagic(fs.Type)]; ok {
+		identity.Type = name
+	}
+
+	// Look for the device in /dev/disk/by-uuid and /dev/disk/by-label,
+	// which udev populates.
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return FilesystemIdentity{}, err
+	}
+	identity.UUID = findDiskLink("/dev/disk/by-uuid", uint64(st.Dev))
+	identity.Label = findDiskLink("/dev/disk/by-label", uint64(st.Dev))
+
+	dtype, err := fsutils.SupportsDType(path)
+	if err != nil {
+		return FilesystemIdentity{}, err
+	}
+	identity.Features["d_type"] = dtype
+
+	probe, err := ioutil.TempFile(path, ".probe-")
+	if err != nil {
+		return FilesystemIdentity{}, err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+	identity.Features["user_xattr"] = system.Lsetxattr(probe.Name(), "user.containers-storage-probe", []byte("1"), 0) == nil
+
+	return identity, nil
+}
+
+// findDiskLink returns the name of the entry in dir which refers to the
+// block device dev, or "" if there isn't one.
+func findDiskLink(dir string, dev uint64) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		var st unix.Stat_t
+		if err := unix.Stat(filepath.Join(dir, entry.Name()), &st); err != nil {
+			continue
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFBLK && uint64(st.Rdev) == dev {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+// filesystemDevice returns a string which identifies the mounted filesystem
+// on which path is located, until it is unmounted.
+func filesystemDevice(path string) (string, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return "", err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x:%08x%08x:%d", st.Dev, uint32(fs.Fsid.Val[0]), uint32(fs.Fsid.Val[1]), st.Ino), nil
+}
+
+// sameFilesystem returns true if a and b are on the same filesystem.
+func sameFilesystem(a, b string) (bool, error) {
+	var sta, stb unix.Stat_t
+	if err := unix.Stat(a, &sta); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(b, &stb); err != nil {
+		return false, err
+	}
+	return sta.Dev == stb.Dev, nil
+}
@@ -0,0 +1,23 @@
+// +build !linux
+
+package storage
+
+// probeFilesystem returns the identity of the filesystem on which path is
+// located.  We don't know how to identify filesystems here, so every
+// filesystem looks the same.
+func probeFilesystem(path string) (FilesystemIdentity, error) {
+	return FilesystemIdentity{}, nil
+}
+
+// sameFilesystem returns true if a and b are on the same filesystem.  We
+// don't know how to tell here, so we assume that they aren't.
+func sameFilesystem(a, b string) (bool, error) {
+	return false, nil
+}
+
+// filesystemDevice returns a string which identifies the mounted filesystem
+// on which path is located.  We don't know how to tell here, so probes of
+// filesystems aren't cached.
+func filesystemDevice(path string) (string, error) {
+	return "", nil
+}
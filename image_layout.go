@@ -0,0 +1,527 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The parts of the OCI image layout and image format specifications which
+// ExportImage and ImportImage use.
+const (
+	ociLayoutFile         = "oci-layout"
+	ociLayoutVersion      = "1.0.0"
+	ociIndexFile          = "index.json"
+	ociBlobsDir           = "blobs"
+	ociMediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnotation  = "org.opencontainers.image.ref.name"
+	// imageIDAnnotation records the ID of an exported image, so that it
+	// can be reused when the image is imported.
+	imageIDAnnotation = "io.containers.storage.image.id"
+)
+
+type ociLayout struct {
+	Version string `json:"imageLayoutVersion"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociImageConfig holds the parts of an image's configuration which we need to
+// read, or to generate a configuration for an image which doesn't have one.
+type ociImageConfig struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	RootFS       struct {
+		Type    string          `json:"type"`
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// blobPath returns the location of a blob in an image layout.
+func blobPath(d digest.Digest) string {
+	return path.Join(ociBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// writeTarFile adds a regular file to an archive.
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// exportLayerBlob writes a compressed diff for the layer to a file in dir,
+// and returns a descriptor for it, the digest of its uncompressed form, and
+// the name of the file.
+func (s *store) exportLayerBlob(dir, id string) (ociDescriptor, digest.Digest, string, error) {
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff("", id, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return ociDescriptor{}, "", "", errors.Wrapf(err, "generating diff for layer %q", id)
+	}
+	defer rc.Close()
+	f, err := ioutil.TempFile(dir, "layer-")
+	if err != nil {
+		return ociDescriptor{}, "", "", err
+	}
+	defer f.Close()
+	digester := digest.Canonical.Digester()
+	counter := ioutils.NewWriteCounter(io.MultiWriter(f, digester.Hash()))
+	compressor, err := archive.CompressStream(counter, archive.Gzip)
+	if err != nil {
+		return ociDescriptor{}, "", "", err
+	}
+	diffIDDigester := digest.Canonical.Digester()
+	if _, err := io.Copy(compressor, io.TeeReader(rc, diffIDDigester.Hash())); err != nil {
+		compressor.Close()
+		return ociDescriptor{}, "", "", errors.Wrapf(err, "compressing diff for layer %q", id)
+	}
+	if err := compressor.Close(); err != nil {
+		return ociDescriptor{}, "", "", err
+	}
+	desc := ociDescriptor{
+		MediaType: ociMediaTypeLayerGzip,
+		Digest:    digester.Digest(),
+		Size:      counter.Count,
+	}
+	return desc, diffIDDigester.Digest(), f.Name(), nil
+}
+
+// imageConfig returns the image's configuration blob, if it has one which
+// matches the diffs we generated for its layers, or a minimal one if it
+// doesn't.  Configuration blobs are stored as big data items named after
+// their digests.
+func (s *store) imageConfig(image *Image, diffIDs []digest.Digest) ([]byte, error) {
+	for _, key := range image.BigDataNames {
+		d, err := digest.Parse(key)
+		if err != nil {
+			continue
+		}
+		data, err := s.ImageBigData(image.ID, key)
+		if err != nil {
+			return nil, err
+		}
+		if !d.Algorithm().Available() || d.Algorithm().FromBytes(data) != d {
+			continue
+		}
+		var config ociImageConfig
+		if err := json.Unmarshal(data, &config); err != nil || len(config.RootFS.DiffIDs) != len(diffIDs) {
+			continue
+		}
+		matched := true
+		for i := range diffIDs {
+			if config.RootFS.DiffIDs[i] != diffIDs[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return data, nil
+		}
+	}
+	config := ociImageConfig{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+	}
+	if !image.Created.IsZero() {
+		created := image.Created.UTC()
+		config.Created = &created
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append([]digest.Digest{}, diffIDs...)
+	return json.Marshal(&config)
+}
+
+func (s *store) ExportImage(id string, w io.Writer) error {
+	image, err := s.Image(id)
+	if err != nil {
+		return err
+	}
+
+	// Build the list of layers, starting with the base layer.
+	var layers []*Layer
+	for next := image.TopLayer; next != ""; {
+		layer, err := s.Layer(next)
+		if err != nil {
+			return errors.Wrapf(err, "locating layer %q", next)
+		}
+		layers = append([]*Layer{layer}, layers...)
+		next = layer.Parent
+	}
+
+	tmpdir, err := ioutil.TempDir("", "export-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Layers:        []ociDescriptor{},
+	}
+	var diffIDs []digest.Digest
+	blobFiles := make(map[digest.Digest]string)
+	for _, layer := range layers {
+		desc, diffID, file, err := s.exportLayerBlob(tmpdir, layer.ID)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		diffIDs = append(diffIDs, diffID)
+		blobFiles[desc.Digest] = file
+	}
+	config, err := s.imageConfig(image, diffIDs)
+	if err != nil {
+		return err
+	}
+	manifest.Config = ociDescriptor{
+		MediaType: ociMediaTypeConfig,
+		Digest:    digest.Canonical.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	manifestBytes, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc := ociDescriptor{
+		MediaType: ociMediaTypeManifest,
+		Digest:    digest.Canonical.FromBytes(manifestBytes),
+		Size:      int64(len(manifestBytes)),
+	}
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeIndex,
+	}
+	names := image.Names
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	for _, name := range names {
+		desc := manifestDesc
+		desc.Annotations = map[string]string{imageIDAnnotation: image.ID}
+		if name != "" {
+			desc.Annotations[ociRefNameAnnotation] = name
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	layoutBytes, err := json.Marshal(&ociLayout{Version: ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	indexBytes, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, ociLayoutFile, int64(len(layoutBytes)), bytes.NewReader(layoutBytes)); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		f, err := os.Open(blobFiles[layer.Digest])
+		if err != nil {
+			return err
+		}
+		err = writeTarFile(tw, blobPath(layer.Digest), layer.Size, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeTarFile(tw, blobPath(manifest.Config.Digest), manifest.Config.Size, bytes.NewReader(config)); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, blobPath(manifestDesc.Digest), manifestDesc.Size, bytes.NewReader(manifestBytes)); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociIndexFile, int64(len(indexBytes)), bytes.NewReader(indexBytes)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// stageImageLayout extracts an image layout archive into dir, verifying the
+// digests of the blobs as they are extracted.
+func stageImageLayout(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading image layout")
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return errors.Errorf("unexpected entry %q in image layout", hdr.Name)
+		}
+		var expected digest.Digest
+		switch {
+		case name == ociLayoutFile || name == ociIndexFile:
+		case strings.HasPrefix(name, ociBlobsDir+"/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				return errors.Errorf("unexpected entry %q in image layout", hdr.Name)
+			}
+			expected = digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+			if err := expected.Validate(); err != nil {
+				return errors.Wrapf(err, "blob %q in image layout", hdr.Name)
+			}
+			name = blobPath(expected)
+		default:
+			return errors.Errorf("unexpected entry %q in image layout", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		var dest io.Writer = f
+		var verifier digest.Verifier
+		if expected != "" {
+			verifier = expected.Verifier()
+			dest = io.MultiWriter(f, verifier)
+		}
+		_, err = io.Copy(dest, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extracting %q from image layout", hdr.Name)
+		}
+		if verifier != nil && !verifier.Verified() {
+			return errors.Wrapf(ErrDigestMismatch, "blob %q in image layout", hdr.Name)
+		}
+	}
+}
+
+// readImageLayoutFile reads a file from an extracted image layout, and decodes
+// it as JSON.
+func readImageLayoutFile(dir, name string, v interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return errors.Wrapf(err, "reading %q from image layout", name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "decoding %q from image layout", name)
+	}
+	return nil
+}
+
+// importLayer creates a layer from an image layout's blob, or reuses a layer
+// with the same contents and parent if there already is one.
+func (s *store) importLayer(dir, parent string, desc ociDescriptor, diffID digest.Digest, provenance *LayerProvenance) (string, error) {
+	if layers, err := s.LayersByUncompressedDigest(diffID); err == nil {
+		for _, layer := range layers {
+			if layer.Parent == parent {
+				return layer.ID, nil
+			}
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(blobPath(desc.Digest))))
+	if err != nil {
+		return "", errors.Wrapf(err, "reading layer blob %q from image layout", desc.Digest)
+	}
+	defer f.Close()
+	layer, _, err := s.PutLayer("", parent, nil, "", false, &LayerOptions{OriginalDigest: desc.Digest, Provenance: provenance}, f)
+	if err != nil {
+		return "", errors.Wrapf(err, "creating layer from blob %q", desc.Digest)
+	}
+	if layer.UncompressedDigest != diffID {
+		if err := s.DeleteLayer(layer.ID); err != nil {
+			return "", errors.Wrapf(err, "deleting layer %q, created from blob %q with the wrong contents", layer.ID, desc.Digest)
+		}
+		return "", errors.Wrapf(ErrDigestMismatch, "layer blob %q has uncompressed digest %q, expected %q", desc.Digest, layer.UncompressedDigest, diffID)
+	}
+	return layer.ID, nil
+}
+
+// deleteImportedLayers deletes the layers which were added while importing an
+// image which we then couldn't create, unless something else has started
+// using them.
+func (s *store) deleteImportedLayers(topLayer string) {
+	if topLayer == "" {
+		return
+	}
+	err := func() error {
+		rlstore, err := s.LayerStore()
+		if err != nil {
+			return err
+		}
+		rlstore.Lock()
+		defer rlstore.Unlock()
+		if err := rlstore.ReloadIfChanged(); err != nil {
+			return err
+		}
+		ristore, err := s.ImageStore()
+		if err != nil {
+			return err
+		}
+		ristore.Lock()
+		defer ristore.Unlock()
+		if err := ristore.ReloadIfChanged(); err != nil {
+			return err
+		}
+		return s.deleteUnusedLayers(rlstore, ristore, topLayer)
+	}()
+	if err != nil {
+		logrus.Debugf("error deleting layers of image which couldn't be imported: %v", err)
+	}
+}
+
+func (s *store) ImportImage(r io.Reader) (*Image, error) {
+	if s.readOnly {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to import images into %q", s.graphRoot)
+	}
+	tmpdir, err := ioutil.TempDir(s.TempDir(), "import-image-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := stageImageLayout(r, tmpdir); err != nil {
+		return nil, err
+	}
+
+	var layout ociLayout
+	if err := readImageLayoutFile(tmpdir, ociLayoutFile, &layout); err != nil {
+		return nil, err
+	}
+	if layout.Version != ociLayoutVersion {
+		return nil, errors.Errorf("unsupported image layout version %q", layout.Version)
+	}
+	var index ociIndex
+	if err := readImageLayoutFile(tmpdir, ociIndexFile, &index); err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.New("image layout contains no images")
+	}
+	manifestDigest := index.Manifests[0].Digest
+	var id string
+	var names []string
+	for _, desc := range index.Manifests {
+		if desc.Digest != manifestDigest {
+			return nil, errors.New("image layout contains more than one image")
+		}
+		if name := desc.Annotations[ociRefNameAnnotation]; name != "" {
+			names = append(names, name)
+		}
+		if id == "" {
+			id = desc.Annotations[imageIDAnnotation]
+		}
+	}
+	if err := manifestDigest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "image layout's index")
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(tmpdir, filepath.FromSlash(blobPath(manifestDigest))))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading manifest %q from image layout", manifestDigest)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest %q", manifestDigest)
+	}
+	if err := manifest.Config.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "manifest %q", manifestDigest)
+	}
+	configBytes, err := ioutil.ReadFile(filepath.Join(tmpdir, filepath.FromSlash(blobPath(manifest.Config.Digest))))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading configuration %q from image layout", manifest.Config.Digest)
+	}
+	var config ociImageConfig
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return nil, errors.Wrapf(err, "decoding configuration %q", manifest.Config.Digest)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, errors.Errorf("manifest %q lists %d layers, but its configuration lists %d", manifestDigest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	// Note which image any new layers were imported for.
+	provenance := &LayerProvenance{
+		Source:    manifestDigest.String(),
+		Operation: "import",
+	}
+	if len(names) > 0 {
+		provenance.Source = names[0]
+	}
+	topLayer := ""
+	for i, desc := range manifest.Layers {
+		if err := desc.Digest.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "manifest %q", manifestDigest)
+		}
+		layer, err := s.importLayer(tmpdir, topLayer, desc, config.RootFS.DiffIDs[i], provenance)
+		if err != nil {
+			s.deleteImportedLayers(topLayer)
+			return nil, err
+		}
+		topLayer = layer
+	}
+
+	if id == "" {
+		id = manifest.Config.Digest.Encoded()
+	}
+	image, err := s.CreateImage(id, names, topLayer, "", &ImageOptions{})
+	if err != nil {
+		s.deleteImportedLayers(topLayer)
+		return nil, err
+	}
+	if err := s.SetImageBigData(image.ID, manifest.Config.Digest.String(), configBytes, nil); err != nil {
+		return nil, err
+	}
+	digestManifest := func([]byte) (digest.Digest, error) { return manifestDigest, nil }
+	if err := s.SetImageBigData(image.ID, ImageDigestBigDataKey, manifestBytes, digestManifest); err != nil {
+		return nil, err
+	}
+	return s.Image(image.ID)
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -9,11 +11,11 @@ import (
 	"time"
 
 	"github.com/containers/storage/pkg/ioutils"
-	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/pkg/stringutils"
 	"github.com/containers/storage/pkg/truncindex"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -82,6 +84,23 @@ type Image struct {
 	// data that has been stored, if they're known.
 	BigDataDigests map[string]digest.Digest `json:"big-data-digests,omitempty"`
 
+	// BigDataBlobs maps the names in BigDataNames to the digests of the
+	// shared blobs which hold their contents.  Items with the same
+	// contents, whether they're attached to the same image or to
+	// different ones, share a single copy on disk.  Items which aren't
+	// listed here are not shared.
+	BigDataBlobs map[string]digest.Digest `json:"big-data-blobs,omitempty"`
+
+	// Annotations are key/value pairs which we keep for the convenience
+	// of the caller.  Unlike Metadata, they can be updated individually,
+	// and used to search for images.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Attachments describes the big data items which hold signatures,
+	// SBOMs, attestations, and other data which describes the image, in
+	// the order in which they were added.
+	Attachments []ImageAttachment `json:"attachments,omitempty"`
+
 	// Created is the datestamp for when this image was created.  Older
 	// versions of the library did not track this information, so callers
 	// will likely want to use the IsZero() method to verify that a value
@@ -94,6 +113,58 @@ type Image struct {
 	Flags map[string]interface{} `json:"flags,omitempty"`
 }
 
+// ImageAttachmentKind identifies what an image attachment contains.  Callers
+// can use kinds other than the ones which are defined here.
+type ImageAttachmentKind string
+
+const (
+	// ImageAttachmentSignature is the kind of attachments which hold
+	// signatures of the image.
+	ImageAttachmentSignature ImageAttachmentKind = "signature"
+	// ImageAttachmentSBOM is the kind of attachments which hold software
+	// bills of materials for the image.
+	ImageAttachmentSBOM ImageAttachmentKind = "sbom"
+	// ImageAttachmentAttestation is the kind of attachments which hold
+	// attestations about the image.
+	ImageAttachmentAttestation ImageAttachmentKind = "attestation"
+
+	// imageAttachmentBigDataNamePrefix is a prefix of the names of big
+	// data items which hold attachments.
+	imageAttachmentBigDataNamePrefix = "attachment/"
+)
+
+// An ImageAttachment is a piece of data, like a signature or an SBOM, which
+// describes an image, and which is stored as one of the image's big data
+// items.  Attachments are located using their kinds and the digests of their
+// contents.
+type ImageAttachment struct {
+	// Kind is the kind of the attachment.
+	Kind ImageAttachmentKind `json:"kind"`
+
+	// MediaType is the media type of the attachment's contents, if one
+	// was specified when it was added.
+	MediaType string `json:"media-type,omitempty"`
+
+	// Digest is the digest of the attachment's contents.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the attachment's contents.
+	Size int64 `json:"size"`
+
+	// BigDataName is the name of the big data item which holds the
+	// attachment's contents.
+	BigDataName string `json:"big-data-name"`
+
+	// Created is the datestamp for when the attachment was added.
+	Created time.Time `json:"created,omitempty"`
+}
+
+// imageAttachmentBigDataName returns the name of the big data item which holds
+// an attachment's contents.
+func imageAttachmentBigDataName(kind ImageAttachmentKind, d digest.Digest) string {
+	return imageAttachmentBigDataNamePrefix + string(kind) + "/" + d.String()
+}
+
 // ROImageStore provides bookkeeping for information about Images.
 type ROImageStore interface {
 	ROFileBasedStore
@@ -118,6 +189,11 @@ type ROImageStore interface {
 	// with ImageDigestManifestBigDataNamePrefix, which matches the
 	// specified digest.
 	ByDigest(d digest.Digest) ([]*Image, error)
+
+	// Attachments returns a slice enumerating the attachments of the
+	// specified kind which the image has, or all of its attachments if
+	// kind is "", in the order in which they were added.
+	Attachments(id string, kind ImageAttachmentKind) ([]ImageAttachment, error)
 }
 
 // ImageStore provides bookkeeping for information about Images.
@@ -127,6 +203,7 @@ type ImageStore interface {
 	RWMetadataStore
 	RWImageBigDataStore
 	FlaggableStore
+	AnnotatedStore
 
 	// Create creates an image that has a specified ID (or a random one) and
 	// optional names, using the specified layer as its topmost (hopefully
@@ -149,6 +226,15 @@ type ImageStore interface {
 	// named image references.
 	RemoveNames(id string, names []string) error
 
+	// AddAttachment stores data as an attachment of the specified kind,
+	// with an optional media type.  If the image already has an identical
+	// attachment of that kind, it is returned instead.
+	AddAttachment(id string, kind ImageAttachmentKind, mediaType string, data []byte) (*ImageAttachment, error)
+
+	// RemoveAttachment removes an attachment of the specified kind, whose
+	// contents have the specified digest.
+	RemoveAttachment(id string, kind ImageAttachmentKind, d digest.Digest) error
+
 	// Delete removes the record of the image.
 	Delete(id string) error
 
@@ -164,7 +250,11 @@ type imageStore struct {
 	byid     map[string]*Image
 	byname   map[string]*Image
 	bydigest map[digest.Digest][]*Image
+	// blobrefs counts the big data items which refer to each shared blob.
+	blobrefs map[digest.Digest]int
 	loadMut  sync.Mutex
+	// records reads and writes the file which holds the records.
+	records recordsFile
 }
 
 func copyImage(i *Image) *Image {
@@ -180,9 +270,12 @@ func copyImage(i *Image) *Image {
 		BigDataNames:    copyStringSlice(i.BigDataNames),
 		BigDataSizes:    copyStringInt64Map(i.BigDataSizes),
 		BigDataDigests:  copyStringDigestMap(i.BigDataDigests),
+		BigDataBlobs:    copyStringDigestMap(i.BigDataBlobs),
 		Created:         i.Created,
 		ReadOnly:        i.ReadOnly,
 		Flags:           copyStringInterfaceMap(i.Flags),
+		Annotations:     copyStringStringMap(i.Annotations),
+		Attachments:     append([]ImageAttachment(nil), i.Attachments...),
 	}
 }
 
@@ -217,6 +310,67 @@ func (r *imageStore) datapath(id, key string) string {
 	return filepath.Join(r.datadir(id), makeBigDataBaseName(key))
 }
 
+// blobpath returns the location of the shared blob which holds the contents
+// of big data items whose contents have the digest d.
+func (r *imageStore) blobpath(d digest.Digest) string {
+	return filepath.Join(r.dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+// shareBigData replaces an image's copy of a big data item with a hard link to
+// the shared blob for items with the same contents, first creating the blob
+// from the image's copy if there isn't one yet.  If it returns false, the
+// image keeps its own copy.
+func (r *imageStore) shareBigData(id, key string, d digest.Digest) bool {
+	blob := r.blobpath(d)
+	datapath := r.datapath(id, key)
+	if _, err := os.Lstat(blob); err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("error checking for shared blob %q: %v", blob, err)
+			return false
+		}
+		if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+			logrus.Debugf("error creating directory for shared blobs: %v", err)
+			return false
+		}
+		if err := os.Link(datapath, blob); err != nil {
+			logrus.Debugf("error sharing big data item %q for image %q: %v", key, id, err)
+			return false
+		}
+		return true
+	}
+	// Link the blob into the image's directory under a temporary name,
+	// and then replace the image's copy with it, so that the item is never
+	// missing.
+	tmp := filepath.Join(r.datadir(id), ".link-"+d.Hex())
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error removing %q: %v", tmp, err)
+		return false
+	}
+	if err := os.Link(blob, tmp); err != nil {
+		logrus.Debugf("error sharing big data item %q for image %q: %v", key, id, err)
+		return false
+	}
+	if err := os.Rename(tmp, datapath); err != nil {
+		os.Remove(tmp)
+		logrus.Debugf("error sharing big data item %q for image %q: %v", key, id, err)
+		return false
+	}
+	return true
+}
+
+// releaseBlob notes that a big data item no longer refers to a shared blob,
+// and removes the blob if nothing else refers to it.
+func (r *imageStore) releaseBlob(d digest.Digest) {
+	r.blobrefs[d]--
+	if r.blobrefs[d] > 0 {
+		return
+	}
+	delete(r.blobrefs, d)
+	if err := os.Remove(r.blobpath(d)); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error removing unused shared blob %q: %v", r.blobpath(d), err)
+	}
+}
+
 // bigDataNameIsManifest determines if a big data item with the specified name
 // is considered to be representative of the image, in that its digest can be
 // said to also be the image's digest.  Currently, if its name is, or begins
@@ -260,16 +414,20 @@ func (i *Image) recomputeDigests() error {
 func (r *imageStore) Load() error {
 	shouldSave := false
 	rpath := r.imagespath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	var images []*Image
+	_, err := r.records.decode(rpath, func() interface{} {
+		images = []*Image{}
+		return &images
+	})
+	if err != nil && !errors.Is(err, ErrStoreCorrupt) {
 		return err
 	}
-	images := []*Image{}
 	idlist := []string{}
 	ids := make(map[string]*Image)
 	names := make(map[string]*Image)
 	digests := make(map[digest.Digest][]*Image)
-	if err = json.Unmarshal(data, &images); len(data) == 0 || err == nil {
+	blobrefs := make(map[digest.Digest]int)
+	if err == nil {
 		idlist = make([]string, 0, len(images))
 		for n, image := range images {
 			ids[image.ID] = images[n]
@@ -292,6 +450,9 @@ func (r *imageStore) Load() error {
 				list := digests[digest]
 				digests[digest] = append(list, image)
 			}
+			for _, blob := range image.BigDataBlobs {
+				blobrefs[blob]++
+			}
 			image.ReadOnly = !r.IsReadWrite()
 		}
 	}
@@ -303,6 +464,10 @@ func (r *imageStore) Load() error {
 	r.byid = ids
 	r.byname = names
 	r.bydigest = digests
+	r.blobrefs = blobrefs
+	if err != nil {
+		return err
+	}
 	if shouldSave {
 		return r.Save()
 	}
@@ -325,10 +490,10 @@ func (r *imageStore) Save() error {
 		return err
 	}
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jdata, 0600)
+	return r.records.write(rpath, jdata)
 }
 
-func newImageStore(dir string) (ImageStore, error) {
+func newImageStore(dir string, writerOptions ioutils.AtomicFileWriterOptions) (ImageStore, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -341,10 +506,12 @@ func newImageStore(dir string) (ImageStore, error) {
 	istore := imageStore{
 		lockfile: lockfile,
 		dir:      dir,
+		records:  recordsFile{options: writerOptions},
 		images:   []*Image{},
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		blobrefs: make(map[digest.Digest]int),
 	}
 	if err := istore.Load(); err != nil {
 		return nil, err
@@ -366,6 +533,34 @@ func newROImageStore(dir string) (ROImageStore, error) {
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		blobrefs: make(map[digest.Digest]int),
+	}
+	if err := istore.Load(); err != nil {
+		return nil, err
+	}
+	return &istore, nil
+}
+
+// newReadOnlyImageStore opens the image store of a read-only Store, which
+// keeps its lock file in rundir.
+func newReadOnlyImageStore(dir, rundir string) (ImageStore, error) {
+	if err := os.MkdirAll(rundir, 0700); err != nil {
+		return nil, err
+	}
+	lockfile, err := getReadOnlyStoreLockfile(filepath.Join(dir, "images.lock"), filepath.Join(rundir, "images.lock"))
+	if err != nil {
+		return nil, err
+	}
+	lockfile.RLock()
+	defer lockfile.Unlock()
+	istore := imageStore{
+		lockfile: lockfile,
+		dir:      dir,
+		images:   []*Image{},
+		byid:     make(map[string]*Image),
+		byname:   make(map[string]*Image),
+		bydigest: make(map[digest.Digest][]*Image),
+		blobrefs: make(map[digest.Digest]int),
 	}
 	if err := istore.Load(); err != nil {
 		return nil, err
@@ -417,12 +612,9 @@ func (r *imageStore) Create(id string, names []string, layer, metadata string, c
 		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new images at %q", r.imagespath())
 	}
 	if id == "" {
-		id = stringid.GenerateRandomID()
-		_, idInUse := r.byid[id]
-		for idInUse {
-			id = stringid.GenerateRandomID()
-			_, idInUse = r.byid[id]
-		}
+		id = generateID(nil, r.Exists)
+	} else if err := validateID(id); err != nil {
+		return nil, err
 	}
 	if _, idInUse := r.byid[id]; idInUse {
 		return nil, errors.Wrapf(ErrDuplicateID, "an image with ID %q already exists", id)
@@ -508,6 +700,107 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
 }
 
+func (r *imageStore) UpdateAnnotations(id string, set map[string]string, remove []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify image annotations at %q", r.imagespath())
+	}
+	if image, ok := r.lookup(id); ok {
+		if updateAnnotations(&image.Annotations, set, remove) {
+			return r.Save()
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (r *imageStore) Attachments(id string, kind ImageAttachmentKind) ([]ImageAttachment, error) {
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	attachments := []ImageAttachment{}
+	for _, attachment := range image.Attachments {
+		if kind == "" || attachment.Kind == kind {
+			attachments = append(attachments, attachment)
+		}
+	}
+	return attachments, nil
+}
+
+func (r *imageStore) AddAttachment(id string, kind ImageAttachmentKind, mediaType string, data []byte) (*ImageAttachment, error) {
+	if kind == "" || strings.Contains(string(kind), "/") {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "invalid attachment kind %q", kind)
+	}
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to add attachments to images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	d := digest.Canonical.FromBytes(data)
+	name := imageAttachmentBigDataName(kind, d)
+	for i := range image.Attachments {
+		if image.Attachments[i].BigDataName == name {
+			attachment := image.Attachments[i]
+			return &attachment, nil
+		}
+	}
+	attachment := ImageAttachment{
+		Kind:        kind,
+		MediaType:   mediaType,
+		Digest:      d,
+		Size:        int64(len(data)),
+		BigDataName: name,
+		Created:     time.Now().UTC(),
+	}
+	// Adding a big data item with a new name saves the record of the
+	// attachment along with it.
+	image.Attachments = append(image.Attachments, attachment)
+	if err := r.SetBigData(image.ID, name, data, nil); err != nil {
+		image.Attachments = image.Attachments[:len(image.Attachments)-1]
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (r *imageStore) RemoveAttachment(id string, kind ImageAttachmentKind, d digest.Digest) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to remove attachments from images at %q", r.imagespath())
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	name := imageAttachmentBigDataName(kind, d)
+	index := -1
+	for i := range image.Attachments {
+		if image.Attachments[i].BigDataName == name {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return errors.Wrapf(ErrAttachmentUnknown, "image %q has no %q attachment with digest %q", image.ID, kind, d)
+	}
+	image.Attachments = append(image.Attachments[:index:index], image.Attachments[index+1:]...)
+	image.BigDataNames = stringSliceWithoutValue(image.BigDataNames, name)
+	delete(image.BigDataSizes, name)
+	delete(image.BigDataDigests, name)
+	blob, hadBlob := image.BigDataBlobs[name]
+	delete(image.BigDataBlobs, name)
+	if err := r.Save(); err != nil {
+		return err
+	}
+	if err := os.Remove(r.datapath(image.ID, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if hadBlob {
+		r.releaseBlob(blob)
+	}
+	return nil
+}
+
 func (r *imageStore) removeName(image *Image, name string) {
 	image.Names = stringSliceWithoutValue(image.Names, name)
 }
@@ -598,6 +891,9 @@ func (r *imageStore) Delete(id string) error {
 	if err := os.RemoveAll(r.datadir(id)); err != nil {
 		return err
 	}
+	for _, blob := range image.BigDataBlobs {
+		r.releaseBlob(blob)
+	}
 	return nil
 }
 
@@ -638,6 +934,17 @@ func (r *imageStore) BigData(id, key string) ([]byte, error) {
 	return ioutil.ReadFile(r.datapath(image.ID, key))
 }
 
+func (r *imageStore) BigDataReader(id, key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve image big data value for empty name")
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	return os.Open(r.datapath(image.ID, key))
+}
+
 func (r *imageStore) BigDataSize(id, key string) (int64, error) {
 	if key == "" {
 		return -1, errors.Wrapf(ErrInvalidBigDataName, "can't retrieve size of image big data with empty name")
@@ -652,8 +959,8 @@ func (r *imageStore) BigDataSize(id, key string) (int64, error) {
 	if size, ok := image.BigDataSizes[key]; ok {
 		return size, nil
 	}
-	if data, err := r.BigData(id, key); err == nil && data != nil {
-		return int64(len(data)), nil
+	if st, err := os.Stat(r.datapath(image.ID, key)); err == nil {
+		return st.Size(), nil
 	}
 	return -1, ErrSizeUnknown
 }
@@ -695,6 +1002,10 @@ func imageSliceWithoutValue(slice []*Image, value *Image) []*Image {
 }
 
 func (r *imageStore) SetBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error {
+	return r.SetBigDataFromReader(id, key, bytes.NewReader(data), digestManifest)
+}
+
+func (r *imageStore) SetBigDataFromReader(id, key string, data io.Reader, digestManifest func([]byte) (digest.Digest, error)) error {
 	if key == "" {
 		return errors.Wrapf(ErrInvalidBigDataName, "can't set empty name for image big data item")
 	}
@@ -714,20 +1025,56 @@ func (r *imageStore) SetBigData(id, key string, data []byte, digestManifest func
 		if digestManifest == nil {
 			return errors.Wrapf(ErrDigestUnknown, "error digesting manifest: no manifest digest callback provided")
 		}
-		if newDigest, err = digestManifest(data); err != nil {
+		// The callback needs to see the whole manifest, but manifests
+		// are small enough to read into memory.
+		manifest, err := ioutil.ReadAll(data)
+		if err != nil {
+			return errors.Wrapf(err, "error reading manifest")
+		}
+		if newDigest, err = digestManifest(manifest); err != nil {
 			return errors.Wrapf(err, "error digesting manifest")
 		}
-	} else {
-		newDigest = digest.Canonical.FromBytes(data)
+		data = bytes.NewReader(manifest)
 	}
-	err = ioutils.AtomicWriteFile(r.datapath(image.ID, key), data, 0600)
+	digester := digest.Canonical.Digester()
+	size, err := ioutils.AtomicWriteFileFromReaderWithOpts(r.datapath(image.ID, key), io.TeeReader(data, digester.Hash()), 0600, r.records.bigDataWriterOptions())
 	if err == nil {
+		contentDigest := digester.Digest()
+		if newDigest == "" {
+			newDigest = contentDigest
+		}
 		save := false
+		if image.BigDataBlobs == nil {
+			image.BigDataBlobs = make(map[string]digest.Digest)
+		}
+		oldBlob, hadBlob := image.BigDataBlobs[key]
+		if r.shareBigData(image.ID, key, contentDigest) {
+			image.BigDataBlobs[key] = contentDigest
+			r.blobrefs[contentDigest]++
+			defer func() {
+				// If we couldn't record that the item uses
+				// the blob, treat it as the image's own copy,
+				// so that the blob's count of references
+				// doesn't include it.
+				if err != nil {
+					delete(image.BigDataBlobs, key)
+					r.releaseBlob(contentDigest)
+				}
+			}()
+		} else {
+			delete(image.BigDataBlobs, key)
+		}
+		if hadBlob {
+			r.releaseBlob(oldBlob)
+		}
+		if newBlob, hasBlob := image.BigDataBlobs[key]; hasBlob != hadBlob || newBlob != oldBlob {
+			save = true
+		}
 		if image.BigDataSizes == nil {
 			image.BigDataSizes = make(map[string]int64)
 		}
 		oldSize, sizeOk := image.BigDataSizes[key]
-		image.BigDataSizes[key] = int64(len(data))
+		image.BigDataSizes[key] = size
 		if image.BigDataDigests == nil {
 			image.BigDataDigests = make(map[string]digest.Digest)
 		}
@@ -830,6 +1177,19 @@ func (r *imageStore) Locked() bool {
 	return r.lockfile.Locked()
 }
 
+// forceReload reloads the store's contents, whether or not its lock file
+// indicates that it was modified.  It should be called with the lock held.
+func (r *imageStore) forceReload() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	// Note that we've seen the current version of the lock file.
+	if _, err := r.Modified(); err != nil {
+		return err
+	}
+	return r.Load()
+}
+
 func (r *imageStore) ReloadIfChanged() error {
 	r.loadMut.Lock()
 	defer r.loadMut.Unlock()
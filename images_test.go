@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containers/storage/pkg/ioutils"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 )
@@ -12,7 +13,7 @@ import (
 func newTestImageStore(t *testing.T) ImageStore {
 	dir, err := ioutil.TempDir("", "storage")
 	require.Nil(t, err)
-	store, err := newImageStore(dir)
+	store, err := newImageStore(dir, ioutils.AtomicFileWriterOptions{})
 	require.Nil(t, err)
 	return store
 }
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/parsers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// imageStoreAccessFile is the name of the file, at the top of an
+	// additional image store, which lists the tokens that may be used to
+	// access it.  Stores which don't have one can be used by anyone who can
+	// read them.
+	imageStoreAccessFile = "access.json"
+	// imageStoreAccessLockFile serializes changes to imageStoreAccessFile.
+	imageStoreAccessLockFile = "access.lock"
+)
+
+// ImageStoreAccessToken describes a token which grants read-only access to
+// an additional image store.  Only a digest of the token is recorded, and that
+// digest is computed over the location of the store as well as the token, so
+// a token which was granted for one store can't be used to access another.
+//
+// Tokens are only checked by this library, so they're advisory: anyone who
+// can read the store's files can use its contents without one, either
+// directly or by using an older version of the library.  Keeping a store from
+// being read by users who shouldn't use it requires setting the permissions
+// or access control lists of its files accordingly.
+type ImageStoreAccessToken struct {
+	// Name identifies the token, so that it can be revoked.
+	Name string `json:"name"`
+	// Digest is the hex-encoded SHA-256 digest of the store's location
+	// and the token.
+	Digest string `json:"digest"`
+	// Created is when the token was granted.
+	Created time.Time `json:"created"`
+	// Expires, if not zero, is when the token stops being accepted.
+	Expires time.Time `json:"expires,omitempty"`
+	// Revoked is set when the token should no longer be accepted.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+type imageStoreAccess struct {
+	Tokens []ImageStoreAccessToken `json:"tokens"`
+}
+
+func imageStoreTokenDigest(store, token string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(store) + "\x00" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// readImageStoreAccess reads the list of tokens which grant access to an
+// additional image store, returning nil if the store doesn't require one.
+func readImageStoreAccess(store string) (*imageStoreAccess, error) {
+	data, err := ioutil.ReadFile(filepath.Join(store, imageStoreAccessFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	access := imageStoreAccess{}
+	if err := json.Unmarshal(data, &access); err != nil {
+		return nil, errors.Wrapf(err, "error parsing access list for image store %q", store)
+	}
+	return &access, nil
+}
+
+// updateImageStoreAccess applies fn to the list of tokens which grant access
+// to an additional image store, and saves the result.
+func updateImageStoreAccess(store string, fn func(*imageStoreAccess) error) error {
+	lock, err := GetLockfile(filepath.Join(store, imageStoreAccessLockFile))
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	access, err := readImageStoreAccess(store)
+	if err != nil {
+		return err
+	}
+	if access == nil {
+		access = &imageStoreAccess{}
+	}
+	if err := fn(access); err != nil {
+		return err
+	}
+	data, err := json.Marshal(access)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(store, imageStoreAccessFile), data, 0644)
+}
+
+// GrantImageStoreAccess creates a new token which grants read-only access to
+// the additional image store at the specified location, records it under the
+// specified name, and returns it.  Once a store has at least one token, Stores
+// which list it as an additional image store will ignore it unless they are
+// configured with a valid token for it.  If expires is not zero, the token
+// will not be accepted after that time.  Tokens are advisory; see
+// ImageStoreAccessToken.
+func GrantImageStoreAccess(store, name string, expires time.Time) (string, error) {
+	if name == "" {
+		return "", errors.New("image store access tokens must be named")
+	}
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw[:])
+	err := updateImageStoreAccess(store, func(access *imageStoreAccess) error {
+		for _, t := range access.Tokens {
+			if t.Name == name && !t.Revoked {
+				return errors.Wrapf(ErrDuplicateName, "image store %q already has an access token named %q", store, name)
+			}
+		}
+		access.Tokens = append(access.Tokens, ImageStoreAccessToken{
+			Name:    name,
+			Digest:  imageStoreTokenDigest(store, token),
+			Created: time.Now().UTC(),
+			Expires: expires.UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeImageStoreAccess revokes the token with the specified name, so that it
+// no longer grants access to the additional image store at the specified
+// location.  Stores which have already loaded the image store's contents will
+// continue to use them until they are reinitialized.
+func RevokeImageStoreAccess(store, name string) error {
+	return updateImageStoreAccess(store, func(access *imageStoreAccess) error {
+		found := false
+		for i := range access.Tokens {
+			if access.Tokens[i].Name == name && !access.Tokens[i].Revoked {
+				access.Tokens[i].Revoked = true
+				found = true
+			}
+		}
+		if !found {
+			return errors.Wrapf(ErrImageStoreAccessDenied, "image store %q has no access token named %q", store, name)
+		}
+		return nil
+	})
+}
+
+// ImageStoreAccessTokens returns the list of tokens which have been granted
+// for the additional image store at the specified location.
+func ImageStoreAccessTokens(store string) ([]ImageStoreAccessToken, error) {
+	access, err := readImageStoreAccess(store)
+	if err != nil || access == nil {
+		return nil, err
+	}
+	return access.Tokens, nil
+}
+
+// CheckImageStoreAccess checks whether or not the token allows the additional
+// image store at the specified location to be used.  Stores which don't
+// require a token can be used with any token, including an empty one.
+func CheckImageStoreAccess(store, token string) error {
+	access, err := readImageStoreAccess(store)
+	if err != nil {
+		return err
+	}
+	if access == nil {
+		return nil
+	}
+	if token == "" {
+		return errors.Wrapf(ErrImageStoreAccessDenied, "image store %q requires an access token", store)
+	}
+	digest := []byte(imageStoreTokenDigest(store, token))
+	now := time.Now()
+	for _, t := range access.Tokens {
+		if subtle.ConstantTimeCompare(digest, []byte(t.Digest)) != 1 {
+			continue
+		}
+		if t.Revoked {
+			return errors.Wrapf(ErrImageStoreAccessDenied, "access token %q for image store %q has been revoked", t.Name, store)
+		}
+		if !t.Expires.IsZero() && now.After(t.Expires) {
+			return errors.Wrapf(ErrImageStoreAccessDenied, "access token %q for image store %q expired at %s", t.Name, store, t.Expires)
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrImageStoreAccessDenied, "invalid access token for image store %q", store)
+}
+
+// imageStoreAccessible checks whether or not our tokens allow us to use the
+// additional image store at the specified location.
+func (s *store) imageStoreAccessible(store string) bool {
+	token := s.imageStoreTokens[store]
+	if token == "" {
+		token = s.imageStoreTokens[filepath.Clean(store)]
+	}
+	if err := CheckImageStoreAccess(store, token); err != nil {
+		logrus.Warnf("Not using additional image store: %v", err)
+		return false
+	}
+	return true
+}
+
+// accessibleDriverOptions returns a copy of the graph driver options with the
+// additional image stores which our tokens don't allow us to use, and any
+// options which are specific to them, removed, so that the driver never finds
+// layers in them.  The remaining stores are sorted by priority, so that the
+// driver searches them in the same order as we do.
+func (s *store) accessibleDriverOptions(options []string) []string {
+	denied := make(map[string]bool)
+	var filtered []string
+	// The driver adds the stores from every image store option to one
+	// list, so gather them into the first option with each key.
+	storeOptions := make(map[string]int)
+	var storeKeys []string
+	var storeLists [][]string
+	for _, option := range options {
+		if option == "" {
+			continue
+		}
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			filtered = append(filtered, option)
+			continue
+		}
+		name := strings.ToLower(key)
+		if i := strings.LastIndex(name, "."); i != -1 {
+			name = name[i+1:]
+		}
+		switch name {
+		case "imagestore", "additionalimagestore":
+			i, ok := storeOptions[key]
+			if !ok {
+				i = len(storeKeys)
+				storeOptions[key] = i
+				storeKeys = append(storeKeys, key)
+				storeLists = append(storeLists, nil)
+				// Hold its place until we have the whole list.
+				filtered = append(filtered, "")
+			}
+			for _, store := range strings.Split(val, ",") {
+				if store == "" {
+					continue
+				}
+				if !s.imageStoreAccessible(store) {
+					denied[filepath.Clean(store)] = true
+					continue
+				}
+				storeLists[i] = append(storeLists[i], store)
+			}
+			continue
+		case "imagestore_mount_program", "imagestore_mountopt":
+			if i := strings.Index(val, "="); i != -1 && denied[filepath.Clean(val[:i])] {
+				continue
+			}
+		}
+		filtered = append(filtered, option)
+	}
+	var result []string
+	next := 0
+	for _, option := range filtered {
+		if option != "" {
+			result = append(result, option)
+			continue
+		}
+		if stores := storeLists[next]; len(stores) > 0 {
+			result = append(result, storeKeys[next]+"="+strings.Join(s.prioritizedImageStores(stores), ","))
+		}
+		next++
+	}
+	return result
+}
+
+// sameImageStoreTokens checks whether or not two sets of image store access
+// tokens are the same.
+func sameImageStoreTokens(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for store, token := range a {
+		if other, ok := b[store]; !ok || subtle.ConstantTimeCompare([]byte(token), []byte(other)) != 1 {
+			return false
+		}
+	}
+	return true
+}
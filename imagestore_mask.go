@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// prioritizedImageStores sorts the additional image stores so that the ones
+// with the highest priorities are searched first.  Stores with the same
+// priority keep the order in which they were listed.
+func (s *store) prioritizedImageStores(stores []string) []string {
+	priority := func(store string) int {
+		if p, ok := s.imageStorePriorities[store]; ok {
+			return p
+		}
+		return s.imageStorePriorities[filepath.Clean(store)]
+	}
+	sorted := append([]string{}, stores...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return priority(sorted[i]) > priority(sorted[j])
+	})
+	return sorted
+}
+
+// imageMasks is the list of IDs of images in additional image stores which
+// have been hidden, which is kept in a file alongside the Store's own image
+// records so that the stores which contain the images aren't modified.
+type imageMasks struct {
+	lock   sync.Mutex
+	path   string
+	mtime  time.Time
+	size   int64
+	masked map[string]bool
+}
+
+func newImageMasks(path string) *imageMasks {
+	return &imageMasks{
+		path:   path,
+		masked: make(map[string]bool),
+	}
+}
+
+// reload reads the list again if the file has changed since it was last read.
+// It should be called with the lock held.
+func (m *imageMasks) reload() error {
+	st, err := os.Stat(m.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		m.mtime, m.size = time.Time{}, 0
+		m.masked = make(map[string]bool)
+		return nil
+	}
+	if st.ModTime().Equal(m.mtime) && st.Size() == m.size {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return errors.Wrapf(err, "error decoding list of masked images %q", m.path)
+		}
+	}
+	m.masked = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		m.masked[id] = true
+	}
+	m.mtime, m.size = st.ModTime(), st.Size()
+	return nil
+}
+
+// isMasked returns true if the image with the specified ID has been hidden.
+func (m *imageMasks) isMasked(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return false
+	}
+	return m.masked[id]
+}
+
+// list returns the IDs of the images which have been hidden.
+func (m *imageMasks) list() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(m.masked))
+	for id := range m.masked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// set hides the image with the specified ID, or stops hiding it.  It should
+// be called with the Store's image store locked for writing.
+func (m *imageMasks) set(id string, masked bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.reload(); err != nil {
+		return err
+	}
+	if m.masked[id] == masked {
+		return nil
+	}
+	if masked {
+		m.masked[id] = true
+	} else {
+		delete(m.masked, id)
+	}
+	ids := make([]string, 0, len(m.masked))
+	for id := range m.masked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	data, err := json.Marshal(&ids)
+	if err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(m.path, data, 0600); err != nil {
+		return err
+	}
+	// Force the next check to read the file, in case it was modified
+	// too quickly for the modification time to change.
+	m.mtime, m.size = time.Time{}, -1
+	return nil
+}
+
+// maskedImageStore wraps an additional image store, and hides the images in
+// it which have been masked.
+type maskedImageStore struct {
+	ROImageStore
+	masks *imageMasks
+}
+
+// visible looks up an image, returning it only if it hasn't been masked.
+func (r *maskedImageStore) visible(id string) (*Image, error) {
+	image, err := r.ROImageStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.masks.isMasked(image.ID) {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+	}
+	return image, nil
+}
+
+func (r *maskedImageStore) Exists(id string) bool {
+	_, err := r.visible(id)
+	return err == nil
+}
+
+func (r *maskedImageStore) Get(id string) (*Image, error) {
+	return r.visible(id)
+}
+
+func (r *maskedImageStore) Lookup(name string) (string, error) {
+	image, err := r.visible(name)
+	if err != nil {
+		return "", err
+	}
+	return image.ID, nil
+}
+
+func (r *maskedImageStore) Images() ([]Image, error) {
+	images, err := r.ROImageStore.Images()
+	if err != nil {
+		return nil, err
+	}
+	visible := images[:0]
+	for _, image := range images {
+		if !r.masks.isMasked(image.ID) {
+			visible = append(visible, image)
+		}
+	}
+	return visible, nil
+}
+
+func (r *maskedImageStore) ByDigest(d digest.Digest) ([]*Image, error) {
+	images, err := r.ROImageStore.ByDigest(d)
+	if err != nil {
+		return nil, err
+	}
+	var visible []*Image
+	for _, image := range images {
+		if !r.masks.isMasked(image.ID) {
+			visible = append(visible, image)
+		}
+	}
+	if len(visible) == 0 {
+		return nil, errors.Wrapf(ErrImageUnknown, "error locating image with digest %q", d)
+	}
+	return visible, nil
+}
+
+func (r *maskedImageStore) Metadata(id string) (string, error) {
+	if _, err := r.visible(id); err != nil {
+		return "", err
+	}
+	return r.ROImageStore.Metadata(id)
+}
+
+func (r *maskedImageStore) BigData(id, key string) ([]byte, error) {
+	if _, err := r.visible(id); err != nil {
+		return nil, err
+	}
+	return r.ROImageStore.BigData(id, key)
+}
+
+func (r *maskedImageStore) BigDataReader(id, key string) (io.ReadCloser, error) {
+	if _, err := r.visible(id); err != nil {
+		return nil, err
+	}
+	return r.ROImageStore.BigDataReader(id, key)
+}
+
+func (r *maskedImageStore) BigDataSize(id, key string) (int64, error) {
+	if _, err := r.visible(id); err != nil {
+		return -1, err
+	}
+	return r.ROImageStore.BigDataSize(id, key)
+}
+
+func (r *maskedImageStore) BigDataDigest(id, key string) (digest.Digest, error) {
+	if _, err := r.visible(id); err != nil {
+		return "", err
+	}
+	return r.ROImageStore.BigDataDigest(id, key)
+}
+
+func (r *maskedImageStore) BigDataNames(id string) ([]string, error) {
+	if _, err := r.visible(id); err != nil {
+		return nil, err
+	}
+	return r.ROImageStore.BigDataNames(id)
+}
+
+func (r *maskedImageStore) Attachments(id string, kind ImageAttachmentKind) ([]ImageAttachment, error) {
+	if _, err := r.visible(id); err != nil {
+		return nil, err
+	}
+	return r.ROImageStore.Attachments(id, kind)
+}
+
+func (s *store) MaskImage(id string) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to mask images in %q", s.graphRoot)
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	if ristore.Exists(id) {
+		return errors.Errorf("image %q is not in an additional image store", id)
+	}
+	for _, istore := range istores {
+		store := istore
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return err
+		}
+		if image, err := store.Get(id); err == nil {
+			return s.imageMasks.set(image.ID, true)
+		}
+	}
+	return errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (s *store) UnmaskImage(id string) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to unmask images in %q", s.graphRoot)
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	masked, err := s.imageMasks.list()
+	if err != nil {
+		return err
+	}
+	for _, maskedID := range masked {
+		if maskedID == id {
+			return s.imageMasks.set(id, false)
+		}
+	}
+	return errors.Wrapf(ErrImageUnknown, "image %q is not masked", id)
+}
+
+func (s *store) MaskedImages() ([]string, error) {
+	if _, err := s.ImageStore(); err != nil {
+		return nil, err
+	}
+	return s.imageMasks.list()
+}
+
+func (s *store) ResolveImageStore(id string) (string, error) {
+	istore, err := s.ImageStore()
+	if err != nil {
+		return "", err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return "", err
+	}
+	for i, candidate := range append([]ROImageStore{istore}, istores...) {
+		store := candidate
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return "", err
+		}
+		if store.Exists(id) {
+			if i == 0 {
+				return s.graphRoot, nil
+			}
+			return s.imageStores[i-1], nil
+		}
+	}
+	return "", errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (s *store) ResolveLayerStore(id string) (string, error) {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return "", err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return "", err
+	}
+	for i, candidate := range append([]ROLayerStore{lstore}, lstores...) {
+		store := candidate
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return "", err
+		}
+		if store.Exists(id) {
+			if i == 0 {
+				return s.graphRoot, nil
+			}
+			return s.imageStores[i-1], nil
+		}
+	}
+	return "", errors.Wrapf(ErrLayerUnknown, "error locating layer with ID %q", id)
+}
@@ -9,13 +9,17 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
 	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/mount"
@@ -26,6 +30,7 @@ import (
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/klauspost/pgzip"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -35,8 +40,9 @@ import (
 )
 
 const (
-	tarSplitSuffix = ".tar-split.gz"
-	incompleteFlag = "incomplete"
+	tarSplitSuffix  = ".tar-split.gz"
+	incompleteFlag  = "incomplete"
+	applyingPIDFlag = "applying-pid"
 )
 
 // A Layer is a record of a copy-on-write layer that's stored by the lower
@@ -62,6 +68,15 @@ type Layer struct {
 	// the layer.
 	MountLabel string `json:"mountlabel,omitempty"`
 
+	// RelabeledMountLabel is the SELinux label which the layer's contents
+	// were last relabeled with while it was being mounted, and
+	// RelabeledShared is set if that was done so that any container could
+	// use them.  Mounting the layer again with the same label and policy
+	// doesn't relabel its contents again, unless they've been replaced
+	// since.
+	RelabeledMountLabel string `json:"relabeled-mountlabel,omitempty"`
+	RelabeledShared     bool   `json:"relabeled-shared,omitempty"`
+
 	// MountPoint is the path where the layer is mounted, or where it was most
 	// recently mounted.  This can change between subsequent Unmount() and
 	// Mount() calls, so the caller should consult this value after Mount()
@@ -72,6 +87,11 @@ type Layer struct {
 	// mounted at the mount point.
 	MountCount int `json:"-"`
 
+	// Annotations are key/value pairs which we keep for the convenience
+	// of the caller.  Unlike Metadata, they can be updated individually,
+	// and used to search for layers.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
 	// Created is the datestamp for when this layer was created.  Older
 	// versions of the library did not track this information, so callers
 	// will likely want to use the IsZero() method to verify that a value
@@ -93,6 +113,11 @@ type Layer struct {
 	// as a DiffID.
 	UncompressedDigest digest.Digest `json:"diff-digest,omitempty"`
 
+	// AdditionalUncompressedDigests are digests of the same data as
+	// UncompressedDigest, which always uses digest.Canonical, computed
+	// using the store's DigestAlgorithm, if that's a different one.
+	AdditionalUncompressedDigests []digest.Digest `json:"additional-diff-digests,omitempty"`
+
 	// UncompressedSize is the length of the blob that was last passed to
 	// ApplyDiff() or Put(), after we decompressed it.  If
 	// UncompressedDigest is not set, this should be treated as if it were
@@ -120,22 +145,88 @@ type Layer struct {
 	// ReadOnly is true if this layer resides in a read-only layer store.
 	ReadOnly bool `json:"-"`
 
+	// ImageStore is the location of the writable image store in which
+	// the layer's contents are kept, if it was placed in one instead of
+	// under the store's GraphRoot.
+	ImageStore string `json:"imagestore,omitempty"`
+
 	// BigDataNames is a list of names of data items that we keep for the
 	// convenience of the caller.  They can be large, and are only in
 	// memory when being read from or written to disk.
 	BigDataNames []string `json:"big-data-names,omitempty"`
+
+	// Provenance records where the layer's contents came from, if the
+	// caller which created it told us.
+	Provenance *LayerProvenance `json:"provenance,omitempty"`
+
+	// ComposefsDigest is the fs-verity digest of the composefs image which
+	// was built from the layer's contents, if the layer has been converted
+	// into one.
+	ComposefsDigest digest.Digest `json:"composefs-digest,omitempty"`
+
+	// EncryptionKeyID is the ID of the key which the layer's contents are
+	// encrypted with, if they are.
+	EncryptionKeyID string `json:"encryption-key-id,omitempty"`
+
+	// CopyStats describes how much of the contents of files which the
+	// driver copied into the layer when it was populated were cloned, and
+	// how much were actually copied, if the driver copies files into new
+	// layers.
+	CopyStats *copy.Stats `json:"copy-stats,omitempty"`
 }
 
 type layerMountPoint struct {
 	ID         string `json:"id"`
 	MountPoint string `json:"path"`
 	MountCount int    `json:"count"`
+	// ReadOnly is set if the layer was mounted read-only, in which case
+	// it can be shared with other processes which want to mount it
+	// read-only, but not with those which want to write to it.
+	ReadOnly bool `json:"read-only,omitempty"`
+	// AdditionalLowers is the list of additional lower directories which
+	// were included in the mount, which can only be shared with others
+	// who want to use the same list.
+	AdditionalLowers []string `json:"additional-lowers,omitempty"`
+	// Holders maps the IDs of processes which have mounted the layer to
+	// the number of references to the mount which each of them holds.
+	Holders map[int]int `json:"holders,omitempty"`
+	// HolderStartTimes maps the IDs of processes which have mounted the
+	// layer to the times at which they started, in clock ticks after
+	// boot, so that a process which reuses the ID of one which exited
+	// isn't mistaken for it.
+	HolderStartTimes map[int]uint64 `json:"holder-start-times,omitempty"`
+	// MountNamespace identifies the mount namespace in which the layer
+	// was mounted, so that processes in other mount namespaces, which
+	// can't see the mount, don't conclude that it was unmounted.
+	MountNamespace string `json:"mount-namespace,omitempty"`
 }
 
 // DiffOptions override the default behavior of Diff() methods.
 type DiffOptions struct {
 	// Compression, if set overrides the default compressor when generating a diff.
 	Compression *archive.Compression
+	// CompressionOptions, if set, tunes the compressor which is used when
+	// the diff is compressed using gzip or zstd.
+	CompressionOptions *archive.CompressionOptions
+	// Reproducible, if set, causes the headers in the diff to be adjusted
+	// so that diffs of layers with identical contents are identical:
+	// modification times are clamped to SourceDateEpoch, access and
+	// change times are dropped, and only numeric user and group IDs are
+	// kept.
+	Reproducible bool
+	// SourceDateEpoch is the time to which modification times are clamped
+	// when Reproducible is set.  If it is not set, all modification times
+	// are set to the start of the Unix epoch.
+	SourceDateEpoch *time.Time
+	// Progress, if set, is called as each entry in the diff is read by
+	// the caller.
+	Progress archive.ProgressFunc
+	// Sparse, if set, causes regular files which have holes in them to be
+	// stored as sparse entries in diffs which are generated from the
+	// layer's contents.  It has no effect on diffs which are reproduced
+	// from the layer's tar-split data.  Layers which are created from
+	// diffs which contain sparse entries don't keep tar-split data.
+	Sparse bool
 }
 
 // ROLayerStore wraps a graph driver, adding the ability to refer to layers by
@@ -159,7 +250,9 @@ type ROLayerStore interface {
 	// Changes returns a slice of Change structures, which contain a pathname
 	// (Path) and a description of what sort of change (Kind) was made by the
 	// layer (either ChangeModify, ChangeAdd, or ChangeDelete), relative to a
-	// specified layer.  By default, the layer's parent is used as a reference.
+	// specified layer, which need not be one of its ancestors.  By default,
+	// or if the specified layer isn't known, the layer's parent is used as
+	// a reference.
 	Changes(from, to string) ([]archive.Change, error)
 
 	// Diff produces a tarstream which can be applied to a layer with the contents
@@ -202,6 +295,7 @@ type LayerStore interface {
 	RWFileBasedStore
 	RWMetadataStore
 	FlaggableStore
+	AnnotatedStore
 	RWLayerBigDataStore
 
 	// Create creates a new layer, optionally giving it a specified ID rather than
@@ -219,6 +313,22 @@ type LayerStore interface {
 	// Put combines the functions of CreateWithFlags and ApplyDiff.
 	Put(id string, parent *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, flags map[string]interface{}, diff io.Reader) (*Layer, int64, error)
 
+	// Snapshot creates a layer which holds the current contents of the
+	// specified layer, which must not be mounted, and which has the same
+	// parent, and makes it the parent of the specified layer, which is
+	// left with no changes of its own.  Any information which was
+	// recorded about the specified layer's diff is moved to the new
+	// layer.
+	Snapshot(id string, names []string) (*Layer, error)
+
+	// Reset discards the contents of the specified layer, which must not
+	// be mounted, and makes parent, which must be either the layer's
+	// parent or one of its ancestors, its parent.  If the driver can't
+	// reset layers in place, the layer is recreated as a writeable
+	// layer, without any of the storage options which were used when it
+	// was first created.
+	Reset(id, parent string) error
+
 	// SetNames replaces the list of names associated with a layer with the
 	// supplied values.
 	// Deprecated: Prone to race conditions, suggested alternatives are `AddNames` and `RemoveNames`.
@@ -258,6 +368,13 @@ type LayerStore interface {
 	// applies its changes to a specified layer.
 	ApplyDiff(to string, diff io.Reader) (int64, error)
 
+	// ApplyDiffWithOptions is like ApplyDiff, but uses the digests and the
+	// progress callback, if any, which are set in options.
+	ApplyDiffWithOptions(to string, options *LayerOptions, diff io.Reader) (int64, error)
+
+	// ApplyDirectory adds the contents of a directory to a layer.
+	ApplyDirectory(to, dir string, options *ApplyDirectoryOptions) (int64, error)
+
 	// ApplyDiffWithDiffer applies the changes through the differ callback function.
 	// If to is the empty string, then a staging directory is created by the driver.
 	ApplyDiffWithDiffer(to string, options *drivers.ApplyDiffOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error)
@@ -271,6 +388,10 @@ type LayerStore interface {
 	// DifferTarget gets the location where files are stored for the layer.
 	DifferTarget(id string) (string, error)
 
+	// SetComposefsDigest records the fs-verity digest of the composefs
+	// image which was built from the layer's contents.
+	SetComposefsDigest(id string, d digest.Digest) error
+
 	// LoadLocked wraps Load in a locked state. This means it loads the store
 	// and cleans-up invalid layers if needed.
 	LoadLocked() error
@@ -292,37 +413,113 @@ type layerStore struct {
 	byid               map[string]*Layer
 	byname             map[string]*Layer
 	bymount            map[string]*Layer
-	bycompressedsum    map[digest.Digest][]string
-	byuncompressedsum  map[digest.Digest][]string
+	mountHolders       map[string]map[int]int
+	mountHolderStarts  map[string]map[int]uint64
+	mountReadOnly      map[string]bool
+	mountLowers        map[string][]string
+	mountNamespaces    map[string]string
 	uidMap             []idtools.IDMap
 	gidMap             []idtools.IDMap
 	loadMut            sync.Mutex
 	layerspathModified time.Time
+	// hardlinkDedup is set if files in new layers should be replaced
+	// with hard links to identical files in other layers.
+	hardlinkDedup bool
+	// dedupIndex is our copy of the index of files which new layers can
+	// share, if we've read it, and dedupIndexChanged is set if we've
+	// changed it since it was read or last saved.
+	dedupIndex        dedupIndex
+	dedupIndexChanged bool
+	// trackChanges is set if we should keep journals of changes made to
+	// read-write layers while they're mounted.
+	trackChanges bool
+	// idGenerator, if not nil, generates IDs for new layers.
+	idGenerator stringid.Generator
+	// reservedSpace is the number of bytes which should be left free
+	// when adding to the contents of layers.
+	reservedSpace int64
+	// digestAlgorithm is the algorithm which we use to compute the
+	// digests of the uncompressed contents of layers.
+	digestAlgorithm digest.Algorithm
+	// keyProvider supplies the keys which layers are encrypted with, and
+	// encryptionKeyID is the ID of the key which is used by default.
+	keyProvider     fscrypt.KeyProvider
+	encryptionKeyID string
+	// loadedKeys records which keys we've added to the file systems which
+	// hold the contents of layers.
+	loadedKeys map[string]bool
+	// trash, if set, is where the layer's data directory is moved when
+	// it's deleted, and where the removal of the layer's contents is
+	// queued, if the driver can move them out of the way.
+	trash *trash
+	// records reads and writes the file which holds the records.
+	records recordsFile
+	// bycompressedsum and byuncompressedsum index layers by digest.  They
+	// aren't loaded until they're needed, at which point digestsLoaded is
+	// set.  digestsRecords is the digest of the version of the records
+	// which we last read or wrote, digestsChanges are the changes which
+	// we've made to the indexes since then, and digestsCompact is set if
+	// the saved indexes should be rewritten instead of appending to their
+	// log.  digestsMut protects all of them.
+	digestsMut        sync.Mutex
+	digestsLoaded     bool
+	digestsRecords    digest.Digest
+	digestsChanges    []layerDigestChange
+	digestsCompact    bool
+	bycompressedsum   map[digest.Digest][]string
+	byuncompressedsum map[digest.Digest][]string
 }
 
 func copyLayer(l *Layer) *Layer {
 	return &Layer{
-		ID:                 l.ID,
-		Names:              copyStringSlice(l.Names),
-		Parent:             l.Parent,
-		Metadata:           l.Metadata,
-		MountLabel:         l.MountLabel,
-		MountPoint:         l.MountPoint,
-		MountCount:         l.MountCount,
-		Created:            l.Created,
-		CompressedDigest:   l.CompressedDigest,
-		CompressedSize:     l.CompressedSize,
-		UncompressedDigest: l.UncompressedDigest,
-		UncompressedSize:   l.UncompressedSize,
-		CompressionType:    l.CompressionType,
-		ReadOnly:           l.ReadOnly,
-		BigDataNames:       copyStringSlice(l.BigDataNames),
-		Flags:              copyStringInterfaceMap(l.Flags),
-		UIDMap:             copyIDMap(l.UIDMap),
-		GIDMap:             copyIDMap(l.GIDMap),
-		UIDs:               copyUint32Slice(l.UIDs),
-		GIDs:               copyUint32Slice(l.GIDs),
+		ID:                  l.ID,
+		Names:               copyStringSlice(l.Names),
+		Parent:              l.Parent,
+		Metadata:            l.Metadata,
+		MountLabel:          l.MountLabel,
+		RelabeledMountLabel: l.RelabeledMountLabel,
+		RelabeledShared:     l.RelabeledShared,
+		MountPoint:          l.MountPoint,
+		MountCount:          l.MountCount,
+		Created:             l.Created,
+		CompressedDigest:    l.CompressedDigest,
+		CompressedSize:      l.CompressedSize,
+		UncompressedDigest:  l.UncompressedDigest,
+		UncompressedSize:    l.UncompressedSize,
+		CompressionType:     l.CompressionType,
+		ReadOnly:            l.ReadOnly,
+		ImageStore:          l.ImageStore,
+		BigDataNames:        copyStringSlice(l.BigDataNames),
+		Flags:               copyStringInterfaceMap(l.Flags),
+		Annotations:         copyStringStringMap(l.Annotations),
+		UIDMap:              copyIDMap(l.UIDMap),
+		GIDMap:              copyIDMap(l.GIDMap),
+		UIDs:                copyUint32Slice(l.UIDs),
+		GIDs:                copyUint32Slice(l.GIDs),
+		Provenance:          copyLayerProvenance(l.Provenance),
+		ComposefsDigest:     l.ComposefsDigest,
+		EncryptionKeyID:     l.EncryptionKeyID,
+		CopyStats:           copyCopyStats(l.CopyStats),
+
+		AdditionalUncompressedDigests: copyDigestSlice(l.AdditionalUncompressedDigests),
+	}
+}
+
+func copyCopyStats(s *copy.Stats) *copy.Stats {
+	if s == nil {
+		return nil
+	}
+	stats := *s
+	return &stats
+}
+
+// takeCopyStats retrieves statistics about copying files into the layer from
+// the driver, if it collects them.
+func (r *layerStore) takeCopyStats(id string) *copy.Stats {
+	if d, ok := r.driver.(drivers.CopyStatsDriver); ok {
+		return d.TakeCopyStats(id)
 	}
+	return nil
 }
 
 func (r *layerStore) Layers() ([]Layer, error) {
@@ -344,20 +541,21 @@ func (r *layerStore) layerspath() string {
 func (r *layerStore) Load() error {
 	shouldSave := false
 	rpath := r.layerspath()
-	data, err := ioutil.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	var layers []*Layer
+	version, err := r.records.decode(rpath, func() interface{} {
+		layers = []*Layer{}
+		return &layers
+	})
+	if err != nil && !errors.Is(err, ErrStoreCorrupt) {
 		return err
 	}
-	layers := []*Layer{}
 	idlist := []string{}
 	ids := make(map[string]*Layer)
 	names := make(map[string]*Layer)
-	compressedsums := make(map[digest.Digest][]string)
-	uncompressedsums := make(map[digest.Digest][]string)
 	if r.IsReadWrite() {
 		label.ClearLabels()
 	}
-	if err = json.Unmarshal(data, &layers); len(data) == 0 || err == nil {
+	if err == nil {
 		idlist = make([]string, 0, len(layers))
 		for n, layer := range layers {
 			ids[layer.ID] = layers[n]
@@ -369,18 +567,11 @@ func (r *layerStore) Load() error {
 				}
 				names[name] = layers[n]
 			}
-			if layer.CompressedDigest != "" {
-				compressedsums[layer.CompressedDigest] = append(compressedsums[layer.CompressedDigest], layer.ID)
-			}
-			if layer.UncompressedDigest != "" {
-				uncompressedsums[layer.UncompressedDigest] = append(uncompressedsums[layer.UncompressedDigest], layer.ID)
-			}
 			if layer.MountLabel != "" {
 				label.ReserveLabel(layer.MountLabel)
 			}
 			layer.ReadOnly = !r.IsReadWrite()
 		}
-		err = nil
 	}
 	if shouldSave && (!r.IsReadWrite() || !r.Locked()) {
 		return ErrDuplicateLayerNames
@@ -389,17 +580,24 @@ func (r *layerStore) Load() error {
 	r.idindex = truncindex.NewTruncIndex(idlist)
 	r.byid = ids
 	r.byname = names
-	r.bycompressedsum = compressedsums
-	r.byuncompressedsum = uncompressedsums
+	// The indexes of layers by digest are only loaded or built if
+	// they're needed.
+	r.resetDigests(version)
+	r.resetDedupIndex()
+	if err != nil {
+		return err
+	}
+	r.loadEncryptionKeys()
 
 	// Load and merge information about which layers are mounted, and where.
-	if r.IsReadWrite() {
+	if r.mountsLockfile != nil {
 		r.mountsLockfile.RLock()
 		defer r.mountsLockfile.Unlock()
 		if err = r.loadMounts(); err != nil {
 			return err
 		}
-
+	}
+	if r.IsReadWrite() {
 		// Last step: as we’re writable, try to remove anything that a previous
 		// user of this storage area marked for deletion but didn't manage to
 		// actually delete.
@@ -409,6 +607,9 @@ func (r *layerStore) Load() error {
 					layer.Flags = make(map[string]interface{})
 				}
 				if layerHasIncompleteFlag(layer) {
+					if layerIsBeingApplied(layer) {
+						continue
+					}
 					logrus.Warnf("Found incomplete layer %#v, deleting it", layer.ID)
 					err = r.deleteInternal(layer.ID)
 					if err != nil {
@@ -452,6 +653,11 @@ func (r *layerStore) loadMounts() error {
 			layer.MountPoint = ""
 			layer.MountCount = 0
 		}
+		r.mountHolders = make(map[string]map[int]int)
+		r.mountHolderStarts = make(map[string]map[int]uint64)
+		r.mountReadOnly = make(map[string]bool)
+		r.mountLowers = make(map[string][]string)
+		r.mountNamespaces = make(map[string]string)
 		// All of the non-zero count values will have been encoded, so
 		// we reset the still-mounted ones based on the contents.
 		for _, mount := range layerMounts {
@@ -460,10 +666,27 @@ func (r *layerStore) loadMounts() error {
 					mounts[mount.MountPoint] = layer
 					layer.MountPoint = mount.MountPoint
 					layer.MountCount = mount.MountCount
+					if len(mount.Holders) > 0 {
+						r.mountHolders[layer.ID] = mount.Holders
+					}
+					if len(mount.HolderStartTimes) > 0 {
+						r.mountHolderStarts[layer.ID] = mount.HolderStartTimes
+					}
+					if mount.ReadOnly {
+						r.mountReadOnly[layer.ID] = true
+					}
+					if len(mount.AdditionalLowers) > 0 {
+						r.mountLowers[layer.ID] = mount.AdditionalLowers
+					}
+					if mount.MountNamespace != "" {
+						r.mountNamespaces[layer.ID] = mount.MountNamespace
+					}
 				}
 			}
 		}
 		err = nil
+	} else {
+		err = corruptRecordsError(mpath, err)
 	}
 	r.bymount = mounts
 	return err
@@ -495,11 +718,16 @@ func (r *layerStore) saveLayers() error {
 		return err
 	}
 	defer r.Touch()
-	return ioutils.AtomicWriteFile(rpath, jldata, 0600)
+	if err := r.records.write(rpath, jldata); err != nil {
+		return err
+	}
+	r.saveDigestIndex(digest.FromBytes(jldata))
+	r.saveDedupIndex()
+	return nil
 }
 
 func (r *layerStore) saveMounts() error {
-	if !r.IsReadWrite() {
+	if r.mountsLockfile == nil {
 		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the layer store at %q", r.layerspath())
 	}
 	if !r.mountsLockfile.Locked() {
@@ -513,9 +741,14 @@ func (r *layerStore) saveMounts() error {
 	for _, layer := range r.layers {
 		if layer.MountPoint != "" && layer.MountCount > 0 {
 			mounts = append(mounts, layerMountPoint{
-				ID:         layer.ID,
-				MountPoint: layer.MountPoint,
-				MountCount: layer.MountCount,
+				ID:               layer.ID,
+				MountPoint:       layer.MountPoint,
+				MountCount:       layer.MountCount,
+				ReadOnly:         r.mountReadOnly[layer.ID],
+				AdditionalLowers: r.mountLowers[layer.ID],
+				Holders:          r.mountHolders[layer.ID],
+				HolderStartTimes: r.mountHolderStarts[layer.ID],
+				MountNamespace:   r.mountNamespaces[layer.ID],
 			})
 		}
 	}
@@ -529,14 +762,236 @@ func (r *layerStore) saveMounts() error {
 	return r.loadMounts()
 }
 
+// reconcileMounts compares the mount counts which were recorded in the run
+// root with the list of file systems which are actually mounted.  Layers which
+// are recorded as mounted, but which aren't, and which no live process claims
+// to be using, for example because the system was rebooted or because the
+// processes which mounted them crashed and something else unmounted them, are
+// marked as not being mounted.  Layers which were mounted in a different
+// mount namespace are left alone, since we can't see their mounts.  Layers
+// which are still mounted where the graph driver would mount them, but which
+// aren't recorded as mounted, for example because the run root was cleaned
+// out, are recorded as being mounted once, so that they can be unmounted.
+func (r *layerStore) reconcileMounts() error {
+	if r.mountsLockfile == nil {
+		return nil
+	}
+	r.mountsLockfile.Lock()
+	defer r.mountsLockfile.Unlock()
+	if err := r.loadMounts(); err != nil {
+		return err
+	}
+	// Only mounts under the graph root can be ones which the graph
+	// driver made for us, so we only need to index those.
+	graphRoot := filepath.Dir(r.layerdir)
+	index, err := mount.NewIndex(mount.PrefixFilter(graphRoot))
+	if err != nil {
+		return err
+	}
+	var candidates []string
+	for _, info := range index.Under(graphRoot) {
+		if info.Mountpoint != graphRoot {
+			candidates = append(candidates, info.Mountpoint)
+		}
+	}
+	mounted := func(mountPoint string) bool {
+		if mountPoint == graphRoot || strings.HasPrefix(mountPoint, graphRoot+string(os.PathSeparator)) {
+			return index.Mounted(mountPoint)
+		}
+		isMounted, err := mount.Mounted(mountPoint)
+		return err == nil && isMounted
+	}
+	changed := false
+	namespace := currentMountNamespace()
+	for _, layer := range r.layers {
+		if layer.MountCount > 0 {
+			if recorded := r.mountNamespaces[layer.ID]; recorded != "" && recorded != namespace {
+				continue
+			}
+			if mounted(layer.MountPoint) || r.mountHeldByLiveProcess(layer.ID) {
+				continue
+			}
+			logrus.Debugf("Layer %v is no longer mounted at %q, resetting its mount count from %d", layer.ID, layer.MountPoint, layer.MountCount)
+			delete(r.bymount, layer.MountPoint)
+			layer.MountPoint = ""
+			layer.MountCount = 0
+			r.clearMountHolders(layer.ID)
+			changed = true
+			continue
+		}
+		if mountPoint := r.unrecordedMountPoint(layer.ID, candidates); mountPoint != "" {
+			logrus.Debugf("Layer %v is still mounted at %q, recording it as mounted", layer.ID, mountPoint)
+			layer.MountPoint = mountPoint
+			layer.MountCount = 1
+			r.bymount[mountPoint] = layer
+			if namespace != "" {
+				r.mountNamespaces[layer.ID] = namespace
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	defer r.mountsLockfile.Touch()
+	return r.saveMounts()
+}
+
+// currentMountNamespace returns an identifier for the mount namespace which
+// this process is in, or "" if it can't be determined.
+func currentMountNamespace() string {
+	namespace, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return ""
+	}
+	return namespace
+}
+
+// mountHeldByLiveProcess returns true if any process which holds a reference
+// to the layer's mount is still running.  The mounts lock should be held.
+func (r *layerStore) mountHeldByLiveProcess(id string) bool {
+	for pid, count := range r.mountHolders[id] {
+		if count > 0 && r.mountHolderAlive(id, pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeMountHolders describes which processes are using the layer's
+// mount, for use in error messages.  The mounts lock should be held.
+func (r *layerStore) describeMountHolders(id string) string {
+	var pids []int
+	for pid, count := range r.mountHolders[id] {
+		if count > 0 && r.mountHolderAlive(id, pid) {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return "it is mounted read-only"
+	}
+	sort.Ints(pids)
+	holders := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		holders = append(holders, strconv.Itoa(pid))
+	}
+	return fmt.Sprintf("it is mounted read-only by process(es) %s", strings.Join(holders, ", "))
+}
+
+// mountHolderAlive returns true if the process which holds references to the
+// layer's mount is still running.  If we recorded when it started, a process
+// which started at a different time has only reused its ID.
+func (r *layerStore) mountHolderAlive(id string, pid int) bool {
+	if !system.IsProcessAlive(pid) {
+		return false
+	}
+	recorded := r.mountHolderStarts[id][pid]
+	if recorded == 0 {
+		return true
+	}
+	start := system.ProcessStartTime(pid)
+	return start == 0 || start == recorded
+}
+
+// unrecordedMountPoint returns the location where the layer is mounted, if
+// it's one of the candidate mount points and it's where the graph driver
+// would have mounted it.
+func (r *layerStore) unrecordedMountPoint(id string, candidates []string) string {
+	component := string(os.PathSeparator) + id + string(os.PathSeparator)
+	possible := false
+	for _, candidate := range candidates {
+		if strings.Contains(candidate+string(os.PathSeparator), component) {
+			possible = true
+			break
+		}
+	}
+	if !possible {
+		return ""
+	}
+	metadata, err := r.driver.Metadata(id)
+	if err != nil || metadata["MergedDir"] == "" {
+		return ""
+	}
+	merged := filepath.Clean(metadata["MergedDir"])
+	for _, candidate := range candidates {
+		if candidate == merged {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// unrecordedMounts returns the locations of file systems which are mounted
+// under the graph driver's home directory, but which aren't recorded as being
+// where any layer is mounted, or under where one is mounted.  Such mounts are
+// usually left behind by processes which crashed while mounting or unmounting
+// a layer.
+func (r *layerStore) unrecordedMounts() ([]string, error) {
+	if r.mountsLockfile == nil {
+		return nil, nil
+	}
+	r.mountsLockfile.RLock()
+	defer r.mountsLockfile.Unlock()
+	if err := r.loadMounts(); err != nil {
+		return nil, err
+	}
+	home := filepath.Join(filepath.Dir(r.layerdir), r.driver.String())
+	infos, err := mount.GetMountsUnder(home)
+	if err != nil {
+		return nil, err
+	}
+	var leaked []string
+	for _, info := range infos {
+		if info.Mountpoint != home && !r.mountRecorded(info.Mountpoint) {
+			leaked = append(leaked, info.Mountpoint)
+		}
+	}
+	sort.Strings(leaked)
+	return leaked, nil
+}
+
+// mountRecorded returns true if mountPoint is where a layer is recorded as
+// being mounted, or is under such a location.  The mounts lock should be held.
+func (r *layerStore) mountRecorded(mountPoint string) bool {
+	for dir := mountPoint; ; dir = filepath.Dir(dir) {
+		if layer, ok := r.bymount[dir]; ok && layer.MountCount > 0 {
+			return true
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// unmountUnrecorded unmounts a file system which unrecordedMounts() reported,
+// after checking that no layer has been recorded as being mounted there in the
+// meantime.
+func (r *layerStore) unmountUnrecorded(mountPoint string) error {
+	r.mountsLockfile.Lock()
+	defer r.mountsLockfile.Unlock()
+	if err := r.loadMounts(); err != nil {
+		return err
+	}
+	if r.mountRecorded(mountPoint) {
+		return errors.Wrapf(ErrLayerMounted, "%q is now in use", mountPoint)
+	}
+	return mount.Unmount(mountPoint)
+}
+
 func (s *store) newLayerStore(rundir string, layerdir string, driver drivers.Driver) (LayerStore, error) {
 	if err := os.MkdirAll(rundir, 0700); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(layerdir, 0700); err != nil {
-		return nil, err
+	var lockfile Locker
+	var err error
+	if s.readOnly {
+		lockfile, err = getReadOnlyStoreLockfile(filepath.Join(layerdir, "layers.lock"), filepath.Join(rundir, "layers.lock"))
+	} else {
+		if err := os.MkdirAll(layerdir, 0700); err != nil {
+			return nil, err
+		}
+		lockfile, err = GetLockfile(filepath.Join(layerdir, "layers.lock"))
 	}
-	lockfile, err := GetLockfile(filepath.Join(layerdir, "layers.lock"))
 	if err != nil {
 		return nil, err
 	}
@@ -545,20 +1000,40 @@ func (s *store) newLayerStore(rundir string, layerdir string, driver drivers.Dri
 		return nil, err
 	}
 	rlstore := layerStore{
-		lockfile:       lockfile,
-		mountsLockfile: mountsLockfile,
-		driver:         driver,
-		rundir:         rundir,
-		layerdir:       layerdir,
-		byid:           make(map[string]*Layer),
-		bymount:        make(map[string]*Layer),
-		byname:         make(map[string]*Layer),
-		uidMap:         copyIDMap(s.uidMap),
-		gidMap:         copyIDMap(s.gidMap),
+		lockfile:        lockfile,
+		mountsLockfile:  mountsLockfile,
+		driver:          driver,
+		rundir:          rundir,
+		layerdir:        layerdir,
+		byid:            make(map[string]*Layer),
+		bymount:         make(map[string]*Layer),
+		mountHolders:    make(map[string]map[int]int),
+		mountReadOnly:   make(map[string]bool),
+		mountLowers:     make(map[string][]string),
+		mountNamespaces: make(map[string]string),
+		byname:          make(map[string]*Layer),
+		uidMap:          copyIDMap(s.uidMap),
+		gidMap:          copyIDMap(s.gidMap),
+		hardlinkDedup:   s.hardlinkDedup,
+		trackChanges:    s.trackLayerChanges,
+		idGenerator:     s.idGenerator,
+		reservedSpace:   s.reservedSpace,
+		digestAlgorithm: s.digestAlgorithm,
+		keyProvider:     s.encryptionKeyProvider,
+		encryptionKeyID: s.encryptionKeyID,
+		loadedKeys:      make(map[string]bool),
+		records:         recordsFile{options: s.writerOptions},
+		trash:           s.backgroundTrash(),
+	}
+	if rlstore.digestAlgorithm == "" {
+		rlstore.digestAlgorithm = digest.Canonical
 	}
 	if err := rlstore.Load(); err != nil {
 		return nil, err
 	}
+	if err := rlstore.reconcileMounts(); err != nil {
+		logrus.Debugf("Unable to check which layers in %q are still mounted: %v", layerdir, err)
+	}
 	return &rlstore, nil
 }
 
@@ -568,14 +1043,18 @@ func newROLayerStore(rundir string, layerdir string, driver drivers.Driver) (ROL
 		return nil, err
 	}
 	rlstore := layerStore{
-		lockfile:       lockfile,
-		mountsLockfile: nil,
-		driver:         driver,
-		rundir:         rundir,
-		layerdir:       layerdir,
-		byid:           make(map[string]*Layer),
-		bymount:        make(map[string]*Layer),
-		byname:         make(map[string]*Layer),
+		lockfile:        lockfile,
+		mountsLockfile:  nil,
+		driver:          driver,
+		rundir:          rundir,
+		layerdir:        layerdir,
+		byid:            make(map[string]*Layer),
+		bymount:         make(map[string]*Layer),
+		mountHolders:    make(map[string]map[int]int),
+		mountReadOnly:   make(map[string]bool),
+		mountLowers:     make(map[string][]string),
+		mountNamespaces: make(map[string]string),
+		byname:          make(map[string]*Layer),
 	}
 	if err := rlstore.Load(); err != nil {
 		return nil, err
@@ -679,12 +1158,7 @@ func (r *layerStore) PutAdditionalLayer(id string, parentLayer *Layer, names []s
 	for _, name := range names { // names got from the additional layer store won't be used
 		r.byname[name] = layer
 	}
-	if layer.CompressedDigest != "" {
-		r.bycompressedsum[layer.CompressedDigest] = append(r.bycompressedsum[layer.CompressedDigest], layer.ID)
-	}
-	if layer.UncompressedDigest != "" {
-		r.byuncompressedsum[layer.CompressedDigest] = append(r.byuncompressedsum[layer.CompressedDigest], layer.ID)
-	}
+	r.indexDigests(layer)
 	if err := r.Save(); err != nil {
 		r.driver.Remove(id)
 		return nil, err
@@ -704,12 +1178,9 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 		return nil, -1, err
 	}
 	if id == "" {
-		id = stringid.GenerateRandomID()
-		_, idInUse := r.byid[id]
-		for idInUse {
-			id = stringid.GenerateRandomID()
-			_, idInUse = r.byid[id]
-		}
+		id = generateID(r.idGenerator, r.Exists)
+	} else if err := validateID(id); err != nil {
+		return nil, -1, err
 	}
 	if duplicateLayer, idInUse := r.byid[id]; idInUse {
 		return duplicateLayer, -1, ErrDuplicateID
@@ -739,6 +1210,17 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 	} else {
 		parentMappings = &idtools.IDMappings{}
 	}
+	if moreOptions.ImageStore != "" {
+		if err := r.checkImageStore(moreOptions.ImageStore); err != nil {
+			return nil, -1, err
+		}
+		if writeable {
+			return nil, -1, errors.Errorf("only read-only layers can be placed in image store %q", moreOptions.ImageStore)
+		}
+	}
+	if err := r.checkFreeSpace(r.spacePath("")); err != nil {
+		return nil, -1, err
+	}
 	if mountLabel != "" {
 		label.ReserveLabel(mountLabel)
 	}
@@ -747,20 +1229,30 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 		MountLabel: mountLabel,
 		StorageOpt: options,
 		IDMappings: idMappings,
+		Progress:   moreOptions.Progress,
+		ImageStore: moreOptions.ImageStore,
+
+		ParentMounted: parentLayer != nil && parentLayer.MountCount > 0,
+	}
+	keyID := r.newLayerKeyID(parentLayer, moreOptions)
+	if keyID != "" {
+		if opts.EncryptionKey, err = r.encryptionKey(keyID); err != nil {
+			return nil, -1, err
+		}
 	}
 	if moreOptions.TemplateLayer != "" {
 		if err = r.driver.CreateFromTemplate(id, moreOptions.TemplateLayer, templateIDMappings, parent, parentMappings, &opts, writeable); err != nil {
-			return nil, -1, errors.Wrapf(err, "error creating copy of template layer %q with ID %q", moreOptions.TemplateLayer, id)
+			return nil, -1, errors.Wrapf(wrapDriverError(err), "error creating copy of template layer %q with ID %q", moreOptions.TemplateLayer, id)
 		}
 		oldMappings = templateIDMappings
 	} else {
 		if writeable {
 			if err = r.driver.CreateReadWrite(id, parent, &opts); err != nil {
-				return nil, -1, errors.Wrapf(err, "error creating read-write layer with ID %q", id)
+				return nil, -1, errors.Wrapf(wrapDriverError(err), "error creating read-write layer with ID %q", id)
 			}
 		} else {
 			if err = r.driver.Create(id, parent, &opts); err != nil {
-				return nil, -1, errors.Wrapf(err, "error creating layer with ID %q", id)
+				return nil, -1, errors.Wrapf(wrapDriverError(err), "error creating layer with ID %q", id)
 			}
 		}
 		oldMappings = parentMappings
@@ -785,7 +1277,18 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 			Flags:        make(map[string]interface{}),
 			UIDMap:       copyIDMap(moreOptions.UIDMap),
 			GIDMap:       copyIDMap(moreOptions.GIDMap),
+			ImageStore:   moreOptions.ImageStore,
 			BigDataNames: []string{},
+			Provenance:   copyLayerProvenance(moreOptions.Provenance),
+
+			EncryptionKeyID: keyID,
+			CopyStats:       r.takeCopyStats(id),
+		}
+		if keyID != "" {
+			r.loadedKeys[loadedKeyName(layer)] = true
+		}
+		if layer.Provenance != nil && layer.Provenance.Created.IsZero() {
+			layer.Provenance.Created = layer.Created
 		}
 		r.layers = append(r.layers, layer)
 		r.idindex.Add(id)
@@ -799,6 +1302,7 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 		savedIncompleteLayer := false
 		if diff != nil {
 			layer.Flags[incompleteFlag] = true
+			layer.Flags[applyingPIDFlag] = os.Getpid()
 			err = r.Save()
 			if err != nil {
 				// We don't have a record of this layer, but at least
@@ -809,17 +1313,24 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 				return nil, -1, err
 			}
 			savedIncompleteLayer = true
-			size, err = r.applyDiffWithOptions(layer.ID, moreOptions, diff)
+			size, err = r.applyDiffUnlocked(id, moreOptions, diff, r.hardlinkDedup && !writeable)
+			if errors.Is(err, errLayerReplaced) {
+				return nil, -1, err
+			}
 			if err != nil {
-				if err2 := r.Delete(layer.ID); err2 != nil {
+				if err2 := r.Delete(id); err2 != nil {
 					// Either a driver error or an error saving.
 					// We now have a layer that's been marked for
 					// deletion but which we failed to remove.
-					logrus.Errorf("While recovering from a failure applying layer diff, error deleting layer %#v: %v", layer.ID, err2)
+					logrus.Errorf("While recovering from a failure applying layer diff, error deleting layer %#v: %v", id, err2)
 				}
 				return nil, -1, err
 			}
+			// The store may have been reloaded while we weren't holding
+			// the lock, so find our (possibly new) record of the layer.
+			layer, _ = r.lookup(id)
 			delete(layer.Flags, incompleteFlag)
+			delete(layer.Flags, applyingPIDFlag)
 		}
 		err = r.Save()
 		if err != nil {
@@ -839,11 +1350,233 @@ func (r *layerStore) Put(id string, parentLayer *Layer, names []string, mountLab
 			}
 			return nil, -1, err
 		}
+		if writeable && diff == nil && moreOptions.TemplateLayer == "" {
+			r.startChangeJournal(id)
+		}
 		layer = copyLayer(layer)
 	}
 	return layer, size, err
 }
 
+func (r *layerStore) Snapshot(id string, names []string) (*Layer, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new layers at %q", r.layerspath())
+	}
+	driver, ok := r.driver.(drivers.LayerSnapshotterDriver)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "the %q driver can't snapshot layers", r.driver.String())
+	}
+	child, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if child.MountCount > 0 {
+		return nil, errors.Wrapf(ErrLayerMounted, "layer %v", child.ID)
+	}
+	names = dedupeNames(names)
+	for _, name := range names {
+		if _, nameInUse := r.byname[name]; nameInUse {
+			return nil, ErrDuplicateName
+		}
+	}
+	snapshotID := generateID(r.idGenerator, r.Exists)
+	if err := driver.SnapshotLayer(child.ID, child.Parent, snapshotID); err != nil {
+		return nil, errors.Wrapf(err, "error snapshotting layer %q", child.ID)
+	}
+	layer := &Layer{
+		ID:                 snapshotID,
+		Parent:             child.Parent,
+		Names:              names,
+		MountLabel:         child.MountLabel,
+		Created:            time.Now().UTC(),
+		CompressedDigest:   child.CompressedDigest,
+		CompressedSize:     child.CompressedSize,
+		UncompressedDigest: child.UncompressedDigest,
+		UncompressedSize:   child.UncompressedSize,
+		CompressionType:    child.CompressionType,
+		ComposefsDigest:    child.ComposefsDigest,
+		EncryptionKeyID:    child.EncryptionKeyID,
+		UIDs:               child.UIDs,
+		GIDs:               child.GIDs,
+		Flags:              make(map[string]interface{}),
+		UIDMap:             copyIDMap(child.UIDMap),
+		GIDMap:             copyIDMap(child.GIDMap),
+		BigDataNames:       []string{},
+
+		AdditionalUncompressedDigests: copyDigestSlice(child.AdditionalUncompressedDigests),
+	}
+	if err := os.Rename(r.tspath(child.ID), r.tspath(snapshotID)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The snapshot holds everything that was changed in the child, so
+	// if we were keeping track of those changes, we can start over.
+	journal, err := r.readChangeJournal(child.ID)
+	r.discardChangeJournal(child.ID)
+	if journal != nil && err == nil && !journal.Tracking {
+		r.startChangeJournal(child.ID)
+	}
+	r.recordDiffResult(child, &layerDiffResult{})
+	child.Parent = snapshotID
+	r.layers = append(r.layers, layer)
+	r.idindex.Add(snapshotID)
+	r.byid[snapshotID] = layer
+	for _, name := range names {
+		r.byname[name] = layer
+	}
+	r.indexDigests(layer)
+	if err := r.Save(); err != nil {
+		return nil, err
+	}
+	return copyLayer(layer), nil
+}
+
+func (r *layerStore) Reset(id, parent string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layers at %q", r.layerspath())
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if layer.MountCount > 0 {
+		return errors.Wrapf(ErrLayerMounted, "layer %v", layer.ID)
+	}
+	parentMappings := &idtools.IDMappings{}
+	if parent != "" {
+		parentLayer, ok := r.lookup(parent)
+		if !ok {
+			return errors.Wrapf(ErrLayerUnknown, "layer %q", parent)
+		}
+		parent = parentLayer.ID
+		parentMappings = idtools.NewIDMappingsFromMaps(parentLayer.UIDMap, parentLayer.GIDMap)
+	}
+	ancestor := layer.Parent
+	for ancestor != parent {
+		ancestorLayer, ok := r.lookup(ancestor)
+		if !ok {
+			return errors.Errorf("layer %q is not an ancestor of layer %q", parent, layer.ID)
+		}
+		ancestor = ancestorLayer.Parent
+	}
+	if driver, ok := r.driver.(drivers.LayerResetterDriver); ok {
+		if err := driver.ResetLayer(layer.ID, parent); err != nil {
+			return errors.Wrapf(err, "error resetting layer %q", layer.ID)
+		}
+	} else {
+		idMappings := idtools.NewIDMappingsFromMaps(layer.UIDMap, layer.GIDMap)
+		opts := drivers.CreateOpts{
+			MountLabel: layer.MountLabel,
+			IDMappings: idMappings,
+		}
+		if layer.EncryptionKeyID != "" {
+			key, err := r.encryptionKey(layer.EncryptionKeyID)
+			if err != nil {
+				return err
+			}
+			opts.EncryptionKey = key
+		}
+		if err := r.recreateLayer(layer, parent, parentMappings, &opts); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(r.tspath(layer.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.discardChangeJournal(layer.ID)
+	r.recordDiffResult(layer, &layerDiffResult{})
+	layer.Parent = parent
+	return r.Save()
+}
+
+// recreateLayer replaces the contents of a layer with those of parent, for
+// drivers which can't reset layers.  The new contents are created under a
+// temporary ID first.  If the driver can rename layers, they're then swapped
+// in, so that the layer's contents aren't lost if we fail.  Otherwise, the
+// layer is removed and created again, which at least we now know should work.
+func (r *layerStore) recreateLayer(layer *Layer, parent string, parentMappings *idtools.IDMappings, opts *drivers.CreateOpts) error {
+	create := func(id string) error {
+		if err := r.driver.CreateReadWrite(id, parent, opts); err != nil {
+			return errors.Wrapf(wrapDriverError(err), "error recreating read-write layer with ID %q", layer.ID)
+		}
+		if !reflect.DeepEqual(parentMappings.UIDs(), opts.IDMappings.UIDs()) || !reflect.DeepEqual(parentMappings.GIDs(), opts.IDMappings.GIDs()) {
+			if err := r.driver.UpdateLayerIDMap(id, parentMappings, opts.IDMappings, layer.MountLabel); err != nil {
+				if err2 := r.driver.Remove(id); err2 != nil {
+					logrus.Errorf("While recovering from a failure recreating layer %q, error deleting %q: %v", layer.ID, id, err2)
+				}
+				return err
+			}
+		}
+		return nil
+	}
+	tmpID := stringid.GenerateRandomID()
+	if err := create(tmpID); err != nil {
+		return err
+	}
+	renamer, ok := r.driver.(drivers.LayerRenamerDriver)
+	if !ok {
+		if err := r.driver.Remove(tmpID); err != nil {
+			return wrapDriverError(err)
+		}
+		if err := r.driver.Remove(layer.ID); err != nil {
+			return errors.Wrapf(wrapDriverError(err), "error removing contents of layer %q", layer.ID)
+		}
+		return create(layer.ID)
+	}
+	oldID := stringid.GenerateRandomID()
+	err := renamer.RenameLayer(layer.ID, oldID)
+	if err == nil {
+		if err = renamer.RenameLayer(tmpID, layer.ID); err != nil {
+			if err2 := renamer.RenameLayer(oldID, layer.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure recreating layer %q, error restoring its contents from %q: %v", layer.ID, oldID, err2)
+			}
+		}
+	}
+	if err != nil {
+		if err2 := r.driver.Remove(tmpID); err2 != nil {
+			logrus.Errorf("While recovering from a failure recreating layer %q, error deleting %q: %v", layer.ID, tmpID, err2)
+		}
+		return errors.Wrapf(wrapDriverError(err), "error replacing contents of layer %q", layer.ID)
+	}
+	if err := r.removeDriverLayer(oldID); err != nil {
+		logrus.Warnf("Error removing old contents of layer %q: %v", layer.ID, err)
+	}
+	return nil
+}
+
+// checkImageStore returns an error if location isn't one of the driver's
+// writable image stores.
+func (r *layerStore) checkImageStore(location string) error {
+	driver, ok := r.driver.(drivers.ImageStoreDriver)
+	if !ok {
+		return errors.Wrapf(ErrNotSupported, "the %q driver can't place layers in image stores", r.driver.String())
+	}
+	for _, store := range driver.WritableImageStores() {
+		if filepath.Clean(location) == store {
+			return nil
+		}
+	}
+	return errors.Errorf("%q is not a writable image store for the %q driver", location, r.driver.String())
+}
+
+// checkLayerImageStores returns an error if the layer, or any of the layers
+// which it's based on, is in a writable image store which the driver is no
+// longer configured to use, since the driver wouldn't be able to find it.
+func (r *layerStore) checkLayerImageStores(layer *Layer) error {
+	for layer != nil {
+		if layer.ImageStore != "" {
+			if err := r.checkImageStore(layer.ImageStore); err != nil {
+				return errors.Wrapf(err, "layer %q is in image store %q", layer.ID, layer.ImageStore)
+			}
+		}
+		parent, ok := r.lookup(layer.Parent)
+		if !ok {
+			break
+		}
+		layer = parent
+	}
+	return nil
+}
+
 func (r *layerStore) CreateWithFlags(id string, parent *Layer, names []string, mountLabel string, options map[string]string, moreOptions *LayerOptions, writeable bool, flags map[string]interface{}) (layer *Layer, err error) {
 	layer, _, err = r.Put(id, parent, names, mountLabel, options, moreOptions, writeable, flags, nil)
 	return layer, err
@@ -854,7 +1587,7 @@ func (r *layerStore) Create(id string, parent *Layer, names []string, mountLabel
 }
 
 func (r *layerStore) Mounted(id string) (int, error) {
-	if !r.IsReadWrite() {
+	if r.mountsLockfile == nil {
 		return 0, errors.Wrapf(ErrStoreIsReadOnly, "no mount information for layers at %q", r.mountspath())
 	}
 	r.mountsLockfile.RLock()
@@ -885,7 +1618,7 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 
 	// You are not allowed to mount layers from readonly stores if they
 	// are not mounted read/only.
-	if !r.IsReadWrite() && !hasReadOnlyOpt(options.Options) {
+	if (!r.IsReadWrite() && !hasReadOnlyOpt(options.Options)) || r.mountsLockfile == nil {
 		return "", errors.Wrapf(ErrStoreIsReadOnly, "not allowed to update mount locations for layers at %q", r.mountspath())
 	}
 	r.mountsLockfile.Lock()
@@ -900,6 +1633,9 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 	if !ok {
 		return "", ErrLayerUnknown
 	}
+	if err := r.checkLayerImageStores(layer); err != nil {
+		return "", err
+	}
 	if layer.MountCount > 0 {
 		mounted, err := mount.Mounted(layer.MountPoint)
 		if err != nil {
@@ -909,20 +1645,54 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 		// where the kernel umounted the mount point. This means
 		// that the mount count never got decremented.
 		if mounted {
+			// A read-only mount can be shared with anyone
+			// else who only wants to read it.
+			if r.mountReadOnly[layer.ID] && !hasReadOnlyOpt(options.Options) {
+				return "", errors.Wrapf(ErrLayerMountedReadOnly, "can't mount layer %v for writing while %s; mount it read-only with the \"ro\" option, or wait until it has been unmounted", layer.ID, r.describeMountHolders(layer.ID))
+			}
+			// Nor can one with additional lower directories be
+			// shared with anyone who doesn't want the same ones.
+			if lowers := r.mountLowers[layer.ID]; (len(lowers) > 0 || len(options.AdditionalLowers) > 0) && !reflect.DeepEqual(lowers, options.AdditionalLowers) {
+				return "", errors.Wrapf(ErrLayerMountMismatch, "layer %v", layer.ID)
+			}
 			layer.MountCount++
+			r.addMountHolder(layer.ID)
 			return layer.MountPoint, r.saveMounts()
 		}
+		r.clearMountHolders(layer.ID)
 	}
 	if options.MountLabel == "" {
 		options.MountLabel = layer.MountLabel
 	}
 
+	relabelShared := options.Relabel == drivers.MountRelabelShared
+	switch options.Relabel {
+	case "":
+	case drivers.MountRelabelPrivate, drivers.MountRelabelShared:
+		if !r.IsReadWrite() {
+			return "", errors.Wrapf(ErrStoreIsReadOnly, "not allowed to relabel layers at %q", r.layerspath())
+		}
+		if options.MountLabel == "" || !selinux.GetEnabled() ||
+			(layer.RelabeledMountLabel == options.MountLabel && layer.RelabeledShared == relabelShared) {
+			options.Relabel = ""
+		}
+	default:
+		return "", errors.Errorf("relabeling policy must be %q or %q, not %q", drivers.MountRelabelPrivate, drivers.MountRelabelShared, options.Relabel)
+	}
+
+	if len(options.AdditionalLowers) > 0 {
+		if driver, ok := r.driver.(drivers.AdditionalLowersDriver); !ok || !driver.SupportsAdditionalLowers() {
+			return "", errors.Wrapf(ErrNotSupported, "mounting layer %v with additional lower directories using driver %q", layer.ID, r.driver.String())
+		}
+	}
+
 	if (options.UidMaps != nil || options.GidMaps != nil) && !r.driver.SupportsShifting() {
 		if !reflect.DeepEqual(options.UidMaps, layer.UIDMap) || !reflect.DeepEqual(options.GidMaps, layer.GIDMap) {
 			return "", fmt.Errorf("cannot mount layer %v: shifting not enabled", layer.ID)
 		}
 	}
 	mountpoint, err := r.driver.Get(id, options)
+	err = wrapDriverError(err)
 	if mountpoint != "" && err == nil {
 		if layer.MountPoint != "" {
 			delete(r.bymount, layer.MountPoint)
@@ -930,13 +1700,37 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 		layer.MountPoint = filepath.Clean(mountpoint)
 		layer.MountCount++
 		r.bymount[layer.MountPoint] = layer
+		r.addMountHolder(layer.ID)
+		if hasReadOnlyOpt(options.Options) {
+			r.mountReadOnly[layer.ID] = true
+		} else {
+			delete(r.mountReadOnly, layer.ID)
+		}
+		if len(options.AdditionalLowers) > 0 {
+			r.mountLowers[layer.ID] = append([]string{}, options.AdditionalLowers...)
+		} else {
+			delete(r.mountLowers, layer.ID)
+		}
+		if namespace := currentMountNamespace(); namespace != "" {
+			r.mountNamespaces[layer.ID] = namespace
+		} else {
+			delete(r.mountNamespaces, layer.ID)
+		}
+		if !hasReadOnlyOpt(options.Options) {
+			r.startTrackingChanges(layer)
+		}
 		err = r.saveMounts()
+		if err == nil && options.Relabel != "" {
+			layer.RelabeledMountLabel = options.MountLabel
+			layer.RelabeledShared = relabelShared
+			err = r.saveLayers()
+		}
 	}
 	return mountpoint, err
 }
 
 func (r *layerStore) Unmount(id string, force bool) (bool, error) {
-	if !r.IsReadWrite() {
+	if r.mountsLockfile == nil {
 		return false, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to update mount locations for layers at %q", r.mountspath())
 	}
 	r.mountsLockfile.Lock()
@@ -957,25 +1751,113 @@ func (r *layerStore) Unmount(id string, force bool) (bool, error) {
 	}
 	if force {
 		layer.MountCount = 1
+		r.clearMountHolders(layer.ID)
+	} else if err := r.removeMountHolder(layer); err != nil {
+		return true, err
 	}
 	if layer.MountCount > 1 {
 		layer.MountCount--
 		return true, r.saveMounts()
 	}
+	recordChanges := r.stopTrackingChanges(layer.ID)
 	err := r.driver.Put(id)
+	recordChanges(err == nil || os.IsNotExist(err))
 	if err == nil || os.IsNotExist(err) {
 		if layer.MountPoint != "" {
 			delete(r.bymount, layer.MountPoint)
 		}
 		layer.MountCount--
 		layer.MountPoint = ""
+		r.clearMountHolders(layer.ID)
 		return false, r.saveMounts()
 	}
 	return true, err
 }
 
+// addMountHolder records that this process holds another reference to the
+// layer's mount.  The mounts lock should be held for writing.
+func (r *layerStore) addMountHolder(id string) {
+	holders := r.mountHolders[id]
+	if holders == nil {
+		holders = make(map[int]int)
+		r.mountHolders[id] = holders
+	}
+	pid := os.Getpid()
+	start := system.ProcessStartTime(pid)
+	if start != 0 && !r.mountHolderAlive(id, pid) {
+		// The references were held by an earlier process which had
+		// the same ID, and which has exited without releasing them.
+		delete(holders, pid)
+	}
+	holders[pid]++
+	if start != 0 {
+		if r.mountHolderStarts == nil {
+			r.mountHolderStarts = make(map[string]map[int]uint64)
+		}
+		starts := r.mountHolderStarts[id]
+		if starts == nil {
+			starts = make(map[int]uint64)
+			r.mountHolderStarts[id] = starts
+		}
+		starts[pid] = start
+	}
+}
+
+// clearMountHolders forgets about every reference to the layer's mount.  The
+// mounts lock should be held for writing.
+func (r *layerStore) clearMountHolders(id string) {
+	delete(r.mountHolders, id)
+	delete(r.mountHolderStarts, id)
+	delete(r.mountReadOnly, id)
+	delete(r.mountLowers, id)
+	delete(r.mountNamespaces, id)
+}
+
+// removeMountHolder drops one of the references to the layer's mount which
+// are about to be released, preferring one held by this process, then one held
+// by a process which has exited without releasing it, and then one which
+// isn't attributed to any process.  Other live processes' references to a
+// read-only mount are never dropped, so that one process can't unmount a
+// layer which another process is still reading.  The mounts lock should be
+// held for writing.
+func (r *layerStore) removeMountHolder(layer *Layer) error {
+	holders := r.mountHolders[layer.ID]
+	release := func(pid int) {
+		holders[pid]--
+		if holders[pid] <= 0 {
+			delete(holders, pid)
+			delete(r.mountHolderStarts[layer.ID], pid)
+		}
+	}
+	if holders[os.Getpid()] > 0 {
+		release(os.Getpid())
+		return nil
+	}
+	held := 0
+	for pid, count := range holders {
+		if !r.mountHolderAlive(layer.ID, pid) {
+			release(pid)
+			return nil
+		}
+		held += count
+	}
+	if held < layer.MountCount {
+		return nil
+	}
+	if r.mountReadOnly[layer.ID] {
+		return errors.Wrapf(ErrLayerMountedByOthers, "layer %v", layer.ID)
+	}
+	// Preserve the historical behavior of letting any process unmount a
+	// layer which is mounted for writing.
+	for pid := range holders {
+		release(pid)
+		break
+	}
+	return nil
+}
+
 func (r *layerStore) ParentOwners(id string) (uids, gids []int, err error) {
-	if !r.IsReadWrite() {
+	if r.mountsLockfile == nil {
 		return nil, nil, errors.Wrapf(ErrStoreIsReadOnly, "no mount information for layers at %q", r.mountspath())
 	}
 	r.mountsLockfile.RLock()
@@ -1126,7 +2008,7 @@ func (r *layerStore) SetBigData(id, key string, data io.Reader) error {
 	// NewAtomicFileWriter doesn't overwrite/truncate the existing inode.
 	// BigData() relies on this behaviour when opening the file for read
 	// so that it is either accessing the old data or the new one.
-	writer, err := ioutils.NewAtomicFileWriter(r.datapath(layer.ID, key), 0600)
+	writer, err := ioutils.NewAtomicFileWriterWithOpts(r.datapath(layer.ID, key), 0600, r.records.bigDataWriterOptions())
 	if err != nil {
 		return errors.Wrapf(err, "error opening bigdata file")
 	}
@@ -1180,10 +2062,168 @@ func (r *layerStore) SetMetadata(id, metadata string) error {
 	return ErrLayerUnknown
 }
 
+func (r *layerStore) SetComposefsDigest(id string, d digest.Digest) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer metadata at %q", r.layerspath())
+	}
+	if d != "" {
+		if err := d.Validate(); err != nil {
+			return errors.Wrapf(err, "recording composefs digest %q", d)
+		}
+	}
+	if layer, ok := r.lookup(id); ok {
+		layer.ComposefsDigest = d
+		return r.Save()
+	}
+	return ErrLayerUnknown
+}
+
+func (r *layerStore) UpdateAnnotations(id string, set map[string]string, remove []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer annotations at %q", r.layerspath())
+	}
+	if layer, ok := r.lookup(id); ok {
+		if updateAnnotations(&layer.Annotations, set, remove) {
+			return r.Save()
+		}
+		return nil
+	}
+	return ErrLayerUnknown
+}
+
 func (r *layerStore) tspath(id string) string {
 	return filepath.Join(r.layerdir, id+tarSplitSuffix)
 }
 
+// walkTarSplit decodes the layer's tar-split data, if it has any, and calls
+// fn for each entry in it.  It returns false if the layer has no tar-split
+// data.
+func (r *layerStore) walkTarSplit(id string, fn func(*storage.Entry)) (bool, error) {
+	f, err := os.Open(r.tspath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	decompressor, err := pgzip.NewReader(f)
+	if err != nil {
+		return true, err
+	}
+	defer decompressor.Close()
+	unpacker := storage.NewJSONUnpacker(decompressor)
+	for {
+		entry, err := unpacker.Next()
+		if err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			return true, err
+		}
+		fn(entry)
+	}
+}
+
+// prepareTarSplit reads tar-split data which was supplied by a caller, which
+// may or may not be gzip-compressed, and returns it in the compressed form in
+// which we store it, along with the length of the tarstream which it describes.
+func prepareTarSplit(data []byte) ([]byte, int64, error) {
+	reader := io.Reader(bytes.NewReader(data))
+	compressed := archive.DetectCompression(data) == archive.Gzip
+	if compressed {
+		decompressor, err := pgzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, -1, err
+		}
+		defer decompressor.Close()
+		reader = decompressor
+	}
+	size := int64(0)
+	unpacker := storage.NewJSONUnpacker(reader)
+	for {
+		entry, err := unpacker.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, -1, err
+		}
+		switch entry.Type {
+		case storage.SegmentType:
+			size += int64(len(entry.Payload))
+		case storage.FileType:
+			size += entry.Size
+		}
+	}
+	if compressed {
+		return data, size, nil
+	}
+	var tsdata bytes.Buffer
+	compressor := pgzip.NewWriter(&tsdata)
+	if _, err := compressor.Write(data); err != nil {
+		return nil, -1, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, -1, err
+	}
+	return tsdata.Bytes(), size, nil
+}
+
+// driverGetCloser reads files from a layer which it mounted using the driver,
+// without going through the layer store, so that it can be used while the
+// layer store's lock isn't held.
+type driverGetCloser struct {
+	driver drivers.Driver
+	path   string
+	id     string
+}
+
+func (d *driverGetCloser) Get(path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.path, path))
+}
+
+func (d *driverGetCloser) Close() error {
+	return d.driver.Put(d.id)
+}
+
+// verifyTarSplit reassembles the diff of a layer whose contents were just
+// extracted, using its compressed tar-split data and the extracted files, and
+// checks that the result has the expected digest, so that tar-split data which
+// was supplied by a caller can't be used to reproduce a diff other than the
+// one which was extracted.
+func (r *layerStore) verifyTarSplit(layer *Layer, tsbytes []byte, expected digest.Digest) error {
+	var fgetter drivers.FileGetCloser
+	if getter, ok := r.driver.(drivers.DiffGetterDriver); ok {
+		var err error
+		if fgetter, err = getter.DiffGetter(layer.ID); err != nil {
+			return errors.Wrapf(err, "creating file-getter")
+		}
+	} else {
+		path, err := r.driver.Get(layer.ID, drivers.MountOpts{MountLabel: layer.MountLabel})
+		if err != nil {
+			return wrapDriverError(err)
+		}
+		fgetter = &driverGetCloser{driver: r.driver, path: path, id: layer.ID}
+	}
+	defer fgetter.Close()
+	decompressor, err := pgzip.NewReader(bytes.NewReader(tsbytes))
+	if err != nil {
+		return errors.Wrapf(err, "reading supplied tar-split data")
+	}
+	defer decompressor.Close()
+	tarstream := asm.NewOutputTarStream(fgetter, storage.NewJSONUnpacker(decompressor))
+	defer tarstream.Close()
+	digester := expected.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), tarstream); err != nil {
+		return errors.Wrapf(err, "reassembling the diff using supplied tar-split data")
+	}
+	if actual := digester.Digest(); actual != expected {
+		return errors.Wrapf(ErrDigestMismatch, "supplied tar-split data reproduces a diff with digest %s instead of %s", actual, expected)
+	}
+	return nil
+}
+
 // layerHasIncompleteFlag returns true if layer.Flags contains an incompleteFlag set to true
 func layerHasIncompleteFlag(layer *Layer) bool {
 	// layer.Flags[…] is defined to succeed and return ok == false if Flags == nil
@@ -1195,6 +2235,40 @@ func layerHasIncompleteFlag(layer *Layer) bool {
 	return false
 }
 
+// layerIsBeingApplied returns true if layer.Flags records that a process which
+// is still running is in the middle of extracting the layer's contents.
+func layerIsBeingApplied(layer *Layer) bool {
+	pid := layerApplyingPID(layer)
+	return pid > 0 && system.IsProcessAlive(pid)
+}
+
+// layerApplyingPID returns the ID of the process which layer.Flags records is
+// extracting the layer's contents, or 0.
+func layerApplyingPID(layer *Layer) int {
+	switch value := layer.Flags[applyingPIDFlag].(type) {
+	case int:
+		return value
+	case float64: // what encoding/json gives us when we load the flag back
+		return int(value)
+	}
+	return 0
+}
+
+// removeDriverLayer has the driver remove the layer with the specified ID.  If
+// we can, its contents are moved out of the way, and removing them, which can
+// take a while, is left for later.
+func (r *layerStore) removeDriverLayer(id string) error {
+	if deferred, ok := r.driver.(drivers.DeferredRemoveDriver); ok && r.trash != nil {
+		if err := r.trash.queue(fmt.Sprintf("contents of layer %q", id), func() (string, error) {
+			return deferred.DeferredRemove(id)
+		}); err != nil {
+			return wrapDriverError(err)
+		}
+		return nil
+	}
+	return wrapDriverError(r.driver.Remove(id))
+}
+
 func (r *layerStore) deleteInternal(id string) error {
 	if !r.IsReadWrite() {
 		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete layers at %q", r.layerspath())
@@ -1216,13 +2290,16 @@ func (r *layerStore) deleteInternal(id string) error {
 	// We never unset incompleteFlag; below, we remove the entire object from r.layers.
 
 	id = layer.ID
-	err := r.driver.Remove(id)
-	if err != nil {
+	if err := r.removeDriverLayer(id); err != nil {
 		return err
 	}
 
 	os.Remove(r.tspath(id))
-	os.RemoveAll(r.datadir(id))
+	r.discardChangeJournal(id)
+	if err := r.trash.removeAll(fmt.Sprintf("data for layer %q", id), r.datadir(id)); err != nil {
+		logrus.Debugf("Error removing data for layer %q: %v", id, err)
+	}
+	r.forgetDedupLayer(id)
 	delete(r.byid, id)
 	for _, name := range layer.Names {
 		delete(r.byname, name)
@@ -1232,7 +2309,7 @@ func (r *layerStore) deleteInternal(id string) error {
 	if layer.MountPoint != "" {
 		delete(r.bymount, layer.MountPoint)
 	}
-	r.deleteInDigestMap(id)
+	r.unindexDigests(layer)
 	toDeleteIndex := -1
 	for i, candidate := range r.layers {
 		if candidate.ID == id {
@@ -1264,27 +2341,6 @@ func (r *layerStore) deleteInternal(id string) error {
 	return nil
 }
 
-func (r *layerStore) deleteInDigestMap(id string) {
-	for digest, layers := range r.bycompressedsum {
-		for i, layerID := range layers {
-			if layerID == id {
-				layers = append(layers[:i], layers[i+1:]...)
-				r.bycompressedsum[digest] = layers
-				break
-			}
-		}
-	}
-	for digest, layers := range r.byuncompressedsum {
-		for i, layerID := range layers {
-			if layerID == id {
-				layers = append(layers[:i], layers[i+1:]...)
-				r.byuncompressedsum[digest] = layers
-				break
-			}
-		}
-	}
-}
-
 func (r *layerStore) Delete(id string) error {
 	layer, ok := r.lookup(id)
 	if !ok {
@@ -1358,6 +2414,9 @@ func (r *layerStore) findParentAndLayer(from, to string) (fromID string, toID st
 	if from == "" {
 		from = toLayer.Parent
 	}
+	// A reference layer doesn't have to be related to the layer, but if
+	// we don't know about it, fall back to the layer's parent, which
+	// might itself be in a different store.
 	if from != "" {
 		fromLayer, ok = r.lookup(from)
 		if ok {
@@ -1384,7 +2443,14 @@ func (r *layerStore) Changes(from, to string) ([]archive.Change, error) {
 	if err != nil {
 		return nil, ErrLayerUnknown
 	}
-	return r.driver.Changes(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	if from == toLayer.Parent {
+		if changes, _, unmount, ok := r.journaledChanges(toLayer, fromLayer); ok {
+			unmount()
+			return changes, nil
+		}
+	}
+	changes, err := r.driver.Changes(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	return changes, wrapDriverError(err)
 }
 
 type simpleGetCloser struct {
@@ -1424,6 +2490,9 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 	if err != nil {
 		return nil, ErrLayerUnknown
 	}
+	if err := r.checkLayerImageStores(toLayer); err != nil {
+		return nil, err
+	}
 	// Default to applying the type of compression that we noted was used
 	// for the layerdiff when it was applied.
 	compression := toLayer.CompressionType
@@ -1433,34 +2502,20 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		compression = *options.Compression
 	}
 	maybeCompressReadCloser := func(rc io.ReadCloser) (io.ReadCloser, error) {
-		// Depending on whether or not compression is desired, return either the
-		// passed-in ReadCloser, or a new one that provides its readers with a
-		// compressed version of the data that the original would have provided
-		// to its readers.
-		if compression == archive.Uncompressed {
-			return rc, nil
-		}
-		preader, pwriter := io.Pipe()
-		compressor, err := archive.CompressStream(pwriter, compression)
-		if err != nil {
-			rc.Close()
-			pwriter.Close()
-			preader.Close()
-			return nil, err
+		return finishDiff(rc, compression, options)
+	}
+	sparse := options != nil && options.Sparse
+	driverDiff := func() (io.ReadCloser, error) {
+		if sd, ok := r.driver.(drivers.SparseDiffDriver); ok && sparse {
+			return sd.SparseDiff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 		}
-		go func() {
-			defer pwriter.Close()
-			defer compressor.Close()
-			defer rc.Close()
-			io.Copy(compressor, rc)
-		}()
-		return preader, nil
+		return r.driver.Diff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 	}
 
 	if from != toLayer.Parent {
-		diff, err := r.driver.Diff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+		diff, err := driverDiff()
 		if err != nil {
-			return nil, err
+			return nil, wrapDriverError(err)
 		}
 		return maybeCompressReadCloser(diff)
 	}
@@ -1484,8 +2539,9 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 				aLayer.Release()
 				return nil, err
 			}
-			// If layer compression type is different from the expected one, decompress and convert it.
-			if compression != layer.CompressionType {
+			// If layer compression type is different from the expected one, or if we need to
+			// rewrite its headers, decompress and convert it.
+			if compression != layer.CompressionType || (options != nil && options.Reproducible) {
 				diff, err := archive.DecompressStream(blob)
 				if err != nil {
 					if err2 := blob.Close(); err2 != nil {
@@ -1507,7 +2563,11 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 					return closeAll(blob.Close, rc.Close)
 				}), nil
 			}
-			return ioutils.NewReadCloserWrapper(blob, func() error { defer aLayer.Release(); return blob.Close() }), nil
+			var rc io.ReadCloser = blob
+			if options != nil && options.Progress != nil {
+				rc = progressCompressedReadCloser(blob, options.Progress)
+			}
+			return ioutils.NewReadCloserWrapper(rc, func() error { defer aLayer.Release(); return rc.Close() }), nil
 		}
 	}
 
@@ -1516,9 +2576,12 @@ func (r *layerStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser,
 		if !os.IsNotExist(err) {
 			return nil, err
 		}
-		diff, err := r.driver.Diff(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+		if diff, ok := r.journaledDiff(toLayer, fromLayer, sparse); ok {
+			return maybeCompressReadCloser(diff)
+		}
+		diff, err := driverDiff()
 		if err != nil {
-			return nil, err
+			return nil, wrapDriverError(err)
 		}
 		return maybeCompressReadCloser(diff)
 	}
@@ -1574,13 +2637,18 @@ func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
 	if err != nil {
 		return -1, ErrLayerUnknown
 	}
-	return r.driver.DiffSize(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	size, err = r.driver.DiffSize(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
+	return size, wrapDriverError(err)
 }
 
 func (r *layerStore) ApplyDiff(to string, diff io.Reader) (size int64, err error) {
 	return r.applyDiffWithOptions(to, nil, diff)
 }
 
+func (r *layerStore) ApplyDiffWithOptions(to string, layerOptions *LayerOptions, diff io.Reader) (size int64, err error) {
+	return r.applyDiffWithOptions(to, layerOptions, diff)
+}
+
 func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions, diff io.Reader) (size int64, err error) {
 	if !r.IsReadWrite() {
 		return -1, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
@@ -1590,18 +2658,126 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	if !ok {
 		return -1, ErrLayerUnknown
 	}
+	r.discardChangeJournal(layer.ID)
+
+	// The layer may already have contents, like a container's layer, so
+	// if we fail, including because we ran out of space, we can't just
+	// discard them.  Put() removes layers which it created when it fails.
+	result, err := r.extractDiff(layer, r.layerMappings(layer), layerOptions, diff)
+	if err != nil {
+		return -1, err
+	}
+	r.recordDiffResult(layer, result)
+
+	err = r.Save()
+
+	return result.size, err
+}
+
+// applyDiffUnlocked does the same work as applyDiffWithOptions, but drops the
+// layer store's lock while the diff is being extracted, so that layers which
+// don't depend on one another can be populated in parallel by other
+// goroutines or processes.  The layer must already have been saved with
+// incompleteFlag and applyingPIDFlag set, so that nobody else tries to use or
+// clean it up while we're working on it.  The lock is held again, and the
+// store reloaded if someone else modified it, by the time this returns.  If
+// dedup is set, the layer's files are also examined while the lock isn't held,
+// and the ones which are identical to files in other layers are then replaced
+// with links to them.  The caller is responsible for saving the updated layer
+// record.  Once the lock is held again, the layer is checked to make sure that
+// it's still the one which we started populating, and that its parent is still
+// around.  If the layer was removed, or replaced by someone else, an error
+// which wraps errLayerReplaced is returned, and the caller shouldn't try to
+// remove it.
+func (r *layerStore) applyDiffUnlocked(id string, layerOptions *LayerOptions, diff io.Reader, dedup bool) (size int64, err error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return -1, ErrLayerUnknown
+	}
+	// Our record may be replaced by a reload while we're not holding the
+	// lock, so work from a private copy of it.
+	layer = copyLayer(layer)
+	mappings := r.layerMappings(layer)
+
+	var dedupFiles []dedupFile
+	result, extractErr := func() (*layerDiffResult, error) {
+		r.lockfile.Unlock()
+		defer r.lockfile.Lock()
+		result, err := r.extractDiff(layer, mappings, layerOptions, diff)
+		if err == nil && dedup {
+			if dedupFiles, err = r.scanDedupFiles(id); err != nil {
+				logrus.Warnf("Error checking the contents of layer %q for files which other layers have: %v", id, err)
+				dedupFiles, err = nil, nil
+			}
+		}
+		return result, err
+	}()
+
+	if err := r.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	// Nobody should have touched the layer while it was flagged as being
+	// populated by us, but a layer with the same ID could have been
+	// created if it was removed anyway, so check that it's still ours.
+	current, ok := r.lookup(id)
+	if !ok || !current.Created.Equal(layer.Created) || !layerHasIncompleteFlag(current) || layerApplyingPID(current) != os.Getpid() {
+		return -1, errors.Wrapf(errLayerReplaced, "layer %q", id)
+	}
+	if extractErr != nil {
+		return -1, extractErr
+	}
+	if current.Parent != "" {
+		if _, ok := r.lookup(current.Parent); !ok {
+			return -1, errors.Wrapf(ErrParentUnknown, "parent %q of layer %q was removed while its contents were being extracted", current.Parent, id)
+		}
+	}
+	r.recordDiffResult(current, result)
+	if len(dedupFiles) > 0 {
+		if err := r.dedupLayer(id, dedupFiles); err != nil {
+			logrus.Warnf("Error sharing the contents of layer %q with other layers: %v", id, err)
+		}
+	}
+	return result.size, nil
+}
+
+// layerDiffResult holds what we learned about a layer's contents while
+// extracting its diff.
+type layerDiffResult struct {
+	size               int64
+	compressedDigest   digest.Digest
+	compressedSize     int64
+	uncompressedDigest digest.Digest
+	uncompressedSize   int64
+	compression        archive.Compression
+	uids, gids         []uint32
+	// additionalUncompressedDigests are digests of the uncompressed diff
+	// which were computed using the store's digest algorithm, if it isn't
+	// digest.Canonical.
+	additionalUncompressedDigests []digest.Digest
+}
+
+// extractDiff hands the diff to the driver and writes out the layer's
+// tar-split data.  It doesn't read or modify the layer store's in-memory
+// state, so it's safe to call without holding the layer store's lock.
+func (r *layerStore) extractDiff(layer *Layer, mappings *idtools.IDMappings, layerOptions *LayerOptions, diff io.Reader) (*layerDiffResult, error) {
+	spacePath := r.spacePath(layer.ID)
+	if err := r.checkFreeSpace(spacePath); err != nil {
+		return nil, err
+	}
 
 	header := make([]byte, 10240)
 	n, err := diff.Read(header)
 	if err != nil && err != io.EOF {
-		return -1, err
+		return nil, err
 	}
 	compression := archive.DetectCompression(header[:n])
 	defragmented := io.MultiReader(bytes.NewBuffer(header[:n]), diff)
 
-	// Decide if we need to compute digests
-	var compressedDigest, uncompressedDigest digest.Digest       // = ""
-	var compressedDigester, uncompressedDigester digest.Digester // = nil
+	// Decide if we need to compute digests.  The uncompressed digest,
+	// which is used as the DiffID, always uses digest.Canonical, and if
+	// the store uses another algorithm, we compute one using it, too.
+	var compressedDigest, uncompressedDigest, additionalDigest digest.Digest         // = ""
+	var compressedDigester, uncompressedDigester, additionalDigester digest.Digester // = nil
 	if layerOptions != nil && layerOptions.OriginalDigest != "" &&
 		layerOptions.OriginalDigest.Algorithm() == digest.Canonical {
 		compressedDigest = layerOptions.OriginalDigest
@@ -1614,10 +2790,36 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	} else {
 		uncompressedDigester = digest.Canonical.Digester()
 	}
+	if r.digestAlgorithm != digest.Canonical {
+		if layerOptions != nil && layerOptions.UncompressedDigest != "" &&
+			layerOptions.UncompressedDigest.Algorithm() == r.digestAlgorithm {
+			additionalDigest = layerOptions.UncompressedDigest
+		} else {
+			additionalDigester = r.digestAlgorithm.Digester()
+		}
+	}
+
+	// If we can, hash the data in a goroutine of its own, so that
+	// computing the digests doesn't hold up the driver while it's
+	// extracting the diff.
+	var asyncDigesters []*ioutils.AsyncWriter
+	defer func() {
+		for _, w := range asyncDigesters {
+			w.Close()
+		}
+	}()
+	digestWriter := func(digester digest.Digester) io.Writer {
+		if runtime.GOMAXPROCS(0) < 2 {
+			return digester.Hash()
+		}
+		w := ioutils.NewAsyncWriter(digester.Hash())
+		asyncDigesters = append(asyncDigesters, w)
+		return w
+	}
 
 	var compressedWriter io.Writer
 	if compressedDigester != nil {
-		compressedWriter = compressedDigester.Hash()
+		compressedWriter = digestWriter(compressedDigester)
 	} else {
 		compressedWriter = ioutil.Discard
 	}
@@ -1635,46 +2837,113 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	metadata := storage.NewJSONPacker(compressor)
 	uncompressed, err := archive.DecompressStream(defragmented)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 	defer uncompressed.Close()
 	uidLog := make(map[uint32]struct{})
 	gidLog := make(map[uint32]struct{})
+	var progress func(*tar.Header)
+	if layerOptions != nil && layerOptions.Progress != nil {
+		progress = progressLogger(layerOptions.Progress)
+	}
+	// Sparse entries can't be reproduced from tar-split data, so if there
+	// are any, we won't keep it.
+	sawSparseEntries := false
 	idLogger, err := tarlog.NewLogger(func(h *tar.Header) {
 		if !strings.HasPrefix(path.Base(h.Name), archive.WhiteoutPrefix) {
 			uidLog[uint32(h.Uid)] = struct{}{}
 			gidLog[uint32(h.Gid)] = struct{}{}
 		}
+		if isSparseEntry(h) {
+			sawSparseEntries = true
+		}
+		if progress != nil {
+			progress(h)
+		}
 	})
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
-	defer idLogger.Close()
+	var closeIDLogger sync.Once
+	defer closeIDLogger.Do(func() { idLogger.Close() })
 	uncompressedCounter := ioutils.NewWriteCounter(idLogger)
 	uncompressedWriter := (io.Writer)(uncompressedCounter)
 	if uncompressedDigester != nil {
-		uncompressedWriter = io.MultiWriter(uncompressedWriter, uncompressedDigester.Hash())
+		uncompressedWriter = io.MultiWriter(uncompressedWriter, digestWriter(uncompressedDigester))
+	}
+	if additionalDigester != nil {
+		uncompressedWriter = io.MultiWriter(uncompressedWriter, digestWriter(additionalDigester))
+	}
+	var payload io.Reader
+	var tarSplitDigester digest.Digester
+	suppliedTarSplit := layerOptions != nil && layerOptions.TarSplit != nil
+	if suppliedTarSplit {
+		// We already have the tar-split data, so there's no need to
+		// generate it, but we'll need to check that it describes
+		// this diff.
+		tarSplitDigester = digest.Canonical.Digester()
+		payload = io.TeeReader(uncompressed, io.MultiWriter(uncompressedWriter, tarSplitDigester.Hash()))
+	} else {
+		payload, err = asm.NewInputTarStream(io.TeeReader(uncompressed, uncompressedWriter), metadata, storage.NewDiscardFilePutter())
+		if err != nil {
+			return nil, err
+		}
 	}
-	payload, err := asm.NewInputTarStream(io.TeeReader(uncompressed, uncompressedWriter), metadata, storage.NewDiscardFilePutter())
-	if err != nil {
-		return -1, err
+	var spaceChecker *spaceCheckingReader
+	if r.reservedSpace > 0 {
+		spaceChecker = &spaceCheckingReader{r: r, reader: payload, path: spacePath}
+		payload = spaceChecker
 	}
 	options := drivers.ApplyDiffOpts{
 		Diff:       payload,
-		Mappings:   r.layerMappings(layer),
+		Mappings:   mappings,
 		MountLabel: layer.MountLabel,
+		Sparse:     true,
 	}
-	size, err = r.driver.ApplyDiff(layer.ID, layer.Parent, options)
+	size, err := r.driver.ApplyDiff(layer.ID, layer.Parent, options)
 	if err != nil {
-		return -1, err
+		if spaceChecker != nil && spaceChecker.err != nil {
+			return nil, spaceChecker.err
+		}
+		return nil, r.noSpaceError(spacePath, wrapDriverError(err))
 	}
 	compressor.Close()
-	if err == nil {
+	tsbytes := tsdata.Bytes()
+	if suppliedTarSplit {
+		// Read any padding which followed the end of the archive, so
+		// that it's counted and included in the digests.
+		if _, err := io.Copy(ioutil.Discard, payload); err != nil {
+			return nil, err
+		}
+		var tarSplitSize int64
+		tsbytes, tarSplitSize, err = prepareTarSplit(layerOptions.TarSplit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading supplied tar-split data")
+		}
+		if tarSplitSize != uncompressedCounter.Count {
+			return nil, errors.Errorf("supplied tar-split data describes %d bytes of the diff, which has %d", tarSplitSize, uncompressedCounter.Count)
+		}
+		if err := r.verifyTarSplit(layer, tsbytes, tarSplitDigester.Digest()); err != nil {
+			return nil, err
+		}
+	}
+	// Wait until the logger has seen every header.
+	closeIDLogger.Do(func() { idLogger.Close() })
+	if sawSparseEntries {
+		if err := os.Remove(r.tspath(layer.ID)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
 		if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0700); err != nil {
-			return -1, err
+			return nil, err
 		}
-		if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), tsdata.Bytes(), 0600); err != nil {
-			return -1, err
+		if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), tsbytes, 0600); err != nil {
+			return nil, r.noSpaceError(r.tspath(layer.ID), err)
+		}
+	}
+	for _, w := range asyncDigesters {
+		if err := w.Close(); err != nil {
+			return nil, err
 		}
 	}
 	if compressedDigester != nil {
@@ -1683,50 +2952,102 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	if uncompressedDigester != nil {
 		uncompressedDigest = uncompressedDigester.Digest()
 	}
+	if additionalDigester != nil {
+		additionalDigest = additionalDigester.Digest()
+	}
 
-	updateDigestMap := func(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
-		var newList []string
-		if oldvalue != "" {
-			for _, value := range (*m)[oldvalue] {
-				if value != id {
-					newList = append(newList, value)
-				}
-			}
-			if len(newList) > 0 {
-				(*m)[oldvalue] = newList
-			} else {
-				delete(*m, oldvalue)
-			}
-		}
-		if newvalue != "" {
-			(*m)[newvalue] = append((*m)[newvalue], id)
-		}
+	result := &layerDiffResult{
+		size:               size,
+		compressedDigest:   compressedDigest,
+		compressedSize:     compressedCounter.Count,
+		uncompressedDigest: uncompressedDigest,
+		uncompressedSize:   uncompressedCounter.Count,
+		compression:        compression,
+		uids:               make([]uint32, 0, len(uidLog)),
+		gids:               make([]uint32, 0, len(gidLog)),
+	}
+	if additionalDigest != "" {
+		result.additionalUncompressedDigests = []digest.Digest{additionalDigest}
 	}
-	updateDigestMap(&r.bycompressedsum, layer.CompressedDigest, compressedDigest, layer.ID)
-	layer.CompressedDigest = compressedDigest
-	layer.CompressedSize = compressedCounter.Count
-	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, uncompressedDigest, layer.ID)
-	layer.UncompressedDigest = uncompressedDigest
-	layer.UncompressedSize = uncompressedCounter.Count
-	layer.CompressionType = compression
-	layer.UIDs = make([]uint32, 0, len(uidLog))
 	for uid := range uidLog {
-		layer.UIDs = append(layer.UIDs, uid)
+		result.uids = append(result.uids, uid)
 	}
-	sort.Slice(layer.UIDs, func(i, j int) bool {
-		return layer.UIDs[i] < layer.UIDs[j]
+	sort.Slice(result.uids, func(i, j int) bool {
+		return result.uids[i] < result.uids[j]
 	})
-	layer.GIDs = make([]uint32, 0, len(gidLog))
 	for gid := range gidLog {
-		layer.GIDs = append(layer.GIDs, gid)
+		result.gids = append(result.gids, gid)
 	}
-	sort.Slice(layer.GIDs, func(i, j int) bool {
-		return layer.GIDs[i] < layer.GIDs[j]
+	sort.Slice(result.gids, func(i, j int) bool {
+		return result.gids[i] < result.gids[j]
 	})
+	return result, nil
+}
 
-	err = r.Save()
-
-	return size, err
+// updateDigestMap moves id from the list of layers indexed under oldvalue in m
+// to the list indexed under newvalue.
+func updateDigestMap(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
+	var newList []string
+	if oldvalue != "" {
+		for _, value := range (*m)[oldvalue] {
+			if value != id {
+				newList = append(newList, value)
+			}
+		}
+		if len(newList) > 0 {
+			(*m)[oldvalue] = newList
+		} else {
+			delete(*m, oldvalue)
+		}
+	}
+	if newvalue != "" {
+		(*m)[newvalue] = append((*m)[newvalue], id)
+	}
+}
+
+// recordDiffResult updates the layer's record and our digest indexes with the
+// results of extracting its diff.
+func (r *layerStore) recordDiffResult(layer *Layer, result *layerDiffResult) {
+	r.unindexDigests(layer)
+	layer.CompressedDigest = result.compressedDigest
+	layer.CompressedSize = result.compressedSize
+	layer.UncompressedDigest = result.uncompressedDigest
+	layer.AdditionalUncompressedDigests = copyDigestSlice(result.additionalUncompressedDigests)
+	r.indexDigests(layer)
+	layer.UncompressedSize = result.uncompressedSize
+	layer.CompressionType = result.compression
+	layer.UIDs = result.uids
+	layer.GIDs = result.gids
+	// Any composefs image which was built from the old contents no longer
+	// matches them, and the new contents haven't been relabeled.
+	layer.ComposefsDigest = ""
+	layer.RelabeledMountLabel = ""
+	layer.RelabeledShared = false
+}
+
+// setUncompressedDigests replaces the layer's uncompressed digests, and updates
+// our index of layers by uncompressed digest to match.
+func (r *layerStore) setUncompressedDigests(layer *Layer, uncompressed digest.Digest, additional []digest.Digest) {
+	r.unindexDigests(layer)
+	layer.UncompressedDigest = uncompressed
+	layer.AdditionalUncompressedDigests = copyDigestSlice(additional)
+	r.indexDigests(layer)
+}
+
+// differDigests sorts the uncompressed digest which a differ reported into
+// the DiffID, which always uses digest.Canonical, and the additional digest
+// which uses the store's digest algorithm, if it's a different one.
+func (r *layerStore) differDigests(d digest.Digest) (digest.Digest, []digest.Digest) {
+	switch {
+	case d == "":
+		return "", nil
+	case d.Algorithm() == digest.Canonical:
+		return d, nil
+	case d.Algorithm() == r.digestAlgorithm:
+		return "", []digest.Digest{d}
+	}
+	logrus.Debugf("Ignoring uncompressed digest %q, which uses neither %q nor %q", d, digest.Canonical, r.digestAlgorithm)
+	return "", nil
 }
 
 func (r *layerStore) DifferTarget(id string) (string, error) {
@@ -1742,6 +3063,9 @@ func (r *layerStore) DifferTarget(id string) (string, error) {
 }
 
 func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string, diffOutput *drivers.DriverWithDifferOutput, options *drivers.ApplyDiffOpts) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
+	}
 	ddriver, ok := r.driver.(drivers.DriverWithDiffer)
 	if !ok {
 		return ErrNotSupported
@@ -1756,15 +3080,20 @@ func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string,
 			MountLabel: layer.MountLabel,
 		}
 	}
+	r.discardChangeJournal(layer.ID)
 	err := ddriver.ApplyDiffFromStagingDirectory(layer.ID, layer.Parent, stagingDirectory, diffOutput, options)
 	if err != nil {
 		return err
 	}
 	layer.UIDs = diffOutput.UIDs
 	layer.GIDs = diffOutput.GIDs
-	layer.UncompressedDigest = diffOutput.UncompressedDigest
+	uncompressedDigest, additionalDigests := r.differDigests(diffOutput.UncompressedDigest)
+	r.setUncompressedDigests(layer, uncompressedDigest, additionalDigests)
 	layer.UncompressedSize = diffOutput.Size
 	layer.Metadata = diffOutput.Metadata
+	layer.ComposefsDigest = diffOutput.ComposefsDigest
+	layer.RelabeledMountLabel = ""
+	layer.RelabeledShared = false
 	if err = r.Save(); err != nil {
 		return err
 	}
@@ -1778,6 +3107,9 @@ func (r *layerStore) ApplyDiffFromStagingDirectory(id, stagingDirectory string,
 }
 
 func (r *layerStore) ApplyDiffWithDiffer(to string, options *drivers.ApplyDiffOpts, differ drivers.Differ) (*drivers.DriverWithDifferOutput, error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify layer contents at %q", r.layerspath())
+	}
 	ddriver, ok := r.driver.(drivers.DriverWithDiffer)
 	if !ok {
 		return nil, ErrNotSupported
@@ -1798,12 +3130,16 @@ func (r *layerStore) ApplyDiffWithDiffer(to string, options *drivers.ApplyDiffOp
 			MountLabel: layer.MountLabel,
 		}
 	}
+	r.discardChangeJournal(layer.ID)
 	output, err := ddriver.ApplyDiffWithDiffer(layer.ID, layer.Parent, options, differ)
 	if err != nil {
 		return nil, err
 	}
 	layer.UIDs = output.UIDs
 	layer.GIDs = output.GIDs
+	uncompressedDigest, additionalDigests := r.differDigests(output.UncompressedDigest)
+	r.setUncompressedDigests(layer, uncompressedDigest, additionalDigests)
+	layer.UncompressedSize = output.Size
 	err = r.Save()
 	return &output, err
 }
@@ -1829,10 +3165,12 @@ func (r *layerStore) layersByDigestMap(m map[digest.Digest][]string, d digest.Di
 }
 
 func (r *layerStore) LayersByCompressedDigest(d digest.Digest) ([]Layer, error) {
+	r.loadDigests()
 	return r.layersByDigestMap(r.bycompressedsum, d)
 }
 
 func (r *layerStore) LayersByUncompressedDigest(d digest.Digest) ([]Layer, error) {
+	r.loadDigests()
 	return r.layersByDigestMap(r.byuncompressedsum, d)
 }
 
@@ -1862,7 +3200,7 @@ func (r *layerStore) Modified() (bool, error) {
 	if err != nil {
 		return lmodified, err
 	}
-	if r.IsReadWrite() {
+	if r.mountsLockfile != nil {
 		r.mountsLockfile.RLock()
 		defer r.mountsLockfile.Unlock()
 		mmodified, err = r.mountsLockfile.Modified()
@@ -1901,6 +3239,19 @@ func (r *layerStore) Locked() bool {
 	return r.lockfile.Locked()
 }
 
+// forceReload reloads the store's contents, whether or not its lock file
+// indicates that it was modified.  It should be called with the lock held.
+func (r *layerStore) forceReload() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	// Note that we've seen the current version of the lock file.
+	if _, err := r.Modified(); err != nil {
+		return err
+	}
+	return r.Load()
+}
+
 func (r *layerStore) ReloadIfChanged() error {
 	r.loadMut.Lock()
 	defer r.loadMut.Unlock()
@@ -1912,6 +3263,112 @@ func (r *layerStore) ReloadIfChanged() error {
 	return err
 }
 
+// isSparseEntry returns true if the header is for a sparse entry, in either
+// the old GNU format or one of the PAX formats.
+func isSparseEntry(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// progressLogger returns a function which, when it is called for each header
+// in a tar stream, reports the running totals to fn.
+func progressLogger(fn archive.ProgressFunc) func(*tar.Header) {
+	var p archive.Progress
+	return func(h *tar.Header) {
+		p.Entries++
+		if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+			p.Bytes += h.Size
+		}
+		p.Entry = h.Name
+		fn(p)
+	}
+}
+
+// finishDiff applies the options which adjust a diff to the uncompressed diff
+// which rc provides.  Depending on whether or not compression is desired, it
+// returns either the passed-in ReadCloser, or a new one that provides its
+// readers with a compressed version of the data that the original would have
+// provided to its readers.
+func finishDiff(rc io.ReadCloser, compression archive.Compression, options *DiffOptions) (io.ReadCloser, error) {
+	if options != nil && options.Reproducible {
+		rc = archive.ReproducibleTarStream(rc, options.SourceDateEpoch)
+	}
+	if options != nil && options.Progress != nil {
+		var err error
+		if rc, err = progressReadCloser(rc, options.Progress); err != nil {
+			return nil, err
+		}
+	}
+	if compression == archive.Uncompressed {
+		return rc, nil
+	}
+	preader, pwriter := io.Pipe()
+	var compressionOptions *archive.CompressionOptions
+	if options != nil {
+		compressionOptions = options.CompressionOptions
+	}
+	compressor, err := archive.CompressStreamWithOptions(pwriter, compression, compressionOptions)
+	if err != nil {
+		rc.Close()
+		pwriter.Close()
+		preader.Close()
+		return nil, err
+	}
+	go func() {
+		defer pwriter.Close()
+		defer compressor.Close()
+		defer rc.Close()
+		io.Copy(compressor, rc)
+	}()
+	return preader, nil
+}
+
+// progressReadCloser returns a ReadCloser which reads the tar stream from rc,
+// and reports progress to fn as each entry in it is read.
+func progressReadCloser(rc io.ReadCloser, fn archive.ProgressFunc) (io.ReadCloser, error) {
+	logger, err := tarlog.NewLogger(progressLogger(fn))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(io.TeeReader(rc, logger), func() error {
+		return closeAll(rc.Close, logger.Close)
+	}), nil
+}
+
+// progressCompressedReadCloser returns a ReadCloser which passes along the
+// possibly-compressed tar stream which rc provides unchanged, and reports
+// progress to fn as each entry in it is read, using a decompressed copy.
+func progressCompressedReadCloser(rc io.ReadCloser, fn archive.ProgressFunc) io.ReadCloser {
+	preader, pwriter := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if diff, err := archive.DecompressStream(preader); err == nil {
+			if logger, err := tarlog.NewLogger(progressLogger(fn)); err == nil {
+				io.Copy(logger, diff)
+				logger.Close()
+			}
+			diff.Close()
+		}
+		// Whatever happened, keep reading, so that the reader of rc
+		// is never kept waiting.
+		io.Copy(ioutil.Discard, preader)
+	}()
+	return ioutils.NewReadCloserWrapper(io.TeeReader(rc, pwriter), func() error {
+		pwriter.Close()
+		<-done
+		return rc.Close()
+	})
+}
+
 func closeAll(closes ...func() error) (rErr error) {
 	for _, f := range closes {
 		if err := f(); err != nil {
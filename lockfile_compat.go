@@ -1,7 +1,12 @@
 package storage
 
 import (
+	"os"
+	"path/filepath"
+	"sync"
+
 	"github.com/containers/storage/pkg/lockfile"
+	"github.com/sirupsen/logrus"
 )
 
 type Locker = lockfile.Locker
@@ -13,3 +18,91 @@ func GetLockfile(path string) (lockfile.Locker, error) {
 func GetROLockfile(path string) (lockfile.Locker, error) {
 	return lockfile.GetROLockfile(path)
 }
+
+// readOnlyLockfile is the lock file of one of the stores of a read-only
+// Store.  It is kept under the run root, since the graph root might not be
+// writable, and it reports that the store is read-only, so that the store's
+// methods which would modify it fail with ErrStoreIsReadOnly.
+type readOnlyLockfile struct {
+	lockfile.Locker
+}
+
+func (l *readOnlyLockfile) IsReadWrite() bool {
+	return false
+}
+
+// sharedLockfile is the lock file of one of the stores of a read-only Store,
+// which was created by whoever populated the store, and which might belong
+// to a process which is still using it.  We open it read-only, and only
+// ever take shared locks on it, even when asked for exclusive ones, so that
+// we see the store's records in a consistent state without ever writing to
+// the lock file.  Nothing which would need an exclusive lock is allowed,
+// since the store reports that it is read-only, but callers in this process
+// which ask for exclusive locks still expect to exclude one another, so we
+// serialize them using a mutex of our own, the same way that a lock file
+// which we could write to would.
+type sharedLockfile struct {
+	lockfile.Locker
+	mu     sync.RWMutex
+	writer bool
+}
+
+func (l *sharedLockfile) Lock() {
+	l.mu.Lock()
+	l.writer = true
+	l.Locker.RLock()
+}
+
+// RecursiveLock can be taken by more than one caller in this process at a
+// time, but not while Lock is held.
+func (l *sharedLockfile) RecursiveLock() {
+	l.mu.RLock()
+	l.Locker.RLock()
+}
+
+func (l *sharedLockfile) RLock() {
+	l.mu.RLock()
+	l.Locker.RLock()
+}
+
+func (l *sharedLockfile) Unlock() {
+	l.Locker.Unlock()
+	if l.writer {
+		l.writer = false
+		l.mu.Unlock()
+	} else {
+		l.mu.RUnlock()
+	}
+}
+
+func (l *sharedLockfile) Touch() error {
+	return ErrStoreIsReadOnly
+}
+
+func (l *sharedLockfile) IsReadWrite() bool {
+	return false
+}
+
+// getReadOnlyStoreLockfile returns a lock file, which can be locked for
+// writing, for a store which can't be modified.  If the store already has a
+// lock file at path, and we can read it, we use it, taking only shared locks
+// on it, so that we cooperate with any other process which is using the
+// store.  Otherwise we use one at fallback, which should be under the run
+// root.
+func getReadOnlyStoreLockfile(path, fallback string) (lockfile.Locker, error) {
+	if _, err := os.Stat(path); err == nil {
+		locker, err := lockfile.GetROLockfile(path)
+		if err == nil {
+			return &sharedLockfile{Locker: locker}, nil
+		}
+		logrus.Debugf("not using lock file %q: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fallback), 0700); err != nil {
+		return nil, err
+	}
+	locker, err := lockfile.GetLockfile(fallback)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyLockfile{locker}, nil
+}
@@ -0,0 +1,598 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/pkg/errors"
+)
+
+// namespacesDir is the directory, under both the graph root and the run root,
+// in which namespaced stores keep their image and container records.
+const namespacesDir = "namespaces"
+
+// validateNamespace checks that a namespace name can be used as a single
+// component of a filesystem path.
+func validateNamespace(namespace string) error {
+	if namespace == "" {
+		return nil
+	}
+	if namespace == "." || namespace == ".." || strings.ContainsAny(namespace, "/\\") {
+		return errors.Wrapf(ErrInvalidNamespace, "%q", namespace)
+	}
+	return nil
+}
+
+// namespaceRoot returns the directory under root in which a store using the
+// specified namespace keeps its image and container records.  The default
+// namespace uses root itself.
+func namespaceRoot(root, namespace string) string {
+	if namespace == "" {
+		return root
+	}
+	return filepath.Join(root, namespacesDir, namespace)
+}
+
+// catalogGraphRoot returns the directory under which this store keeps its
+// image and container records.  It is the same as GraphRoot() unless the
+// store was given a namespace.
+func (s *store) catalogGraphRoot() string {
+	return namespaceRoot(s.graphRoot, s.namespace)
+}
+
+// catalogRunRoot returns the directory under which this store keeps run-time
+// information about its containers.  It is the same as RunRoot() unless the
+// store was given a namespace.
+func (s *store) catalogRunRoot() string {
+	return namespaceRoot(s.runRoot, s.namespace)
+}
+
+func (s *store) Namespace() string {
+	return s.namespace
+}
+
+// peerNamespaces returns the names of the namespaces, other than this store's,
+// which have image or container records under the graph root and so might be
+// using layers that we would otherwise consider unused.
+func (s *store) peerNamespaces() ([]string, error) {
+	var peers []string
+	if s.namespace != "" {
+		if _, err := os.Stat(filepath.Join(s.graphRoot, s.graphDriverName+"-images")); err == nil {
+			peers = append(peers, "")
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(s.graphRoot, namespacesDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return peers, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != s.namespace {
+			peers = append(peers, entry.Name())
+		}
+	}
+	return peers, nil
+}
+
+// peerImageStore returns the image store at gipath, which belongs to another
+// namespace, reusing the one which we opened the last time we needed it.
+func (s *store) peerImageStore(gipath string) (ImageStore, error) {
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
+	if istore, ok := s.peerImageStores[gipath]; ok {
+		return istore, nil
+	}
+	istore, err := newImageStore(gipath, s.writerOptions)
+	if err != nil {
+		return nil, err
+	}
+	if s.peerImageStores == nil {
+		s.peerImageStores = make(map[string]ImageStore)
+	}
+	s.peerImageStores[gipath] = istore
+	return istore, nil
+}
+
+// peerContainerStore returns the container store at gcpath, which belongs to
+// another namespace, reusing the one which we opened the last time we needed
+// it.
+func (s *store) peerContainerStore(gcpath string) (ContainerStore, error) {
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
+	if cstore, ok := s.peerContainerStores[gcpath]; ok {
+		return cstore, nil
+	}
+	cstore, err := newContainerStore(gcpath, s.containerLog, s.writerOptions)
+	if err != nil {
+		return nil, err
+	}
+	if s.peerContainerStores == nil {
+		s.peerContainerStores = make(map[string]ContainerStore)
+	}
+	s.peerContainerStores[gcpath] = cstore
+	return cstore, nil
+}
+
+// layersUsedByPeerNamespaces returns a map from the IDs of layers which are
+// used by images or containers in other namespaces to a description of one of
+// their users.  The layer store should be locked by the caller.
+func (s *store) layersUsedByPeerNamespaces() (map[string]error, error) {
+	peers, err := s.peerNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]error)
+	driverPrefix := s.graphDriverName + "-"
+	for _, peer := range peers {
+		describe := func(what string, id string) string {
+			if peer == "" {
+				return fmt.Sprintf("%s %v in the default namespace", what, id)
+			}
+			return fmt.Sprintf("%s %v in namespace %q", what, id, peer)
+		}
+		gipath := filepath.Join(namespaceRoot(s.graphRoot, peer), driverPrefix+"images")
+		if _, err := os.Stat(gipath); err == nil {
+			istore, err := s.peerImageStore(gipath)
+			if err != nil {
+				return nil, err
+			}
+			images, err := func() ([]Image, error) {
+				istore.RLock()
+				defer istore.Unlock()
+				if err := istore.ReloadIfChanged(); err != nil {
+					return nil, err
+				}
+				return istore.Images()
+			}()
+			if err != nil {
+				return nil, err
+			}
+			for _, image := range images {
+				for _, layer := range append([]string{image.TopLayer}, image.MappedTopLayers...) {
+					if layer != "" {
+						used[layer] = errors.Wrapf(ErrLayerUsedByImage, "layer %v used by %s", layer, describe("image", image.ID))
+					}
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		gcpath := filepath.Join(namespaceRoot(s.graphRoot, peer), driverPrefix+"containers")
+		if _, err := os.Stat(gcpath); err == nil {
+			cstore, err := s.peerContainerStore(gcpath)
+			if err != nil {
+				return nil, err
+			}
+			containers, err := func() ([]Container, error) {
+				cstore.RLock()
+				defer cstore.Unlock()
+				if err := cstore.ReloadIfChanged(); err != nil {
+					return nil, err
+				}
+				return cstore.Containers()
+			}()
+			if err != nil {
+				return nil, err
+			}
+			for _, container := range containers {
+				used[container.LayerID] = errors.Wrapf(ErrLayerUsedByContainer, "layer %v used by %s", container.LayerID, describe("container", container.ID))
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return used, nil
+}
+
+// wipeUnsharedLayers deletes every layer in the layer store which isn't used,
+// directly or as an ancestor, by images or containers in other namespaces.
+// The layer store should be locked by the caller.
+func (s *store) wipeUnsharedLayers(rlstore LayerStore, used map[string]error) error {
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*Layer, len(layers))
+	children := make(map[string]int)
+	for i := range layers {
+		byID[layers[i].ID] = &layers[i]
+		children[layers[i].Parent]++
+	}
+	keep := make(map[string]bool)
+	for id := range used {
+		for layer, ok := byID[id]; ok && !keep[layer.ID]; layer, ok = byID[layer.Parent] {
+			keep[layer.ID] = true
+		}
+	}
+	// Delete leaves first, working our way down each chain until we reach
+	// a layer that we need to keep or one that still has other children.
+	var pending []string
+	for _, layer := range layers {
+		if children[layer.ID] == 0 && !keep[layer.ID] {
+			pending = append(pending, layer.ID)
+		}
+	}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		if err := rlstore.Delete(id); err != nil {
+			return err
+		}
+		parent := byID[id].Parent
+		if parent == "" {
+			continue
+		}
+		children[parent]--
+		if children[parent] == 0 && !keep[parent] {
+			pending = append(pending, parent)
+		}
+	}
+	return nil
+}
+
+// lastUsedFlag is set on images, to the time at which a container was last
+// created from them, so that Prune() can tell how long they've gone unused.
+const lastUsedFlag = "last-used"
+
+// imageLastUsed returns the time at which a container was last created from
+// the image, or the time at which it was created if it has never been used.
+func imageLastUsed(image *Image) time.Time {
+	if value, ok := image.Flags[lastUsedFlag].(string); ok {
+		if lastUsed, err := time.Parse(time.RFC3339Nano, value); err == nil && lastUsed.After(image.Created) {
+			return lastUsed
+		}
+	}
+	return image.Created
+}
+
+// namespacePolicyFile is the file, under a namespace's graph root directory,
+// in which its NamespacePolicy is kept.
+const namespacePolicyFile = "namespace-policy.json"
+
+// NamespacePolicy limits the space which the images and containers in a
+// store's namespace may use, and controls which of its images Prune()
+// removes.
+type NamespacePolicy struct {
+	// Quota, if not zero, is the number of bytes of layer contents which
+	// the namespace's images and containers may use.  Creating an image
+	// or a container which would take the namespace's usage over its
+	// quota fails with an error which wraps ErrNamespaceQuotaExceeded.
+	Quota int64 `json:"quota,omitempty"`
+	// PruneDangling causes Prune() to remove images which have no names.
+	PruneDangling bool `json:"prune-dangling,omitempty"`
+	// PruneUnusedAfter, if not zero, causes Prune() to remove images
+	// from which no container has been created for longer than this.
+	// Images which have never been used are counted from the time at
+	// which they were created.
+	PruneUnusedAfter time.Duration `json:"prune-unused-after,omitempty"`
+	// PruneToQuota causes Prune() to remove the least recently used
+	// images until the namespace's usage fits in its quota.
+	PruneToQuota bool `json:"prune-to-quota,omitempty"`
+}
+
+// PruneReport lists what a call to Prune() removed.
+type PruneReport struct {
+	// Images lists the IDs of the images which were deleted.
+	Images []string `json:"images,omitempty"`
+	// Layers lists the IDs of the layers which were deleted.
+	Layers []string `json:"layers,omitempty"`
+	// Usage is the namespace's usage, as NamespaceUsage() would report
+	// it, after pruning.
+	Usage int64 `json:"usage"`
+}
+
+func (s *store) namespacePolicyPath() string {
+	return filepath.Join(s.catalogGraphRoot(), namespacePolicyFile)
+}
+
+func (s *store) NamespacePolicy() (*NamespacePolicy, error) {
+	var policy NamespacePolicy
+	data, err := ioutil.ReadFile(s.namespacePolicyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &policy, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, errors.Wrapf(err, "decoding %q", s.namespacePolicyPath())
+	}
+	return &policy, nil
+}
+
+func (s *store) SetNamespacePolicy(policy *NamespacePolicy) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to change the policy at %q", s.namespacePolicyPath())
+	}
+	if policy == nil {
+		policy = &NamespacePolicy{}
+	}
+	if policy.Quota < 0 || policy.PruneUnusedAfter < 0 {
+		return errors.Errorf("invalid namespace policy: quota and prune-unused-after can't be negative")
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.catalogGraphRoot(), 0700); err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(s.namespacePolicyPath(), data, 0600)
+}
+
+func (s *store) NamespaceUsage() (int64, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return -1, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return -1, err
+	}
+	rlstore.RLock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	ristore.RLock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	return s.namespaceUsage(rlstore, ristore)
+}
+
+// namespaceUsage adds up the sizes of the layers which the namespace's images
+// and containers use, along with any layers which the specified top layers
+// would add.  The layer and image stores should be locked by the caller.
+func (s *store) namespaceUsage(rlstore ROLayerStore, ristore ROImageStore, topLayers ...string) (int64, error) {
+	images, err := ristore.Images()
+	if err != nil {
+		return -1, err
+	}
+	for _, image := range images {
+		topLayers = append(append(topLayers, image.TopLayer), image.MappedTopLayers...)
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return -1, err
+	}
+	containers, err := func() ([]Container, error) {
+		rcstore.RLock()
+		defer rcstore.Unlock()
+		if err := rcstore.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		return rcstore.Containers()
+	}()
+	if err != nil {
+		return -1, err
+	}
+	for _, container := range containers {
+		topLayers = append(topLayers, container.LayerID)
+	}
+	var usage int64
+	counted := make(map[string]bool)
+	for _, id := range topLayers {
+		for id != "" && !counted[id] {
+			layer, err := rlstore.Get(id)
+			if err != nil {
+				// Layers in additional image stores don't count.
+				break
+			}
+			counted[id] = true
+			if layer.UncompressedDigest != "" && layer.UncompressedSize >= 0 {
+				usage += layer.UncompressedSize
+			} else if size, err := rlstore.DiffSize(layer.Parent, id); err == nil && size > 0 {
+				// Layers which weren't populated from a diff,
+				// such as those of containers, are measured.
+				usage += size
+			}
+			id = layer.Parent
+		}
+	}
+	return usage, nil
+}
+
+// checkNamespaceQuota returns an error if adding an image or container which
+// uses topLayer would take the namespace's usage over its quota.  The layer
+// and image stores should be locked by the caller.
+func (s *store) checkNamespaceQuota(rlstore ROLayerStore, ristore ROImageStore, topLayer string) error {
+	if topLayer == "" {
+		return nil
+	}
+	policy, err := s.NamespacePolicy()
+	if err != nil {
+		return err
+	}
+	if policy.Quota == 0 {
+		return nil
+	}
+	usage, err := s.namespaceUsage(rlstore, ristore, topLayer)
+	if err != nil {
+		return err
+	}
+	if usage > policy.Quota {
+		return errors.Wrapf(ErrNamespaceQuotaExceeded, "%d bytes would be used, but the quota is %d bytes", usage, policy.Quota)
+	}
+	return nil
+}
+
+// checkLayerNamespaceQuota returns an error if the layer which was just added
+// would take the namespace's usage over its quota, if something were to use
+// it.  The layer store should be locked by the caller.
+func (s *store) checkLayerNamespaceQuota(rlstore ROLayerStore, id string) error {
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	ristore.RLock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return s.checkNamespaceQuota(rlstore, ristore, id)
+}
+
+// deleteUnusedLayers deletes topLayer, and then its ancestors, until it reaches
+// one which is used by an image or a container, or which has other children.
+// It's used to clean up after layers which were added for an image which we
+// then couldn't create.  The layer and image stores should be locked by the
+// caller.
+func (s *store) deleteUnusedLayers(rlstore LayerStore, ristore ROImageStore, topLayer string) error {
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return err
+	}
+	images, err := ristore.Images()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	containers, err := rcstore.Containers()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, image := range images {
+		used[image.TopLayer] = true
+		for _, id := range image.MappedTopLayers {
+			used[id] = true
+		}
+	}
+	for _, container := range containers {
+		used[container.LayerID] = true
+	}
+	parents := make(map[string]string)
+	children := make(map[string]int)
+	for _, layer := range layers {
+		parents[layer.ID] = layer.Parent
+		children[layer.Parent]++
+	}
+	for id := topLayer; id != "" && !used[id] && children[id] == 0; {
+		parent, ok := parents[id]
+		if !ok {
+			// It's in a read-only layer store.
+			break
+		}
+		if err := rlstore.Delete(id); err != nil {
+			return err
+		}
+		children[parent]--
+		id = parent
+	}
+	return nil
+}
+
+func (s *store) Prune() (*PruneReport, error) {
+	policy, err := s.NamespacePolicy()
+	if err != nil {
+		return nil, err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the images which could be removed, oldest first.
+	candidates, err := func() ([]Image, error) {
+		ristore.RLock()
+		defer ristore.Unlock()
+		if err := ristore.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		rcstore.RLock()
+		defer rcstore.Unlock()
+		if err := rcstore.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		images, err := ristore.Images()
+		if err != nil {
+			return nil, err
+		}
+		containers, err := rcstore.Containers()
+		if err != nil {
+			return nil, err
+		}
+		inUse := make(map[string]bool)
+		for _, container := range containers {
+			inUse[container.ImageID] = true
+		}
+		var candidates []Image
+		for _, image := range images {
+			if !inUse[image.ID] && !isPinned(image.Flags) {
+				candidates = append(candidates, image)
+			}
+		}
+		return candidates, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return imageLastUsed(&candidates[i]).Before(imageLastUsed(&candidates[j]))
+	})
+
+	report := &PruneReport{}
+	remove := func(image *Image) error {
+		layers, err := s.DeleteImage(image.ID, true)
+		if err != nil {
+			if errors.Is(err, ErrImageUnknown) || errors.Is(err, ErrImageUsedByContainer) {
+				// Someone else got to it first.
+				return nil
+			}
+			return errors.Wrapf(err, "pruning image %q", image.ID)
+		}
+		report.Images = append(report.Images, image.ID)
+		report.Layers = append(report.Layers, layers...)
+		return nil
+	}
+	cutoff := time.Now().Add(-policy.PruneUnusedAfter)
+	var remaining []Image
+	for i := range candidates {
+		image := &candidates[i]
+		if (policy.PruneDangling && len(image.Names) == 0) || (policy.PruneUnusedAfter != 0 && imageLastUsed(image).Before(cutoff)) {
+			if err := remove(image); err != nil {
+				return report, err
+			}
+			continue
+		}
+		remaining = append(remaining, *image)
+	}
+	if report.Usage, err = s.NamespaceUsage(); err != nil {
+		return report, err
+	}
+	if policy.PruneToQuota && policy.Quota != 0 {
+		for i := 0; i < len(remaining) && report.Usage > policy.Quota; i++ {
+			if err := remove(&remaining[i]); err != nil {
+				return report, err
+			}
+			if report.Usage, err = s.NamespaceUsage(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
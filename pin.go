@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// pinnedFlag is set on images and layers which have been pinned, to keep them
+// from being deleted.
+const pinnedFlag = "pinned"
+
+// isPinned returns true if the flags of an image or layer mark it as pinned.
+func isPinned(flags map[string]interface{}) bool {
+	pinned, ok := flags[pinnedFlag].(bool)
+	return ok && pinned
+}
+
+func (s *store) setImagePinned(id string, pinned bool) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to pin or unpin images in %q", s.graphRoot)
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	image, err := ristore.Get(id)
+	if err != nil {
+		return err
+	}
+	if pinned {
+		return ristore.SetFlag(image.ID, pinnedFlag, true)
+	}
+	return ristore.ClearFlag(image.ID, pinnedFlag)
+}
+
+func (s *store) setLayerPinned(id string, pinned bool) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to pin or unpin layers in %q", s.graphRoot)
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	layer, err := rlstore.Get(id)
+	if err != nil {
+		return err
+	}
+	if pinned {
+		return rlstore.SetFlag(layer.ID, pinnedFlag, true)
+	}
+	return rlstore.ClearFlag(layer.ID, pinnedFlag)
+}
+
+func (s *store) PinImage(id string) error {
+	return s.setImagePinned(id, true)
+}
+
+func (s *store) UnpinImage(id string) error {
+	return s.setImagePinned(id, false)
+}
+
+func (s *store) PinLayer(id string) error {
+	return s.setLayerPinned(id, true)
+}
+
+func (s *store) UnpinLayer(id string) error {
+	return s.setLayerPinned(id, false)
+}
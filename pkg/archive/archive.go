@@ -11,9 +11,11 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/containers/storage/pkg/fileutils"
 	"github.com/containers/storage/pkg/idtools"
@@ -67,6 +69,30 @@ type (
 		CopyPass bool
 		// ForceMask, if set, indicates the permission mask used for created files.
 		ForceMask *os.FileMode
+		// CompressionOptions, if set, tunes the compressor which is
+		// used when Compression is Gzip or Zstd.
+		CompressionOptions *CompressionOptions
+		// Sparse, when creating an archive, stores regular files which
+		// have holes in them as GNU sparse entries.  When unpacking, it
+		// leaves holes in place of blocks of regular files which contain
+		// only zeroes.  Sparse entries can't be reassembled from tar-split
+		// data, so this shouldn't be used when generating layer diffs.
+		Sparse bool
+		// Reproducible, when creating an archive, causes the archive's
+		// contents to depend only on the contents of the files being
+		// archived: entries are added in a fixed order, modification
+		// times are clamped to SourceDateEpoch, access and change times
+		// are omitted, and only numeric user and group IDs are recorded.
+		Reproducible bool
+		// SourceDateEpoch is the time to which modification times are
+		// clamped when Reproducible is set.  If it is not set, all
+		// modification times are set to the start of the Unix epoch.
+		SourceDateEpoch *time.Time
+		// XattrPolicy, if set, controls which extended attributes and
+		// POSIX ACLs are recorded when creating an archive, and which
+		// are set when extracting one.  If it is not set, the policy
+		// returned by DefaultXattrPolicy is used.
+		XattrPolicy *XattrPolicy
 	}
 )
 
@@ -77,10 +103,6 @@ const (
 	containersOverrideXattr = "user.containers.override_stat"
 )
 
-var xattrsToIgnore = map[string]interface{}{
-	"security.selinux": true,
-}
-
 // Archiver allows the reuse of most utility functions of this package with a
 // pluggable Untar function.  To facilitate the passing of specific id mappings
 // for untar, an archiver can be created with maps which will then be passed to
@@ -222,8 +244,28 @@ func DecompressStream(archive io.Reader) (io.ReadCloser, error) {
 	}
 }
 
+// CompressionOptions tunes the compressors which CompressStreamWithOptions
+// creates.
+type CompressionOptions struct {
+	// Level is the compression level, on the scale which the algorithm's
+	// reference implementation uses.  0 selects the default level.
+	Level int
+	// Concurrency is the number of blocks which the gzip and zstd
+	// compressors compress in parallel.  0 selects one per CPU.
+	Concurrency int
+}
+
 // CompressStream compresses the dest with specified compression algorithm.
 func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, error) {
+	return CompressStreamWithOptions(dest, compression, nil)
+}
+
+// CompressStreamWithOptions compresses the dest with specified compression
+// algorithm, tuning the compressor using options if they are set.
+func CompressStreamWithOptions(dest io.Writer, compression Compression, options *CompressionOptions) (io.WriteCloser, error) {
+	if options == nil {
+		options = &CompressionOptions{}
+	}
 	p := pools.BufioWriter32KPool
 	buf := p.Get(dest)
 	switch compression {
@@ -231,11 +273,23 @@ func CompressStream(dest io.Writer, compression Compression) (io.WriteCloser, er
 		writeBufWrapper := p.NewWriteCloserWrapper(buf, buf)
 		return writeBufWrapper, nil
 	case Gzip:
-		gzWriter := gzip.NewWriter(dest)
+		level := options.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gzWriter, err := gzip.NewWriterLevel(dest, level)
+		if err != nil {
+			return nil, err
+		}
+		if options.Concurrency > 0 {
+			if err := gzWriter.SetConcurrency(1024*1024, options.Concurrency); err != nil {
+				return nil, err
+			}
+		}
 		writeBufWrapper := p.NewWriteCloserWrapper(buf, gzWriter)
 		return writeBufWrapper, nil
 	case Zstd:
-		return zstdWriter(dest)
+		return zstdWriter(dest, options)
 	case Bzip2, Xz:
 		// archive/bzip2 does not support writing, and there is no xz support at all
 		// However, this is not a problem as docker only currently generates gzipped tars
@@ -469,12 +523,40 @@ type tarAppender struct {
 	// from the traditional behavior/format to get features like subsecond
 	// precision in timestamps.
 	CopyPass bool
+	// Sparse indicates that regular files which have holes in them should
+	// be written as sparse entries.
+	Sparse bool
+	// Reproducible indicates that headers should be adjusted so that they
+	// don't vary from one run to the next, with modification times clamped
+	// to SourceDateEpoch.
+	Reproducible    bool
+	SourceDateEpoch *time.Time
+	// XattrPolicy controls which extended attributes are recorded.  If
+	// it is nil, the default policy is used.
+	XattrPolicy *XattrPolicy
+	// RawWriter is the stream which TarWriter writes to.  Sparse entries
+	// are written to it directly.
+	RawWriter io.Writer
+	// SpliceTo, if set, is the pipe which RawWriter writes to.  The
+	// contents of regular files are spliced into it, where that's
+	// possible, instead of being copied through a buffer.
+	SpliceTo *os.File
+}
+
+// tarFileEntry is what we learn about a file when we decide what its header
+// should look like, before we add it to an archive.
+type tarFileEntry struct {
+	path string
+	name string
+	fi   os.FileInfo
+	hdr  *tar.Header
 }
 
 func newTarAppender(idMapping *idtools.IDMappings, writer io.Writer, chownOpts *idtools.IDPair) *tarAppender {
 	return &tarAppender{
 		SeenFiles:  make(map[uint64]string),
 		TarWriter:  tar.NewWriter(writer),
+		RawWriter:  writer,
 		Buffer:     pools.BufioWriter32KPool.Get(nil),
 		IDMappings: idMapping,
 		ChownOpts:  chownOpts,
@@ -498,9 +580,21 @@ func canonicalTarName(name string, isDir bool) (string, error) {
 
 // addTarFile adds to the tar archive a file from `path` as `name`
 func (ta *tarAppender) addTarFile(path, name string) error {
+	entry, err := ta.prepareTarFile(path, name)
+	if err != nil || entry == nil {
+		return err
+	}
+	return ta.writeTarFile(entry)
+}
+
+// prepareTarFile reads the information about a file which we need in order to
+// build its header.  It doesn't modify the tarAppender, so it can be called
+// for several files at once.  If the file shouldn't be added to the archive,
+// it returns nil.
+func (ta *tarAppender) prepareTarFile(path, name string) (*tarFileEntry, error) {
 	fi, err := os.Lstat(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var link string
@@ -508,24 +602,32 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 		var err error
 		link, err = os.Readlink(path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if fi.Mode()&os.ModeSocket != 0 {
 		logrus.Warnf("archive: skipping %q since it is a socket", path)
-		return nil
+		return nil, nil
 	}
 
 	hdr, err := FileInfoHeader(name, fi, link)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := ReadSecurityXattrToTarHeader(path, hdr); err != nil {
-		return err
+	xattrPolicy := ta.XattrPolicy
+	if xattrPolicy == nil {
+		xattrPolicy = defaultTarXattrPolicy
 	}
-	if err := ReadUserXattrToTarHeader(path, hdr); err != nil {
-		return err
+	if err := ReadXattrsToTarHeader(path, hdr, xattrPolicy); err != nil {
+		return nil, err
 	}
+	return &tarFileEntry{path: path, name: name, fi: fi, hdr: hdr}, nil
+}
+
+// writeTarFile finishes the header for a file which was examined using
+// prepareTarFile, and adds the file to the archive.
+func (ta *tarAppender) writeTarFile(entry *tarFileEntry) error {
+	path, name, fi, hdr := entry.path, entry.name, entry.fi, entry.hdr
 	if ta.CopyPass {
 		copyPassHeader(hdr)
 	}
@@ -569,6 +671,9 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 	}
 
 	maybeTruncateHeaderModTime(hdr)
+	if ta.Reproducible {
+		reproducibleHeader(hdr, ta.SourceDateEpoch)
+	}
 
 	if ta.WhiteoutConverter != nil {
 		wo, err := ta.WhiteoutConverter.ConvertWrite(hdr, path, fi)
@@ -589,6 +694,23 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 				return fmt.Errorf("tar: cannot use whiteout for non-empty file")
 			}
 			hdr = wo
+			if ta.Reproducible {
+				reproducibleHeader(hdr, ta.SourceDateEpoch)
+			}
+		}
+	}
+
+	if ta.Sparse && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		written, err := ta.addSparseFile(path, hdr)
+		if err != nil || written {
+			return err
+		}
+	}
+
+	if ta.SpliceTo != nil && hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		written, err := ta.spliceTarFile(path, hdr)
+		if err != nil || written {
+			return err
 		}
 	}
 
@@ -618,7 +740,7 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 	return nil
 }
 
-func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, Lchown bool, chownOpts *idtools.IDPair, inUserns, ignoreChownErrors bool, forceMask *os.FileMode, buffer []byte) error {
+func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, Lchown bool, chownOpts *idtools.IDPair, inUserns, ignoreChownErrors bool, forceMask *os.FileMode, sparse bool, xattrPolicy *XattrPolicy, buffer []byte) error {
 	// hdr.Mode is in linux format, which we can use for sycalls,
 	// but for os.Foo() calls we need the mode converted to os.FileMode,
 	// so use hdrInfo.Mode() (they differ for e.g. setuid bits)
@@ -643,11 +765,18 @@ func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, L
 		// Source is regular file. We use system.OpenFileSequential to use sequential
 		// file access to avoid depleting the standby list on Windows.
 		// On Linux, this equates to a regular os.OpenFile
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, mask)
+		// Anything which was there was removed, so don't follow a
+		// symbolic link if one has been put in its place since.
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mask)
 		if err != nil {
 			return err
 		}
-		if _, err := io.CopyBuffer(file, reader, buffer); err != nil {
+		if sparse {
+			err = writeSparseFile(file, reader, buffer)
+		} else {
+			_, err = io.CopyBuffer(file, reader, buffer)
+		}
+		if err != nil {
 			file.Close()
 			return err
 		}
@@ -671,19 +800,27 @@ func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, L
 		if !strings.HasPrefix(targetPath, extractDir) {
 			return breakoutError(fmt.Errorf("invalid hardlink %q -> %q", targetPath, hdr.Linkname))
 		}
-		if err := os.Link(targetPath, path); err != nil {
+		targetPath, release, err := resolveUnderRoot(extractDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		err = os.Link(targetPath, path)
+		release()
+		if err != nil {
 			return err
 		}
 
 	case tar.TypeSymlink:
-		// 	path 				-> hdr.Linkname = targetPath
+		// 	hdr.Name 			-> hdr.Linkname = targetPath
 		// e.g. /extractDir/path/to/symlink 	-> ../2/file	= /extractDir/path/2/file
-		targetPath := filepath.Join(filepath.Dir(path), hdr.Linkname)
+		// path may refer to the directory which contains it using
+		// /proc/self/fd, so use the name from the header.
+		targetPath := filepath.Join(extractDir, filepath.Dir(hdr.Name), hdr.Linkname)
 
 		// the reason we don't need to check symlinks in the path (with FollowSymlinkInScope) is because
 		// that symlink would first have to be created, which would be caught earlier, at this very check:
 		if !strings.HasPrefix(targetPath, extractDir) {
-			return breakoutError(fmt.Errorf("invalid symlink %q -> %q", path, hdr.Linkname))
+			return breakoutError(fmt.Errorf("invalid symlink %q -> %q", filepath.Join(extractDir, hdr.Name), hdr.Linkname))
 		}
 		if err := os.Symlink(hdr.Linkname, path); err != nil {
 			return err
@@ -698,7 +835,7 @@ func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, L
 	}
 
 	if forceMask != nil && hdr.Typeflag != tar.TypeSymlink {
-		value := fmt.Sprintf("%d:%d:0%o", hdr.Uid, hdr.Gid, hdrInfo.Mode()&07777)
+		value := fmt.Sprintf("%d:%d:0%o", hdr.Uid, hdr.Gid, hdr.Mode&07777)
 		if err := system.Lsetxattr(path, containersOverrideXattr, []byte(value), 0); err != nil {
 			return err
 		}
@@ -749,13 +886,19 @@ func createTarFile(path, extractDir string, hdr *tar.Header, reader io.Reader, L
 		}
 	}
 
+	if xattrPolicy == nil {
+		xattrPolicy = defaultUntarXattrPolicy
+		if inUserns {
+			xattrPolicy = rootlessXattrPolicy
+		}
+	}
 	var errs []string
 	for key, value := range hdr.Xattrs {
-		if _, found := xattrsToIgnore[key]; found {
+		if !xattrPolicy.Allows(key) {
 			continue
 		}
 		if err := system.Lsetxattr(path, key, []byte(value), 0); err != nil {
-			if errors.Is(err, syscall.ENOTSUP) || (inUserns && errors.Is(err, syscall.EPERM)) {
+			if errors.Is(err, syscall.ENOTSUP) || (inUserns && errors.Is(err, syscall.EPERM)) || xattrPolicy.IgnoreErrors {
 				// We ignore errors here because not all graphdrivers support
 				// xattrs *cough* old versions of AUFS *cough*. However only
 				// ENOTSUP should be emitted in that case, otherwise we still
@@ -799,7 +942,7 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 
 	pipeReader, pipeWriter := io.Pipe()
 
-	compressWriter, err := CompressStream(pipeWriter, options.Compression)
+	compressWriter, err := CompressStreamWithOptions(pipeWriter, options.Compression, options.CompressionOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -812,6 +955,10 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 		)
 		ta.WhiteoutConverter = GetWhiteoutConverter(options.WhiteoutFormat, options.WhiteoutData)
 		ta.CopyPass = options.CopyPass
+		ta.Sparse = options.Sparse
+		ta.Reproducible = options.Reproducible
+		ta.SourceDateEpoch = options.SourceDateEpoch
+		ta.XattrPolicy = options.XattrPolicy
 
 		defer func() {
 			// Make sure to check the error on Close.
@@ -856,6 +1003,13 @@ func TarWithOptions(srcPath string, options *TarOptions) (io.ReadCloser, error)
 		if len(options.IncludeFiles) == 0 {
 			options.IncludeFiles = []string{"."}
 		}
+		if options.Reproducible {
+			// filepath.Walk visits entries in lexical order, so we
+			// only need to settle the order of the starting points.
+			includes := append([]string{}, options.IncludeFiles...)
+			sort.Strings(includes)
+			options.IncludeFiles = includes
+		}
 
 		seen := make(map[string]bool)
 
@@ -1009,21 +1163,6 @@ loop:
 			}
 		}
 
-		// After calling filepath.Clean(hdr.Name) above, hdr.Name will now be in
-		// the filepath format for the OS on which the daemon is running. Hence
-		// the check for a slash-suffix MUST be done in an OS-agnostic way.
-		if !strings.HasSuffix(hdr.Name, string(os.PathSeparator)) {
-			// Not the root directory, ensure that the parent directory exists
-			parent := filepath.Dir(hdr.Name)
-			parentPath := filepath.Join(dest, parent)
-			if _, err := os.Lstat(parentPath); err != nil && os.IsNotExist(err) {
-				err = idtools.MkdirAllAndChownNew(parentPath, 0777, rootIDs)
-				if err != nil {
-					return err
-				}
-			}
-		}
-
 		path := filepath.Join(dest, hdr.Name)
 		rel, err := filepath.Rel(dest, path)
 		if err != nil {
@@ -1032,70 +1171,92 @@ loop:
 		if strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
 			return breakoutError(fmt.Errorf("%q is outside of %q", hdr.Name, dest))
 		}
-
-		// If path exits we almost always just want to remove and replace it
-		// The only exception is when it is a directory *and* the file from
-		// the layer is also a directory. Then we want to merge them (i.e.
-		// just apply the metadata from the layer).
-		if fi, err := os.Lstat(path); err == nil {
-			if options.NoOverwriteDirNonDir && fi.IsDir() && hdr.Typeflag != tar.TypeDir {
-				// If NoOverwriteDirNonDir is true then we cannot replace
-				// an existing directory with a non-directory from the archive.
-				return overwriteError(fmt.Errorf("cannot overwrite directory %q with non-directory %q", path, dest))
+		// Don't follow symbolic links out of dest, even if we're not
+		// running in a chroot, and ensure that the parent directory
+		// exists.
+		path, release, err := createUnderRoot(dest, hdr.Name, 0777, &rootIDs)
+		if err != nil {
+			// Nothing under something which isn't a directory
+			// needs to be whited out.
+			if isENOTDIR(err) && strings.HasPrefix(filepath.Base(hdr.Name), WhiteoutPrefix) {
+				continue
 			}
+			return err
+		}
+		err = func() error {
+			defer release()
+			// If path exits we almost always just want to remove and replace it
+			// The only exception is when it is a directory *and* the file from
+			// the layer is also a directory. Then we want to merge them (i.e.
+			// just apply the metadata from the layer).
+			if fi, err := os.Lstat(path); err == nil {
+				if options.NoOverwriteDirNonDir && fi.IsDir() && hdr.Typeflag != tar.TypeDir {
+					// If NoOverwriteDirNonDir is true then we cannot replace
+					// an existing directory with a non-directory from the archive.
+					return overwriteError(fmt.Errorf("cannot overwrite directory %q with non-directory %q", filepath.Join(dest, hdr.Name), dest))
+				}
+
+				if options.NoOverwriteDirNonDir && !fi.IsDir() && hdr.Typeflag == tar.TypeDir {
+					// If NoOverwriteDirNonDir is true then we cannot replace
+					// an existing non-directory with a directory from the archive.
+					return overwriteError(fmt.Errorf("cannot overwrite non-directory %q with directory %q", filepath.Join(dest, hdr.Name), dest))
+				}
+
+				if fi.IsDir() && hdr.Name == "." {
+					return nil
+				}
 
-			if options.NoOverwriteDirNonDir && !fi.IsDir() && hdr.Typeflag == tar.TypeDir {
-				// If NoOverwriteDirNonDir is true then we cannot replace
-				// an existing non-directory with a directory from the archive.
-				return overwriteError(fmt.Errorf("cannot overwrite non-directory %q with directory %q", path, dest))
+				if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+					if err := os.RemoveAll(path); err != nil {
+						return err
+					}
+				}
 			}
+			trBuf.Reset(tr)
 
-			if fi.IsDir() && hdr.Name == "." {
-				continue
+			chownOpts := options.ChownOpts
+			if err := remapIDs(nil, idMappings, chownOpts, hdr); err != nil {
+				return err
 			}
 
-			if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
-				if err := os.RemoveAll(path); err != nil {
+			if whiteoutConverter != nil {
+				writeFile, err := whiteoutConverter.ConvertRead(hdr, path)
+				if err != nil {
 					return err
 				}
+				if !writeFile {
+					return nil
+				}
 			}
-		}
-		trBuf.Reset(tr)
 
-		chownOpts := options.ChownOpts
-		if err := remapIDs(nil, idMappings, chownOpts, hdr); err != nil {
-			return err
-		}
+			if chownOpts != nil {
+				chownOpts = &idtools.IDPair{UID: hdr.Uid, GID: hdr.Gid}
+			}
 
-		if whiteoutConverter != nil {
-			writeFile, err := whiteoutConverter.ConvertRead(hdr, path)
-			if err != nil {
+			if err := createTarFile(path, dest, hdr, trBuf, doChown, chownOpts, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, options.Sparse, options.XattrPolicy, buffer); err != nil {
 				return err
 			}
-			if !writeFile {
-				continue
-			}
-		}
-
-		if chownOpts != nil {
-			chownOpts = &idtools.IDPair{UID: hdr.Uid, GID: hdr.Gid}
-		}
 
-		if err = createTarFile(path, dest, hdr, trBuf, doChown, chownOpts, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, buffer); err != nil {
+			// Directory mtimes must be handled at the end to avoid further
+			// file creation in them to modify the directory mtime
+			if hdr.Typeflag == tar.TypeDir {
+				dirs = append(dirs, hdr)
+			}
+			return nil
+		}()
+		if err != nil {
 			return err
 		}
-
-		// Directory mtimes must be handled at the end to avoid further
-		// file creation in them to modify the directory mtime
-		if hdr.Typeflag == tar.TypeDir {
-			dirs = append(dirs, hdr)
-		}
 	}
 
 	for _, hdr := range dirs {
-		path := filepath.Join(dest, hdr.Name)
-
-		if err := system.Chtimes(path, hdr.AccessTime, hdr.ModTime); err != nil {
+		path, release, err := resolveUnderRoot(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		err = system.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+		release()
+		if err != nil {
 			return err
 		}
 	}
@@ -1105,7 +1266,7 @@ loop:
 // Untar reads a stream of bytes from `archive`, parses it as a tar archive,
 // and unpacks it into the directory at `dest`.
 // The archive may be compressed with one of the following algorithms:
-//  identity (uncompressed), gzip, bzip2, xz.
+//  identity (uncompressed), gzip, bzip2, xz, zstd.
 // FIXME: specify behavior when target path exists vs. doesn't exist.
 func Untar(tarArchive io.Reader, dest string, options *TarOptions) error {
 	return untarHandler(tarArchive, dest, options, true)
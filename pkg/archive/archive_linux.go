@@ -2,6 +2,7 @@ package archive
 
 import (
 	"archive/tar"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -189,3 +191,104 @@ func GetFileOwner(path string) (uint32, uint32, uint32, error) {
 	}
 	return 0, 0, uint32(f.Mode()), nil
 }
+
+// ConvertWhiteouts converts the whiteouts in the directory tree rooted at dir,
+// which holds the contents of a layer, from one format to another.  Overlay
+// whiteouts are 0/0 character devices and directories with the "opaque"
+// extended attribute set, while AUFS whiteouts are empty files whose names
+// begin with WhiteoutPrefix, and WhiteoutOpaqueDir files.
+func ConvertWhiteouts(dir string, from, to WhiteoutFormat) error {
+	if from == to {
+		return nil
+	}
+	opaque := getOverlayOpaqueXattrName()
+	// Find everything that we need to change before we change anything,
+	// so that we don't have to worry about modifying directories while
+	// we're walking them.
+	var whiteouts, opaqueDirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch from {
+		case OverlayWhiteoutFormat:
+			if info.Mode()&os.ModeCharDevice != 0 && isWhiteOut(info) {
+				whiteouts = append(whiteouts, path)
+			} else if info.IsDir() {
+				value, err := system.Lgetxattr(path, opaque)
+				if err != nil && !errors.Is(err, unix.EOPNOTSUPP) {
+					return err
+				}
+				if len(value) == 1 && value[0] == 'y' {
+					opaqueDirs = append(opaqueDirs, path)
+				}
+			}
+		case AUFSWhiteoutFormat:
+			base := filepath.Base(path)
+			if base == WhiteoutOpaqueDir {
+				opaqueDirs = append(opaqueDirs, filepath.Dir(path))
+			} else if strings.HasPrefix(base, WhiteoutPrefix) && !strings.HasPrefix(base, WhiteoutMetaPrefix) {
+				whiteouts = append(whiteouts, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range whiteouts {
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return &os.PathError{Op: "lstat", Path: path, Err: err}
+		}
+		dir, base := filepath.Split(path)
+		if from == OverlayWhiteoutFormat {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			newPath := filepath.Join(dir, WhiteoutPrefix+base)
+			if err := ioutil.WriteFile(newPath, nil, 0600); err != nil {
+				return err
+			}
+			if err := idtools.SafeLchown(newPath, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+			continue
+		}
+		newPath := filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(newPath); err == nil {
+			// The item was recreated in this layer after it was
+			// removed, so the whiteout didn't hide anything.
+			continue
+		}
+		if err := unix.Mknod(newPath, unix.S_IFCHR, 0); err != nil {
+			return &os.PathError{Op: "mknod", Path: newPath, Err: err}
+		}
+		if err := idtools.SafeLchown(newPath, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range opaqueDirs {
+		if from == OverlayWhiteoutFormat {
+			if err := unix.Lremovexattr(path, opaque); err != nil {
+				return &os.PathError{Op: "lremovexattr", Path: path, Err: err}
+			}
+			if err := ioutil.WriteFile(filepath.Join(path, WhiteoutOpaqueDir), nil, 0600); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(filepath.Join(path, WhiteoutOpaqueDir)); err != nil {
+			return err
+		}
+		if err := system.Lsetxattr(path, opaque, []byte{'y'}, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
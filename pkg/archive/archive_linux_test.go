@@ -2,14 +2,17 @@ package archive
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"testing"
 
 	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sys/unix"
 )
@@ -216,3 +219,398 @@ func TestNestedOverlayWhiteouts(t *testing.T) {
 	require.NoError(t, err)
 	checkFileMode(t, filepath.Join(dst, "foo"), os.ModeDevice|os.ModeCharDevice)
 }
+
+// allocatedSize returns the number of bytes which are allocated to a file.
+func allocatedSize(t *testing.T, path string) int64 {
+	var st unix.Stat_t
+	require.NoError(t, unix.Stat(path, &st))
+	return st.Blocks * 512
+}
+
+func TestTarUntarSparse(t *testing.T) {
+	const size = 4 << 20
+	data := bytes.Repeat([]byte("data"), 1024)
+
+	src, err := ioutil.TempDir("", "storage-archive-sparse-src")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	f, err := os.Create(filepath.Join(src, "sparse"))
+	require.NoError(t, err)
+	_, err = f.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(size))
+	require.NoError(t, f.Close())
+	if allocatedSize(t, filepath.Join(src, "sparse")) >= size {
+		t.Skip("filesystem doesn't support sparse files")
+	}
+	err = ioutil.WriteFile(filepath.Join(src, "dense"), data, 0644)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile(filepath.Join(src, "sparse"))
+	require.NoError(t, err)
+
+	rc, err := TarWithOptions(src, &TarOptions{Sparse: true})
+	require.NoError(t, err)
+	archive, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Less(t, len(archive), 64<<10, "holes should not have been stored in the archive")
+
+	// The standard library's reader should see the entries with their
+	// original names and contents.
+	tr := tar.NewReader(bytes.NewReader(archive))
+	contents := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		contents[hdr.Name], err = ioutil.ReadAll(tr)
+		require.NoError(t, err)
+	}
+	require.Equal(t, expected, contents["sparse"])
+	require.Equal(t, data, contents["dense"])
+
+	dest, err := ioutil.TempDir("", "storage-archive-sparse-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Untar(bytes.NewReader(archive), dest, &TarOptions{Sparse: true})
+	require.NoError(t, err)
+	actual, err := ioutil.ReadFile(filepath.Join(dest, "sparse"))
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.Less(t, allocatedSize(t, filepath.Join(dest, "sparse")), int64(size))
+	actual, err = ioutil.ReadFile(filepath.Join(dest, "dense"))
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+}
+
+func TestUntarSparseZeroes(t *testing.T) {
+	const size = 1<<20 + 100
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "zeroes", Mode: 0644, Size: size})
+	require.NoError(t, err)
+	_, err = tw.Write(make([]byte, size))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	dest, err := ioutil.TempDir("", "storage-archive-sparse-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	err = Untar(&buf, dest, &TarOptions{Sparse: true})
+	require.NoError(t, err)
+	fi, err := os.Stat(filepath.Join(dest, "zeroes"))
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+	require.Less(t, allocatedSize(t, filepath.Join(dest, "zeroes")), int64(size))
+}
+
+func TestUntarAbsoluteSymlinkInPath(t *testing.T) {
+	for untarFn, untar := range testUntarFns {
+		tmpdir, err := ioutil.TempDir("", "storage-archive-absolute-symlink")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmpdir)
+		dest := filepath.Join(tmpdir, "dest")
+		require.NoError(t, os.Mkdir(dest, 0755))
+		victim := filepath.Join(tmpdir, "victim")
+		require.NoError(t, os.Mkdir(victim, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(victim, "hello"), []byte("hello"), 0644))
+
+		// Without a chroot, the absolute symlink would point to the
+		// victim directory.  It should be treated as if dest were the
+		// root directory.
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "absolute", Linkname: victim}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "absolute/file", Mode: 0644, Size: 4}))
+		_, err = tw.Write([]byte("file"))
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "absolute/.wh.hello", Mode: 0644}))
+		require.NoError(t, tw.Close())
+		require.NoError(t, untar(dest, &buf), untarFn)
+
+		names, err := ioutil.ReadDir(victim)
+		require.NoError(t, err)
+		require.Len(t, names, 1, untarFn)
+		require.Equal(t, "hello", names[0].Name(), untarFn)
+		data, err := ioutil.ReadFile(filepath.Join(dest, victim, "file"))
+		require.NoError(t, err, untarFn)
+		require.Equal(t, "file", string(data), untarFn)
+
+		// A hard link to a file in the victim directory should not be
+		// created.
+		buf.Reset()
+		tw = tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "absolute/hello"}))
+		require.NoError(t, tw.Close())
+		require.Error(t, untar(dest, &buf), untarFn)
+		_, err = os.Lstat(filepath.Join(dest, "hardlink"))
+		require.True(t, os.IsNotExist(err), untarFn)
+	}
+}
+
+func TestCreateUnderRootPinsParent(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "storage-archive-create-under-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	dest := filepath.Join(tmpdir, "dest")
+	victim := filepath.Join(tmpdir, "victim")
+	require.NoError(t, os.Mkdir(dest, 0755))
+	require.NoError(t, os.Mkdir(victim, 0755))
+
+	path, release, err := createUnderRoot(dest, "a/b/file", 0755, nil)
+	require.NoError(t, err)
+	defer release()
+	info, err := os.Stat(filepath.Join(dest, "a", "b"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+	if atomic.LoadInt32(&skipOpenat2) != 0 || !canUseProcSelfFD() {
+		t.Skip("openat2 or /proc/self/fd isn't available")
+	}
+
+	// Replacing a directory with a symbolic link after it was checked
+	// doesn't change where the file is created.
+	require.NoError(t, os.Rename(filepath.Join(dest, "a", "b"), filepath.Join(dest, "moved")))
+	require.NoError(t, os.Symlink(victim, filepath.Join(dest, "a", "b")))
+	require.NoError(t, ioutil.WriteFile(path, []byte("file"), 0644))
+	_, err = os.Stat(filepath.Join(victim, "file"))
+	require.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(dest, "moved", "file"))
+	require.NoError(t, err)
+	require.Equal(t, "file", string(data))
+}
+
+func TestTarUntarXattrPolicy(t *testing.T) {
+	src, err := ioutil.TempDir("", "storage-archive-xattrs-src")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	file := filepath.Join(src, "file")
+	require.NoError(t, ioutil.WriteFile(file, []byte("content"), 0644))
+	if err := system.Lsetxattr(file, "user.keep", []byte("1"), 0); err != nil {
+		t.Skipf("filesystem doesn't support user xattrs: %v", err)
+	}
+	require.NoError(t, system.Lsetxattr(file, "user.drop", []byte("2"), 0))
+	require.NoError(t, system.Lsetxattr(file, "user.unpack", []byte("3"), 0))
+
+	rc, err := TarWithOptions(src, &TarOptions{XattrPolicy: &XattrPolicy{Exclude: []string{"user.drop"}}})
+	require.NoError(t, err)
+	archive, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	hdr, err := tar.NewReader(bytes.NewReader(archive)).Next()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"user.keep": "1", "user.unpack": "3"}, hdr.Xattrs)
+
+	dest, err := ioutil.TempDir("", "storage-archive-xattrs-dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Untar(bytes.NewReader(archive), dest, &TarOptions{XattrPolicy: &XattrPolicy{Include: []string{"user.unpack"}}})
+	require.NoError(t, err)
+	value, err := system.Lgetxattr(filepath.Join(dest, "file"), "user.unpack")
+	require.NoError(t, err)
+	require.Equal(t, "3", string(value))
+	value, err = system.Lgetxattr(filepath.Join(dest, "file"), "user.keep")
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestConvertWhiteouts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating whiteout devices requires root")
+	}
+	dir, err := ioutil.TempDir("", "storage-archive-convert-whiteouts")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opaque := getOverlayOpaqueXattrName()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "d"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "d", WhiteoutOpaqueDir), nil, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, WhiteoutPrefix+"gone"), nil, 0600))
+	require.NoError(t, os.Lchown(filepath.Join(dir, WhiteoutPrefix+"gone"), 1, 2))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kept"), []byte("kept"), 0644))
+
+	err = ConvertWhiteouts(dir, AUFSWhiteoutFormat, OverlayWhiteoutFormat)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("filesystem doesn't support overlay xattrs: %v", err)
+	}
+	require.NoError(t, err)
+	checkFileMode(t, filepath.Join(dir, "gone"), os.ModeDevice|os.ModeCharDevice)
+	_, err = os.Lstat(filepath.Join(dir, WhiteoutPrefix+"gone"))
+	require.True(t, os.IsNotExist(err))
+	var st unix.Stat_t
+	require.NoError(t, unix.Lstat(filepath.Join(dir, "gone"), &st))
+	require.Equal(t, uint32(1), st.Uid)
+	require.Equal(t, uint32(2), st.Gid)
+	_, err = os.Lstat(filepath.Join(dir, "d", WhiteoutOpaqueDir))
+	require.True(t, os.IsNotExist(err))
+	value, err := system.Lgetxattr(filepath.Join(dir, "d"), opaque)
+	require.NoError(t, err)
+	require.Equal(t, "y", string(value))
+
+	err = ConvertWhiteouts(dir, OverlayWhiteoutFormat, AUFSWhiteoutFormat)
+	require.NoError(t, err)
+	fi, err := os.Lstat(filepath.Join(dir, WhiteoutPrefix+"gone"))
+	require.NoError(t, err)
+	require.True(t, fi.Mode().IsRegular())
+	_, err = os.Lstat(filepath.Join(dir, "gone"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(dir, "d", WhiteoutOpaqueDir))
+	require.NoError(t, err)
+	value, err = system.Lgetxattr(filepath.Join(dir, "d"), opaque)
+	require.NoError(t, err)
+	require.Nil(t, value)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "kept"))
+	require.NoError(t, err)
+	require.Equal(t, "kept", string(content))
+}
+
+func TestOverriddenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-archive-override")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mask := os.FileMode(0700)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 04755, Uid: os.Getuid(), Gid: os.Getgid()}))
+	require.NoError(t, tw.Close())
+	err = Untar(&buf, dir, &TarOptions{ForceMask: &mask})
+	if err != nil && errors.Is(err, unix.ENOTSUP) {
+		t.Skipf("filesystem doesn't support user xattrs: %v", err)
+	}
+	require.NoError(t, err)
+
+	files, err := ListOverriddenFiles(dir)
+	require.NoError(t, err)
+	var file *OverriddenFile
+	for i := range files {
+		if files[i].Path == "file" {
+			file = &files[i]
+		}
+	}
+	require.NotNil(t, file)
+	require.Equal(t, os.FileMode(0700), file.Effective.Mode)
+	require.Equal(t, os.ModeSetuid|0755, file.Original.Mode)
+	require.Equal(t, os.Getuid(), file.Original.UID)
+
+	require.NoError(t, RestoreOverriddenFiles(dir))
+	fi, err := os.Stat(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSetuid|0755, fi.Mode()&(os.ModePerm|os.ModeSetuid))
+	stat, err := GetOverrideStat(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	require.Nil(t, stat)
+}
+
+func TestOverlayChanges(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storage-overlay-changes-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	lower2 := filepath.Join(tmp, "lower2")
+	lower1 := filepath.Join(tmp, "lower1")
+	upper := filepath.Join(tmp, "upper")
+
+	mkdir := func(path string, opaque bool) {
+		require.NoError(t, os.MkdirAll(path, 0755))
+		if opaque {
+			require.NoError(t, system.Lsetxattr(path, getOverlayOpaqueXattrName(), []byte("y"), 0))
+		}
+	}
+	file := func(path string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(path), 0644))
+	}
+	whiteout := func(path string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, system.Mknod(path, unix.S_IFCHR, 0))
+	}
+
+	// The bottom layer.
+	file(filepath.Join(lower2, "a", "file1"))
+	file(filepath.Join(lower2, "a", "file2"))
+	file(filepath.Join(lower2, "a", "meta"))
+	file(filepath.Join(lower2, "b", "x"))
+	mkdir(filepath.Join(lower2, "c"), false)
+	file(filepath.Join(lower2, "d", "y"))
+	// The layer above it removes a file and replaces a directory.
+	whiteout(filepath.Join(lower1, "a", "file2"))
+	mkdir(filepath.Join(lower1, "d"), true)
+	file(filepath.Join(lower1, "d", "z"))
+	// The upper layer.
+	file(filepath.Join(upper, "a", "file1"))
+	file(filepath.Join(upper, "a", "file2"))
+	whiteout(filepath.Join(upper, "b"))
+	mkdir(filepath.Join(upper, "c"), true)
+	file(filepath.Join(upper, "c", "n"))
+	file(filepath.Join(upper, "d", "y"))
+	file(filepath.Join(upper, "d", "z"))
+	file(filepath.Join(upper, "e", "new"))
+
+	// A metadata-only copy of a file which matches the lower file isn't a
+	// change.
+	meta := filepath.Join(upper, "a", "meta")
+	require.NoError(t, ioutil.WriteFile(meta, nil, 0644))
+	if err := system.Lsetxattr(meta, GetOverlayXattrName("metacopy"), nil, 0); err != nil {
+		t.Skipf("unable to set metacopy attribute: %v", err)
+	}
+	require.NoError(t, os.Truncate(meta, int64(len(filepath.Join(lower2, "a", "meta")))))
+	lowerMeta, err := os.Stat(filepath.Join(lower2, "a", "meta"))
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(meta, lowerMeta.ModTime(), lowerMeta.ModTime()))
+
+	changes, err := OverlayChanges([]string{lower1, lower2}, upper)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Path: "/a", Kind: ChangeModify},
+		{Path: "/a/file1", Kind: ChangeModify},
+		{Path: "/a/file2", Kind: ChangeAdd},
+		{Path: "/b", Kind: ChangeDelete},
+		{Path: "/c", Kind: ChangeDelete},
+		{Path: "/c/n", Kind: ChangeAdd},
+		{Path: "/d", Kind: ChangeModify},
+		{Path: "/d/y", Kind: ChangeAdd},
+		{Path: "/d/z", Kind: ChangeModify},
+		{Path: "/e", Kind: ChangeAdd},
+		{Path: "/e/new", Kind: ChangeAdd},
+	}, changes)
+
+	// Unless its extended attributes were changed.
+	if err := system.Lsetxattr(meta, "user.test", []byte("changed"), 0); err != nil {
+		t.Skipf("unable to set user xattr: %v", err)
+	}
+	require.NoError(t, os.Chtimes(meta, lowerMeta.ModTime(), lowerMeta.ModTime()))
+	changes, err = OverlayChanges([]string{lower1, lower2}, upper)
+	require.NoError(t, err)
+	require.Contains(t, changes, Change{Path: "/a/meta", Kind: ChangeModify})
+}
+
+func TestSpliceFile(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 300*1024)
+	f, err := ioutil.TempFile("", "splice")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(contents)
+	require.NoError(t, err)
+
+	reader, writer, spliceTo := newExportPipe()
+	require.NotNil(t, spliceTo)
+	defer reader.Close()
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		received <- data
+	}()
+
+	// Ask for more than the file holds, as if it had shrunk.
+	n, err := spliceFile(spliceTo, f, int64(len(contents)+10))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(contents)), n)
+	require.NoError(t, writer.Close())
+	require.True(t, bytes.Equal(contents, <-received))
+}
@@ -2,6 +2,11 @@
 
 package archive
 
+import (
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+)
+
 func GetWhiteoutConverter(format WhiteoutFormat, data interface{}) TarWhiteoutConverter {
 	return nil
 }
@@ -9,3 +14,13 @@ func GetWhiteoutConverter(format WhiteoutFormat, data interface{}) TarWhiteoutCo
 func GetFileOwner(path string) (uint32, uint32, uint32, error) {
 	return 0, 0, 0, nil
 }
+
+// ConvertWhiteouts converts the whiteouts in the directory tree rooted at dir
+// from one format to another.  Only the AUFS format is supported on this
+// platform, so no conversion is ever possible.
+func ConvertWhiteouts(dir string, from, to WhiteoutFormat) error {
+	if from == to {
+		return nil
+	}
+	return errors.Wrap(system.ErrNotSupportedPlatform, "converting whiteouts")
+}
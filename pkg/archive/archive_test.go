@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/stretchr/testify/assert"
@@ -845,7 +846,7 @@ func TestTypeXGlobalHeaderDoesNotFail(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpDir)
 	buffer := make([]byte, 1<<20)
-	err = createTarFile(filepath.Join(tmpDir, "pax_global_header"), tmpDir, &hdr, nil, true, nil, false, false, nil, buffer)
+	err = createTarFile(filepath.Join(tmpDir, "pax_global_header"), tmpDir, &hdr, nil, true, nil, false, false, nil, false, nil, buffer)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1339,3 +1340,179 @@ func readFileFromArchive(t *testing.T, archive io.ReadCloser, name string, expec
 	assert.NoError(t, err)
 	return string(content)
 }
+
+func TestCompressStreamZstd(t *testing.T) {
+	for _, options := range []*CompressionOptions{nil, {Level: 19, Concurrency: 2}} {
+		var compressed bytes.Buffer
+		w, err := CompressStreamWithOptions(&compressed, Zstd, options)
+		if err != nil {
+			t.Fatalf("Failed to create a zstd compressor: %v", err)
+		}
+		content := bytes.Repeat([]byte("zstd compressed content\n"), 4096)
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("Failed to compress: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to close the compressor: %v", err)
+		}
+		if compression := DetectCompression(compressed.Bytes()); compression != Zstd {
+			t.Fatalf("Expected zstd compressed data, detected %s", (&compression).Extension())
+		}
+		r, err := DecompressStream(&compressed)
+		if err != nil {
+			t.Fatalf("Failed to decompress: %v", err)
+		}
+		decompressed, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Failed to read the decompressed stream: %v", err)
+		}
+		if !bytes.Equal(content, decompressed) {
+			t.Fatalf("Decompressed content doesn't match the original")
+		}
+	}
+}
+
+func TestCompressStreamGzipLevel(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := CompressStreamWithOptions(&compressed, Gzip, &CompressionOptions{Level: 9, Concurrency: 2})
+	if err != nil {
+		t.Fatalf("Failed to create a gzip compressor: %v", err)
+	}
+	if _, err := w.Write([]byte("gzip compressed content")); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the compressor: %v", err)
+	}
+	if compression := DetectCompression(compressed.Bytes()); compression != Gzip {
+		t.Fatalf("Expected gzip compressed data, detected %s", (&compression).Extension())
+	}
+}
+
+func TestTarWithOptionsZstd(t *testing.T) {
+	origin, err := ioutil.TempDir("", "storage-archive-zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(origin)
+	if err := ioutil.WriteFile(filepath.Join(origin, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := ioutil.TempDir("", "storage-archive-zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	rc, err := TarWithOptions(origin, &TarOptions{Compression: Zstd, CompressionOptions: &CompressionOptions{Concurrency: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := Untar(rc, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dest, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Fatalf("Expected %q, got %q", "content", content)
+	}
+}
+
+func TestTarWithOptionsReproducible(t *testing.T) {
+	origin, err := ioutil.TempDir("", "storage-archive-reproducible")
+	require.NoError(t, err)
+	defer os.RemoveAll(origin)
+	require.NoError(t, os.Mkdir(filepath.Join(origin, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, "dir", "file"), []byte("content"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(origin, "file"), []byte("content"), 0644))
+
+	epoch := time.Unix(1000000000, 0)
+	tarBytes := func(mtime time.Time) []byte {
+		for _, name := range []string{"dir/file", "file", "dir"} {
+			require.NoError(t, os.Chtimes(filepath.Join(origin, name), mtime, mtime))
+		}
+		rc, err := TarWithOptions(origin, &TarOptions{IncludeFiles: []string{"file", "dir"}, Reproducible: true, SourceDateEpoch: &epoch})
+		require.NoError(t, err)
+		defer rc.Close()
+		b, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return b
+	}
+	first := tarBytes(time.Now())
+	second := tarBytes(time.Now().Add(time.Hour))
+	require.Equal(t, first, second)
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		assert.Equal(t, epoch, hdr.ModTime)
+		assert.True(t, hdr.AccessTime.IsZero())
+		assert.Empty(t, hdr.Uname)
+	}
+	assert.Equal(t, []string{"dir/", "dir/file", "file"}, names)
+
+	// Older timestamps are left alone.
+	old := time.Unix(500000000, 0)
+	third := tarBytes(old)
+	hdr, err := tar.NewReader(bytes.NewReader(third)).Next()
+	require.NoError(t, err)
+	assert.Equal(t, old, hdr.ModTime)
+}
+
+func TestReproducibleTarStream(t *testing.T) {
+	archive := func(mtime time.Time, uname string) io.ReadCloser {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Size: 7, ModTime: mtime, AccessTime: mtime, Uname: uname, Format: tar.FormatPAX}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte("content"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		return ioutil.NopCloser(&buf)
+	}
+	first, err := ioutil.ReadAll(ReproducibleTarStream(archive(time.Now(), "root"), nil))
+	require.NoError(t, err)
+	second, err := ioutil.ReadAll(ReproducibleTarStream(archive(time.Now().Add(time.Minute), "nobody"), nil))
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+
+	tr := tar.NewReader(bytes.NewReader(first))
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(0, 0), hdr.ModTime)
+	content, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(content))
+}
+
+func TestXattrPolicyAllows(t *testing.T) {
+	policy := &XattrPolicy{Include: []string{"user.", "security.capability"}, Exclude: []string{"user.secret"}}
+	assert.True(t, policy.Allows("user.foo"))
+	assert.True(t, policy.Allows("security.capability"))
+	assert.False(t, policy.Allows("security.ima"))
+	assert.False(t, policy.Allows("user.secret"))
+	assert.False(t, policy.Allows("trusted.overlay.opaque"))
+	assert.False(t, policy.Allows(xattrPOSIXACLAccess))
+	policy.ACLs = true
+	assert.True(t, policy.Allows(xattrPOSIXACLAccess))
+
+	policy = &XattrPolicy{Exclude: []string{"trusted."}}
+	assert.True(t, policy.Allows("security.selinux"))
+	assert.False(t, policy.Allows("trusted.overlay.opaque"))
+
+	assert.False(t, DefaultXattrPolicy(false, false).Allows("trusted.foo"))
+	assert.True(t, DefaultXattrPolicy(false, false).Allows("user.foo"))
+	assert.False(t, DefaultXattrPolicy(true, false).Allows("security.selinux"))
+	assert.True(t, DefaultXattrPolicy(true, false).Allows("trusted.foo"))
+	assert.False(t, DefaultXattrPolicy(true, true).Allows("trusted.foo"))
+}
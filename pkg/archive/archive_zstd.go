@@ -36,6 +36,13 @@ func zstdReader(buf io.Reader) (io.ReadCloser, error) {
 	return &wrapperZstdDecoder{decoder: decoder}, err
 }
 
-func zstdWriter(dest io.Writer) (io.WriteCloser, error) {
-	return zstd.NewWriter(dest)
+func zstdWriter(dest io.Writer, options *CompressionOptions) (io.WriteCloser, error) {
+	var opts []zstd.EOption
+	if options.Level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.Level)))
+	}
+	if options.Concurrency > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(options.Concurrency))
+	}
+	return zstd.NewWriter(dest, opts...)
 }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"syscall"
@@ -418,6 +419,111 @@ func ChangesDirs(newDir string, newMappings *idtools.IDMappings, oldDir string,
 	return newRoot.Changes(oldRoot), nil
 }
 
+// ChangesPaths is like ChangesDirs, but instead of walking both directories,
+// it only examines the listed paths and the directories which contain them.
+// It's meant to be used with a record of the paths in newDir which might have
+// been modified, which was kept while they were being modified.  Any listed
+// path which is a directory in newDir, but not in oldDir, is examined in its
+// entirety, as are any directories which are listed in subtrees, which
+// should include directories which were created or moved into place.
+// If oldDir is "", then all of the examined files in newDir will be
+// Add-Changes.
+func ChangesPaths(newDir string, newMappings *idtools.IDMappings, oldDir string, oldMappings *idtools.IDMappings, paths, subtrees []string) ([]Change, error) {
+	oldRoot, newRoot := newRootFileInfo(oldMappings), newRootFileInfo(newMappings)
+	whole := make(map[string]bool, len(subtrees))
+	for _, subtree := range subtrees {
+		whole[filepath.Join(string(os.PathSeparator), subtree)] = true
+	}
+	examine := func(root *FileInfo, dir, path string) (*FileInfo, error) {
+		if dir == "" {
+			return nil, nil
+		}
+		return addPathFileInfo(root, dir, path)
+	}
+	for _, list := range [][]string{paths, subtrees} {
+		for _, path := range list {
+			// As this runs on the daemon side, file paths are OS specific.
+			path = filepath.Join(string(os.PathSeparator), path)
+			if path == string(os.PathSeparator) {
+				continue
+			}
+			oldInfo, err := examine(oldRoot, oldDir, path)
+			if err != nil {
+				return nil, err
+			}
+			newInfo, err := examine(newRoot, newDir, path)
+			if err != nil {
+				return nil, err
+			}
+			if newInfo == nil || !newInfo.isDir() {
+				continue
+			}
+			if whole[path] || oldInfo == nil || !oldInfo.isDir() {
+				if err := addSubtreeFileInfo(newRoot, newDir, path); err != nil {
+					return nil, err
+				}
+			}
+			if whole[path] && oldInfo != nil && oldInfo.isDir() {
+				if err := addSubtreeFileInfo(oldRoot, oldDir, path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return newRoot.Changes(oldRoot), nil
+}
+
+// addPathFileInfo adds a path under dir, and the directories which lead to
+// it, to the tree rooted at root, if they aren't already in it.  It returns
+// the path's entry, or nil if it doesn't exist.
+func addPathFileInfo(root *FileInfo, dir, path string) (*FileInfo, error) {
+	info := root
+	for _, elem := range strings.Split(path, string(os.PathSeparator)) {
+		if elem == "" {
+			continue
+		}
+		if child := info.children[elem]; child != nil {
+			info = child
+			continue
+		}
+		if !info.isDir() {
+			return nil, nil
+		}
+		cpath := filepath.Join(info.path(), elem)
+		fi, err := os.Lstat(filepath.Join(dir, cpath))
+		if err != nil {
+			if os.IsNotExist(err) || isENOTDIR(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if err := walkchunk(cpath, fi, dir, root); err != nil {
+			return nil, err
+		}
+		info = info.children[elem]
+	}
+	return info, nil
+}
+
+// addSubtreeFileInfo adds everything below a directory under dir to the tree
+// rooted at root, which must already include the directory.
+func addSubtreeFileInfo(root *FileInfo, dir, path string) error {
+	return filepath.Walk(filepath.Join(dir, path), func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.Join(string(os.PathSeparator), rel)
+		if root.LookUp(rel) != nil {
+			return nil
+		}
+		return walkchunk(rel, fi, dir, root)
+	})
+}
+
 // ChangesSize calculates the size in bytes of the provided changes, based on newDir.
 func ChangesSize(newDir string, changes []Change) int64 {
 	var (
@@ -449,22 +555,83 @@ func ChangesSize(newDir string, changes []Change) int64 {
 	return size
 }
 
+// preparedChange is the result of examining a changed file before it's added
+// to an archive.
+type preparedChange struct {
+	entry *tarFileEntry
+	err   error
+}
+
+// prepareChanges examines the files which were added or modified, using
+// several goroutines, so that the files' headers are ready by the time that
+// they're needed.  The results for each change are delivered through the
+// corresponding channel in the returned slice.  Deleted files don't need to be
+// examined, so their channels are closed.  To keep them from getting too far
+// ahead, the goroutines wait for a slot in window before starting on a file,
+// and the caller should free the slot after receiving that file's result.
+func (ta *tarAppender) prepareChanges(dir string, changes []Change, window chan struct{}) []chan preparedChange {
+	results := make([]chan preparedChange, len(changes))
+	for i := range results {
+		results[i] = make(chan preparedChange, 1)
+	}
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i, change := range changes {
+			if change.Kind == ChangeDelete {
+				close(results[i])
+				continue
+			}
+			window <- struct{}{}
+			indexes <- i
+		}
+	}()
+	workers := runtime.NumCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range indexes {
+				path := filepath.Join(dir, changes[i].Path)
+				entry, err := ta.prepareTarFile(path, changes[i].Path[1:])
+				results[i] <- preparedChange{entry: entry, err: err}
+			}
+		}()
+	}
+	return results
+}
+
 // ExportChanges produces an Archive from the provided changes, relative to dir.
 func ExportChanges(dir string, changes []Change, uidMaps, gidMaps []idtools.IDMap) (io.ReadCloser, error) {
-	reader, writer := io.Pipe()
+	return exportChanges(dir, changes, uidMaps, gidMaps, false)
+}
+
+// ExportSparseChanges is like ExportChanges, but regular files which have
+// holes in them are stored as sparse entries.
+func ExportSparseChanges(dir string, changes []Change, uidMaps, gidMaps []idtools.IDMap) (io.ReadCloser, error) {
+	return exportChanges(dir, changes, uidMaps, gidMaps, true)
+}
+
+func exportChanges(dir string, changes []Change, uidMaps, gidMaps []idtools.IDMap, sparse bool) (io.ReadCloser, error) {
+	reader, writer, spliceTo := newExportPipe()
 	go func() {
 		ta := newTarAppender(idtools.NewIDMappingsFromMaps(uidMaps, gidMaps), writer, nil)
+		ta.SpliceTo = spliceTo
+		ta.Sparse = sparse
 
 		// this buffer is needed for the duration of this piped stream
 		defer pools.BufioWriter32KPool.Put(ta.Buffer)
 
 		sort.Sort(changesByPath(changes))
+		window := make(chan struct{}, 64*runtime.NumCPU())
+		prepared := ta.prepareChanges(dir, changes, window)
 
 		// In general we log errors here but ignore them because
 		// during e.g. a diff operation the container can continue
 		// mutating the filesystem and we can see transient errors
 		// from this
-		for _, change := range changes {
+		for i, change := range changes {
 			if change.Kind == ChangeDelete {
 				whiteOutDir := filepath.Dir(change.Path)
 				whiteOutBase := filepath.Base(change.Path)
@@ -481,9 +648,13 @@ func ExportChanges(dir string, changes []Change, uidMaps, gidMaps []idtools.IDMa
 					logrus.Debugf("Can't write whiteout header: %s", err)
 				}
 			} else {
-				path := filepath.Join(dir, change.Path)
-				if err := ta.addTarFile(path, change.Path[1:]); err != nil {
-					logrus.Debugf("Can't add file %s to tar: %s", path, err)
+				result := <-prepared[i]
+				<-window
+				if result.err == nil && result.entry != nil {
+					result.err = ta.writeTarFile(result.entry)
+				}
+				if result.err != nil {
+					logrus.Debugf("Can't add file %s to tar: %s", filepath.Join(dir, change.Path), result.err)
 				}
 			}
 		}
@@ -313,89 +313,247 @@ func parseDirent(buf []byte, names []nameIno) (consumed int, newnames []nameIno)
 }
 
 // OverlayChanges walks the path rw and determines changes for the files in the path,
-// with respect to the parent layers
+// with respect to the parent layers.  The layers are listed with the topmost
+// layer first, as they are in an overlay mount's list of lower directories.
+//
+// Only rw is walked.  The lower layers are only consulted for the paths which
+// appear in rw, and only the layers whose contents can still be seen through
+// the directories above a path are searched for it.
 func OverlayChanges(layers []string, rw string) ([]Change, error) {
-	dc := func(root, path string, fi os.FileInfo) (string, error) {
-		return overlayDeletedFile(layers, root, path, fi)
+	w := overlayChangesWalker{
+		rw:          rw,
+		changedDirs: make(map[string]struct{}),
+		opaque:      getOverlayOpaqueXattrName(),
+		metacopy:    GetOverlayXattrName("metacopy"),
 	}
-	return changes(layers, rw, dc, nil, overlayLowerContainsWhiteout)
+	if err := w.walk(string(os.PathSeparator), layers); err != nil {
+		return nil, err
+	}
+	return w.changes, nil
 }
 
-func overlayLowerContainsWhiteout(root, path string) (bool, error) {
-	// Whiteout for a file or directory has the same name, but is for a character
-	// device with major/minor of 0/0.
-	stat, err := os.Stat(filepath.Join(root, path))
-	if err != nil && !os.IsNotExist(err) && !isENOTDIR(err) {
-		// Not sure what happened here.
-		return false, err
+type overlayChangesWalker struct {
+	rw               string
+	changes          []Change
+	changedDirs      map[string]struct{}
+	opaque, metacopy string
+}
+
+// walk records the changes for the contents of the directory dir in the
+// upper layer.  lowers is the list of lower layers in which the contents of
+// the directory could be found, topmost first.
+func (w *overlayChangesWalker) walk(dir string, lowers []string) error {
+	names, err := readdirnames(filepath.Join(w.rw, dir))
+	if err != nil {
+		return err
 	}
-	if err == nil && stat.Mode()&os.ModeCharDevice != 0 {
-		if isWhiteOut(stat) {
-			return true, nil
+	for _, name := range names {
+		path := filepath.Join(dir, name.name)
+		fi, err := os.Lstat(filepath.Join(w.rw, path))
+		if err != nil {
+			return err
+		}
+		change := Change{
+			Path: path,
+			Kind: ChangeAdd,
+		}
+		record := true
+		var dirLowers []string
+
+		if fi.Mode()&os.ModeCharDevice != 0 && isWhiteOut(fi) {
+			// A file or directory with this name is removed by this layer.
+			change.Kind = ChangeDelete
+		} else {
+			lower, lowerPath, err := overlayLowerLookup(lowers, path)
+			if err != nil {
+				return err
+			}
+			opaque := false
+			if fi.IsDir() {
+				if opaque, err = w.isOpaque(filepath.Join(w.rw, path)); err != nil {
+					return err
+				}
+				if !opaque {
+					if dirLowers, err = w.lowerDirLayers(lowers, path); err != nil {
+						return err
+					}
+				}
+			}
+			switch {
+			case lower == nil:
+				// It's new in this layer.
+			case opaque:
+				// The directory was removed and then recreated in this layer.
+				change.Kind = ChangeDelete
+			case fi.IsDir() && lower.IsDir():
+				// If you modify /foo/bar/baz, then /foo will be part of the
+				// upper layer only because it's the parent of bar.
+				if fi.Size() == lower.Size() && fi.Mode() == lower.Mode() && sameFsTime(fi.ModTime(), lower.ModTime()) {
+					record = false
+				}
+				change.Kind = ChangeModify
+			default:
+				change.Kind = ChangeModify
+				if fi.Mode().IsRegular() && lower.Mode().IsRegular() {
+					unchanged, err := w.unchangedMetacopy(filepath.Join(w.rw, path), fi, lowerPath, lower)
+					if err != nil {
+						return err
+					}
+					record = !unchanged
+				}
+			}
+		}
+
+		if record {
+			w.add(change, fi.IsDir())
+		}
+		if fi.IsDir() {
+			if err := w.walk(path, dirLowers); err != nil {
+				return err
+			}
 		}
 	}
-	return false, nil
+	return nil
 }
 
-func overlayDeletedFile(layers []string, root, path string, fi os.FileInfo) (string, error) {
-	// If it's a whiteout item, then a file or directory with that name is removed by this layer.
-	if fi.Mode()&os.ModeCharDevice != 0 {
-		if isWhiteOut(fi) {
-			return path, nil
+// add records a change, preceded by changes for any of its parent directories
+// which haven't been recorded yet.
+func (w *overlayChangesWalker) add(change Change, isDir bool) {
+	// If /foo/bar/file.txt is modified, then /foo/bar must be part of the changed files.
+	// This block is here to ensure the change is recorded even if the
+	// modify time, mode and size of the parent directory in the rw and ro layers are all equal.
+	// Check https://github.com/docker/docker/pull/13590 for details.
+	if isDir {
+		w.changedDirs[change.Path] = struct{}{}
+	}
+	if change.Kind == ChangeAdd || change.Kind == ChangeDelete {
+		parent := filepath.Dir(change.Path)
+		tail := []Change{}
+		for parent != "/" {
+			if _, ok := w.changedDirs[parent]; !ok {
+				tail = append([]Change{{Path: parent, Kind: ChangeModify}}, tail...)
+				w.changedDirs[parent] = struct{}{}
+			}
+			parent = filepath.Dir(parent)
 		}
+		w.changes = append(w.changes, tail...)
 	}
-	// After this we only need to pay attention to directories.
-	if !fi.IsDir() {
-		return "", nil
+	w.changes = append(w.changes, change)
+}
+
+func (w *overlayChangesWalker) isOpaque(path string) (bool, error) {
+	opaque, err := system.Lgetxattr(path, w.opaque)
+	if err != nil {
+		return false, err
 	}
-	// If the directory isn't marked as opaque, then it's just a normal directory.
-	opaque, err := system.Lgetxattr(filepath.Join(root, path), getOverlayOpaqueXattrName())
+	return len(opaque) == 1 && opaque[0] == 'y', nil
+}
+
+// lowerDirLayers returns the subset of lowers in which the contents of the
+// directory at path can be seen: the layers which have a directory at path,
+// down to the first one which hides the layers below it, either with a
+// whiteout, a non-directory, or an opaque directory.
+func (w *overlayChangesWalker) lowerDirLayers(lowers []string, path string) ([]string, error) {
+	var dirLowers []string
+	for _, layer := range lowers {
+		stat, err := os.Lstat(filepath.Join(layer, path))
+		if err != nil {
+			if os.IsNotExist(err) || isENOTDIR(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !stat.IsDir() {
+			break
+		}
+		dirLowers = append(dirLowers, layer)
+		opaque, err := w.isOpaque(filepath.Join(layer, path))
+		if err != nil {
+			return nil, err
+		}
+		if opaque {
+			break
+		}
+	}
+	return dirLowers, nil
+}
+
+// unchangedMetacopy checks if the file in the upper layer only holds metadata
+// for a file whose contents are still in a lower layer, and if that metadata
+// is the same as the lower file's, including its extended attributes.  That
+// happens when the metadata is changed and then changed back, and we don't
+// want to report it as a modification.
+func (w *overlayChangesWalker) unchangedMetacopy(path string, fi os.FileInfo, lowerPath string, lower os.FileInfo) (bool, error) {
+	metacopy, err := system.Lgetxattr(path, w.metacopy)
+	if err != nil || metacopy == nil {
+		return false, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	lst, lok := lower.Sys().(*syscall.Stat_t)
+	if !ok || !lok {
+		return false, nil
+	}
+	if fi.Mode() != lower.Mode() || fi.Size() != lower.Size() ||
+		st.Uid != lst.Uid || st.Gid != lst.Gid ||
+		!sameFsTime(fi.ModTime(), lower.ModTime()) {
+		return false, nil
+	}
+	xattrs, err := nonOverlayXattrs(path)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	if len(opaque) != 1 || opaque[0] != 'y' {
-		return "", err
+	lowerXattrs, err := nonOverlayXattrs(lowerPath)
+	if err != nil {
+		return false, err
 	}
-	// If there are no lower layers, then it can't have been deleted and recreated in this layer.
-	if len(layers) == 0 {
-		return "", err
+	if len(xattrs) != len(lowerXattrs) {
+		return false, nil
 	}
-	// At this point, we have a directory that's opaque.  If it appears in one of the lower
-	// layers, then it was newly-created here, so it wasn't also deleted here.
-	for _, layer := range layers {
-		stat, err := os.Stat(filepath.Join(layer, path))
-		if err != nil && !os.IsNotExist(err) && !isENOTDIR(err) {
-			// Not sure what happened here.
-			return "", err
+	for name, value := range xattrs {
+		if lowerValue, ok := lowerXattrs[name]; !ok || !bytes.Equal(value, lowerValue) {
+			return false, nil
 		}
-		if err == nil {
-			if stat.Mode()&os.ModeCharDevice != 0 {
-				if isWhiteOut(stat) {
-					return "", nil
-				}
-			}
-			// It's not whiteout, so it was there in the older layer, so it has to be
-			// marked as deleted in this layer.
-			return path, nil
+	}
+	return true, nil
+}
+
+// nonOverlayXattrs returns the extended attributes of path, other than the
+// ones which overlay uses to keep track of its own state.
+func nonOverlayXattrs(path string) (map[string][]byte, error) {
+	names, err := system.Llistxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") {
+			continue
 		}
-		for dir := filepath.Dir(path); dir != "" && dir != string(os.PathSeparator); dir = filepath.Dir(dir) {
-			// Check for whiteout for a parent directory.
-			stat, err := os.Stat(filepath.Join(layer, dir))
-			if err != nil && !os.IsNotExist(err) && !isENOTDIR(err) {
-				// Not sure what happened here.
-				return "", err
-			}
-			if err == nil {
-				if stat.Mode()&os.ModeCharDevice != 0 {
-					if isWhiteOut(stat) {
-						return "", nil
-					}
-				}
-			}
+		value, err := system.Lgetxattr(path, name)
+		if err != nil {
+			return nil, err
 		}
+		xattrs[name] = value
 	}
+	return xattrs, nil
+}
 
-	// We didn't find the same path in any older layers, so it was new in this one.
-	return "", nil
-
+// overlayLowerLookup returns information about path in the topmost of the
+// layers which has it, and its location there, or nil if none of them do, or
+// a whiteout for it is found first.
+func overlayLowerLookup(layers []string, path string) (os.FileInfo, string, error) {
+	for _, layer := range layers {
+		stat, err := os.Lstat(filepath.Join(layer, path))
+		if err != nil {
+			if os.IsNotExist(err) || isENOTDIR(err) {
+				continue
+			}
+			return nil, "", err
+		}
+		if stat.Mode()&os.ModeCharDevice != 0 && isWhiteOut(stat) {
+			return nil, "", nil
+		}
+		return stat, filepath.Join(layer, path), nil
+	}
+	return nil, "", nil
 }
@@ -97,3 +97,30 @@ func collectFileInfo(sourceDir string, idMappings *idtools.IDMappings) (*FileInf
 	}
 	return root, nil
 }
+
+// walkchunk registers a file, whose parent must already be registered, with
+// the tree rooted at root.
+func walkchunk(path string, fi os.FileInfo, dir string, root *FileInfo) error {
+	if fi == nil {
+		return nil
+	}
+	parent := root.LookUp(filepath.Dir(path))
+	if parent == nil {
+		return fmt.Errorf("walkchunk: Unexpectedly no parent for %s", path)
+	}
+	cpath := filepath.Join(dir, path)
+	s, err := system.Lstat(cpath)
+	if err != nil {
+		return err
+	}
+	info := &FileInfo{
+		name:       filepath.Base(path),
+		children:   make(map[string]*FileInfo),
+		parent:     parent,
+		idMappings: root.idMappings,
+		stat:       s,
+	}
+	info.capability, _ = system.Lgetxattr(cpath, "security.capability")
+	parent.children[info.name] = info
+	return nil
+}
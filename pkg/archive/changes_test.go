@@ -1,10 +1,13 @@
 package archive
 
 import (
+	"bytes"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"testing"
@@ -386,6 +389,39 @@ func TestChangesDirsMutated(t *testing.T) {
 	}
 }
 
+func TestChangesPathsMatchesChangesDirs(t *testing.T) {
+	if runtime.GOOS == windows || runtime.GOOS == solaris {
+		t.Skip("symlinks on Windows; gcp failures on Solaris")
+	}
+	src, err := ioutil.TempDir("", "storage-changes-test")
+	require.NoError(t, err)
+	createSampleDir(t, src)
+	dst := src + "-copy"
+	err = copyDir(src, dst)
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+
+	mutateSampleDir(t, dst)
+	err = ioutil.WriteFile(path.Join(dst, "dirnew", "nested"), []byte("nested\n"), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(path.Join(dst, "dir4", "file4-3"), []byte("file4-3\n"), 0600)
+	require.NoError(t, err)
+	err = os.Rename(path.Join(dst, "dir3"), path.Join(dst, "dir3-moved"))
+	require.NoError(t, err)
+
+	expected, err := ChangesDirs(dst, &idtools.IDMappings{}, src, &idtools.IDMappings{})
+	require.NoError(t, err)
+	sort.Sort(changesByPath(expected))
+
+	// Unchanged paths in the list shouldn't show up in the results.
+	paths := []string{"file1", "dir1", "symlink1", "file2", "file3", "file4", "file5", "filenew", "dirnew", "symlinknew", "symlink2", "dir2", "dir3", "dir4/file4-3", "file6", "dir4/file3-1"}
+	changes, err := ChangesPaths(dst, &idtools.IDMappings{}, src, &idtools.IDMappings{}, paths, []string{"dir3-moved"})
+	require.NoError(t, err)
+	sort.Sort(changesByPath(changes))
+	require.Equal(t, expected, changes)
+}
+
 func TestApplyLayer(t *testing.T) {
 	// TODO Windows. There may be a way of running this, but turning off for now
 	// as createSampleDir uses symlinks.
@@ -423,6 +459,48 @@ func TestApplyLayer(t *testing.T) {
 	}
 }
 
+func TestExportChangesMatchesSequentialArchive(t *testing.T) {
+	if runtime.GOOS == windows {
+		t.Skip("hard links and symlinks on Windows")
+	}
+	src, err := ioutil.TempDir("", "storage-changes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "storage-changes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	// Files of assorted sizes, including ones which are larger than what
+	// we splice at a time, or which don't end on a block boundary.
+	large := make([]byte, 3*1024*1024+123)
+	rand.New(rand.NewSource(0)).Read(large)
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "dir", "subdir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "dir", "large"), large, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "dir", "small"), []byte("small"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "dir", "subdir", "empty"), nil, 0644))
+	require.NoError(t, os.Link(filepath.Join(dst, "dir", "small"), filepath.Join(dst, "dir", "subdir", "link")))
+	require.NoError(t, os.Symlink("../large", filepath.Join(dst, "dir", "subdir", "symlink")))
+
+	changes, err := ChangesDirs(dst, &idtools.IDMappings{}, src, &idtools.IDMappings{})
+	require.NoError(t, err)
+	sort.Sort(changesByPath(changes))
+
+	// Build the archive one file at a time, without splicing.
+	var expected bytes.Buffer
+	ta := newTarAppender(&idtools.IDMappings{}, &expected, nil)
+	for _, change := range changes {
+		require.NoError(t, ta.addTarFile(filepath.Join(dst, change.Path), change.Path[1:]))
+	}
+	require.NoError(t, ta.TarWriter.Close())
+
+	layer, err := ExportChanges(dst, changes, nil, nil)
+	require.NoError(t, err)
+	defer layer.Close()
+	exported, err := ioutil.ReadAll(layer)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(expected.Bytes(), exported), "exported archive differs from the one built sequentially")
+}
+
 func TestChangesSizeWithHardlinks(t *testing.T) {
 	// TODO Windows. There may be a way of running this, but turning off for now
 	// as createSampleDir uses symlinks.
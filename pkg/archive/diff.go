@@ -36,6 +36,11 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 	idMappings := idtools.NewIDMappingsFromMaps(options.UIDMaps, options.GIDMaps)
 
 	aufsTempdir := ""
+	defer func() {
+		if aufsTempdir != "" {
+			os.RemoveAll(aufsTempdir)
+		}
+	}()
 	aufsHardlinks := make(map[string]*tar.Header)
 	buffer := make([]byte, 1<<20)
 
@@ -76,45 +81,6 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 			}
 		}
 
-		// Note as these operations are platform specific, so must the slash be.
-		if !strings.HasSuffix(hdr.Name, string(os.PathSeparator)) {
-			// Not the root directory, ensure that the parent directory exists.
-			// This happened in some tests where an image had a tarfile without any
-			// parent directories.
-			parent := filepath.Dir(hdr.Name)
-			parentPath := filepath.Join(dest, parent)
-
-			if _, err := os.Lstat(parentPath); err != nil && os.IsNotExist(err) {
-				err = os.MkdirAll(parentPath, 0600)
-				if err != nil {
-					return 0, err
-				}
-			}
-		}
-
-		// Skip AUFS metadata dirs
-		if strings.HasPrefix(hdr.Name, WhiteoutMetaPrefix) {
-			// Regular files inside /.wh..wh.plnk can be used as hardlink targets
-			// We don't want this directory, but we need the files in them so that
-			// such hardlinks can be resolved.
-			if strings.HasPrefix(hdr.Name, WhiteoutLinkDir) && hdr.Typeflag == tar.TypeReg {
-				basename := filepath.Base(hdr.Name)
-				aufsHardlinks[basename] = hdr
-				if aufsTempdir == "" {
-					if aufsTempdir, err = ioutil.TempDir("", "storageplnk"); err != nil {
-						return 0, err
-					}
-					defer os.RemoveAll(aufsTempdir)
-				}
-				if err := createTarFile(filepath.Join(aufsTempdir, basename), dest, hdr, tr, true, nil, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, buffer); err != nil {
-					return 0, err
-				}
-			}
-
-			if hdr.Name != WhiteoutOpaqueDir {
-				continue
-			}
-		}
 		path := filepath.Join(dest, hdr.Name)
 		rel, err := filepath.Rel(dest, path)
 		if err != nil {
@@ -125,94 +91,152 @@ func UnpackLayer(dest string, layer io.Reader, options *TarOptions) (size int64,
 		if strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
 			return 0, breakoutError(fmt.Errorf("%q is outside of %q", hdr.Name, dest))
 		}
-		base := filepath.Base(path)
+		// Don't follow symbolic links out of dest, even if we're not
+		// running in a chroot, and ensure that the parent directory
+		// exists.  This happened in some tests where an image had a
+		// tarfile without any parent directories.
+		path, release, err := createUnderRoot(dest, hdr.Name, 0600, nil)
+		if err != nil {
+			// Nothing under something which isn't a directory
+			// needs to be whited out.
+			if isENOTDIR(err) && strings.HasPrefix(filepath.Base(hdr.Name), WhiteoutPrefix) {
+				continue
+			}
+			return 0, err
+		}
+		err = func() error {
+			defer release()
+			// Skip AUFS metadata dirs
+			if strings.HasPrefix(hdr.Name, WhiteoutMetaPrefix) {
+				// Regular files inside /.wh..wh.plnk can be used as hardlink targets
+				// We don't want this directory, but we need the files in them so that
+				// such hardlinks can be resolved.
+				if strings.HasPrefix(hdr.Name, WhiteoutLinkDir) && hdr.Typeflag == tar.TypeReg {
+					basename := filepath.Base(hdr.Name)
+					aufsHardlinks[basename] = hdr
+					if aufsTempdir == "" {
+						tempdir, err := ioutil.TempDir("", "storageplnk")
+						if err != nil {
+							return err
+						}
+						aufsTempdir = tempdir
+					}
+					if err := createTarFile(filepath.Join(aufsTempdir, basename), dest, hdr, tr, true, nil, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, options.Sparse, options.XattrPolicy, buffer); err != nil {
+						return err
+					}
+				}
 
-		if strings.HasPrefix(base, WhiteoutPrefix) {
-			dir := filepath.Dir(path)
-			if base == WhiteoutOpaqueDir {
-				_, err := os.Lstat(dir)
-				if err != nil {
-					return 0, err
+				if hdr.Name != WhiteoutOpaqueDir {
+					return nil
 				}
-				err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			}
+			base := filepath.Base(path)
+
+			if strings.HasPrefix(base, WhiteoutPrefix) {
+				dir := filepath.Dir(path)
+				if base == WhiteoutOpaqueDir {
+					_, err := os.Lstat(dir)
 					if err != nil {
-						if os.IsNotExist(err) {
-							err = nil // parent was deleted
-						}
 						return err
 					}
-					if path == dir {
+					// dir may be a link in /proc/self/fd, so
+					// make sure that it's followed.
+					walkRoot := dir + string(os.PathSeparator)
+					err = filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+						if err != nil {
+							if os.IsNotExist(err) {
+								err = nil // parent was deleted
+							}
+							return err
+						}
+						if path == walkRoot {
+							return nil
+						}
+						// Paths which were unpacked are recorded
+						// using the names in the archive.
+						rel, err := filepath.Rel(dir, path)
+						if err != nil {
+							return err
+						}
+						if _, exists := unpackedPaths[filepath.Join(dest, filepath.Dir(hdr.Name), rel)]; !exists {
+							err := os.RemoveAll(path)
+							return err
+						}
 						return nil
+					})
+					if err != nil {
+						return err
 					}
-					if _, exists := unpackedPaths[path]; !exists {
-						err := os.RemoveAll(path)
+				} else {
+					originalBase := base[len(WhiteoutPrefix):]
+					originalPath := filepath.Join(dir, originalBase)
+					if err := os.RemoveAll(originalPath); err != nil {
 						return err
 					}
-					return nil
-				})
-				if err != nil {
-					return 0, err
 				}
 			} else {
-				originalBase := base[len(WhiteoutPrefix):]
-				originalPath := filepath.Join(dir, originalBase)
-				if err := os.RemoveAll(originalPath); err != nil {
-					return 0, err
-				}
-			}
-		} else {
-			// If path exits we almost always just want to remove and replace it.
-			// The only exception is when it is a directory *and* the file from
-			// the layer is also a directory. Then we want to merge them (i.e.
-			// just apply the metadata from the layer).
-			if fi, err := os.Lstat(path); err == nil {
-				if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
-					if err := os.RemoveAll(path); err != nil {
-						return 0, err
+				// If path exits we almost always just want to remove and replace it.
+				// The only exception is when it is a directory *and* the file from
+				// the layer is also a directory. Then we want to merge them (i.e.
+				// just apply the metadata from the layer).
+				if fi, err := os.Lstat(path); err == nil {
+					if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+						if err := os.RemoveAll(path); err != nil {
+							return err
+						}
 					}
 				}
-			}
 
-			trBuf.Reset(tr)
-			srcData := io.Reader(trBuf)
-			srcHdr := hdr
+				trBuf.Reset(tr)
+				srcData := io.Reader(trBuf)
+				srcHdr := hdr
 
-			// Hard links into /.wh..wh.plnk don't work, as we don't extract that directory, so
-			// we manually retarget these into the temporary files we extracted them into
-			if hdr.Typeflag == tar.TypeLink && strings.HasPrefix(filepath.Clean(hdr.Linkname), WhiteoutLinkDir) {
-				linkBasename := filepath.Base(hdr.Linkname)
-				srcHdr = aufsHardlinks[linkBasename]
-				if srcHdr == nil {
-					return 0, fmt.Errorf("Invalid aufs hardlink")
-				}
-				tmpFile, err := os.Open(filepath.Join(aufsTempdir, linkBasename))
-				if err != nil {
-					return 0, err
+				// Hard links into /.wh..wh.plnk don't work, as we don't extract that directory, so
+				// we manually retarget these into the temporary files we extracted them into
+				if hdr.Typeflag == tar.TypeLink && strings.HasPrefix(filepath.Clean(hdr.Linkname), WhiteoutLinkDir) {
+					linkBasename := filepath.Base(hdr.Linkname)
+					srcHdr = aufsHardlinks[linkBasename]
+					if srcHdr == nil {
+						return fmt.Errorf("Invalid aufs hardlink")
+					}
+					tmpFile, err := os.Open(filepath.Join(aufsTempdir, linkBasename))
+					if err != nil {
+						return err
+					}
+					defer tmpFile.Close()
+					srcData = tmpFile
 				}
-				defer tmpFile.Close()
-				srcData = tmpFile
-			}
 
-			if err := remapIDs(nil, idMappings, options.ChownOpts, srcHdr); err != nil {
-				return 0, err
-			}
+				if err := remapIDs(nil, idMappings, options.ChownOpts, srcHdr); err != nil {
+					return err
+				}
 
-			if err := createTarFile(path, dest, srcHdr, srcData, true, nil, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, buffer); err != nil {
-				return 0, err
-			}
+				if err := createTarFile(path, dest, srcHdr, srcData, true, nil, options.InUserNS, options.IgnoreChownErrors, options.ForceMask, options.Sparse, options.XattrPolicy, buffer); err != nil {
+					return err
+				}
 
-			// Directory mtimes must be handled at the end to avoid further
-			// file creation in them to modify the directory mtime
-			if hdr.Typeflag == tar.TypeDir {
-				dirs = append(dirs, hdr)
+				// Directory mtimes must be handled at the end to avoid further
+				// file creation in them to modify the directory mtime
+				if hdr.Typeflag == tar.TypeDir {
+					dirs = append(dirs, hdr)
+				}
+				unpackedPaths[filepath.Join(dest, hdr.Name)] = struct{}{}
 			}
-			unpackedPaths[path] = struct{}{}
+			return nil
+		}()
+		if err != nil {
+			return 0, err
 		}
 	}
 
 	for _, hdr := range dirs {
-		path := filepath.Join(dest, hdr.Name)
-		if err := system.Chtimes(path, hdr.AccessTime, hdr.ModTime); err != nil {
+		path, release, err := resolveUnderRoot(dest, hdr.Name)
+		if err != nil {
+			return 0, err
+		}
+		err = system.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+		release()
+		if err != nil {
 			return 0, err
 		}
 	}
@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// OverrideStat holds the ownership and permissions which a file would have
+// had if a permissions mask hadn't been forced on it when it was created.
+// They are recorded in the file's "user.containers.override_stat" extended
+// attribute.
+type OverrideStat struct {
+	UID int
+	GID int
+	// Mode holds the permission bits, including the setuid, setgid and
+	// sticky bits.
+	Mode os.FileMode
+}
+
+// OverriddenFile describes a file whose ownership and permissions on disk
+// differ from the ones that it is supposed to have.
+type OverriddenFile struct {
+	// Path is the file's location, relative to the root of the tree.
+	Path string
+	// Effective is the ownership and permissions that the file has on disk.
+	Effective OverrideStat
+	// Original is the ownership and permissions that the file is supposed
+	// to have.
+	Original OverrideStat
+}
+
+// parseOverrideStat parses the value of the override attribute, which is of
+// the form "uid:gid:mode", with the mode in octal.
+func parseOverrideStat(value string) (*OverrideStat, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 3 {
+		return nil, errors.Errorf("invalid value %q for %s", value, containersOverrideXattr)
+	}
+	uid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid UID in %q", value)
+	}
+	gid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid GID in %q", value)
+	}
+	mode, err := strconv.ParseUint(fields[2], 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mode in %q", value)
+	}
+	return &OverrideStat{UID: uid, GID: gid, Mode: fileModeFromPermissions(os.FileMode(mode))}, nil
+}
+
+// GetOverrideStat returns the ownership and permissions that were recorded
+// for the file at path when it was created with a forced permissions mask, or
+// nil if none were recorded.
+func GetOverrideStat(path string) (*OverrideStat, error) {
+	value, err := system.Lgetxattr(path, containersOverrideXattr)
+	if err != nil {
+		if errors.Is(err, system.EOPNOTSUPP) || err == system.ErrNotSupportedPlatform {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return parseOverrideStat(string(value))
+}
+
+// ListOverriddenFiles walks the tree rooted at dir, and returns information
+// about every file in it whose ownership and permissions were recorded
+// because they were overridden by a forced permissions mask.
+func ListOverriddenFiles(dir string) ([]OverriddenFile, error) {
+	var files []OverriddenFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		original, err := GetOverrideStat(path)
+		if err != nil || original == nil {
+			return err
+		}
+		uid, gid, mode, err := GetFileOwner(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, OverriddenFile{
+			Path:      rel,
+			Effective: OverrideStat{UID: int(uid), GID: int(gid), Mode: fileModeFromPermissions(os.FileMode(mode))},
+			Original:  *original,
+		})
+		return nil
+	})
+	return files, err
+}
+
+// RestoreOverriddenFiles walks the tree rooted at dir, and gives every file
+// in it which has ownership and permissions recorded in an extended attribute
+// that ownership and those permissions, removing the attribute.
+func RestoreOverriddenFiles(dir string) error {
+	files, err := ListOverriddenFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Path)
+		// Chown first, since it can clear setuid and setgid bits.
+		if err := os.Lchown(path, file.Original.UID, file.Original.GID); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, file.Original.Mode); err != nil {
+			return err
+		}
+		if err := system.Lremovexattr(path, containersOverrideXattr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileModeFromPermissions converts permission bits in the traditional Unix
+// layout to an os.FileMode.
+func fileModeFromPermissions(perms os.FileMode) os.FileMode {
+	mode := perms & os.ModePerm
+	if perms&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perms&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perms&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
@@ -0,0 +1,18 @@
+package archive
+
+// Progress describes how much of a tar stream, or of a directory tree which
+// is being copied, has been processed.
+type Progress struct {
+	// Entries counts the entries (files, directories, links, and so on)
+	// which have been processed so far, including the current one.
+	Entries int64
+	// Bytes counts the contents of the entries which have been processed
+	// so far, including the current one.
+	Bytes int64
+	// Entry is the path of the current entry.
+	Entry string
+}
+
+// ProgressFunc is called as each entry in a tar stream, or in a directory tree
+// which is being copied, is processed.
+type ProgressFunc func(Progress)
@@ -0,0 +1,77 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+
+	"github.com/containers/storage/pkg/pools"
+)
+
+// reproducibleHeader adjusts hdr so that it doesn't depend on when the
+// archive was generated, or on the contents of the host's user and group
+// databases.  Modification times are clamped to epoch, or set to the start of
+// the Unix epoch if epoch is nil, and access and change times are dropped.
+// User and group names are dropped, leaving only the numeric IDs.
+func reproducibleHeader(hdr *tar.Header, epoch *time.Time) {
+	clamp := time.Unix(0, 0)
+	if epoch != nil {
+		clamp = *epoch
+	}
+	if epoch == nil || hdr.ModTime.After(clamp) {
+		hdr.ModTime = clamp
+	}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	for _, key := range []string{"mtime", "atime", "ctime", "uname", "gname"} {
+		delete(hdr.PAXRecords, key)
+	}
+}
+
+// ReproducibleTarStream reads the tar stream from archive, and returns a tar
+// stream with the same entries, in the same order, with their headers
+// modified the same way they would be if the archive had been generated with
+// TarOptions.Reproducible set, using epoch as the TarOptions.SourceDateEpoch.
+// This lets the output of a generator which doesn't know about those options
+// be made reproducible.  The returned stream is uncompressed.
+func ReproducibleTarStream(archive io.ReadCloser, epoch *time.Time) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		err := func() error {
+			tr := tar.NewReader(archive)
+			tw := tar.NewWriter(pipeWriter)
+			buf := pools.BufioWriter32KPool.Get(nil)
+			defer pools.BufioWriter32KPool.Put(buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return tw.Close()
+				}
+				if err != nil {
+					return err
+				}
+				if hdr.Typeflag != tar.TypeXGlobalHeader {
+					reproducibleHeader(hdr, epoch)
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				buf.Reset(tw)
+				if _, err := io.Copy(buf, tr); err != nil {
+					return err
+				}
+				if err := buf.Flush(); err != nil {
+					return err
+				}
+			}
+		}()
+		if closeErr := archive.Close(); err == nil {
+			err = closeErr
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader
+}
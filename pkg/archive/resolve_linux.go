@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containers/storage/pkg/idtools"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// skipOpenat2 is set when openat2 is not supported by the running kernel, so
+// that we don't keep trying to use it.
+var skipOpenat2 int32
+
+var (
+	procSelfFDOnce sync.Once
+	procSelfFD     bool
+)
+
+// canUseProcSelfFD returns true if descriptors which we've opened can be
+// referred to using /proc/self/fd, which isn't the case if we're running in a
+// chroot which doesn't have /proc mounted in it.
+func canUseProcSelfFD() bool {
+	procSelfFDOnce.Do(func() {
+		_, err := os.Stat("/proc/self/fd")
+		procSelfFD = err == nil
+	})
+	return procSelfFD
+}
+
+// openat2InRoot opens name, a path relative to the directory which rootfd
+// refers to, as a directory, using openat2() with RESOLVE_IN_ROOT, the variant
+// of RESOLVE_BENEATH which resolves symbolic links as if rootfd were the root
+// directory instead of rejecting those which would lead out of it.
+func openat2InRoot(rootfd int, name string) (int, error) {
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	for {
+		fd, err := unix.Openat2(rootfd, name, &how)
+		// EAGAIN means that something was renamed while the path
+		// was being resolved.
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// openParentUnderRoot opens parent, a directory under root, using
+// openat2InRoot().  If mkdir isn't nil, it's used to create any of the
+// directories in parent which don't exist, each in the directory which
+// contains it, which has already been opened.
+func openParentUnderRoot(root, parent string, mkdir func(dirfd int, name string) error) (int, error) {
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootfd)
+	fd, err := openat2InRoot(rootfd, parent)
+	if err == nil {
+		return fd, nil
+	}
+	if err != unix.ENOENT || mkdir == nil {
+		return -1, &os.PathError{Op: "openat2", Path: filepath.Join(root, parent), Err: err}
+	}
+	return mkdirAllUnderRoot(root, rootfd, parent, mkdir, true)
+}
+
+// mkdirAllUnderRoot uses mkdir to create the directories in parent, a
+// directory under root, which don't exist, each in the directory which
+// contains it, which it has already opened, and returns a descriptor for
+// parent.  If followLinks is set, and a symbolic link in parent points to a
+// directory which doesn't exist, that directory is created, too.
+func mkdirAllUnderRoot(root string, rootfd int, parent string, mkdir func(dirfd int, name string) error, followLinks bool) (int, error) {
+	dirfd, current := rootfd, ""
+	for _, component := range strings.Split(parent, string(os.PathSeparator)) {
+		if component == "" {
+			continue
+		}
+		current = filepath.Join(current, component)
+		fd, err := openat2InRoot(rootfd, current)
+		if err == unix.ENOENT {
+			err = mkdir(dirfd, component)
+			if err == unix.EEXIST && followLinks {
+				var target string
+				if target, err = securejoin.SecureJoin(root, current); err == nil {
+					if target, err = filepath.Rel(root, target); err == nil {
+						var targetfd int
+						if targetfd, err = mkdirAllUnderRoot(root, rootfd, target, mkdir, false); err == nil {
+							unix.Close(targetfd)
+						}
+					}
+				}
+			}
+			if err == nil || err == unix.EEXIST {
+				fd, err = openat2InRoot(rootfd, current)
+			}
+		}
+		if dirfd != rootfd {
+			unix.Close(dirfd)
+		}
+		if err != nil {
+			return -1, &os.PathError{Op: "mkdir", Path: filepath.Join(root, current), Err: err}
+		}
+		dirfd = fd
+	}
+	return dirfd, nil
+}
+
+// resolvePathUnderRoot returns the location of name, a cleaned path relative
+// to root, with symbolic links in the directories which contain it resolved as
+// if root were the root directory.  It's used when openat2() or /proc/self/fd
+// can't be, and only checks the path, so it can't keep the directories which
+// contain name from being replaced before the caller uses the location.
+func resolvePathUnderRoot(root, name string) (string, error) {
+	parent := filepath.Dir(strings.TrimLeft(name, string(os.PathSeparator)))
+	resolvedParent, err := securejoin.SecureJoin(root, parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(name)), nil
+}
+
+// openUnderRoot returns a location through which name, a cleaned path
+// relative to root which doesn't start with "..", can be created, removed, or
+// modified, and a function which the caller should call when it's done with
+// it.  Symbolic links in the directories which contain name are resolved as if
+// root were the root directory, the way they would be if we had chrooted into
+// it, so that the caller can't be tricked into affecting anything outside of
+// root, even if it isn't running in a chroot.  The directory which contains
+// name is opened, and the location refers to it using /proc/self/fd, so that
+// replacing any of the directories which contain it with symbolic links
+// afterward doesn't change where the location leads.  The final component of
+// name is not resolved.  If mkdir isn't nil, it's used to create any of the
+// directories which contain name which don't exist.  If openat2() or
+// /proc/self/fd can't be used, mkdirAll is used instead, if it isn't nil.
+func openUnderRoot(root, name string, mkdir func(dirfd int, name string) error, mkdirAll func(path string) error) (string, func(), error) {
+	parent := filepath.Dir(strings.TrimLeft(name, string(os.PathSeparator)))
+	if parent == "." {
+		return filepath.Join(root, name), func() {}, nil
+	}
+	if atomic.LoadInt32(&skipOpenat2) == 0 && canUseProcSelfFD() {
+		fd, err := openParentUnderRoot(root, parent, mkdir)
+		if err == nil {
+			path := filepath.Join("/proc/self/fd", strconv.Itoa(fd), filepath.Base(name))
+			return path, func() { unix.Close(fd) }, nil
+		}
+		if !errors.Is(err, unix.ENOSYS) {
+			return "", nil, err
+		}
+		atomic.StoreInt32(&skipOpenat2, 1)
+	}
+	path, err := resolvePathUnderRoot(root, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if mkdirAll != nil {
+		if _, err := os.Lstat(filepath.Dir(path)); err != nil && os.IsNotExist(err) {
+			if err := mkdirAll(filepath.Dir(path)); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return path, func() {}, nil
+}
+
+// resolveUnderRoot returns a location through which name, a cleaned path
+// relative to root which doesn't start with "..", can be created, removed, or
+// modified without affecting anything outside of root, and a function which
+// the caller should call when it's done with it.  See openUnderRoot().
+func resolveUnderRoot(root, name string) (string, func(), error) {
+	return openUnderRoot(root, name, nil, nil)
+}
+
+// createUnderRoot is like resolveUnderRoot(), but it first creates any of the
+// directories which contain name which don't exist, using mode, and if ids
+// isn't nil, makes them owned by ids.
+func createUnderRoot(root, name string, mode os.FileMode, ids *idtools.IDPair) (string, func(), error) {
+	mkdir := func(dirfd int, name string) error {
+		if err := unix.Mkdirat(dirfd, name, uint32(mode.Perm())); err != nil {
+			return err
+		}
+		if ids != nil {
+			return unix.Fchownat(dirfd, name, ids.UID, ids.GID, unix.AT_SYMLINK_NOFOLLOW)
+		}
+		return nil
+	}
+	mkdirAll := func(path string) error {
+		if ids != nil {
+			return idtools.MkdirAllAndChownNew(path, mode, *ids)
+		}
+		return os.MkdirAll(path, mode)
+	}
+	return openUnderRoot(root, name, mkdir, mkdirAll)
+}
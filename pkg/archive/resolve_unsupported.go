@@ -0,0 +1,35 @@
+// +build !linux
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/idtools"
+)
+
+// resolveUnderRoot returns the location where name, a cleaned path relative
+// to root, should be created, removed, or modified, and a function which the
+// caller should call when it's done with it.
+func resolveUnderRoot(root, name string) (string, func(), error) {
+	return filepath.Join(root, name), func() {}, nil
+}
+
+// createUnderRoot is like resolveUnderRoot(), but it first creates the
+// directory which would contain name if it doesn't exist, using mode, and if
+// ids isn't nil, makes the directories which it creates owned by ids.
+func createUnderRoot(root, name string, mode os.FileMode, ids *idtools.IDPair) (string, func(), error) {
+	path := filepath.Join(root, name)
+	if _, err := os.Lstat(filepath.Dir(path)); err != nil && os.IsNotExist(err) {
+		if ids != nil {
+			err = idtools.MkdirAllAndChownNew(filepath.Dir(path), mode, *ids)
+		} else {
+			err = os.MkdirAll(filepath.Dir(path), mode)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return path, func() {}, nil
+}
@@ -0,0 +1,366 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The standard library's tar writer can't produce sparse entries, so they're
+// written here by hand, using the GNU PAX 1.0 sparse format: a PAX extended
+// header carrying the GNU.sparse.* records, followed by a ustar header whose
+// data section starts with the sparse map and is followed by the contents of
+// the data segments, back to back.  The standard library's tar reader (along
+// with GNU tar and bsdtar) knows how to read these back.
+
+const (
+	tarBlockSize = 512
+
+	// sparseBlockSize is the granularity at which runs of zeroes are turned
+	// into holes when extracting regular files.
+	sparseBlockSize = 4096
+
+	// Largest values which fit in the octal numeric fields of a ustar header.
+	maxUstarID   = 1<<21 - 1
+	maxUstarSize = 1<<33 - 1
+	maxUstarTime = 1<<33 - 1
+)
+
+// dataSegment is a range of a file which contains data, rather than a hole.
+type dataSegment struct {
+	offset, length int64
+}
+
+// addSparseFile writes the regular file at path to the archive as a sparse
+// entry, if the file has holes in it.  If it doesn't, or if holes can't be
+// detected on this platform, it writes nothing and returns false, and the
+// caller should write the file normally.
+func (ta *tarAppender) addSparseFile(path string, hdr *tar.Header) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	segments, err := findDataSegments(file, hdr.Size)
+	if err != nil || segments == nil {
+		return false, err
+	}
+	var dataSize int64
+	for _, segment := range segments {
+		dataSize += segment.length
+	}
+	if dataSize >= hdr.Size {
+		return false, nil
+	}
+
+	sparseMap := formatSparseMap(segments, hdr.Size)
+	records, err := sparsePAXRecords(hdr)
+	if err != nil {
+		return false, err
+	}
+	name := sparseEntryName(hdr.Name)
+	if len(name) > 100 {
+		records["path"] = name
+		name = name[:100]
+	}
+	paxData := formatPAXRecords(records)
+
+	// Make sure that the previous entry has been padded out, since we're
+	// about to write to the underlying stream directly.
+	if err := ta.TarWriter.Flush(); err != nil {
+		return false, err
+	}
+
+	paxHdr := &tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     paxHeaderName(hdr.Name),
+		Mode:     0644,
+		Size:     int64(len(paxData)),
+		ModTime:  hdr.ModTime,
+	}
+	if _, err := ta.RawWriter.Write(formatUstarHeader(paxHdr, paxHdr.Name)); err != nil {
+		return false, err
+	}
+	if err := writePadded(ta.RawWriter, paxData); err != nil {
+		return false, err
+	}
+
+	mainHdr := *hdr
+	mainHdr.Typeflag = tar.TypeReg
+	mainHdr.Size = int64(len(sparseMap)) + dataSize
+	if _, err := ta.RawWriter.Write(formatUstarHeader(&mainHdr, name)); err != nil {
+		return false, err
+	}
+	if _, err := ta.RawWriter.Write(sparseMap); err != nil {
+		return false, err
+	}
+
+	ta.Buffer.Reset(ta.RawWriter)
+	defer ta.Buffer.Reset(nil)
+	var copyErr error
+	for _, segment := range segments {
+		n, err := io.Copy(ta.Buffer, io.NewSectionReader(file, segment.offset, segment.length))
+		if err == nil && n < segment.length {
+			err = fmt.Errorf("archive: %q shrank while it was being archived", path)
+		}
+		if err != nil {
+			// Keep the archive well-formed, even though this entry's
+			// contents won't be right.
+			copyErr = err
+			if _, err := ta.Buffer.Write(make([]byte, segment.length-n)); err != nil {
+				return true, err
+			}
+		}
+	}
+	if pad := dataSize % tarBlockSize; pad != 0 {
+		if _, err := ta.Buffer.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return true, err
+		}
+	}
+	if err := ta.Buffer.Flush(); err != nil {
+		return true, err
+	}
+	return true, copyErr
+}
+
+// formatSparseMap encodes the list of data segments in the form used by
+// version 1.0 of the GNU sparse format, padded out to a whole number of
+// blocks.  If the file ends with a hole, a zero-length segment is added at the
+// end of the file, as GNU tar does.
+func formatSparseMap(segments []dataSegment, size int64) []byte {
+	if len(segments) == 0 || segments[len(segments)-1].offset+segments[len(segments)-1].length < size {
+		segments = append(segments[:len(segments):len(segments)], dataSegment{offset: size})
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", len(segments))
+	for _, segment := range segments {
+		fmt.Fprintf(&buf, "%d\n%d\n", segment.offset, segment.length)
+	}
+	if pad := buf.Len() % tarBlockSize; pad != 0 {
+		buf.Write(make([]byte, tarBlockSize-pad))
+	}
+	return buf.Bytes()
+}
+
+// sparsePAXRecords builds the set of PAX records which need to accompany the
+// header for a sparse version of the entry described by hdr.
+func sparsePAXRecords(hdr *tar.Header) (map[string]string, error) {
+	records := make(map[string]string)
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	for k, v := range hdr.Xattrs {
+		records["SCHILY.xattr."+k] = v
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = hdr.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(hdr.Size, 10)
+	if hdr.Uid < 0 || hdr.Gid < 0 {
+		return nil, fmt.Errorf("archive: invalid ownership %d:%d for %q", hdr.Uid, hdr.Gid, hdr.Name)
+	}
+	if hdr.Uid > maxUstarID {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+	}
+	if hdr.Gid > maxUstarID {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+	}
+	if len(hdr.Uname) > 32 {
+		records["uname"] = hdr.Uname
+	}
+	if len(hdr.Gname) > 32 {
+		records["gname"] = hdr.Gname
+	}
+	if hdr.ModTime.Nanosecond() != 0 || hdr.ModTime.Unix() < 0 || hdr.ModTime.Unix() > maxUstarTime {
+		records["mtime"] = formatPAXTime(hdr.ModTime)
+	}
+	if hdr.Format == tar.FormatPAX {
+		if !hdr.AccessTime.IsZero() {
+			records["atime"] = formatPAXTime(hdr.AccessTime)
+		}
+		if !hdr.ChangeTime.IsZero() {
+			records["ctime"] = formatPAXTime(hdr.ChangeTime)
+		}
+	}
+	return records, nil
+}
+
+// sparseEntryName returns the name which GNU tar gives to the ustar header of
+// a version 1.0 sparse entry.  Readers which understand the format use the
+// GNU.sparse.name record instead.
+func sparseEntryName(name string) string {
+	dir, base := path.Split(strings.TrimSuffix(name, "/"))
+	return path.Join(dir, "GNUSparseFile.0", base)
+}
+
+// paxHeaderName returns the name used for the PAX extended header which
+// describes the entry with the given name.
+func paxHeaderName(name string) string {
+	dir, base := path.Split(strings.TrimSuffix(name, "/"))
+	name = path.Join(dir, "PaxHeaders.0", base)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	return name
+}
+
+// formatPAXTime formats a time as a PAX record value.
+func formatPAXTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs = -(secs + 1)
+		nsecs = -(nsecs - 1e9)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// formatPAXRecords encodes a set of PAX records, sorted by key.
+func formatPAXRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		// The length of a record includes the digits of the length itself.
+		const padding = 3 // space, equals sign, newline
+		size := len(k) + len(records[k]) + padding
+		size += len(strconv.Itoa(size))
+		record := fmt.Sprintf("%d %s=%s\n", size, k, records[k])
+		if len(record) != size {
+			size = len(record)
+			record = fmt.Sprintf("%d %s=%s\n", size, k, records[k])
+		}
+		buf.WriteString(record)
+	}
+	return buf.Bytes()
+}
+
+// formatUstarHeader encodes a ustar header block for hdr, using name in place
+// of hdr.Name.  Values which don't fit are expected to have been supplied in
+// a preceding PAX extended header, and are clamped.
+func formatUstarHeader(hdr *tar.Header, name string) []byte {
+	block := make([]byte, tarBlockSize)
+	formatString := func(b []byte, s string) {
+		copy(b, s)
+	}
+	formatOctal := func(b []byte, v int64) {
+		max := int64(1)<<(3*uint(len(b)-1)) - 1
+		if v < 0 {
+			v = 0
+		}
+		if v > max {
+			v = max
+		}
+		formatString(b, fmt.Sprintf("%0*o", len(b)-1, v))
+	}
+	formatString(block[0:100], name)
+	formatOctal(block[100:108], hdr.Mode&07777)
+	formatOctal(block[108:116], int64(hdr.Uid))
+	formatOctal(block[116:124], int64(hdr.Gid))
+	formatOctal(block[124:136], hdr.Size)
+	formatOctal(block[136:148], hdr.ModTime.Unix())
+	block[156] = hdr.Typeflag
+	formatString(block[257:263], "ustar\x00")
+	formatString(block[263:265], "00")
+	if len(hdr.Uname) <= 32 {
+		formatString(block[265:297], hdr.Uname)
+	}
+	if len(hdr.Gname) <= 32 {
+		formatString(block[297:329], hdr.Gname)
+	}
+	formatOctal(block[329:337], hdr.Devmajor)
+	formatOctal(block[337:345], hdr.Devminor)
+
+	// The checksum is computed with the checksum field filled with spaces.
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	formatString(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+// writePadded writes data, followed by enough zeroes to fill out its last
+// block.
+func writePadded(w io.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if pad := len(data) % tarBlockSize; pad != 0 {
+		if _, err := w.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSparseFile copies the contents of an entry to file, leaving holes in
+// place of blocks which contain only zeroes.
+func writeSparseFile(file *os.File, reader io.Reader, buffer []byte) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	zeroes := make([]byte, sparseBlockSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(reader, buffer)
+		chunk := buffer[:n]
+		for len(chunk) > 0 {
+			// Find the next run of blocks which contain data, and write
+			// them out.
+			start := 0
+			for start < len(chunk) {
+				end := start + sparseBlockSize
+				if end > len(chunk) {
+					end = len(chunk)
+				}
+				if !bytes.Equal(chunk[start:end], zeroes[:end-start]) {
+					break
+				}
+				start = end
+			}
+			end := start
+			for end < len(chunk) {
+				next := end + sparseBlockSize
+				if next > len(chunk) {
+					next = len(chunk)
+				}
+				if bytes.Equal(chunk[end:next], zeroes[:next-end]) {
+					break
+				}
+				end = next
+			}
+			if end > start {
+				if _, err := file.WriteAt(chunk[start:end], offset+int64(start)); err != nil {
+					return err
+				}
+			}
+			offset += int64(end)
+			chunk = chunk[end:]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Extend the file to cover any hole at its end.
+	return file.Truncate(offset)
+}
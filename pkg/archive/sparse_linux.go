@@ -0,0 +1,39 @@
+package archive
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// findDataSegments returns the parts of the file which contain data.
+func findDataSegments(f *os.File, size int64) ([]dataSegment, error) {
+	segments := []dataSegment{}
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+		if err != nil {
+			if err == unix.ENXIO {
+				// There's no more data after offset.
+				break
+			}
+			if err == unix.EINVAL {
+				// The filesystem doesn't support SEEK_DATA.
+				return nil, nil
+			}
+			return nil, err
+		}
+		if start >= size {
+			break
+		}
+		end, err := unix.Seek(int(f.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		segments = append(segments, dataSegment{start, end - start})
+		offset = end
+	}
+	return segments, nil
+}
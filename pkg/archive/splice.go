@@ -0,0 +1,69 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errSpliceUnsupported is returned by spliceFile if the kernel can't splice
+// data from the file into the pipe, so it has to be copied instead.
+var errSpliceUnsupported = errors.New("splicing is not supported")
+
+// spliceTarFile writes the regular file at path to the archive, splicing its
+// contents into ta.SpliceTo so that they aren't copied through our buffers.
+// If the file can't be opened, it writes nothing and returns false, and the
+// caller should handle the file normally.
+func (ta *tarAppender) spliceTarFile(path string, hdr *tar.Header) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
+
+	// Let the standard library format the header, exactly as it would
+	// have if it were writing the whole entry.
+	var header bytes.Buffer
+	if err := tar.NewWriter(&header).WriteHeader(hdr); err != nil {
+		return false, err
+	}
+	// Make sure that the previous entry has been padded out, since we're
+	// about to write to the underlying stream directly.
+	if err := ta.TarWriter.Flush(); err != nil {
+		return false, err
+	}
+	if _, err := ta.SpliceTo.Write(header.Bytes()); err != nil {
+		return true, err
+	}
+
+	n, err := spliceFile(ta.SpliceTo, file, hdr.Size)
+	if err == errSpliceUnsupported {
+		ta.Buffer.Reset(ta.SpliceTo)
+		var copied int64
+		copied, err = io.Copy(ta.Buffer, io.NewSectionReader(file, n, hdr.Size-n))
+		n += copied
+		if flushErr := ta.Buffer.Flush(); err == nil {
+			err = flushErr
+		}
+		ta.Buffer.Reset(nil)
+	}
+	copyErr := err
+	if copyErr == nil && n < hdr.Size {
+		copyErr = fmt.Errorf("archive: %q shrank while it was being archived", path)
+	}
+	// Keep the archive well-formed, even if this entry's contents won't
+	// be right.
+	padding := hdr.Size - n
+	if pad := hdr.Size % tarBlockSize; pad != 0 {
+		padding += tarBlockSize - pad
+	}
+	if padding > 0 {
+		if _, err := ta.SpliceTo.Write(make([]byte, padding)); err != nil {
+			return true, err
+		}
+	}
+	return true, copyErr
+}
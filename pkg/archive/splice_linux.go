@@ -0,0 +1,76 @@
+package archive
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// exportPipeSize is the size which we ask the kernel to use for the
+	// buffers of pipes that we export changes through.
+	exportPipeSize = 1024 * 1024
+	// maxSpliceSize is the most that we try to splice at a time.
+	maxSpliceSize = 1024 * 1024
+)
+
+// newExportPipe returns a pipe for an archive to be written to and read from.
+// If it's a kernel pipe, which the contents of files can be spliced into, it's
+// also returned as an *os.File.
+func newExportPipe() (io.ReadCloser, io.WriteCloser, *os.File) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		pipeReader, pipeWriter := io.Pipe()
+		return pipeReader, pipeWriter, nil
+	}
+	// A bigger pipe lets us move more data with each call, but it's only
+	// an optimization.
+	if conn, err := writer.SyscallConn(); err == nil {
+		_ = conn.Control(func(fd uintptr) {
+			_, _ = unix.FcntlInt(fd, unix.F_SETPIPE_SZ, exportPipeSize)
+		})
+	}
+	return reader, writer, writer
+}
+
+// spliceFile moves up to length bytes from the start of file into pipe without
+// copying them through userspace, and returns how many it moved.  If the
+// kernel can't do that for this file, it returns errSpliceUnsupported, and the
+// caller should copy the rest of the data itself.
+func spliceFile(pipe *os.File, file *os.File, length int64) (int64, error) {
+	conn, err := pipe.SyscallConn()
+	if err != nil {
+		return 0, errSpliceUnsupported
+	}
+	src := int(file.Fd())
+	var offset int64
+	for offset < length {
+		chunk := length - offset
+		if chunk > maxSpliceSize {
+			chunk = maxSpliceSize
+		}
+		var n int64
+		var spliceErr error
+		if err := conn.Write(func(fd uintptr) bool {
+			n, spliceErr = unix.Splice(src, &offset, int(fd), nil, int(chunk), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return spliceErr != unix.EAGAIN
+		}); err != nil {
+			return offset, err
+		}
+		switch spliceErr {
+		case nil:
+		case unix.EINTR:
+			continue
+		case unix.EINVAL, unix.ENOSYS:
+			return offset, errSpliceUnsupported
+		default:
+			return offset, spliceErr
+		}
+		if n == 0 {
+			// The file is shorter than it was.
+			break
+		}
+	}
+	return offset, nil
+}
@@ -0,0 +1,21 @@
+// +build !linux
+
+package archive
+
+import (
+	"io"
+	"os"
+)
+
+// newExportPipe returns a pipe for an archive to be written to and read from.
+// Data can't be spliced into pipes on this platform, so it's an io.Pipe.
+func newExportPipe() (io.ReadCloser, io.WriteCloser, *os.File) {
+	pipeReader, pipeWriter := io.Pipe()
+	return pipeReader, pipeWriter, nil
+}
+
+// spliceFile returns errSpliceUnsupported, since data can't be spliced on this
+// platform.
+func spliceFile(pipe *os.File, file *os.File, length int64) (int64, error) {
+	return 0, errSpliceUnsupported
+}
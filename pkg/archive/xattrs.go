@@ -0,0 +1,141 @@
+package archive
+
+import (
+	"archive/tar"
+	"strings"
+
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	xattrPOSIXACLAccess  = "system.posix_acl_access"
+	xattrPOSIXACLDefault = "system.posix_acl_default"
+)
+
+// XattrPolicy controls which extended attributes are recorded when creating
+// an archive, and which are set when extracting one.
+type XattrPolicy struct {
+	// Include lists the attributes which should be preserved.  Entries
+	// which end with a "." (e.g. "user.", "security.", "trusted.") match
+	// every attribute in that namespace, and other entries match only the
+	// attribute with that exact name.  If Include is empty, all attributes
+	// are preserved, unless they are matched by Exclude.
+	Include []string
+	// Exclude lists attributes which should not be preserved, using the
+	// same syntax as Include.  It takes precedence over Include.
+	Exclude []string
+	// ACLs controls whether or not POSIX ACLs, which are stored in the
+	// system.posix_acl_access and system.posix_acl_default attributes,
+	// are preserved.  They are not matched by Include or Exclude.
+	ACLs bool
+	// IgnoreErrors causes errors reading or setting attributes to be logged
+	// and ignored, rather than causing the operation to fail.
+	IgnoreErrors bool
+}
+
+var (
+	// defaultTarXattrPolicy is used when creating archives if no policy
+	// was specified.
+	defaultTarXattrPolicy = &XattrPolicy{
+		Include: []string{"security.capability", "security.ima", "user."},
+	}
+	// defaultUntarXattrPolicy is used when extracting archives if no
+	// policy was specified.
+	defaultUntarXattrPolicy = &XattrPolicy{
+		Exclude: []string{"security.selinux"},
+		ACLs:    true,
+	}
+	// rootlessXattrPolicy is used when extracting archives in a user
+	// namespace if no policy was specified.  The trusted.* namespace and
+	// most of the security.* namespace can't be written to without
+	// privileges that we don't have there.
+	rootlessXattrPolicy = &XattrPolicy{
+		Include: []string{"security.capability", "user."},
+		ACLs:    true,
+	}
+)
+
+// DefaultXattrPolicy returns the policy which is used when creating archives
+// (if forUnpack is false) or extracting them (if forUnpack is true) when
+// TarOptions.XattrPolicy is not set.  If inUserNS is true, the policy is one
+// which is suitable for use in a user namespace.
+func DefaultXattrPolicy(forUnpack, inUserNS bool) *XattrPolicy {
+	policy := defaultTarXattrPolicy
+	if forUnpack {
+		policy = defaultUntarXattrPolicy
+		if inUserNS {
+			policy = rootlessXattrPolicy
+		}
+	}
+	return &XattrPolicy{
+		Include:      append([]string{}, policy.Include...),
+		Exclude:      append([]string{}, policy.Exclude...),
+		ACLs:         policy.ACLs,
+		IgnoreErrors: policy.IgnoreErrors,
+	}
+}
+
+// matchesXattr checks if the attribute name is matched by an entry in a list
+// of attribute names and namespaces.
+func matchesXattr(list []string, name string) bool {
+	for _, entry := range list {
+		if entry == name || (strings.HasSuffix(entry, ".") && strings.HasPrefix(name, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if the policy allows the named attribute to be preserved.
+func (p *XattrPolicy) Allows(name string) bool {
+	if name == xattrPOSIXACLAccess || name == xattrPOSIXACLDefault {
+		return p.ACLs
+	}
+	if matchesXattr(p.Exclude, name) {
+		return false
+	}
+	return len(p.Include) == 0 || matchesXattr(p.Include, name)
+}
+
+// ReadXattrsToTarHeader reads the extended attributes of the file at path which
+// are allowed by the policy into a tar header.
+func ReadXattrsToTarHeader(path string, hdr *tar.Header, policy *XattrPolicy) error {
+	names, err := system.Llistxattr(path)
+	if err != nil {
+		if errors.Is(err, system.EOPNOTSUPP) || err == system.ErrNotSupportedPlatform {
+			return nil
+		}
+		if policy.IgnoreErrors {
+			logrus.Debugf("archive: ignoring error listing extended attributes of %q: %v", path, err)
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if !policy.Allows(name) {
+			continue
+		}
+		value, err := system.Lgetxattr(path, name)
+		if err != nil {
+			if errors.Is(err, system.E2BIG) {
+				logrus.Errorf("archive: Skipping xattr for file %s since value is too big: %s", path, name)
+				continue
+			}
+			if policy.IgnoreErrors {
+				logrus.Debugf("archive: ignoring error reading %q attribute from %q: %v", name, path, err)
+				continue
+			}
+			return errors.Wrapf(err, "failed to read %q attribute from %q", name, path)
+		}
+		if value == nil {
+			continue
+		}
+		if hdr.Xattrs == nil {
+			hdr.Xattrs = make(map[string]string)
+		}
+		hdr.Xattrs[name] = string(value)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -46,6 +47,10 @@ func untar() {
 		fatal(err)
 	}
 
+	if err := adjustOptionsForUserNS(&options); err != nil {
+		fatal(err)
+	}
+
 	if err := archive.Unpack(os.Stdin, dst, &options); err != nil {
 		fatal(err)
 	}
@@ -86,15 +91,17 @@ func invokeUnpack(decompressedArchive io.Reader, dest string, options *archive.T
 		dest = relDest
 	}
 
-	cmd := reexec.Command("storage-untar", dest, root)
-	cmd.Stdin = decompressedArchive
-
-	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
 	output := bytes.NewBuffer(nil)
-	cmd.Stdout = output
-	cmd.Stderr = output
-
-	if err := cmd.Start(); err != nil {
+	cmd, err := startChild(func() *exec.Cmd {
+		cmd := reexec.Command("storage-untar", dest, root)
+		cmd.Stdin = decompressedArchive
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		output.Reset()
+		cmd.Stdout = output
+		cmd.Stderr = output
+		return cmd
+	})
+	if err != nil {
 		w.Close()
 		return fmt.Errorf("Untar error on re-exec cmd: %v", err)
 	}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 
@@ -55,6 +56,10 @@ func applyLayer() {
 		options.InUserNS = true
 	}
 
+	if err := adjustOptionsForUserNS(options); err != nil {
+		fatal(err)
+	}
+
 	if tmpDir, err = ioutil.TempDir("/", "temp-storage-extract"); err != nil {
 		fatal(err)
 	}
@@ -107,14 +112,18 @@ func applyLayerHandler(dest string, layer io.Reader, options *archive.TarOptions
 		return 0, fmt.Errorf("ApplyLayer json encode: %v", err)
 	}
 
-	cmd := reexec.Command("storage-applyLayer", dest)
-	cmd.Stdin = layer
-	cmd.Env = append(cmd.Env, fmt.Sprintf("OPT=%s", data))
-
 	outBuf, errBuf := new(bytes.Buffer), new(bytes.Buffer)
-	cmd.Stdout, cmd.Stderr = outBuf, errBuf
-
-	if err = cmd.Run(); err != nil {
+	cmd, err := startChild(func() *exec.Cmd {
+		cmd := reexec.Command("storage-applyLayer", dest)
+		cmd.Stdin = layer
+		cmd.Env = append(cmd.Env, fmt.Sprintf("OPT=%s", data))
+		cmd.Stdout, cmd.Stderr = outBuf, errBuf
+		return cmd
+	})
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
 		return 0, fmt.Errorf("ApplyLayer %s stdout: %s stderr: %s", err, outBuf, errBuf)
 	}
 
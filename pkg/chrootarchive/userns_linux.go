@@ -0,0 +1,93 @@
+package chrootarchive
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/sirupsen/logrus"
+	"github.com/syndtr/gocapability/capability"
+)
+
+// userNSEnv is set in the environment of a child process which we started in
+// new user and mount namespaces, and holds our UID and GID, to which root in
+// the child's user namespace is mapped.
+const userNSEnv = "_CONTAINERS_STORAGE_CHROOTARCHIVE_USERNS"
+
+// needUserNS checks if we lack the privileges that we need to set up a mount
+// namespace and pivot_root into it, in which case a child process which
+// needs to do that should be started in a user namespace of its own.
+func needUserNS() bool {
+	caps, err := capability.NewPid(0)
+	if err != nil {
+		return false
+	}
+	return !caps.Get(capability.EFFECTIVE, capability.CAP_SYS_ADMIN)
+}
+
+// startChild starts the command returned by newCmd.  If we lack the privileges
+// needed to extract content safely, the command is started in new user and
+// mount namespaces, where it runs as root, mapped to our UID and GID.  If
+// that can't be done, the command is started normally.
+func startChild(newCmd func() *exec.Cmd) (*exec.Cmd, error) {
+	if needUserNS() {
+		uid, gid := os.Geteuid(), os.Getegid()
+		cmd := newCmd()
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d:%d", userNSEnv, uid, gid))
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+		}
+		err := cmd.Start()
+		if err == nil {
+			return cmd, nil
+		}
+		logrus.Debugf("Unable to start %v in a user namespace, trying without one: %v", cmd.Args, err)
+	}
+	cmd := newCmd()
+	return cmd, cmd.Start()
+}
+
+// namespaceRootMappings returns ID mappings which map the container ID which
+// corresponds to hostID in maps (or hostID itself, if maps is empty) to 0,
+// which is the only ID that can be used in a user namespace which we set up
+// without help from privileged tools.
+func namespaceRootMappings(maps []idtools.IDMap, hostID int) []idtools.IDMap {
+	if len(maps) == 0 {
+		return []idtools.IDMap{{ContainerID: hostID, HostID: 0, Size: 1}}
+	}
+	for _, m := range maps {
+		if hostID >= m.HostID && hostID < m.HostID+m.Size {
+			return []idtools.IDMap{{ContainerID: m.ContainerID + hostID - m.HostID, HostID: 0, Size: 1}}
+		}
+	}
+	return nil
+}
+
+// adjustOptionsForUserNS updates options for use in a child process which was
+// started in a user namespace by startChild, if this is one.  Content owned by
+// the user and group which started us is extracted as being owned by root in
+// the namespace, which is them.  Other IDs can't be represented, so attempts
+// to use them will fail, much as they would if we weren't in a namespace.
+func adjustOptionsForUserNS(options *archive.TarOptions) error {
+	ids := os.Getenv(userNSEnv)
+	if ids == "" {
+		return nil
+	}
+	os.Unsetenv(userNSEnv)
+	var uid, gid int
+	if _, err := fmt.Sscanf(ids, "%d:%d", &uid, &gid); err != nil {
+		return fmt.Errorf("parsing %s=%q: %v", userNSEnv, ids, err)
+	}
+	options.InUserNS = true
+	options.UIDMaps = namespaceRootMappings(options.UIDMaps, uid)
+	options.GIDMaps = namespaceRootMappings(options.GIDMaps, gid)
+	return nil
+}
@@ -0,0 +1,20 @@
+package chrootarchive
+
+import (
+	"testing"
+
+	"github.com/containers/storage/pkg/idtools"
+	"gotest.tools/assert"
+)
+
+func TestNamespaceRootMappings(t *testing.T) {
+	assert.DeepEqual(t, namespaceRootMappings(nil, 1000), []idtools.IDMap{{ContainerID: 1000, HostID: 0, Size: 1}})
+
+	maps := []idtools.IDMap{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+	assert.DeepEqual(t, namespaceRootMappings(maps, 1000), []idtools.IDMap{{ContainerID: 0, HostID: 0, Size: 1}})
+	assert.DeepEqual(t, namespaceRootMappings(maps, 100010), []idtools.IDMap{{ContainerID: 11, HostID: 0, Size: 1}})
+	assert.Assert(t, namespaceRootMappings(maps, 2000) == nil)
+}
@@ -0,0 +1,21 @@
+// +build !windows,!linux
+
+package chrootarchive
+
+import (
+	"os/exec"
+
+	"github.com/containers/storage/pkg/archive"
+)
+
+// startChild starts the command returned by newCmd.
+func startChild(newCmd func() *exec.Cmd) (*exec.Cmd, error) {
+	cmd := newCmd()
+	return cmd, cmd.Start()
+}
+
+// adjustOptionsForUserNS does nothing, since startChild never starts child
+// processes in user namespaces on this platform.
+func adjustOptionsForUserNS(options *archive.TarOptions) error {
+	return nil
+}
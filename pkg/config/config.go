@@ -56,6 +56,22 @@ type ThinpoolOptionsConfig struct {
 	// devices.
 	MountOpt string `toml:"mountopt,omitempty"`
 
+	// PoolAutoExtend runs lvextend to grow the thin pool when its usage
+	// rises above one of the watermarks.
+	PoolAutoExtend string `toml:"pool_autoextend,omitempty"`
+
+	// PoolDataWatermark is the percentage of the thin pool's data space
+	// which has to be used for it to be reported as filling up.
+	PoolDataWatermark string `toml:"pool_data_watermark,omitempty"`
+
+	// PoolMetadataWatermark is the percentage of the thin pool's
+	// metadata space which has to be used for it to be reported as
+	// filling up.
+	PoolMetadataWatermark string `toml:"pool_metadata_watermark,omitempty"`
+
+	// PoolMonitorInterval is how often the thin pool's usage is checked.
+	PoolMonitorInterval string `toml:"pool_monitor_interval,omitempty"`
+
 	// Size
 	Size string `toml:"size,omitempty"`
 
@@ -100,12 +116,50 @@ type OverlayOptionsConfig struct {
 	// ForceMask indicates the permissions mask (e.g. "0755") to use for new
 	// files and directories
 	ForceMask string `toml:"force_mask,omitempty"`
+	// FlattenDepth is the number of lower layers beyond which the
+	// lowermost ones are merged into a flattened layer
+	FlattenDepth string `toml:"flatten_depth,omitempty"`
+	// NetworkFSFallback is what to do if the backing file system is a
+	// network file system and no mount program is set: "none",
+	// "mount_program", or "vfs"
+	NetworkFSFallback string `toml:"network_fs_fallback,omitempty"`
+	// NetworkFSMountProgram is the mount program which is used when
+	// NetworkFSFallback is "mount_program"
+	NetworkFSMountProgram string `toml:"network_fs_mount_program,omitempty"`
+	// Fallback is a comma-separated list of what to try, in order, if
+	// native overlay can't be used: "mount_program" and/or "vfs"
+	Fallback string `toml:"fallback,omitempty"`
+	// FallbackMountProgram is the mount program which is tried when
+	// Fallback includes "mount_program"
+	FallbackMountProgram string `toml:"fallback_mount_program,omitempty"`
+	// QuotaFallback is how size limits are enforced if project quotas
+	// aren't available: "none" or "poll"
+	QuotaFallback string `toml:"quota_fallback,omitempty"`
+	// QuotaPollInterval is how often disk usage is checked when
+	// QuotaFallback is "poll"
+	QuotaPollInterval string `toml:"quota_poll_interval,omitempty"`
+	// QuotaHook is a program which is run when a layer is found to be
+	// over its limits when QuotaFallback is "poll"
+	QuotaHook string `toml:"quota_hook,omitempty"`
+	// WritableImageStore is a directory, separate from the graph root,
+	// in which read-only layers can be created if callers ask for it
+	WritableImageStore string `toml:"writable_imagestore,omitempty"`
+	// MountPropagation is the propagation of the driver's home directory
+	// and, by default, of layers' mountpoints: "private", "rshared", or
+	// "rslave"
+	MountPropagation string `toml:"mount_propagation,omitempty"`
 }
 
 type VfsOptionsConfig struct {
 	// IgnoreChownErrors is a flag for whether chown errors should be
 	// ignored when building an image.
 	IgnoreChownErrors string `toml:"ignore_chown_errors,omitempty"`
+	// PristineCompression is how read-only layers are compressed once
+	// new layers have been created from them: "none", "gzip", or "zstd"
+	PristineCompression string `toml:"pristine_compression,omitempty"`
+	// PristineCacheDir is where compressed layers are unpacked when
+	// they're needed
+	PristineCacheDir string `toml:"pristine_cache_dir,omitempty"`
 }
 
 type ZfsOptionsConfig struct {
@@ -124,6 +178,25 @@ type OptionsConfig struct {
 	// for shared image content
 	AdditionalImageStores []string `toml:"additionalimagestores,omitempty"`
 
+	// AdditionalImageStoreTokens maps the locations of additional image
+	// stores to the tokens which grant access to them
+	AdditionalImageStoreTokens map[string]string `toml:"additionalimagestoretokens,omitempty"`
+
+	// AdditionalImageStorePriorities maps the locations of additional
+	// image stores to their priorities.  Stores with higher priorities
+	// are searched first.
+	AdditionalImageStorePriorities map[string]int `toml:"additionalimagestorepriorities,omitempty"`
+
+	// AdditionalImageStoreMountPrograms maps the locations of additional
+	// image stores to the mount programs which are used to mount layers
+	// whose lower layers are in them, in place of MountProgram.
+	AdditionalImageStoreMountPrograms map[string]string `toml:"additionalimagestoremountprograms,omitempty"`
+
+	// AdditionalImageStoreMountOpts maps the locations of additional
+	// image stores to extra mount options which are used when mounting
+	// layers whose lower layers are in them.
+	AdditionalImageStoreMountOpts map[string]string `toml:"additionalimagestoremountopts,omitempty"`
+
 	// AdditionalLayerStores is the location of additional read/only
 	// Layer stores.  Usually used to access Networked File System
 	// for shared image content
@@ -198,6 +271,44 @@ type OptionsConfig struct {
 
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `toml:"disable-volatile,omitempty"`
+
+	// Durability is the name of the profile which controls how metadata
+	// files are synced to disk when they are saved: "default", "none",
+	// "batched", or "strict".
+	Durability string `toml:"durability,omitempty"`
+
+	// DurabilityBatchWindow is how long a save made using the "batched"
+	// durability profile waits for other saves to join it, e.g. "10ms".
+	DurabilityBatchWindow string `toml:"durability_batch_window,omitempty"`
+
+	// ReadOnly opens the store for use with a graph root which was
+	// populated ahead of time, and refuses to modify it.
+	ReadOnly bool `toml:"read_only,omitempty"`
+
+	// HardlinkDedup replaces files in newly-added image layers with hard
+	// links to identical files in layers which are already present.
+	HardlinkDedup bool `toml:"hardlink_dedup,omitempty"`
+
+	// ContainerRecordsLog appends changes to the records of containers
+	// to a log instead of rewriting all of them every time.
+	ContainerRecordsLog bool `toml:"container_records_log,omitempty"`
+
+	// TrackLayerChanges keeps journals of the paths which are modified in
+	// read-write layers while they're mounted.
+	TrackLayerChanges bool `toml:"track_layer_changes,omitempty"`
+
+	// ReservedSpace is the amount of space, e.g. "2GB", which should be
+	// kept free on the filesystem which holds layers' contents.
+	ReservedSpace string `toml:"reserved_space,omitempty"`
+
+	// DigestAlgorithm is an algorithm which a new store uses to compute
+	// digests of the uncompressed contents of layers, in addition to the
+	// sha256 digests which are used as their DiffIDs.
+	DigestAlgorithm string `toml:"digest_algorithm,omitempty"`
+
+	// DeleteWorkers is the number of layers whose contents are removed
+	// in parallel, in the background, after they're deleted.
+	DeleteWorkers int `toml:"delete_workers,omitempty"`
 }
 
 // GetGraphDriverOptions returns the driver specific options
@@ -261,6 +372,19 @@ func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
 			doptions = append(doptions, fmt.Sprintf("%s.mountopt=%s", driverName, options.MountOpt))
 		}
 
+		if options.Thinpool.PoolAutoExtend != "" {
+			doptions = append(doptions, fmt.Sprintf("dm.pool_autoextend=%s", options.Thinpool.PoolAutoExtend))
+		}
+		if options.Thinpool.PoolDataWatermark != "" {
+			doptions = append(doptions, fmt.Sprintf("dm.pool_data_watermark=%s", options.Thinpool.PoolDataWatermark))
+		}
+		if options.Thinpool.PoolMetadataWatermark != "" {
+			doptions = append(doptions, fmt.Sprintf("dm.pool_metadata_watermark=%s", options.Thinpool.PoolMetadataWatermark))
+		}
+		if options.Thinpool.PoolMonitorInterval != "" {
+			doptions = append(doptions, fmt.Sprintf("dm.pool_monitor_interval=%s", options.Thinpool.PoolMonitorInterval))
+		}
+
 		if options.Thinpool.Size != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.size=%s", driverName, options.Thinpool.Size))
 		} else if options.Size != "" {
@@ -311,12 +435,48 @@ func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
 		} else if options.ForceMask != 0 {
 			doptions = append(doptions, fmt.Sprintf("%s.force_mask=%s", driverName, options.ForceMask))
 		}
+		if options.Overlay.FlattenDepth != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.flatten_depth=%s", driverName, options.Overlay.FlattenDepth))
+		}
+		if options.Overlay.NetworkFSFallback != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.network_fs_fallback=%s", driverName, options.Overlay.NetworkFSFallback))
+		}
+		if options.Overlay.NetworkFSMountProgram != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.network_fs_mount_program=%s", driverName, options.Overlay.NetworkFSMountProgram))
+		}
+		if options.Overlay.Fallback != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.fallback=%s", driverName, options.Overlay.Fallback))
+		}
+		if options.Overlay.FallbackMountProgram != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.fallback_mount_program=%s", driverName, options.Overlay.FallbackMountProgram))
+		}
+		if options.Overlay.QuotaFallback != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.quota_fallback=%s", driverName, options.Overlay.QuotaFallback))
+		}
+		if options.Overlay.QuotaPollInterval != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.quota_poll_interval=%s", driverName, options.Overlay.QuotaPollInterval))
+		}
+		if options.Overlay.QuotaHook != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.quota_hook=%s", driverName, options.Overlay.QuotaHook))
+		}
+		if options.Overlay.WritableImageStore != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.writable_imagestore=%s", driverName, options.Overlay.WritableImageStore))
+		}
+		if options.Overlay.MountPropagation != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.mount_propagation=%s", driverName, options.Overlay.MountPropagation))
+		}
 	case "vfs":
 		if options.Vfs.IgnoreChownErrors != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.ignore_chown_errors=%s", driverName, options.Vfs.IgnoreChownErrors))
 		} else if options.IgnoreChownErrors != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.ignore_chown_errors=%s", driverName, options.IgnoreChownErrors))
 		}
+		if options.Vfs.PristineCompression != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.pristine_compression=%s", driverName, options.Vfs.PristineCompression))
+		}
+		if options.Vfs.PristineCacheDir != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.pristine_cache_dir=%s", driverName, options.Vfs.PristineCacheDir))
+		}
 
 	case "zfs":
 		if options.Zfs.Name != "" {
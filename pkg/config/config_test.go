@@ -124,6 +124,13 @@ func TestDeviceMapperOptions(t *testing.T) {
 		t.Fatalf("Expected to find size %q, got %v", s100, doptions)
 	}
 
+	options = OptionsConfig{}
+	options.Thinpool.PoolMonitorInterval = "30s"
+	options.Thinpool.PoolDataWatermark = "90"
+	doptions = GetGraphDriverOptions("devicemapper", options)
+	if !searchOptions(doptions, "dm.pool_monitor_interval=30s") || !searchOptions(doptions, "dm.pool_data_watermark=90") {
+		t.Fatalf("Expected to find pool monitor options, got %v", doptions)
+	}
 }
 
 func TestBtrfsOptions(t *testing.T) {
@@ -244,6 +251,37 @@ func TestOverlayOptions(t *testing.T) {
 	if !searchOptions(doptions, "mount_program=/usr/bin/fuse_overlay") {
 		t.Fatalf("Expected to find 'fuse_overlay' options, got %v", doptions)
 	}
+	options.Overlay.NetworkFSFallback = "vfs"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "network_fs_fallback=vfs") {
+		t.Fatalf("Expected to find 'network_fs_fallback' options, got %v", doptions)
+	}
+	options.Overlay.Fallback = "mount_program,vfs"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "fallback=mount_program,vfs") {
+		t.Fatalf("Expected to find 'fallback' options, got %v", doptions)
+	}
+	options.Overlay.Inodes = "1000"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "inodes=1000") {
+		t.Fatalf("Expected to find 'inodes' options, got %v", doptions)
+	}
+	options.Overlay.QuotaFallback = "poll"
+	options.Overlay.QuotaPollInterval = "30s"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "quota_fallback=poll") || !searchOptions(doptions, "quota_poll_interval=30s") {
+		t.Fatalf("Expected to find 'quota_fallback' and 'quota_poll_interval' options, got %v", doptions)
+	}
+	options.Overlay.WritableImageStore = "/var/lib/imagestore"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "writable_imagestore=/var/lib/imagestore") {
+		t.Fatalf("Expected to find 'writable_imagestore' options, got %v", doptions)
+	}
+	options.Overlay.MountPropagation = "rslave"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "mount_propagation=rslave") {
+		t.Fatalf("Expected to find 'mount_propagation' options, got %v", doptions)
+	}
 	options.Overlay.SkipMountHome = "true"
 	doptions = GetGraphDriverOptions("overlay", options)
 	if len(doptions) == 0 {
@@ -310,6 +348,11 @@ func TestVfsOptions(t *testing.T) {
 	if len(doptions) == 0 {
 		t.Fatalf("Expected 1 options, got %v", doptions)
 	}
+	options.Vfs.PristineCompression = "zstd"
+	doptions = GetGraphDriverOptions("vfs", options)
+	if !searchOptions(doptions, "pristine_compression=zstd") {
+		t.Fatalf("Expected to find 'pristine_compression' options, got %v", doptions)
+	}
 }
 
 func TestZfsOptions(t *testing.T) {
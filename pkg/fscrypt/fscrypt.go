@@ -0,0 +1,30 @@
+// Package fscrypt encrypts the contents of directories using the Linux
+// kernel's file system encryption support, with version 2 encryption
+// policies.
+package fscrypt
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+// KeySize is the size of the keys which are used to encrypt directories.
+const KeySize = 64
+
+// ErrNotSupported is returned when the file system which holds a directory
+// doesn't support encryption.
+var ErrNotSupported = errors.New("file system encryption is not supported")
+
+// KeyProvider returns the key with the specified ID, which must be KeySize
+// bytes long.  Applications which want the contents of layers to be
+// encrypted supply one, since the keys are never written to disk.
+type KeyProvider func(keyID string) ([]byte, error)
+
+// Identifier is the identifier which the kernel computes for a key which has
+// been added to a file system.
+type Identifier [16]byte
+
+// String returns the identifier in hexadecimal form.
+func (i Identifier) String() string {
+	return hex.EncodeToString(i[:])
+}
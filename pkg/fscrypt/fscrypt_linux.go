@@ -0,0 +1,107 @@
+package fscrypt
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// addKeyArg is the argument to FS_IOC_ADD_ENCRYPTION_KEY, which the raw key
+// immediately follows.
+type addKeyArg struct {
+	unix.FscryptAddKeyArg
+	raw [KeySize]byte
+}
+
+// ioctl opens path and performs an ioctl on it, translating the errors which
+// mean that encryption isn't supported into ErrNotSupported.
+func ioctl(path string, request uintptr, arg unsafe.Pointer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), request, uintptr(arg))
+	switch errno {
+	case 0:
+		return nil
+	case unix.EOPNOTSUPP, unix.ENOTTY:
+		return errors.Wrapf(ErrNotSupported, "%s", path)
+	}
+	return &os.PathError{Op: "ioctl", Path: path, Err: errno}
+}
+
+// AddKey adds key to the file system which holds path, so that directories
+// on it can be encrypted with it, and the contents of directories which were
+// encrypted with it can be read, and returns the key's identifier.  Adding a
+// key which has already been added is not an error.
+func AddKey(path string, key []byte) (Identifier, error) {
+	var id Identifier
+	if len(key) != KeySize {
+		return id, fmt.Errorf("encryption keys must be %d bytes long, not %d", KeySize, len(key))
+	}
+	var arg addKeyArg
+	defer func() {
+		for i := range arg.raw {
+			arg.raw[i] = 0
+		}
+	}()
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = KeySize
+	copy(arg.raw[:], key)
+	if err := ioctl(path, unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(&arg)); err != nil {
+		return id, errors.Wrapf(err, "adding encryption key")
+	}
+	copy(id[:], arg.Key_spec.U[:len(id)])
+	return id, nil
+}
+
+// SetPolicy encrypts the contents of dir, which must be empty, using the key
+// with the specified identifier, which must have been added to the file
+// system which holds it.  Everything which is subsequently created in dir is
+// encrypted with the same key.
+func SetPolicy(dir string, id Identifier) error {
+	policy := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+		Master_key_identifier:     id,
+	}
+	if err := ioctl(dir, unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&policy)); err != nil {
+		return errors.Wrapf(err, "encrypting %q", dir)
+	}
+	return nil
+}
+
+// Policy returns the identifier of the key which is used to encrypt the
+// contents of dir, and false if they aren't encrypted.
+func Policy(dir string) (Identifier, bool, error) {
+	var id Identifier
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(unsafe.Sizeof(unix.FscryptPolicyV2{}))}
+	err := ioctl(dir, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg))
+	if err != nil {
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, ErrNotSupported) {
+			return id, false, nil
+		}
+		return id, false, err
+	}
+	policy := (*unix.FscryptPolicyV2)(unsafe.Pointer(&arg.Policy[0]))
+	if policy.Version != unix.FSCRYPT_POLICY_V2 {
+		return id, false, fmt.Errorf("%q is encrypted using an unsupported version %d policy", dir, policy.Version)
+	}
+	return policy.Master_key_identifier, true, nil
+}
+
+// EncryptDirectory adds key to the file system which holds dir, which must be
+// empty, and encrypts dir's contents with it.
+func EncryptDirectory(dir string, key []byte) error {
+	id, err := AddKey(dir, key)
+	if err != nil {
+		return err
+	}
+	return SetPolicy(dir, id)
+}
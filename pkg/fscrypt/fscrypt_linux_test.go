@@ -0,0 +1,49 @@
+package fscrypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEncryptDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, encrypted, err := Policy(dir); err != nil || encrypted {
+		t.Fatalf("expected %q to not be encrypted: %v", dir, err)
+	}
+	if _, err := AddKey(dir, []byte("short")); err == nil {
+		t.Fatalf("expected an error adding a key which is too short")
+	}
+
+	key := bytes.Repeat([]byte{0x5a}, KeySize)
+	encrypted := filepath.Join(dir, "encrypted")
+	if err := os.Mkdir(encrypted, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptDirectory(encrypted, key); err != nil {
+		if errors.Is(err, ErrNotSupported) || os.IsPermission(errors.Cause(err)) {
+			t.Skipf("encryption is not available here: %v", err)
+		}
+		t.Fatal(err)
+	}
+	id, ok, err := Policy(encrypted)
+	if err != nil || !ok {
+		t.Fatalf("expected %q to be encrypted: %v", encrypted, err)
+	}
+	added, err := AddKey(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != added {
+		t.Fatalf("expected %q to be encrypted with key %s, not %s", encrypted, added, id)
+	}
+}
@@ -0,0 +1,26 @@
+// +build !linux
+
+package fscrypt
+
+// AddKey adds key to the file system which holds path.
+func AddKey(path string, key []byte) (Identifier, error) {
+	return Identifier{}, ErrNotSupported
+}
+
+// SetPolicy encrypts the contents of dir using the key with the specified
+// identifier.
+func SetPolicy(dir string, id Identifier) error {
+	return ErrNotSupported
+}
+
+// Policy returns the identifier of the key which is used to encrypt the
+// contents of dir, and false if they aren't encrypted.
+func Policy(dir string) (Identifier, bool, error) {
+	return Identifier{}, false, nil
+}
+
+// EncryptDirectory adds key to the file system which holds dir, and encrypts
+// dir's contents with it.
+func EncryptDirectory(dir string, key []byte) error {
+	return ErrNotSupported
+}
@@ -1,10 +1,13 @@
 package ioutils
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
 // AtomicFileWriterOptions specifies options for creating the atomic file writer.
@@ -14,6 +17,20 @@ type AtomicFileWriterOptions struct {
 	// storage after it has been written and before it is moved to
 	// the specified path.
 	NoSync bool
+	// Durability selects how the file, and the directory which contains
+	// it, are synced when the file is committed.  It is ignored if NoSync
+	// is set.
+	Durability Durability
+	// BatchWindow is how long a commit made with DurabilityBatched waits
+	// for other commits to join it.  If it is not set,
+	// DefaultBatchWindow is used.
+	BatchWindow time.Duration
+	// TempDir, if set, is the directory in which the file is written
+	// before it is committed, in place of the directory which will
+	// contain it.  If the two directories are on different file systems,
+	// the file is copied next to its destination before it is renamed
+	// into place.
+	TempDir string
 }
 
 var defaultWriterOptions AtomicFileWriterOptions = AtomicFileWriterOptions{}
@@ -24,26 +41,48 @@ func SetDefaultOptions(opts AtomicFileWriterOptions) {
 	defaultWriterOptions = opts
 }
 
+// DefaultOptions returns the default options used when creating an atomic
+// file writer.
+func DefaultOptions() AtomicFileWriterOptions {
+	return defaultWriterOptions
+}
+
+// SyncDir syncs a directory, so that changes to its entries, such as files
+// which were created, linked, or renamed in it, aren't lost if the system
+// crashes.  It does nothing on platforms which can't sync directories.
+func SyncDir(dir string) error {
+	return syncDir(dir)
+}
+
 // NewAtomicFileWriterWithOpts returns WriteCloser so that writing to it writes to a
 // temporary file and closing it atomically changes the temporary file to
 // destination path. Writing and closing concurrently is not allowed.
 func NewAtomicFileWriterWithOpts(filename string, perm os.FileMode, opts *AtomicFileWriterOptions) (io.WriteCloser, error) {
-	f, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-"+filepath.Base(filename))
-	if err != nil {
-		return nil, err
-	}
 	if opts == nil {
 		opts = &defaultWriterOptions
 	}
+	dir := filepath.Dir(filename)
+	if opts.TempDir != "" {
+		dir = opts.TempDir
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-"+filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
 	abspath, err := filepath.Abs(filename)
 	if err != nil {
 		return nil, err
 	}
+	durability := opts.Durability
+	if opts.NoSync {
+		durability = DurabilityNone
+	}
 	return &atomicFileWriter{
-		f:      f,
-		fn:     abspath,
-		perm:   perm,
-		noSync: opts.NoSync,
+		f:           f,
+		fn:          abspath,
+		perm:        perm,
+		durability:  durability,
+		batchWindow: opts.BatchWindow,
 	}, nil
 }
 
@@ -71,12 +110,38 @@ func AtomicWriteFile(filename string, data []byte, perm os.FileMode) error {
 	return err
 }
 
+// AtomicWriteFileFromReader atomically writes the contents of r to a file
+// named by filename, and returns the number of bytes that it wrote.  If
+// reading from r fails, the file is left as it was.
+func AtomicWriteFileFromReader(filename string, r io.Reader, perm os.FileMode) (int64, error) {
+	return AtomicWriteFileFromReaderWithOpts(filename, r, perm, nil)
+}
+
+// AtomicWriteFileFromReaderWithOpts is like AtomicWriteFileFromReader, but
+// uses the specified options for the writer, or the default options if opts
+// is nil.
+func AtomicWriteFileFromReaderWithOpts(filename string, r io.Reader, perm os.FileMode, opts *AtomicFileWriterOptions) (int64, error) {
+	f, err := NewAtomicFileWriterWithOpts(filename, perm, opts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.(*atomicFileWriter).writeErr = err
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return n, err
+}
+
 type atomicFileWriter struct {
-	f        *os.File
-	fn       string
-	writeErr error
-	perm     os.FileMode
-	noSync   bool
+	f           *os.File
+	fn          string
+	writeErr    error
+	perm        os.FileMode
+	durability  Durability
+	batchWindow time.Duration
 }
 
 func (w *atomicFileWriter) Write(dt []byte) (int, error) {
@@ -88,12 +153,13 @@ func (w *atomicFileWriter) Write(dt []byte) (int, error) {
 }
 
 func (w *atomicFileWriter) Close() (retErr error) {
+	name := w.f.Name()
 	defer func() {
 		if retErr != nil || w.writeErr != nil {
-			os.Remove(w.f.Name())
+			os.Remove(name)
 		}
 	}()
-	if !w.noSync {
+	if w.durability == DurabilityDefault || w.durability == DurabilityStrict {
 		if err := fdatasync(w.f); err != nil {
 			w.f.Close()
 			return err
@@ -102,13 +168,85 @@ func (w *atomicFileWriter) Close() (retErr error) {
 	if err := w.f.Close(); err != nil {
 		return err
 	}
-	if err := os.Chmod(w.f.Name(), w.perm); err != nil {
+	if err := os.Chmod(name, w.perm); err != nil {
 		return err
 	}
-	if w.writeErr == nil {
-		return os.Rename(w.f.Name(), w.fn)
+	if w.writeErr != nil {
+		return nil
+	}
+	if filepath.Dir(name) != filepath.Dir(w.fn) {
+		moved, err := moveBeside(name, w.fn, w.perm, w.durability)
+		if err != nil {
+			return err
+		}
+		name = moved
+	}
+	switch w.durability {
+	case DurabilityBatched:
+		return commitBatched(name, w.fn, w.batchWindow)
+	case DurabilityStrict:
+		if err := os.Rename(name, w.fn); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(w.fn))
+	}
+	return os.Rename(name, w.fn)
+}
+
+// moveBeside moves src, a temporary file which was written in a directory
+// other than the one which will contain fn, into fn's directory, so that it
+// can be renamed into place atomically, and returns its new name.  If the
+// directories are on different file systems, src's contents are copied
+// instead, and src is removed.
+func moveBeside(src, fn string, perm os.FileMode, durability Durability) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".tmp-"+filepath.Base(fn))
+	if err != nil {
+		return "", err
+	}
+	dst := f.Name()
+	f.Close()
+	err = os.Rename(src, dst)
+	if err == nil {
+		return dst, nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		os.Remove(dst)
+		return "", err
+	}
+	if err := copyFileContents(src, dst, perm, durability); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	os.Remove(src)
+	return dst, nil
+}
+
+// copyFileContents copies the contents of src into dst, which already
+// exists, and syncs them if durability calls for it.
+func copyFileContents(src, dst string, perm os.FileMode, durability Durability) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if durability == DurabilityDefault || durability == DurabilityStrict {
+		if err := fdatasync(out); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
 	}
-	return nil
+	return os.Chmod(dst, perm)
 }
 
 // AtomicWriteSet is used to atomically write a set
@@ -0,0 +1,164 @@
+package ioutils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Durability selects how much work is done to ensure that a file written by
+// an atomic file writer survives a crash once the writer has been closed.
+type Durability int
+
+const (
+	// DurabilityDefault syncs the file's contents before renaming it into
+	// place.
+	DurabilityDefault Durability = iota
+	// DurabilityNone skips syncing entirely.  It is equivalent to setting
+	// NoSync.
+	DurabilityNone
+	// DurabilityBatched syncs the file's contents before renaming it into
+	// place and syncs its directory afterward, but it does so for every
+	// file which is committed within a short window at the same time,
+	// once per file and once per directory.  If the same file is written
+	// more than once during the window, only the last version is synced
+	// and renamed into place.  Closing the writer blocks until the batch
+	// has been committed.
+	DurabilityBatched
+	// DurabilityStrict syncs the file's contents before renaming it into
+	// place, and syncs its directory afterward.
+	DurabilityStrict
+)
+
+// DefaultBatchWindow is how long a commit made with DurabilityBatched waits
+// for other commits to join it, if no window is specified.
+const DefaultBatchWindow = 10 * time.Millisecond
+
+var durabilityNames = map[Durability]string{
+	DurabilityDefault: "default",
+	DurabilityNone:    "none",
+	DurabilityBatched: "batched",
+	DurabilityStrict:  "strict",
+}
+
+func (d Durability) String() string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseDurability returns the Durability with the specified name.  An empty
+// name selects DurabilityDefault.
+func ParseDurability(name string) (Durability, error) {
+	if name == "" {
+		return DurabilityDefault, nil
+	}
+	for d, n := range durabilityNames {
+		if strings.EqualFold(n, name) {
+			return d, nil
+		}
+	}
+	return DurabilityDefault, errors.Errorf("unknown durability profile %q", name)
+}
+
+// batchedCommit is a request to rename a temporary file into place.
+type batchedCommit struct {
+	tmpfile string
+	target  string
+	done    chan error
+}
+
+// commitBatch is a set of commits which will be synced and renamed together.
+type commitBatch struct {
+	commits []*batchedCommit
+}
+
+var (
+	batchLock    sync.Mutex
+	pendingBatch *commitBatch
+)
+
+// commitBatched arranges for tmpfile to be synced and renamed to target along
+// with any other files which are committed within window, and waits for that
+// to happen.
+func commitBatched(tmpfile, target string, window time.Duration) error {
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+	c := &batchedCommit{
+		tmpfile: tmpfile,
+		target:  target,
+		done:    make(chan error, 1),
+	}
+	batchLock.Lock()
+	if pendingBatch == nil {
+		b := &commitBatch{}
+		pendingBatch = b
+		time.AfterFunc(window, func() {
+			batchLock.Lock()
+			if pendingBatch == b {
+				pendingBatch = nil
+			}
+			batchLock.Unlock()
+			b.commit()
+		})
+	}
+	pendingBatch.commits = append(pendingBatch.commits, c)
+	batchLock.Unlock()
+	return <-c.done
+}
+
+// commit syncs and renames the latest version of each file in the batch,
+// then syncs the directories which contain them, and reports the results to
+// the waiting writers.  Superseded versions are discarded, and their writers
+// get the results for the version which replaced them.
+func (b *commitBatch) commit() {
+	latest := make(map[string]*batchedCommit)
+	for _, c := range b.commits {
+		latest[c.target] = c
+	}
+	results := make(map[string]error)
+	dirs := make(map[string][]string)
+	for target, c := range latest {
+		err := syncFile(c.tmpfile)
+		if err == nil {
+			err = os.Rename(c.tmpfile, target)
+		}
+		results[target] = err
+		if err == nil {
+			dir := filepath.Dir(target)
+			dirs[dir] = append(dirs[dir], target)
+		}
+	}
+	for dir, targets := range dirs {
+		if err := syncDir(dir); err != nil {
+			for _, target := range targets {
+				results[target] = err
+			}
+		}
+	}
+	for _, c := range b.commits {
+		if latest[c.target] != c {
+			os.Remove(c.tmpfile)
+		}
+		c.done <- results[c.target]
+	}
+}
+
+// syncFile syncs the contents of the named file.
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = fdatasync(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
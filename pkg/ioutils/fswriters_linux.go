@@ -9,3 +9,15 @@ import (
 func fdatasync(f *os.File) error {
 	return unix.Fdatasync(int(f.Fd()))
 }
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = unix.Fsync(int(d.Fd()))
+	if err1 := d.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
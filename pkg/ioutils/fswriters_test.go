@@ -2,11 +2,16 @@ package ioutils
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var (
@@ -50,6 +55,98 @@ func TestAtomicWriteToFile(t *testing.T) {
 	}
 }
 
+func TestAtomicWriteFileFromReader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atomic-writers-test")
+	if err != nil {
+		t.Fatalf("Error when creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "foo")
+
+	expected := []byte("barbaz")
+	n, err := AtomicWriteFileFromReader(filename, bytes.NewReader(expected), testMode)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v", err)
+	}
+	if n != int64(len(expected)) {
+		t.Fatalf("Expected %d bytes to be written, got %d", len(expected), n)
+	}
+
+	// A failure to read leaves the file's contents alone.
+	failing := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.TimeoutReader(bytes.NewReader([]byte("x"))))
+	if _, err := AtomicWriteFileFromReader(filename, failing, testMode); err == nil {
+		t.Fatalf("Expected an error when the reader fails")
+	}
+	actual, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading from file: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Fatalf("Data mismatch, expected %q, got %q", expected, actual)
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected the temporary file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestAtomicWriteFileTempDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atomic-writers-test")
+	if err != nil {
+		t.Fatalf("Error when creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	scratchDirs := []string{filepath.Join(tmpDir, "scratch")}
+	if err := os.Mkdir(scratchDirs[0], 0700); err != nil {
+		t.Fatalf("Error creating scratch directory: %v", err)
+	}
+	// /dev/shm is usually on a different file system, which forces the
+	// writer to copy the file instead of renaming it.
+	if shmDir, err := ioutil.TempDir("/dev/shm", "atomic-writers-test"); err == nil {
+		defer os.RemoveAll(shmDir)
+		scratchDirs = append(scratchDirs, shmDir)
+	}
+	filename := filepath.Join(tmpDir, "foo")
+	for _, scratchDir := range scratchDirs {
+		expected := []byte("barbaz " + scratchDir)
+		opts := &AtomicFileWriterOptions{TempDir: scratchDir}
+		if _, err := AtomicWriteFileFromReaderWithOpts(filename, bytes.NewReader(expected), testMode, opts); err != nil {
+			t.Fatalf("Error writing to file using %q: %v", scratchDir, err)
+		}
+		actual, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Error reading from file: %v", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("Data mismatch, expected %q, got %q", expected, actual)
+		}
+		st, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("Error statting file: %v", err)
+		}
+		if expected := os.FileMode(testMode); st.Mode() != expected {
+			t.Fatalf("Mode mismatched, expected %o, got %o", expected, st.Mode())
+		}
+		entries, err := ioutil.ReadDir(scratchDir)
+		if err != nil {
+			t.Fatalf("Error reading directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("Expected the temporary file to be removed from %q, found %d files", scratchDir, len(entries))
+		}
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected only the file and the scratch directory, found %d files", len(entries))
+	}
+}
+
 func TestAtomicWriteSetCommit(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "atomic-writerset-test")
 	if err != nil {
@@ -130,3 +227,104 @@ func TestAtomicWriteSetCancel(t *testing.T) {
 		t.Fatalf("Unexpected error reading file: %s", err)
 	}
 }
+
+func TestAtomicWriteFileDurability(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atomic-writers-durability-test")
+	if err != nil {
+		t.Fatalf("Error when creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, durability := range []Durability{DurabilityDefault, DurabilityNone, DurabilityBatched, DurabilityStrict} {
+		parsed, err := ParseDurability(durability.String())
+		if err != nil {
+			t.Fatalf("Error parsing durability %q: %v", durability, err)
+		}
+		if parsed != durability {
+			t.Fatalf("Durability mismatch, expected %q, got %q", durability, parsed)
+		}
+		filename := filepath.Join(tmpDir, durability.String())
+		expected := []byte(durability.String())
+		opts := AtomicFileWriterOptions{Durability: durability}
+		f, err := NewAtomicFileWriterWithOpts(filename, testMode, &opts)
+		if err != nil {
+			t.Fatalf("Error creating writer: %v", err)
+		}
+		if _, err := f.Write(expected); err != nil {
+			t.Fatalf("Error writing to file: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Error closing file: %v", err)
+		}
+		actual, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Error reading from file: %v", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("Data mismatch, expected %q, got %q", expected, actual)
+		}
+	}
+	if _, err := ParseDurability("sometimes"); err == nil {
+		t.Fatalf("Expected an error parsing an unknown durability profile")
+	}
+}
+
+func TestAtomicWriteFileBatched(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atomic-writers-batched-test")
+	if err != nil {
+		t.Fatalf("Error when creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := AtomicFileWriterOptions{Durability: DurabilityBatched, BatchWindow: 50 * time.Millisecond}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Half of the writers share a file, so their commits
+			// will be coalesced.
+			name := filepath.Join(tmpDir, fmt.Sprintf("file-%d", i))
+			if i%2 == 0 {
+				name = filepath.Join(tmpDir, "shared")
+			}
+			f, err := NewAtomicFileWriterWithOpts(name, testMode, &opts)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := f.Write([]byte(name)); err != nil {
+				f.Close()
+				errs <- err
+				return
+			}
+			errs <- f.Close()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(entries) != 9 {
+		t.Fatalf("Expected 9 files to be left after coalescing writes, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		name := filepath.Join(tmpDir, entry.Name())
+		actual, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Error reading from file: %v", err)
+		}
+		if string(actual) != name {
+			t.Fatalf("Data mismatch, expected %q, got %q", name, actual)
+		}
+	}
+}
@@ -9,3 +9,9 @@ import (
 func fdatasync(f *os.File) error {
 	return f.Sync()
 }
+
+// syncDir does nothing here, since not every platform supports syncing a
+// directory.
+func syncDir(dir string) error {
+	return nil
+}
@@ -1,6 +1,9 @@
 package ioutils
 
-import "io"
+import (
+	"errors"
+	"io"
+)
 
 // NopWriter represents a type which write operation is nop.
 type NopWriter struct{}
@@ -64,3 +67,93 @@ func (wc *WriteCounter) Write(p []byte) (count int, err error) {
 	wc.Count += int64(count)
 	return
 }
+
+// asyncWriterChunkSize is how much data an AsyncWriter collects before
+// handing it to its goroutine.
+const asyncWriterChunkSize = 256 * 1024
+
+// asyncWriterQueueLength is how many chunks an AsyncWriter lets pile up
+// before Write() waits for its goroutine to catch up.
+const asyncWriterQueueLength = 16
+
+// AsyncWriter passes the data which is written to it on to another writer in
+// a goroutine of its own, so that a slow writer, such as a hash, doesn't hold
+// up whoever is producing the data.  Data is written in the order in which
+// it was received.  Close must be called to wait for all of the data to be
+// written, and it reports any error which the other writer returned.
+type AsyncWriter struct {
+	writer io.Writer
+	queue  chan []byte
+	free   chan []byte
+	done   chan struct{}
+	buf    []byte
+	err    error
+	closed bool
+}
+
+// NewAsyncWriter returns an AsyncWriter which writes to w.
+func NewAsyncWriter(w io.Writer) *AsyncWriter {
+	a := &AsyncWriter{
+		writer: w,
+		queue:  make(chan []byte, asyncWriterQueueLength),
+		free:   make(chan []byte, asyncWriterQueueLength+1),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+	for chunk := range a.queue {
+		if a.err == nil {
+			_, a.err = a.writer.Write(chunk)
+		}
+		select {
+		case a.free <- chunk[:0]:
+		default:
+		}
+	}
+}
+
+// Write queues a copy of p to be written.  It only fails if the AsyncWriter
+// has been closed.
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	if a.closed {
+		return 0, errors.New("write to closed AsyncWriter")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if a.buf == nil {
+			select {
+			case a.buf = <-a.free:
+			default:
+				a.buf = make([]byte, 0, asyncWriterChunkSize)
+			}
+		}
+		copied := copy(a.buf[len(a.buf):cap(a.buf)], p)
+		a.buf = a.buf[:len(a.buf)+copied]
+		p = p[copied:]
+		if len(a.buf) == cap(a.buf) {
+			a.queue <- a.buf
+			a.buf = nil
+		}
+	}
+	return n, nil
+}
+
+// Close waits for all of the data which was written to the AsyncWriter to be
+// written to the writer which it wraps, and returns the first error which
+// that writer returned.  It can be called more than once.
+func (a *AsyncWriter) Close() error {
+	if !a.closed {
+		a.closed = true
+		if len(a.buf) > 0 {
+			a.queue <- a.buf
+			a.buf = nil
+		}
+		close(a.queue)
+	}
+	<-a.done
+	return a.err
+}
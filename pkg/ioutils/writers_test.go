@@ -2,6 +2,7 @@ package ioutils
 
 import (
 	"bytes"
+	"errors"
 	"strings"
 	"testing"
 )
@@ -63,3 +64,46 @@ func TestWriteCounter(t *testing.T) {
 		t.Error("Wrong message written")
 	}
 }
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestAsyncWriter(t *testing.T) {
+	var expected bytes.Buffer
+	var written bytes.Buffer
+	w := NewAsyncWriter(&written)
+	for i := 0; i < 1000; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, i*37)
+		expected.Write(chunk)
+		n, err := w.Write(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(chunk) {
+			t.Fatalf("Expected %d got %d", len(chunk), n)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected.Bytes(), written.Bytes()) {
+		t.Fatalf("Expected %d bytes to be written in order, got %d bytes", expected.Len(), written.Len())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Fatal("Expected an error writing to a closed AsyncWriter")
+	}
+
+	w = NewAsyncWriter(failingWriter{})
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("Expected Close to report the error from the wrapped writer")
+	}
+}
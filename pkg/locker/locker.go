@@ -10,13 +10,22 @@ If a lock with a given name does not exist when `Lock` is called, one is
 created.
 Lock references are automatically cleaned up on `Unlock` if nothing else is
 waiting for the lock.
+
+To help with debugging lock contention, a Locker tracks how long callers have
+waited for each of its locks, and can optionally report locks which are held,
+or waited for, for longer than a given threshold, along with the stack of the
+goroutine which is holding the lock.
 */
 package locker
 
 import (
 	"errors"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // ErrNoSuchLock is returned when the requested lock does not exist
@@ -26,6 +35,53 @@ var ErrNoSuchLock = errors.New("no such lock")
 type Locker struct {
 	mu    sync.Mutex
 	locks map[string]*lockCtr
+	// longHold is the threshold after which we report that a lock has
+	// been held, or waited for, for too long.  Zero disables reporting.
+	longHold time.Duration
+	// report is called to report a lock which has been held or waited for
+	// for longer than longHold.
+	report func(format string, args ...interface{})
+	// stats accumulates usage information for all of our locks.
+	stats Stats
+}
+
+// Stats summarizes how a Locker's locks have been used.
+type Stats struct {
+	// Acquisitions is the number of times any lock has been acquired.
+	Acquisitions uint64
+	// Contended is the number of acquisitions which had to wait for
+	// another caller to release the lock.
+	Contended uint64
+	// TotalWait is the total time that callers have spent waiting to
+	// acquire locks.
+	TotalWait time.Duration
+	// LongestWait is the longest time that a caller has spent waiting to
+	// acquire a lock.
+	LongestWait time.Duration
+}
+
+// LockInfo describes the state of a lock with a given name.
+type LockInfo struct {
+	// Name is the name of the lock.
+	Name string
+	// Held is true if the lock is currently held.
+	Held bool
+	// HeldSince is when the current holder acquired the lock.
+	HeldSince time.Time
+	// HolderStack is the stack of the goroutine which acquired the lock,
+	// if long-hold detection was enabled at the time.
+	HolderStack string
+	// Waiters is the number of callers waiting to acquire the lock.
+	Waiters int
+	// Acquisitions is the number of times the lock has been acquired
+	// since it was created.
+	Acquisitions uint64
+	// TotalWait is the total time that callers have spent waiting to
+	// acquire the lock since it was created.
+	TotalWait time.Duration
+	// LongestWait is the longest time that a caller has spent waiting to
+	// acquire the lock since it was created.
+	LongestWait time.Duration
 }
 
 // lockCtr is used by Locker to represent a lock with a given name.
@@ -34,6 +90,16 @@ type lockCtr struct {
 	// waiters is the number of waiters waiting to acquire the lock
 	// this is int32 instead of uint32 so we can add `-1` in `dec()`
 	waiters int32
+
+	// The remaining fields are protected by the Locker's mu.
+	held         bool
+	heldSince    time.Time
+	holderStack  string
+	acquisitions uint64
+	totalWait    time.Duration
+	longestWait  time.Duration
+	// holdTimer reports the lock if it's held for too long.
+	holdTimer *time.Timer
 }
 
 // inc increments the number of waiters waiting for the lock
@@ -64,7 +130,83 @@ func (l *lockCtr) Unlock() {
 // New creates a new Locker
 func New() *Locker {
 	return &Locker{
-		locks: make(map[string]*lockCtr),
+		locks:  make(map[string]*lockCtr),
+		report: logrus.Warnf,
+	}
+}
+
+// SetLongHoldThreshold enables reporting, using logrus, of locks which are
+// held or waited for for longer than threshold, including the stack of the
+// goroutine holding the lock.  Since recording the holder's stack isn't free,
+// this is disabled by default, and passing zero disables it again.
+func (l *Locker) SetLongHoldThreshold(threshold time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.longHold = threshold
+}
+
+// info returns a description of the named lock.  The Locker's mu must be held.
+func (l *Locker) info(name string, nameLock *lockCtr) LockInfo {
+	return LockInfo{
+		Name:         name,
+		Held:         nameLock.held,
+		HeldSince:    nameLock.heldSince,
+		HolderStack:  nameLock.holderStack,
+		Waiters:      int(nameLock.count()),
+		Acquisitions: nameLock.acquisitions,
+		TotalWait:    nameLock.totalWait,
+		LongestWait:  nameLock.longestWait,
+	}
+}
+
+// Info returns a description of the lock with the given name, if it exists.
+func (l *Locker) Info(name string) (LockInfo, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nameLock, exists := l.locks[name]
+	if !exists {
+		return LockInfo{}, false
+	}
+	return l.info(name, nameLock), true
+}
+
+// Stats returns usage information for all of the Locker's locks, including
+// ones which no longer exist.
+func (l *Locker) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// Locks returns descriptions of all of the locks which currently exist.
+func (l *Locker) Locks() []LockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locks := make([]LockInfo, 0, len(l.locks))
+	for name, nameLock := range l.locks {
+		locks = append(locks, l.info(name, nameLock))
+	}
+	return locks
+}
+
+// reportf calls the Locker's reporting function.
+func (l *Locker) reportf(format string, args ...interface{}) {
+	if l.report != nil {
+		l.report(format, args...)
+		return
+	}
+	logrus.Warnf(format, args...)
+}
+
+// currentStack returns the stack of the calling goroutine.
+func currentStack() string {
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
 	}
 }
 
@@ -84,12 +226,63 @@ func (l *Locker) Lock(name string) {
 	// increment the nameLock waiters while inside the main mutex
 	// this makes sure that the lock isn't deleted if `Lock` and `Unlock` are called concurrently
 	nameLock.inc()
+
+	contended := nameLock.held || nameLock.count() > 1
+	longHold := l.longHold
 	l.mu.Unlock()
 
+	// If we're asked to, complain if we end up waiting for too long.
+	var waitTimer *time.Timer
+	start := time.Now()
+	if longHold > 0 {
+		waitTimer = time.AfterFunc(longHold, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if nameLock.held {
+				l.reportf("Waited more than %v for lock %q, held since %v by:\n%s", longHold, name, nameLock.heldSince, nameLock.holderStack)
+			}
+		})
+	}
+
 	// Lock the nameLock outside the main mutex so we don't block other operations
 	// once locked then we can decrement the number of waiters for this lock
 	nameLock.Lock()
 	nameLock.dec()
+
+	if waitTimer != nil {
+		waitTimer.Stop()
+	}
+	waited := time.Since(start)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nameLock.held = true
+	nameLock.heldSince = time.Now()
+	nameLock.acquisitions++
+	nameLock.totalWait += waited
+	if waited > nameLock.longestWait {
+		nameLock.longestWait = waited
+	}
+	l.stats.Acquisitions++
+	if contended {
+		l.stats.Contended++
+	}
+	l.stats.TotalWait += waited
+	if waited > l.stats.LongestWait {
+		l.stats.LongestWait = waited
+	}
+	if l.longHold > 0 {
+		longHold := l.longHold
+		nameLock.holderStack = currentStack()
+		acquisition := nameLock.acquisitions
+		nameLock.holdTimer = time.AfterFunc(longHold, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if nameLock.held && nameLock.acquisitions == acquisition {
+				l.reportf("Lock %q has been held for more than %v by:\n%s", name, longHold, nameLock.holderStack)
+			}
+		})
+	}
 }
 
 // Unlock unlocks the mutex with the given name
@@ -105,6 +298,13 @@ func (l *Locker) Unlock(name string) error {
 	if nameLock.count() == 0 {
 		delete(l.locks, name)
 	}
+	nameLock.held = false
+	nameLock.heldSince = time.Time{}
+	nameLock.holderStack = ""
+	if nameLock.holdTimer != nil {
+		nameLock.holdTimer.Stop()
+		nameLock.holdTimer = nil
+	}
 	nameLock.Unlock()
 
 	l.mu.Unlock()
@@ -1,6 +1,8 @@
 package locker
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -122,3 +124,92 @@ func TestLockerConcurrency(t *testing.T) {
 		t.Fatalf("lock should not exist: %v", ctr)
 	}
 }
+
+func TestLockerInfo(t *testing.T) {
+	l := New()
+	if _, ok := l.Info("test"); ok {
+		t.Fatal("expected no information about a lock that doesn't exist")
+	}
+
+	l.Lock("test")
+	info, ok := l.Info("test")
+	if !ok || !info.Held || info.HeldSince.IsZero() || info.Acquisitions != 1 {
+		t.Fatalf("unexpected lock information %+v", info)
+	}
+	if info.HolderStack != "" {
+		t.Fatal("expected holder stack to not be recorded by default")
+	}
+
+	chDone := make(chan struct{})
+	go func() {
+		l.Lock("test")
+		close(chDone)
+	}()
+	for {
+		if info, _ := l.Info("test"); info.Waiters == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := l.Unlock("test"); err != nil {
+		t.Fatal(err)
+	}
+	<-chDone
+
+	info, _ = l.Info("test")
+	if info.Acquisitions != 2 || info.LongestWait < 10*time.Millisecond {
+		t.Fatalf("unexpected lock information %+v", info)
+	}
+	if len(l.Locks()) != 1 {
+		t.Fatalf("expected one lock, got %+v", l.Locks())
+	}
+	if err := l.Unlock("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := l.Stats()
+	if stats.Acquisitions != 2 || stats.Contended != 1 || stats.TotalWait < 10*time.Millisecond {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(l.Locks()) != 0 {
+		t.Fatalf("expected no locks, got %+v", l.Locks())
+	}
+}
+
+func TestLockerLongHold(t *testing.T) {
+	l := New()
+	reports := make(chan string, 10)
+	l.report = func(format string, args ...interface{}) {
+		reports <- fmt.Sprintf(format, args...)
+	}
+	l.SetLongHoldThreshold(10 * time.Millisecond)
+
+	l.Lock("test")
+	info, _ := l.Info("test")
+	if !strings.Contains(info.HolderStack, "TestLockerLongHold") {
+		t.Fatalf("expected holder stack to be recorded, got %q", info.HolderStack)
+	}
+	select {
+	case report := <-reports:
+		if !strings.Contains(report, `"test"`) || !strings.Contains(report, "TestLockerLongHold") {
+			t.Fatalf("unexpected report %q", report)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for the long hold to be reported")
+	}
+	if err := l.Unlock("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Locks which are released quickly aren't reported.
+	l.Lock("quick")
+	if err := l.Unlock("quick"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case report := <-reports:
+		t.Fatalf("unexpected report %q", report)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,33 @@
+package lockfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processStartTime returns the time, in clock ticks after boot, at which the
+// process started, or 0 if it can't be determined.
+func processStartTime(pid int) uint64 {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name can contain spaces, so skip past it before
+	// splitting the rest of the fields, the 20th of which is the start
+	// time.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
@@ -0,0 +1,134 @@
+// +build linux solaris darwin freebsd
+
+package lockfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// holderOffset is where the holder record starts in the lock file,
+	// just past the last writer's ID.
+	holderOffset = 64
+	// holderSize is the size of the holder record.
+	holderSize = 64
+)
+
+// readHolderAt reads the holder record from the lock file open as fd.
+func readHolderAt(fd int) (*Holder, error) {
+	buf := make([]byte, holderSize)
+	n, err := unix.Pread(fd, buf, holderOffset)
+	if err != nil {
+		return nil, err
+	}
+	record := bytes.TrimRight(buf[:n], "\x00")
+	if len(record) == 0 {
+		return nil, nil
+	}
+	var h Holder
+	if _, err := fmt.Sscanf(string(record), "%d %d", &h.PID, &h.StartTime); err != nil {
+		return nil, errors.Wrapf(err, "error parsing lock holder record %q", string(record))
+	}
+	return &h, nil
+}
+
+// writeHolderAt writes a holder record to the lock file open as fd, leaving
+// the file's modification time alone so that TouchedSince() only notices
+// changes made by Touch().
+func (l *lockfile) writeHolderAt(record []byte) error {
+	st, err := system.Fstat(int(l.fd))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, holderSize)
+	copy(buf, record)
+	n, err := unix.Pwrite(int(l.fd), buf, holderOffset)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return unix.ENOSPC
+	}
+	mtime := st.Mtim()
+	mtim := unix.NsecToTimespec(mtime.Nano())
+	return unix.UtimesNano(l.file, []unix.Timespec{mtim, mtim})
+}
+
+// recordHolder notes that we are now the writer holding the lock.  If another
+// writer's record is still there, that writer lost the lock without releasing
+// it, most likely because it crashed, and may have left the data which the
+// lock protects half-updated, so we give the lock a new last-writer ID to make
+// everyone who shares it, including us, treat that data as modified.  Called
+// with stateMutex held, after acquiring the file lock for writing.
+func (l *lockfile) recordHolder() {
+	l.stale = nil
+	previous, err := readHolderAt(int(l.fd))
+	if err != nil {
+		logrus.Debugf("Error reading holder of lock %q: %v", l.file, err)
+	}
+	if previous != nil {
+		logrus.Warnf("Recovering lock %q left behind by process %d", l.file, previous.PID)
+		id := []byte(stringid.GenerateRandomID())
+		if _, err := unix.Pwrite(int(l.fd), id, 0); err != nil {
+			logrus.Warnf("Error updating last writer of lock %q: %v", l.file, err)
+		}
+		l.stale = previous
+	}
+	pid := os.Getpid()
+	record := fmt.Sprintf("%d %d", pid, processStartTime(pid))
+	if err := l.writeHolderAt([]byte(record)); err != nil {
+		logrus.Debugf("Error recording holder of lock %q: %v", l.file, err)
+	}
+}
+
+// clearHolder removes our holder record before we release the lock.  Called
+// with stateMutex held.
+func (l *lockfile) clearHolder() {
+	if err := l.writeHolderAt(nil); err != nil {
+		logrus.Debugf("Error clearing holder of lock %q: %v", l.file, err)
+	}
+}
+
+// readHolder returns the writer recorded as holding the lock at path.
+func readHolder(path string) (*Holder, error) {
+	fd, err := unix.Open(path, os.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer unix.Close(fd)
+	return readHolderAt(fd)
+}
+
+// alive returns true if the holder's process is still running.
+func (h *Holder) alive() bool {
+	if !system.IsProcessAlive(h.PID) {
+		return false
+	}
+	// If the process ID has been reused, the start time will differ.
+	return h.StartTime == 0 || processStartTime(h.PID) == h.StartTime
+}
+
+// recoverStale acquires and releases the write lock, and returns the holder
+// which had left it behind, if there was one.
+func recoverStale(locker Locker) (*Holder, error) {
+	l, ok := locker.(*lockfile)
+	if !ok || l.ro {
+		return nil, errors.New("not a read-write lock")
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+	return l.stale, nil
+}
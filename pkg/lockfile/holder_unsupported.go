@@ -0,0 +1,9 @@
+// +build solaris darwin freebsd
+
+package lockfile
+
+// processStartTime returns 0, since we don't know how to look up when a
+// process started here, so holders are identified only by process ID.
+func processStartTime(pid int) uint64 {
+	return 0
+}
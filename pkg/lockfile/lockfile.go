@@ -49,6 +49,22 @@ type Locker interface {
 	Locked() bool
 }
 
+// Holder describes the process which is recorded as holding a lock file for
+// writing.
+type Holder struct {
+	// PID is the holder's process ID.
+	PID int
+	// StartTime is when the holder's process started, in a
+	// platform-specific form, or 0 if it isn't known.  It is used to
+	// notice when a process ID has been reused.
+	StartTime uint64
+}
+
+// Alive returns true if the holder's process is still running.
+func (h *Holder) Alive() bool {
+	return h.alive()
+}
+
 var (
 	lockfiles     map[string]Locker
 	lockfilesLock sync.Mutex
@@ -105,3 +121,36 @@ func getLockfile(path string, ro bool) (Locker, error) {
 	lockfiles[cleanPath] = locker
 	return locker, nil
 }
+
+// ReadHolder returns the process which is recorded as holding the lock file
+// at path for writing, or nil if no process is recorded as holding it.  It
+// does not acquire the lock, so the result is only a snapshot.  A holder
+// which is no longer Alive() left the lock without releasing it.
+func ReadHolder(path string) (*Holder, error) {
+	cleanPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error ensuring that path %q is an absolute path", path)
+	}
+	return readHolder(cleanPath)
+}
+
+// RecoverStale acquires and releases the read-write lock file at path, waiting
+// for any live holder to release it.  If the previous writer had left the lock
+// without releasing it, most likely by crashing, its record is cleared and
+// the lock is given a new last-writer ID, so that everyone sharing the lock
+// notices that the data it protects may have been modified, and the previous
+// writer is returned.  Otherwise it returns nil.
+//
+// Every write lock performs this recovery when it is acquired, so RecoverStale
+// is only needed by callers which want to do it eagerly.
+func RecoverStale(path string) (*Holder, error) {
+	locker, err := GetLockfile(path)
+	if err != nil {
+		return nil, err
+	}
+	holder, err := recoverStale(locker)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error recovering lock %q", path)
+	}
+	return holder, nil
+}
@@ -28,6 +28,9 @@ type lockfile struct {
 	locked     bool
 	ro         bool
 	recursive  bool
+	// stale is the holder which we found had left the lock without
+	// releasing it when we last acquired it for writing, if there was one.
+	stale *Holder
 }
 
 // openLock opens the file at path and returns the corresponding file
@@ -134,6 +137,9 @@ func (l *lockfile) lock(lType int16, recursive bool) {
 		for unix.FcntlFlock(l.fd, unix.F_SETLKW, &lk) != nil {
 			time.Sleep(10 * time.Millisecond)
 		}
+		if lType == unix.F_WRLCK && !l.ro {
+			l.recordHolder()
+		}
 	}
 	l.locktype = lType
 	l.locked = true
@@ -186,6 +192,9 @@ func (l *lockfile) Unlock() {
 		// avoid releasing read-locks too early; a given process may
 		// acquire a read lock multiple times.
 		l.locked = false
+		if l.locktype == unix.F_WRLCK && !l.ro {
+			l.clearHolder()
+		}
 		// Close the file descriptor on the last unlock, releasing the
 		// file lock.
 		unix.Close(int(l.fd))
@@ -3,8 +3,10 @@
 package lockfile
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
 
@@ -63,3 +65,61 @@ func TestOpenLock(t *testing.T) {
 		require.Nil(t, os.RemoveAll(path))
 	}
 }
+
+func TestLockfileStaleHolder(t *testing.T) {
+	l, err := getTempLockfile()
+	require.NoError(t, err)
+	defer os.Remove(l.name)
+
+	// While we hold the lock, we're recorded as its holder.
+	l.Lock()
+	holder, err := ReadHolder(l.name)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	require.Equal(t, os.Getpid(), holder.PID)
+	require.True(t, holder.Alive())
+	_, err = l.Modified()
+	require.NoError(t, err)
+	require.NoError(t, l.Touch())
+	l.Unlock()
+
+	holder, err = ReadHolder(l.name)
+	require.NoError(t, err)
+	require.Nil(t, holder)
+
+	recovered, err := RecoverStale(l.name)
+	require.NoError(t, err)
+	require.Nil(t, recovered, "lock which was released cleanly was treated as stale")
+
+	// Simulate a writer which exited without releasing the lock.
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	deadPID := cmd.ProcessState.Pid()
+	f, err := os.OpenFile(l.name, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte(fmt.Sprintf("%d 1", deadPID)), holderOffset)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	holder, err = ReadHolder(l.name)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	require.Equal(t, deadPID, holder.PID)
+	require.False(t, holder.Alive())
+
+	recovered, err = RecoverStale(l.name)
+	require.NoError(t, err)
+	require.NotNil(t, recovered)
+	require.Equal(t, deadPID, recovered.PID)
+
+	holder, err = ReadHolder(l.name)
+	require.NoError(t, err)
+	require.Nil(t, holder)
+
+	// The recovery bumped the lock's generation.
+	l.Lock()
+	modified, err := l.Modified()
+	l.Unlock()
+	require.NoError(t, err)
+	require.True(t, modified, "recovering a stale lock did not mark it as modified")
+}
@@ -73,3 +73,15 @@ func (l *lockfile) TouchedSince(when time.Time) bool {
 	}
 	return when.Before(stat.ModTime())
 }
+
+func (h *Holder) alive() bool {
+	return false
+}
+
+func readHolder(path string) (*Holder, error) {
+	return nil, nil
+}
+
+func recoverStale(locker Locker) (*Holder, error) {
+	return nil, nil
+}
@@ -1,13 +1,139 @@
 package mount
 
 import (
+	"path/filepath"
+	"sort"
+	"strings"
+
 	"github.com/moby/sys/mountinfo"
 )
 
 type Info = mountinfo.Info
 
-var Mounted = mountinfo.Mounted
+// FilterFunc decides which entries in the mount table are returned by
+// GetMountsFiltered() and NewIndex(), and can stop the table from being read
+// any further.
+type FilterFunc = mountinfo.FilterFunc
+
+var (
+	Mounted = mountinfo.Mounted
+
+	// PrefixFilter returns a FilterFunc which selects the entries for
+	// mount points at or under a directory.
+	PrefixFilter = mountinfo.PrefixFilter
+	// FSTypeFilter returns a FilterFunc which selects the entries for
+	// file systems of any of the specified types.
+	FSTypeFilter = mountinfo.FSTypeFilter
+)
 
 func GetMounts() ([]*Info, error) {
 	return mountinfo.GetMounts(nil)
 }
+
+// GetMountsFiltered returns the entries in the mount table which filter
+// selects.  Entries which are skipped are discarded as the table is read.
+func GetMountsFiltered(filter FilterFunc) ([]*Info, error) {
+	return mountinfo.GetMounts(filter)
+}
+
+// GetMountsUnder returns the entries in the mount table for mount points at or
+// under dir.
+func GetMountsUnder(dir string) ([]*Info, error) {
+	dir = filepath.Clean(dir)
+	if dir == "/" {
+		return mountinfo.GetMounts(nil)
+	}
+	return mountinfo.GetMounts(PrefixFilter(dir))
+}
+
+// GetMountsByFSType returns the entries in the mount table for file systems of
+// any of the specified types.
+func GetMountsByFSType(fstypes ...string) ([]*Info, error) {
+	return mountinfo.GetMounts(FSTypeFilter(fstypes...))
+}
+
+// Index is a snapshot of entries in the mount table, indexed so that they can
+// be looked up by mount point, by the directory which contains them, or by
+// file system type, without searching through all of them.
+type Index struct {
+	// sorted holds the entries in order of their mount points, and then
+	// in the order in which they were mounted.
+	sorted       []*Info
+	byMountpoint map[string][]*Info
+	byFSType     map[string][]*Info
+}
+
+// NewIndex reads the entries in the mount table which filter selects, or all
+// of them if filter is nil, and indexes them.
+func NewIndex(filter FilterFunc) (*Index, error) {
+	infos, err := mountinfo.GetMounts(filter)
+	if err != nil {
+		return nil, err
+	}
+	return newIndex(infos), nil
+}
+
+func newIndex(infos []*Info) *Index {
+	i := &Index{
+		sorted:       make([]*Info, len(infos)),
+		byMountpoint: make(map[string][]*Info, len(infos)),
+		byFSType:     make(map[string][]*Info),
+	}
+	copy(i.sorted, infos)
+	sort.SliceStable(i.sorted, func(a, b int) bool {
+		return i.sorted[a].Mountpoint < i.sorted[b].Mountpoint
+	})
+	for _, info := range infos {
+		i.byMountpoint[info.Mountpoint] = append(i.byMountpoint[info.Mountpoint], info)
+		i.byFSType[info.FSType] = append(i.byFSType[info.FSType], info)
+	}
+	return i
+}
+
+// Len returns the number of entries in the index.
+func (i *Index) Len() int {
+	return len(i.sorted)
+}
+
+// Mounted returns true if something is mounted at mountpoint.
+func (i *Index) Mounted(mountpoint string) bool {
+	return len(i.byMountpoint[filepath.Clean(mountpoint)]) > 0
+}
+
+// Lookup returns the entry for the file system which was most recently
+// mounted at mountpoint, or nil if nothing is mounted there.
+func (i *Index) Lookup(mountpoint string) *Info {
+	infos := i.byMountpoint[filepath.Clean(mountpoint)]
+	if len(infos) == 0 {
+		return nil
+	}
+	return infos[len(infos)-1]
+}
+
+// Under returns the entries for mount points at or under dir, in order of
+// their mount points.
+func (i *Index) Under(dir string) []*Info {
+	dir = filepath.Clean(dir)
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = dir
+	}
+	infos := append([]*Info{}, i.byMountpoint[dir]...)
+	first := sort.Search(len(i.sorted), func(n int) bool {
+		return i.sorted[n].Mountpoint >= prefix
+	})
+	for _, info := range i.sorted[first:] {
+		if !strings.HasPrefix(info.Mountpoint, prefix) {
+			break
+		}
+		if info.Mountpoint != dir {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// ByFSType returns the entries for file systems of the specified type.
+func (i *Index) ByFSType(fstype string) []*Info {
+	return i.byFSType[fstype]
+}
@@ -0,0 +1,141 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	infos := []*Info{
+		{ID: 1, Mountpoint: "/", FSType: "ext4"},
+		{ID: 2, Mountpoint: "/var/lib/containers/storage/overlay/a/merged", FSType: "overlay"},
+		{ID: 3, Mountpoint: "/var/lib/containers/storage-other", FSType: "tmpfs"},
+		{ID: 4, Mountpoint: "/var/lib/containers/storage", FSType: "xfs"},
+		{ID: 5, Mountpoint: "/var/lib/containers/storage/overlay/b/merged", FSType: "overlay"},
+		{ID: 6, Mountpoint: "/var/lib/containers/storage", FSType: "tmpfs"},
+	}
+	index := newIndex(infos)
+
+	if index.Len() != len(infos) {
+		t.Fatalf("Expected %d entries, got %d", len(infos), index.Len())
+	}
+	if !index.Mounted("/var/lib/containers/storage/overlay/a/merged/") {
+		t.Fatal("Expected overlay/a/merged to be mounted")
+	}
+	if index.Mounted("/var/lib/containers/storage/overlay/a") {
+		t.Fatal("Expected overlay/a not to be mounted")
+	}
+	if info := index.Lookup("/var/lib/containers/storage"); info == nil || info.ID != 6 {
+		t.Fatalf("Expected the most recent mount at the graph root, got %+v", info)
+	}
+	if info := index.Lookup("/var/lib/containers/storage/overlay"); info != nil {
+		t.Fatalf("Expected nothing to be mounted at overlay, got %+v", info)
+	}
+
+	var ids []int
+	for _, info := range index.Under("/var/lib/containers/storage") {
+		ids = append(ids, info.ID)
+	}
+	expected := []int{4, 6, 2, 5}
+	if len(ids) != len(expected) {
+		t.Fatalf("Expected mounts %v under the graph root, got %v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("Expected mounts %v under the graph root, got %v", expected, ids)
+		}
+	}
+	if n := len(index.Under("/")); n != len(infos) {
+		t.Fatalf("Expected %d mounts under /, got %d", len(infos), n)
+	}
+	if n := len(index.ByFSType("overlay")); n != 2 {
+		t.Fatalf("Expected 2 overlay mounts, got %d", n)
+	}
+	if n := len(index.ByFSType("btrfs")); n != 0 {
+		t.Fatalf("Expected no btrfs mounts, got %d", n)
+	}
+}
+
+func TestGetMountsUnder(t *testing.T) {
+	all, err := GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	under, err := GetMountsUnder("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(under) != len(all) {
+		t.Fatalf("Expected %d mounts under /, got %d", len(all), len(under))
+	}
+	index, err := NewIndex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Mounted("/") {
+		t.Fatal("Expected / to be mounted")
+	}
+	byType, err := GetMountsByFSType(index.Lookup("/").FSType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byType) == 0 {
+		t.Fatal("Expected to find mounts with the same type as /")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root required")
+	}
+
+	tmp, err := ioutil.TempDir("", "mount-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	target := filepath.Join(tmp, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Watch(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	next := func() Event {
+		select {
+		case event := <-w.Events():
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for an event")
+		}
+		return Event{}
+	}
+
+	if err := Mount("tmpfs", target, "tmpfs", ""); err != nil {
+		t.Skipf("unable to mount a tmpfs: %v", err)
+	}
+	defer Unmount(target)
+	if event := next(); !event.Mounted || event.Info.Mountpoint != target {
+		t.Fatalf("Expected %q to be mounted, got %+v", target, event)
+	}
+	if err := Unmount(target); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Mounted || event.Info.Mountpoint != target {
+		t.Fatalf("Expected %q to be unmounted, got %+v", target, event)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("Expected the events channel to be closed")
+	}
+}
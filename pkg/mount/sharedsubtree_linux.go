@@ -1,5 +1,7 @@
 package mount
 
+import "github.com/sirupsen/logrus"
+
 // MakeShared ensures a mounted filesystem has the SHARED mount option enabled.
 // See the supported options in flags.go for further reference.
 func MakeShared(mountPoint string) error {
@@ -60,5 +62,14 @@ func ensureMountedAs(mnt string, flags int) error {
 		}
 	}
 
-	return mount("", mnt, "none", uintptr(flags), "")
+	if err := mount("", mnt, "none", uintptr(flags), ""); err != nil {
+		// Don't leave behind the bind mount which we just made.
+		if !mounted {
+			if err2 := unmount(mnt, mntDetach); err2 != nil {
+				logrus.Debugf("Error unmounting %q after failing to change its propagation: %v", mnt, err2)
+			}
+		}
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,85 @@
+package mount
+
+import "path/filepath"
+
+// Event describes a file system which was mounted or unmounted.
+type Event struct {
+	// Info is the file system's entry in the mount table.
+	Info *Info
+	// Mounted is true if the file system was mounted, and false if it was
+	// unmounted.
+	Mounted bool
+}
+
+// Watcher reports file systems which are mounted or unmounted at or under a
+// directory.
+type Watcher struct {
+	dir    string
+	events chan Event
+	done   chan struct{}
+	// current holds the entries which were last read, keyed by their
+	// mount IDs.
+	current map[int]*Info
+	watcherImpl
+}
+
+// Events returns the channel on which changes are reported.  It is closed
+// when the Watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// rescan reads the entries for mount points under the watched directory,
+// and sends events for the ones which have appeared or disappeared since
+// the last time it was called.  It returns false if the Watcher was closed
+// while it was sending them.
+func (w *Watcher) rescan() (bool, error) {
+	infos, err := GetMountsUnder(w.dir)
+	if err != nil {
+		return true, err
+	}
+	next := make(map[int]*Info, len(infos))
+	var events []Event
+	for _, info := range infos {
+		next[info.ID] = info
+		if _, ok := w.current[info.ID]; !ok {
+			events = append(events, Event{Info: info, Mounted: true})
+		}
+	}
+	for id, info := range w.current {
+		if _, ok := next[id]; !ok {
+			events = append(events, Event{Info: info, Mounted: false})
+		}
+	}
+	w.current = next
+	for _, event := range events {
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Watch starts watching for file systems which are mounted or unmounted at or
+// under dir.  The caller should close the Watcher when it's done with it.
+func Watch(dir string) (*Watcher, error) {
+	w := &Watcher{
+		dir:    filepath.Clean(dir),
+		events: make(chan Event),
+		done:   make(chan struct{}),
+	}
+	infos, err := GetMountsUnder(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	w.current = make(map[int]*Info, len(infos))
+	for _, info := range infos {
+		w.current[info.ID] = info
+	}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,89 @@
+package mount
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// watchInterval is how often the mount table is read again if the kernel
+// hasn't reported that it has changed, since not every kernel reliably does.
+const watchInterval = time.Second
+
+// watcherImpl waits for the kernel to report that the mount table has
+// changed, which it does by marking /proc/self/mountinfo as having an
+// exceptional condition, or for watchInterval to pass.
+type watcherImpl struct {
+	mountinfo *os.File
+	// wakeRead and wakeWrite are a pipe which is used to interrupt
+	// poll() when the Watcher is closed.
+	wakeRead, wakeWrite *os.File
+	closeOnce           sync.Once
+	stopped             chan struct{}
+}
+
+func (w *Watcher) start() error {
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	wakeRead, wakeWrite, err := os.Pipe()
+	if err != nil {
+		mountinfo.Close()
+		return err
+	}
+	w.mountinfo = mountinfo
+	w.wakeRead = wakeRead
+	w.wakeWrite = wakeWrite
+	w.stopped = make(chan struct{})
+	go w.watch()
+	return nil
+}
+
+func (w *Watcher) watch() {
+	defer close(w.stopped)
+	defer close(w.events)
+	fds := []unix.PollFd{
+		{Fd: int32(w.mountinfo.Fd()), Events: unix.POLLPRI},
+		{Fd: int32(w.wakeRead.Fd()), Events: unix.POLLIN},
+	}
+	for {
+		fds[0].Revents, fds[1].Revents = 0, 0
+		if _, err := unix.Poll(fds, int(watchInterval/time.Millisecond)); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logrus.Debugf("Error waiting for changes to the mount table: %v", err)
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		more, err := w.rescan()
+		if err != nil {
+			logrus.Debugf("Error reading the mount table: %v", err)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// Close stops watching for changes.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		if _, err = w.wakeWrite.Write([]byte{0}); err != nil {
+			return
+		}
+		<-w.stopped
+		w.wakeWrite.Close()
+		w.wakeRead.Close()
+		err = w.mountinfo.Close()
+	})
+	return err
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package mount
+
+import "github.com/pkg/errors"
+
+type watcherImpl struct{}
+
+func (w *Watcher) start() error {
+	return errors.New("watching the mount table is not supported on this platform")
+}
+
+// Close stops watching for changes.
+func (w *Watcher) Close() error {
+	return nil
+}
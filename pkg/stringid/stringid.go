@@ -3,6 +3,8 @@ package stringid
 
 import (
 	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -70,6 +73,40 @@ func GenerateNonCryptoID() string {
 	return generateID(readerFunc(rand.Read))
 }
 
+// Generator generates IDs for new items.
+type Generator interface {
+	GenerateID() string
+}
+
+// sequentialGenerator generates IDs from a hash of a seed and a counter.
+type sequentialGenerator struct {
+	mu    sync.Mutex
+	seed  string
+	count uint64
+}
+
+// NewSequentialGenerator returns a Generator which generates the same
+// sequence of IDs every time one is created using the same seed, which can be
+// useful in tests which need to produce the same results every time they're
+// run.  The IDs look like the ones which GenerateRandomID returns, but they
+// are easily guessed, so it shouldn't be used otherwise.
+func NewSequentialGenerator(seed string) Generator {
+	return &sequentialGenerator{seed: seed}
+}
+
+// GenerateID returns the next ID in the sequence.
+func (g *sequentialGenerator) GenerateID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return generateID(readerFunc(func(p []byte) (int, error) {
+		var counter [8]byte
+		binary.BigEndian.PutUint64(counter[:], g.count)
+		g.count++
+		sum := sha256.Sum256(append([]byte(g.seed), counter[:]...))
+		return copy(p, sum[:]), nil
+	}))
+}
+
 // ValidateID checks whether an ID string is a valid image ID.
 func ValidateID(id string) error {
 	if ok := validHex.MatchString(id); !ok {
@@ -21,6 +21,27 @@ func TestGenerateNonCryptoID(t *testing.T) {
 	}
 }
 
+func TestSequentialGenerator(t *testing.T) {
+	first, second := NewSequentialGenerator("seed"), NewSequentialGenerator("seed")
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		id := first.GenerateID()
+		if err := ValidateID(id); err != nil {
+			t.Fatalf("Id returned is incorrect: %v", err)
+		}
+		if seen[id] {
+			t.Fatalf("Id %s was returned more than once", id)
+		}
+		seen[id] = true
+		if other := second.GenerateID(); other != id {
+			t.Fatalf("Generators with the same seed returned %s and %s", id, other)
+		}
+	}
+	if id := NewSequentialGenerator("other seed").GenerateID(); seen[id] {
+		t.Fatalf("Generators with different seeds both returned %s", id)
+	}
+}
+
 func TestShortenId(t *testing.T) {
 	id := "90435eec5c4e124e741ef731e118be2fc799a68aba0466ec17717f24ce2ae6a2"
 	truncID := TruncateID(id)
@@ -0,0 +1,34 @@
+package system
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ProcessStartTime returns the time, in clock ticks after boot, at which the
+// process started, or 0 if it isn't running.  Comparing it with a value which
+// was recorded earlier tells whether the process ID has since been reused.
+func ProcessStartTime(pid int) uint64 {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name can contain spaces, so skip past it before
+	// splitting the rest of the fields.  The first of them is the state,
+	// and the 20th is the start time.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 || fields[0] == "Z" || fields[0] == "X" {
+		return 0
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
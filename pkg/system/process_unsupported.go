@@ -0,0 +1,9 @@
+// +build !linux
+
+package system
+
+// ProcessStartTime is not supported on platforms other than linux, and always
+// returns 0.
+func ProcessStartTime(pid int) uint64 {
+	return 0
+}
@@ -53,6 +53,16 @@ func Lsetxattr(path string, attr string, data []byte, flags int) error {
 	return nil
 }
 
+// Lremovexattr removes the extended attribute identified by attr from the
+// given path in the file system.  It is not an error if the attribute isn't
+// set.
+func Lremovexattr(path string, attr string) error {
+	if err := unix.Lremovexattr(path, attr); err != nil && err != unix.ENODATA {
+		return &os.PathError{Op: "lremovexattr", Path: path, Err: err}
+	}
+	return nil
+}
+
 // Llistxattr lists extended attributes associated with the given path
 // in the file system.
 func Llistxattr(path string) ([]string, error) {
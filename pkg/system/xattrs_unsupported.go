@@ -22,6 +22,11 @@ func Lsetxattr(path string, attr string, data []byte, flags int) error {
 	return ErrNotSupportedPlatform
 }
 
+// Lremovexattr is not supported on platforms other than linux.
+func Lremovexattr(path string, attr string) error {
+	return ErrNotSupportedPlatform
+}
+
 // Llistxattr is not supported on platforms other than linux.
 func Llistxattr(path string) ([]string, error) {
 	return nil, ErrNotSupportedPlatform
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LayerProvenance records where a layer's contents came from, and which
+// operation put them there, so that it's possible to find out later why a
+// layer is in the store.
+type LayerProvenance struct {
+	// Source is a reference to the image, or some other description of
+	// the location, from which the layer's contents were obtained.
+	Source string `json:"source,omitempty"`
+	// Operation is a short description of the operation which created
+	// the layer, such as "pull" or "build".
+	Operation string `json:"operation,omitempty"`
+	// Tool is the name, and possibly the version, of the program which
+	// created the layer.
+	Tool string `json:"tool,omitempty"`
+	// Created is when the layer was created.  If it isn't set when the
+	// layer is created, the layer's creation time is used.
+	Created time.Time `json:"created,omitempty"`
+}
+
+func copyLayerProvenance(p *LayerProvenance) *LayerProvenance {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+func (s *store) LayersBySource(source string) ([]Layer, error) {
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	var matched []Layer
+	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		layers, err := store.Layers()
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			if layer.Provenance != nil && layer.Provenance.Source == source {
+				matched = append(matched, layer)
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (s *store) ImageHistory(id string) ([]Layer, error) {
+	image, err := s.Image(id)
+	if err != nil {
+		return nil, err
+	}
+	lstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	lstores, err := s.ROLayerStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range append([]ROLayerStore{lstore}, lstores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	// Walk from the top layer down to the base layer.
+	var history []Layer
+	visited := make(map[string]struct{})
+	for layerID := image.TopLayer; layerID != ""; {
+		if _, ok := visited[layerID]; ok {
+			return nil, errors.Errorf("layer %q is its own ancestor", layerID)
+		}
+		visited[layerID] = struct{}{}
+		var layer *Layer
+		for _, store := range append([]ROLayerStore{lstore}, lstores...) {
+			if layer, err = store.Get(layerID); err == nil {
+				break
+			}
+		}
+		if layer == nil {
+			return nil, errors.Wrapf(ErrLayerUnknown, "error locating layer with ID %q", layerID)
+		}
+		history = append(history, *layer)
+		layerID = layer.Parent
+	}
+	// Put the base layer first, as an image's history would.
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	return history, nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reaper runs functions which remove the contents of deleted layers in the
+// background, running no more than a fixed number of them at a time.
+type reaper struct {
+	wg    sync.WaitGroup
+	slots chan struct{}
+	// cleanedUp is set once we've started removing contents which an
+	// earlier process left behind.
+	cleanedUp bool
+	lock      sync.Mutex
+}
+
+// newReaper returns a reaper which runs up to "workers" removals at a time.
+func newReaper(workers int) *reaper {
+	if workers < 1 {
+		workers = 1
+	}
+	return &reaper{slots: make(chan struct{}, workers)}
+}
+
+// add arranges for remove to be called in the background.  Errors are
+// logged, since the records of what was being removed are already gone.
+func (r *reaper) add(what string, remove func() error) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.slots <- struct{}{}
+		defer func() { <-r.slots }()
+		if err := remove(); err != nil {
+			logrus.Warnf("Error removing %s: %v", what, err)
+		}
+	}()
+}
+
+// cleanupOnce arranges for cleanup to be called in the background, unless
+// it has already been arranged for.
+func (r *reaper) cleanupOnce(what string, cleanup func() error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cleanedUp {
+		return
+	}
+	r.cleanedUp = true
+	r.add(what, cleanup)
+}
+
+// wait waits for all of the removals which have been added to finish.
+func (r *reaper) wait() {
+	r.wg.Wait()
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// previousRecordsSuffix is appended to the name of a file which holds the
+// records of layers, images, or containers, to form the name of the file
+// which holds the version of them that was replaced by the last save.
+const previousRecordsSuffix = ".prev"
+
+// recordsFile reads and writes a file which holds records of layers, images,
+// or containers.  It remembers whether the file was intact the last time that
+// it read or wrote it, so that it only keeps a copy of a version of the file
+// which was intact as the previous version of it.
+type recordsFile struct {
+	// path is the file which was last read or written.
+	path string
+	// intact is true if path was intact when it was last read or written.
+	intact bool
+	// options control how the file, and big data items which are kept
+	// alongside it, are written.  Their TempDir is only used for the big
+	// data items.
+	options ioutils.AtomicFileWriterOptions
+}
+
+// decode parses the records in path into the value which newRecords returns,
+// reading the file a piece at a time instead of reading all of it into memory
+// first, and returns the digest of the file's contents.  If the file is
+// damaged, as it could be if the system lost power while it was being
+// written, and the previous version of it is intact, the previous version is
+// parsed instead, into a new value from newRecords.  A file which
+// doesn't exist is treated as being empty.  If neither version can be parsed,
+// the error is ErrStoreCorrupt.
+func (f *recordsFile) decode(path string, newRecords func() interface{}) (digest.Digest, error) {
+	f.path, f.intact = path, false
+	d, empty, err := decodeRecords(path, newRecords())
+	if err == nil {
+		f.intact = !empty
+		return d, nil
+	}
+	if os.IsNotExist(err) {
+		return digest.FromBytes(nil), nil
+	}
+	if _, ok := err.(recordsSyntaxError); !ok {
+		return "", err
+	}
+	previous := path + previousRecordsSuffix
+	d, empty, perr := decodeRecords(previous, newRecords())
+	if perr != nil || empty {
+		logrus.Errorf("%s is damaged, and there is no usable previous version of it", path)
+		// Leave the caller with an empty list.
+		newRecords()
+		return "", corruptRecordsError(path, err)
+	}
+	logrus.Warnf("%s is damaged, using the previous version of it from %s", path, previous)
+	return d, nil
+}
+
+// recordsSyntaxError is returned by decodeRecords() if the file it reads
+// isn't a single valid JSON value.
+type recordsSyntaxError struct {
+	error
+}
+
+// decodeRecords parses the single JSON value in path into records, and
+// returns the digest of the file's contents, and whether or not the file was
+// empty, in which case records is left alone.
+func decodeRecords(path string, records interface{}) (digest.Digest, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	digester := digest.Canonical.Digester()
+	counter := ioutils.NewWriteCounter(digester.Hash())
+	r := io.TeeReader(file, counter)
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(records); err != nil {
+		if err == io.EOF && counter.Count == 0 {
+			return digester.Digest(), true, nil
+		}
+		if _, ok := err.(*os.PathError); ok {
+			return "", false, err
+		}
+		return "", false, recordsSyntaxError{err}
+	}
+	// Anything after the records, which the decoder may have already
+	// read, has to be whitespace.
+	rest := bufio.NewReader(io.MultiReader(decoder.Buffered(), r))
+	for {
+		c, err := rest.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return "", false, recordsSyntaxError{errors.Errorf("unexpected %q after the records", c)}
+		}
+	}
+	return digester.Digest(), false, nil
+}
+
+// write atomically replaces the records in path.  The version of the file
+// which is being replaced is kept, if it was intact, so that decode() can fall
+// back to it.  Unless syncing is turned off, the directory is synced after the
+// previous version is kept and again after the file is replaced, so that
+// neither of them can be lost.
+func (f *recordsFile) write(path string, data []byte) error {
+	opts := f.options
+	sync := !opts.NoSync && opts.Durability != ioutils.DurabilityNone
+	if sync && opts.Durability == ioutils.DurabilityDefault {
+		opts.Durability = ioutils.DurabilityStrict
+	}
+	opts.TempDir = ""
+	if f.path == path && f.intact {
+		previous := path + previousRecordsSuffix
+		if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(path, previous); err != nil {
+			logrus.Debugf("Error linking the previous version of %s, copying it instead: %v", path, err)
+			if err := copyRecords(path, previous); err != nil {
+				logrus.Debugf("Error keeping the previous version of %s: %v", path, err)
+			}
+		}
+		if sync {
+			if err := ioutils.SyncDir(filepath.Dir(path)); err != nil {
+				return err
+			}
+		}
+	}
+	f.path, f.intact = path, false
+	if _, err := ioutils.AtomicWriteFileFromReaderWithOpts(path, bytes.NewReader(data), 0600, &opts); err != nil {
+		return err
+	}
+	f.intact = len(data) > 0
+	return nil
+}
+
+// copyRecords atomically copies the file at path to dest.
+func copyRecords(path, dest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = ioutils.AtomicWriteFileFromReader(dest, file, 0600)
+	return err
+}
+
+// corruptRecordsError describes a failure to parse the records of layers,
+// images, or containers which were read from path.
+func corruptRecordsError(path string, err error) error {
+	return errors.Wrapf(ErrStoreCorrupt, "parsing %s: %v", path, err)
+}
+
+// bigDataWriterOptions returns the options to use when writing big data items
+// for the layers, images, or containers whose records are in the file.
+func (f *recordsFile) bigDataWriterOptions() *ioutils.AtomicFileWriterOptions {
+	opts := f.options
+	return &opts
+}
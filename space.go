@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/pkg/errors"
+)
+
+// freeSpaceCheckInterval is how much of a diff we extract between checks of
+// how much free space is left.
+const freeSpaceCheckInterval = 32 * 1024 * 1024
+
+// NoSpaceError is returned when a layer's contents couldn't be added to,
+// either because doing so would have left less free space than the store
+// was told to keep free, or because the filesystem ran out of space.
+type NoSpaceError struct {
+	// Path is the location whose filesystem is short on space.
+	Path string
+	// Available is the number of bytes which were available, if it's
+	// known.
+	Available int64
+	// Reserved is the number of bytes which are to be kept free.
+	Reserved int64
+	// Err is the error which the filesystem reported, if it ran out of
+	// space before we noticed.
+	Err error
+}
+
+func (e *NoSpaceError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %s: %v", ErrNoSpace, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%v: %s: %d bytes available, %d bytes reserved", ErrNoSpace, e.Path, e.Available, e.Reserved)
+}
+
+// Unwrap returns ErrNoSpace, so that errors.Is() can be used to check for
+// this type of error.
+func (e *NoSpaceError) Unwrap() error {
+	return ErrNoSpace
+}
+
+// Cause returns ErrNoSpace, so that errors.Cause() can be used to check for
+// this type of error.
+func (e *NoSpaceError) Cause() error {
+	return ErrNoSpace
+}
+
+// spacePath returns the location whose free space should be checked before
+// adding to the contents of the layer with the specified ID, or to a new
+// layer if id is "".  If the driver can tell us where a layer's contents
+// are, we check there, since a quota on that directory may leave it with
+// less space than the rest of the filesystem has.
+func (r *layerStore) spacePath(id string) string {
+	if id != "" {
+		if driver, ok := r.driver.(drivers.LayerDiffPathDriver); ok {
+			if path, err := driver.LayerDiffPath(id); err == nil {
+				return path
+			}
+		}
+	}
+	return r.layerdir
+}
+
+// checkFreeSpace returns a *NoSpaceError if less than the reserved amount of
+// space is available at path.  If we can't tell how much is available, we
+// assume that there's enough.
+func (r *layerStore) checkFreeSpace(path string) error {
+	if r.reservedSpace <= 0 {
+		return nil
+	}
+	available, err := freeSpace(path)
+	if err != nil {
+		return nil
+	}
+	if available < r.reservedSpace {
+		return &NoSpaceError{Path: path, Available: available, Reserved: r.reservedSpace}
+	}
+	return nil
+}
+
+// noSpaceError returns a *NoSpaceError if err indicates that the filesystem
+// ran out of space while we were writing to path, and err otherwise.
+func (r *layerStore) noSpaceError(path string, err error) error {
+	if err == nil || errors.Is(err, ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	available, _ := freeSpace(path)
+	return &NoSpaceError{Path: path, Available: available, Reserved: r.reservedSpace, Err: err}
+}
+
+// spaceCheckingReader periodically checks that there's still enough free
+// space at a location while data which is being written there is read, and
+// fails if there isn't.
+type spaceCheckingReader struct {
+	r         *layerStore
+	reader    io.Reader
+	path      string
+	unchecked int64
+	err       error
+}
+
+func (c *spaceCheckingReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.reader.Read(p)
+	c.unchecked += int64(n)
+	if c.unchecked >= freeSpaceCheckInterval {
+		c.unchecked = 0
+		if c.err = c.r.checkFreeSpace(c.path); c.err != nil {
+			return n, c.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the number of bytes which unprivileged processes can
+// still write at path.  If path is a directory with a project quota, the
+// filesystem may report the quota's limits instead of its own.
+func freeSpace(path string) (int64, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package storage
+
+// freeSpace returns the number of bytes which can still be written at path.
+// We don't know how to find out here.
+func freeSpace(path string) (int64, error) {
+	return 0, ErrNotSupported
+}
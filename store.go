@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 	drivers "github.com/containers/storage/drivers"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/parsers"
@@ -29,6 +31,7 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type updateNameOperation int
@@ -99,6 +102,11 @@ type ROBigDataStore interface {
 	// this ID, if it has previously been set.
 	BigData(id, key string) ([]byte, error)
 
+	// BigDataReader returns a reader for a (potentially large) piece of
+	// data associated with this ID, so that it doesn't need to be read
+	// into memory all at once.
+	BigDataReader(id, key string) (io.ReadCloser, error)
+
 	// BigDataSize retrieves the size of a (potentially large) piece of
 	// data associated with this ID, if it has previously been set.
 	BigDataSize(id, key string) (int64, error)
@@ -119,6 +127,13 @@ type RWImageBigDataStore interface {
 	// Pass github.com/containers/image/manifest.Digest as digestManifest
 	// to allow ByDigest to find images by their correct digests.
 	SetBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error
+
+	// SetBigDataFromReader stores a (potentially large) piece of data
+	// associated with this ID, reading it from data, and computing its
+	// size and digest as it is written.  Items whose names mark them as
+	// manifests are read into memory so that they can be passed to
+	// digestManifest.
+	SetBigDataFromReader(id, key string, data io.Reader, digestManifest func([]byte) (digest.Digest, error)) error
 }
 
 // A ContainerBigDataStore wraps up how we store big-data associated with containers.
@@ -127,6 +142,11 @@ type ContainerBigDataStore interface {
 	// SetBigData stores a (potentially large) piece of data associated
 	// with this ID.
 	SetBigData(id, key string, data []byte) error
+
+	// SetBigDataFromReader stores a (potentially large) piece of data
+	// associated with this ID, reading it from data, and computing its
+	// size and digest as it is written.
+	SetBigDataFromReader(id, key string, data io.Reader) error
 }
 
 // A ROLayerBigDataStore wraps up how we store RO big-data associated with layers.
@@ -162,8 +182,19 @@ type FlaggableStore interface {
 	SetFlag(id string, flag string, value interface{}) error
 }
 
+// An AnnotatedStore can have annotations set and removed on items which it
+// manages.
+type AnnotatedStore interface {
+	// UpdateAnnotations sets the annotations in set, and then removes the
+	// annotations named in remove, from an item in the store, in a single
+	// update.
+	UpdateAnnotations(id string, set map[string]string, remove []string) error
+}
+
 type StoreOptions = types.StoreOptions
 
+type ImageBigDataProvider = types.ImageBigDataProvider
+
 // Store wraps up the various types of file-based stores that we use into a
 // singleton object that initializes and manages them all together.
 type Store interface {
@@ -176,6 +207,36 @@ type Store interface {
 	UIDMap() []idtools.IDMap
 	GIDMap() []idtools.IDMap
 
+	// TempDir returns the directory in which the Store keeps temporary
+	// files, which is the TempDir that was passed to GetStore(), or a
+	// directory under the GraphRoot if none was.
+	TempDir() string
+
+	// Namespace returns the name of the namespace in which the Store keeps
+	// its image and container records, or "" for the default namespace.
+	// Stores in different namespaces under the same graph root share
+	// layers, but not images or containers.
+	Namespace() string
+
+	// NamespacePolicy returns the quota and pruning policy of the Store's
+	// namespace.  Each namespace, including the default one, has its own.
+	NamespacePolicy() (*NamespacePolicy, error)
+
+	// SetNamespacePolicy replaces the quota and pruning policy of the
+	// Store's namespace.
+	SetNamespacePolicy(policy *NamespacePolicy) error
+
+	// NamespaceUsage returns the number of bytes of layer contents which
+	// the images and containers in the Store's namespace use.  Layers
+	// which are shared with other namespaces are counted in full for
+	// each of them, and layers in additional image stores aren't counted.
+	NamespaceUsage() (int64, error)
+
+	// Prune deletes images in the Store's namespace which no container
+	// uses, and which its namespace's policy says should be removed,
+	// along with any layers which nothing else uses.
+	Prune() (*PruneReport, error)
+
 	// GraphDriver obtains and returns a handle to the graph Driver object used
 	// by the Store.
 	GraphDriver() (drivers.Driver, error)
@@ -204,7 +265,9 @@ type Store interface {
 	// referring to a specified image, and with optional metadata.  An
 	// image is a record which associates the ID of a layer with a
 	// additional bookkeeping information which the library stores for the
-	// convenience of its caller.
+	// convenience of its caller.  If the ID is that of an image in a
+	// read-only image store, the new image takes its place, as a copy of
+	// it does when names are added to it.
 	CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error)
 
 	// CreateContainer creates a new container, optionally with the
@@ -227,6 +290,24 @@ type Store interface {
 	// the object directly.
 	SetMetadata(id, metadata string) error
 
+	// UpdateAnnotations sets the annotations in set, and then removes the
+	// annotations named in remove, on a layer, image, or container
+	// (whichever the passed-in ID refers to), in a single update, so that
+	// it doesn't race with changes to its other annotations.
+	UpdateAnnotations(id string, set map[string]string, remove []string) error
+
+	// LayersByAnnotation returns a list of the layers which have an
+	// annotation with the specified key and, if it is not empty, value.
+	LayersByAnnotation(key, value string) ([]Layer, error)
+
+	// ImagesByAnnotation returns a list of the images which have an
+	// annotation with the specified key and, if it is not empty, value.
+	ImagesByAnnotation(key, value string) ([]Image, error)
+
+	// ContainersByAnnotation returns a list of the containers which have
+	// an annotation with the specified key and, if it is not empty, value.
+	ContainersByAnnotation(key, value string) ([]Container, error)
+
 	// Exists checks if there is a layer, image, or container which has the
 	// passed-in ID or name.
 	Exists(id string) bool
@@ -236,6 +317,28 @@ type Store interface {
 	// to driver.
 	Status() ([][2]string, error)
 
+	// DriverStatus asks the underlying storage driver for a structured
+	// status report.
+	DriverStatus() (*drivers.DriverStatus, error)
+
+	// DriverCapabilities reports which optional features the underlying
+	// storage driver, and the file system that it uses, provide.
+	DriverCapabilities() (drivers.Capabilities, error)
+
+	// FindPath lists the changes which the layers of an image, a
+	// container, or a layer and its parents make to paths which match
+	// pattern, in order, starting with the base layer.  A pattern which
+	// contains a "/" is matched against whole paths, using the syntax of
+	// path.Match(), and other patterns are matched against the last
+	// component of the paths.  Where possible, the paths are read from the
+	// layers' tar-split data, so the layers don't need to be mounted.
+	FindPath(id, pattern string) ([]LayerPathChange, error)
+
+	// Check looks for inconsistencies between the records of layers,
+	// images, and containers, and the data which the storage driver has
+	// for layers, and, if options.Repair is set, tries to fix them.
+	Check(options *CheckOptions) (*CheckReport, error)
+
 	// Delete removes the layer, image, or container which has the
 	// passed-in ID or name.  Note that no safety checks are performed, so
 	// this can leave images with references to layers which do not exist,
@@ -264,7 +367,8 @@ type Store interface {
 	// layer does not, an error will be returned.
 	DeleteContainer(id string) error
 
-	// Wipe removes all known layers, images, and containers.
+	// Wipe removes all known layers, images, containers, artifacts, and
+	// volumes.
 	Wipe() error
 
 	// MountImage mounts an image to temp directory and returns the mount point.
@@ -290,6 +394,11 @@ type Store interface {
 	//   }
 	Mount(id, mountLabel string) (string, error)
 
+	// MountWithOptions is like Mount, but accepts additional options.
+	// Drivers which can't honor all of them will return an error which
+	// wraps ErrNotSupported.
+	MountWithOptions(id string, options *MountOptions) (string, error)
+
 	// Unmount attempts to unmount a layer, image, or container, given an ID, a
 	// name, or a mount path. Returns whether or not the layer is still mounted.
 	Unmount(id string, force bool) (bool, error)
@@ -297,10 +406,104 @@ type Store interface {
 	// Mounted returns number of times the layer has been mounted.
 	Mounted(id string) (int, error)
 
+	// EnterMount mounts an image, layer, or container, runs a command
+	// (by default, an interactive shell) in a new mount namespace with
+	// the mounted filesystem as its working directory or root directory,
+	// waits for it to exit, and then unmounts the filesystem.  It is meant
+	// for debugging.
+	//
+	// Like Mount(), it does some of its work in a child process, so the
+	// calling process's main() function needs to call reexec.Init().  A
+	// rootless caller must also have called
+	// unshare.MaybeReexecUsingUserNamespace() so that it is running in a
+	// user namespace in which it can create mounts.
+	EnterMount(id string, options *EnterMountOptions) error
+
+	// AdoptNewFilesystem accepts the filesystem which currently holds the
+	// graph root as the store's filesystem.  If the filesystem has been
+	// replaced since the store was created, for example because a disk
+	// was replaced, most methods return a *GraphRootChangedError until
+	// this is called.  It discards the graph driver's cached results of
+	// checks for the old filesystem's features, so that the new one's
+	// will be checked instead, and records the new filesystem's identity.
+	// It isn't needed if only the filesystem's features have changed,
+	// since that is noticed and handled when the store is opened.
+	AdoptNewFilesystem() error
+
+	// TransferLayer copies a layer, including its contents, metadata,
+	// tar-split data, and ID mappings, to another Store, keeping its ID.
+	// Any of the layer's parents which the other Store doesn't already
+	// have are copied first.  If both Stores use the same graph driver and
+	// are on the same filesystem, the driver may clone the layer's
+	// contents instead of extracting them from a diff.  If the other Store
+	// already has a layer with the same ID, that layer is returned.
+	TransferLayer(id string, dest Store, options *TransferLayerOptions) (*Layer, error)
+
+	// CloneTo creates a new Store using the specified options, and copies
+	// this Store's layers, images, containers, and artifacts into it,
+	// keeping their IDs.  If cloneOptions lists images, only those images
+	// and the layers which they use are copied.  Layers are copied using
+	// TransferLayer(), so their contents are cloned when the graph driver
+	// and filesystem allow it.  The caller is responsible for shutting
+	// down the new Store.
+	CloneTo(options types.StoreOptions, cloneOptions *CloneOptions) (Store, error)
+
+	// MoveContainerLayer moves a container, which must not be mounted, to
+	// another Store, which can use a different graph root or graph
+	// driver, keeping its ID, names, metadata, big data items, and the
+	// contents of its layer and its directory.  The container's image
+	// and the image's layers are copied to the other Store if it doesn't
+	// already have them, but are not removed from this one.  Once the
+	// container has been copied, it is deleted from this Store, and the
+	// copy is returned.
+	MoveContainerLayer(id string, dest Store) (*Container, error)
+
+	// ConvertDriver opens a Store which uses the same graph root and run
+	// root as this one, but the specified graph driver, and re-creates
+	// this Store's layers, images, and containers in it, keeping their
+	// IDs, by extracting the layers' diffs.  Items which the other Store
+	// already has are skipped, so a conversion which was interrupted can
+	// be resumed by calling ConvertDriver() again.  Once the conversion is
+	// complete, this Store should be shut down, and the graph root should
+	// be opened using the new driver from then on.  The caller is
+	// responsible for shutting down the returned Store.
+	ConvertDriver(target string, options *ConvertDriverOptions) (Store, error)
+
+	// DigestAlgorithm returns the algorithm which the Store uses to
+	// compute the digests of the uncompressed contents of layers.  Layers'
+	// UncompressedDigest values always use digest.Canonical, and if this
+	// is a different algorithm, the digests which it computes are recorded
+	// as their AdditionalUncompressedDigests.  It is chosen when the Store
+	// is first used, and doesn't change after that.
+	DigestAlgorithm() digest.Algorithm
+
+	// SnapshotContainer turns the current contents of a container's
+	// layer, which must not be mounted, into a new layer with the
+	// specified names, which becomes the parent of the container's layer,
+	// so that the container's layer only records the changes which are
+	// made after the snapshot is taken.  Diff() can then be used to
+	// retrieve just those changes, for example to make an incremental
+	// backup.  The graph driver must be able to do this cheaply, and if
+	// it can't, a wrapped ErrNotSupported is returned.  The new layer is
+	// not removed when the container is.
+	SnapshotContainer(id string, names []string) (*Layer, error)
+
+	// ResetContainerLayer discards the changes which have been made to a
+	// container's layer, which must not be mounted, without recreating
+	// the container.  If snapshot is "", the layer goes back to matching
+	// its parent, which is either the most recent snapshot that was taken
+	// using SnapshotContainer() or the container's image's top layer.
+	// Otherwise, snapshot should be the ID or name of either an older
+	// snapshot of the container or the image's top layer, and it becomes
+	// the layer's parent.  Snapshots which were taken after it are left
+	// in place.
+	ResetContainerLayer(id, snapshot string) error
+
 	// Changes returns a summary of the changes which would need to be made
-	// to one layer to make its contents the same as a second layer.  If
-	// the first layer is not specified, the second layer's parent is
-	// assumed.  Each Change structure contains a Path relative to the
+	// to one layer to make its contents the same as a second layer.  The
+	// layers need not be related to one another, but they need to be in
+	// the same layer store.  If the first layer is not specified, or isn't
+	// known, the second layer's parent is assumed.  Each Change structure contains a Path relative to the
 	// layer's root directory, and a Kind which is either ChangeAdd,
 	// ChangeModify, or ChangeDelete.
 	Changes(from, to string) ([]archive.Change, error)
@@ -314,6 +517,27 @@ type Store interface {
 	// behaviors.
 	Diff(from, to string, options *DiffOptions) (io.ReadCloser, error)
 
+	// ExportImage writes an image, along with its layers, its
+	// configuration, and its names, to w as a tar archive in OCI image
+	// layout format.  The layers are compressed using gzip.  If the image
+	// has no configuration blob which matches its layers, a minimal one is
+	// generated.
+	ExportImage(id string, w io.Writer) error
+
+	// ImportImage reads an image which was written by ExportImage(), or
+	// any other OCI image layout archive which contains exactly one image,
+	// and adds it and its layers to the store, reusing any layers which
+	// are already present.  The digests of the blobs and of the layers'
+	// uncompressed contents are verified.
+	ImportImage(r io.Reader) (*Image, error)
+
+	// VerifyImage regenerates the diff for each of an image's layers,
+	// from the layer's tar-split data if it has any, and compares its
+	// digest with the DiffID which the image's configuration lists for
+	// the layer.  Mismatches are listed in the report, and are not
+	// treated as errors.
+	VerifyImage(id string) (*VerifyImageReport, error)
+
 	// ApplyDiff applies a tarstream to a layer.  Information about the
 	// tarstream is cached with the layer.  Typically, a layer which is
 	// populated using a tarstream will be expected to not be modified in
@@ -328,6 +552,22 @@ type Store interface {
 	//   }
 	ApplyDiff(to string, diff io.Reader) (int64, error)
 
+	// ApplyDiffWithOptions is like ApplyDiff, but uses the digests and the
+	// progress callback, if any, which are set in options.
+	ApplyDiffWithOptions(to string, options *LayerOptions, diff io.Reader) (int64, error)
+
+	// ApplyDirectory adds the contents of a directory to a layer, much as
+	// ApplyDiff would if it were passed a diff which contained them, but
+	// without making one if the graph driver keeps each layer's files
+	// separately, as the overlay driver does, in which case the files are
+	// moved or copied, cloning their contents where the filesystem allows
+	// it, directly into the layer.  Ownership and permissions are kept as
+	// they are, and aren't affected by the layer's ID mappings.  Since no
+	// diff is recorded, the layer's digests are cleared, and Diff()
+	// computes its changes from its contents.  It returns the total size
+	// of the regular files which were added.
+	ApplyDirectory(to, dir string, options *ApplyDirectoryOptions) (int64, error)
+
 	// ApplyDiffer applies a diff to a layer.
 	// It is the caller responsibility to clean the staging directory if it is not
 	// successfully applied with ApplyDiffFromStagingDirectory.
@@ -354,6 +594,25 @@ type Store interface {
 	// if we don't have a value on hand.
 	LayerSize(id string) (int64, error)
 
+	// LayersBySource returns a slice of the layers which were recorded as
+	// having been created using contents from the specified source.
+	LayersBySource(source string) ([]Layer, error)
+
+	// ImageHistory returns the layers which make up an image, starting
+	// with its base layer, along with any records of where they came from.
+	ImageHistory(id string) ([]Layer, error)
+
+	// SetLayerComposefsDigest records the fs-verity digest of the
+	// composefs image which was built from a layer's contents, for use
+	// by programs which convert layers into composefs images.
+	SetLayerComposefsDigest(id string, d digest.Digest) error
+
+	// ImageVerityDigests returns the composefs digests of the layers which
+	// make up an image, starting with its base layer, so that the image's
+	// contents can be verified layer by layer.  Layers which haven't been
+	// converted into composefs images are included with no digest.
+	ImageVerityDigests(id string) ([]LayerVerityDigest, error)
+
 	// LayerParentOwners returns the UIDs and GIDs of owners of parents of
 	// the layer's mountpoint for which the layer's UID and GID maps (if
 	// any are defined) don't contain corresponding IDs.
@@ -409,6 +668,107 @@ type Store interface {
 	// allow ImagesByDigest to find images by their correct digests.
 	SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error
 
+	// ImageBigDataReader returns a reader for a (possibly large) chunk of
+	// named data associated with an image, so that it doesn't need to be
+	// read into memory all at once.
+	ImageBigDataReader(id, key string) (io.ReadCloser, error)
+
+	// SetImageBigDataFromReader stores a (possibly large) chunk of named
+	// data associated with an image, reading it from data, and computing
+	// its size and digest as it is written, so that it doesn't need to be
+	// read into memory all at once.  The data is copied to a file in
+	// TempDir() before the image store is locked, so that other users of
+	// the store don't have to wait while it's read.
+	SetImageBigDataFromReader(id, key string, data io.Reader, digestManifest func([]byte) (digest.Digest, error)) error
+
+	// AddImageAttachment stores data, like a signature, an SBOM, or an
+	// attestation, as an attachment of the specified kind to an image,
+	// with an optional media type.  Attachments are kept as big data
+	// items, and are located using their kinds and the digests of their
+	// contents.  If the image already has an identical attachment of that
+	// kind, it is returned instead.
+	AddImageAttachment(id string, kind ImageAttachmentKind, mediaType string, data []byte) (*ImageAttachment, error)
+
+	// ImageAttachments lists an image's attachments of the specified
+	// kind, or all of its attachments if kind is "", in the order in which
+	// they were added.
+	ImageAttachments(id string, kind ImageAttachmentKind) ([]ImageAttachment, error)
+
+	// ImageAttachmentData retrieves the contents of an image's attachment
+	// of the specified kind, whose contents have the specified digest.
+	ImageAttachmentData(id string, kind ImageAttachmentKind, d digest.Digest) ([]byte, error)
+
+	// RemoveImageAttachment removes an image's attachment of the
+	// specified kind, whose contents have the specified digest.
+	RemoveImageAttachment(id string, kind ImageAttachmentKind, d digest.Digest) error
+
+	// CreateArtifact records an artifact, which is content other than a
+	// container image that is described by a manifest, with a specified
+	// ID (or a random one) and optional names.  Artifacts are kept
+	// separately from images, so their names can be the same as those of
+	// images.
+	CreateArtifact(id string, names []string, manifest []byte, options *ArtifactOptions) (*Artifact, error)
+
+	// PutArtifactBlob stores a blob which an artifact's manifest refers
+	// to, with an optional media type.  If expected is set, the blob's
+	// contents must have that digest.  Blobs are shared by artifacts
+	// which include the same contents.
+	PutArtifactBlob(id, mediaType string, blob io.Reader, expected digest.Digest) (*ArtifactBlob, error)
+
+	// ArtifactBlob opens an artifact's manifest, if d is its digest, or a
+	// blob which has been added to it.
+	ArtifactBlob(id string, d digest.Digest) (io.ReadCloser, error)
+
+	// Artifact returns a specific artifact.
+	Artifact(id string) (*Artifact, error)
+
+	// Artifacts returns a list of the currently known artifacts.
+	Artifacts() ([]Artifact, error)
+
+	// AddArtifactNames adds names to an artifact, taking them from any
+	// other artifact which has them.
+	AddArtifactNames(id string, names []string) error
+
+	// RemoveArtifactNames removes names from an artifact.
+	RemoveArtifactNames(id string, names []string) error
+
+	// UpdateArtifactAnnotations sets and removes annotations of an
+	// artifact.
+	UpdateArtifactAnnotations(id string, set map[string]string, remove []string) error
+
+	// DeleteArtifact removes an artifact, along with any of its blobs
+	// which no other artifact refers to.
+	DeleteArtifact(id string) error
+
+	// CreateVolume records a volume, which is a directory that can be
+	// mounted into containers to hold data which outlives them, with a
+	// specified ID (or a random one) and optional names.  Its contents
+	// are managed by the VolumeDriver named in the options, which is
+	// "local" by default.
+	CreateVolume(id string, names []string, options *VolumeOptions) (*Volume, error)
+
+	// Volume returns a specific volume.
+	Volume(id string) (*Volume, error)
+
+	// Volumes returns a list of the currently known volumes.
+	Volumes() ([]Volume, error)
+
+	// MountVolume makes a volume's contents available, if they aren't
+	// already, and returns the location of the directory in which they
+	// can be found.
+	MountVolume(id string) (string, error)
+
+	// UnmountVolume undoes a call to MountVolume(), or all of them if
+	// "force" is true, and returns true if the volume is still mounted.
+	UnmountVolume(id string, force bool) (bool, error)
+
+	// UpdateVolumeLabels sets and removes labels of a volume.
+	UpdateVolumeLabels(id string, set map[string]string, remove []string) error
+
+	// DeleteVolume removes a volume and its contents.  Volumes which are
+	// mounted can't be removed.
+	DeleteVolume(id string) error
+
 	// ListLayerBigData retrieves a list of the (possibly large) chunks of
 	// named data associated with an layer.
 	ListLayerBigData(id string) ([]string, error)
@@ -444,6 +804,18 @@ type Store interface {
 	// associated with a container.
 	SetContainerBigData(id, key string, data []byte) error
 
+	// ContainerBigDataReader returns a reader for a (possibly large) chunk
+	// of named data associated with a container, so that it doesn't need
+	// to be read into memory all at once.
+	ContainerBigDataReader(id, key string) (io.ReadCloser, error)
+
+	// SetContainerBigDataFromReader stores a (possibly large) chunk of
+	// named data associated with a container, reading it from data, and
+	// computing its size and digest as it is written.  Like
+	// SetImageBigDataFromReader, it copies the data to a file in TempDir()
+	// before locking the container store.
+	SetContainerBigDataFromReader(id, key string, data io.Reader) error
+
 	// ContainerSize computes the size of the container's layer and ancillary
 	// data.  Warning:  this is a potentially expensive operation.
 	ContainerSize(id string) (int64, error)
@@ -463,6 +835,50 @@ type Store interface {
 	// named ImageDigestBigDataKey whose contents have the specified digest.
 	ImagesByDigest(d digest.Digest) ([]*Image, error)
 
+	// ResolveImageStore returns the location of the image store in which
+	// the specified image was found: the graph root if it is in the
+	// Store's own image store, or the location of the additional image
+	// store which contains it.  Additional image stores are searched in
+	// order of their priorities.
+	ResolveImageStore(id string) (string, error)
+
+	// ResolveLayerStore returns the location of the store in which the
+	// specified layer was found, like ResolveImageStore() does for images.
+	ResolveLayerStore(id string) (string, error)
+
+	// MaskImage hides an image which is in an additional image store, so
+	// that it can no longer be found using this Store, without modifying
+	// the additional image store.  The list of hidden images is kept in
+	// the graph root.  If another additional image store contains an
+	// image with the same ID, it is hidden as well.
+	MaskImage(id string) error
+
+	// UnmaskImage makes an image which was hidden using MaskImage()
+	// visible again.  The image must be specified using its full ID.
+	UnmaskImage(id string) error
+
+	// MaskedImages returns the IDs of the images which have been hidden
+	// using MaskImage().
+	MaskedImages() ([]string, error)
+
+	// PinImage marks an image as pinned, so that DeleteImage() and
+	// Delete() refuse to remove it until UnpinImage() is called, and
+	// DeleteImage() doesn't remove it when it removes images which no
+	// longer have names.  The mark is kept in the image's Flags.
+	PinImage(id string) error
+
+	// UnpinImage removes the mark which PinImage() set on an image.
+	UnpinImage(id string) error
+
+	// PinLayer marks a layer as pinned, so that DeleteLayer() and Delete()
+	// refuse to remove it until UnpinLayer() is called, and DeleteImage()
+	// doesn't remove it, or its parents, along with an image which used
+	// it.  The mark is kept in the layer's Flags.
+	PinLayer(id string) error
+
+	// UnpinLayer removes the mark which PinLayer() set on a layer.
+	UnpinLayer(id string) error
+
 	// Container returns a specific container.
 	Container(id string) (*Container, error)
 
@@ -512,12 +928,43 @@ type Store interface {
 	Lookup(name string) (string, error)
 
 	// Shutdown attempts to free any kernel resources which are being used
-	// by the underlying driver.  If "force" is true, any mounted (i.e., in
+	// by the underlying driver.  It first waits for operations which are
+	// in progress when it's called to finish, but it doesn't keep new ones
+	// from starting after that, so callers should stop using the store
+	// before calling it.  If "force" is true, any mounted (i.e., in
 	// use) layers are unmounted beforehand.  If "force" is not true, then
 	// layers being in use is considered to be an error condition.  A list
-	// of still-mounted layers is returned along with possible errors.
+	// of still-mounted layers, which when "force" is true is the list of
+	// layers which could not be unmounted, is returned along with possible
+	// errors.  If everything is unmounted, and no other Store is using the
+	// graph root, it is marked as having been shut down cleanly.  Stores
+	// in other processes are counted as users of the graph root from the
+	// time they're opened until they're freed or the process exits, but
+	// only if they were opened using a version of this library which
+	// counts them.
 	Shutdown(force bool) (layers []string, err error)
 
+	// WaitForDeletions waits for the contents of deleted layers, which
+	// are removed in the background, to finish being removed.  Processes
+	// which exit without shutting down the store should call it first,
+	// or the contents will be left for the next process to remove.
+	WaitForDeletions()
+
+	// ShutDownCleanly returns true if, when the Store was opened, the
+	// graph root was marked as having been shut down cleanly by the last
+	// Shutdown() call, and it had not been opened since then, so that
+	// nothing should have been left half-finished and checking it for
+	// inconsistencies using Check() can be skipped.
+	ShutDownCleanly() bool
+
+	// ReloadIfChanged reloads the layer, image, and container records if
+	// another process has modified them since they were last read.  Where
+	// it's possible, the store uses inotify to notice modifications, so
+	// that calling this when nothing has changed doesn't require acquiring
+	// or reading any lock files, and it can be called often by long-running
+	// processes which want to notice modifications promptly.
+	ReloadIfChanged() error
+
 	// Version returns version information, in the form of key-value pairs, from
 	// the storage package.
 	Version() ([][2]string, error)
@@ -574,6 +1021,35 @@ type LayerOptions struct {
 	// and reliably known by the caller.
 	// Use the default "" if this fields is not applicable or the value is not known.
 	UncompressedDigest digest.Digest
+	// Progress, if set, is called as the contents of the layer are
+	// populated: first as the contents of the parent layer are copied, by
+	// drivers which need to do that, and then again, with the counts
+	// starting over, as entries in the diff are extracted.
+	Progress archive.ProgressFunc
+	// ImageStore, if set, is the location of one of the graph driver's
+	// writable image stores, such as the one set using the overlay
+	// driver's "writable_imagestore" option, in which the layer should be
+	// created instead of under the store's GraphRoot.  Only layers which
+	// aren't writeable can be placed in image stores.  The location is
+	// recorded in the layer's ImageStore field.
+	ImageStore string
+	// Provenance, if set, is recorded in the new layer's Provenance field,
+	// to note where its contents came from.
+	Provenance *LayerProvenance
+	// EncryptionKeyID, if set, is the ID of the key, obtained from the
+	// Store's EncryptionKeyProvider, which the layer's contents are
+	// encrypted with, such as a key which is used for every layer of an
+	// image.  If it isn't set, the parent layer's key, or the key which
+	// the Store was opened with, is used, if there is one.
+	EncryptionKeyID string
+	// TarSplit, if set, is tar-split metadata for the uncompressed diff,
+	// in the format used by github.com/vbatts/tar-split/tar/storage's
+	// JSONPacker, and optionally gzip-compressed, which the caller
+	// generated while it was reading the diff.  It is saved instead of
+	// being generated again while the diff is extracted.  After the diff
+	// is extracted, it is reassembled using the tar-split data, and an
+	// error is returned if the result doesn't match the diff.
+	TarSplit []byte
 }
 
 // ImageOptions is used for passing options to a Store's CreateImage() method.
@@ -599,6 +1075,31 @@ type ContainerOptions struct {
 	StorageOpt map[string]string
 }
 
+// MountOptions is used for passing options to a Store's MountWithOptions() method.
+type MountOptions struct {
+	// MountLabel is the SELinux label to use for the mount.  If it is not
+	// set, the default label for the container or layer will be used.
+	MountLabel string
+	// AdditionalLowers is a list of directories, such as cache or build
+	// stage directories, which should appear in the mount below the
+	// layer's own contents and above those of its parents, with earlier
+	// entries taking precedence over later ones.  The directories must
+	// not be modified while the layer is mounted.  A layer which is
+	// already mounted can only be mounted again with the same list.
+	AdditionalLowers []string
+	// Propagation is the mount propagation to set on the mountpoint,
+	// "private", "rshared", or "rslave".  If it is not set, the driver's
+	// default is used.
+	Propagation string
+	// Relabel, if set to "private" or "shared", relabels the layer's
+	// contents with the mount label, or with a version of it which any
+	// container can use, while mounting it, if the storage driver doesn't
+	// apply the label using mount options.  The label which was used is
+	// recorded, and the contents aren't relabeled again when they're
+	// mounted with the same label and policy.
+	Relabel string
+}
+
 type store struct {
 	lastLoaded      time.Time
 	runRoot         string
@@ -620,13 +1121,99 @@ type store struct {
 	imageStore      ImageStore
 	roImageStores   []ROImageStore
 	containerStore  ContainerStore
+	artifactStore   *artifactStore
+	volumeStore     *volumeStore
 	digestLockRoot  string
 	disableVolatile bool
+	namespace       string
+	// readOnly is set if the Store was opened using the ReadOnly option.
+	readOnly bool
+	// hardlinkDedup is set if the Store was opened using the
+	// HardlinkDedup option.
+	hardlinkDedup bool
+	// containerLog is set if the Store was opened using the
+	// ContainerRecordsLog option.
+	containerLog bool
+	// trackLayerChanges is set if the Store was opened using the
+	// TrackLayerChanges option.
+	trackLayerChanges bool
+	// reservedSpace is the number of bytes which we should keep free
+	// when adding to the contents of layers.
+	reservedSpace int64
+	// digestAlgorithm is the algorithm which we use to compute the
+	// digests of the uncompressed contents of layers.
+	digestAlgorithm digest.Algorithm
+	// idGenerator is the IDGenerator which the Store was opened with.
+	idGenerator stringid.Generator
+	// encryptionKeyProvider and encryptionKeyID are the
+	// EncryptionKeyProvider and EncryptionKeyID which the Store was
+	// opened with.
+	encryptionKeyProvider fscrypt.KeyProvider
+	encryptionKeyID       string
+	// imageBigDataProvider is the ImageBigDataProvider which the Store
+	// was opened with.
+	imageBigDataProvider ImageBigDataProvider
+	// reaper, if not nil, removes the contents of deleted layers in the
+	// background.  It always finishes removals which an earlier process
+	// left unfinished, but it's only used for new ones if
+	// deleteInBackground is set.
+	reaper *reaper
+	// trash, if not nil, is where directories which are being deleted
+	// are moved so that the reaper can remove them.
+	trash *trash
+	// deleteInBackground is set if the DeleteWorkers option asked for
+	// the contents of deleted items to be removed in the background.
+	deleteInBackground bool
+	// tempDir is the TempDir which the Store was opened with, if it
+	// was opened with one.
+	tempDir string
+	// writerOptions control how the records of layers, images,
+	// containers, artifacts, and volumes, and their big data items, are
+	// written.
+	writerOptions ioutils.AtomicFileWriterOptions
+	// imageStoreTokens are the tokens for accessing additional image
+	// stores, and imageStores are the ones which they let us use.
+	imageStoreTokens map[string]string
+	imageStores      []string
+	// imageStorePriorities are the priorities of additional image stores.
+	imageStorePriorities map[string]int
+	// imageMasks records which images in additional image stores have
+	// been hidden.
+	imageMasks *imageMasks
+	// graphRootChanged is set if the graph root's filesystem has been
+	// replaced, until AdoptNewFilesystem() is called.
+	graphRootChanged error
+	// loaded is set once load() has succeeded.  The image, container, and
+	// artifact stores are created the first time they're needed after
+	// that, while holding storesLock.
+	loaded     bool
+	storesLock sync.Mutex
+	// peerImageStores and peerContainerStores are the image and
+	// container stores of other namespaces, keyed by their locations,
+	// which we've opened to check which layers they use.  They're
+	// created the first time they're needed, while holding storesLock.
+	peerImageStores     map[string]ImageStore
+	peerContainerStores map[string]ContainerStore
+	// shutDownCleanly is set if the graph root was marked as having been
+	// shut down cleanly when the Store was opened.
+	shutDownCleanly bool
+	// users is a shared lock which we hold while we're using the graph
+	// root, so that Shutdown() can tell if any other Store still is.
+	users *usersLock
+	// watcher, if it is not nil, tells us when the directories which hold
+	// the lock files and records have been modified.  watchFailed is set
+	// if we couldn't start one, so that we don't keep trying.
+	watchLock   sync.Mutex
+	watcher     *changeWatcher
+	watchFailed bool
 }
 
 // GetStore attempts to find an already-created Store object matching the
 // specified location and graph driver, and if it can't, it creates and
 // initializes a new Store object, and the underlying storage that it controls.
+// If a Store which matches is already open, but it was opened with different
+// ReadOnly, Durability, or DurabilityBatchWindow settings, ErrStoreOptionsConflict
+// is returned.
 //
 // If StoreOptions `options` haven't been fully populated, then DefaultStoreOptions are used.
 //
@@ -660,13 +1247,36 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		}
 		options.RunRoot = dir
 	}
+	if options.TempDir != "" {
+		dir, err := filepath.Abs(options.TempDir)
+		if err != nil {
+			return nil, err
+		}
+		options.TempDir = dir
+	}
+	if err := validateNamespace(options.Namespace); err != nil {
+		return nil, err
+	}
+	durability, err := ioutils.ParseDurability(options.Durability)
+	if err != nil {
+		return nil, err
+	}
 
 	storesLock.Lock()
 	defer storesLock.Unlock()
 
 	// return if BOTH run and graph root are matched, otherwise our run-root can be overridden if the graph is found first
 	for _, s := range stores {
-		if (s.graphRoot == options.GraphRoot) && (s.runRoot == options.RunRoot) && (options.GraphDriverName == "" || s.graphDriverName == options.GraphDriverName) {
+		if (s.graphRoot == options.GraphRoot) && (s.runRoot == options.RunRoot) && (options.GraphDriverName == "" || s.graphDriverName == options.GraphDriverName) && s.namespace == options.Namespace && sameImageStoreTokens(s.imageStoreTokens, options.ImageStoreTokens) {
+			// Don't hand a writable Store to a caller which asked
+			// for a read-only one, or one which syncs its records
+			// differently than the caller asked for.
+			if s.readOnly != options.ReadOnly {
+				return nil, errors.Wrapf(ErrStoreOptionsConflict, "store at %q is already open with read-only set to %v", s.graphRoot, s.readOnly)
+			}
+			if s.writerOptions.Durability != durability || s.writerOptions.BatchWindow != options.DurabilityBatchWindow {
+				return nil, errors.Wrapf(ErrStoreOptionsConflict, "store at %q is already open with a different durability profile", s.graphRoot)
+			}
 			return s, nil
 		}
 	}
@@ -680,25 +1290,51 @@ func GetStore(options types.StoreOptions) (Store, error) {
 	case options.RunRoot == "":
 		options.RunRoot = types.Options().RunRoot
 	}
+	if options.EncryptionKeyID != "" && options.EncryptionKeyProvider == nil {
+		return nil, errors.Wrap(ErrIncompleteOptions, "an encryption key ID was specified without an encryption key provider")
+	}
 
 	if err := os.MkdirAll(options.RunRoot, 0700); err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(options.GraphRoot, 0700); err != nil {
-		return nil, err
-	}
-	for _, subdir := range []string{"mounts", "tmp", options.GraphDriverName} {
-		if err := os.MkdirAll(filepath.Join(options.GraphRoot, subdir), 0700); err != nil {
+	// A read-only store's graph root was populated ahead of time, and may
+	// be on a file system which we can't write to, or be in use by another
+	// process, so we only take shared locks on the lock files which are
+	// already in it, and keep any which we would have created in it in the
+	// run root instead.
+	lockRoot := options.GraphRoot
+	if options.ReadOnly {
+		if _, err := os.Stat(options.GraphRoot); err != nil {
 			return nil, err
 		}
+		lockRoot = options.RunRoot
+	} else {
+		if err := os.MkdirAll(options.GraphRoot, 0700); err != nil {
+			return nil, err
+		}
+		for _, subdir := range []string{"mounts", "tmp", options.GraphDriverName} {
+			if err := os.MkdirAll(filepath.Join(options.GraphRoot, subdir), 0700); err != nil {
+				return nil, err
+			}
+		}
+		if options.TempDir != "" {
+			if err := os.MkdirAll(options.TempDir, 0700); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	graphLock, err := GetLockfile(filepath.Join(options.GraphRoot, "storage.lock"))
+	var graphLock Locker
+	if options.ReadOnly {
+		graphLock, err = getReadOnlyStoreLockfile(filepath.Join(options.GraphRoot, "storage.lock"), filepath.Join(lockRoot, "storage.lock"))
+	} else {
+		graphLock, err = GetLockfile(filepath.Join(lockRoot, "storage.lock"))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	usernsLock, err := GetLockfile(filepath.Join(options.GraphRoot, "userns.lock"))
+	usernsLock, err := GetLockfile(filepath.Join(lockRoot, "userns.lock"))
 	if err != nil {
 		return nil, err
 	}
@@ -712,22 +1348,84 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		autoNsMaxSize = AutoUserNsMaxSize
 	}
 	s := &store{
-		runRoot:         options.RunRoot,
-		graphLock:       graphLock,
-		graphRoot:       options.GraphRoot,
-		graphDriverName: options.GraphDriverName,
-		graphOptions:    options.GraphDriverOptions,
-		uidMap:          copyIDMap(options.UIDMap),
-		gidMap:          copyIDMap(options.GIDMap),
-		autoUsernsUser:  options.RootAutoNsUser,
-		autoNsMinSize:   autoNsMinSize,
-		autoNsMaxSize:   autoNsMaxSize,
-		additionalUIDs:  nil,
-		additionalGIDs:  nil,
-		usernsLock:      usernsLock,
-		disableVolatile: options.DisableVolatile,
+		runRoot:           options.RunRoot,
+		graphLock:         graphLock,
+		graphRoot:         options.GraphRoot,
+		graphDriverName:   options.GraphDriverName,
+		graphOptions:      options.GraphDriverOptions,
+		uidMap:            copyIDMap(options.UIDMap),
+		gidMap:            copyIDMap(options.GIDMap),
+		autoUsernsUser:    options.RootAutoNsUser,
+		autoNsMinSize:     autoNsMinSize,
+		autoNsMaxSize:     autoNsMaxSize,
+		additionalUIDs:    nil,
+		additionalGIDs:    nil,
+		usernsLock:        usernsLock,
+		disableVolatile:   options.DisableVolatile,
+		namespace:         options.Namespace,
+		readOnly:          options.ReadOnly,
+		hardlinkDedup:     options.HardlinkDedup,
+		containerLog:      options.ContainerRecordsLog,
+		trackLayerChanges: options.TrackLayerChanges,
+		reservedSpace:     options.ReservedSpace,
+		idGenerator:       options.IDGenerator,
+
+		encryptionKeyProvider: options.EncryptionKeyProvider,
+		encryptionKeyID:       options.EncryptionKeyID,
+		imageBigDataProvider:  options.ImageBigDataProvider,
+		tempDir:               options.TempDir,
+		writerOptions: ioutils.AtomicFileWriterOptions{
+			Durability:  durability,
+			BatchWindow: options.DurabilityBatchWindow,
+			TempDir:     options.TempDir,
+		},
+	}
+	s.deleteInBackground = options.DeleteWorkers > 0
+	s.reaper = newReaper(options.DeleteWorkers)
+	if !options.ReadOnly {
+		if s.trash, err = newTrash(options.GraphRoot, s.reaper); err != nil {
+			return nil, err
+		}
+		if err := s.trash.resume(); err != nil {
+			logrus.Warnf("Error resuming removal of deleted items in %q: %v", s.trash.dir, err)
+		}
+	}
+	s.imageStoreTokens = make(map[string]string, len(options.ImageStoreTokens))
+	for store, token := range options.ImageStoreTokens {
+		s.imageStoreTokens[store] = token
+	}
+	s.imageStorePriorities = make(map[string]int, len(options.ImageStorePriorities))
+	for store, priority := range options.ImageStorePriorities {
+		s.imageStorePriorities[store] = priority
+	}
+	// Count ourselves as a user of the graph root before we clear the
+	// mark which says that it was shut down cleanly, so that a Store
+	// which is shutting down can't mark it again while we're using it.
+	if s.users, err = openUsersLock(filepath.Join(s.graphRoot, "users.lock")); err != nil {
+		return nil, err
 	}
-	if err := s.load(); err != nil {
+	graphLock.Lock()
+	s.digestAlgorithm, err = s.chooseDigestAlgorithm(options.DigestAlgorithm)
+	if err != nil {
+		graphLock.Unlock()
+		s.users.close()
+		return nil, err
+	}
+	err = s.checkFilesystemIdentity()
+	if err == nil {
+		s.shutDownCleanly, err = s.takeCleanShutdownMarker()
+	}
+	graphLock.Unlock()
+	if err != nil {
+		if !errors.Is(err, ErrGraphRootChanged) {
+			s.users.close()
+			return nil, err
+		}
+		// Hand back a store which refuses to do anything until the
+		// caller decides to adopt the new filesystem.
+		s.graphRootChanged = err
+	} else if err := s.load(); err != nil {
+		s.users.close()
 		return nil, err
 	}
 
@@ -772,6 +1470,13 @@ func (s *store) GraphRoot() string {
 	return s.graphRoot
 }
 
+func (s *store) TempDir() string {
+	if s.tempDir != "" {
+		return s.tempDir
+	}
+	return filepath.Join(s.graphRoot, "tmp")
+}
+
 func (s *store) GraphOptions() []string {
 	return s.graphOptions
 }
@@ -792,48 +1497,25 @@ func (s *store) load() error {
 	s.graphDriver = driver
 	s.graphDriverName = driver.String()
 	driverPrefix := s.graphDriverName + "-"
+	s.imageStores = s.prioritizedImageStores(driver.AdditionalImageStores())
 
-	gipath := filepath.Join(s.graphRoot, driverPrefix+"images")
-	if err := os.MkdirAll(gipath, 0700); err != nil {
-		return err
-	}
-	ris, err := newImageStore(gipath)
-	if err != nil {
-		return err
-	}
-	s.imageStore = ris
-	if _, err := s.ROImageStores(); err != nil {
-		return err
-	}
-
-	gcpath := filepath.Join(s.graphRoot, driverPrefix+"containers")
-	if err := os.MkdirAll(gcpath, 0700); err != nil {
-		return err
-	}
-	rcs, err := newContainerStore(gcpath)
-	if err != nil {
-		return err
-	}
-	rcpath := filepath.Join(s.runRoot, driverPrefix+"containers")
-	if err := os.MkdirAll(rcpath, 0700); err != nil {
-		return err
-	}
-	s.containerStore = rcs
-
-	for _, store := range driver.AdditionalImageStores() {
-		gipath := filepath.Join(store, driverPrefix+"images")
-		ris, err := newROImageStore(gipath)
-		if err != nil {
-			return err
-		}
-		s.roImageStores = append(s.roImageStores, ris)
-	}
+	// The records of images, containers, and artifacts aren't read until
+	// they're first needed, so that callers which only use some of them,
+	// such as those which only look at layers, don't wait for the rest to be
+	// read.  When they are read, like the layer records which are read
+	// when the Store is opened, they're parsed as they're read from disk,
+	// without first reading the whole file into memory.
+	gipath := filepath.Join(s.catalogGraphRoot(), driverPrefix+"images")
+	s.imageMasks = newImageMasks(filepath.Join(gipath, "masked-images.json"))
 
 	s.digestLockRoot = filepath.Join(s.runRoot, driverPrefix+"locks")
 	if err := os.MkdirAll(s.digestLockRoot, 0700); err != nil {
 		return err
 	}
 
+	s.storesLock.Lock()
+	s.loaded = true
+	s.storesLock.Unlock()
 	return nil
 }
 
@@ -849,13 +1531,14 @@ func (s *store) getGraphDriver() (drivers.Driver, error) {
 	config := drivers.Options{
 		Root:          s.graphRoot,
 		RunRoot:       s.runRoot,
-		DriverOptions: s.graphOptions,
+		DriverOptions: s.accessibleDriverOptions(s.graphOptions),
 		UIDMaps:       s.uidMap,
 		GIDMaps:       s.gidMap,
+		TempDir:       s.tempDir,
 	}
 	driver, err := drivers.New(s.graphDriverName, config)
 	if err != nil {
-		return nil, err
+		return nil, wrapDriverInitError(err)
 	}
 	s.graphDriver = driver
 	s.graphDriverName = driver.String()
@@ -865,6 +1548,9 @@ func (s *store) getGraphDriver() (drivers.Driver, error) {
 func (s *store) GraphDriver() (drivers.Driver, error) {
 	s.graphLock.Lock()
 	defer s.graphLock.Unlock()
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
 	if s.graphLock.TouchedSince(s.lastLoaded) {
 		s.graphDriver = nil
 		s.layerStore = nil
@@ -879,6 +1565,9 @@ func (s *store) GraphDriver() (drivers.Driver, error) {
 func (s *store) LayerStore() (LayerStore, error) {
 	s.graphLock.Lock()
 	defer s.graphLock.Unlock()
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
 	if s.graphLock.TouchedSince(s.lastLoaded) {
 		s.graphDriver = nil
 		s.layerStore = nil
@@ -897,13 +1586,20 @@ func (s *store) LayerStore() (LayerStore, error) {
 		return nil, err
 	}
 	glpath := filepath.Join(s.graphRoot, driverPrefix+"layers")
-	if err := os.MkdirAll(glpath, 0700); err != nil {
-		return nil, err
+	if !s.readOnly {
+		if err := os.MkdirAll(glpath, 0700); err != nil {
+			return nil, err
+		}
 	}
 	rls, err := s.newLayerStore(rlpath, glpath, driver)
 	if err != nil {
 		return nil, err
 	}
+	if deferred, ok := driver.(drivers.DeferredRemoveDriver); ok && s.trash != nil {
+		s.reaper.cleanupOnce("contents of previously deleted layers", func() error {
+			return s.trash.adoptDirs(deferred.DeferredRemovalDirs()...)
+		})
+	}
 	s.layerStore = rls
 	return s.layerStore, nil
 }
@@ -914,6 +1610,9 @@ func (s *store) LayerStore() (LayerStore, error) {
 func (s *store) ROLayerStores() ([]ROLayerStore, error) {
 	s.graphLock.Lock()
 	defer s.graphLock.Unlock()
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
 	if s.roLayerStores != nil {
 		return s.roLayerStores, nil
 	}
@@ -926,7 +1625,7 @@ func (s *store) ROLayerStores() ([]ROLayerStore, error) {
 	if err := os.MkdirAll(rlpath, 0700); err != nil {
 		return nil, err
 	}
-	for _, store := range driver.AdditionalImageStores() {
+	for _, store := range s.imageStores {
 		glpath := filepath.Join(store, driverPrefix+"layers")
 		rls, err := newROLayerStore(rlpath, glpath, driver)
 		if err != nil {
@@ -938,34 +1637,143 @@ func (s *store) ROLayerStores() ([]ROLayerStore, error) {
 }
 
 // ImageStore obtains and returns a handle to the writable image store object
-// used by the Store.  Accessing this store directly will bypass locking and
-// synchronization, so it is not a part of the exported Store interface.
+// used by the Store, reading the image records if they haven't been read yet.
+// Accessing this store directly will bypass locking and synchronization, so
+// it is not a part of the exported Store interface.
 func (s *store) ImageStore() (ImageStore, error) {
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
 	if s.imageStore != nil {
 		return s.imageStore, nil
 	}
-	return nil, ErrLoadError
+	if !s.loaded {
+		return nil, ErrLoadError
+	}
+	gipath := filepath.Join(s.catalogGraphRoot(), s.graphDriverName+"-images")
+	var ris ImageStore
+	var err error
+	if s.readOnly {
+		ripath := filepath.Join(s.catalogRunRoot(), s.graphDriverName+"-images")
+		ris, err = newReadOnlyImageStore(gipath, ripath)
+	} else {
+		ris, err = newImageStore(gipath, s.writerOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.imageStore = ris
+	return s.imageStore, nil
 }
 
 // ROImageStores obtains additional read/only image store objects used by the
-// Store.  Accessing these stores directly will bypass locking and
-// synchronization, so it is not a part of the exported Store interface.
+// Store, reading their records if they haven't been read yet.  Accessing
+// these stores directly will bypass locking and synchronization, so it is not
+// a part of the exported Store interface.
 func (s *store) ROImageStores() ([]ROImageStore, error) {
-	if s.imageStore == nil {
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
+	if s.roImageStores != nil {
+		return s.roImageStores, nil
+	}
+	if !s.loaded {
 		return nil, ErrLoadError
 	}
-
+	roImageStores := make([]ROImageStore, 0, len(s.imageStores))
+	for _, store := range s.imageStores {
+		gipath := filepath.Join(store, s.graphDriverName+"-images")
+		ris, err := newROImageStore(gipath)
+		if err != nil {
+			return nil, err
+		}
+		roImageStores = append(roImageStores, &maskedImageStore{ROImageStore: ris, masks: s.imageMasks})
+	}
+	s.roImageStores = roImageStores
 	return s.roImageStores, nil
 }
 
+// getArtifactStore obtains the artifact store object used by the Store,
+// reading the artifact records if they haven't been read yet.
+func (s *store) getArtifactStore() (*artifactStore, error) {
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
+	if s.artifactStore != nil {
+		return s.artifactStore, nil
+	}
+	if !s.loaded {
+		return nil, ErrLoadError
+	}
+	// Artifacts don't depend on the driver, so they're kept in one place.
+	gapath := filepath.Join(s.catalogGraphRoot(), "artifacts")
+	var alock Locker
+	var err error
+	if s.readOnly {
+		rapath := filepath.Join(s.catalogRunRoot(), "artifacts")
+		if err := os.MkdirAll(rapath, 0700); err != nil {
+			return nil, err
+		}
+		alock, err = getReadOnlyStoreLockfile(filepath.Join(gapath, "artifacts.lock"), filepath.Join(rapath, "artifacts.lock"))
+	} else {
+		if err := os.MkdirAll(gapath, 0700); err != nil {
+			return nil, err
+		}
+		alock, err = GetLockfile(filepath.Join(gapath, "artifacts.lock"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	astore, err := newArtifactStore(gapath, alock, s.writerOptions)
+	if err != nil {
+		return nil, err
+	}
+	s.artifactStore = astore
+	return s.artifactStore, nil
+}
+
 // ContainerStore obtains and returns a handle to the container store object
-// used by the Store.  Accessing this store directly will bypass locking and
+// used by the Store, reading the container records if they haven't been read
+// yet.  Accessing this store directly will bypass locking and
 // synchronization, so it is not a part of the exported Store interface.
 func (s *store) ContainerStore() (ContainerStore, error) {
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
 	if s.containerStore != nil {
 		return s.containerStore, nil
 	}
-	return nil, ErrLoadError
+	if !s.loaded {
+		return nil, ErrLoadError
+	}
+	gcpath := filepath.Join(s.catalogGraphRoot(), s.graphDriverName+"-containers")
+	rcpath := filepath.Join(s.catalogRunRoot(), s.graphDriverName+"-containers")
+	var rcs ContainerStore
+	var err error
+	if s.readOnly {
+		rcs, err = newReadOnlyContainerStore(gcpath, rcpath)
+	} else {
+		if err := os.MkdirAll(gcpath, 0700); err != nil {
+			return nil, err
+		}
+		rcs, err = newContainerStore(gcpath, s.containerLog, s.writerOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(rcpath, 0700); err != nil {
+		return nil, err
+	}
+	s.containerStore = rcs
+	return s.containerStore, nil
 }
 
 func (s *store) canUseShifting(uidmap, gidmap []idtools.IDMap) bool {
@@ -1000,13 +1808,26 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 	if err := rlstore.ReloadIfChanged(); err != nil {
 		return nil, -1, err
 	}
-	rcstore.Lock()
-	defer rcstore.Unlock()
-	if err := rcstore.ReloadIfChanged(); err != nil {
-		return nil, -1, err
+	for _, l := range rlstores {
+		lstore := l
+		lstore.RLock()
+		defer lstore.Unlock()
+		if err := lstore.ReloadIfChanged(); err != nil {
+			return nil, -1, err
+		}
+	}
+	inReadOnlyStore := func(id string) bool {
+		for _, lstore := range rlstores {
+			if lstore.Exists(id) {
+				return true
+			}
+		}
+		return false
 	}
 	if id == "" {
-		id = stringid.GenerateRandomID()
+		id = generateID(s.idGenerator, rlstore.Exists, inReadOnlyStore)
+	} else if inReadOnlyStore(id) {
+		return nil, -1, errors.Wrapf(ErrDuplicateID, "a layer with ID %q is already in a read-only layer store", id)
 	}
 	if options == nil {
 		options = &LayerOptions{}
@@ -1021,15 +1842,7 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 	gidMap := options.GIDMap
 	if parent != "" {
 		var ilayer *Layer
-		for _, l := range append([]ROLayerStore{rlstore}, rlstores...) {
-			lstore := l
-			if lstore != rlstore {
-				lstore.RLock()
-				defer lstore.Unlock()
-				if err := lstore.ReloadIfChanged(); err != nil {
-					return nil, -1, err
-				}
-			}
+		for _, lstore := range append([]ROLayerStore{rlstore}, rlstores...) {
 			if l, err := lstore.Get(parent); err == nil && l != nil {
 				ilayer = l
 				parent = ilayer.ID
@@ -1040,14 +1853,28 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 			return nil, -1, ErrLayerUnknown
 		}
 		parentLayer = ilayer
-		containers, err := rcstore.Containers()
-		if err != nil {
-			return nil, -1, err
-		}
-		for _, container := range containers {
-			if container.LayerID == parent {
-				return nil, -1, ErrParentIsContainer
+		// Only hold the container store's lock for as long as it takes
+		// to check the parent, since the layer store drops its own lock
+		// while the diff is being extracted to let other layers be
+		// created in parallel, and we don't want to serialize them here.
+		if err := func() error {
+			rcstore.Lock()
+			defer rcstore.Unlock()
+			if err := rcstore.ReloadIfChanged(); err != nil {
+				return err
 			}
+			containers, err := rcstore.Containers()
+			if err != nil {
+				return err
+			}
+			for _, container := range containers {
+				if container.LayerID == parent {
+					return ErrParentIsContainer
+				}
+			}
+			return nil
+		}(); err != nil {
+			return nil, -1, err
 		}
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
 			uidMap = ilayer.UIDMap
@@ -1066,6 +1893,11 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 	layerOptions := LayerOptions{
 		OriginalDigest:     options.OriginalDigest,
 		UncompressedDigest: options.UncompressedDigest,
+		Progress:           options.Progress,
+		ImageStore:         options.ImageStore,
+		Provenance:         options.Provenance,
+		TarSplit:           options.TarSplit,
+		EncryptionKeyID:    options.EncryptionKeyID,
 	}
 	if s.canUseShifting(uidMap, gidMap) {
 		layerOptions.IDMappingOptions = types.IDMappingOptions{HostUIDMapping: true, HostGIDMapping: true, UIDMap: nil, GIDMap: nil}
@@ -1077,7 +1909,17 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 			GIDMap:         copyIDMap(gidMap),
 		}
 	}
-	return rlstore.Put(id, parentLayer, names, mountLabel, nil, &layerOptions, writeable, nil, diff)
+	layer, size, err := rlstore.Put(id, parentLayer, names, mountLabel, nil, &layerOptions, writeable, nil, diff)
+	if err != nil {
+		return nil, -1, err
+	}
+	if err := s.checkLayerNamespaceQuota(rlstore, layer.ID); err != nil {
+		if err2 := rlstore.Delete(layer.ID); err2 != nil {
+			logrus.Debugf("error deleting layer %q: %v", layer.ID, err2)
+		}
+		return nil, -1, err
+	}
+	return layer, size, nil
 }
 
 func (s *store) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
@@ -1086,12 +1928,10 @@ func (s *store) CreateLayer(id, parent string, names []string, mountLabel string
 }
 
 func (s *store) CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error) {
-	if id == "" {
-		id = stringid.GenerateRandomID()
-	}
-
+	var lstore LayerStore
 	if layer != "" {
-		lstore, err := s.LayerStore()
+		var err error
+		lstore, err = s.LayerStore()
 		if err != nil {
 			return nil, err
 		}
@@ -1132,6 +1972,41 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, o
 	if err := ristore.ReloadIfChanged(); err != nil {
 		return nil, err
 	}
+	ristores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ristores {
+		store := r
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	inReadOnlyStore := func(id string) bool {
+		for _, store := range ristores {
+			if store.Exists(id) {
+				return true
+			}
+		}
+		return false
+	}
+	if id == "" {
+		id = generateID(s.idGenerator, ristore.Exists, inReadOnlyStore)
+	}
+
+	if layer != "" {
+		if err := s.checkNamespaceQuota(lstore, ristore, layer); err != nil {
+			// Don't leave behind the layers which were added for
+			// this image, since they'd count against the quota if
+			// anything else started using them.
+			if err2 := s.deleteUnusedLayers(lstore, ristore, layer); err2 != nil {
+				logrus.Debugf("error deleting unused layers of image: %v", err2)
+			}
+			return nil, err
+		}
+	}
 
 	creationDate := time.Now().UTC()
 	if options != nil && !options.CreationDate.IsZero() {
@@ -1250,6 +2125,11 @@ func (s *store) imageTopLayerForMapping(image *Image, ristore ROImageStore, crea
 }
 
 func (s *store) CreateContainer(id string, names []string, image, layer, metadata string, options *ContainerOptions) (*Container, error) {
+	if id != "" {
+		if err := validateID(id); err != nil {
+			return nil, err
+		}
+	}
 	if options == nil {
 		options = &ContainerOptions{}
 	}
@@ -1263,9 +2143,6 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 	if err != nil {
 		return nil, err
 	}
-	if id == "" {
-		id = stringid.GenerateRandomID()
-	}
 
 	var imageTopLayer *Layer
 	imageID := ""
@@ -1406,6 +2283,12 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.Flags["MountLabel"] = mountLabel
 	}
 
+	if imageTopLayer != nil {
+		if err := s.checkNamespaceQuota(rlstore, istore, imageTopLayer.ID); err != nil {
+			return nil, err
+		}
+	}
+
 	clayer, err := rlstore.Create(layer, imageTopLayer, nil, options.Flags["MountLabel"].(string), options.StorageOpt, layerOptions, true)
 	if err != nil {
 		return nil, err
@@ -1426,11 +2309,21 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		UIDMap:         copyIDMap(options.UIDMap),
 		GIDMap:         copyIDMap(options.GIDMap),
 	}
+	if id == "" {
+		id = generateID(s.idGenerator, rcstore.Exists)
+	}
 	container, err := rcstore.Create(id, names, imageID, layer, metadata, options)
 	if err != nil || container == nil {
 		rlstore.Delete(layer)
+		return container, err
+	}
+	if imageID != "" && imageHomeStore == istore {
+		// Let Prune() know that the image is still being used.
+		if err := istore.SetFlag(imageID, lastUsedFlag, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+			logrus.Debugf("error recording the use of image %q: %v", imageID, err)
+		}
 	}
-	return container, err
+	return container, nil
 }
 
 func (s *store) SetMetadata(id, metadata string) error {
@@ -1475,6 +2368,90 @@ func (s *store) SetMetadata(id, metadata string) error {
 	return ErrNotAnID
 }
 
+func (s *store) UpdateAnnotations(id string, set map[string]string, remove []string) error {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	rcstore.Lock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+
+	if rlstore.Exists(id) {
+		return rlstore.UpdateAnnotations(id, set, remove)
+	}
+	if ristore.Exists(id) {
+		return ristore.UpdateAnnotations(id, set, remove)
+	}
+	if rcstore.Exists(id) {
+		return rcstore.UpdateAnnotations(id, set, remove)
+	}
+	return ErrNotAnID
+}
+
+func (s *store) LayersByAnnotation(key, value string) ([]Layer, error) {
+	layers, err := s.Layers()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Layer
+	for _, layer := range layers {
+		if matchAnnotation(layer.Annotations, key, value) {
+			matches = append(matches, layer)
+		}
+	}
+	return matches, nil
+}
+
+func (s *store) ImagesByAnnotation(key, value string) ([]Image, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Image
+	for _, image := range images {
+		if matchAnnotation(image.Annotations, key, value) {
+			matches = append(matches, image)
+		}
+	}
+	return matches, nil
+}
+
+func (s *store) ContainersByAnnotation(key, value string) ([]Container, error) {
+	containers, err := s.Containers()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Container
+	for _, container := range containers {
+		if matchAnnotation(container.Annotations, key, value) {
+			matches = append(matches, container)
+		}
+	}
+	return matches, nil
+}
+
 func (s *store) Metadata(id string) (string, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
@@ -1605,6 +2582,16 @@ func (s *store) ImageBigDataDigest(id, key string) (digest.Digest, error) {
 }
 
 func (s *store) ImageBigData(id, key string) ([]byte, error) {
+	data, err := s.localImageBigData(id, key)
+	if err != nil && errors.Is(err, os.ErrNotExist) && s.imageBigDataProvider != nil {
+		return s.fetchImageBigData(id, key)
+	}
+	return data, err
+}
+
+// localImageBigData retrieves an item of data for an image from the image
+// stores, without asking the ImageBigDataProvider for it.
+func (s *store) localImageBigData(id, key string) ([]byte, error) {
 	istore, err := s.ImageStore()
 	if err != nil {
 		return nil, err
@@ -1635,6 +2622,111 @@ func (s *store) ImageBigData(id, key string) ([]byte, error) {
 	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
 }
 
+// fetchImageBigData asks the ImageBigDataProvider for an item of data for an
+// image which we know about, but which we don't have the item for, checks it
+// against the digest which we have recorded for it, if we have one, and saves
+// it in the read-write image store if the image is there.  Manifests which
+// don't match any of the image's digests are returned, but not saved.
+func (s *store) fetchImageBigData(id, key string) ([]byte, error) {
+	image, err := s.Image(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.imageBigDataProvider.FetchImageBigData(image.ID, copyStringSlice(image.Names), key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching item named %q for image with ID %q", key, image.ID)
+	}
+	expected := image.BigDataDigests[key]
+	verified := false
+	if bigDataNameIsManifest(key) {
+		// A manifest's recorded digest isn't always the digest of its
+		// contents, for example if it's a signed schema 1 manifest, so
+		// we return one which doesn't match any of the image's digests,
+		// but we don't keep it.
+		for _, d := range append([]digest.Digest{expected}, image.Digests...) {
+			if d != "" && d.Validate() == nil && d.Algorithm().FromBytes(data) == d {
+				expected, verified = d, true
+				break
+			}
+		}
+		if !verified {
+			logrus.Debugf("Not saving manifest named %q fetched for image with ID %q: it does not match any of the image's digests", key, image.ID)
+		}
+	} else if expected != "" {
+		if expected.Validate() != nil || expected.Algorithm().FromBytes(data) != expected {
+			return nil, errors.Wrapf(ErrDigestMismatch, "item named %q fetched for image with ID %q does not match digest %q", key, image.ID, expected)
+		}
+		verified = true
+	} else {
+		// There's nothing to check it against.
+		verified = true
+	}
+	if s.readOnly || !verified {
+		return data, nil
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	ristore.RLock()
+	cacheable := ristore.Exists(image.ID)
+	ristore.Unlock()
+	if cacheable {
+		digestManifest := func(manifest []byte) (digest.Digest, error) {
+			return expected, nil
+		}
+		if err := s.SetImageBigData(image.ID, key, data, digestManifest); err != nil {
+			logrus.Debugf("Unable to save item named %q fetched for image with ID %q: %v", key, image.ID, err)
+		}
+	}
+	return data, nil
+}
+
+func (s *store) ImageBigDataReader(id, key string) (io.ReadCloser, error) {
+	rc, err := s.localImageBigDataReader(id, key)
+	if err != nil && errors.Is(err, os.ErrNotExist) && s.imageBigDataProvider != nil {
+		data, err := s.fetchImageBigData(id, key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return rc, err
+}
+
+// localImageBigDataReader opens an item of data for an image from the image
+// stores, without asking the ImageBigDataProvider for it.
+func (s *store) localImageBigDataReader(id, key string) (io.ReadCloser, error) {
+	istore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	foundImage := false
+	for _, s := range append([]ROImageStore{istore}, istores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		rc, err := store.BigDataReader(id, key)
+		if err == nil {
+			return rc, nil
+		}
+		if store.Exists(id) {
+			foundImage = true
+		}
+	}
+	if foundImage {
+		return nil, errors.Wrapf(os.ErrNotExist, "error locating item named %q for image with ID %q (consider removing the image to resolve the issue)", key, id)
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
 // ListLayerBigData retrieves a list of the (possibly large) chunks of
 // named data associated with an layer.
 func (s *store) ListLayerBigData(id string) ([]string, error) {
@@ -1732,6 +2824,143 @@ func (s *store) SetImageBigData(id, key string, data []byte, digestManifest func
 	return ristore.SetBigData(id, key, data, digestManifest)
 }
 
+// spoolBigData copies data to a temporary file, so that it can be read without
+// waiting on the caller while a store is locked.  Data which is already in
+// memory is left as it is.  Closing the returned reader removes the file.
+func (s *store) spoolBigData(data io.Reader) (io.ReadCloser, error) {
+	switch data.(type) {
+	case *bytes.Reader, *bytes.Buffer, *strings.Reader:
+		return ioutil.NopCloser(data), nil
+	}
+	if err := os.MkdirAll(s.TempDir(), 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(s.TempDir(), "bigdata-")
+	if err != nil {
+		return nil, err
+	}
+	spooled := ioutils.NewReadCloserWrapper(f, func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	})
+	if _, err := io.Copy(f, data); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+func (s *store) SetImageBigDataFromReader(id, key string, data io.Reader, digestManifest func([]byte) (digest.Digest, error)) error {
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+
+	spooled, err := s.spoolBigData(data)
+	if err != nil {
+		return err
+	}
+	defer spooled.Close()
+
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+
+	return ristore.SetBigDataFromReader(id, key, spooled, digestManifest)
+}
+
+func (s *store) AddImageAttachment(id string, kind ImageAttachmentKind, mediaType string, data []byte) (*ImageAttachment, error) {
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	return ristore.AddAttachment(id, kind, mediaType, data)
+}
+
+func (s *store) ImageAttachments(id string, kind ImageAttachmentKind) ([]ImageAttachment, error) {
+	istore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range append([]ROImageStore{istore}, istores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		if store.Exists(id) {
+			return store.Attachments(id, kind)
+		}
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (s *store) ImageAttachmentData(id string, kind ImageAttachmentKind, d digest.Digest) ([]byte, error) {
+	istore, err := s.ImageStore()
+	if err != nil {
+		return nil, err
+	}
+	istores, err := s.ROImageStores()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range append([]ROImageStore{istore}, istores...) {
+		store := s
+		store.RLock()
+		defer store.Unlock()
+		if err := store.ReloadIfChanged(); err != nil {
+			return nil, err
+		}
+		if !store.Exists(id) {
+			continue
+		}
+		attachments, err := store.Attachments(id, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, attachment := range attachments {
+			if attachment.Digest == d {
+				return store.BigData(id, attachment.BigDataName)
+			}
+		}
+		return nil, errors.Wrapf(ErrAttachmentUnknown, "image %q has no %q attachment with digest %q", id, kind, d)
+	}
+	return nil, errors.Wrapf(ErrImageUnknown, "error locating image with ID %q", id)
+}
+
+func (s *store) RemoveImageAttachment(id string, kind ImageAttachmentKind, d digest.Digest) error {
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+
+	ristore.Lock()
+	defer ristore.Unlock()
+	if err := ristore.ReloadIfChanged(); err != nil {
+		return err
+	}
+
+	return ristore.RemoveAttachment(id, kind, d)
+}
+
 func (s *store) ImageSize(id string) (int64, error) {
 	var image *Image
 
@@ -1962,17 +3191,43 @@ func (s *store) ContainerBigDataSize(id, key string) (int64, error) {
 func (s *store) ContainerBigDataDigest(id, key string) (digest.Digest, error) {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
-		return "", err
+		return "", err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return "", err
+	}
+	return rcstore.BigDataDigest(id, key)
+}
+
+func (s *store) ContainerBigData(id, key string) ([]byte, error) {
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return rcstore.BigData(id, key)
+}
+
+func (s *store) SetContainerBigData(id, key string, data []byte) error {
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
 	}
-	rcstore.RLock()
+	rcstore.Lock()
 	defer rcstore.Unlock()
 	if err := rcstore.ReloadIfChanged(); err != nil {
-		return "", err
+		return err
 	}
-	return rcstore.BigDataDigest(id, key)
+	return rcstore.SetBigData(id, key, data)
 }
 
-func (s *store) ContainerBigData(id, key string) ([]byte, error) {
+func (s *store) ContainerBigDataReader(id, key string) (io.ReadCloser, error) {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
 		return nil, err
@@ -1982,20 +3237,25 @@ func (s *store) ContainerBigData(id, key string) ([]byte, error) {
 	if err := rcstore.ReloadIfChanged(); err != nil {
 		return nil, err
 	}
-	return rcstore.BigData(id, key)
+	return rcstore.BigDataReader(id, key)
 }
 
-func (s *store) SetContainerBigData(id, key string, data []byte) error {
+func (s *store) SetContainerBigDataFromReader(id, key string, data io.Reader) error {
 	rcstore, err := s.ContainerStore()
 	if err != nil {
 		return err
 	}
+	spooled, err := s.spoolBigData(data)
+	if err != nil {
+		return err
+	}
+	defer spooled.Close()
 	rcstore.Lock()
 	defer rcstore.Unlock()
 	if err := rcstore.ReloadIfChanged(); err != nil {
 		return err
 	}
-	return rcstore.SetBigData(id, key, data)
+	return rcstore.SetBigDataFromReader(id, key, spooled)
 }
 
 func (s *store) Exists(id string) bool {
@@ -2320,8 +3580,13 @@ func (s *store) DeleteLayer(id string) error {
 	}
 
 	if rlstore.Exists(id) {
-		if l, err := rlstore.Get(id); err != nil {
-			id = l.ID
+		l, err := rlstore.Get(id)
+		if err != nil {
+			return err
+		}
+		id = l.ID
+		if isPinned(l.Flags) {
+			return errors.Wrapf(ErrLayerPinned, "layer %v is pinned", id)
 		}
 		layers, err := rlstore.Layers()
 		if err != nil {
@@ -2357,6 +3622,13 @@ func (s *store) DeleteLayer(id string) error {
 				return errors.Wrapf(ErrLayerUsedByContainer, "layer %v used by container %v", id, container.ID)
 			}
 		}
+		usedByPeers, err := s.layersUsedByPeerNamespaces()
+		if err != nil {
+			return err
+		}
+		if err, used := usedByPeers[id]; used {
+			return err
+		}
 		if err := rlstore.Delete(id); err != nil {
 			return errors.Wrapf(err, "delete layer %v", id)
 		}
@@ -2413,6 +3685,9 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			return nil, err
 		}
 		id = image.ID
+		if isPinned(image.Flags) {
+			return nil, errors.Wrapf(ErrImagePinned, "image %v is pinned", id)
+		}
 		containers, err := rcstore.Containers()
 		if err != nil {
 			return nil, err
@@ -2437,6 +3712,13 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			childrenByParent[layer.Parent] = append(childrenByParent[layer.Parent], layer.ID)
 		}
 		otherImagesTopLayers := make(map[string]struct{})
+		usedByPeers, err := s.layersUsedByPeerNamespaces()
+		if err != nil {
+			return nil, err
+		}
+		for layerID := range usedByPeers {
+			otherImagesTopLayers[layerID] = struct{}{}
+		}
 		for _, img := range images {
 			if img.ID != id {
 				otherImagesTopLayers[img.TopLayer] = struct{}{}
@@ -2461,6 +3743,9 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, err error)
 			}
 			parent := ""
 			if l, err := rlstore.Get(layer); err == nil {
+				if isPinned(l.Flags) {
+					break
+				}
 				parent = l.Parent
 			}
 			hasChildrenNotBeingRemoved := func() bool {
@@ -2555,10 +3840,14 @@ func (s *store) DeleteContainer(id string) error {
 			}()
 
 			middleDir := s.graphDriverName + "-containers"
-			gcpath := filepath.Join(s.GraphRoot(), middleDir, container.ID)
+			gcpath := filepath.Join(s.catalogGraphRoot(), middleDir, container.ID)
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
+				if s.deleteInBackground && s.trash != nil {
+					errChan <- s.trash.removeAll(fmt.Sprintf("directory for container %q", container.ID), gcpath)
+					return
+				}
 				// attempt a simple rm -rf first
 				err := os.RemoveAll(gcpath)
 				if err == nil {
@@ -2569,7 +3858,7 @@ func (s *store) DeleteContainer(id string) error {
 				errChan <- system.EnsureRemoveAll(gcpath)
 			}()
 
-			rcpath := filepath.Join(s.RunRoot(), middleDir, container.ID)
+			rcpath := filepath.Join(s.catalogRunRoot(), middleDir, container.ID)
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
@@ -2640,11 +3929,11 @@ func (s *store) Delete(id string) error {
 					return err
 				}
 				middleDir := s.graphDriverName + "-containers"
-				gcpath := filepath.Join(s.GraphRoot(), middleDir, container.ID, "userdata")
+				gcpath := filepath.Join(s.catalogGraphRoot(), middleDir, container.ID, "userdata")
 				if err = os.RemoveAll(gcpath); err != nil {
 					return err
 				}
-				rcpath := filepath.Join(s.RunRoot(), middleDir, container.ID, "userdata")
+				rcpath := filepath.Join(s.catalogRunRoot(), middleDir, container.ID, "userdata")
 				if err = os.RemoveAll(rcpath); err != nil {
 					return err
 				}
@@ -2654,9 +3943,15 @@ func (s *store) Delete(id string) error {
 		}
 	}
 	if ristore.Exists(id) {
+		if image, err := ristore.Get(id); err == nil && isPinned(image.Flags) {
+			return errors.Wrapf(ErrImagePinned, "image %v is pinned", image.ID)
+		}
 		return ristore.Delete(id)
 	}
 	if rlstore.Exists(id) {
+		if layer, err := rlstore.Get(id); err == nil && isPinned(layer.Flags) {
+			return errors.Wrapf(ErrLayerPinned, "layer %v is pinned", layer.ID)
+		}
 		return rlstore.Delete(id)
 	}
 	return ErrLayerUnknown
@@ -2675,6 +3970,14 @@ func (s *store) Wipe() error {
 	if err != nil {
 		return err
 	}
+	astore, err := s.getArtifactStore()
+	if err != nil {
+		return err
+	}
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return err
+	}
 
 	rlstore.Lock()
 	defer rlstore.Unlock()
@@ -2691,13 +3994,37 @@ func (s *store) Wipe() error {
 	if err := rcstore.ReloadIfChanged(); err != nil {
 		return err
 	}
+	astore.Lock()
+	defer astore.Unlock()
+	if err := astore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return err
+	}
 
+	if err = vstore.Wipe(s.backgroundTrash()); err != nil {
+		return err
+	}
+	if err = astore.Wipe(); err != nil {
+		return err
+	}
 	if err = rcstore.Wipe(); err != nil {
 		return err
 	}
 	if err = ristore.Wipe(); err != nil {
 		return err
 	}
+	usedByPeers, err := s.layersUsedByPeerNamespaces()
+	if err != nil {
+		return err
+	}
+	if len(usedByPeers) > 0 {
+		// Leave the layers that other namespaces still need.
+		return s.wipeUnsharedLayers(rlstore, usedByPeers)
+	}
 	return rlstore.Wipe()
 }
 
@@ -2709,6 +4036,22 @@ func (s *store) Status() ([][2]string, error) {
 	return rlstore.Status()
 }
 
+func (s *store) DriverStatus() (*drivers.DriverStatus, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	return drivers.GetDriverStatus(driver), nil
+}
+
+func (s *store) DriverCapabilities() (drivers.Capabilities, error) {
+	driver, err := s.GraphDriver()
+	if err != nil {
+		return drivers.Capabilities{}, err
+	}
+	return drivers.GetCapabilities(driver), nil
+}
+
 func (s *store) Version() ([][2]string, error) {
 	return [][2]string{}, nil
 }
@@ -2747,6 +4090,12 @@ func (s *store) mount(id string, options drivers.MountOpts) (string, error) {
 		options.DisableShifting = !s.canUseShifting(options.UidMaps, options.GidMaps)
 	}
 
+	// Nothing in a read-only store can be modified, so its layers can
+	// only be mounted read-only.
+	if s.readOnly && !stringutils.InSlice(options.Options, "ro") {
+		options.Options = append(options.Options, "ro")
+	}
+
 	if rlstore.Exists(id) {
 		return rlstore.Mount(id, options)
 	}
@@ -2772,8 +4121,18 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 }
 
 func (s *store) Mount(id, mountLabel string) (string, error) {
+	return s.MountWithOptions(id, &MountOptions{MountLabel: mountLabel})
+}
+
+func (s *store) MountWithOptions(id string, mountOptions *MountOptions) (string, error) {
+	if mountOptions == nil {
+		mountOptions = &MountOptions{}
+	}
 	options := drivers.MountOpts{
-		MountLabel: mountLabel,
+		MountLabel:       mountOptions.MountLabel,
+		AdditionalLowers: mountOptions.AdditionalLowers,
+		Propagation:      mountOptions.Propagation,
+		Relabel:          mountOptions.Relabel,
 	}
 	// check if `id` is a container, then grab the LayerID, uidmap and gidmap, along with
 	// otherwise we assume the id is a LayerID and attempt to mount it.
@@ -2835,6 +4194,80 @@ func (s *store) Unmount(id string, force bool) (bool, error) {
 	return false, ErrLayerUnknown
 }
 
+func (s *store) SnapshotContainer(id string, names []string) (*Layer, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return nil, err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	rcstore.RLock()
+	defer rcstore.Unlock()
+	if err := rcstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	container, err := rcstore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return rlstore.Snapshot(container.LayerID, names)
+}
+
+func (s *store) ResetContainerLayer(id, snapshot string) error {
+	container, err := s.Container(id)
+	if err != nil {
+		return err
+	}
+	imageTopLayer := ""
+	if container.ImageID != "" {
+		image, err := s.Image(container.ImageID)
+		if err != nil {
+			return err
+		}
+		imageTopLayer = image.TopLayer
+	}
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	layer, err := rlstore.Get(container.LayerID)
+	if err != nil {
+		return err
+	}
+	parent := layer.Parent
+	if snapshot != "" {
+		snapshotLayer, err := rlstore.Get(snapshot)
+		if err != nil {
+			return err
+		}
+		// Only look at the layers between the container's layer and
+		// its image's top layer.
+		for parent != snapshotLayer.ID {
+			if parent == imageTopLayer {
+				return errors.Errorf("layer %q is not a snapshot of container %q", snapshot, container.ID)
+			}
+			ancestor, err := rlstore.Get(parent)
+			if err != nil {
+				return err
+			}
+			parent = ancestor.Parent
+		}
+	}
+	return rlstore.Reset(layer.ID, parent)
+}
+
 func (s *store) Changes(from, to string) ([]archive.Change, error) {
 	lstore, err := s.LayerStore()
 	if err != nil {
@@ -3022,6 +4455,38 @@ func (s *store) ApplyDiff(to string, diff io.Reader) (int64, error) {
 	return -1, ErrLayerUnknown
 }
 
+func (s *store) ApplyDiffWithOptions(to string, options *LayerOptions, diff io.Reader) (int64, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return -1, err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	if rlstore.Exists(to) {
+		return rlstore.ApplyDiffWithOptions(to, options, diff)
+	}
+	return -1, ErrLayerUnknown
+}
+
+func (s *store) ApplyDirectory(to, dir string, options *ApplyDirectoryOptions) (int64, error) {
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return -1, err
+	}
+	rlstore.Lock()
+	defer rlstore.Unlock()
+	if err := rlstore.ReloadIfChanged(); err != nil {
+		return -1, err
+	}
+	if rlstore.Exists(to) {
+		return rlstore.ApplyDirectory(to, dir, options)
+	}
+	return -1, ErrLayerUnknown
+}
+
 func (s *store) layersByMappedDigest(m func(ROLayerStore, digest.Digest) ([]Layer, error), d digest.Digest) ([]Layer, error) {
 	var layers []Layer
 	lstore, err := s.LayerStore()
@@ -3485,7 +4950,7 @@ func (s *store) ContainerDirectory(id string) (string, error) {
 	}
 
 	middleDir := s.graphDriverName + "-containers"
-	gcpath := filepath.Join(s.GraphRoot(), middleDir, id, "userdata")
+	gcpath := filepath.Join(s.catalogGraphRoot(), middleDir, id, "userdata")
 	if err := os.MkdirAll(gcpath, 0700); err != nil {
 		return "", err
 	}
@@ -3510,7 +4975,7 @@ func (s *store) ContainerRunDirectory(id string) (string, error) {
 	}
 
 	middleDir := s.graphDriverName + "-containers"
-	rcpath := filepath.Join(s.RunRoot(), middleDir, id, "userdata")
+	rcpath := filepath.Join(s.catalogRunRoot(), middleDir, id, "userdata")
 	if err := os.MkdirAll(rcpath, 0700); err != nil {
 		return "", err
 	}
@@ -3518,6 +4983,9 @@ func (s *store) ContainerRunDirectory(id string) (string, error) {
 }
 
 func (s *store) SetContainerDirectoryFile(id, file string, data []byte) error {
+	if s.readOnly {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the directory of container %q", id)
+	}
 	dir, err := s.ContainerDirectory(id)
 	if err != nil {
 		return err
@@ -3557,15 +5025,199 @@ func (s *store) FromContainerRunDirectory(id, file string) ([]byte, error) {
 	return ioutil.ReadFile(filepath.Join(dir, file))
 }
 
+// watchedDirs returns the directories which hold the lock files and records
+// for the layer, image, and container stores.
+func (s *store) watchedDirs() []string {
+	driverPrefix := s.graphDriverName + "-"
+	dirs := []string{
+		s.graphRoot,
+		filepath.Join(s.graphRoot, driverPrefix+"layers"),
+		filepath.Join(s.runRoot, driverPrefix+"layers"),
+		filepath.Join(s.catalogGraphRoot(), driverPrefix+"images"),
+		filepath.Join(s.catalogGraphRoot(), driverPrefix+"containers"),
+	}
+	for _, store := range s.imageStores {
+		dirs = append(dirs, filepath.Join(store, driverPrefix+"layers"), filepath.Join(store, driverPrefix+"images"))
+	}
+	return dirs
+}
+
+// startWatcher returns the store's watcher, starting it if it isn't already
+// running.  It returns nil if we can't watch for changes.
+func (s *store) startWatcher() *changeWatcher {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	if s.watcher == nil && !s.watchFailed {
+		watcher, err := newChangeWatcher(s.watchedDirs())
+		if err != nil {
+			logrus.Debugf("not watching for changes to storage at %q: %v", s.graphRoot, err)
+			s.watchFailed = true
+			return nil
+		}
+		s.watcher = watcher
+	}
+	return s.watcher
+}
+
+// stopWatcher stops the store's watcher, if it's running.
+func (s *store) stopWatcher() {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+}
+
+func (s *store) ReloadIfChanged() error {
+	// Make sure the layer store has been created before we start watching,
+	// so that all of the directories that we watch exist.
+	rlstore, err := s.LayerStore()
+	if err != nil {
+		return err
+	}
+	watcher := s.startWatcher()
+	overflowed := false
+	if watcher != nil {
+		var changed bool
+		if changed, overflowed = watcher.takeChanged(); !changed {
+			return nil
+		}
+	}
+	if err := s.reloadStores(rlstore, overflowed); err != nil {
+		if watcher != nil {
+			watcher.setChanged(overflowed)
+		}
+		return err
+	}
+	return nil
+}
+
+// forceReloader is implemented by stores which can reload their contents
+// even if their lock files don't indicate that they've been modified.
+type forceReloader interface {
+	forceReload() error
+}
+
+// reloadStores reloads each of the layer, image, and container stores if its
+// lock file indicates that another process has modified it, or, if all is set,
+// reloads all of them, since the watcher dropped events and we can't know what
+// we missed.
+func (s *store) reloadStores(rlstore LayerStore, all bool) error {
+	rlstores, err := s.ROLayerStores()
+	if err != nil {
+		return err
+	}
+	ristore, err := s.ImageStore()
+	if err != nil {
+		return err
+	}
+	ristores, err := s.ROImageStores()
+	if err != nil {
+		return err
+	}
+	rcstore, err := s.ContainerStore()
+	if err != nil {
+		return err
+	}
+	reload := func(store ROFileBasedStore) error {
+		store.RLock()
+		defer store.Unlock()
+		if r, ok := store.(forceReloader); ok && all {
+			return r.forceReload()
+		}
+		return store.ReloadIfChanged()
+	}
+	for _, store := range append([]ROLayerStore{rlstore}, rlstores...) {
+		if err := reload(store); err != nil {
+			return err
+		}
+	}
+	for _, store := range append([]ROImageStore{ristore}, ristores...) {
+		if err := reload(store); err != nil {
+			return err
+		}
+	}
+	return reload(rcstore)
+}
+
+// cleanShutdownMarker returns the location of the file which Shutdown()
+// creates in the graph root when it succeeds.
+func (s *store) cleanShutdownMarker() string {
+	return filepath.Join(s.graphRoot, "clean-shutdown")
+}
+
+// takeCleanShutdownMarker checks if the graph root was marked as having been
+// shut down cleanly, and unless the store is read-only, removes the mark, since
+// we may not be shut down cleanly ourselves.  It should be called with the
+// graph lock held.
+func (s *store) takeCleanShutdownMarker() (bool, error) {
+	if _, err := os.Stat(s.cleanShutdownMarker()); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if s.readOnly {
+		return true, nil
+	}
+	if err := os.Remove(s.cleanShutdownMarker()); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *store) ShutDownCleanly() bool {
+	return s.shutDownCleanly
+}
+
+// backgroundTrash returns the trash which new deletions should use, or nil if
+// they should remove things right away.
+func (s *store) backgroundTrash() *trash {
+	if !s.deleteInBackground {
+		return nil
+	}
+	return s.trash
+}
+
+func (s *store) WaitForDeletions() {
+	s.waitForDeletions()
+}
+
+func (s *store) waitForDeletions() {
+	if s.reaper != nil {
+		s.reaper.wait()
+	}
+}
+
 func (s *store) Shutdown(force bool) ([]string, error) {
 	mounted := []string{}
 	modified := false
 
+	s.stopWatcher()
+
 	rlstore, err := s.LayerStore()
 	if err != nil {
 		return mounted, err
 	}
 
+	// Wait for any image and container operations which are in progress
+	// to finish.  Layer operations are waited for when we lock the layer
+	// store below.  If we haven't read the records of images or
+	// containers, nothing can be using them.  Nothing keeps new
+	// operations from starting once we've unlocked them, though.
+	s.storesLock.Lock()
+	ristore, rcstore := s.imageStore, s.containerStore
+	s.storesLock.Unlock()
+	if ristore != nil {
+		ristore.Lock()
+		ristore.Unlock()
+	}
+	if rcstore != nil {
+		rcstore.Lock()
+		rcstore.Unlock()
+	}
+
 	s.graphLock.Lock()
 	defer s.graphLock.Unlock()
 
@@ -3583,28 +5235,42 @@ func (s *store) Shutdown(force bool) ([]string, error) {
 		if layer.MountCount == 0 {
 			continue
 		}
-		mounted = append(mounted, layer.ID)
 		if force {
-			for layer.MountCount > 0 {
-				_, err2 := rlstore.Unmount(layer.ID, force)
-				if err2 != nil {
-					if err == nil {
-						err = err2
-					}
-					break
-				}
+			// A forced unmount drops all of the layer's references
+			// at once.
+			stillMounted, err2 := rlstore.Unmount(layer.ID, force)
+			if err2 != nil && err == nil {
+				err = err2
+			}
+			if err2 == nil {
 				modified = true
 			}
+			if !stillMounted && err2 == nil {
+				continue
+			}
 		}
+		mounted = append(mounted, layer.ID)
 	}
 	if len(mounted) > 0 && err == nil {
 		err = errors.Wrap(ErrLayerUsedByContainer, "A layer is mounted")
 	}
+	// Removals which are in progress are finished whether or not layers
+	// are still mounted, so that they aren't cut short when we exit.
+	s.waitForDeletions()
 	if err == nil {
 		err = s.graphDriver.Cleanup()
 		s.graphLock.Touch()
 		modified = true
 	}
+	if err == nil && !s.readOnly {
+		// Only mark the graph root as having been shut down cleanly
+		// if nobody else is using it, and keep anyone from starting
+		// to until the mark is in place, so that whoever does next
+		// will see it and clear it.
+		_, err = s.users.whileLastUser(func() error {
+			return ioutils.AtomicWriteFile(s.cleanShutdownMarker(), []byte{}, 0600)
+		})
+	}
 	if modified {
 		rlstore.Touch()
 	}
@@ -3684,6 +5350,50 @@ func copyStringInterfaceMap(m map[string]interface{}) map[string]interface{} {
 	return ret
 }
 
+func copyStringStringMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// updateAnnotations sets and then removes annotations in the map pointed to by
+// annotations, and returns true if that changed anything.
+func updateAnnotations(annotations *map[string]string, set map[string]string, remove []string) bool {
+	changed := false
+	for k, v := range set {
+		if old, ok := (*annotations)[k]; ok && old == v {
+			continue
+		}
+		if *annotations == nil {
+			*annotations = make(map[string]string)
+		}
+		(*annotations)[k] = v
+		changed = true
+	}
+	for _, k := range remove {
+		if _, ok := (*annotations)[k]; ok {
+			delete(*annotations, k)
+			changed = true
+		}
+	}
+	if len(*annotations) == 0 {
+		*annotations = nil
+	}
+	return changed
+}
+
+// matchAnnotation checks if annotations include key, with the specified value
+// if value is not empty.
+func matchAnnotation(annotations map[string]string, key, value string) bool {
+	v, ok := annotations[key]
+	return ok && (value == "" || v == value)
+}
+
 // AutoUserNsMinSize is the minimum size for automatically created user namespaces
 const AutoUserNsMinSize = 1024
 
@@ -3739,6 +5449,8 @@ func GetMountOptions(driver string, graphDriverOptions []string) ([]string, erro
 
 // Free removes the store from the list of stores
 func (s *store) Free() {
+	s.users.close()
+	s.users = nil
 	for i := 0; i < len(stores); i++ {
 		if stores[i] == s {
 			stores = append(stores[:i], stores[i+1:]...)
@@ -0,0 +1,664 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/stringutils"
+	"github.com/containers/storage/pkg/system"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// staleCacheTempAge is how old a temporary file or directory in the
+	// cache has to be before it's assumed that it was left behind by a
+	// process which didn't finish writing it.
+	staleCacheTempAge = 24 * time.Hour
+)
+
+// errCacheMiss is returned internally when an item isn't in the cache.
+var errCacheMiss = errors.New("item is not cached")
+
+// CacheOptions is used for passing options to NewCachingStore().
+type CacheOptions struct {
+	// Directory is where cached data is kept.  It should be on fast,
+	// local storage.
+	Directory string
+	// MaxSize is the number of bytes of cached data which are kept.  When
+	// it is exceeded, the least recently used items which aren't in use
+	// are removed from the cache.  If it is 0, nothing is removed.
+	MaxSize int64
+}
+
+// cacheEntry records information about an item in the cache.
+type cacheEntry struct {
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last-used"`
+	// Users is the number of times a cached image has been mounted and
+	// not yet unmounted.  While it is not 0, a read-only bind mount of the
+	// item is kept at its mount path.  Items which are in use are never
+	// evicted.
+	Users int `json:"users,omitempty"`
+}
+
+// storeCache manages a directory of cached layer diffs and image contents,
+// which can be shared by multiple processes.
+type storeCache struct {
+	dir      string
+	maxSize  int64
+	lockfile lockfile.Locker
+	entries  map[string]*cacheEntry
+}
+
+func newStoreCache(dir string, maxSize int64) (*storeCache, error) {
+	for _, subdir := range []string{"entries", "mounts", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := GetLockfile(filepath.Join(dir, "index.lock"))
+	if err != nil {
+		return nil, err
+	}
+	c := &storeCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		lockfile: lock,
+		entries:  make(map[string]*cacheEntry),
+	}
+	c.removeStaleTemps()
+	return c, nil
+}
+
+func (c *storeCache) indexPath() string {
+	return filepath.Join(c.dir, "index.json")
+}
+
+func (c *storeCache) entryPath(key string) string {
+	return filepath.Join(c.dir, "entries", key)
+}
+
+// mountPath returns the location where a cached image's contents are mounted
+// read-only while they are in use.
+func (c *storeCache) mountPath(key string) string {
+	return filepath.Join(c.dir, "mounts", key)
+}
+
+func (c *storeCache) tempDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+// removeStaleTemps removes temporary files and directories which were left
+// behind by processes which didn't get to finish writing them.
+func (c *storeCache) removeStaleTemps() {
+	names, err := ioutil.ReadDir(c.tempDir())
+	if err != nil {
+		return
+	}
+	for _, info := range names {
+		if time.Since(info.ModTime()) > staleCacheTempAge {
+			if err := system.EnsureRemoveAll(filepath.Join(c.tempDir(), info.Name())); err != nil {
+				logrus.Debugf("error removing stale cache item %q: %v", info.Name(), err)
+			}
+		}
+	}
+}
+
+// load reads the index.  It should be called with the lock held.
+func (c *storeCache) load() error {
+	entries := make(map[string]*cacheEntry)
+	data, err := ioutil.ReadFile(c.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return errors.Wrapf(err, "error decoding cache index %q", c.indexPath())
+		}
+	}
+	for key := range entries {
+		if _, err := os.Lstat(c.entryPath(key)); err != nil {
+			delete(entries, key)
+		}
+	}
+	c.entries = entries
+	return nil
+}
+
+// save writes the index.  It should be called with the lock held.
+func (c *storeCache) save() error {
+	data, err := json.Marshal(&c.entries)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(c.indexPath(), data, 0600)
+}
+
+// update calls fn with the lock held and the index loaded, and saves the
+// index afterward.
+func (c *storeCache) update(fn func() error) error {
+	c.lockfile.Lock()
+	defer c.lockfile.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return c.save()
+}
+
+// open returns the cached copy of an item, if there is one.
+func (c *storeCache) open(key string) (*os.File, bool) {
+	var f *os.File
+	err := c.update(func() error {
+		entry, ok := c.entries[key]
+		if !ok {
+			return errCacheMiss
+		}
+		var err error
+		if f, err = os.Open(c.entryPath(key)); err != nil {
+			return err
+		}
+		entry.LastUsed = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, false
+	}
+	return f, true
+}
+
+// acquire returns the location of a read-only mount of the cached copy of an
+// item, if there is one, and marks it as being in use.
+func (c *storeCache) acquire(key string) (string, bool) {
+	err := c.update(func() error {
+		entry, ok := c.entries[key]
+		if !ok {
+			return errCacheMiss
+		}
+		return c.use(key, entry)
+	})
+	if err != nil {
+		if err != errCacheMiss {
+			logrus.Debugf("error mounting cache item %q: %v", key, err)
+		}
+		return "", false
+	}
+	return c.mountPath(key), true
+}
+
+// use marks an item as being used by one more user, mounting it read-only at
+// its mount path if it wasn't already in use.  It should be called with the
+// lock held.
+func (c *storeCache) use(key string, entry *cacheEntry) error {
+	if entry.Users == 0 {
+		mountPoint := c.mountPath(key)
+		if err := os.MkdirAll(mountPoint, 0700); err != nil {
+			return err
+		}
+		if err := mount.Mount(c.entryPath(key), mountPoint, "bind", "bind,ro"); err != nil {
+			os.Remove(mountPoint)
+			return err
+		}
+	}
+	entry.Users++
+	entry.LastUsed = time.Now().UTC()
+	return nil
+}
+
+// unuse unmounts an item which is no longer in use.  It should be called with
+// the lock held.
+func (c *storeCache) unuse(key string) {
+	mountPoint := c.mountPath(key)
+	if err := mount.Unmount(mountPoint); err != nil {
+		logrus.Debugf("error unmounting cache item %q: %v", key, err)
+		return
+	}
+	if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("error removing mount point for cache item %q: %v", key, err)
+	}
+}
+
+// release marks a cached item whose key is key, or starts with key followed by
+// a "-", as being used by one fewer user, or all such items as being used by
+// none if force is true.  It returns whether or not an item is still in use,
+// and whether or not one was in use at all.
+func (c *storeCache) release(key string, force bool) (bool, bool) {
+	stillUsed := false
+	err := c.update(func() error {
+		released := false
+		for k, entry := range c.entries {
+			if entry.Users == 0 || (k != key && !strings.HasPrefix(k, key+"-")) {
+				continue
+			}
+			if released && !force {
+				stillUsed = true
+				continue
+			}
+			released = true
+			entry.Users--
+			if force {
+				entry.Users = 0
+			}
+			if entry.Users > 0 {
+				stillUsed = true
+			} else {
+				c.unuse(k)
+			}
+		}
+		if !released {
+			return errCacheMiss
+		}
+		c.evict()
+		return nil
+	})
+	if err != nil {
+		return false, false
+	}
+	return stillUsed, true
+}
+
+// commit moves a temporary file or directory into the cache, and evicts items
+// if the cache has grown too large.  If another process already added the
+// item, the temporary copy is discarded.  If use is true, the item is marked
+// as being in use and the location of its read-only mount is returned.
+func (c *storeCache) commit(key, tempPath string, size int64, use bool) (string, error) {
+	var useErr error
+	err := c.update(func() error {
+		entry, ok := c.entries[key]
+		if ok {
+			if err := system.EnsureRemoveAll(tempPath); err != nil {
+				logrus.Debugf("error removing temporary cache item %q: %v", tempPath, err)
+			}
+		} else {
+			if err := system.EnsureRemoveAll(c.entryPath(key)); err != nil {
+				return err
+			}
+			if err := os.Rename(tempPath, c.entryPath(key)); err != nil {
+				return err
+			}
+			entry = &cacheEntry{Size: size}
+			c.entries[key] = entry
+		}
+		entry.LastUsed = time.Now().UTC()
+		if use {
+			// The item is kept even if it can't be mounted.
+			useErr = c.use(key, entry)
+		}
+		c.evict()
+		return nil
+	})
+	if err != nil {
+		system.EnsureRemoveAll(tempPath)
+		return "", err
+	}
+	if useErr != nil {
+		return "", useErr
+	}
+	if use {
+		return c.mountPath(key), nil
+	}
+	return c.entryPath(key), nil
+}
+
+// remove discards cached items whose keys start with any of the prefixes, if
+// they aren't in use.
+func (c *storeCache) remove(prefixes ...string) {
+	err := c.update(func() error {
+		for key, entry := range c.entries {
+			if entry.Users > 0 {
+				continue
+			}
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					c.discard(key)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Debugf("error removing items from cache %q: %v", c.dir, err)
+	}
+}
+
+// discard removes an item from the cache.  It should be called with the lock
+// held.
+func (c *storeCache) discard(key string) {
+	if err := system.EnsureRemoveAll(c.entryPath(key)); err != nil {
+		logrus.Debugf("error removing cache item %q: %v", key, err)
+		return
+	}
+	delete(c.entries, key)
+}
+
+// evict removes the least recently used items which aren't in use until the
+// cache is no larger than its maximum size.  It should be called with the
+// lock held.
+func (c *storeCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	total := int64(0)
+	keys := make([]string, 0, len(c.entries))
+	for key, entry := range c.entries {
+		total += entry.Size
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.entries[keys[i]].LastUsed.Before(c.entries[keys[j]].LastUsed)
+	})
+	for _, key := range keys {
+		if total <= c.maxSize {
+			break
+		}
+		entry := c.entries[key]
+		if entry.Users > 0 {
+			continue
+		}
+		c.discard(key)
+		if _, ok := c.entries[key]; !ok {
+			total -= entry.Size
+		}
+	}
+}
+
+// cachingStore wraps a Store whose graph root is on slow storage, such as a
+// network file system, and keeps copies of layer diffs and of the contents of
+// images which are mounted read-only in a cache on faster storage.
+type cachingStore struct {
+	Store
+	cache *storeCache
+}
+
+// NewCachingStore returns a Store which passes calls through to store, but
+// keeps copies of layer diffs which are written or read, and of the contents
+// of images which are mounted with the "ro" option, in the cache directory.
+// Cached image contents are returned as read-only bind mounts, which are
+// shared by everyone who mounts the same image with the same mount label.
+// The cache directory can be shared by multiple Stores which use the same
+// graph root.
+func NewCachingStore(store Store, options CacheOptions) (Store, error) {
+	if options.Directory == "" {
+		return nil, errors.Wrap(ErrIncompleteOptions, "no cache directory specified")
+	}
+	cache, err := newStoreCache(options.Directory, options.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingStore{Store: store, cache: cache}, nil
+}
+
+// diffCacheKey returns the key for the cached diff of a layer, or "" if the
+// diff can't be cached because its digest isn't known.
+func diffCacheKey(layer *Layer) string {
+	if layer == nil || layer.UncompressedDigest == "" {
+		return ""
+	}
+	return "diff-" + layer.ID + "-" + layer.UncompressedDigest.Encoded()
+}
+
+// imageCacheKey returns the key for the cached contents of an image.  Copies
+// which are labeled for use with a mount label are kept separately.
+func imageCacheKey(image *Image, mountLabel string) string {
+	key := imageCacheKeyPrefix(image)
+	if mountLabel != "" {
+		key += "-" + digest.FromString(mountLabel).Encoded()[:12]
+	}
+	return key
+}
+
+func imageCacheKeyPrefix(image *Image) string {
+	return "image-" + image.ID + "-" + image.TopLayer
+}
+
+// cacheFiller passes a diff through to its reader while writing a copy of it
+// to a temporary file, which is added to the cache when the reader closes it
+// if the diff was read completely and its digest was what we expected.
+type cacheFiller struct {
+	io.ReadCloser
+	cache    *storeCache
+	key      string
+	expected digest.Digest
+	file     *os.File
+	digester digest.Digester
+	size     int64
+	complete bool
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && f.file != nil {
+		if _, werr := f.file.Write(p[:n]); werr != nil {
+			f.file.Close()
+			os.Remove(f.file.Name())
+			f.file = nil
+		} else {
+			f.digester.Hash().Write(p[:n])
+			f.size += int64(n)
+		}
+	}
+	if err == io.EOF {
+		f.complete = true
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.ReadCloser.Close()
+	if f.file == nil {
+		return err
+	}
+	f.file.Close()
+	if !f.complete || f.digester.Digest() != f.expected {
+		os.Remove(f.file.Name())
+		return err
+	}
+	if _, cerr := f.cache.commit(f.key, f.file.Name(), f.size, false); cerr != nil {
+		logrus.Debugf("error caching %q: %v", f.key, cerr)
+	}
+	return err
+}
+
+func (s *cachingStore) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
+	layer, err := s.Store.Layer(to)
+	if err != nil {
+		return nil, err
+	}
+	key := diffCacheKey(layer)
+	if key == "" || (from != "" && from != layer.Parent) {
+		return s.Store.Diff(from, to, options)
+	}
+	compression := layer.CompressionType
+	if options != nil && options.Compression != nil {
+		compression = *options.Compression
+	}
+	if f, ok := s.cache.open(key); ok {
+		return finishDiff(f, compression, options)
+	}
+	uncompressed := archive.Uncompressed
+	rc, err := s.Store.Diff(from, to, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, err
+	}
+	filler := &cacheFiller{
+		ReadCloser: rc,
+		cache:      s.cache,
+		key:        key,
+		expected:   layer.UncompressedDigest,
+		digester:   digest.Canonical.Digester(),
+	}
+	if filler.file, err = ioutil.TempFile(s.cache.tempDir(), "diff"); err != nil {
+		logrus.Debugf("not caching diff for layer %q: %v", layer.ID, err)
+		filler.file = nil
+	}
+	return finishDiff(filler, compression, options)
+}
+
+// writeThrough returns a reader which passes diff through while writing an
+// uncompressed copy of it to a temporary file, and a function which should be
+// called with the layer which was created or modified using the diff, or nil
+// if that failed, to add the copy to the cache.
+func (s *cachingStore) writeThrough(diff io.Reader) (io.Reader, func(*Layer)) {
+	if diff == nil {
+		return nil, func(*Layer) {}
+	}
+	tmp, err := ioutil.TempFile(s.cache.tempDir(), "diff")
+	if err != nil {
+		logrus.Debugf("not caching diff: %v", err)
+		return diff, func(*Layer) {}
+	}
+	preader, pwriter := io.Pipe()
+	digester := digest.Canonical.Digester()
+	size := int64(0)
+	done := make(chan error, 1)
+	go func() {
+		decompressed, err := archive.DecompressStream(preader)
+		if err == nil {
+			size, err = io.Copy(io.MultiWriter(tmp, digester.Hash()), decompressed)
+			decompressed.Close()
+		}
+		// Keep reading, so that the layer can still be written if
+		// we couldn't keep a copy.
+		io.Copy(ioutil.Discard, preader)
+		done <- err
+	}()
+	finish := func(layer *Layer) {
+		pwriter.Close()
+		err := <-done
+		tmp.Close()
+		key := diffCacheKey(layer)
+		if err != nil || key == "" || digester.Digest() != layer.UncompressedDigest {
+			os.Remove(tmp.Name())
+			return
+		}
+		if _, err := s.cache.commit(key, tmp.Name(), size, false); err != nil {
+			logrus.Debugf("error caching diff for layer %q: %v", layer.ID, err)
+		}
+	}
+	return io.TeeReader(diff, pwriter), finish
+}
+
+func (s *cachingStore) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
+	reader, finish := s.writeThrough(diff)
+	layer, size, err := s.Store.PutLayer(id, parent, names, mountLabel, writeable, options, reader)
+	finish(layer)
+	return layer, size, err
+}
+
+func (s *cachingStore) ApplyDiff(to string, diff io.Reader) (int64, error) {
+	reader, finish := s.writeThrough(diff)
+	size, err := s.Store.ApplyDiff(to, reader)
+	var layer *Layer
+	if err == nil {
+		layer, _ = s.Store.Layer(to)
+	}
+	finish(layer)
+	return size, err
+}
+
+func (s *cachingStore) MountImage(id string, mountOptions []string, mountLabel string) (string, error) {
+	if !stringutils.InSlice(mountOptions, "ro") {
+		return s.Store.MountImage(id, mountOptions, mountLabel)
+	}
+	image, err := s.Store.Image(id)
+	if err != nil {
+		return "", err
+	}
+	key := imageCacheKey(image, mountLabel)
+	if path, ok := s.cache.acquire(key); ok {
+		return path, nil
+	}
+	mountPoint, err := s.Store.MountImage(id, mountOptions, mountLabel)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(s.cache.tempDir(), "image")
+	if err == nil {
+		if err = archive.NewDefaultArchiver().CopyWithTar(mountPoint, tmp); err == nil {
+			var st os.FileInfo
+			if st, err = os.Stat(mountPoint); err == nil {
+				err = os.Chmod(tmp, st.Mode().Perm())
+			}
+		}
+		if err == nil && mountLabel != "" {
+			err = label.Relabel(tmp, mountLabel, false)
+		}
+		if err != nil {
+			system.EnsureRemoveAll(tmp)
+		}
+	}
+	if err != nil {
+		logrus.Debugf("not caching contents of image %q: %v", image.ID, err)
+		return mountPoint, nil
+	}
+	size, err := directory.Size(tmp)
+	if err != nil {
+		logrus.Debugf("error computing size of cached contents of image %q: %v", image.ID, err)
+	}
+	path, err := s.cache.commit(key, tmp, size, true)
+	if err != nil {
+		logrus.Debugf("error caching contents of image %q: %v", image.ID, err)
+		return mountPoint, nil
+	}
+	if _, err := s.Store.UnmountImage(id, false); err != nil {
+		logrus.Debugf("error unmounting image %q: %v", image.ID, err)
+	}
+	return path, nil
+}
+
+func (s *cachingStore) UnmountImage(id string, force bool) (bool, error) {
+	if image, err := s.Store.Image(id); err == nil {
+		if stillUsed, ok := s.cache.release(imageCacheKeyPrefix(image), force); ok {
+			return stillUsed, nil
+		}
+	}
+	return s.Store.UnmountImage(id, force)
+}
+
+func (s *cachingStore) DeleteLayer(id string) error {
+	layer, err := s.Store.Layer(id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.DeleteLayer(id); err != nil {
+		return err
+	}
+	s.cache.remove("diff-" + layer.ID + "-")
+	return nil
+}
+
+func (s *cachingStore) DeleteImage(id string, commit bool) ([]string, error) {
+	image, err := s.Store.Image(id)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := s.Store.DeleteImage(id, commit)
+	if err != nil || !commit {
+		return layers, err
+	}
+	prefixes := []string{"image-" + image.ID + "-"}
+	for _, layer := range layers {
+		prefixes = append(prefixes, "diff-"+layer+"-")
+	}
+	s.cache.remove(prefixes...)
+	return layers, nil
+}
@@ -1,17 +1,69 @@
 package storage
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/system"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vbatts/tar-split/tar/asm"
+	tsstorage "github.com/vbatts/tar-split/tar/storage"
 )
 
+func init() {
+	// storage-test-add-names runs AddNames in a separate process, so that
+	// tests can check that changes made by other processes are noticed.
+	reexec.Register("storage-test-add-names", func() {
+		store, err := GetStore(StoreOptions{
+			RunRoot:            os.Args[1],
+			GraphRoot:          os.Args[2],
+			GraphDriverName:    "vfs",
+			GraphDriverOptions: []string{},
+		})
+		if err == nil {
+			err = store.AddNames(os.Args[3], os.Args[4:])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	})
+}
+
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
 func TestStore(t *testing.T) {
 	wd, err := ioutil.TempDir("", "testStorageRuntime")
 	require.NoError(t, err)
@@ -244,3 +296,4123 @@ func TestStore(t *testing.T) {
 	store.Free()
 	store.Free()
 }
+
+func newTestStore(t *testing.T) Store {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+
+	store, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = store.Shutdown(true) })
+	return store
+}
+
+func TestStoreDurability(t *testing.T) {
+	wd := t.TempDir()
+	s, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		Durability:      "none",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+	other := newTestStore(t)
+
+	// The profile only applies to the store which was opened with it.
+	assert.Equal(t, ioutils.DurabilityNone, s.(*store).writerOptions.Durability)
+	assert.Equal(t, ioutils.DurabilityDefault, other.(*store).writerOptions.Durability)
+	assert.Equal(t, ioutils.DurabilityDefault, ioutils.DefaultOptions().Durability)
+	images, err := s.(*store).ImageStore()
+	require.NoError(t, err)
+	assert.Equal(t, ioutils.DurabilityNone, images.(*imageStore).records.options.Durability)
+
+	// An open store isn't handed out to callers which asked for a
+	// different profile, or for a read-only store.
+	_, err = GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	assert.True(t, errors.Is(err, ErrStoreOptionsConflict), "GetStore with another durability profile: %v", err)
+	_, err = GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+		Durability:      "none",
+		ReadOnly:        true,
+	})
+	assert.True(t, errors.Is(err, ErrStoreOptionsConflict), "GetStore for a read-only store: %v", err)
+	same, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+		Durability:      "none",
+	})
+	require.NoError(t, err)
+	assert.Same(t, s, same)
+}
+
+func TestStoreConcurrentPutLayer(t *testing.T) {
+	store := newTestStore(t)
+
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	parent, _, err := store.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+
+	const count = 8
+	ids := make([]string, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			diff, err := archive.Generate(fmt.Sprintf("file%d", i), fmt.Sprintf("contents %d", i))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			layer, _, err := store.PutLayer("", parent.ID, nil, "", false, nil, diff)
+			if err == nil {
+				ids[i] = layer.ID
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < count; i++ {
+		require.NoError(t, errs[i])
+		layer, err := store.Layer(ids[i])
+		require.NoError(t, err)
+		assert.Equal(t, parent.ID, layer.Parent)
+		assert.NotEmpty(t, layer.UncompressedDigest)
+		assert.False(t, layerHasIncompleteFlag(layer))
+		_, ok := layer.Flags[applyingPIDFlag]
+		assert.False(t, ok)
+	}
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, count+1)
+}
+
+func TestStoreConcurrentNames(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", []string{"base", "unwanted"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	const count = 8
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = store.RemoveNames(image.ID, []string{"unwanted"})
+				return
+			}
+			errs[i] = store.AddNames(image.ID, []string{fmt.Sprintf("name%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	expected := []string{"base"}
+	for i := 0; i < count; i++ {
+		require.NoError(t, errs[i])
+		if i > 0 {
+			expected = append(expected, fmt.Sprintf("name%d", i))
+		}
+	}
+	names, err := store.Names(image.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, names)
+}
+
+func TestStoreNamespaces(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageNamespaces")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+
+	getStore := func(namespace string) Store {
+		store, err := GetStore(StoreOptions{
+			RunRoot:         filepath.Join(wd, "run"),
+			GraphRoot:       filepath.Join(wd, "root"),
+			GraphDriverName: "vfs",
+			Namespace:       namespace,
+		})
+		require.NoError(t, err)
+		return store
+	}
+	tenantA := getStore("a")
+	defer tenantA.Shutdown(true)
+	tenantB := getStore("b")
+	defer tenantB.Shutdown(true)
+	assert.Equal(t, "a", tenantA.Namespace())
+	assert.Equal(t, "b", tenantB.Namespace())
+
+	_, err = GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		Namespace:       "../c",
+	})
+	assert.True(t, errors.Is(err, ErrInvalidNamespace))
+
+	layer, err := tenantA.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := tenantA.CreateImage("", []string{"example.com/a:latest"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	// Layers are shared, images are not.
+	_, err = tenantB.Layer(layer.ID)
+	require.NoError(t, err)
+	_, err = tenantB.Image(image.ID)
+	assert.Error(t, err)
+	images, err := tenantB.Images()
+	require.NoError(t, err)
+	assert.Empty(t, images)
+
+	// Another namespace can't delete a layer that's still in use.
+	err = tenantB.DeleteLayer(layer.ID)
+	assert.True(t, errors.Is(err, ErrLayerUsedByImage))
+	require.NoError(t, tenantB.Wipe())
+	_, err = tenantA.Layer(layer.ID)
+	require.NoError(t, err)
+
+	// Other namespaces' records are only opened once.
+	peerImageStores := make(map[string]ImageStore)
+	for path, istore := range tenantB.(*store).peerImageStores {
+		peerImageStores[path] = istore
+	}
+	assert.NotEmpty(t, peerImageStores)
+	err = tenantB.DeleteLayer(layer.ID)
+	assert.True(t, errors.Is(err, ErrLayerUsedByImage))
+	for path, istore := range peerImageStores {
+		assert.Same(t, istore, tenantB.(*store).peerImageStores[path])
+	}
+
+	// Once nothing uses it, the layer goes away along with the image.
+	layers, err := tenantA.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{layer.ID}, layers)
+	_, err = tenantB.Layer(layer.ID)
+	assert.Error(t, err)
+}
+
+func TestStoreEnterMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("entering a mount requires root")
+	}
+	store := newTestStore(t)
+
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "marker"), []byte("marker"), 0644))
+	_, err = store.Unmount(layer.ID, false)
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	err = store.EnterMount(layer.ID, &EnterMountOptions{
+		Command: []string{"sh", "-c", "pwd; cat marker"},
+		Stdout:  &stdout,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, mountPoint+"\nmarker", stdout.String())
+
+	mounted, err := store.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Zero(t, mounted, "layer was left mounted")
+
+	err = store.EnterMount(layer.ID, &EnterMountOptions{Command: []string{"sh", "-c", "exit 1"}})
+	assert.Error(t, err, "failure of the command was not reported")
+}
+
+func TestStoreSharedReadOnlyMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting layers requires root")
+	}
+	s := newTestStore(t)
+	// Asking for "nodev" makes the vfs driver bind mount the layer, so
+	// that it's actually mounted.
+	roOptions := []string{"ro", "nodev"}
+
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	lstore, err := s.(*store).LayerStore()
+	require.NoError(t, err)
+	rlstore := lstore.(*layerStore)
+
+	_, err = rlstore.Mount(layer.ID, drivers.MountOpts{Options: roOptions})
+	require.NoError(t, err)
+
+	// Pretend that another, still-running, process made the mount.
+	otherHolder := func(pid int, start uint64) {
+		rlstore.mountsLockfile.Lock()
+		defer rlstore.mountsLockfile.Unlock()
+		rlstore.mountHolders[layer.ID] = map[int]int{pid: 1}
+		rlstore.mountHolderStarts[layer.ID] = map[int]uint64{pid: start}
+		require.NoError(t, rlstore.saveMounts())
+		rlstore.mountsLockfile.Touch()
+	}
+	otherHolder(os.Getppid(), system.ProcessStartTime(os.Getppid()))
+
+	_, err = rlstore.Mount(layer.ID, drivers.MountOpts{})
+	assert.True(t, errors.Is(err, ErrLayerMountedReadOnly), "mounted a read-only mount for writing: %v", err)
+	assert.Contains(t, err.Error(), strconv.Itoa(os.Getppid()))
+
+	_, err = rlstore.Mount(layer.ID, drivers.MountOpts{Options: roOptions})
+	require.NoError(t, err)
+	count, err := rlstore.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// We can drop our own reference, but not the other process's.
+	stillMounted, err := rlstore.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.True(t, stillMounted)
+	stillMounted, err = rlstore.Unmount(layer.ID, false)
+	assert.True(t, errors.Is(err, ErrLayerMountedByOthers), "unmounted a mount held by another process: %v", err)
+	assert.True(t, stillMounted)
+
+	// A process which reuses the other process's ID isn't mistaken for it.
+	_, err = rlstore.Mount(layer.ID, drivers.MountOpts{Options: roOptions})
+	require.NoError(t, err)
+	otherHolder(os.Getppid(), system.ProcessStartTime(os.Getppid())+1)
+	stillMounted, err = rlstore.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.True(t, stillMounted)
+
+	// Once the other process has exited, its reference can be dropped.
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	otherHolder(cmd.ProcessState.Pid(), 0)
+	stillMounted, err = rlstore.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.False(t, stillMounted)
+}
+
+func TestStoreImageStoreAccess(t *testing.T) {
+	shared := newTestStore(t)
+	_, err := shared.CreateImage("", []string{"shared"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	// Use a copy of the store's contents as the additional image store,
+	// since this process already has read-write locks for the original.
+	sharedRoot := shared.GraphRoot() + "-shared"
+	require.NoError(t, exec.Command("cp", "-a", shared.GraphRoot(), sharedRoot).Run())
+
+	openStore := func(tokens map[string]string) Store {
+		wd, err := ioutil.TempDir("", "testStorageRuntime")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(wd) })
+		s, err := GetStore(StoreOptions{
+			RunRoot:            filepath.Join(wd, "run"),
+			GraphRoot:          filepath.Join(wd, "root"),
+			GraphDriverName:    "vfs",
+			GraphDriverOptions: []string{"vfs.imagestore=" + sharedRoot},
+			ImageStoreTokens:   tokens,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = s.Shutdown(true) })
+		return s
+	}
+
+	// Stores which don't require a token can be used by anyone.
+	s := openStore(nil)
+	_, err = s.Image("shared")
+	require.NoError(t, err)
+
+	token, err := GrantImageStoreAccess(sharedRoot, "test", time.Time{})
+	require.NoError(t, err)
+	_, err = GrantImageStoreAccess(sharedRoot, "test", time.Time{})
+	assert.True(t, errors.Is(err, ErrDuplicateName))
+	require.NoError(t, CheckImageStoreAccess(sharedRoot, token))
+	assert.True(t, errors.Is(CheckImageStoreAccess(sharedRoot, ""), ErrImageStoreAccessDenied))
+	assert.True(t, errors.Is(CheckImageStoreAccess(sharedRoot, "bogus"), ErrImageStoreAccessDenied))
+	// Tokens are only valid for the store they were granted for.
+	other, err := ioutil.TempDir("", "testStorageAccess")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+	access, err := ioutil.ReadFile(filepath.Join(sharedRoot, imageStoreAccessFile))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(other, imageStoreAccessFile), access, 0644))
+	assert.True(t, errors.Is(CheckImageStoreAccess(other, token), ErrImageStoreAccessDenied))
+
+	s = openStore(nil)
+	_, err = s.Image("shared")
+	assert.True(t, errors.Is(err, ErrImageUnknown), "expected the image store to be skipped without a token, got %v", err)
+	// The driver isn't told about stores which we can't use, so it won't
+	// look for lower layers in them.
+	driver, err := s.GraphDriver()
+	require.NoError(t, err)
+	assert.Empty(t, driver.AdditionalImageStores())
+
+	// Stores which are opened with different tokens aren't shared.
+	options := StoreOptions{
+		RunRoot:            s.RunRoot(),
+		GraphRoot:          s.GraphRoot(),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{"vfs.imagestore=" + sharedRoot},
+		ImageStoreTokens:   map[string]string{sharedRoot: token},
+	}
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s2, err := GetStore(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+	assert.NotSame(t, s, s2)
+	_, err = s2.Image("shared")
+	require.NoError(t, err)
+	s2.Free()
+
+	s = openStore(map[string]string{sharedRoot: token})
+	_, err = s.Image("shared")
+	require.NoError(t, err)
+	driver, err = s.GraphDriver()
+	require.NoError(t, err)
+	assert.Equal(t, []string{sharedRoot}, driver.AdditionalImageStores())
+
+	expired, err := GrantImageStoreAccess(sharedRoot, "expired", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.True(t, errors.Is(CheckImageStoreAccess(sharedRoot, expired), ErrImageStoreAccessDenied))
+
+	require.NoError(t, RevokeImageStoreAccess(sharedRoot, "test"))
+	assert.True(t, errors.Is(CheckImageStoreAccess(sharedRoot, token), ErrImageStoreAccessDenied))
+	s = openStore(map[string]string{sharedRoot: token})
+	_, err = s.Image("shared")
+	assert.True(t, errors.Is(err, ErrImageUnknown), "expected the image store to be skipped with a revoked token, got %v", err)
+
+	tokens, err := ImageStoreAccessTokens(sharedRoot)
+	require.NoError(t, err)
+	assert.Len(t, tokens, 2)
+}
+
+func TestStoreShadowReadOnlyImage(t *testing.T) {
+	shared := newTestStore(t)
+	image, err := shared.CreateImage("", []string{"shared"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	sharedRoot := shared.GraphRoot() + "-shared"
+	require.NoError(t, exec.Command("cp", "-a", shared.GraphRoot(), sharedRoot).Run())
+	t.Cleanup(func() { os.RemoveAll(sharedRoot) })
+
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	s, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{"vfs.imagestore=" + sharedRoot},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	// An image with the ID of one in a read-only store takes its place,
+	// the way that a copy of it does when names are added to it.
+	created, err := s.CreateImage(image.ID, []string{"local"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, created.ID)
+	found, err := s.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"local"}, found.Names)
+	_, err = s.CreateImage(image.ID, nil, "", "", &ImageOptions{})
+	assert.True(t, errors.Is(err, ErrDuplicateID), "expected a duplicate ID error, got %v", err)
+}
+
+func TestStoreGraphRootChanged(t *testing.T) {
+	s := newTestStore(t)
+	image, err := s.CreateImage("", []string{"before"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+
+	recorded, err := readFilesystemIdentity(s.GraphRoot())
+	require.NoError(t, err)
+	require.NotNil(t, recorded)
+	require.NotEmpty(t, recorded.Features)
+
+	// Forget about the store so that GetStore() will check again.
+	reopen := func(s Store) Store {
+		storesLock.Lock()
+		for i := range stores {
+			if stores[i] == s {
+				stores = append(stores[:i], stores[i+1:]...)
+				break
+			}
+		}
+		storesLock.Unlock()
+		s2, err := GetStore(StoreOptions{
+			RunRoot:         s.RunRoot(),
+			GraphRoot:       s.GraphRoot(),
+			GraphDriverName: "vfs",
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+		return s2
+	}
+
+	// Pretend that the filesystem's features were different when the
+	// store was created.  That doesn't mean that it was replaced, so the
+	// features are just probed and recorded again.
+	changed := *recorded
+	changed.Features = make(map[string]bool)
+	for feature, supported := range recorded.Features {
+		changed.Features[feature] = !supported
+	}
+	require.NoError(t, writeFilesystemIdentity(s.GraphRoot(), changed))
+	s = reopen(s)
+	_, err = s.Image("before")
+	require.NoError(t, err)
+	updated, err := readFilesystemIdentity(s.GraphRoot())
+	require.NoError(t, err)
+	assert.Equal(t, recorded.Features, updated.Features)
+
+	// Pretend that the graph root was on a different filesystem when the
+	// store was created.
+	changed = *recorded
+	changed.Magic = "0x0"
+	changed.UUID = "00000000-0000-0000-0000-000000000000"
+	require.NoError(t, writeFilesystemIdentity(s.GraphRoot(), changed))
+	s2 := reopen(s)
+
+	_, err = s2.Images()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrGraphRootChanged))
+	var changedErr *GraphRootChangedError
+	require.True(t, errors.As(err, &changedErr))
+	assert.Equal(t, "0x0", changedErr.Recorded.Magic)
+	assert.Equal(t, recorded.Magic, changedErr.Current.Magic)
+	_, err = s2.CreateImage("", []string{"during"}, "", "", &ImageOptions{})
+	assert.True(t, errors.Is(err, ErrGraphRootChanged))
+
+	require.NoError(t, s2.AdoptNewFilesystem())
+	img, err := s2.Image("before")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, img.ID)
+	adopted, err := readFilesystemIdentity(s.GraphRoot())
+	require.NoError(t, err)
+	assert.Equal(t, recorded.Magic, adopted.Magic)
+	assert.Empty(t, recorded.differences(*adopted))
+}
+
+func TestFilesystemIdentityDifferences(t *testing.T) {
+	recorded := FilesystemIdentity{Type: "xfs", Magic: "0x58465342", UUID: "1234", Label: "data", FSID: "0000080300000000"}
+
+	// Filesystem IDs change when devices are renumbered, and whether or
+	// not we can find UUIDs and labels depends on udev.
+	current := recorded
+	current.FSID = "0000081100000000"
+	assert.Empty(t, recorded.differences(current))
+	current.UUID = ""
+	current.Label = ""
+	assert.Empty(t, recorded.differences(current))
+
+	current = recorded
+	current.Label = "other"
+	assert.Len(t, recorded.differences(current), 1)
+	current.UUID = "5678"
+	assert.Len(t, recorded.differences(current), 2)
+
+	// Features can change without the filesystem being replaced.
+	recorded.Features = map[string]bool{"d_type": true, "user_xattr": false}
+	current = recorded
+	current.Features = map[string]bool{"d_type": true, "user_xattr": true}
+	assert.Empty(t, recorded.differences(current))
+	assert.Len(t, recorded.featureChanges(current), 1)
+}
+
+func TestStoreFilesystemProbeCached(t *testing.T) {
+	s := newTestStore(t)
+	st := s.(*store)
+	device, err := filesystemDevice(st.graphRoot)
+	require.NoError(t, err)
+	if device == "" {
+		t.Skip("probes aren't cached on this platform")
+	}
+	_, err = os.Stat(filepath.Join(st.runRoot, filesystemProbeFile))
+	require.NoError(t, err)
+
+	// A cached probe is used instead of probing again.
+	cached := filesystemProbe{Device: device, Identity: FilesystemIdentity{Magic: "0x1234"}}
+	data, err := json.Marshal(&cached)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(st.runRoot, filesystemProbeFile), data, 0600))
+	identity, err := st.probeFilesystemCached()
+	require.NoError(t, err)
+	assert.Equal(t, "0x1234", identity.Magic)
+
+	// A probe of some other filesystem isn't.
+	cached.Device = "elsewhere"
+	data, err = json.Marshal(&cached)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(st.runRoot, filesystemProbeFile), data, 0600))
+	identity, err = st.probeFilesystemCached()
+	require.NoError(t, err)
+	assert.NotEqual(t, "0x1234", identity.Magic)
+}
+
+func TestStoreTransferLayer(t *testing.T) {
+	src := newTestStore(t)
+
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	parent, _, err := src.PutLayer("", "", []string{"transfer-base"}, "", false, nil, base)
+	require.NoError(t, err)
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	layer, _, err := src.PutLayer("", parent.ID, []string{"transfer-top"}, "", false, nil, diff)
+	require.NoError(t, err)
+	require.NoError(t, src.SetMetadata(layer.ID, "metadata"))
+	require.NoError(t, src.SetLayerBigData(layer.ID, "item", bytes.NewReader([]byte("data"))))
+	layer, err = src.Layer(layer.ID)
+	require.NoError(t, err)
+
+	readDiff := func(s Store, id string) []byte {
+		uncompressed := archive.Uncompressed
+		rc, err := s.Diff("", id, &DiffOptions{Compression: &uncompressed})
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return data
+	}
+	expected := readDiff(src, layer.ID)
+
+	for _, noReflink := range []bool{false, true} {
+		dest := newTestStore(t)
+		copied, err := src.TransferLayer(layer.ID, dest, &TransferLayerOptions{NoReflink: noReflink})
+		require.NoError(t, err, "NoReflink=%v", noReflink)
+		assert.Equal(t, layer.ID, copied.ID)
+		assert.Equal(t, parent.ID, copied.Parent)
+		assert.Equal(t, layer.Names, copied.Names)
+		assert.Equal(t, layer.CompressedDigest, copied.CompressedDigest)
+		assert.Equal(t, layer.CompressedSize, copied.CompressedSize)
+		assert.Equal(t, layer.UncompressedDigest, copied.UncompressedDigest)
+		assert.Equal(t, layer.UncompressedSize, copied.UncompressedSize)
+		assert.Equal(t, "metadata", copied.Metadata)
+		assert.Equal(t, expected, readDiff(dest, layer.ID))
+
+		copiedParent, err := dest.Layer("transfer-base")
+		require.NoError(t, err)
+		assert.Equal(t, parent.ID, copiedParent.ID)
+
+		rc, err := dest.LayerBigData(layer.ID, "item")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+
+		// Copying it again just returns the copy.
+		again, err := src.TransferLayer(layer.ID, dest, nil)
+		require.NoError(t, err)
+		assert.Equal(t, copied.ID, again.ID)
+	}
+
+	_, err = src.TransferLayer(layer.ID, src, nil)
+	assert.Error(t, err)
+
+	// Copies made in opposite directions at the same time don't deadlock.
+	other := newTestStore(t)
+	var ids [2][]string
+	for i, s := range []Store{src, other} {
+		for j := 0; j < 4; j++ {
+			diff, err := archive.Generate("file", fmt.Sprintf("content %d %d", i, j))
+			require.NoError(t, err)
+			layer, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+			require.NoError(t, err)
+			ids[i] = append(ids[i], layer.ID)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i, pair := range [][2]Store{{src, other}, {other, src}} {
+		for _, id := range ids[i] {
+			wg.Add(1)
+			go func(from, to Store, id string) {
+				defer wg.Done()
+				_, err := from.TransferLayer(id, to, nil)
+				errs <- err
+			}(pair[0], pair[1], id)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestStoreCloneTo(t *testing.T) {
+	src := newTestStore(t)
+
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	layer, _, err := src.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	image, err := src.CreateImage("", []string{"clone-image"}, layer.ID, "image metadata", &ImageOptions{})
+	require.NoError(t, err)
+	require.NoError(t, src.SetImageBigData(image.ID, "config", []byte("config"), nil))
+	other, err := src.CreateImage("", []string{"other-image"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := src.CreateContainer("", []string{"clone-container"}, image.ID, "", "container metadata", nil)
+	require.NoError(t, err)
+	require.NoError(t, src.SetContainerBigData(container.ID, "state", []byte("state")))
+	dir, err := src.ContainerDirectory(container.ID)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "userdata-file"), []byte("userdata"), 0600))
+
+	cloneTo := func(cloneOptions *CloneOptions) Store {
+		wd, err := ioutil.TempDir("", "testStorageClone")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(wd) })
+		dest, err := src.CloneTo(StoreOptions{
+			RunRoot:   filepath.Join(wd, "run"),
+			GraphRoot: filepath.Join(wd, "root"),
+		}, cloneOptions)
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = dest.Shutdown(true) })
+		return dest
+	}
+
+	dest := cloneTo(nil)
+	assert.Equal(t, "vfs", dest.GraphDriverName())
+	copiedImage, err := dest.Image("clone-image")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, copiedImage.ID)
+	assert.Equal(t, layer.ID, copiedImage.TopLayer)
+	assert.Equal(t, "image metadata", copiedImage.Metadata)
+	assert.Equal(t, image.Created, copiedImage.Created)
+	data, err := dest.ImageBigData(image.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "config", string(data))
+	_, err = dest.Image(other.ID)
+	assert.NoError(t, err)
+	copiedContainer, err := dest.Container("clone-container")
+	require.NoError(t, err)
+	assert.Equal(t, container.ID, copiedContainer.ID)
+	assert.Equal(t, container.LayerID, copiedContainer.LayerID)
+	assert.Equal(t, "container metadata", copiedContainer.Metadata)
+	data, err = dest.ContainerBigData(container.ID, "state")
+	require.NoError(t, err)
+	assert.Equal(t, "state", string(data))
+	copiedLayer, err := dest.Layer(container.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, layer.ID, copiedLayer.Parent)
+	dir, err = dest.ContainerDirectory(container.ID)
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(dir, "userdata-file"))
+	require.NoError(t, err)
+	assert.Equal(t, "userdata", string(data))
+
+	// Items which were copied completely aren't copied again, but items
+	// whose copying was interrupted are.
+	d := dest.(*store)
+	require.NoError(t, dest.SetMetadata(image.ID, "partial"))
+	require.NoError(t, dest.SetMetadata(other.ID, "changed"))
+	require.NoError(t, dest.SetMetadata(container.ID, "partial"))
+	for _, marker := range []string{d.incompleteCopyPath("image", image.ID), d.incompleteCopyPath("container", container.ID)} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(marker), 0700))
+		require.NoError(t, ioutil.WriteFile(marker, nil, 0600))
+	}
+	require.NoError(t, src.(*store).cloneInto(d, &CloneOptions{}))
+	copiedImage, err = dest.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "image metadata", copiedImage.Metadata)
+	data, err = dest.ImageBigData(image.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "config", string(data))
+	copiedImage, err = dest.Image(other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", copiedImage.Metadata)
+	copiedContainer, err = dest.Container(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "container metadata", copiedContainer.Metadata)
+	assert.NoFileExists(t, d.incompleteCopyPath("image", image.ID))
+	assert.NoFileExists(t, d.incompleteCopyPath("container", container.ID))
+
+	// Cloning selected images leaves out everything else.
+	dest = cloneTo(&CloneOptions{Images: []string{"clone-image"}, NoReflink: true})
+	_, err = dest.Image(image.ID)
+	assert.NoError(t, err)
+	_, err = dest.Image(other.ID)
+	assert.True(t, errors.Is(err, ErrImageUnknown))
+	containers, err := dest.Containers()
+	require.NoError(t, err)
+	assert.Empty(t, containers)
+	_, err = dest.Layer(container.LayerID)
+	assert.True(t, errors.Is(err, ErrLayerUnknown))
+
+	_, err = src.CloneTo(StoreOptions{RunRoot: src.RunRoot(), GraphRoot: src.GraphRoot()}, nil)
+	assert.Error(t, err)
+}
+
+func TestStoreLayerProgress(t *testing.T) {
+	store := newTestStore(t)
+
+	base, err := archive.Generate("base", "base contents")
+	require.NoError(t, err)
+	parent, _, err := store.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+
+	var created []archive.Progress
+	layer, err := store.CreateLayer("", parent.ID, nil, "", true, &LayerOptions{
+		Progress: func(p archive.Progress) { created = append(created, p) },
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, created, "copying the parent layer should have reported progress")
+	assert.Equal(t, "base", created[len(created)-1].Entry)
+	assert.Equal(t, int64(len("base contents")), created[len(created)-1].Bytes)
+
+	diff, err := archive.Generate("file1", "one", "file2", "two!")
+	require.NoError(t, err)
+	var applied []archive.Progress
+	_, err = store.ApplyDiffWithOptions(layer.ID, &LayerOptions{
+		Progress: func(p archive.Progress) { applied = append(applied, p) },
+	}, diff)
+	require.NoError(t, err)
+	require.Len(t, applied, 2)
+	assert.Equal(t, archive.Progress{Entries: 2, Bytes: 7, Entry: "file2"}, applied[1])
+
+	_, err = store.ApplyDiffWithOptions("no-such-layer", nil, bytes.NewReader(nil))
+	assert.Equal(t, ErrLayerUnknown, err)
+
+	uncompressed := archive.Uncompressed
+	var read []archive.Progress
+	rc, err := store.Diff(parent.ID, layer.ID, &DiffOptions{
+		Compression: &uncompressed,
+		Progress:    func(p archive.Progress) { read = append(read, p) },
+	})
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Len(t, read, 2)
+	assert.Equal(t, int64(7), read[1].Bytes)
+
+	// Progress can be reported for compressed diffs which are passed
+	// along as they are, like those of additional layers.
+	diff, err = archive.Generate("file1", "one", "file2", "two!")
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	compressor, err := archive.CompressStream(&compressed, archive.Gzip)
+	require.NoError(t, err)
+	_, err = io.Copy(compressor, diff)
+	require.NoError(t, err)
+	require.NoError(t, compressor.Close())
+	read = nil
+	rc = progressCompressedReadCloser(ioutil.NopCloser(bytes.NewReader(compressed.Bytes())), func(p archive.Progress) { read = append(read, p) })
+	passed, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, compressed.Bytes(), passed)
+	require.Len(t, read, 2)
+	assert.Equal(t, archive.Progress{Entries: 2, Bytes: 7, Entry: "file2"}, read[1])
+}
+
+func TestStoreCheck(t *testing.T) {
+	store := newTestStore(t)
+
+	report, err := store.Check(nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	diff, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	withDiff, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	empty, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+
+	// Damage the store in a few different ways.
+	vfsDir := filepath.Join(store.GraphRoot(), "vfs", "dir")
+	require.NoError(t, os.RemoveAll(filepath.Join(vfsDir, empty.ID)))
+	require.NoError(t, os.Mkdir(filepath.Join(vfsDir, "orphan"), 0700))
+	tspath := filepath.Join(store.GraphRoot(), "vfs-layers", withDiff.ID+tarSplitSuffix)
+	require.NoError(t, ioutil.WriteFile(tspath, []byte("not compressed"), 0600))
+
+	kinds := func(report *CheckReport) map[CheckProblemKind]string {
+		found := make(map[CheckProblemKind]string)
+		for _, problem := range report.Problems {
+			found[problem.Kind] = problem.ID
+		}
+		return found
+	}
+	expected := map[CheckProblemKind]string{
+		CheckMissingLayerData: empty.ID,
+		CheckOrphanedLayer:    "orphan",
+		CheckBadTarSplit:      withDiff.ID,
+	}
+	report, err = store.Check(nil)
+	require.NoError(t, err)
+	assert.Equal(t, expected, kinds(report))
+	for _, problem := range report.Problems {
+		assert.False(t, problem.Fixed)
+	}
+
+	report, err = store.Check(&CheckOptions{Repair: true})
+	require.NoError(t, err)
+	assert.Equal(t, expected, kinds(report))
+	for _, problem := range report.Problems {
+		assert.True(t, problem.Fixed, problem.String())
+	}
+
+	report, err = store.Check(nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	_, err = store.Layer(empty.ID)
+	assert.Error(t, err)
+	rc, err := store.Diff("", withDiff.ID, nil)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+}
+
+func TestStoreFindPath(t *testing.T) {
+	store := newTestStore(t)
+
+	diff, err := archive.Generate("etc/passwd", "root", "etc/hosts", "localhost", "usr/lib/libc.so", "libc")
+	require.NoError(t, err)
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	diff, err = archive.Generate("etc/passwd", "root\nuser", "etc/.wh.hosts", "", "usr/lib/libm.so", "libm")
+	require.NoError(t, err)
+	middle, _, err := store.PutLayer("", base.ID, nil, "", false, nil, diff)
+	require.NoError(t, err)
+
+	// A layer without tar-split data, whose changes have to be computed.
+	top, err := store.CreateLayer("", middle.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(top.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(mountPoint, "etc", "passwd")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "etc", "hosts"), []byte("again"), 0644))
+	_, err = store.Unmount(top.ID, true)
+	require.NoError(t, err)
+
+	image, err := store.CreateImage("", nil, top.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	changes, err := store.FindPath(image.ID, "/etc/*")
+	require.NoError(t, err)
+	assert.Equal(t, []LayerPathChange{
+		{Layer: base.ID, Path: "/etc/passwd", Kind: archive.ChangeAdd},
+		{Layer: base.ID, Path: "/etc/hosts", Kind: archive.ChangeAdd},
+		{Layer: middle.ID, Path: "/etc/passwd", Kind: archive.ChangeModify},
+		{Layer: middle.ID, Path: "/etc/hosts", Kind: archive.ChangeDelete},
+		{Layer: top.ID, Path: "/etc/hosts", Kind: archive.ChangeAdd},
+		{Layer: top.ID, Path: "/etc/passwd", Kind: archive.ChangeDelete},
+	}, changes)
+
+	changes, err = store.FindPath(middle.ID, "*.so")
+	require.NoError(t, err)
+	assert.Equal(t, []LayerPathChange{
+		{Layer: base.ID, Path: "/usr/lib/libc.so", Kind: archive.ChangeAdd},
+		{Layer: middle.ID, Path: "/usr/lib/libm.so", Kind: archive.ChangeAdd},
+	}, changes)
+
+	_, err = store.FindPath(image.ID, "[")
+	assert.Error(t, err)
+}
+
+func TestStoreLayerDigests(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+	}
+	store, err := GetStore(options)
+	require.NoError(t, err)
+
+	tarball, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	uncompressed, err := ioutil.ReadAll(tarball)
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	compressor, err := archive.CompressStream(&compressed, archive.Gzip)
+	require.NoError(t, err)
+	_, err = compressor.Write(uncompressed)
+	require.NoError(t, err)
+	require.NoError(t, compressor.Close())
+
+	layer, size, err := store.PutLayer("", "", nil, "", false, nil, bytes.NewReader(compressed.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("contents")), size)
+
+	check := func(s Store) {
+		layer, err := s.Layer(layer.ID)
+		require.NoError(t, err)
+		assert.Equal(t, digest.FromBytes(compressed.Bytes()), layer.CompressedDigest)
+		assert.Equal(t, int64(compressed.Len()), layer.CompressedSize)
+		assert.Equal(t, digest.FromBytes(uncompressed), layer.UncompressedDigest)
+		assert.Equal(t, int64(len(uncompressed)), layer.UncompressedSize)
+		assert.Equal(t, archive.Gzip, layer.CompressionType)
+
+		byCompressed, err := s.LayersByCompressedDigest(layer.CompressedDigest)
+		require.NoError(t, err)
+		require.Len(t, byCompressed, 1)
+		assert.Equal(t, layer.ID, byCompressed[0].ID)
+		byUncompressed, err := s.LayersByUncompressedDigest(layer.UncompressedDigest)
+		require.NoError(t, err)
+		require.Len(t, byUncompressed, 1)
+		assert.Equal(t, layer.ID, byUncompressed[0].ID)
+
+		size, err := s.LayerSize(layer.ID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(uncompressed)), size)
+	}
+	check(store)
+
+	// The values are still known after the store is reloaded.
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store, err = GetStore(options)
+	require.NoError(t, err)
+	defer func() { _, _ = store.Shutdown(true) }()
+	check(store)
+}
+
+func TestStoreLayerDigestIndex(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	defer os.RemoveAll(wd)
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+	}
+	store, err := GetStore(options)
+	require.NoError(t, err)
+	tarball, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, tarball)
+	require.NoError(t, err)
+	// The index is only saved once it's been used.
+	layerdir := filepath.Join(options.GraphRoot, "vfs-layers")
+	assert.NoFileExists(t, filepath.Join(layerdir, "digests.json"))
+	_, err = store.LayersByUncompressedDigest(layer.UncompressedDigest)
+	require.NoError(t, err)
+	require.NoError(t, store.SetNames(layer.ID, []string{"layer"}))
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+
+	// Add an entry to the saved index, so that we can tell when it's used.
+	data, err := ioutil.ReadFile(filepath.Join(layerdir, "digests.json"))
+	require.NoError(t, err)
+	var index layerDigestIndex
+	require.NoError(t, json.Unmarshal(data, &index))
+	assert.Equal(t, []string{layer.ID}, index.Uncompressed[layer.UncompressedDigest])
+	records, err := ioutil.ReadFile(filepath.Join(layerdir, "layers.json"))
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(records), index.Records)
+	marker := digest.FromString("marker")
+	index.Uncompressed[marker] = []string{layer.ID}
+	data, err = json.Marshal(&index)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layerdir, "digests.json"), data, 0600))
+
+	lookup := func(d digest.Digest) ([]Layer, error) {
+		s, err := GetStore(options)
+		require.NoError(t, err)
+		defer func() { _, _ = s.Shutdown(true) }()
+		// The index isn't read until it's needed.
+		rlstore, err := s.(interface{ LayerStore() (LayerStore, error) }).LayerStore()
+		require.NoError(t, err)
+		assert.False(t, rlstore.(*layerStore).digestsLoaded)
+		return s.LayersByUncompressedDigest(d)
+	}
+	layers, err := lookup(marker)
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	// Adding a layer without using the index only logs the change.
+	store, err = GetStore(options)
+	require.NoError(t, err)
+	tarball, err = archive.Generate("other", "contents")
+	require.NoError(t, err)
+	other, _, err := store.PutLayer("", "", nil, "", false, nil, tarball)
+	require.NoError(t, err)
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	saved, err := ioutil.ReadFile(filepath.Join(layerdir, "digests.json"))
+	require.NoError(t, err)
+	assert.Equal(t, data, saved)
+	assert.FileExists(t, filepath.Join(layerdir, "digests.log"))
+	layers, err = lookup(other.UncompressedDigest)
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+	layers, err = lookup(marker)
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	// The index is ignored once the records have been replaced.
+	records, err = ioutil.ReadFile(filepath.Join(layerdir, "layers.json"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layerdir, "layers.json"), append(records, '\n'), 0600))
+	_, err = lookup(marker)
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "LayersByUncompressedDigest: %v", err)
+	layers, err = lookup(layer.UncompressedDigest)
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+}
+
+func TestStoreLazyLoading(t *testing.T) {
+	s := newTestStore(t)
+	image, err := s.CreateImage("", []string{"image"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	s2, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+	internal, ok := s2.(*store)
+	require.True(t, ok)
+
+	// Records are only read when they're needed.
+	assert.Nil(t, internal.imageStore)
+	assert.Nil(t, internal.containerStore)
+	assert.Nil(t, internal.artifactStore)
+	found, err := s2.Image("image")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, found.ID)
+	assert.NotNil(t, internal.imageStore)
+	assert.Nil(t, internal.containerStore)
+	assert.Nil(t, internal.artifactStore)
+}
+
+func TestStoreBigDataReader(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	contents := bytes.Repeat([]byte("model weights "), 1024)
+	readAll := func(rc io.ReadCloser, err error) []byte {
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return data
+	}
+
+	require.NoError(t, store.SetImageBigDataFromReader(image.ID, "blob", bytes.NewReader(contents), nil))
+	assert.Equal(t, contents, readAll(store.ImageBigDataReader(image.ID, "blob")))
+	size, err := store.ImageBigDataSize(image.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), size)
+	d, err := store.ImageBigDataDigest(image.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(contents), d)
+
+	// Manifests are passed to the callback to be digested.
+	manifest := []byte(`{"schemaVersion": 2}`)
+	manifestDigest := digest.FromString("manifest digest")
+	require.NoError(t, store.SetImageBigDataFromReader(image.ID, ImageDigestBigDataKey, bytes.NewReader(manifest), func(b []byte) (digest.Digest, error) {
+		assert.Equal(t, manifest, b)
+		return manifestDigest, nil
+	}))
+	d, err = store.ImageBigDataDigest(image.ID, ImageDigestBigDataKey)
+	require.NoError(t, err)
+	assert.Equal(t, manifestDigest, d)
+	images, err := store.ImagesByDigest(manifestDigest)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+
+	// A reader which fails leaves the old value in place.
+	failing := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.TimeoutReader(bytes.NewReader([]byte("x"))))
+	assert.Error(t, store.SetImageBigDataFromReader(image.ID, "blob", failing, nil))
+	assert.Equal(t, contents, readAll(store.ImageBigDataReader(image.ID, "blob")))
+
+	// The store isn't locked while a slow reader is being read.
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- store.SetImageBigDataFromReader(image.ID, "slow", pr, nil)
+	}()
+	_, err = pw.Write([]byte("slow"))
+	require.NoError(t, err)
+	require.NoError(t, store.SetImageBigData(image.ID, "fast", []byte("fast"), nil))
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-done)
+	assert.Equal(t, []byte("slow"), readAll(store.ImageBigDataReader(image.ID, "slow")))
+	entries, err := ioutil.ReadDir(store.TempDir())
+	require.NoError(t, err)
+	assert.Empty(t, entries, "spooled data should have been removed")
+
+	_, err = store.ImageBigDataReader(image.ID, "no-such-item")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = store.ImageBigDataReader("no-such-image", "blob")
+	assert.True(t, errors.Is(err, ErrImageUnknown))
+
+	require.NoError(t, store.SetContainerBigDataFromReader(container.ID, "blob", bytes.NewReader(contents)))
+	assert.Equal(t, contents, readAll(store.ContainerBigDataReader(container.ID, "blob")))
+	size, err = store.ContainerBigDataSize(container.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), size)
+	d, err = store.ContainerBigDataDigest(container.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(contents), d)
+}
+
+func TestStoreSharedImageBigData(t *testing.T) {
+	s := newTestStore(t)
+	istore, err := s.(*store).ImageStore()
+	require.NoError(t, err)
+	images := istore.(*imageStore)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	first, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	second, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	config := []byte(`{"architecture": "amd64"}`)
+	configDigest := digest.FromBytes(config)
+	require.NoError(t, s.SetImageBigData(first.ID, "config", config, nil))
+	require.NoError(t, s.SetImageBigData(second.ID, "config", config, nil))
+	require.NoError(t, s.SetImageBigData(second.ID, "copy", config, nil))
+
+	// All of the items share the blob's contents on disk.
+	blob, err := os.Stat(images.blobpath(configDigest))
+	require.NoError(t, err)
+	for _, item := range []struct{ id, key string }{{first.ID, "config"}, {second.ID, "config"}, {second.ID, "copy"}} {
+		fi, err := os.Stat(images.datapath(item.id, item.key))
+		require.NoError(t, err)
+		assert.True(t, os.SameFile(blob, fi), "expected item %q of image %q to share the blob", item.key, item.id)
+		data, err := s.ImageBigData(item.id, item.key)
+		require.NoError(t, err)
+		assert.Equal(t, config, data)
+	}
+	image, err := s.Image(second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]digest.Digest{"config": configDigest, "copy": configDigest}, image.BigDataBlobs)
+
+	// Changing one of the items doesn't affect the others.
+	changed := []byte(`{"architecture": "arm64"}`)
+	require.NoError(t, s.SetImageBigData(second.ID, "copy", changed, nil))
+	data, err := s.ImageBigData(second.ID, "copy")
+	require.NoError(t, err)
+	assert.Equal(t, changed, data)
+	data, err = s.ImageBigData(first.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, config, data)
+
+	// The blob is removed when nothing refers to it.
+	_, err = s.DeleteImage(first.ID, true)
+	require.NoError(t, err)
+	_, err = os.Stat(images.blobpath(configDigest))
+	require.NoError(t, err)
+	_, err = s.DeleteImage(second.ID, true)
+	require.NoError(t, err)
+	_, err = os.Stat(images.blobpath(configDigest))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(images.blobpath(digest.FromBytes(changed)))
+	assert.True(t, os.IsNotExist(err))
+
+	// If the image's record can't be saved, the item doesn't count as a
+	// reference to the blob.
+	third, err := s.CreateImage("", nil, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(images.imagespath()))
+	require.NoError(t, os.MkdirAll(filepath.Join(images.imagespath(), "blocker"), 0700))
+	assert.Error(t, s.SetImageBigData(third.ID, "config", config, nil))
+	assert.Zero(t, images.blobrefs[configDigest])
+	_, err = os.Stat(images.blobpath(configDigest))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreAnnotations(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	for _, id := range []string{layer.ID, image.ID, container.ID} {
+		require.NoError(t, store.UpdateAnnotations(id, map[string]string{"owner": "ci", "stage": "build"}, nil))
+	}
+	require.NoError(t, store.UpdateAnnotations(image.ID, map[string]string{"owner": "release"}, []string{"stage"}))
+	assert.Equal(t, ErrNotAnID, store.UpdateAnnotations("no-such-item", map[string]string{"owner": "ci"}, nil))
+
+	l, err := store.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ci", "stage": "build"}, l.Annotations)
+	i, err := store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "release"}, i.Annotations)
+	c, err := store.Container(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ci", "stage": "build"}, c.Annotations)
+
+	layers, err := store.LayersByAnnotation("stage", "")
+	require.NoError(t, err)
+	ids := []string{}
+	for _, l := range layers {
+		ids = append(ids, l.ID)
+	}
+	// The container's layer was created from the image, and isn't annotated.
+	assert.Equal(t, []string{layer.ID}, ids)
+	images, err := store.ImagesByAnnotation("owner", "ci")
+	require.NoError(t, err)
+	assert.Empty(t, images)
+	images, err = store.ImagesByAnnotation("owner", "release")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+	containers, err := store.ContainersByAnnotation("owner", "ci")
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	assert.Equal(t, container.ID, containers[0].ID)
+
+	// Removing every annotation leaves none behind.
+	require.NoError(t, store.UpdateAnnotations(image.ID, nil, []string{"owner", "not-set"}))
+	i, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Nil(t, i.Annotations)
+}
+
+func TestStoreReloadIfChanged(t *testing.T) {
+	s := newTestStore(t)
+
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"base"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.ReloadIfChanged())
+	require.NoError(t, s.ReloadIfChanged())
+
+	cmd := reexec.Command("storage-test-add-names", s.RunRoot(), s.GraphRoot(), image.ID, "other")
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	// Look at the image store's records directly, since the Store's
+	// methods would reload them anyway.
+	require.NoError(t, s.ReloadIfChanged())
+	istore, err := s.(*store).ImageStore()
+	require.NoError(t, err)
+	loaded, err := istore.Get(image.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base", "other"}, loaded.Names)
+
+	// If the watcher drops events, everything is reloaded, even if the
+	// lock files don't say that anything changed.
+	watcher := s.(*store).startWatcher()
+	if watcher == nil {
+		t.Skip("not watching for changes")
+	}
+	istore.(*imageStore).byid[image.ID].Names = []string{"stale"}
+	require.NoError(t, s.ReloadIfChanged())
+	loaded, err = istore.Get(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stale"}, loaded.Names)
+	watcher.setChanged(true)
+	require.NoError(t, s.ReloadIfChanged())
+	loaded, err = istore.Get(image.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base", "other"}, loaded.Names)
+}
+
+func TestStoreReadOnly(t *testing.T) {
+	s := newTestStore(t)
+
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"base"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+
+	snapshot := func() map[string]time.Time {
+		files := make(map[string]time.Time)
+		err := filepath.Walk(s.GraphRoot(), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			files[path] = info.ModTime()
+			return nil
+		})
+		require.NoError(t, err)
+		return files
+	}
+	before := snapshot()
+
+	ro, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(filepath.Dir(s.RunRoot()), "ro-run"),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+		ReadOnly:        true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = ro.Shutdown(true) })
+
+	images, err := ro.Images()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+	layers, err := ro.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	mountPoint, err := ro.MountImage(image.ID, nil, "")
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(mountPoint, "base"))
+	require.NoError(t, err)
+	mountPoint, err = ro.Mount(layer.ID, "")
+	require.NoError(t, err)
+	mounted, err := ro.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mounted)
+	_, err = ro.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	_, err = ro.UnmountImage(image.ID, false)
+	require.NoError(t, err)
+
+	_, _, err = ro.PutLayer("", layer.ID, nil, "", false, nil, nil)
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "PutLayer: %v", err)
+	_, err = ro.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "CreateImage: %v", err)
+	_, err = ro.CreateContainer("", nil, image.ID, "", "", nil)
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "CreateContainer: %v", err)
+	err = ro.AddNames(image.ID, []string{"other"})
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "AddNames: %v", err)
+	err = ro.SetImageBigData(image.ID, "key", []byte("data"), nil)
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "SetImageBigData: %v", err)
+	_, err = ro.DeleteImage(image.ID, true)
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "DeleteImage: %v", err)
+	err = ro.Wipe()
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "Wipe: %v", err)
+
+	_, err = ro.Shutdown(false)
+	require.NoError(t, err)
+	assert.Equal(t, before, snapshot())
+}
+
+func TestStoreReadOnlySharedLocks(t *testing.T) {
+	s := newTestStore(t)
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"base"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+
+	// Make a copy of the graph root whose lock files this process hasn't
+	// opened yet, as if another process had been using it.
+	graphRoot := filepath.Join(filepath.Dir(s.RunRoot()), "shared-root")
+	require.NoError(t, copy.DirCopy(s.GraphRoot(), graphRoot, copy.Content, false))
+	lockContents := func() map[string]string {
+		contents := make(map[string]string)
+		for _, lock := range []string{"storage.lock", "vfs-layers/layers.lock", "vfs-images/images.lock"} {
+			data, err := ioutil.ReadFile(filepath.Join(graphRoot, lock))
+			require.NoError(t, err)
+			contents[lock] = string(data)
+		}
+		return contents
+	}
+	before := lockContents()
+
+	runRoot := filepath.Join(filepath.Dir(s.RunRoot()), "shared-run")
+	ro, err := GetStore(StoreOptions{
+		RunRoot:         runRoot,
+		GraphRoot:       graphRoot,
+		GraphDriverName: "vfs",
+		ReadOnly:        true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = ro.Shutdown(true) })
+	shared, ok := ro.(*store).graphLock.(*sharedLockfile)
+	require.True(t, ok, "expected a shared lock on the graph root's lock file")
+
+	// Exclusive locks still exclude each other within this process.
+	shared.Lock()
+	locked := make(chan struct{})
+	go func() {
+		shared.Lock()
+		close(locked)
+		shared.Unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("took an exclusive lock while another one was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	shared.Unlock()
+	<-locked
+	shared.RLock()
+	shared.RecursiveLock()
+	shared.Unlock()
+	shared.Unlock()
+
+	images, err := ro.Images()
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+	_, err = ro.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "CreateImage: %v", err)
+	err = ro.SetNames(image.ID, []string{"other"})
+	assert.True(t, errors.Is(err, ErrStoreIsReadOnly), "SetNames: %v", err)
+
+	_, err = ro.Shutdown(false)
+	require.NoError(t, err)
+	assert.Equal(t, before, lockContents())
+	for _, lock := range []string{"storage.lock", "vfs-images/images.lock"} {
+		_, err := os.Stat(filepath.Join(runRoot, lock))
+		assert.True(t, os.IsNotExist(err), "expected no lock file at %q in the run root", lock)
+	}
+}
+
+func TestStoreExportImportImage(t *testing.T) {
+	s := newTestStore(t)
+
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+	upper, err := archive.Generate("upper", "upper")
+	require.NoError(t, err)
+	layer2, _, err := s.PutLayer("", layer.ID, nil, "", false, nil, upper)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"example.com/image:latest", "example.com/image:1.0"}, layer2.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	var exported bytes.Buffer
+	require.NoError(t, s.ExportImage(image.ID, &exported))
+
+	s2 := newTestStore(t)
+	imported, err := s2.ImportImage(bytes.NewReader(exported.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, imported.ID)
+	assert.ElementsMatch(t, image.Names, imported.Names)
+	assert.NotEmpty(t, imported.Digest)
+
+	top, err := s2.Layer(imported.TopLayer)
+	require.NoError(t, err)
+	assert.Equal(t, layer2.UncompressedDigest, top.UncompressedDigest)
+	parent, err := s2.Layer(top.Parent)
+	require.NoError(t, err)
+	assert.Equal(t, layer.UncompressedDigest, parent.UncompressedDigest)
+	assert.Empty(t, parent.Parent)
+
+	// The configuration which was generated when the image was exported
+	// is kept, so exporting the imported image produces the same layout.
+	var reexported bytes.Buffer
+	require.NoError(t, s2.ExportImage(imported.ID, &reexported))
+	assert.Equal(t, exported.Bytes(), reexported.Bytes())
+
+	// Layers which are already present are reused.
+	_, err = s2.CreateImage("", nil, imported.TopLayer, "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s2.DeleteImage(imported.ID, true)
+	require.NoError(t, err)
+	layersBefore, err := s2.Layers()
+	require.NoError(t, err)
+	_, err = s2.ImportImage(bytes.NewReader(exported.Bytes()))
+	require.NoError(t, err)
+	layersAfter, err := s2.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layersAfter, len(layersBefore))
+
+	// Blobs which don't match their digests are rejected.
+	s3 := newTestStore(t)
+	tr := tar.NewReader(bytes.NewReader(exported.Bytes()))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		if strings.HasPrefix(hdr.Name, "blobs/") && len(data) > 0 {
+			data[len(data)-1] ^= 0xff
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	_, err = s3.ImportImage(&buf)
+	assert.Error(t, err)
+	images, err := s3.Images()
+	require.NoError(t, err)
+	assert.Empty(t, images)
+	layers, err := s3.Layers()
+	require.NoError(t, err)
+	assert.Empty(t, layers)
+
+	// Layers which were added for an image which then can't be created
+	// are removed again.
+	_, err = s3.CreateImage(image.ID, nil, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = s3.ImportImage(bytes.NewReader(exported.Bytes()))
+	assert.Error(t, err)
+	layers, err = s3.Layers()
+	require.NoError(t, err)
+	assert.Empty(t, layers)
+}
+
+func TestStoreImageAttachments(t *testing.T) {
+	s := newTestStore(t)
+
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	signature := []byte("signature")
+	sbom := []byte(`{"spdxVersion":"SPDX-2.3"}`)
+	sig, err := s.AddImageAttachment(image.ID, ImageAttachmentSignature, "", signature)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(signature), sig.Digest)
+	assert.Equal(t, int64(len(signature)), sig.Size)
+	_, err = s.AddImageAttachment(image.ID, ImageAttachmentSBOM, "application/spdx+json", sbom)
+	require.NoError(t, err)
+	_, err = s.AddImageAttachment(image.ID, ImageAttachmentSignature, "", []byte("another signature"))
+	require.NoError(t, err)
+
+	// Adding an identical attachment doesn't add another one.
+	again, err := s.AddImageAttachment(image.ID, ImageAttachmentSignature, "", signature)
+	require.NoError(t, err)
+	assert.Equal(t, sig.BigDataName, again.BigDataName)
+
+	_, err = s.AddImageAttachment(image.ID, "", "", signature)
+	assert.Error(t, err)
+	_, err = s.AddImageAttachment(image.ID, "a/b", "", signature)
+	assert.Error(t, err)
+
+	all, err := s.ImageAttachments(image.ID, "")
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, ImageAttachmentSignature, all[0].Kind)
+	assert.Equal(t, ImageAttachmentSBOM, all[1].Kind)
+	assert.Equal(t, "application/spdx+json", all[1].MediaType)
+	signatures, err := s.ImageAttachments(image.ID, ImageAttachmentSignature)
+	require.NoError(t, err)
+	require.Len(t, signatures, 2)
+	assert.Equal(t, sig.Digest, signatures[0].Digest)
+	attestations, err := s.ImageAttachments(image.ID, ImageAttachmentAttestation)
+	require.NoError(t, err)
+	assert.Empty(t, attestations)
+
+	data, err := s.ImageAttachmentData(image.ID, ImageAttachmentSBOM, digest.FromBytes(sbom))
+	require.NoError(t, err)
+	assert.Equal(t, sbom, data)
+	_, err = s.ImageAttachmentData(image.ID, ImageAttachmentSBOM, sig.Digest)
+	assert.True(t, errors.Is(err, ErrAttachmentUnknown))
+
+	// The attachments are ordinary big data items.
+	names, err := s.ListImageBigData(image.ID)
+	require.NoError(t, err)
+	assert.Contains(t, names, sig.BigDataName)
+
+	require.NoError(t, s.RemoveImageAttachment(image.ID, ImageAttachmentSignature, sig.Digest))
+	err = s.RemoveImageAttachment(image.ID, ImageAttachmentSignature, sig.Digest)
+	assert.True(t, errors.Is(err, ErrAttachmentUnknown))
+	names, err = s.ListImageBigData(image.ID)
+	require.NoError(t, err)
+	assert.NotContains(t, names, sig.BigDataName)
+	_, err = s.ImageBigData(image.ID, sig.BigDataName)
+	assert.Error(t, err)
+
+	// The records are kept with the image.
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s2, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+	all, err = s2.ImageAttachments(image.ID, "")
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, ImageAttachmentSBOM, all[0].Kind)
+	assert.Equal(t, ImageAttachmentSignature, all[1].Kind)
+}
+
+func TestStoreImageStorePrioritiesAndMasks(t *testing.T) {
+	// Populate two additional image stores, each with an image using the
+	// same name.  Copies of the stores' contents are used, since this
+	// process already has read-write locks for the originals.
+	var sharedRoots, sharedImages, sharedLayers []string
+	for i := 0; i < 2; i++ {
+		shared := newTestStore(t)
+		layer, err := shared.CreateLayer("", "", nil, "", false, nil)
+		require.NoError(t, err)
+		image, err := shared.CreateImage("", []string{"shared"}, layer.ID, "", &ImageOptions{})
+		require.NoError(t, err)
+		sharedRoot := shared.GraphRoot() + "-shared"
+		require.NoError(t, exec.Command("cp", "-a", shared.GraphRoot(), sharedRoot).Run())
+		sharedRoots = append(sharedRoots, sharedRoot)
+		sharedImages = append(sharedImages, image.ID)
+		sharedLayers = append(sharedLayers, layer.ID)
+	}
+
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	s, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		GraphDriverOptions: []string{
+			"vfs.imagestore=" + sharedRoots[0],
+			"vfs.imagestore=" + sharedRoots[1],
+		},
+		ImageStorePriorities: map[string]int{sharedRoots[1]: 10},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	// The store with the higher priority is searched first.
+	image, err := s.Image("shared")
+	require.NoError(t, err)
+	assert.Equal(t, sharedImages[1], image.ID)
+	driver, err := s.GraphDriver()
+	require.NoError(t, err)
+	assert.Equal(t, []string{sharedRoots[1], sharedRoots[0]}, driver.AdditionalImageStores())
+	where, err := s.ResolveImageStore("shared")
+	require.NoError(t, err)
+	assert.Equal(t, sharedRoots[1], where)
+	where, err = s.ResolveImageStore(sharedImages[0])
+	require.NoError(t, err)
+	assert.Equal(t, sharedRoots[0], where)
+	where, err = s.ResolveLayerStore(sharedLayers[0])
+	require.NoError(t, err)
+	assert.Equal(t, sharedRoots[0], where)
+	local, err := s.CreateImage("", []string{"local"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+	where, err = s.ResolveImageStore(local.ID)
+	require.NoError(t, err)
+	assert.Equal(t, s.GraphRoot(), where)
+	_, err = s.ResolveImageStore("unknown")
+	assert.True(t, errors.Is(err, ErrImageUnknown))
+
+	// Masking an image hides it, and exposes the one which it shadowed,
+	// without modifying the store which contains it.
+	before, err := ioutil.ReadFile(filepath.Join(sharedRoots[1], "vfs-images", "images.json"))
+	require.NoError(t, err)
+	require.NoError(t, s.MaskImage("shared"))
+	image, err = s.Image("shared")
+	require.NoError(t, err)
+	assert.Equal(t, sharedImages[0], image.ID)
+	assert.False(t, s.Exists(sharedImages[1]))
+	images, err := s.Images()
+	require.NoError(t, err)
+	assert.Len(t, images, 2)
+	masked, err := s.MaskedImages()
+	require.NoError(t, err)
+	assert.Equal(t, []string{sharedImages[1]}, masked)
+	after, err := ioutil.ReadFile(filepath.Join(sharedRoots[1], "vfs-images", "images.json"))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// Images in the Store's own image store can't be masked.
+	assert.Error(t, s.MaskImage(local.ID))
+
+	require.NoError(t, s.UnmaskImage(sharedImages[1]))
+	assert.True(t, errors.Is(s.UnmaskImage(sharedImages[1]), ErrImageUnknown))
+	image, err = s.Image("shared")
+	require.NoError(t, err)
+	assert.Equal(t, sharedImages[1], image.ID)
+	masked, err = s.MaskedImages()
+	require.NoError(t, err)
+	assert.Empty(t, masked)
+}
+
+func TestStoreCachingStore(t *testing.T) {
+	backing := newTestStore(t)
+	cacheDir, err := ioutil.TempDir("", "testStorageCache")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(cacheDir) })
+	s, err := NewCachingStore(backing, CacheOptions{Directory: cacheDir})
+	require.NoError(t, err)
+	cache := s.(*cachingStore).cache
+
+	base, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, base)
+	require.NoError(t, err)
+	key := diffCacheKey(layer)
+	require.NotEmpty(t, key)
+	assert.FileExists(t, cache.entryPath(key), "diff was not written through to the cache")
+
+	// Diffs read from the cache match the ones read from the backing store.
+	for _, compression := range []archive.Compression{archive.Uncompressed, archive.Gzip} {
+		compression := compression
+		options := &DiffOptions{Compression: &compression}
+		expected, err := backing.Diff("", layer.ID, options)
+		require.NoError(t, err)
+		expectedBytes, err := ioutil.ReadAll(expected)
+		require.NoError(t, err)
+		expected.Close()
+		cached, err := s.Diff("", layer.ID, options)
+		require.NoError(t, err)
+		cachedBytes, err := ioutil.ReadAll(cached)
+		require.NoError(t, err)
+		cached.Close()
+		assert.Equal(t, expectedBytes, cachedBytes, "compression %s", compression.Extension())
+	}
+
+	// Reading a diff which isn't cached adds it to the cache.
+	require.NoError(t, os.Remove(cache.entryPath(key)))
+	rc, err := s.Diff("", layer.ID, nil)
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.FileExists(t, cache.entryPath(key), "diff was not cached when it was read")
+
+	// Read-only mounts of images use a read-only mount of a cached copy of
+	// their contents, which is shared by everyone who mounts them.
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	mountPoint, err := s.MountImage(image.ID, []string{"ro"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, cache.mountPath(imageCacheKey(image, "")), mountPoint)
+	assert.FileExists(t, filepath.Join(mountPoint, "base"))
+	assert.Error(t, ioutil.WriteFile(filepath.Join(mountPoint, "new"), nil, 0600), "cached image contents were writable")
+	mountPoint2, err := s.MountImage(image.ID, []string{"ro"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, mountPoint, mountPoint2)
+	stillMounted, err := s.UnmountImage(image.ID, false)
+	require.NoError(t, err)
+	assert.True(t, stillMounted)
+	assert.FileExists(t, filepath.Join(mountPoint, "base"), "image was unmounted while still in use")
+	stillMounted, err = s.UnmountImage(image.ID, false)
+	require.NoError(t, err)
+	assert.False(t, stillMounted)
+	assert.NoDirExists(t, mountPoint, "image was not unmounted")
+	assert.DirExists(t, cache.entryPath(imageCacheKey(image, "")), "unused image contents were evicted")
+	assert.NotEqual(t, imageCacheKey(image, ""), imageCacheKey(image, "system_u:object_r:container_file_t:s0:c1,c2"))
+
+	// When the cache is too large, the least recently used items which
+	// aren't in use are evicted.
+	mountPoint, err = s.MountImage(image.ID, []string{"ro"}, "")
+	require.NoError(t, err)
+	cache.maxSize = 1
+	upper, err := archive.Generate("upper", "upper")
+	require.NoError(t, err)
+	layer2, _, err := s.PutLayer("", layer.ID, nil, "", false, nil, upper)
+	require.NoError(t, err)
+	assert.NoFileExists(t, cache.entryPath(key), "unused diff was not evicted")
+	assert.NoFileExists(t, cache.entryPath(diffCacheKey(layer2)), "unused diff was not evicted")
+	assert.DirExists(t, cache.entryPath(imageCacheKey(image, "")), "mounted image contents were evicted")
+	_, err = s.UnmountImage(image.ID, false)
+	require.NoError(t, err)
+	assert.NoDirExists(t, mountPoint, "image was not unmounted")
+	assert.NoDirExists(t, cache.entryPath(imageCacheKey(image, "")), "unmounted image contents were not evicted")
+}
+
+func TestStoreShutdown(t *testing.T) {
+	s := newTestStore(t)
+	assert.False(t, s.ShutDownCleanly())
+
+	layer, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	_, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+
+	// Mounted layers are reported, and nothing is shut down.
+	mounted, err := s.Shutdown(false)
+	assert.True(t, errors.Is(err, ErrLayerUsedByContainer), "Shutdown: %v", err)
+	assert.Equal(t, []string{layer.ID}, mounted)
+	assert.NoFileExists(t, filepath.Join(s.GraphRoot(), "clean-shutdown"))
+
+	// All of a layer's mounts are removed when shutting down is forced,
+	// but while someone else is using the graph root, it isn't marked.
+	other, err := openUsersLock(filepath.Join(s.GraphRoot(), "users.lock"))
+	require.NoError(t, err)
+	mounted, err = s.Shutdown(true)
+	require.NoError(t, err)
+	assert.Empty(t, mounted)
+	count, err := s.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+	assert.NoFileExists(t, filepath.Join(s.GraphRoot(), "clean-shutdown"))
+	other.close()
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(s.GraphRoot(), "clean-shutdown"))
+
+	reopen := func() Store {
+		s.Free()
+		var err error
+		s, err = GetStore(StoreOptions{
+			RunRoot:         s.RunRoot(),
+			GraphRoot:       s.GraphRoot(),
+			GraphDriverName: "vfs",
+		})
+		require.NoError(t, err)
+		return s
+	}
+	// The next user of the store is told that it was shut down cleanly,
+	// but the one after that isn't, since the first one didn't shut down.
+	assert.True(t, reopen().ShutDownCleanly())
+	assert.False(t, reopen().ShutDownCleanly())
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+}
+
+func TestStoreDamagedRecords(t *testing.T) {
+	s := newTestStore(t)
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"image"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", []string{"container"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	// Save each of the files again, so that the versions which were
+	// replaced include what we created.
+	require.NoError(t, s.SetMetadata(layer.ID, "layer"))
+	require.NoError(t, s.SetMetadata(image.ID, "image"))
+	require.NoError(t, s.SetMetadata(container.ID, "container"))
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	// Simulate files which were torn by losing power while they were
+	// being written.
+	for _, name := range []string{"vfs-layers/layers.json", "vfs-images/images.json", "vfs-containers/containers.json"} {
+		path := filepath.Join(s.GraphRoot(), name)
+		require.FileExists(t, path+previousRecordsSuffix)
+		require.NoError(t, os.Truncate(path, 10))
+	}
+	// Anything other than whitespace after the records also means that a
+	// file is damaged.
+	path := filepath.Join(s.GraphRoot(), "vfs-containers/containers.json")
+	records, err := ioutil.ReadFile(path + previousRecordsSuffix)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, append(records, "]\n"...), 0600))
+
+	s2, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+	assert.True(t, s2.Exists(layer.ID))
+	assert.True(t, s2.Exists(image.ID))
+	assert.True(t, s2.Exists(container.ID))
+
+	// Saving again doesn't replace the intact previous versions with the
+	// damaged ones.
+	require.NoError(t, s2.SetMetadata(image.ID, "changed"))
+	metadata, err := s2.Metadata(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", metadata)
+	data, err := ioutil.ReadFile(filepath.Join(s.GraphRoot(), "vfs-images/images.json"+previousRecordsSuffix))
+	require.NoError(t, err)
+	assert.True(t, json.Valid(data))
+}
+
+func TestStoreCorruptRecords(t *testing.T) {
+	s := newTestStore(t)
+	_, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	// Without an intact previous version to fall back to, a damaged file
+	// can't be used.
+	path := filepath.Join(s.GraphRoot(), "vfs-layers/layers.json")
+	require.NoError(t, os.RemoveAll(path+previousRecordsSuffix))
+	require.NoError(t, ioutil.WriteFile(path, []byte("[{garbage"), 0600))
+
+	s2, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	if err == nil {
+		t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+		_, err = s2.Layers()
+	}
+	assert.True(t, errors.Is(err, ErrStoreCorrupt), "Layers: %v", err)
+}
+
+func TestWrapDriverError(t *testing.T) {
+	err := wrapDriverError(fmt.Errorf("looking up %q: %w", "layer", drivers.ErrLayerUnknown))
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "%v", err)
+	assert.True(t, errors.Is(err, drivers.ErrLayerUnknown), "%v", err)
+	err = wrapDriverInitError(fmt.Errorf("no kernel support: %w", drivers.ErrPrerequisites))
+	assert.True(t, errors.Is(err, ErrIncompatibleDriver), "%v", err)
+	assert.True(t, errors.Is(err, drivers.ErrPrerequisites), "%v", err)
+	assert.Nil(t, wrapDriverError(nil))
+}
+
+func TestStorePinning(t *testing.T) {
+	s := newTestStore(t)
+	base, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	top, err := s.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", []string{"image"}, top.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.PinImage("image"))
+	pinned, err := s.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, true, pinned.Flags[pinnedFlag])
+	_, err = s.DeleteImage(image.ID, true)
+	assert.True(t, errors.Is(err, ErrImagePinned), "DeleteImage: %v", err)
+	err = s.Delete(image.ID)
+	assert.True(t, errors.Is(err, ErrImagePinned), "Delete: %v", err)
+	require.NoError(t, s.UnpinImage(image.ID))
+
+	// Deleting the image keeps a pinned layer, and its parents.
+	require.NoError(t, s.PinLayer(base.ID))
+	removed, err := s.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{top.ID}, removed)
+	assert.True(t, s.Exists(base.ID))
+	err = s.DeleteLayer(base.ID)
+	assert.True(t, errors.Is(err, ErrLayerPinned), "DeleteLayer: %v", err)
+	err = s.Delete(base.ID)
+	assert.True(t, errors.Is(err, ErrLayerPinned), "Delete: %v", err)
+
+	require.NoError(t, s.UnpinLayer(base.ID))
+	require.NoError(t, s.DeleteLayer(base.ID))
+	assert.True(t, errors.Is(s.PinLayer(base.ID), ErrLayerUnknown))
+}
+
+func TestStoreSnapshotContainer(t *testing.T) {
+	s := newTestStore(t)
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// The vfs driver can't snapshot layers cheaply.
+	_, err = s.SnapshotContainer(container.ID, nil)
+	assert.True(t, errors.Is(err, ErrNotSupported), "SnapshotContainer: %v", err)
+	_, err = s.SnapshotContainer("no-such-container", nil)
+	assert.True(t, errors.Is(err, ErrContainerUnknown), "SnapshotContainer: %v", err)
+}
+
+func TestStoreResetContainerLayer(t *testing.T) {
+	s := newTestStore(t)
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	dir, err := s.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	err = s.ResetContainerLayer(container.ID, "")
+	assert.True(t, errors.Is(err, ErrLayerMounted), "ResetContainerLayer: %v", err)
+	_, err = s.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	// The vfs driver has to recreate the layer, but the container stays.
+	require.NoError(t, s.ResetContainerLayer(container.ID, ""))
+	dir, err = s.Mount(container.ID, "")
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "file"))
+	assert.True(t, os.IsNotExist(err), "expected the file to be gone: %v", err)
+	_, err = s.Unmount(container.ID, false)
+	require.NoError(t, err)
+	reset, err := s.Container(container.ID)
+	require.NoError(t, err)
+	assert.Equal(t, container.LayerID, reset.LayerID)
+	containerLayer, err := s.Layer(container.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, layer.ID, containerLayer.Parent)
+	// The new contents were swapped in, and nothing was left behind.
+	driver, err := s.GraphDriver()
+	require.NoError(t, err)
+	listed, err := driver.(drivers.LayerListerDriver).ListLayers()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{layer.ID, container.LayerID}, listed)
+
+	// Resetting to the image's top layer is fine, but other layers aren't
+	// snapshots of the container.
+	require.NoError(t, s.ResetContainerLayer(container.ID, layer.ID))
+	other, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	assert.Error(t, s.ResetContainerLayer(container.ID, other.ID))
+	err = s.ResetContainerLayer("no-such-container", "")
+	assert.True(t, errors.Is(err, ErrContainerUnknown), "ResetContainerLayer: %v", err)
+}
+
+func TestStoreHardlinkDedup(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	s, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "overlay",
+		HardlinkDedup:   true,
+	})
+	if err != nil {
+		t.Skipf("overlay isn't usable here: %v", err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	putLayer := func(files ...string) *Layer {
+		diff, err := archive.Generate(files...)
+		require.NoError(t, err)
+		layer, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+		require.NoError(t, err)
+		return layer
+	}
+	stat := func(layer *Layer, name string) os.FileInfo {
+		st, err := os.Stat(filepath.Join(s.GraphRoot(), "overlay", layer.ID, "diff", name))
+		require.NoError(t, err)
+		return st
+	}
+	first := putLayer("shared", "same contents", "unique", "first")
+	second := putLayer("shared", "same contents", "unique", "second")
+	assert.True(t, os.SameFile(stat(first, "shared"), stat(second, "shared")), "identical files should have been linked")
+	assert.False(t, os.SameFile(stat(first, "unique"), stat(second, "unique")), "different files should not have been linked")
+
+	// The layer's diff still looks the way it did when it was added.
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff("", second.ID, &DiffOptions{Compression: &uncompressed})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, second.UncompressedDigest, digest.FromBytes(data))
+
+	// Deleting the first layer leaves the second one's copy intact, and
+	// new layers can still share it.
+	require.NoError(t, s.DeleteLayer(first.ID))
+	index, err := ioutil.ReadFile(filepath.Join(s.GraphRoot(), "overlay-layers", dedupIndexFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(index), first.ID)
+	content, err := ioutil.ReadFile(filepath.Join(s.GraphRoot(), "overlay", second.ID, "diff", "shared"))
+	require.NoError(t, err)
+	assert.Equal(t, "same contents", string(content))
+	third := putLayer("shared", "same contents")
+	assert.True(t, os.SameFile(stat(second, "shared"), stat(third, "shared")), "identical files should have been linked")
+
+	// Files with different modification times aren't linked, since links
+	// would have to share one.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "shared", Size: int64(len("same contents")), ModTime: time.Unix(1000000000, 0)}))
+	_, err = tw.Write([]byte("same contents"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	fourth, _, err := s.PutLayer("", "", nil, "", false, nil, &buf)
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(stat(third, "shared"), stat(fourth, "shared")), "files with different modification times should not have been linked")
+	assert.Equal(t, int64(1000000000), stat(fourth, "shared").ModTime().Unix())
+}
+
+func TestStoreLayerImageStore(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	imageStore := filepath.Join(wd, "imagestore")
+	options := StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "overlay",
+		GraphDriverOptions: []string{"overlay.writable_imagestore=" + imageStore},
+	}
+	s, err := GetStore(options)
+	if err != nil {
+		t.Skipf("overlay isn't usable here: %v", err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	diff, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, &LayerOptions{ImageStore: imageStore}, diff)
+	require.NoError(t, err)
+	assert.Equal(t, imageStore, layer.ImageStore)
+	assert.FileExists(t, filepath.Join(imageStore, "overlay", layer.ID, "diff", "file"))
+	_, err = os.Stat(filepath.Join(s.GraphRoot(), "overlay", layer.ID))
+	assert.True(t, os.IsNotExist(err), "expected the layer to not be under the graph root: %v", err)
+
+	// Layers which are based on it find it.
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	dir, err := s.Mount(container.ID, "")
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "contents", string(content))
+	_, err = s.Unmount(container.ID, true)
+	require.NoError(t, err)
+	rc, err := s.Diff("", layer.ID, nil)
+	require.NoError(t, err)
+	rc.Close()
+
+	// Writeable layers, and unknown locations, aren't allowed.
+	_, err = s.CreateLayer("", "", nil, "", true, &LayerOptions{ImageStore: imageStore})
+	assert.Error(t, err)
+	_, err = s.CreateLayer("", "", nil, "", false, &LayerOptions{ImageStore: filepath.Join(wd, "elsewhere")})
+	assert.Error(t, err)
+
+	// Without the image store, the layer can't be used.
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+	options.GraphDriverOptions = nil
+	s, err = GetStore(options)
+	require.NoError(t, err)
+	_, err = s.Mount(container.ID, "")
+	assert.Error(t, err)
+	layers, err := s.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+
+	// The vfs driver doesn't have image stores.
+	vfs := newTestStore(t)
+	_, err = vfs.CreateLayer("", "", nil, "", false, &LayerOptions{ImageStore: imageStore})
+	assert.True(t, errors.Is(err, ErrNotSupported), "CreateLayer: %v", err)
+}
+
+func TestStoreApplyDirectory(t *testing.T) {
+	populate := func(t *testing.T) string {
+		dir, err := ioutil.TempDir("", "testApplyDirectory")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "subdir"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "subdir", "file"), []byte("contents"), 0644))
+		return dir
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		s := newTestStore(t)
+		layer, err := s.CreateLayer("", "", nil, "", false, nil)
+		require.NoError(t, err)
+		dir := populate(t)
+		size, err := s.ApplyDirectory(layer.ID, dir, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("contents")), size)
+		assert.FileExists(t, filepath.Join(dir, "subdir", "file"))
+
+		rc, err := s.Diff("", layer.ID, nil)
+		require.NoError(t, err)
+		found := false
+		tr := tar.NewReader(rc)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if hdr.Name == "subdir/file" {
+				found = true
+			}
+		}
+		rc.Close()
+		assert.True(t, found, "expected the layer's diff to include the file")
+
+		_, err = s.ApplyDirectory(layer.ID, filepath.Join(dir, "subdir", "file"), nil)
+		assert.Error(t, err)
+		_, err = s.ApplyDirectory("nonexistent", dir, nil)
+		assert.True(t, errors.Is(err, ErrLayerUnknown), "ApplyDirectory: %v", err)
+	})
+
+	t.Run("move", func(t *testing.T) {
+		wd, err := ioutil.TempDir("", "testStorageRuntime")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(wd) })
+		s, err := GetStore(StoreOptions{
+			RunRoot:         filepath.Join(wd, "run"),
+			GraphRoot:       filepath.Join(wd, "root"),
+			GraphDriverName: "overlay",
+		})
+		if err != nil {
+			t.Skipf("overlay isn't usable here: %v", err)
+		}
+		t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+		diff, err := archive.Generate("subdir/other", "other contents")
+		require.NoError(t, err)
+		layer, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+		require.NoError(t, err)
+		require.NotEmpty(t, layer.UncompressedDigest)
+		dir := populate(t)
+		_, err = s.ApplyDirectory(layer.ID, dir, &ApplyDirectoryOptions{Move: true})
+		require.NoError(t, err)
+
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+		for name, expected := range map[string]string{
+			"file":  "contents",
+			"other": "other contents",
+		} {
+			content, err := ioutil.ReadFile(filepath.Join(s.GraphRoot(), "overlay", layer.ID, "diff", "subdir", name))
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(content))
+		}
+		updated, err := s.Layer(layer.ID)
+		require.NoError(t, err)
+		assert.Empty(t, updated.UncompressedDigest)
+		assert.Equal(t, int64(len("contents")), updated.UncompressedSize)
+	})
+}
+
+func TestStoreMountWithAdditionalLowers(t *testing.T) {
+	extra, err := ioutil.TempDir("", "testAdditionalLowers")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(extra) })
+	require.NoError(t, ioutil.WriteFile(filepath.Join(extra, "extra"), []byte("extra"), 0644))
+	options := &MountOptions{AdditionalLowers: []string{extra}}
+
+	// The vfs driver can't do this.
+	vfs := newTestStore(t)
+	layer, err := vfs.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	_, err = vfs.MountWithOptions(layer.ID, options)
+	assert.True(t, errors.Is(err, ErrNotSupported), "MountWithOptions: %v", err)
+
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	s, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "overlay",
+	})
+	if err != nil {
+		t.Skipf("overlay isn't usable here: %v", err)
+	}
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	layer, err = s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	dir, err := s.MountWithOptions(layer.ID, options)
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "extra"))
+	require.NoError(t, err)
+	assert.Equal(t, "extra", string(content))
+
+	// The mount can only be shared by those who want the same lowers.
+	_, err = s.Mount(layer.ID, "")
+	assert.True(t, errors.Is(err, ErrLayerMountMismatch), "Mount: %v", err)
+	again, err := s.MountWithOptions(layer.ID, &MountOptions{AdditionalLowers: []string{extra}})
+	require.NoError(t, err)
+	assert.Equal(t, dir, again)
+	_, err = s.Unmount(layer.ID, true)
+	require.NoError(t, err)
+
+	dir, err = s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "extra"))
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+}
+
+func TestStoreArtifacts(t *testing.T) {
+	s := newTestStore(t)
+
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	artifact, err := s.CreateArtifact("", []string{"first"}, manifest, &ArtifactOptions{
+		MediaType:    "application/vnd.oci.image.manifest.v1+json",
+		ArtifactType: "application/example",
+		Annotations:  map[string]string{"a": "b"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(manifest), artifact.Digest)
+	assert.Equal(t, int64(len(manifest)), artifact.ManifestSize)
+	_, err = s.CreateArtifact("", []string{"first"}, manifest, nil)
+	assert.True(t, errors.Is(err, ErrDuplicateName), "CreateArtifact: %v", err)
+	other, err := s.CreateArtifact("", []string{"second"}, manifest, nil)
+	require.NoError(t, err)
+
+	content := []byte("blob content")
+	blob, err := s.PutArtifactBlob("first", "text/plain", bytes.NewReader(content), digest.FromBytes(content))
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(content), blob.Digest)
+	assert.Equal(t, int64(len(content)), blob.Size)
+	_, err = s.PutArtifactBlob("first", "", strings.NewReader("something else"), digest.FromBytes(content))
+	assert.True(t, errors.Is(err, ErrDigestMismatch), "PutArtifactBlob: %v", err)
+	_, err = s.PutArtifactBlob("second", "", bytes.NewReader(content), "")
+	require.NoError(t, err)
+	_, err = s.PutArtifactBlob("third", "", bytes.NewReader(content), "")
+	assert.True(t, errors.Is(err, ErrArtifactUnknown), "PutArtifactBlob: %v", err)
+
+	artifact, err = s.Artifact("first")
+	require.NoError(t, err)
+	require.Len(t, artifact.Blobs, 1)
+	assert.Equal(t, "text/plain", artifact.Blobs[0].MediaType)
+	assert.Equal(t, "b", artifact.Annotations["a"])
+
+	readBlob := func(id string, d digest.Digest) []byte {
+		rc, err := s.ArtifactBlob(id, d)
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return data
+	}
+	assert.Equal(t, manifest, readBlob(artifact.ID, artifact.Digest))
+	assert.Equal(t, content, readBlob(artifact.ID, blob.Digest))
+	_, err = s.ArtifactBlob(artifact.ID, digest.FromString("unknown"))
+	assert.True(t, errors.Is(err, ErrArtifactBlobUnknown), "ArtifactBlob: %v", err)
+
+	// Shared blobs are kept until the last artifact which refers to them
+	// is deleted.
+	require.NoError(t, s.DeleteArtifact("first"))
+	_, err = s.Artifact("first")
+	assert.True(t, errors.Is(err, ErrArtifactUnknown), "Artifact: %v", err)
+	assert.Equal(t, content, readBlob(other.ID, blob.Digest))
+
+	require.NoError(t, s.AddArtifactNames(other.ID, []string{"third"}))
+	require.NoError(t, s.RemoveArtifactNames(other.ID, []string{"second"}))
+	require.NoError(t, s.UpdateArtifactAnnotations(other.ID, map[string]string{"c": "d"}, nil))
+
+	// The records are kept across restarts.
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s2, err := GetStore(StoreOptions{
+		RunRoot:         s.RunRoot(),
+		GraphRoot:       s.GraphRoot(),
+		GraphDriverName: "vfs",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s2.Shutdown(true) })
+	artifacts, err := s2.Artifacts()
+	require.NoError(t, err)
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, other.ID, artifacts[0].ID)
+	assert.Equal(t, []string{"third"}, artifacts[0].Names)
+	assert.Equal(t, map[string]string{"c": "d"}, artifacts[0].Annotations)
+
+	require.NoError(t, s2.Wipe())
+	artifacts, err = s2.Artifacts()
+	require.NoError(t, err)
+	assert.Empty(t, artifacts)
+	blobs, err := ioutil.ReadDir(filepath.Join(s2.GraphRoot(), "artifacts", "blobs", "sha256"))
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+}
+
+func TestStoreLayerProvenance(t *testing.T) {
+	s := newTestStore(t)
+
+	provenance := &LayerProvenance{Source: "example.com/base:latest", Operation: "pull", Tool: "test"}
+	base, err := s.CreateLayer("", "", nil, "", false, &LayerOptions{Provenance: provenance})
+	require.NoError(t, err)
+	require.NotNil(t, base.Provenance)
+	assert.Equal(t, "example.com/base:latest", base.Provenance.Source)
+	assert.Equal(t, base.Created, base.Provenance.Created)
+	child, err := s.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	assert.Nil(t, child.Provenance)
+	image, err := s.CreateImage("", nil, child.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	layers, err := s.LayersBySource("example.com/base:latest")
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	assert.Equal(t, base.ID, layers[0].ID)
+	assert.Equal(t, "pull", layers[0].Provenance.Operation)
+	layers, err = s.LayersBySource("example.com/other:latest")
+	require.NoError(t, err)
+	assert.Empty(t, layers)
+
+	history, err := s.ImageHistory(image.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, base.ID, history[0].ID)
+	assert.Equal(t, "test", history[0].Provenance.Tool)
+	assert.Equal(t, child.ID, history[1].ID)
+	_, err = s.ImageHistory("unknown")
+	assert.True(t, errors.Is(err, ErrImageUnknown), "ImageHistory: %v", err)
+}
+
+func TestStoreComposefsDigests(t *testing.T) {
+	s := newTestStore(t)
+
+	diff, err := archive.Generate("base", "base")
+	require.NoError(t, err)
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	child, err := s.CreateLayer("", base.ID, nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, child.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	verity := digest.FromString("composefs image")
+	require.NoError(t, s.SetLayerComposefsDigest(base.ID, verity))
+	layer, err := s.Layer(base.ID)
+	require.NoError(t, err)
+	assert.Equal(t, verity, layer.ComposefsDigest)
+	assert.Error(t, s.SetLayerComposefsDigest(base.ID, "not-a-digest"))
+	err = s.SetLayerComposefsDigest("unknown", verity)
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "SetLayerComposefsDigest: %v", err)
+
+	digests, err := s.ImageVerityDigests(image.ID)
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+	assert.Equal(t, LayerVerityDigest{LayerID: base.ID, UncompressedDigest: base.UncompressedDigest, ComposefsDigest: verity}, digests[0])
+	assert.Equal(t, child.ID, digests[1].LayerID)
+	assert.Empty(t, digests[1].ComposefsDigest)
+
+	// Changing the layer's contents discards the digest.
+	diff, err = archive.Generate("changed", "changed")
+	require.NoError(t, err)
+	_, err = s.ApplyDiff(base.ID, diff)
+	require.NoError(t, err)
+	layer, err = s.Layer(base.ID)
+	require.NoError(t, err)
+	assert.Empty(t, layer.ComposefsDigest)
+}
+
+func TestStoreEncryptedLayers(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		EncryptionKeyID: "store",
+	}
+	_, err = GetStore(options)
+	assert.True(t, errors.Is(err, ErrIncompleteOptions), "GetStore: %v", err)
+
+	var requested []string
+	options.EncryptionKeyProvider = func(keyID string) ([]byte, error) {
+		requested = append(requested, keyID)
+		return bytes.Repeat([]byte(keyID[:1]), fscrypt.KeySize), nil
+	}
+	s, err := GetStore(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	base, err := s.CreateLayer("", "", nil, "", false, &LayerOptions{EncryptionKeyID: "image"})
+	if errors.Is(err, fscrypt.ErrNotSupported) {
+		assert.Equal(t, []string{"image"}, requested)
+		t.Skipf("encryption is not available here: %v", err)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, "image", base.EncryptionKeyID)
+	child, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "image", child.EncryptionKeyID)
+	other, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "store", other.EncryptionKeyID)
+	for _, layer := range []*Layer{base, child, other} {
+		dir, err := s.Mount(layer.ID, "")
+		require.NoError(t, err)
+		_, encrypted, err := fscrypt.Policy(dir)
+		require.NoError(t, err)
+		assert.True(t, encrypted, "expected the contents of layer %s to be encrypted", layer.ID)
+		_, err = s.Unmount(layer.ID, false)
+		require.NoError(t, err)
+	}
+}
+
+func TestStoreContainerRecordsLog(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	options := StoreOptions{
+		RunRoot:             filepath.Join(wd, "run"),
+		GraphRoot:           filepath.Join(wd, "root"),
+		GraphDriverName:     "vfs",
+		ContainerRecordsLog: true,
+	}
+	open := func(logged bool) Store {
+		options.ContainerRecordsLog = logged
+		s, err := GetStore(options)
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = s.Shutdown(true) })
+		return s
+	}
+	reopen := func(s Store, logged bool) Store {
+		_, err := s.Shutdown(true)
+		require.NoError(t, err)
+		s.Free()
+		return open(logged)
+	}
+	names := func(s Store) []string {
+		containers, err := s.Containers()
+		require.NoError(t, err)
+		var names []string
+		for _, container := range containers {
+			names = append(names, container.Names...)
+		}
+		return names
+	}
+	logpath := filepath.Join(options.GraphRoot, "vfs-containers", "containers.log")
+
+	s := open(true)
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	for _, name := range []string{"one", "two", "three"} {
+		_, err = s.CreateContainer("", []string{name}, image.ID, "", "", nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.DeleteContainer("two"))
+	require.NoError(t, s.AddNames("three", []string{"four"}))
+	assert.FileExists(t, logpath)
+
+	// Stores which don't log changes still read the log, and fold it
+	// into the list of containers when they save it.
+	s = reopen(s, false)
+	assert.ElementsMatch(t, []string{"one", "three", "four"}, names(s))
+	require.NoError(t, s.DeleteContainer("one"))
+	assert.NoFileExists(t, logpath)
+	assert.ElementsMatch(t, []string{"three", "four"}, names(s))
+
+	// Entries after a damaged one are ignored, and the log is folded into
+	// the list as soon as it can be.
+	s = reopen(s, true)
+	_, err = s.CreateContainer("", []string{"five"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	f, err := os.OpenFile(logpath, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString("{\"op\":\"put\",\"cont\n{\"op\":\"delete\",\"id\":\"x\"}\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s = reopen(s, true)
+	assert.ElementsMatch(t, []string{"three", "four", "five"}, names(s))
+	assert.NoFileExists(t, logpath)
+	_, err = s.CreateContainer("", []string{"six"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	assert.FileExists(t, logpath)
+	s = reopen(s, true)
+	assert.ElementsMatch(t, []string{"three", "four", "five", "six"}, names(s))
+
+	// A log which was started for a different version of containers.json,
+	// as it would be if containers.json was rewritten by a process which
+	// didn't know about the log, is discarded.
+	_, err = s.CreateContainer("", []string{"seven"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	assert.FileExists(t, logpath)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+	recordsPath := filepath.Join(options.GraphRoot, "vfs-containers", "containers.json")
+	data, err := ioutil.ReadFile(recordsPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(recordsPath, append(data, '\n'), 0600))
+	s = open(true)
+	assert.ElementsMatch(t, []string{"three", "four", "five"}, names(s))
+}
+
+func TestStoreChangesBetweenUnrelatedLayers(t *testing.T) {
+	store := newTestStore(t)
+
+	diff, err := archive.Generate("etc/hosts", "localhost", "etc/passwd", "root")
+	require.NoError(t, err)
+	base, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	diff, err = archive.Generate("etc/hosts", "localhost", "etc/passwd", "root\nuser", "etc/group", "root")
+	require.NoError(t, err)
+	other, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+
+	changes, err := store.Changes(base.ID, other.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []archive.Change{
+		{Path: "/etc", Kind: archive.ChangeModify},
+		{Path: "/etc/group", Kind: archive.ChangeAdd},
+		{Path: "/etc/passwd", Kind: archive.ChangeModify},
+	}, changes)
+
+	changes, err = store.Changes(other.ID, base.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []archive.Change{
+		{Path: "/etc", Kind: archive.ChangeModify},
+		{Path: "/etc/group", Kind: archive.ChangeDelete},
+		{Path: "/etc/passwd", Kind: archive.ChangeModify},
+	}, changes)
+
+	// The tarstream for the changes recreates the second layer's contents
+	// when it's applied to a copy of the first one.
+	rc, err := store.Diff(base.ID, other.ID, nil)
+	require.NoError(t, err)
+	delta, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	copied, err := store.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	_, err = store.ApplyDiff(copied.ID, bytes.NewReader(delta))
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(copied.ID, "")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadFile(filepath.Join(mountPoint, "etc", "passwd"))
+	require.NoError(t, err)
+	assert.Equal(t, "root\nuser", string(contents))
+	assert.FileExists(t, filepath.Join(mountPoint, "etc", "group"))
+	_, err = store.Unmount(copied.ID, true)
+	require.NoError(t, err)
+
+	// A reference layer which we don't know about is replaced with the
+	// layer's parent, as it always has been.
+	changes, err = store.Changes("no-such-layer", copied.ID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []archive.Change{
+		{Path: "/etc", Kind: archive.ChangeModify},
+		{Path: "/etc/group", Kind: archive.ChangeAdd},
+		{Path: "/etc/passwd", Kind: archive.ChangeModify},
+	}, changes)
+}
+
+func TestStoreDriverCapabilities(t *testing.T) {
+	store := newTestStore(t)
+
+	capabilities, err := store.DriverCapabilities()
+	require.NoError(t, err)
+	// vfs copies the contents of parent layers into new layers.
+	assert.False(t, capabilities.Snapshots)
+	assert.False(t, capabilities.NativeDiff)
+	assert.False(t, capabilities.Quota)
+	assert.Zero(t, capabilities.MaxLowers)
+	assert.Empty(t, capabilities.WhiteoutFormat)
+}
+
+func TestStorePutLayerWithTarSplit(t *testing.T) {
+	store := newTestStore(t)
+
+	diff, err := archive.Generate("etc/hosts", "localhost", "etc/passwd", "root")
+	require.NoError(t, err)
+	original, err := ioutil.ReadAll(diff)
+	require.NoError(t, err)
+
+	// Generate the tar-split data the way that a caller which was reading
+	// the diff might.
+	var tarSplit bytes.Buffer
+	stream, err := asm.NewInputTarStream(bytes.NewReader(original), tsstorage.NewJSONPacker(&tarSplit), tsstorage.NewDiscardFilePutter())
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, stream)
+	require.NoError(t, err)
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, &LayerOptions{TarSplit: tarSplit.Bytes()}, bytes.NewReader(original))
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromBytes(original), layer.UncompressedDigest)
+	assert.Equal(t, int64(len(original)), layer.UncompressedSize)
+
+	// The saved tar-split data is used to reproduce the diff.
+	uncompressed := archive.Uncompressed
+	rc, err := store.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	require.NoError(t, err)
+	reassembled, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, original, reassembled)
+
+	// Tar-split data which doesn't describe the diff is rejected.
+	diff, err = archive.Generate("etc/hosts", "localhost, but longer")
+	require.NoError(t, err)
+	_, _, err = store.PutLayer("", "", nil, "", false, &LayerOptions{TarSplit: tarSplit.Bytes()}, diff)
+	assert.Error(t, err)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+
+	// Even if it describes a diff of the same length.
+	tamper := func(mode int64) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: mode, Size: 4}))
+		_, err := tw.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		return buf.Bytes()
+	}
+	tarSplit.Reset()
+	stream, err = asm.NewInputTarStream(bytes.NewReader(tamper(0644)), tsstorage.NewJSONPacker(&tarSplit), tsstorage.NewDiscardFilePutter())
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, stream)
+	require.NoError(t, err)
+	_, _, err = store.PutLayer("", "", nil, "", false, &LayerOptions{TarSplit: tarSplit.Bytes()}, bytes.NewReader(tamper(0755)))
+	assert.True(t, errors.Is(err, ErrDigestMismatch), "expected a digest mismatch, got %v", err)
+	layers, err = store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+}
+
+func TestStoreSparseDiff(t *testing.T) {
+	store := newTestStore(t)
+
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	f, err := os.Create(filepath.Join(mountPoint, "sparse"))
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("data"), 1024)
+	_, err = f.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4<<20))
+	require.NoError(t, f.Close())
+	expected, err := ioutil.ReadFile(filepath.Join(mountPoint, "sparse"))
+	require.NoError(t, err)
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+
+	uncompressed := archive.Uncompressed
+	readDiff := func(id string, options *DiffOptions) []byte {
+		options.Compression = &uncompressed
+		rc, err := store.Diff("", id, options)
+		require.NoError(t, err)
+		diff, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		return diff
+	}
+	readFile := func(diff []byte) (contents []byte, sparse bool) {
+		tr := tar.NewReader(bytes.NewReader(diff))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if hdr.Name == "sparse" {
+				contents, err = ioutil.ReadAll(tr)
+				require.NoError(t, err)
+				sparse = hdr.PAXRecords["GNU.sparse.major"] != ""
+			}
+		}
+		return contents, sparse
+	}
+
+	contents, sparse := readFile(readDiff(layer.ID, &DiffOptions{}))
+	assert.Equal(t, expected, contents)
+	assert.False(t, sparse, "sparse entries should only be used when asked for")
+
+	diff := readDiff(layer.ID, &DiffOptions{Sparse: true})
+	contents, sparse = readFile(diff)
+	if !sparse {
+		t.Skip("filesystem doesn't support sparse files")
+	}
+	assert.Equal(t, expected, contents)
+	assert.Less(t, len(diff), 64<<10, "holes should not have been stored in the diff")
+
+	// A layer created from a diff with sparse entries doesn't keep
+	// tar-split data, which couldn't reproduce them, so its diffs are
+	// generated from its contents.
+	copied, _, err := store.PutLayer("", "", nil, "", false, nil, bytes.NewReader(diff))
+	require.NoError(t, err)
+	contents, sparse = readFile(readDiff(copied.ID, &DiffOptions{}))
+	assert.Equal(t, expected, contents)
+	assert.False(t, sparse)
+	contents, sparse = readFile(readDiff(copied.ID, &DiffOptions{Sparse: true}))
+	assert.Equal(t, expected, contents)
+	assert.True(t, sparse, "the layer's copy of the file should have kept its holes")
+}
+
+func TestStoreTrackLayerChanges(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	s, err := GetStore(StoreOptions{
+		RunRoot:           filepath.Join(wd, "run"),
+		GraphRoot:         filepath.Join(wd, "root"),
+		GraphDriverName:   "vfs",
+		TrackLayerChanges: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	diff, err := archive.Generate("etc/hosts", "localhost", "etc/passwd", "root", "usr/bin/true", "")
+	require.NoError(t, err)
+	base, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	layer, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	journalPath := filepath.Join(s.GraphRoot(), "vfs-layers", layer.ID+changeJournalSuffix)
+	require.FileExists(t, journalPath)
+
+	mountpoint, err := s.Mount(layer.ID, "")
+	require.NoError(t, err)
+	if _, err := os.Stat(journalPath); err != nil {
+		_, _ = s.Unmount(layer.ID, true)
+		t.Skipf("changes can't be tracked here")
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountpoint, "etc", "hosts"), []byte("127.0.0.1 localhost"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(mountpoint, "etc", "passwd")))
+	require.NoError(t, os.MkdirAll(filepath.Join(mountpoint, "tmp", "new"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountpoint, "tmp", "new", "file"), []byte("new"), 0644))
+	_, err = s.Unmount(layer.ID, false)
+	require.NoError(t, err)
+
+	// Modify the layer without tracking the change, so that we can tell
+	// that the journal was used instead of comparing the layer's contents
+	// to its parent's.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountpoint, "untracked"), []byte("untracked"), 0644))
+
+	expected := []archive.Change{
+		{Path: "/etc", Kind: archive.ChangeModify},
+		{Path: "/etc/hosts", Kind: archive.ChangeModify},
+		{Path: "/etc/passwd", Kind: archive.ChangeDelete},
+		{Path: "/tmp", Kind: archive.ChangeAdd},
+		{Path: "/tmp/new", Kind: archive.ChangeAdd},
+		{Path: "/tmp/new/file", Kind: archive.ChangeAdd},
+	}
+	changes, err := s.Changes("", layer.ID)
+	require.NoError(t, err)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	assert.Equal(t, expected, changes)
+
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	require.NoError(t, err)
+	var names []string
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	rc.Close()
+	assert.Equal(t, []string{"etc/", "etc/hosts", "etc/.wh.passwd", "tmp/", "tmp/new/", "tmp/new/file"}, names)
+
+	// Once the layer's modified in a way that we can't keep track of,
+	// its journal is discarded, and we compare it to its parent.
+	diff, err = archive.Generate("applied", "applied")
+	require.NoError(t, err)
+	_, err = s.ApplyDiff(layer.ID, diff)
+	require.NoError(t, err)
+	assert.NoFileExists(t, journalPath)
+	changes, err = s.Changes("", layer.ID)
+	require.NoError(t, err)
+	assert.Len(t, changes, len(expected)+2)
+
+	// The same goes for populating a layer from a directory.
+	other, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	otherJournalPath := filepath.Join(s.GraphRoot(), "vfs-layers", other.ID+changeJournalSuffix)
+	require.FileExists(t, otherJournalPath)
+	dir := filepath.Join(wd, "dir")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "applied"), []byte("applied"), 0644))
+	_, err = s.ApplyDirectory(other.ID, dir, nil)
+	require.NoError(t, err)
+	assert.NoFileExists(t, otherJournalPath)
+}
+
+func TestStoreIDGenerator(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	open := func(dir string) Store {
+		s, err := GetStore(StoreOptions{
+			RunRoot:         filepath.Join(wd, dir, "run"),
+			GraphRoot:       filepath.Join(wd, dir, "root"),
+			GraphDriverName: "vfs",
+			IDGenerator:     stringid.NewSequentialGenerator("test"),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = s.Shutdown(true) })
+		return s
+	}
+	populate := func(s Store) []string {
+		layer, err := s.CreateLayer("", "", nil, "", false, nil)
+		require.NoError(t, err)
+		image, err := s.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+		require.NoError(t, err)
+		container, err := s.CreateContainer("", nil, image.ID, "", "", nil)
+		require.NoError(t, err)
+		artifact, err := s.CreateArtifact("", nil, []byte("{}"), nil)
+		require.NoError(t, err)
+		return []string{layer.ID, image.ID, container.ID, container.LayerID, artifact.ID}
+	}
+
+	// Stores which use generators with the same seed assign the same IDs.
+	first, second := open("first"), open("second")
+	ids := populate(first)
+	assert.Equal(t, ids, populate(second))
+	for _, id := range ids {
+		assert.NoError(t, stringid.ValidateID(id))
+	}
+
+	// IDs which are already in use by other layers are skipped.
+	_, err = first.Shutdown(true)
+	require.NoError(t, err)
+	first.Free()
+	reopened := open("first")
+	layer, err := reopened.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, ids[0], layer.ID)
+	assert.NotEqual(t, ids[3], layer.ID)
+
+	// IDs which callers supply are checked.
+	_, err = reopened.CreateLayer(ids[0], "", nil, "", false, nil)
+	assert.True(t, errors.Is(err, ErrDuplicateID))
+	for _, id := range []string{".", "..", "../escape", "with/slash"} {
+		_, err = reopened.CreateLayer(id, "", nil, "", false, nil)
+		assert.Truef(t, errors.Is(err, ErrInvalidID), "layer ID %q", id)
+		_, err = reopened.CreateImage(id, nil, layer.ID, "", &ImageOptions{})
+		assert.Truef(t, errors.Is(err, ErrInvalidID), "image ID %q", id)
+		_, err = reopened.CreateContainer(id, nil, "", "", "", nil)
+		assert.Truef(t, errors.Is(err, ErrInvalidID), "container ID %q", id)
+	}
+	mirrored := strings.Repeat("5", 64)
+	layer, err = reopened.CreateLayer(mirrored, "", nil, "", false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, mirrored, layer.ID)
+}
+
+func TestStoreReservedSpace(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+	}
+	s, err := GetStore(options)
+	require.NoError(t, err)
+	empty, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	// Ask for more free space than any filesystem we'll be tested on has.
+	options.ReservedSpace = 1 << 60
+	s, err = GetStore(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = s.Shutdown(true) })
+
+	_, err = s.CreateLayer("", "", nil, "", false, nil)
+	assert.True(t, errors.Is(err, ErrNoSpace), "CreateLayer: %v", err)
+	var noSpace *NoSpaceError
+	if assert.True(t, errors.As(err, &noSpace)) {
+		assert.Equal(t, int64(1<<60), noSpace.Reserved)
+	}
+
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	_, _, err = s.PutLayer("", "", []string{"no-space"}, "", false, nil, diff)
+	assert.True(t, errors.Is(err, ErrNoSpace), "PutLayer: %v", err)
+	_, err = s.Layer("no-space")
+	assert.True(t, errors.Is(err, ErrLayerUnknown))
+
+	diff, err = archive.Generate("file", "content")
+	require.NoError(t, err)
+	_, err = s.ApplyDiff(empty.ID, diff)
+	assert.True(t, errors.Is(err, ErrNoSpace), "ApplyDiff: %v", err)
+	layer, err := s.Layer(empty.ID)
+	require.NoError(t, err)
+	assert.Empty(t, layer.UncompressedDigest)
+	mountPoint, err := s.Mount(empty.ID, "")
+	require.NoError(t, err)
+	entries, err := ioutil.ReadDir(mountPoint)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = s.Unmount(empty.ID, false)
+	require.NoError(t, err)
+}
+
+func TestStoreDigestAlgorithm(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	options := StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "vfs",
+		DigestAlgorithm: "sha512",
+	}
+	s, err := GetStore(options)
+	require.NoError(t, err)
+	assert.Equal(t, digest.SHA512, s.DigestAlgorithm())
+
+	var buf bytes.Buffer
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, io.TeeReader(diff, &buf))
+	require.NoError(t, err)
+	assert.Equal(t, digest.Canonical.FromBytes(buf.Bytes()), layer.UncompressedDigest)
+	assert.Equal(t, []digest.Digest{digest.SHA512.FromBytes(buf.Bytes())}, layer.AdditionalUncompressedDigests)
+	assert.Equal(t, digest.Canonical.FromBytes(buf.Bytes()), layer.CompressedDigest)
+	for _, d := range []digest.Digest{layer.UncompressedDigest, layer.AdditionalUncompressedDigests[0]} {
+		layers, err := s.LayersByUncompressedDigest(d)
+		require.NoError(t, err)
+		require.Len(t, layers, 1)
+		assert.Equal(t, layer.ID, layers[0].ID)
+	}
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	// The store keeps using the algorithm which it was created with.
+	options.DigestAlgorithm = ""
+	s, err = GetStore(options)
+	require.NoError(t, err)
+	assert.Equal(t, digest.SHA512, s.DigestAlgorithm())
+	_, err = s.Shutdown(true)
+	require.NoError(t, err)
+	s.Free()
+
+	// A store which already has layers isn't switched to another one.
+	other := newTestStore(t)
+	diff, err = archive.Generate("file", "content")
+	require.NoError(t, err)
+	_, _, err = other.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	_, err = other.Shutdown(true)
+	require.NoError(t, err)
+	other.Free()
+	other, err = GetStore(StoreOptions{
+		RunRoot:         other.RunRoot(),
+		GraphRoot:       other.GraphRoot(),
+		GraphDriverName: "vfs",
+		DigestAlgorithm: "sha384",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, digest.Canonical, other.DigestAlgorithm())
+	_, err = other.Shutdown(true)
+	require.NoError(t, err)
+
+	options.GraphRoot = filepath.Join(wd, "unavailable")
+	options.DigestAlgorithm = "blake3"
+	_, err = GetStore(options)
+	assert.True(t, errors.Is(err, ErrNotSupported), "GetStore: %v", err)
+}
+
+func TestStoreMountRelabel(t *testing.T) {
+	store := newTestStore(t)
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+
+	_, err = store.MountWithOptions(layer.ID, &MountOptions{Relabel: "sometimes"})
+	assert.Error(t, err, "MountWithOptions with an unknown relabeling policy")
+
+	const mountLabel = "system_u:object_r:container_file_t:s0:c1,c2"
+	dir, err := store.MountWithOptions(layer.ID, &MountOptions{MountLabel: mountLabel, Relabel: "private"})
+	require.NoError(t, err)
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+
+	// The label is only recorded if it was actually applied.
+	layer, err = store.Layer(layer.ID)
+	require.NoError(t, err)
+	if !selinux.GetEnabled() {
+		assert.Empty(t, layer.RelabeledMountLabel)
+		return
+	}
+	assert.Equal(t, mountLabel, layer.RelabeledMountLabel)
+	assert.False(t, layer.RelabeledShared)
+	fileLabel, err := selinux.FileLabel(dir)
+	require.NoError(t, err)
+	assert.Equal(t, mountLabel, fileLabel)
+}
+
+func TestStoreApplyDiffForgetsRelabeling(t *testing.T) {
+	s := newTestStore(t)
+	layer, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+
+	// Pretend that the layer's contents were relabeled when it was
+	// mounted.
+	lstore, err := s.(*store).LayerStore()
+	require.NoError(t, err)
+	rlstore := lstore.(*layerStore)
+	rlstore.Lock()
+	record, ok := rlstore.lookup(layer.ID)
+	require.True(t, ok)
+	record.RelabeledMountLabel = "system_u:object_r:container_file_t:s0"
+	record.RelabeledShared = true
+	require.NoError(t, rlstore.Save())
+	rlstore.Unlock()
+
+	// New contents haven't been relabeled, so they have to be the next
+	// time the layer is mounted.
+	diff, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	_, err = s.ApplyDiff(layer.ID, diff)
+	require.NoError(t, err)
+	layer, err = s.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.Empty(t, layer.RelabeledMountLabel)
+	assert.False(t, layer.RelabeledShared)
+}
+
+func TestCreateUserDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testCreateUserDir")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	owner := idtools.IDPair{UID: os.Getuid(), GID: os.Getgid()}
+	require.NoError(t, createUserDir(filepath.Join(dir, "a", "b"), owner))
+	st, err := os.Stat(filepath.Join(dir, "a", "b"))
+	require.NoError(t, err)
+	assert.True(t, st.IsDir())
+
+	// Nothing should be created for someone else in a directory which
+	// they don't own.
+	other := idtools.IDPair{UID: os.Getuid() + 1, GID: os.Getgid() + 1}
+	assert.Error(t, createUserDir(filepath.Join(dir, "c"), other))
+	_, err = os.Stat(filepath.Join(dir, "c"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreTempDir(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	// /dev/shm is usually on a different file system, which forces big
+	// data items to be copied into place instead of being renamed.
+	tempDir, err := ioutil.TempDir("/dev/shm", "testStorageTemp")
+	if err != nil {
+		tempDir = filepath.Join(wd, "temp")
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	store, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		TempDir:            tempDir,
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = store.Shutdown(true) })
+	assert.Equal(t, tempDir, store.TempDir())
+
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+
+	contents := []byte("written somewhere else first")
+	require.NoError(t, store.SetImageBigData(image.ID, "blob", contents, nil))
+	data, err := store.ImageBigData(image.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, contents, data)
+	require.NoError(t, store.SetContainerBigData(container.ID, "blob", contents))
+	data, err = store.ContainerBigData(container.ID, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, contents, data)
+	require.NoError(t, store.SetLayerBigData(layer.ID, "blob", bytes.NewReader(contents)))
+	rc, err := store.LayerBigData(layer.ID, "blob")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, contents, data)
+
+	entries, err := ioutil.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Without the option, temporary files are kept under the graph root.
+	defaultStore := newTestStore(t)
+	assert.Equal(t, filepath.Join(defaultStore.GraphRoot(), "tmp"), defaultStore.TempDir())
+}
+
+func TestStoreMoveContainerLayer(t *testing.T) {
+	src := newTestStore(t)
+	dest := newTestStore(t)
+
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	layer, _, err := src.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	image, err := src.CreateImage("", []string{"move-image"}, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := src.CreateContainer("", []string{"move-container"}, image.ID, "", "container metadata", nil)
+	require.NoError(t, err)
+	require.NoError(t, src.SetContainerBigData(container.ID, "state", []byte("state")))
+
+	mountPoint, err := src.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "written"), []byte("written"), 0644))
+
+	// A mounted container can't be moved.
+	_, err = src.MoveContainerLayer(container.ID, dest)
+	assert.True(t, errors.Is(err, ErrLayerMounted))
+	_, err = src.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	moved, err := src.MoveContainerLayer("move-container", dest)
+	require.NoError(t, err)
+	assert.Equal(t, container.ID, moved.ID)
+	assert.Equal(t, container.Names, moved.Names)
+	assert.Equal(t, container.LayerID, moved.LayerID)
+	assert.Equal(t, "container metadata", moved.Metadata)
+	data, err := dest.ContainerBigData(container.ID, "state")
+	require.NoError(t, err)
+	assert.Equal(t, "state", string(data))
+	_, err = dest.Image("move-image")
+	assert.NoError(t, err)
+
+	mountPoint, err = dest.Mount(container.ID, "")
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(mountPoint, "written"))
+	require.NoError(t, err)
+	assert.Equal(t, "written", string(data))
+	_, err = dest.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	// The container is gone from the original store, but its image isn't.
+	_, err = src.Container(container.ID)
+	assert.True(t, errors.Is(err, ErrContainerUnknown))
+	_, err = src.Layer(container.LayerID)
+	assert.True(t, errors.Is(err, ErrLayerUnknown))
+	_, err = src.Image(image.ID)
+	assert.NoError(t, err)
+
+	_, err = dest.MoveContainerLayer(container.ID, dest)
+	assert.Error(t, err)
+}
+
+func TestStoreConvertDriver(t *testing.T) {
+	src := newTestStore(t)
+
+	diff, err := archive.Generate("file", "content")
+	require.NoError(t, err)
+	layer, _, err := src.PutLayer("", "", []string{"base-layer"}, "", false, nil, diff)
+	require.NoError(t, err)
+	image, err := src.CreateImage("", []string{"convert-image"}, layer.ID, "image metadata", &ImageOptions{})
+	require.NoError(t, err)
+	require.NoError(t, src.SetImageBigData(image.ID, "config", []byte("config"), nil))
+	container, err := src.CreateContainer("", []string{"convert-container"}, image.ID, "", "", nil)
+	require.NoError(t, err)
+	mountPoint, err := src.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "written"), []byte("written"), 0644))
+	_, err = src.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	_, err = src.ConvertDriver("vfs", nil)
+	assert.Error(t, err)
+
+	// Pretend that an earlier attempt converted the base layer.
+	dest, err := GetStore(StoreOptions{
+		RunRoot:         src.RunRoot(),
+		GraphRoot:       src.GraphRoot(),
+		GraphDriverName: "overlay",
+	})
+	if err != nil {
+		t.Skipf("overlay driver can't be used here: %v", err)
+	}
+	_, err = src.TransferLayer(layer.ID, dest, nil)
+	require.NoError(t, err)
+
+	var progress []ConvertDriverProgress
+	converted, err := src.ConvertDriver("overlay", &ConvertDriverOptions{
+		Progress:     func(p ConvertDriverProgress) { progress = append(progress, p) },
+		RemoveSource: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = converted.Shutdown(true) })
+	assert.Equal(t, "overlay", converted.GraphDriverName())
+	require.Len(t, progress, 4)
+	assert.Equal(t, ConvertDriverProgress{Kind: "container", ID: container.ID, Completed: 4, Total: 4}, progress[3])
+
+	convertedImage, err := converted.Image("convert-image")
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, convertedImage.ID)
+	assert.Equal(t, "image metadata", convertedImage.Metadata)
+	data, err := converted.ImageBigData(image.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, "config", string(data))
+	_, err = converted.Layer("base-layer")
+	assert.NoError(t, err)
+	mountPoint, err = converted.Mount("convert-container", "")
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(mountPoint, "written"))
+	require.NoError(t, err)
+	assert.Equal(t, "written", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(mountPoint, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	_, err = converted.Unmount("convert-container", false)
+	require.NoError(t, err)
+
+	// The original driver's copies were removed.
+	layers, err := src.Layers()
+	require.NoError(t, err)
+	assert.Empty(t, layers)
+}
+
+func TestStoreReconcileMounts(t *testing.T) {
+	reopenLayers := func(st Store) LayerStore {
+		s := st.(*store)
+		driver, err := s.GraphDriver()
+		require.NoError(t, err)
+		prefix := s.graphDriverName + "-"
+		layers, err := s.newLayerStore(filepath.Join(s.runRoot, prefix+"layers"), filepath.Join(s.graphRoot, prefix+"layers"), driver)
+		require.NoError(t, err)
+		return layers
+	}
+	mountsFile := func(store Store) string {
+		return filepath.Join(store.RunRoot(), store.GraphDriverName()+"-layers", "mountpoints.json")
+	}
+
+	// A layer which was mounted by a process which went away, and which
+	// isn't mounted any more, is no longer recorded as mounted.
+	store := newTestStore(t)
+	layer, _, err := store.PutLayer("", "", nil, "", true, nil, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	crashed := fmt.Sprintf(`[{"id":%q,"path":%q,"count":2,"holders":{"%d":2}}]`, layer.ID, mountPoint, exited.Process.Pid)
+	require.NoError(t, ioutil.WriteFile(mountsFile(store), []byte(crashed), 0600))
+	count, err := reopenLayers(store).Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = store.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// Unless it was mounted in a different mount namespace, where we
+	// can't check whether or not it's still mounted.
+	mountPoint, err = store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	elsewhere := fmt.Sprintf(`[{"id":%q,"path":%q,"count":2,"holders":{"%d":2},"mount-namespace":"mnt:[0]"}]`, layer.ID, mountPoint, exited.Process.Pid)
+	require.NoError(t, ioutil.WriteFile(mountsFile(store), []byte(elsewhere), 0600))
+	count, err = reopenLayers(store).Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	if namespace := currentMountNamespace(); namespace != "" {
+		here := fmt.Sprintf(`[{"id":%q,"path":%q,"count":2,"holders":{"%d":2},"mount-namespace":%q}]`, layer.ID, mountPoint, exited.Process.Pid, namespace)
+		require.NoError(t, ioutil.WriteFile(mountsFile(store), []byte(here), 0600))
+		count, err = reopenLayers(store).Mounted(layer.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+	}
+	require.NoError(t, ioutil.WriteFile(mountsFile(store), []byte("[]"), 0600))
+
+	// A layer which is still mounted, but which we've lost track of, is
+	// recorded as being mounted, so that it can be unmounted.
+	wd, err := ioutil.TempDir("", "testStorageReconcile")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+	overlayStore, err := GetStore(StoreOptions{
+		RunRoot:         filepath.Join(wd, "run"),
+		GraphRoot:       filepath.Join(wd, "root"),
+		GraphDriverName: "overlay",
+	})
+	if err != nil {
+		t.Skipf("overlay driver can't be used here: %v", err)
+	}
+	t.Cleanup(func() { _, _ = overlayStore.Shutdown(true) })
+	layer, _, err = overlayStore.PutLayer("", "", nil, "", true, nil, nil)
+	require.NoError(t, err)
+	mountPoint, err = overlayStore.Mount(layer.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(mountsFile(overlayStore), []byte("[]"), 0600))
+	layers := reopenLayers(overlayStore)
+	count, err = layers.Mounted(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	stillMounted, err := layers.Unmount(layer.ID, false)
+	require.NoError(t, err)
+	assert.False(t, stillMounted)
+	mounts, err := mount.GetMounts()
+	require.NoError(t, err)
+	for _, m := range mounts {
+		assert.NotEqual(t, mountPoint, m.Mountpoint)
+	}
+}
+
+func TestStoreCheckLeakedMount(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root required")
+	}
+	store := newTestStore(t)
+	layer, _, err := store.PutLayer("", "", nil, "", true, nil, nil)
+	require.NoError(t, err)
+	_, err = store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	defer func() { _, _ = store.Unmount(layer.ID, true) }()
+
+	leak := filepath.Join(store.GraphRoot(), store.GraphDriverName(), "leaked")
+	require.NoError(t, os.MkdirAll(leak, 0700))
+	if err := mount.Mount("tmpfs", leak, "tmpfs", ""); err != nil {
+		t.Skipf("unable to mount a tmpfs: %v", err)
+	}
+	defer func() { _ = mount.Unmount(leak) }()
+
+	report, err := store.Check(nil)
+	require.NoError(t, err)
+	var leaked []string
+	for _, problem := range report.Problems {
+		if problem.Kind == CheckLeakedMount {
+			leaked = append(leaked, problem.ID)
+		}
+	}
+	assert.Equal(t, []string{leak}, leaked)
+
+	report, err = store.Check(&CheckOptions{Repair: true})
+	require.NoError(t, err)
+	for _, problem := range report.Problems {
+		if problem.Kind == CheckLeakedMount {
+			assert.True(t, problem.Fixed, problem.String())
+		}
+	}
+	mounted, err := mount.Mounted(leak)
+	require.NoError(t, err)
+	assert.False(t, mounted)
+}
+
+// testBigDataProvider is an ImageBigDataProvider which serves items from a
+// map, and counts how many times it has been asked for them.
+type testBigDataProvider struct {
+	items   map[string][]byte
+	fetched int
+}
+
+func (p *testBigDataProvider) FetchImageBigData(id string, names []string, key string) ([]byte, error) {
+	p.fetched++
+	data, ok := p.items[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func TestStoreImageBigDataProvider(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+
+	provider := &testBigDataProvider{items: map[string][]byte{
+		"config":  []byte("fetched config"),
+		"corrupt": []byte("not what was recorded"),
+	}}
+	st, err := GetStore(StoreOptions{
+		RunRoot:              filepath.Join(wd, "run"),
+		GraphRoot:            filepath.Join(wd, "root"),
+		GraphDriverName:      "vfs",
+		GraphDriverOptions:   []string{},
+		ImageBigDataProvider: provider,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = st.Shutdown(true) })
+
+	image, err := st.CreateImage("", []string{"example.com/thin:latest"}, "", "", &ImageOptions{})
+	require.NoError(t, err)
+
+	// Items which are missing are fetched once, and then kept.
+	data, err := st.ImageBigData(image.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("fetched config"), data)
+	assert.Equal(t, 1, provider.fetched)
+	rc, err := st.ImageBigDataReader(image.ID, "config")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("fetched config"), data)
+	assert.Equal(t, 1, provider.fetched)
+	names, err := st.ListImageBigData(image.ID)
+	require.NoError(t, err)
+	assert.Contains(t, names, "config")
+
+	// Items which the provider doesn't have are still missing.
+	_, err = st.ImageBigData(image.ID, "missing")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Items which don't match the digest that was recorded for them are
+	// rejected.
+	require.NoError(t, st.SetImageBigData(image.ID, "corrupt", []byte("original"), nil))
+	images, err := st.(*store).ImageStore()
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(images.(*imageStore).datapath(image.ID, "corrupt")))
+	_, err = st.ImageBigData(image.ID, "corrupt")
+	assert.True(t, errors.Is(err, ErrDigestMismatch))
+
+	// Manifests are kept only if they match one of the image's digests.
+	provider.items["manifest-verified"] = []byte("verified manifest")
+	provider.items["manifest-unverified"] = []byte("unverified manifest")
+	image, err = st.CreateImage("", nil, "", "", &ImageOptions{Digest: digest.FromBytes(provider.items["manifest-verified"])})
+	require.NoError(t, err)
+	for _, key := range []string{"manifest-verified", "manifest-unverified"} {
+		data, err = st.ImageBigData(image.ID, key)
+		require.NoError(t, err)
+		assert.Equal(t, provider.items[key], data)
+	}
+	names, err = st.ListImageBigData(image.ID)
+	require.NoError(t, err)
+	assert.Contains(t, names, "manifest-verified")
+	assert.NotContains(t, names, "manifest-unverified")
+
+	// Images which aren't known aren't fetched for.
+	fetched := provider.fetched
+	_, err = st.ImageBigData("unknown", "config")
+	assert.True(t, errors.Is(err, ErrImageUnknown))
+	assert.Equal(t, fetched, provider.fetched)
+}
+
+func TestStoreVerifyImage(t *testing.T) {
+	store := newTestStore(t)
+
+	diff, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	require.NotEmpty(t, layer.UncompressedDigest)
+
+	makeImage := func(diffIDs ...digest.Digest) *Image {
+		image, err := store.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+		require.NoError(t, err)
+		var config ociImageConfig
+		config.RootFS.Type = "layers"
+		config.RootFS.DiffIDs = diffIDs
+		data, err := json.Marshal(&config)
+		require.NoError(t, err)
+		require.NoError(t, store.SetImageBigData(image.ID, digest.FromBytes(data).String(), data, nil))
+		return image
+	}
+
+	image := makeImage(layer.UncompressedDigest)
+	report, err := store.VerifyImage(image.ID)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	require.Len(t, report.Layers, 1)
+	assert.Equal(t, layer.ID, report.Layers[0].ID)
+	assert.Equal(t, layer.UncompressedDigest, report.Layers[0].Actual)
+
+	// A DiffID which doesn't match is reported.
+	wrong := digest.FromString("something else")
+	image = makeImage(wrong)
+	report, err = store.VerifyImage(image.ID)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	require.Len(t, report.Layers, 1)
+	assert.Equal(t, wrong, report.Layers[0].Expected)
+	assert.Equal(t, layer.UncompressedDigest, report.Layers[0].Actual)
+
+	// So is a configuration which lists more layers than the image has.
+	image = makeImage(layer.UncompressedDigest, wrong)
+	report, err = store.VerifyImage(image.ID)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	require.Len(t, report.Layers, 2)
+	assert.True(t, report.Layers[0].OK())
+	assert.Empty(t, report.Layers[1].ID)
+
+	// Images without a configuration can't be verified.
+	image, err = store.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	_, err = store.VerifyImage(image.ID)
+	assert.True(t, errors.Is(err, ErrDigestUnknown))
+}
+
+func TestStoreDeferredLayerRemoval(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+
+	// Contents which an earlier process didn't get to are removed.
+	leftover := filepath.Join(wd, "root", "vfs", "deleted", "leftover-1234", "data")
+	require.NoError(t, os.MkdirAll(filepath.Join(leftover, "subdir"), 0700))
+
+	st, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{},
+		DeleteWorkers:      2,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = st.Shutdown(true) })
+
+	parent := ""
+	for i := 0; i < 4; i++ {
+		diff, err := archive.Generate(fmt.Sprintf("file%d", i), "contents")
+		require.NoError(t, err)
+		layer, _, err := st.PutLayer("", parent, nil, "", false, nil, diff)
+		require.NoError(t, err)
+		parent = layer.ID
+	}
+	image, err := st.CreateImage("", []string{"example.com/deleted:latest"}, parent, "", &ImageOptions{})
+	require.NoError(t, err)
+
+	deleted, err := st.DeleteImage(image.ID, true)
+	require.NoError(t, err)
+	assert.Len(t, deleted, 4)
+	layers, err := st.Layers()
+	require.NoError(t, err)
+	assert.Empty(t, layers)
+
+	st.WaitForDeletions()
+	entries, err := ioutil.ReadDir(filepath.Join(wd, "root", "vfs", "dir"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = ioutil.ReadDir(filepath.Join(wd, "root", "vfs", "deleted"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	// The removals were queued, and dropped from the queue when they
+	// finished.
+	entries, err = ioutil.ReadDir(filepath.Join(wd, "root", trashDir))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.Equal(t, trashLockFile, entry.Name())
+	}
+
+	// By default, contents are removed before deleting a layer returns.
+	s := newTestStore(t)
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, s.(*store).backgroundTrash())
+	require.NoError(t, s.DeleteLayer(layer.ID))
+	assert.NoDirExists(t, filepath.Join(s.GraphRoot(), "vfs", "dir", layer.ID))
+	entries, err = ioutil.ReadDir(filepath.Join(s.GraphRoot(), "vfs", "deleted"))
+	if err == nil {
+		assert.Empty(t, entries)
+	}
+}
+
+func TestStoreTrashResume(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageRuntime")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+
+	// Leave behind an item which was queued and moved, one which was
+	// moved but not queued, one which was queued but not moved, one which
+	// another process is still removing, and one which the graph driver
+	// moved out of the way but which wasn't queued.
+	dir := filepath.Join(wd, "root", trashDir)
+	for _, name := range []string{"queued", "unqueued", "claimed"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, name, "subdir"), 0700))
+	}
+	deletedLayer := filepath.Join(wd, "root", "vfs", "deleted", "layer-1234")
+	require.NoError(t, os.MkdirAll(filepath.Join(deletedLayer, "data"), 0700))
+	for name, path := range map[string]string{
+		"queued-entry":  filepath.Join(dir, "queued"),
+		"unmoved-entry": filepath.Join(dir, "unmoved"),
+		"claimed-entry": filepath.Join(dir, "claimed"),
+	} {
+		entry, err := json.Marshal(&trashEntry{Path: path, What: "test"})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+trashEntrySuffix), entry, 0600))
+	}
+	claim, err := os.Open(filepath.Join(dir, "claimed-entry"+trashEntrySuffix))
+	require.NoError(t, err)
+	claimed, err := claimTrashEntry(claim)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	st, err := GetStore(StoreOptions{
+		RunRoot:            filepath.Join(wd, "run"),
+		GraphRoot:          filepath.Join(wd, "root"),
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = st.Shutdown(true) })
+
+	checkEmpty := func() {
+		st.WaitForDeletions()
+		items, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		for _, item := range items {
+			// The item which is being removed by someone else is
+			// left to them.
+			assert.Contains(t, []string{trashLockFile, "claimed", "claimed-entry" + trashEntrySuffix}, item.Name())
+		}
+		assert.NoDirExists(t, deletedLayer)
+	}
+	_, err = st.Layers()
+	require.NoError(t, err)
+	checkEmpty()
+	assert.DirExists(t, filepath.Join(dir, "claimed"))
+	claim.Close()
+
+	// A deleted container's directory is moved out of the way right away.
+	layer, _, err := st.PutLayer("", "", nil, "", false, nil, nil)
+	require.NoError(t, err)
+	image, err := st.CreateImage("", nil, layer.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	container, err := st.CreateContainer("", nil, image.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, st.SetContainerDirectoryFile(container.ID, "data", []byte("contents")))
+	containerDir, err := st.ContainerDirectory(container.ID)
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteContainer(container.ID))
+	_, err = os.Stat(filepath.Dir(containerDir))
+	assert.True(t, os.IsNotExist(err))
+	checkEmpty()
+}
+
+func TestStoreNamespacePolicy(t *testing.T) {
+	wd, err := ioutil.TempDir("", "testStorageNamespaces")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(wd) })
+
+	getStore := func(namespace string) Store {
+		store, err := GetStore(StoreOptions{
+			RunRoot:         filepath.Join(wd, "run"),
+			GraphRoot:       filepath.Join(wd, "root"),
+			GraphDriverName: "vfs",
+			Namespace:       namespace,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { _, _ = store.Shutdown(true) })
+		return store
+	}
+	tenantA := getStore("a")
+	tenantB := getStore("b")
+
+	putLayer := func(parent string) *Layer {
+		diff, err := archive.Generate("file", strings.Repeat("x", 4096))
+		require.NoError(t, err)
+		layer, _, err := tenantA.PutLayer("", parent, nil, "", false, nil, diff)
+		require.NoError(t, err)
+		require.True(t, layer.UncompressedSize > 0)
+		return layer
+	}
+	base := putLayer("")
+	top := putLayer(base.ID)
+	other := putLayer("")
+
+	policy, err := tenantA.NamespacePolicy()
+	require.NoError(t, err)
+	assert.Equal(t, &NamespacePolicy{}, policy)
+
+	// Usage is counted per namespace, and shared layers are counted for
+	// each namespace which uses them.
+	dangling, err := tenantA.CreateImage("", nil, top.ID, "", &ImageOptions{CreationDate: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	usage, err := tenantA.NamespaceUsage()
+	require.NoError(t, err)
+	assert.Equal(t, base.UncompressedSize+top.UncompressedSize, usage)
+	shared, err := tenantB.CreateImage("", []string{"example.com/b:latest"}, base.ID, "", &ImageOptions{})
+	require.NoError(t, err)
+	usage, err = tenantB.NamespaceUsage()
+	require.NoError(t, err)
+	assert.Equal(t, base.UncompressedSize, usage)
+
+	// Images which would take a namespace over its quota are refused.
+	require.NoError(t, tenantA.SetNamespacePolicy(&NamespacePolicy{Quota: base.UncompressedSize + top.UncompressedSize, PruneDangling: true}))
+	_, err = tenantA.CreateImage("", []string{"example.com/a:other"}, other.ID, "", &ImageOptions{})
+	assert.True(t, errors.Is(err, ErrNamespaceQuotaExceeded))
+	_, err = tenantA.Layer(other.ID)
+	assert.True(t, errors.Is(err, ErrLayerUnknown), "the image's layer should have been removed: %v", err)
+	diff, err := archive.Generate("file", strings.Repeat("x", 4096))
+	require.NoError(t, err)
+	_, _, err = tenantA.PutLayer("", top.ID, nil, "", false, nil, diff)
+	assert.True(t, errors.Is(err, ErrNamespaceQuotaExceeded))
+	layers, err := tenantA.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 2)
+	named, err := tenantA.CreateImage("", []string{"example.com/a:latest"}, base.ID, "", &ImageOptions{CreationDate: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	// Using the image keeps it from being pruned for being old.
+	container, err := tenantA.CreateContainer("", nil, named.ID, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, tenantA.DeleteContainer(container.ID))
+	require.NoError(t, tenantA.SetNamespacePolicy(&NamespacePolicy{Quota: base.UncompressedSize + top.UncompressedSize, PruneDangling: true, PruneUnusedAfter: time.Minute}))
+	policy, err = tenantB.NamespacePolicy()
+	require.NoError(t, err)
+	assert.Equal(t, &NamespacePolicy{}, policy)
+
+	// Pruning only removes the dangling image, and keeps layers which
+	// are still in use.
+	report, err := tenantA.Prune()
+	require.NoError(t, err)
+	assert.Equal(t, []string{dangling.ID}, report.Images)
+	assert.Equal(t, []string{top.ID}, report.Layers)
+	assert.Equal(t, base.UncompressedSize, report.Usage)
+
+	// Pruning to fit a smaller quota removes the remaining image, but
+	// not the layer which the other namespace uses.
+	require.NoError(t, tenantA.SetNamespacePolicy(&NamespacePolicy{Quota: 1, PruneToQuota: true}))
+	report, err = tenantA.Prune()
+	require.NoError(t, err)
+	assert.Equal(t, []string{named.ID}, report.Images)
+	assert.Empty(t, report.Layers)
+	assert.Equal(t, int64(0), report.Usage)
+	_, err = tenantB.Image(shared.ID)
+	require.NoError(t, err)
+	_, err = tenantB.Layer(base.ID)
+	require.NoError(t, err)
+}
+
+type testVolumeDriver struct {
+	mounted map[string]bool
+}
+
+func (d *testVolumeDriver) Create(dir string, options map[string]string) error {
+	return ioutil.WriteFile(filepath.Join(dir, "created"), []byte(options["greeting"]), 0600)
+}
+
+func (d *testVolumeDriver) Mount(dir string, options map[string]string) error {
+	d.mounted[dir] = true
+	return nil
+}
+
+func (d *testVolumeDriver) Unmount(dir string) error {
+	delete(d.mounted, dir)
+	return nil
+}
+
+func TestStoreVolumes(t *testing.T) {
+	st := newTestStore(t)
+
+	volume, err := st.CreateVolume("", []string{"data"}, &VolumeOptions{Options: map[string]string{"mode": "1770"}, Labels: map[string]string{"app": "test"}})
+	require.NoError(t, err)
+	assert.Equal(t, "local", volume.Driver)
+	_, err = st.CreateVolume("", []string{"data"}, nil)
+	assert.True(t, errors.Is(err, ErrDuplicateName))
+	_, err = st.CreateVolume("", nil, &VolumeOptions{Driver: "no-such-driver"})
+	assert.True(t, errors.Is(err, ErrVolumeDriverUnknown))
+	_, err = st.CreateVolume("", nil, &VolumeOptions{Options: map[string]string{"color": "blue"}})
+	assert.Error(t, err)
+
+	// Local volumes keep their contents between mounts.
+	dir, err := st.MountVolume("data")
+	require.NoError(t, err)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSticky|0770, info.Mode()&(os.ModeSticky|os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0600))
+	again, err := st.MountVolume(volume.ID)
+	require.NoError(t, err)
+	assert.Equal(t, dir, again)
+	mounted, err := st.Volume("data")
+	require.NoError(t, err)
+	assert.Equal(t, 2, mounted.MountCount)
+	assert.True(t, errors.Is(st.DeleteVolume("data"), ErrVolumeMounted))
+	stillMounted, err := st.UnmountVolume("data", false)
+	require.NoError(t, err)
+	assert.True(t, stillMounted)
+	stillMounted, err = st.UnmountVolume("data", true)
+	require.NoError(t, err)
+	assert.False(t, stillMounted)
+	dir, err = st.MountVolume("data")
+	require.NoError(t, err)
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("contents"), contents)
+	_, err = st.UnmountVolume("data", false)
+	require.NoError(t, err)
+
+	require.NoError(t, st.UpdateVolumeLabels("data", map[string]string{"tier": "db"}, []string{"app"}))
+	volumes, err := st.Volumes()
+	require.NoError(t, err)
+	require.Len(t, volumes, 1)
+	assert.Equal(t, map[string]string{"tier": "db"}, volumes[0].Labels)
+
+	// Other drivers can be plugged in.
+	driver := &testVolumeDriver{mounted: make(map[string]bool)}
+	require.NoError(t, RegisterVolumeDriver("test", driver))
+	plugged, err := st.CreateVolume("", nil, &VolumeOptions{Driver: "test", Options: map[string]string{"greeting": "hello"}})
+	require.NoError(t, err)
+	dir, err = st.MountVolume(plugged.ID)
+	require.NoError(t, err)
+	assert.True(t, driver.mounted[dir])
+	contents, err = ioutil.ReadFile(filepath.Join(dir, "created"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), contents)
+
+	// Deleting a volume removes its contents, and wiping the store
+	// removes every volume, even mounted ones.
+	require.NoError(t, st.DeleteVolume("data"))
+	_, err = st.Volume("data")
+	assert.True(t, errors.Is(err, ErrVolumeUnknown))
+	require.NoError(t, st.Wipe())
+	assert.Empty(t, driver.mounted)
+	volumes, err = st.Volumes()
+	require.NoError(t, err)
+	assert.Empty(t, volumes)
+	st.WaitForDeletions()
+	entries, err := ioutil.ReadDir(filepath.Join(st.GraphRoot(), "volumes"))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, entry.IsDir(), "%s was left behind", entry.Name())
+	}
+
+	// If the record of a new volume can't be saved, it's forgotten.
+	records := filepath.Join(st.GraphRoot(), "volumes", "volumes.json")
+	require.NoError(t, os.Remove(records))
+	require.NoError(t, os.MkdirAll(filepath.Join(records, "blocker"), 0700))
+	_, err = st.CreateVolume("unsaved", []string{"unsaved"}, nil)
+	assert.Error(t, err)
+	_, err = st.Volume("unsaved")
+	assert.True(t, errors.Is(err, ErrVolumeUnknown))
+	volumes, err = st.Volumes()
+	require.NoError(t, err)
+	assert.Empty(t, volumes)
+	_, err = os.Stat(filepath.Join(st.GraphRoot(), "volumes", "unsaved"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreTmpfsVolume(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting a tmpfs requires root")
+	}
+	st := newTestStore(t)
+
+	_, err := st.CreateVolume("", []string{"scratch"}, &VolumeOptions{Driver: "tmpfs", Options: map[string]string{"size": "1m", "mode": "1777"}})
+	require.NoError(t, err)
+	dir, err := st.MountVolume("scratch")
+	require.NoError(t, err)
+	isMounted, err := mount.Mounted(dir)
+	require.NoError(t, err)
+	assert.True(t, isMounted)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSticky|0777, info.Mode()&(os.ModeSticky|os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0600))
+
+	// The contents go away when the volume is unmounted.
+	_, err = st.UnmountVolume("scratch", false)
+	require.NoError(t, err)
+	isMounted, err = mount.Mounted(dir)
+	require.NoError(t, err)
+	assert.False(t, isMounted)
+	_, err = os.Stat(filepath.Join(dir, "file"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, st.DeleteVolume("scratch"))
+}
+
+func TestChownUserDir(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving files to other users requires root")
+	}
+	dir, err := ioutil.TempDir("", "user-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	require.NoError(t, os.Mkdir(outside, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outside, "file"), nil, 0600))
+	owner := idtools.IDPair{UID: 12345, GID: 12345}
+	store := filepath.Join(dir, "store")
+	require.NoError(t, idtools.MkdirAndChown(store, 0700, owner))
+
+	// Nothing should be created by way of a symbolic link which the user
+	// controls.
+	require.NoError(t, os.Symlink(outside, filepath.Join(store, "link")))
+	assert.Error(t, createUserDir(filepath.Join(store, "link", "overlay"), owner))
+	_, err = os.Stat(filepath.Join(outside, "overlay"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, createUserDir(filepath.Join(store, "overlay", "l"), owner))
+
+	// Everything which we created in the store should be given to the
+	// user, but not anything which a symbolic link or a hard link in it
+	// refers to.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store, "overlay", "l", "lock"), nil, 0600))
+	require.NoError(t, os.Link(filepath.Join(outside, "file"), filepath.Join(store, "overlay", "hardlink")))
+	require.NoError(t, chownUserDir(store, owner))
+	for _, path := range []string{"link", "overlay", "overlay/l", "overlay/l/lock"} {
+		st, err := system.Lstat(filepath.Join(store, path))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(owner.UID), st.UID(), path)
+	}
+	for _, path := range []string{outside, filepath.Join(outside, "file")} {
+		st, err := system.Lstat(path)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(0), st.UID(), path)
+	}
+}
+
+func TestStoreLayerCopyStats(t *testing.T) {
+	store := newTestStore(t)
+
+	parent, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(parent.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mountPoint, "file"), []byte("contents"), 0644))
+	_, err = store.Unmount(parent.ID, true)
+	require.NoError(t, err)
+	assert.Nil(t, parent.CopyStats)
+
+	child, err := store.CreateLayer("", parent.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	require.NotNil(t, child.CopyStats)
+	stats := child.CopyStats
+	assert.Equal(t, int64(1), stats.ClonedFiles+stats.RangeCopiedFiles+stats.CopiedFiles)
+	assert.Equal(t, int64(len("contents")), stats.ClonedBytes+stats.RangeCopiedBytes+stats.CopiedBytes)
+
+	// The statistics are kept with the layer's record.
+	child, err = store.Layer(child.ID)
+	require.NoError(t, err)
+	assert.Equal(t, stats, child.CopyStats)
+}
+
+// readerFunc adapts a function to io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestStorePutLayerReplacedWhileExtracting(t *testing.T) {
+	store := newTestStore(t)
+
+	const id = "replaced"
+	diff, err := archive.Generate("file", "contents")
+	require.NoError(t, err)
+	var replacement *Layer
+	var replaceErr error
+	var once sync.Once
+	reader := readerFunc(func(p []byte) (int, error) {
+		// While the lock isn't held, someone removes the layer and
+		// creates another one with the same ID.
+		once.Do(func() {
+			if replaceErr = store.DeleteLayer(id); replaceErr == nil {
+				replacement, replaceErr = store.CreateLayer(id, "", nil, "", false, nil)
+			}
+		})
+		return diff.Read(p)
+	})
+	_, _, err = store.PutLayer(id, "", nil, "", false, nil, reader)
+	require.NoError(t, replaceErr)
+	assert.True(t, errors.Is(err, errLayerReplaced))
+
+	// The replacement is left alone.
+	layer, err := store.Layer(id)
+	require.NoError(t, err)
+	assert.True(t, layer.Created.Equal(replacement.Created))
+	assert.Empty(t, layer.UncompressedDigest)
+}
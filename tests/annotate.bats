@@ -0,0 +1,33 @@
+#!/usr/bin/env bats
+
+load helpers
+
+@test "annotate" {
+	# Create a layer.
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer=$output
+
+	# Set a pair of annotations, and check that they're listed.
+	run storage --debug=false annotate $layer owner=ci stage=build
+	[ "$status" -eq 0 ]
+	[ "${#lines[*]}" -eq 2 ]
+	[ "${lines[0]}" = "owner=ci" ]
+	[ "${lines[1]}" = "stage=build" ]
+
+	# Change one and remove the other in one update.
+	run storage --debug=false annotate $layer owner=release stage-
+	[ "$status" -eq 0 ]
+	[ "${#lines[*]}" -eq 1 ]
+	[ "${lines[0]}" = "owner=release" ]
+
+	# List them as JSON.
+	run storage --debug=false annotate --json $layer
+	[ "$status" -eq 0 ]
+	[ "$output" = '{"owner":"release"}' ]
+
+	# Malformed changes are rejected.
+	run storage --debug=false annotate $layer owner
+	[ "$status" -ne 0 ]
+}
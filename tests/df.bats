@@ -0,0 +1,32 @@
+#!/usr/bin/env bats
+
+load helpers
+
+@test "df" {
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer="$output"
+	run storage --debug=false create-image --name df-image "$layer"
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	image="$output"
+	run storage --debug=false create-container "$image"
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+
+	run storage --debug=false df
+	echo :"$output":
+	[ "$status" -eq 0 ]
+	[[ "$output" =~ "IMAGE ID" ]]
+	[[ "$output" =~ "df-image" ]]
+	[[ "$output" =~ "CONTAINER ID" ]]
+	[[ "$output" =~ "LAYER ID" ]]
+	[[ "$output" =~ "TOTAL" ]]
+
+	run storage --debug=false df --json
+	echo :"$output":
+	[ "$status" -eq 0 ]
+	[[ "$output" =~ "\"id\":\"$image\"" ]]
+	[[ "$output" =~ "\"exclusive\":" ]]
+}
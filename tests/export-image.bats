@@ -0,0 +1,45 @@
+#!/usr/bin/env bats
+
+load helpers
+
+@test "export-image" {
+	# Create and populate three interesting layers.
+	populate
+
+	# Create an image using the top layer.
+	run storage --debug=false create-image -n exported-image $upperlayer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	image=${lines[0]}
+
+	# Export the image, and note what the top layer's contents were.
+	storage export-image -f $TESTDIR/image.tar $image
+	storage diff -u -f $TESTDIR/upper.tar $upperlayer
+
+	# Delete the image, which also deletes its layers.
+	storage delete-image $image
+	run storage exists -i $image
+	[ "$status" -ne 0 ]
+	run storage exists -l $upperlayer
+	[ "$status" -ne 0 ]
+
+	# Import the image.  It should keep its ID and its name.
+	run storage --debug=false import-image -f $TESTDIR/image.tar
+	[ "$status" -eq 0 ]
+	[ "${lines[0]}" = "$image" ]
+	[ "${lines[1]}" = "	exported-image" ]
+
+	# The new top layer should have the same contents as the old one.
+	run storage --debug=false image -j $image
+	[ "$status" -eq 0 ]
+	toplayer=$(echo "$output" | sed -n 's/.*"layer": *"\([^"]*\)".*/\1/p')
+	[ "$toplayer" != "" ]
+	storage diff -u -f $TESTDIR/imported.tar $toplayer
+	cmp $TESTDIR/upper.tar $TESTDIR/imported.tar
+
+	# Importing a corrupted archive should fail.
+	storage delete-image $image
+	head -c 2048 $TESTDIR/image.tar > $TESTDIR/truncated.tar
+	run storage --debug=false import-image -f $TESTDIR/truncated.tar
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,62 @@
+#!/usr/bin/env bats
+
+load helpers
+
+@test "image-attachments" {
+	# Bail if "sha256sum" isn't available.
+	if test -z "$(which sha256sum 2> /dev/null)" ; then
+		skip "need sha256sum"
+	fi
+
+	# Create a layer.
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer=$output
+
+	# Create an image using that layer.
+	run storage --debug=false create-image $layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	image=${output%%	*}
+
+	# Make sure the image has no attachments.
+	run storage --debug=false list-image-attachments $image
+	[ "$status" -eq 0 ]
+	[ "$output" = "" ]
+
+	# Attach a signature and an SBOM.
+	createrandom $TESTDIR/signature 512
+	createrandom $TESTDIR/sbom 2048
+	run storage --debug=false add-image-attachment -f $TESTDIR/signature $image signature
+	[ "$status" -eq 0 ]
+	signature=$output
+	[ "$signature" = "sha256:$(sha256sum $TESTDIR/signature | cut -f1 -d' ')" ]
+	run storage --debug=false add-image-attachment -m application/spdx+json -f $TESTDIR/sbom $image sbom
+	[ "$status" -eq 0 ]
+	sbom=$output
+
+	# Both should be listed, in order, and each can be listed by kind.
+	run storage --debug=false list-image-attachments $image
+	[ "$status" -eq 0 ]
+	[ "${#lines[*]}" -eq 2 ]
+	[ "${lines[0]}" = "signature	$signature	512	" ]
+	[ "${lines[1]}" = "sbom	$sbom	2048	application/spdx+json" ]
+	run storage --debug=false list-image-attachments $image sbom
+	[ "$status" -eq 0 ]
+	[ "${#lines[*]}" -eq 1 ]
+
+	# Retrieve the signature.
+	storage get-image-attachment -f $TESTDIR/signature.out $image signature $signature
+	cmp $TESTDIR/signature $TESTDIR/signature.out
+	run storage --debug=false get-image-attachment $image sbom $signature
+	[ "$status" -ne 0 ]
+
+	# Remove the signature.
+	storage remove-image-attachment $image signature $signature
+	run storage --debug=false list-image-attachments $image signature
+	[ "$status" -eq 0 ]
+	[ "$output" = "" ]
+	run storage --debug=false remove-image-attachment $image signature $signature
+	[ "$status" -ne 0 ]
+}
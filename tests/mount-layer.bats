@@ -83,3 +83,33 @@ load helpers
 	run storage delete-layer $layer
 	[ "$status" -eq 0 ]
 }
+
+@test "unmount-all" {
+	# Create two layers and mount them, one of them twice.
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer1="$output"
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer2="$output"
+	for layer in $layer1 $layer2 $layer2 ; do
+		run storage --debug=false mount $layer
+		[ "$status" -eq 0 ]
+		[ "$output" != "" ]
+	done
+
+	# Naming layers along with --all is an error.
+	run storage --debug=false unmount --all $layer1
+	[ "$status" -ne 0 ]
+
+	# Unmount everything.
+	run storage --debug=false unmount --all --force
+	[ "$status" -eq 0 ]
+	for layer in $layer1 $layer2 ; do
+		run storage --debug=false mounted $layer
+		[ "$status" -eq 0 ]
+		[ "$output" == "" ]
+	done
+}
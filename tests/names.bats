@@ -294,6 +294,34 @@ check-for-name() {
 	[ "$status" -eq 0 ]
 }
 
+@test "remove-names: images" {
+	# Create a layer.
+	run storage --debug=false create-layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	layer=$output
+
+	# Create an image with names that uses that layer.
+	run storage --debug=false create-image -n fooimage -n barimage -n bazimage $layer
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	image=${output%%	*}
+
+	# Remove two of the names, one of which the image doesn't have.
+	run storage remove-names -n barimage -n no-such-thing-as-this-name $image
+	[ "$status" -eq 0 ]
+
+	# Check that only the removed name is no longer assigned.
+	run storage exists -i barimage
+	[ "$status" -ne 0 ]
+	run check-for-name barimage $image
+	[ "$status" -ne 0 ]
+	run check-for-name fooimage $image
+	[ "$status" -eq 0 ]
+	run check-for-name bazimage $image
+	[ "$status" -eq 0 ]
+}
+
 @test "set-names: images" {
 	# Create a layer.
 	run storage --debug=false create-layer
@@ -151,3 +151,33 @@ load helpers
         [ "$output" != "" ]
         ! [[ "$output" =~ "Read Only: true" ]]
 }
+
+@test "additional-stores-masking" {
+	# Create an image in what will become a read-only store.
+	run storage --graph ${TESTDIR}/ro-root --run ${TESTDIR}/ro-runroot --debug=false create-image -n shared-image
+	[ "$status" -eq 0 ]
+	[ "$output" != "" ]
+	image=${lines[0]}
+	storage --graph ${TESTDIR}/ro-root --run ${TESTDIR}/ro-runroot shutdown
+	cp ${TESTDIR}/ro-root/${STORAGE_DRIVER}-images/images.json ${TESTDIR}/images.json.before
+
+	# The image should be visible through the writable store.
+	storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root exists -i shared-image
+
+	# Hide it, and check that it's hidden, and that the read-only store
+	# wasn't modified.
+	storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root mask-image shared-image
+	run storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root exists -i shared-image
+	[ "$status" -ne 0 ]
+	run storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root --debug=false masked-images
+	[ "$status" -eq 0 ]
+	[ "$output" = "$image" ]
+	cmp ${TESTDIR}/images.json.before ${TESTDIR}/ro-root/${STORAGE_DRIVER}-images/images.json
+
+	# Make it visible again.
+	storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root unmask-image $image
+	storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root exists -i shared-image
+	run storage --storage-opt ${STORAGE_DRIVER}.imagestore=${TESTDIR}/ro-root --debug=false masked-images
+	[ "$status" -eq 0 ]
+	[ "$output" = "" ]
+}
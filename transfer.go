@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TransferLayerOptions is used for passing options to a Store's
+// TransferLayer() method.
+type TransferLayerOptions struct {
+	// IDMappingOptions, if set, specifies the ID mappings which the copied
+	// layer, and any of its parents which also need to be copied, will use
+	// in the destination store.  By default they keep the mappings which
+	// they have in the source store.
+	IDMappingOptions *types.IDMappingOptions
+	// NoReflink forces the layer's contents to be copied by extracting
+	// its diff, even if the stores are on the same filesystem.
+	NoReflink bool
+}
+
+// TransferLayer copies a layer, along with any of its parents which dest
+// doesn't already have, from s to dest, keeping its ID.
+func (s *store) TransferLayer(id string, dest Store, options *TransferLayerOptions) (*Layer, error) {
+	if options == nil {
+		options = &TransferLayerOptions{}
+	}
+	d, ok := dest.(*store)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "copying layers to a %T", dest)
+	}
+	if d == s || s.sameLocation(d) {
+		return nil, errors.Errorf("can't copy layer %q to the store which it's already in", id)
+	}
+	layer, err := s.Layer(id)
+	if err != nil {
+		return nil, err
+	}
+	if existing, err := d.Layer(layer.ID); err == nil {
+		return existing, nil
+	}
+	if layer.Parent != "" {
+		if _, err := s.TransferLayer(layer.Parent, dest, options); err != nil {
+			return nil, errors.Wrapf(err, "copying parent %q of layer %q", layer.Parent, layer.ID)
+		}
+	}
+	if !options.NoReflink && options.IDMappingOptions == nil {
+		copied, err := s.cloneLayer(layer, d)
+		if err == nil {
+			return copied, nil
+		}
+		if errors.Cause(err) != ErrNotSupported {
+			return nil, err
+		}
+		logrus.Debugf("Copying layer %q by extracting its diff: %v", layer.ID, err)
+	}
+	return s.extractLayer(layer, d, options)
+}
+
+// sameLocation returns true if d keeps its layers in the same place that we
+// do.  Stores which share a graph root and run root, but use different graph
+// drivers, keep their layers, images, and containers separately.
+func (s *store) sameLocation(d *store) bool {
+	return d.graphRoot == s.graphRoot && d.runRoot == s.runRoot && d.graphDriverName == s.graphDriverName
+}
+
+// extractLayer copies a layer by extracting its diff into dest.
+func (s *store) extractLayer(layer *Layer, d *store, options *TransferLayerOptions) (*Layer, error) {
+	uncompressed := archive.Uncompressed
+	diff, err := s.Diff("", layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Close()
+	layerOptions := LayerOptions{
+		OriginalDigest:     layer.CompressedDigest,
+		UncompressedDigest: layer.UncompressedDigest,
+		Provenance:         layer.Provenance,
+	}
+	if options.IDMappingOptions != nil {
+		layerOptions.IDMappingOptions = *options.IDMappingOptions
+	} else {
+		layerOptions.IDMappingOptions = types.IDMappingOptions{
+			HostUIDMapping: len(layer.UIDMap) == 0,
+			HostGIDMapping: len(layer.GIDMap) == 0,
+			UIDMap:         copyIDMap(layer.UIDMap),
+			GIDMap:         copyIDMap(layer.GIDMap),
+		}
+	}
+	if _, _, err := d.PutLayer(layer.ID, layer.Parent, layer.Names, layer.MountLabel, false, &layerOptions, diff); err != nil {
+		return nil, err
+	}
+	return s.finishTransfer(layer, d, false)
+}
+
+// cloneLayer copies a layer by having dest's graph driver copy the layer's
+// contents from our graph driver, which can clone the files if the stores are
+// on the same filesystem.  It returns ErrNotSupported if that isn't possible.
+func (s *store) cloneLayer(layer *Layer, d *store) (*Layer, error) {
+	srcDriver, err := s.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	dstDriver, err := d.GraphDriver()
+	if err != nil {
+		return nil, err
+	}
+	copier, ok := dstDriver.(drivers.LayerCopierDriver)
+	if !ok || srcDriver.String() != dstDriver.String() {
+		return nil, errors.Wrapf(ErrNotSupported, "%s driver can't copy layers from %s driver", dstDriver.String(), srcDriver.String())
+	}
+	same, err := sameFilesystem(s.graphRoot, d.graphRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !same {
+		return nil, errors.Wrapf(ErrNotSupported, "%q and %q are on different filesystems", s.graphRoot, d.graphRoot)
+	}
+
+	slstore, err := s.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	srcLayers, ok := slstore.(*layerStore)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "reading layers from a %T", slstore)
+	}
+	dlstore, err := d.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	dstLayers, ok := dlstore.(*layerStore)
+	if !ok {
+		return nil, errors.Wrapf(ErrNotSupported, "writing layers to a %T", dlstore)
+	}
+
+	if err := func() error {
+		unlock := lockLayerStores(srcLayers, dstLayers)
+		defer unlock()
+		if err := srcLayers.ReloadIfChanged(); err != nil {
+			return err
+		}
+		if err := dstLayers.ReloadIfChanged(); err != nil {
+			return err
+		}
+		srcLayer, ok := srcLayers.lookup(layer.ID)
+		if !ok {
+			// It's in one of our read-only layer stores.
+			return errors.Wrapf(ErrNotSupported, "layer %q is in a read-only layer store", layer.ID)
+		}
+		tarSplit, err := ioutil.ReadFile(srcLayers.tspath(srcLayer.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		var parent *Layer
+		if srcLayer.Parent != "" {
+			if parent, ok = dstLayers.lookup(srcLayer.Parent); !ok {
+				return errors.Wrapf(ErrNotSupported, "parent %q of layer %q is in a read-only layer store", srcLayer.Parent, srcLayer.ID)
+			}
+		}
+		layerOptions := LayerOptions{
+			IDMappingOptions: types.IDMappingOptions{
+				HostUIDMapping: len(srcLayer.UIDMap) == 0,
+				HostGIDMapping: len(srcLayer.GIDMap) == 0,
+				UIDMap:         copyIDMap(srcLayer.UIDMap),
+				GIDMap:         copyIDMap(srcLayer.GIDMap),
+			},
+			Provenance: srcLayer.Provenance,
+		}
+		// Mark the layer as incomplete until we're done, so that it'll
+		// be cleaned up if we're interrupted.
+		flags := map[string]interface{}{
+			incompleteFlag:  true,
+			applyingPIDFlag: os.Getpid(),
+		}
+		if _, _, err := dstLayers.Put(srcLayer.ID, parent, srcLayer.Names, srcLayer.MountLabel, nil, &layerOptions, false, flags, nil); err != nil {
+			return err
+		}
+		succeeded := false
+		defer func() {
+			if !succeeded {
+				if err := dstLayers.Delete(srcLayer.ID); err != nil {
+					logrus.Errorf("While recovering from a failure copying layer %q, error deleting it: %v", srcLayer.ID, err)
+				}
+			}
+		}()
+		if err := copier.CopyLayer(srcLayer.ID, srcDriver, srcLayer.ID); err != nil {
+			return err
+		}
+		if tarSplit != nil {
+			if err := os.MkdirAll(filepath.Dir(dstLayers.tspath(srcLayer.ID)), 0700); err != nil {
+				return err
+			}
+			if err := ioutils.AtomicWriteFile(dstLayers.tspath(srcLayer.ID), tarSplit, 0600); err != nil {
+				return err
+			}
+		}
+		copied, _ := dstLayers.lookup(srcLayer.ID)
+		copied.CopyStats = dstLayers.takeCopyStats(srcLayer.ID)
+		dstLayers.recordDiffResult(copied, &layerDiffResult{
+			compressedDigest:   srcLayer.CompressedDigest,
+			compressedSize:     srcLayer.CompressedSize,
+			uncompressedDigest: srcLayer.UncompressedDigest,
+			uncompressedSize:   srcLayer.UncompressedSize,
+			compression:        srcLayer.CompressionType,
+			uids:               copyUint32Slice(srcLayer.UIDs),
+			gids:               copyUint32Slice(srcLayer.GIDs),
+
+			additionalUncompressedDigests: srcLayer.AdditionalUncompressedDigests,
+		})
+		delete(copied.Flags, incompleteFlag)
+		delete(copied.Flags, applyingPIDFlag)
+		if err := dstLayers.Save(); err != nil {
+			return err
+		}
+		succeeded = true
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+	return s.finishTransfer(layer, d, true)
+}
+
+// lockLayerStores locks src for reading and dst for writing, and returns a
+// function which unlocks both of them.  They're always locked in the order of
+// their directories' names, so that copies being made in opposite directions
+// at the same time can't deadlock.
+func lockLayerStores(src, dst *layerStore) func() {
+	if src.layerdir < dst.layerdir {
+		src.RLock()
+		dst.Lock()
+	} else {
+		dst.Lock()
+		src.RLock()
+	}
+	return func() {
+		dst.Unlock()
+		src.Unlock()
+	}
+}
+
+// finishTransfer copies a layer's metadata, flags, and big data items to the
+// copy of it in dest.  If the layer's contents were extracted from its diff,
+// the record of its compressed form is also copied.
+func (s *store) finishTransfer(layer *Layer, d *store, cloned bool) (*Layer, error) {
+	if layer.Metadata != "" {
+		if err := d.SetMetadata(layer.ID, layer.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range layer.BigDataNames {
+		if err := func() error {
+			rc, err := s.LayerBigData(layer.ID, key)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			return d.SetLayerBigData(layer.ID, key, rc)
+		}(); err != nil {
+			return nil, errors.Wrapf(err, "copying data item %q of layer %q", key, layer.ID)
+		}
+	}
+	dlstore, err := d.LayerStore()
+	if err != nil {
+		return nil, err
+	}
+	dlstore.Lock()
+	defer dlstore.Unlock()
+	if err := dlstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	if dstLayers, ok := dlstore.(*layerStore); ok {
+		copied, ok := dstLayers.lookup(layer.ID)
+		if !ok {
+			return nil, ErrLayerUnknown
+		}
+		for flag, value := range layer.Flags {
+			copied.Flags[flag] = value
+		}
+		updateAnnotations(&copied.Annotations, layer.Annotations, nil)
+		if !cloned {
+			dstLayers.recordDiffResult(copied, &layerDiffResult{
+				compressedDigest:   layer.CompressedDigest,
+				compressedSize:     layer.CompressedSize,
+				uncompressedDigest: copied.UncompressedDigest,
+				uncompressedSize:   copied.UncompressedSize,
+				compression:        layer.CompressionType,
+				uids:               copied.UIDs,
+				gids:               copied.GIDs,
+
+				additionalUncompressedDigests: copied.AdditionalUncompressedDigests,
+			})
+		}
+		if err := dstLayers.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return dlstore.Get(layer.ID)
+}
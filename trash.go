@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/containers/storage/pkg/system"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// trashDir is the directory under the graph root into which
+	// directories which are being deleted are moved.
+	trashDir = "trash"
+	// trashEntrySuffix is appended to the names of the files in the trash
+	// directory which record what's waiting to be removed, so that
+	// removing it can be finished by a later process if the one which
+	// queued it exits first.
+	trashEntrySuffix = ".json"
+	// trashLockFile is locked for writing while looking for items which
+	// aren't recorded in the queue, and for reading while queueing items,
+	// so that items which are being queued aren't mistaken for them.
+	trashLockFile = "queue.lock"
+)
+
+// trashEntry records an item which is waiting to be removed.  Each entry is
+// kept in its own file in the trash directory, which a process locks while
+// it's removing the item, so that other processes leave it alone.
+type trashEntry struct {
+	// Path is the location of the item, which is either in the trash
+	// directory, or in a directory into which a graph driver moved it.
+	Path string `json:"path"`
+	// What describes what the item was, for logging.
+	What string `json:"what"`
+	// Queued is when the item was queued.
+	Queued time.Time `json:"queued"`
+}
+
+// trash moves directories which are being deleted out of the way, and
+// removes them in the background using a reaper.  A nil *trash removes them
+// right away.
+type trash struct {
+	dir      string
+	lockfile Locker
+	reaper   *reaper
+}
+
+// newTrash returns a trash which uses the trash directory under graphRoot.
+func newTrash(graphRoot string, reaper *reaper) (*trash, error) {
+	dir := filepath.Join(graphRoot, trashDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lockfile, err := GetLockfile(filepath.Join(dir, trashLockFile))
+	if err != nil {
+		return nil, err
+	}
+	return &trash{dir: dir, lockfile: lockfile, reaper: reaper}, nil
+}
+
+func (t *trash) entryPath(name string) string {
+	return filepath.Join(t.dir, name+trashEntrySuffix)
+}
+
+// record writes an entry for an item which is about to be, or has just been,
+// moved to path.  The caller should hold the lock for reading.
+func (t *trash) record(name, what, path string) error {
+	data, err := json.Marshal(&trashEntry{Path: path, What: what, Queued: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(t.entryPath(name), data, 0600)
+}
+
+// removeAll removes path, which should be on the same file system as the
+// graph root.  It's moved into the trash directory, recorded there, and
+// removed from there in the background.  If it can't be moved, it's removed
+// right away.
+func (t *trash) removeAll(what, path string) error {
+	if t == nil {
+		return system.EnsureRemoveAll(path)
+	}
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	name := stringid.GenerateRandomID()
+	moved := filepath.Join(t.dir, name)
+	t.lockfile.RLock()
+	if err := os.Rename(path, moved); err != nil {
+		t.lockfile.Unlock()
+		logrus.Debugf("Removing %s now: %v", what, err)
+		return system.EnsureRemoveAll(path)
+	}
+	err := t.record(name, what, moved)
+	t.lockfile.Unlock()
+	t.add(name, what, moved, err)
+	return nil
+}
+
+// queue records an item which a graph driver moved to path, and removes it in
+// the background.  If move fails, nothing is recorded.
+func (t *trash) queue(what string, move func() (string, error)) error {
+	t.lockfile.RLock()
+	path, err := move()
+	if err != nil || path == "" {
+		t.lockfile.Unlock()
+		return err
+	}
+	name := stringid.GenerateRandomID()
+	err = t.record(name, what, path)
+	t.lockfile.Unlock()
+	t.add(name, what, path, err)
+	return nil
+}
+
+// add arranges for an item which was just queued to be removed in the
+// background.  If recording it failed, it's removed without being claimed,
+// since no other process could know to claim it.
+func (t *trash) add(name, what, path string, recordErr error) {
+	if recordErr != nil {
+		logrus.Debugf("Error recording %s in %q: %v", what, t.dir, recordErr)
+		t.reaper.add(what, func() error {
+			return system.EnsureRemoveAll(path)
+		})
+		return
+	}
+	t.reaper.add(what, func() error {
+		return t.remove(name)
+	})
+}
+
+// remove removes the item which the named entry records, and then the entry,
+// unless another process is already removing it.
+func (t *trash) remove(name string) error {
+	f, err := os.OpenFile(t.entryPath(name), os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Someone else already removed it.
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	claimed, err := claimTrashEntry(f)
+	if err != nil || !claimed {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var entry trashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return errors.Wrapf(err, "decoding %q", t.entryPath(name))
+	}
+	if entry.Path != "" {
+		if err := system.EnsureRemoveAll(entry.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(t.entryPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// resume arranges for items which earlier processes queued, but didn't finish
+// removing, to be removed in the background.  Items in the trash directory
+// which aren't recorded are queued, too.  Items which another process is
+// removing are left to it.
+func (t *trash) resume() error {
+	return t.queueUnremoved(true, t.dir)
+}
+
+// adoptDirs arranges for items in dirs, into which a graph driver moves
+// things which it's deleting, to be removed in the background if they haven't
+// been queued.
+func (t *trash) adoptDirs(dirs ...string) error {
+	return t.queueUnremoved(false, dirs...)
+}
+
+// queueUnremoved records items in dirs which haven't been queued, and arranges
+// for them, and every other queued item if all is set, to be removed in the
+// background.
+func (t *trash) queueUnremoved(all bool, dirs ...string) error {
+	t.lockfile.Lock()
+	entries, adopted, err := t.adopt(dirs)
+	t.lockfile.Unlock()
+	if err != nil {
+		return err
+	}
+	if !all {
+		entries = adopted
+	}
+	for name, what := range entries {
+		name := name
+		t.reaper.add(what, func() error {
+			return t.remove(name)
+		})
+	}
+	return nil
+}
+
+// adopt reads the entries in the trash directory, and records anything in
+// dirs which they don't mention.  It returns descriptions of every entry, and
+// of the ones which it added, keyed by their names.  The caller should hold
+// the lock for writing.
+func (t *trash) adopt(dirs []string) (entries, adopted map[string]string, err error) {
+	items, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries = make(map[string]string)
+	adopted = make(map[string]string)
+	recorded := make(map[string]bool)
+	for _, item := range items {
+		name := item.Name()
+		if !strings.HasSuffix(name, trashEntrySuffix) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		name = strings.TrimSuffix(name, trashEntrySuffix)
+		entries[name] = filepath.Join(t.dir, name)
+		data, err := ioutil.ReadFile(t.entryPath(name))
+		if err != nil {
+			continue
+		}
+		var entry trashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			// remove() will report it.
+			continue
+		}
+		entries[name] = entry.What
+		recorded[entry.Path] = true
+	}
+	for _, dir := range dirs {
+		items, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		for _, item := range items {
+			name := item.Name()
+			// Skip entries, the lock, and new versions of
+			// entries which are being written.
+			if dir == t.dir && (strings.HasSuffix(name, trashEntrySuffix) || name == trashLockFile || strings.HasPrefix(name, ".")) {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if recorded[path] {
+				continue
+			}
+			name = stringid.GenerateRandomID()
+			if err := t.record(name, path, path); err != nil {
+				return nil, nil, err
+			}
+			entries[name] = path
+			adopted[name] = path
+		}
+	}
+	return entries, adopted, nil
+}
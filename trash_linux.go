@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// claimTrashEntry tries to take an exclusive flock() lock on an entry in the
+// trash directory, which is released when f is closed.  It returns false if
+// another process holds the lock, because it's removing the entry's item.
+func claimTrashEntry(f *os.File) (bool, error) {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		switch err {
+		case nil:
+			return true, nil
+		case unix.EWOULDBLOCK:
+			return false, nil
+		case unix.EINTR:
+			continue
+		default:
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Configuration is read from a main configuration file, followed by the files
+// in its drop-in directory, which is named after the main file with ".d"
+// appended (e.g. /etc/containers/storage.conf.d).  Only files in a drop-in
+// directory whose names end with ".conf" are read, in lexical order of their
+// names.  A setting in a file which is read later overrides the same setting
+// in a file which was read earlier.  Tables are merged key by key, so a
+// drop-in file only needs to contain the settings which it changes, while
+// arrays are replaced as a whole.  Environment variables override settings
+// from all of the files.
+//
+// The system-wide configuration is read from /etc/containers/storage.conf, or
+// /usr/share/containers/storage.conf if that file doesn't exist, followed by
+// the files in both of their drop-in directories.  A file in
+// /etc/containers/storage.conf.d masks a file with the same name in
+// /usr/share/containers/storage.conf.d.
+//
+// A rootless user's configuration is read from their own storage.conf, and
+// the files in its drop-in directory.  If they have a drop-in directory but
+// no storage.conf, the files in it are read after the system-wide
+// configuration, and the locations of the run and graph roots are only taken
+// from them, since the system-wide locations can't be used.
+
+const (
+	// configDropInSuffix is appended to the name of a configuration file
+	// to get the name of its drop-in directory.
+	configDropInSuffix = ".d"
+	// configDropInExtension is the extension of files in drop-in
+	// directories which are read.
+	configDropInExtension = ".conf"
+)
+
+// envOverrides maps the names of settings which can be overridden using
+// environment variables to the names of those variables.  The environment
+// variables take precedence over any configuration file.
+var envOverrides = []struct {
+	setting, variable string
+}{
+	{"storage.driver", "STORAGE_DRIVER"},
+	{"storage.runroot", "CONTAINERS_STORAGE_RUNROOT"},
+	{"storage.graphroot", "CONTAINERS_STORAGE_GRAPHROOT"},
+	{"storage.options", "STORAGE_OPTS"},
+}
+
+// ConfigSources maps the names of settings, in dotted form (e.g.
+// "storage.driver" or "storage.options.overlay.mount_program"), to the file
+// which the setting's effective value was read from.  Settings which are
+// overridden by an environment variable are mapped to the name of the
+// variable, prefixed with "$".
+type ConfigSources map[string]string
+
+// ConfigDropInDir returns the name of the drop-in directory for configFile.
+func ConfigDropInDir(configFile string) string {
+	return configFile + configDropInSuffix
+}
+
+// dropInFiles returns the paths of the files in the drop-in directories of
+// configFiles, sorted by name.  A file in the drop-in directory of a later
+// entry in configFiles masks a file with the same name in an earlier one.
+func dropInFiles(configFiles ...string) ([]string, error) {
+	byName := make(map[string]string)
+	for _, configFile := range configFiles {
+		dir := ConfigDropInDir(configFile)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, configDropInExtension) {
+				continue
+			}
+			byName[name] = filepath.Join(dir, name)
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		files = append(files, byName[name])
+	}
+	return files, nil
+}
+
+// ConfigFiles returns the list of files which are read, in order, when the
+// configuration is loaded from configFile: configFile itself, if it exists,
+// followed by the files in its drop-in directory.  If configFile is one of
+// the locations of the system-wide configuration file, the drop-in
+// directories of both of them are included, and if configFile doesn't exist,
+// the other location is read instead.
+func ConfigFiles(configFile string) ([]string, error) {
+	if configFile == vendorConfigFile || configFile == defaultOverrideConfigFile {
+		return systemConfigFiles(configFile)
+	}
+	var files []string
+	if _, err := os.Stat(configFile); err == nil {
+		files = append(files, configFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	dropIns, err := dropInFiles(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, dropIns...), nil
+}
+
+// systemConfigFiles returns the list of files which are read, in order, to
+// load the system-wide configuration.  The first of the locations of the
+// main file which exists is read, trying preferred first, if it is set, and
+// then the override and vendor locations.
+func systemConfigFiles(preferred ...string) ([]string, error) {
+	var files []string
+	for _, configFile := range append(preferred, defaultOverrideConfigFile, vendorConfigFile) {
+		_, err := os.Stat(configFile)
+		if err == nil {
+			files = append(files, configFile)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	dropIns, err := dropInFiles(vendorConfigFile, defaultOverrideConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, dropIns...), nil
+}
+
+// configFilesModTime returns the most recent modification time of the files
+// in the list, and of the directories containing them.  Adding a file to a
+// drop-in directory or removing one from it changes the modification time of
+// the directory.
+func configFilesModTime(configFile string, files []string) (latest int64) {
+	paths := append([]string{configFile, ConfigDropInDir(configFile)}, files...)
+	for _, file := range files {
+		paths = append(paths, filepath.Dir(file))
+	}
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().UnixNano() > latest {
+			latest = fi.ModTime().UnixNano()
+		}
+	}
+	return latest
+}
+
+// loadConfigFiles decodes the files, in order, into a single configuration,
+// and records which file each setting in it was read from, and which file
+// each setting that it didn't recognize was found in.
+func loadConfigFiles(files []string) (*TomlConfig, ConfigSources, ConfigSources, error) {
+	config := new(TomlConfig)
+	sources := make(ConfigSources)
+	unknown := make(ConfigSources)
+	for _, file := range files {
+		meta, err := toml.DecodeFile(file, config)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, nil, errors.Wrapf(err, "Failed to read %s", file)
+		}
+		if keys := meta.Undecoded(); len(keys) > 0 {
+			logrus.Warningf("Failed to decode the keys %q from %q.", keys, file)
+			for _, key := range keys {
+				unknown[key.String()] = file
+			}
+		}
+		for _, key := range meta.Keys() {
+			name := key.String()
+			if _, ok := unknown[name]; ok || meta.Type(key...) == "Hash" {
+				continue
+			}
+			sources[name] = file
+		}
+	}
+	for _, env := range envOverrides {
+		// STORAGE_OPTS replaces the driver options even if it's set to
+		// an empty value, but the others are ignored if they're empty.
+		if value, ok := os.LookupEnv(env.variable); ok && (value != "" || env.variable == "STORAGE_OPTS") {
+			sources[env.setting] = "$" + env.variable
+		}
+	}
+	return config, sources, unknown, nil
+}
+
+// GetConfigSources reports which file, or environment variable, the effective
+// value of each setting comes from when the configuration is loaded from
+// configFile and its drop-in directory.
+func GetConfigSources(configFile string) (ConfigSources, error) {
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return nil, err
+	}
+	_, sources, _, err := loadConfigFiles(files)
+	return sources, err
+}
+
+// DefaultConfigSources reports which file, or environment variable, the
+// effective value of each setting comes from in the configuration which
+// DefaultStoreOptions would use.  Settings which aren't listed have built-in
+// default values.
+func DefaultConfigSources(rootless bool, rootlessUID int) (ConfigSources, error) {
+	storageConf, err := DefaultConfigFile(rootless && rootlessUID != 0)
+	if err != nil {
+		return nil, err
+	}
+	files, _, err := storeConfigFiles(rootless, rootlessUID, storageConf)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && rootless && rootlessUID != 0 {
+		// The rootless defaults are derived from the system-wide
+		// configuration.
+		if files, err = systemConfigFiles(); err != nil {
+			return nil, err
+		}
+	}
+	_, sources, _, err := loadConfigFiles(files)
+	return sources, err
+}
+
+// storeConfigFiles returns the list of files which DefaultStoreOptions reads
+// if storageConf is the path of the configuration file that it uses.  If
+// storageConf doesn't exist, but a rootless user has a drop-in directory for
+// it, the list includes the system-wide configuration files followed by the
+// user's drop-ins, and layered is true.
+func storeConfigFiles(rootless bool, rootlessUID int, storageConf string) (files []string, layered bool, err error) {
+	if defaultConfigFileSet {
+		files, err = ConfigFiles(defaultConfigFile)
+		return files, false, err
+	}
+	_, err = os.Stat(storageConf)
+	if err == nil || !os.IsNotExist(err) || !rootless || rootlessUID == 0 {
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		files, err = ConfigFiles(storageConf)
+		return files, false, err
+	}
+	userDropIns, err := dropInFiles(storageConf)
+	if err != nil || len(userDropIns) == 0 {
+		return nil, false, err
+	}
+	files, err = systemConfigFiles()
+	if err != nil {
+		return nil, false, err
+	}
+	return append(files, userDropIns...), true, nil
+}
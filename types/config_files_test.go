@@ -0,0 +1,113 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestConfigDropIns(t *testing.T) {
+	for _, env := range []string{"STORAGE_DRIVER", "STORAGE_OPTS", "CONTAINERS_STORAGE_RUNROOT", "CONTAINERS_STORAGE_GRAPHROOT"} {
+		if value, ok := os.LookupEnv(env); ok {
+			os.Unsetenv(env)
+			defer os.Setenv(env, value)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "storage-conf")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	dropInDir := ConfigDropInDir(configFile)
+	assert.NilError(t, os.Mkdir(dropInDir, 0755))
+	for name, content := range map[string]string{
+		"storage.conf": `[storage]
+driver = "overlay"
+runroot = "/run/base"
+graphroot = "/var/lib/base"
+[storage.options]
+additionalimagestores = ["/a", "/b"]
+[storage.options.overlay]
+mountopt = "nodev"
+`,
+		"storage.conf.d/20-graphroot.conf": `[storage]
+graphroot = "/var/lib/dropin"
+`,
+		"storage.conf.d/10-stores.conf": `[storage.options]
+additionalimagestores = ["/c"]
+[storage.options.overlay]
+mount_program = "/usr/bin/true"
+`,
+		"storage.conf.d/30-ignored.txt": `[storage]
+driver = "vfs"
+`,
+	} {
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	files, err := ConfigFiles(configFile)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, files, []string{
+		configFile,
+		filepath.Join(dropInDir, "10-stores.conf"),
+		filepath.Join(dropInDir, "20-graphroot.conf"),
+	})
+
+	var storageOpts StoreOptions
+	ReloadConfigurationFile(configFile, &storageOpts)
+	assert.Equal(t, storageOpts.GraphDriverName, "overlay")
+	assert.Equal(t, storageOpts.RunRoot, "/run/base")
+	assert.Equal(t, storageOpts.GraphRoot, "/var/lib/dropin")
+	assert.DeepEqual(t, storageOpts.GraphDriverOptions, []string{
+		"overlay.imagestore=/c",
+		"overlay.mount_program=/usr/bin/true",
+		"overlay.mountopt=nodev",
+	})
+
+	sources, err := GetConfigSources(configFile)
+	assert.NilError(t, err)
+	assert.Equal(t, sources["storage.driver"], configFile)
+	assert.Equal(t, sources["storage.runroot"], configFile)
+	assert.Equal(t, sources["storage.graphroot"], filepath.Join(dropInDir, "20-graphroot.conf"))
+	assert.Equal(t, sources["storage.options.additionalimagestores"], filepath.Join(dropInDir, "10-stores.conf"))
+	assert.Equal(t, sources["storage.options.overlay.mountopt"], configFile)
+	_, ok := sources["storage.options"]
+	assert.Assert(t, !ok, "tables should not be listed as settings")
+
+	os.Setenv("CONTAINERS_STORAGE_GRAPHROOT", "/var/lib/env")
+	defer os.Unsetenv("CONTAINERS_STORAGE_GRAPHROOT")
+	ReloadConfigurationFile(configFile, &storageOpts)
+	assert.Equal(t, storageOpts.GraphRoot, "/var/lib/env")
+	sources, err = GetConfigSources(configFile)
+	assert.NilError(t, err)
+	assert.Equal(t, sources["storage.graphroot"], "$CONTAINERS_STORAGE_GRAPHROOT")
+}
+
+func TestDropInFilesMasking(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-conf")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	vendor := filepath.Join(dir, "usr", "storage.conf")
+	site := filepath.Join(dir, "etc", "storage.conf")
+	for _, file := range []string{
+		ConfigDropInDir(vendor) + "/10-a.conf",
+		ConfigDropInDir(vendor) + "/20-b.conf",
+		ConfigDropInDir(site) + "/20-b.conf",
+		ConfigDropInDir(site) + "/05-c.conf",
+	} {
+		assert.NilError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NilError(t, ioutil.WriteFile(file, nil, 0644))
+	}
+	files, err := dropInFiles(vendor, site)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, files, []string{
+		ConfigDropInDir(site) + "/05-c.conf",
+		ConfigDropInDir(vendor) + "/10-a.conf",
+		ConfigDropInDir(site) + "/20-b.conf",
+	})
+}
@@ -25,6 +25,8 @@ var (
 	ErrIncompleteOptions = errors.New("missing necessary StoreOptions")
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = errors.New("not a valid name for a big data item")
+	// ErrInvalidID indicates that an ID which is to be assigned to a new item is not acceptable.
+	ErrInvalidID = errors.New("not a valid ID")
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = errors.New("layer has children")
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
@@ -57,4 +59,46 @@ var (
 	ErrNotSupported = errors.New("not supported")
 	// ErrInvalidMappings is returned when the specified mappings are invalid.
 	ErrInvalidMappings = errors.New("invalid mappings specified")
+	// ErrInvalidNamespace is returned when the specified store namespace can't be used.
+	ErrInvalidNamespace = errors.New("invalid store namespace")
+	// ErrNamespaceQuotaExceeded is returned when creating an image or container would take a store namespace's usage over its quota.
+	ErrNamespaceQuotaExceeded = errors.New("store namespace quota exceeded")
+	// ErrLayerMountedReadOnly is returned when a layer which is mounted read-only is to be mounted for writing.
+	ErrLayerMountedReadOnly = errors.New("layer is mounted read-only")
+	// ErrLayerMountedByOthers is returned when a process tries to unmount a read-only mount of a layer which only other processes are using.
+	ErrLayerMountedByOthers = errors.New("layer is mounted by other processes")
+	// ErrImageStoreAccessDenied is returned when an additional image store requires an access token which wasn't supplied or isn't valid.
+	ErrImageStoreAccessDenied = errors.New("access to image store denied")
+	// ErrGraphRootChanged is returned when the filesystem which holds the graph root is not the one which was recorded for it.
+	ErrGraphRootChanged = errors.New("graph root filesystem changed")
+	// ErrAttachmentUnknown indicates that an image has no attachment of the specified kind with the specified digest.
+	ErrAttachmentUnknown = errors.New("attachment not known")
+	// ErrImagePinned is returned when the caller attempts to delete an image which has been pinned.
+	ErrImagePinned = errors.New("image is pinned")
+	// ErrLayerPinned is returned when the caller attempts to delete a layer which has been pinned.
+	ErrLayerPinned = errors.New("layer is pinned")
+	// ErrLayerMountMismatch is returned when a layer which is already mounted is to be mounted with a different set of additional lower directories.
+	ErrLayerMountMismatch = errors.New("layer is already mounted with different additional lower directories")
+	// ErrArtifactUnknown indicates that there was no artifact with the specified name or ID.
+	ErrArtifactUnknown = errors.New("artifact not known")
+	// ErrArtifactBlobUnknown indicates that an artifact does not include a blob with the specified digest.
+	ErrArtifactBlobUnknown = errors.New("artifact blob not known")
+	// ErrVolumeUnknown indicates that there was no volume with the specified name or ID.
+	ErrVolumeUnknown = errors.New("volume not known")
+	// ErrVolumeDriverUnknown indicates that no volume driver with the specified name has been registered.
+	ErrVolumeDriverUnknown = errors.New("volume driver not known")
+	// ErrVolumeMounted is returned when an operation can't be performed on a volume because it is mounted.
+	ErrVolumeMounted = errors.New("volume is mounted")
+	// ErrNoSpace is returned when there isn't enough free space left to add to a layer's contents without using up the space which is to be kept free.
+	ErrNoSpace = errors.New("not enough free space")
+	// ErrLayerMounted is returned when an operation can't be performed on a layer because it is mounted.
+	ErrLayerMounted = errors.New("layer is mounted")
+	// ErrDigestMismatch is returned when content doesn't match the digest which it was expected to have.
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrStoreCorrupt is returned when the metadata which a store keeps can't be parsed.
+	ErrStoreCorrupt = errors.New("storage metadata is corrupt")
+	// ErrIncompatibleDriver is returned when a graph driver can't be used with the storage which it was asked to manage.
+	ErrIncompatibleDriver = errors.New("graph driver can't be used with this storage")
+	// ErrStoreOptionsConflict is returned when a Store which is already open is asked for again using options which it can't honor.
+	ErrStoreOptionsConflict = errors.New("store is already open with different options")
 )
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,7 +13,10 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/containers/storage/drivers/overlay"
 	cfg "github.com/containers/storage/pkg/config"
+	"github.com/containers/storage/pkg/fscrypt"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/stringid"
+	units "github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +27,7 @@ type TomlConfig struct {
 		RunRoot             string            `toml:"runroot,omitempty"`
 		GraphRoot           string            `toml:"graphroot,omitempty"`
 		RootlessStoragePath string            `toml:"rootless_storage_path,omitempty"`
+		TempDir             string            `toml:"tempdir,omitempty"`
 		Options             cfg.OptionsConfig `toml:"options,omitempty"`
 	} `toml:"storage"`
 }
@@ -34,9 +39,13 @@ const (
 	defaultGraphRoot string = "/var/lib/containers/storage"
 )
 
+// vendorConfigFile is the path of the system wide storage.conf file which is
+// shipped with the distribution
+const vendorConfigFile = "/usr/share/containers/storage.conf"
+
 // defaultConfigFile path to the system wide storage.conf file
 var (
-	defaultConfigFile         = "/usr/share/containers/storage.conf"
+	defaultConfigFile         = vendorConfigFile
 	defaultOverrideConfigFile = "/etc/containers/storage.conf"
 	defaultConfigFileSet      = false
 	// DefaultStoreOptions is a reasonable default set of options.
@@ -93,6 +102,15 @@ func defaultStoreOptionsIsolated(rootless bool, rootlessUID int, storageConf str
 	if err != nil && !os.IsNotExist(err) {
 		return storageOpts, err
 	}
+	if err != nil && !defaultConfigFileSet && rootless && rootlessUID != 0 {
+		files, layered, err := storeConfigFiles(rootless, rootlessUID, storageConf)
+		if err != nil {
+			return storageOpts, err
+		}
+		if layered {
+			storageOpts = layerUserDropIns(storageConf, files, storageOpts)
+		}
+	}
 	if err == nil && !defaultConfigFileSet {
 		defaultRootlessRunRoot = storageOpts.RunRoot
 		defaultRootlessGraphRoot = storageOpts.GraphRoot
@@ -135,10 +153,50 @@ func defaultStoreOptionsIsolated(rootless bool, rootlessUID int, storageConf str
 		}
 		storageOpts.RootlessStoragePath = storagePath
 	}
+	if storageOpts.TempDir != "" {
+		tempDir, err := expandEnvPath(storageOpts.TempDir, rootlessUID)
+		if err != nil {
+			return storageOpts, err
+		}
+		storageOpts.TempDir = tempDir
+	}
 
 	return storageOpts, nil
 }
 
+// layerUserDropIns loads the configuration from files, which are the
+// system-wide configuration files followed by a rootless user's drop-ins for
+// storageConf, which doesn't exist.  The locations of the run and graph roots,
+// and the driver, are taken from rootlessOpts unless the user's drop-ins set
+// them.
+func layerUserDropIns(storageConf string, files []string, rootlessOpts StoreOptions) StoreOptions {
+	var storageOpts StoreOptions
+	sources := reloadConfigurationFiles(storageConf, files, &storageOpts)
+	userDropInDir := ConfigDropInDir(storageConf) + string(os.PathSeparator)
+	userSetting := func(setting string) bool {
+		source := sources[setting]
+		return strings.HasPrefix(source, userDropInDir) || strings.HasPrefix(source, "$")
+	}
+	if !userSetting("storage.runroot") {
+		storageOpts.RunRoot = rootlessOpts.RunRoot
+	}
+	if !userSetting("storage.graphroot") {
+		if userSetting("storage.rootless_storage_path") {
+			storageOpts.GraphRoot = storageOpts.RootlessStoragePath
+		} else {
+			storageOpts.GraphRoot = rootlessOpts.GraphRoot
+		}
+	}
+	if !userSetting("storage.driver") {
+		if storageOpts.GraphDriverName != rootlessOpts.GraphDriverName {
+			storageOpts.GraphDriverOptions = nil
+		}
+		storageOpts.GraphDriverName = rootlessOpts.GraphDriverName
+		storageOpts.GraphDriverOptions = append(append([]string{}, rootlessOpts.GraphDriverOptions...), storageOpts.GraphDriverOptions...)
+	}
+	return storageOpts
+}
+
 // DefaultStoreOptions returns the default storage ops for containers
 func DefaultStoreOptions(rootless bool, rootlessUID int) (StoreOptions, error) {
 	storageConf, err := DefaultConfigFile(rootless && rootlessUID != 0)
@@ -161,6 +219,14 @@ type StoreOptions struct {
 	// RootlessStoragePath is the storage path for rootless users
 	// default $HOME/.local/share/containers/storage
 	RootlessStoragePath string `toml:"rootless_storage_path"`
+	// TempDir, if set, is the filesystem path under which temporary
+	// files, such as staging directories for layers which are being
+	// added, and big data items which are being written, are kept before
+	// they are moved into the GraphRoot.  It can be on a different file
+	// system than the GraphRoot, in which case the files are copied into
+	// the GraphRoot instead of being renamed.  It should not be shared
+	// with other stores.
+	TempDir string `json:"tempdir,omitempty"`
 	// GraphDriverName is the underlying storage driver that we'll be
 	// using.  It only needs to be specified the first time a Store is
 	// initialized for a given RunRoot and GraphRoot.
@@ -183,6 +249,109 @@ type StoreOptions struct {
 	PullOptions map[string]string `toml:"pull_options"`
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `json:"disable-volatile,omitempty"`
+	// Namespace, if set, keeps the Store's image and container records
+	// separate from those of stores using other namespaces under the same
+	// GraphRoot and RunRoot, while still sharing their layers.
+	Namespace string `json:"namespace,omitempty"`
+	// Durability names the profile which controls how metadata files are
+	// synced to disk when they are saved.  See ioutils.ParseDurability.
+	Durability string `json:"durability,omitempty"`
+	// DurabilityBatchWindow is how long a save made using the "batched"
+	// durability profile waits for other saves to join it.
+	DurabilityBatchWindow time.Duration `json:"durability-batch-window,omitempty"`
+	// ImageStoreTokens maps the locations of additional image stores to
+	// the tokens which grant access to them, for stores which require one.
+	// Tokens are only checked by this library, and don't keep the stores'
+	// contents from being read by other means.
+	ImageStoreTokens map[string]string `json:"image-store-tokens,omitempty"`
+	// ImageStorePriorities maps the locations of additional image stores
+	// to their priorities.  Stores with higher priorities are searched
+	// for images and layers first, and stores which have the same
+	// priority, which is 0 if none is set, are searched in the order in
+	// which they were listed.
+	ImageStorePriorities map[string]int `json:"image-store-priorities,omitempty"`
+	// ReadOnly, if set, opens the Store for use with a GraphRoot which was
+	// populated ahead of time, for example as part of an operating system
+	// image, and which might not be writable.  Layers can be mounted, but
+	// only read-only, and every attempt to modify the Store fails with
+	// ErrStoreIsReadOnly.  Nothing is written to the GraphRoot, and only
+	// lock files and mount bookkeeping are written to the RunRoot.  Lock
+	// files which are already in the GraphRoot are only ever locked for
+	// reading, so the Store can be used to inspect a GraphRoot which
+	// belongs to another user, or which another process is using, as long
+	// as it is given a RunRoot of its own.
+	ReadOnly bool `json:"read-only,omitempty"`
+	// HardlinkDedup, if set, replaces files in layers which are added
+	// along with their contents, and which aren't writeable, with hard
+	// links to identical files in layers which are already present, if
+	// the graph driver keeps each layer's files separately, as the
+	// overlay driver does.  Files are only considered identical if their
+	// contents, permissions, ownership, and extended attributes match.
+	HardlinkDedup bool `json:"hardlink-dedup,omitempty"`
+	// ContainerRecordsLog, if set, records changes to the records of
+	// containers by appending them to a log instead of rewriting the
+	// whole list of containers every time one is created, modified, or
+	// deleted.  The log is periodically folded back into the list.
+	ContainerRecordsLog bool `json:"container-records-log,omitempty"`
+	// TrackLayerChanges, if set, uses fanotify to keep track of which
+	// paths in read-write layers are modified while they're mounted, so
+	// that the layers' changes and diffs can be produced without
+	// comparing all of their contents to their parents' contents.  It
+	// requires CAP_SYS_ADMIN, and a filesystem which supports looking
+	// up directories using file handles, so it won't help with every
+	// graph driver.
+	TrackLayerChanges bool `json:"track-layer-changes,omitempty"`
+	// ReservedSpace, if set, is the number of bytes which should be kept
+	// free on the filesystem which holds layers' contents.  Creating
+	// layers and extracting diffs into them fails with an error which
+	// wraps ErrNoSpace, instead of using up that space, and layers which
+	// were being populated when that happened are removed or emptied.
+	ReservedSpace int64 `json:"reserved-space,omitempty"`
+	// DigestAlgorithm, if set, names an algorithm, such as "sha512",
+	// which a new Store should use to compute digests of the uncompressed
+	// contents of layers, in addition to the "sha256" digests which are
+	// used as their DiffIDs.  A Store keeps using the algorithm which it
+	// was created with, which is "sha256" if none was specified.
+	DigestAlgorithm string `json:"digest-algorithm,omitempty"`
+	// IDGenerator, if set, is used to generate IDs for new layers,
+	// images, containers, and artifacts whose IDs aren't specified by
+	// the caller.  It can be used to make the IDs predictable in tests.
+	// IDs which are already in use are skipped.
+	IDGenerator stringid.Generator `json:"-"`
+	// EncryptionKeyProvider, if set, supplies the keys which the contents
+	// of layers are encrypted with, using the file system's encryption
+	// support, when they're created with an EncryptionKeyID, and which
+	// are needed to use the contents of layers which were.
+	EncryptionKeyProvider fscrypt.KeyProvider `json:"-"`
+	// EncryptionKeyID, if set, is the ID of the key which new layers are
+	// encrypted with if neither the caller nor the layer's parent
+	// specifies one.  It requires an EncryptionKeyProvider.
+	EncryptionKeyID string `json:"encryption-key-id,omitempty"`
+	// ImageBigDataProvider, if set, is asked for items of data which are
+	// associated with images in the store, such as their configurations
+	// and manifests, when they aren't present locally.  Items which it
+	// supplies are saved for later use, so that a store can start out
+	// holding only the metadata for its images.  Manifests are only saved
+	// if they match one of the image's digests.
+	ImageBigDataProvider ImageBigDataProvider `json:"-"`
+	// DeleteWorkers is the number of deleted layers whose contents are
+	// removed at the same time.  If the graph driver supports it, a
+	// deleted layer's contents are moved out of the way and its record is
+	// removed right away, and its contents are removed in the background.
+	// Deleted containers' directories are moved into a directory in the
+	// graph root and removed in the background, too.  If it is 0, which is
+	// the default, or negative, contents are removed before deleting them
+	// returns.
+	DeleteWorkers int `json:"delete-workers,omitempty"`
+}
+
+// ImageBigDataProvider retrieves items of data which are associated with
+// images, for a Store which doesn't have them locally.
+type ImageBigDataProvider interface {
+	// FetchImageBigData returns the contents of the named item for the
+	// image with the specified ID and names.  It should return an error
+	// which wraps os.ErrNotExist if it doesn't have the item either.
+	FetchImageBigData(id string, names []string, key string) ([]byte, error)
 }
 
 // isRootlessDriver returns true if the given storage driver is valid for containers running as non root
@@ -205,7 +374,12 @@ func getRootlessStorageOpts(rootlessUID int, systemOpts StoreOptions) (StoreOpti
 		return opts, err
 	}
 	opts.RunRoot = rootlessRuntime
-	if systemOpts.RootlessStoragePath != "" {
+	if runRoot := os.Getenv("CONTAINERS_STORAGE_RUNROOT"); runRoot != "" {
+		opts.RunRoot = runRoot
+	}
+	if graphRoot := os.Getenv("CONTAINERS_STORAGE_GRAPHROOT"); graphRoot != "" {
+		opts.GraphRoot = graphRoot
+	} else if systemOpts.RootlessStoragePath != "" {
 		opts.GraphRoot, err = expandEnvPath(systemOpts.RootlessStoragePath, rootlessUID)
 		if err != nil {
 			return opts, err
@@ -282,43 +456,48 @@ func ReloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptio
 	prevReloadConfig.mutex.Lock()
 	defer prevReloadConfig.mutex.Unlock()
 
-	fi, err := os.Stat(configFile)
+	files, err := ConfigFiles(configFile)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Printf("Failed to read %s %v\n", configFile, err.Error())
-		}
+		fmt.Printf("Failed to read %s %v\n", configFile, err.Error())
+		return
+	}
+	if len(files) == 0 {
 		return
 	}
 
-	mtime := fi.ModTime()
+	mtime := time.Unix(0, configFilesModTime(configFile, files))
 	if prevReloadConfig.storeOptions != nil && prevReloadConfig.mod == mtime && prevReloadConfig.configFile == configFile {
 		*storeOptions = *prevReloadConfig.storeOptions
 		return
 	}
 
-	ReloadConfigurationFile(configFile, storeOptions)
+	reloadConfigurationFiles(configFile, files, storeOptions)
 
 	prevReloadConfig.storeOptions = storeOptions
 	prevReloadConfig.mod = mtime
 	prevReloadConfig.configFile = configFile
 }
 
-// ReloadConfigurationFile parses the specified configuration file and overrides
-// the configuration in storeOptions.
+// ReloadConfigurationFile parses the specified configuration file, and the
+// files in its drop-in directory, and overrides the configuration in
+// storeOptions.
 func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
-	config := new(TomlConfig)
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		fmt.Printf("Failed to read %s %v\n", configFile, err.Error())
+		return
+	}
+	reloadConfigurationFiles(configFile, files, storeOptions)
+}
 
-	meta, err := toml.DecodeFile(configFile, &config)
-	if err == nil {
-		keys := meta.Undecoded()
-		if len(keys) > 0 {
-			logrus.Warningf("Failed to decode the keys %q from %q.", keys, configFile)
-		}
-	} else {
-		if !os.IsNotExist(err) {
-			fmt.Printf("Failed to read %s %v\n", configFile, err.Error())
-			return
-		}
+// reloadConfigurationFiles parses the configuration files, in order, and
+// overrides the configuration in storeOptions.  It returns a record of which
+// file, or environment variable, each setting's value came from.
+func reloadConfigurationFiles(configFile string, files []string, storeOptions *StoreOptions) ConfigSources {
+	config, sources, _, err := loadConfigFiles(files)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return nil
 	}
 
 	// Clear storeOptions of previous settings
@@ -335,20 +514,54 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 		storeOptions.GraphDriverName = overlayDriver
 	}
 	if storeOptions.GraphDriverName == "" {
+		if len(files) > 0 {
+			configFile = files[0]
+		}
 		logrus.Errorf("The storage 'driver' option must be set in %s, guarantee proper operation.", configFile)
 	}
+	if runRoot := os.Getenv("CONTAINERS_STORAGE_RUNROOT"); runRoot != "" {
+		config.Storage.RunRoot = runRoot
+	}
 	if config.Storage.RunRoot != "" {
 		storeOptions.RunRoot = config.Storage.RunRoot
 	}
+	if graphRoot := os.Getenv("CONTAINERS_STORAGE_GRAPHROOT"); graphRoot != "" {
+		config.Storage.GraphRoot = graphRoot
+	}
 	if config.Storage.GraphRoot != "" {
 		storeOptions.GraphRoot = config.Storage.GraphRoot
 	}
 	if config.Storage.RootlessStoragePath != "" {
 		storeOptions.RootlessStoragePath = config.Storage.RootlessStoragePath
 	}
+	if config.Storage.TempDir != "" {
+		storeOptions.TempDir = config.Storage.TempDir
+	}
 	for _, s := range config.Storage.Options.AdditionalImageStores {
 		storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, fmt.Sprintf("%s.imagestore=%s", config.Storage.Driver, s))
 	}
+	if config.Storage.Options.AdditionalImageStoreTokens != nil {
+		storeOptions.ImageStoreTokens = config.Storage.Options.AdditionalImageStoreTokens
+	}
+	if config.Storage.Options.AdditionalImageStorePriorities != nil {
+		storeOptions.ImageStorePriorities = config.Storage.Options.AdditionalImageStorePriorities
+	}
+	for _, setting := range []struct {
+		option string
+		values map[string]string
+	}{
+		{"imagestore_mount_program", config.Storage.Options.AdditionalImageStoreMountPrograms},
+		{"imagestore_mountopt", config.Storage.Options.AdditionalImageStoreMountOpts},
+	} {
+		stores := make([]string, 0, len(setting.values))
+		for store := range setting.values {
+			stores = append(stores, store)
+		}
+		sort.Strings(stores)
+		for _, store := range stores {
+			storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, fmt.Sprintf("%s.%s=%s=%s", config.Storage.Driver, setting.option, store, setting.values[store]))
+		}
+	}
 	for _, s := range config.Storage.Options.AdditionalLayerStores {
 		storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, fmt.Sprintf("%s.additionallayerstore=%s", config.Storage.Driver, s))
 	}
@@ -380,7 +593,7 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 		mappings, err := idtools.NewIDMappings(config.Storage.Options.RemapUser, config.Storage.Options.RemapGroup)
 		if err != nil {
 			fmt.Printf("Error initializing ID mappings for %s:%s %v\n", config.Storage.Options.RemapUser, config.Storage.Options.RemapGroup, err)
-			return
+			return sources
 		}
 		storeOptions.UIDMap = mappings.UIDs()
 		storeOptions.GIDMap = mappings.GIDs()
@@ -410,6 +623,30 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 	}
 
 	storeOptions.DisableVolatile = config.Storage.Options.DisableVolatile
+	storeOptions.ReadOnly = config.Storage.Options.ReadOnly
+	storeOptions.HardlinkDedup = config.Storage.Options.HardlinkDedup
+	storeOptions.ContainerRecordsLog = config.Storage.Options.ContainerRecordsLog
+	storeOptions.TrackLayerChanges = config.Storage.Options.TrackLayerChanges
+	storeOptions.DigestAlgorithm = config.Storage.Options.DigestAlgorithm
+	storeOptions.DeleteWorkers = config.Storage.Options.DeleteWorkers
+	if config.Storage.Options.ReservedSpace != "" {
+		reserved, err := units.RAMInBytes(config.Storage.Options.ReservedSpace)
+		if err != nil {
+			fmt.Printf("Error parsing reserved_space %q: %v\n", config.Storage.Options.ReservedSpace, err)
+		} else {
+			storeOptions.ReservedSpace = reserved
+		}
+	}
+
+	storeOptions.Durability = config.Storage.Options.Durability
+	if config.Storage.Options.DurabilityBatchWindow != "" {
+		window, err := time.ParseDuration(config.Storage.Options.DurabilityBatchWindow)
+		if err != nil {
+			fmt.Printf("Error parsing durability_batch_window %q: %v\n", config.Storage.Options.DurabilityBatchWindow, err)
+		} else {
+			storeOptions.DurabilityBatchWindow = window
+		}
+	}
 
 	storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, cfg.GetGraphDriverOptions(storeOptions.GraphDriverName, config.Storage.Options)...)
 
@@ -419,6 +656,7 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) {
 	if len(storeOptions.GraphDriverOptions) == 1 && storeOptions.GraphDriverOptions[0] == "" {
 		storeOptions.GraphDriverOptions = nil
 	}
+	return sources
 }
 
 func Options() StoreOptions {
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/containers/storage/pkg/idtools"
 	"github.com/sirupsen/logrus"
 	"gotest.tools/assert"
 )
@@ -111,6 +113,26 @@ func TestGetRootlessStorageOpts2(t *testing.T) {
 	assert.Equal(t, storageOpts.GraphRoot, expectedPath)
 }
 
+func TestStoreOptionsForUID(t *testing.T) {
+	u, err := user.LookupId("65534")
+	if err != nil {
+		t.Skipf("no user with UID 65534: %v", err)
+	}
+	storageOpts, err := StoreOptionsForUID(65534)
+	assert.NilError(t, err)
+	assert.Equal(t, storageOpts.RunRoot, "/run/user/65534/containers")
+	if defaultStoreOptions.RootlessStoragePath == "" {
+		assert.Equal(t, storageOpts.GraphRoot, filepath.Join(u.HomeDir, ".local/share/containers/storage"))
+	}
+	assert.Assert(t, len(storageOpts.UIDMap) > 0)
+	assert.Equal(t, storageOpts.UIDMap[0], idtools.IDMap{ContainerID: 0, HostID: 65534, Size: 1})
+	assert.Assert(t, len(storageOpts.GIDMap) > 0)
+	assert.Equal(t, storageOpts.GIDMap[0].ContainerID, 0)
+	for i, m := range storageOpts.UIDMap[1:] {
+		assert.Equal(t, m.ContainerID, storageOpts.UIDMap[i].ContainerID+storageOpts.UIDMap[i].Size)
+	}
+}
+
 func TestReloadConfigurationFile(t *testing.T) {
 	content := bytes.NewBufferString("")
 	logrus.SetOutput(content)
@@ -0,0 +1,107 @@
+package types
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// userRunDirParent is the directory which holds each user's runtime
+// directory.
+const userRunDirParent = "/run/user"
+
+// StoreOptionsForUID returns the storage options which the user with the
+// specified UID would use by default when running rootless, for use by a
+// privileged process which manages stores on behalf of other users.  Unlike
+// DefaultStoreOptions, it doesn't consult the calling process's environment.
+// The run root is placed under /run/user/$UID, and the graph root under the
+// user's home directory, unless the system-wide configuration sets a
+// rootless_storage_path or the user's own storage.conf says otherwise.  The
+// UID and GID maps map root in the store to the user and their primary group,
+// and the rest of the IDs to the user's subordinate IDs from /etc/subuid and
+// /etc/subgid, if there are any.  Since the store will be used by a process
+// which is more privileged than the user, only the locations of the store are
+// taken from the user's storage.conf.  The driver is always the one which the
+// system-wide configuration names, and options for it, including its
+// mount_program, are ignored.
+func StoreOptionsForUID(uid int) (StoreOptions, error) {
+	if uid == 0 {
+		return DefaultStoreOptions(false, 0)
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return StoreOptions{}, errors.Wrapf(err, "looking up user with UID %d", uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return StoreOptions{}, errors.Wrapf(err, "parsing primary GID %q of user %q", u.Gid, u.Username)
+	}
+	expand := func(path string) string {
+		path = strings.Replace(path, "$UID", strconv.Itoa(uid), -1)
+		path = strings.Replace(path, "$HOME", u.HomeDir, -1)
+		return filepath.Clean(path)
+	}
+
+	systemOpts := defaultStoreOptions
+	storageOpts := StoreOptions{
+		RunRoot:   filepath.Join(UserRunDir(uid), "containers"),
+		GraphRoot: filepath.Join(u.HomeDir, ".local", "share", "containers", "storage"),
+	}
+	if systemOpts.RootlessStoragePath != "" {
+		storageOpts.GraphRoot = expand(systemOpts.RootlessStoragePath)
+	}
+	if driver := systemOpts.GraphDriverName; isRootlessDriver(driver) {
+		storageOpts.GraphDriverName = driver
+		if driver == overlay2 {
+			storageOpts.GraphDriverName = overlayDriver
+		}
+	}
+
+	userConf := filepath.Join(u.HomeDir, ".config", "containers", "storage.conf")
+	if _, err := os.Stat(userConf); err == nil {
+		var userOpts StoreOptions
+		ReloadConfigurationFile(userConf, &userOpts)
+		if userOpts.RunRoot != "" {
+			storageOpts.RunRoot = expand(userOpts.RunRoot)
+		}
+		if userOpts.GraphRoot != "" {
+			storageOpts.GraphRoot = expand(userOpts.GraphRoot)
+		} else if userOpts.RootlessStoragePath != "" {
+			storageOpts.GraphRoot = expand(userOpts.RootlessStoragePath)
+		}
+		if userOpts.GraphDriverName != "" || len(userOpts.GraphDriverOptions) > 0 {
+			logrus.Debugf("ignoring driver settings from %q", userConf)
+		}
+	} else if !os.IsNotExist(err) {
+		return StoreOptions{}, err
+	}
+
+	storageOpts.UIDMap = []idtools.IDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	storageOpts.GIDMap = []idtools.IDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+	mappings, err := idtools.NewIDMappings(u.Username, u.Username)
+	if err != nil {
+		logrus.Debugf("not mapping subordinate IDs for user %q: %v", u.Username, err)
+		return storageOpts, nil
+	}
+	for _, m := range mappings.UIDs() {
+		m.ContainerID++
+		storageOpts.UIDMap = append(storageOpts.UIDMap, m)
+	}
+	for _, m := range mappings.GIDs() {
+		m.ContainerID++
+		storageOpts.GIDMap = append(storageOpts.GIDMap, m)
+	}
+	return storageOpts, nil
+}
+
+// UserRunDir returns the location of the runtime directory of the user with
+// the specified UID.
+func UserRunDir(uid int) string {
+	return filepath.Join(userRunDirParent, strconv.Itoa(uid))
+}
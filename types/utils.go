@@ -188,26 +188,5 @@ func DefaultConfigFile(rootless bool) (string, error) {
 }
 
 func reloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptions) {
-	prevReloadConfig.mutex.Lock()
-	defer prevReloadConfig.mutex.Unlock()
-
-	fi, err := os.Stat(configFile)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Printf("Failed to read %s %v\n", configFile, err.Error())
-		}
-		return
-	}
-
-	mtime := fi.ModTime()
-	if prevReloadConfig.storeOptions != nil && prevReloadConfig.mod == mtime && prevReloadConfig.configFile == configFile {
-		*storeOptions = *prevReloadConfig.storeOptions
-		return
-	}
-
-	ReloadConfigurationFile(configFile, storeOptions)
-
-	prevReloadConfig.storeOptions = storeOptions
-	prevReloadConfig.mod = mtime
-	prevReloadConfig.configFile = configFile
+	ReloadConfigurationFileIfNeeded(configFile, storeOptions)
 }
@@ -271,6 +271,7 @@ func TestDefaultStoreOpts(t *testing.T) {
 	assert.Equal(t, storageOpts.RunRoot, expectedPath)
 	assert.Equal(t, storageOpts.GraphRoot, expectedPath)
 	assert.Equal(t, storageOpts.RootlessStoragePath, expectedPath)
+	assert.Equal(t, storageOpts.TempDir, filepath.Join(os.Getenv("HOME"), "1000", "containers/tmp"))
 }
 
 func TestStorageConfOverrideEnvironmentDefaultConfigFileRootless(t *testing.T) {
@@ -0,0 +1,300 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/overlay"
+	// register the graph drivers, so that their options are known
+	_ "github.com/containers/storage/drivers/register"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/parsers"
+)
+
+// DiagnosticSeverity indicates how serious a problem which was found by
+// ValidateOptions is.
+type DiagnosticSeverity string
+
+const (
+	// DiagnosticError indicates a problem which will prevent a store from
+	// being initialized, or cause it to misbehave.
+	DiagnosticError DiagnosticSeverity = "error"
+	// DiagnosticWarning indicates a setting which is ignored, or which may
+	// not work on this system.
+	DiagnosticWarning DiagnosticSeverity = "warning"
+)
+
+// Diagnostic describes a problem with a configuration.
+type Diagnostic struct {
+	// Severity indicates how serious the problem is.
+	Severity DiagnosticSeverity `json:"severity"`
+	// Setting is the name of the setting which has the problem, in
+	// dotted form (e.g. "storage.graphroot"), or the name of a driver
+	// option (e.g. "overlay.mount_program").
+	Setting string `json:"setting"`
+	// Source is the file, or environment variable, which the setting's
+	// value came from, if that is known.
+	Source string `json:"source,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+// String formats the diagnostic for display.
+func (d Diagnostic) String() string {
+	if d.Source != "" {
+		return fmt.Sprintf("%s: %s: %s (set in %s)", d.Severity, d.Setting, d.Message, d.Source)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Severity, d.Setting, d.Message)
+}
+
+// validator accumulates diagnostics about a configuration.
+type validator struct {
+	diagnostics []Diagnostic
+	sources     ConfigSources
+}
+
+func (v *validator) add(severity DiagnosticSeverity, setting, source, format string, args ...interface{}) {
+	if source == "" && v.sources != nil {
+		source = v.sources[setting]
+	}
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Severity: severity,
+		Setting:  setting,
+		Source:   source,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// driverOptionSource returns the source of a driver option, which could have
+// been set in the driver's table or in the generic options table.
+func (v *validator) driverOptionSource(driver, name string) string {
+	if v.sources == nil {
+		return ""
+	}
+	if source, ok := v.sources["storage.options."+driver+"."+name]; ok {
+		return source
+	}
+	if source, ok := v.sources["storage.options."+name]; ok {
+		return source
+	}
+	return v.sources["storage.options"]
+}
+
+// ValidateOptions checks the options for problems which would prevent a store
+// from being initialized with them, or cause it to behave unexpectedly, and
+// returns a list of the problems that it found.
+func ValidateOptions(options StoreOptions) []Diagnostic {
+	v := &validator{}
+	v.validate(options)
+	return v.diagnostics
+}
+
+// ValidateConfigFile loads the configuration from configFile, and the files
+// in its drop-in directory, checks it for problems, including settings which
+// aren't recognized, and returns a list of the problems that it found.  The
+// diagnostics include the names of the files which set the settings that they
+// describe.
+func ValidateConfigFile(configFile string) ([]Diagnostic, error) {
+	files, err := ConfigFiles(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: configFile, Err: os.ErrNotExist}
+	}
+	_, sources, unknown, err := loadConfigFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{sources: sources}
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v.add(DiagnosticWarning, name, unknown[name], "unrecognized setting is ignored")
+	}
+	var options StoreOptions
+	reloadConfigurationFiles(configFile, files, &options)
+	v.validate(options)
+	return v.diagnostics, nil
+}
+
+func (v *validator) validate(options StoreOptions) {
+	for _, path := range []struct {
+		setting, value string
+		required       bool
+	}{
+		{"storage.runroot", options.RunRoot, true},
+		{"storage.graphroot", options.GraphRoot, true},
+		{"storage.rootless_storage_path", options.RootlessStoragePath, false},
+		{"storage.tempdir", options.TempDir, false},
+	} {
+		if path.value == "" {
+			if path.required {
+				v.add(DiagnosticError, path.setting, "", "must be set")
+			}
+			continue
+		}
+		expanded, _ := expandEnvPath(path.value, getRootlessUID())
+		if !filepath.IsAbs(expanded) {
+			v.add(DiagnosticError, path.setting, "", "%q is not an absolute path", path.value)
+		}
+	}
+
+	driver := options.GraphDriverName
+	if driver == overlay2 {
+		driver = overlayDriver
+	}
+	if driver != "" {
+		if names, ok := graphdriver.GetOptionNames(driver); !ok {
+			v.add(DiagnosticError, "storage.driver", "", "unknown storage driver %q", options.GraphDriverName)
+		} else {
+			v.validateDriverOptions(driver, names, options.GraphDriverOptions)
+		}
+	}
+
+	if len(options.UIDMap) > 0 && len(options.GIDMap) == 0 {
+		v.add(DiagnosticWarning, "storage.options.remap-gids", "", "UID mappings are set, but GID mappings are not")
+	}
+	if len(options.GIDMap) > 0 && len(options.UIDMap) == 0 {
+		v.add(DiagnosticWarning, "storage.options.remap-uids", "", "GID mappings are set, but UID mappings are not")
+	}
+	for _, maps := range []struct {
+		setting string
+		maps    []idtools.IDMap
+	}{
+		{"storage.options.remap-uids", options.UIDMap},
+		{"storage.options.remap-gids", options.GIDMap},
+	} {
+		if overlapping := overlappingIDMaps(maps.maps); overlapping != "" {
+			v.add(DiagnosticError, maps.setting, "", "mappings %s overlap", overlapping)
+		}
+	}
+
+	if options.AutoNsMinSize > 0 && options.AutoNsMaxSize > 0 && options.AutoNsMinSize > options.AutoNsMaxSize {
+		v.add(DiagnosticError, "storage.options.auto-userns-min-size", "", "%d is larger than auto-userns-max-size (%d)", options.AutoNsMinSize, options.AutoNsMaxSize)
+	}
+	if _, err := ioutils.ParseDurability(options.Durability); err != nil {
+		v.add(DiagnosticError, "storage.options.durability", "", "%v", err)
+	}
+	if options.DurabilityBatchWindow < 0 {
+		v.add(DiagnosticError, "storage.options.durability_batch_window", "", "must not be negative")
+	}
+}
+
+// validateDriverOptions checks the options for the named driver.
+func (v *validator) validateDriverOptions(driver string, names graphdriver.OptionNames, options []string) {
+	var mountProgram, forceMask, mountOpt string
+	for _, option := range options {
+		key, val, err := parsers.ParseKeyValueOpt(option)
+		if err != nil {
+			v.add(DiagnosticError, option, v.sources["storage.options"], "%v", err)
+			continue
+		}
+		key = strings.ToLower(key)
+		prefix, name := "", key
+		if i := strings.Index(key, "."); i >= 0 {
+			prefix, name = key[:i], key[i+1:]
+		}
+		source := v.driverOptionSource(driver, name)
+		if prefix != "" && !stringInSlice(prefix, names.Prefixes) {
+			v.add(DiagnosticError, key, source, "option is not for the %q driver", driver)
+			continue
+		}
+		if !stringInSlice(name, names.Names) {
+			v.add(DiagnosticError, key, source, "option is not supported by the %q driver", driver)
+			continue
+		}
+		if driver == overlayDriver {
+			if err := overlay.ValidateOptions([]string{option}); err != nil {
+				v.add(DiagnosticError, key, source, "%v", err)
+				continue
+			}
+		}
+		switch name {
+		case "mount_program":
+			mountProgram = val
+		case "force_mask":
+			forceMask = key
+		case "mountopt":
+			mountOpt = val
+		}
+	}
+	if forceMask != "" && mountProgram == "" {
+		v.add(DiagnosticError, forceMask, v.driverOptionSource(driver, "force_mask"), "force_mask requires mount_program to be set")
+	}
+
+	if driver == overlayDriver && mountProgram == "" {
+		if supported, known := kernelSupportsFilesystem("overlay"); known && !supported {
+			v.add(DiagnosticWarning, "storage.driver", "", "the kernel doesn't currently support overlay file systems; the overlay module may need to be loaded, or mount_program set")
+		}
+		for _, o := range strings.Split(mountOpt, ",") {
+			if o != "metacopy=on" {
+				continue
+			}
+			if _, err := os.Stat("/sys/module/overlay/parameters/metacopy"); os.IsNotExist(err) {
+				v.add(DiagnosticWarning, "overlay.mountopt", v.driverOptionSource(driver, "mountopt"), "the kernel's overlay file system doesn't support metacopy")
+			}
+		}
+	} else if driver == "btrfs" || driver == "zfs" || driver == "aufs" {
+		if supported, known := kernelSupportsFilesystem(driver); known && !supported {
+			v.add(DiagnosticWarning, "storage.driver", "", "the kernel doesn't currently support %s file systems", driver)
+		}
+	}
+}
+
+// kernelSupportsFilesystem checks if the named file system type is listed in
+// /proc/filesystems.  If that can't be read, known is false.
+func kernelSupportsFilesystem(fsType string) (supported, known bool) {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fsType {
+			return true, true
+		}
+	}
+	return false, scanner.Err() == nil
+}
+
+// overlappingIDMaps returns a description of the first pair of mappings in
+// the list whose container or host ID ranges overlap, or "" if there are none.
+func overlappingIDMaps(maps []idtools.IDMap) string {
+	format := func(m idtools.IDMap) string {
+		return strconv.Itoa(m.ContainerID) + ":" + strconv.Itoa(m.HostID) + ":" + strconv.Itoa(m.Size)
+	}
+	overlaps := func(a, aSize, b, bSize int) bool {
+		return a < b+bSize && b < a+aSize
+	}
+	for i := range maps {
+		for j := i + 1; j < len(maps); j++ {
+			if overlaps(maps[i].ContainerID, maps[i].Size, maps[j].ContainerID, maps[j].Size) ||
+				overlaps(maps[i].HostID, maps[i].Size, maps[j].HostID, maps[j].Size) {
+				return format(maps[i]) + " and " + format(maps[j])
+			}
+		}
+	}
+	return ""
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/idtools"
+	"gotest.tools/assert"
+)
+
+// findDiagnostic returns the first diagnostic about the setting, if there is one.
+func findDiagnostic(diagnostics []Diagnostic, setting string) *Diagnostic {
+	for i := range diagnostics {
+		if diagnostics[i].Setting == setting {
+			return &diagnostics[i]
+		}
+	}
+	return nil
+}
+
+func TestValidateOptions(t *testing.T) {
+	valid := StoreOptions{
+		RunRoot:            "/run/containers/storage",
+		GraphRoot:          "/var/lib/containers/storage",
+		GraphDriverName:    "vfs",
+		GraphDriverOptions: []string{"vfs.ignore_chown_errors=true", "vfs.pristine_compression=zstd", "vfs.pristine_cache_dir=/var/cache/pristine"},
+	}
+	assert.Equal(t, len(ValidateOptions(valid)), 0)
+
+	invalid := StoreOptions{
+		RunRoot:            "relative/run",
+		GraphDriverName:    "overlay",
+		GraphDriverOptions: []string{"overlay.force_mask=0755", "vfs.imagestore=/foo", "overlay.bogus=1"},
+		UIDMap:             []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}, {ContainerID: 1000, HostID: 1000, Size: 1}},
+		AutoNsMinSize:      2048,
+		AutoNsMaxSize:      1024,
+		Durability:         "sometimes",
+	}
+	diagnostics := ValidateOptions(invalid)
+	for setting, severity := range map[string]DiagnosticSeverity{
+		"storage.runroot":                      DiagnosticError,
+		"storage.graphroot":                    DiagnosticError,
+		"overlay.force_mask":                   DiagnosticError,
+		"vfs.imagestore":                       DiagnosticError,
+		"overlay.bogus":                        DiagnosticError,
+		"storage.options.remap-uids":           DiagnosticError,
+		"storage.options.remap-gids":           DiagnosticWarning,
+		"storage.options.auto-userns-min-size": DiagnosticError,
+		"storage.options.durability":           DiagnosticError,
+	} {
+		d := findDiagnostic(diagnostics, setting)
+		if assert.Check(t, d != nil, "expected a diagnostic about %s in %v", setting, diagnostics) {
+			assert.Equal(t, d.Severity, severity, d.String())
+		}
+	}
+
+	diagnostics = ValidateOptions(StoreOptions{RunRoot: "/run", GraphRoot: "/var", GraphDriverName: "nonesuch"})
+	assert.Assert(t, findDiagnostic(diagnostics, "storage.driver") != nil)
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage-conf")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	assert.NilError(t, ioutil.WriteFile(configFile, []byte(`[storage]
+driver = "overlay"
+runroot = "/run/containers/storage"
+graphroot = "/var/lib/containers/storage"
+unknown_setting = true
+[storage.options.overlay]
+force_mask = "0700"
+`), 0644))
+
+	diagnostics, err := ValidateConfigFile(configFile)
+	assert.NilError(t, err)
+	d := findDiagnostic(diagnostics, "storage.unknown_setting")
+	if assert.Check(t, d != nil, "%v", diagnostics) {
+		assert.Equal(t, d.Severity, DiagnosticWarning)
+		assert.Equal(t, d.Source, configFile)
+	}
+	d = findDiagnostic(diagnostics, "overlay.force_mask")
+	if assert.Check(t, d != nil, "%v", diagnostics) {
+		assert.Equal(t, d.Severity, DiagnosticError)
+		assert.Equal(t, d.Source, configFile)
+	}
+
+	_, err = ValidateConfigFile(filepath.Join(dir, "missing.conf"))
+	assert.Assert(t, os.IsNotExist(err))
+}
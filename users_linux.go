@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// usersLock is a shared lock, on a file in the graph root, which every Store
+// holds for as long as it's in use, so that Shutdown() can tell whether or not
+// it's the last user of the graph root.  It uses flock(), and not the fcntl()
+// locks which our other lock files use, since a process can hold more than
+// one flock() lock on the same file, and closing one of them doesn't release
+// the others.
+type usersLock struct {
+	f *os.File
+}
+
+// openUsersLock opens the lock file at path, and takes a shared lock on it,
+// waiting for any Store which is shutting down to finish checking for other
+// users.  If the file can't be created, nil is returned, and we won't be able
+// to tell if we're the last user.
+func openUsersLock(path string) (*usersLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		if f, err = os.Open(path); err != nil {
+			return nil, nil
+		}
+	}
+	l := &usersLock{f: f}
+	if err := l.flock(unix.LOCK_SH); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *usersLock) flock(how int) error {
+	for {
+		err := unix.Flock(int(l.f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// whileLastUser calls fn if no other Store is using the graph root, while
+// holding an exclusive lock which keeps any other Store from starting to use
+// it until fn returns.  It returns true if fn was called.
+func (l *usersLock) whileLastUser(fn func() error) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	if err := l.flock(unix.LOCK_EX | unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			// Converting the lock may have dropped it.
+			return false, l.flock(unix.LOCK_SH)
+		}
+		return false, err
+	}
+	err := fn()
+	if err2 := l.flock(unix.LOCK_SH); err == nil {
+		err = err2
+	}
+	return true, err
+}
+
+// close releases the lock.
+func (l *usersLock) close() {
+	if l != nil {
+		l.f.Close()
+	}
+}
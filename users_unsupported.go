@@ -0,0 +1,23 @@
+// +build !linux
+
+package storage
+
+// usersLock would let Shutdown() tell whether or not it's the last user of
+// the graph root.  We don't know how to do that here.
+type usersLock struct{}
+
+// openUsersLock returns nil, since we can't tell who else is using the graph
+// root here.
+func openUsersLock(path string) (*usersLock, error) {
+	return nil, nil
+}
+
+// whileLastUser doesn't call fn, since we can't tell if we're the last user of
+// the graph root here.
+func (l *usersLock) whileLastUser(fn func() error) (bool, error) {
+	return false, nil
+}
+
+// close does nothing here.
+func (l *usersLock) close() {
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"os"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/types"
+)
+
+// GetStoreForUID opens the store which the user with the specified UID would
+// use by default when running rootless, using the options which
+// types.StoreOptionsForUID() computes for them, for use by a privileged
+// process which manages stores on behalf of other users.  The store's run
+// root and graph root are created if they don't already exist, owned by the
+// user, but only inside of directories which the user already owns, or inside
+// of the user's runtime directory under /run/user, which is created if it
+// doesn't exist yet.
+//
+// Since the store's directories are controlled by the user, they're opened
+// one component at a time, without following symbolic links in any of the
+// directories which the calling process doesn't own and control, and
+// anything in them which the calling process created is given to the user,
+// through descriptors which are opened the same way, once the store has been
+// opened, and again when the returned store is shut down.  The store itself
+// still refers to its files by name while it's in use, so it should only be
+// kept open for as long as it's needed.
+func GetStoreForUID(uid int) (Store, error) {
+	options, err := types.StoreOptionsForUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 || os.Geteuid() == uid {
+		return GetStore(options)
+	}
+	owner := idtools.IDPair{UID: uid, GID: options.GIDMap[0].HostID}
+	dirs := []string{options.RunRoot, options.GraphRoot}
+	for _, dir := range dirs {
+		if err := createUserDir(dir, owner); err != nil {
+			return nil, err
+		}
+	}
+	store, err := GetStore(options)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := chownUserDir(dir, owner); err != nil {
+			return nil, err
+		}
+	}
+	return &userStore{Store: store, owner: owner, dirs: dirs}, nil
+}
+
+// userStore is a Store which GetStoreForUID() opened on behalf of a user.
+type userStore struct {
+	Store
+	owner idtools.IDPair
+	dirs  []string
+}
+
+// Shutdown shuts the store down, and then gives anything in its directories
+// which the calling process created while it was open to the user.
+func (s *userStore) Shutdown(force bool) ([]string, error) {
+	layers, err := s.Store.Shutdown(force)
+	if err != nil {
+		return layers, err
+	}
+	for _, dir := range s.dirs {
+		if err := chownUserDir(dir, s.owner); err != nil {
+			return layers, err
+		}
+	}
+	return layers, nil
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/types"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// openUserDirEntry opens name, an entry in the directory which dirfd refers
+// to, if it's a directory, and not a symbolic link to one.
+func openUserDirEntry(dirfd int, name string) (int, error) {
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	for {
+		fd, err := unix.Openat2(dirfd, name, &how)
+		if err == unix.ENOSYS {
+			// Without openat2(), O_NOFOLLOW does the same for a
+			// single component.
+			return unix.Openat(dirfd, name, int(how.Flags), 0)
+		}
+		// EAGAIN means that something was renamed while the path
+		// was being resolved.
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// trustedUserDirParent returns true if st describes a directory which the
+// calling process owns and which nobody else can modify, so that entries in
+// it can't be replaced by the user we're acting on behalf of.
+func trustedUserDirParent(st *unix.Stat_t) bool {
+	return int(st.Uid) == os.Geteuid() && st.Mode&0o022 == 0
+}
+
+// openUserDir opens dir, one component at a time.  Once it reaches a
+// directory which the calling process doesn't control, it stops following
+// symbolic links, so that the user can't redirect it somewhere else.  If
+// create is set, the directories in dir which don't exist are created, owned
+// by owner, if the directory which would contain them is owned by owner, or
+// if it's owner's runtime directory.
+func openUserDir(dir string, owner idtools.IDPair, create bool) (int, error) {
+	fd, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: "/", Err: err}
+	}
+	runDir := types.UserRunDir(owner.UID)
+	trusted, current := true, "/"
+	for _, component := range strings.Split(filepath.Clean(dir), string(os.PathSeparator)) {
+		if component == "" {
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return -1, &os.PathError{Op: "fstat", Path: current, Err: err}
+		}
+		trusted = trusted && trustedUserDirParent(&st)
+		next := filepath.Join(current, component)
+		var child int
+		if trusted {
+			child, err = unix.Openat(fd, component, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		} else {
+			child, err = openUserDirEntry(fd, component)
+		}
+		if err == unix.ENOENT && create {
+			if int(st.Uid) != owner.UID && next != runDir {
+				unix.Close(fd)
+				return -1, errors.Errorf("%q is not owned by UID %d, not creating %q on its behalf", current, owner.UID, dir)
+			}
+			child, err = mkdirUserDir(fd, component, owner)
+		}
+		unix.Close(fd)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: next, Err: err}
+		}
+		fd, current = child, next
+	}
+	return fd, nil
+}
+
+// mkdirUserDir creates name in the directory which dirfd refers to, gives it
+// to owner, and opens it.
+func mkdirUserDir(dirfd int, name string, owner idtools.IDPair) (int, error) {
+	if err := unix.Mkdirat(dirfd, name, 0700); err != nil && err != unix.EEXIST {
+		return -1, err
+	}
+	fd, err := openUserDirEntry(dirfd, name)
+	if err != nil {
+		return -1, err
+	}
+	if err := chownUserDirEntry(fd, owner); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// chownUserDirEntry gives the file or directory which fd refers to to owner,
+// if the calling process owns it, unless it's a file with other hard links to
+// it, which might be somewhere else.
+func chownUserDirEntry(fd int, owner idtools.IDPair) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if int(st.Uid) != os.Geteuid() || (st.Mode&unix.S_IFMT != unix.S_IFDIR && st.Nlink > 1) {
+		return nil
+	}
+	return unix.Fchownat(fd, "", owner.UID, owner.GID, unix.AT_EMPTY_PATH)
+}
+
+// createUserDir creates dir, and any of its parents which don't exist, owned
+// by owner, if the nearest of its parents which does exist is owned by
+// owner.  The owner's runtime directory is created first if dir is inside of
+// it, but the directory which holds every user's runtime directory isn't.
+func createUserDir(dir string, owner idtools.IDPair) error {
+	fd, err := openUserDir(dir, owner, true)
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// chownUserDir gives everything in dir which the calling process owns to
+// owner, without following symbolic links or descending into mount points.
+func chownUserDir(dir string, owner idtools.IDPair) error {
+	fd, err := openUserDir(dir, owner, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "fstat", Path: dir, Err: err}
+	}
+	return chownUserDirContents(fd, dir, uint64(st.Dev), owner)
+}
+
+// chownUserDirContents gives everything in the directory which dirfd refers
+// to, and which is on the device dev, to owner, if the calling process owns
+// it.
+func chownUserDirContents(dirfd int, dir string, dev uint64, owner idtools.IDPair) error {
+	rfd, err := unix.Openat(dirfd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	f := os.NewFile(uintptr(rfd), dir)
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if err == unix.ENOENT {
+				continue
+			}
+			return &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return &os.PathError{Op: "fstat", Path: path, Err: err}
+		}
+		if uint64(st.Dev) == dev {
+			if err := chownUserDirEntry(fd, owner); err != nil {
+				unix.Close(fd)
+				return &os.PathError{Op: "chown", Path: path, Err: err}
+			}
+			if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+				if err := chownUserDirContents(fd, path, dev, owner); err != nil {
+					unix.Close(fd)
+					return err
+				}
+			}
+		}
+		unix.Close(fd)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package storage
+
+import (
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// createUserDir would create dir on owner's behalf.  We don't know how to do
+// that safely here.
+func createUserDir(dir string, owner idtools.IDPair) error {
+	return errors.Wrapf(ErrNotSupported, "creating %q on behalf of UID %d", dir, owner.UID)
+}
+
+// chownUserDir would give everything in dir which the calling process owns to
+// owner.  We don't know how to do that safely here.
+func chownUserDir(dir string, owner idtools.IDPair) error {
+	return errors.Wrapf(ErrNotSupported, "giving %q to UID %d", dir, owner.UID)
+}
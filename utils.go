@@ -2,10 +2,18 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/types"
+	"github.com/pkg/errors"
 )
 
+// maxIDGenerationAttempts is the number of IDs which generateID will try
+// before giving up and returning one which is in use, leaving it to the
+// caller to report the collision.
+const maxIDGenerationAttempts = 100
+
 // ParseIDMapping takes idmappings and subuid and subgid maps and returns a storage mapping
 func ParseIDMapping(UIDMapSlice, GIDMapSlice []string, subUIDMap, subGIDMap string) (*types.IDMappingOptions, error) {
 	return types.ParseIDMapping(UIDMapSlice, GIDMapSlice, subUIDMap, subGIDMap)
@@ -41,6 +49,40 @@ func validateMountOptions(mountOptions []string) error {
 	return nil
 }
 
+// generateID returns an ID for a new item which none of the inUse functions
+// report is already in use, using generator if it isn't nil.
+func generateID(generator stringid.Generator, inUse ...func(id string) bool) string {
+	var id string
+	for attempt := 0; attempt < maxIDGenerationAttempts; attempt++ {
+		if generator != nil {
+			id = generator.GenerateID()
+		} else {
+			id = stringid.GenerateRandomID()
+		}
+		used := false
+		for _, check := range inUse {
+			if check(id) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			break
+		}
+	}
+	return id
+}
+
+// validateID checks that an ID which a caller supplied for a new item can be
+// used as part of the names of the files and directories which we use to
+// store it.
+func validateID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\\\x00") {
+		return errors.Wrapf(ErrInvalidID, "%q", id)
+	}
+	return nil
+}
+
 func applyNameOperation(oldNames []string, opParameters []string, op updateNameOperation) ([]string, error) {
 	result := make([]string, 0)
 	switch op {
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containers/storage/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LayerVerification describes how one of an image's layers compared with the
+// DiffID which the image's configuration lists for it.
+type LayerVerification struct {
+	// ID is the ID of the layer, or empty if the configuration lists
+	// more DiffIDs than the image has layers.
+	ID string `json:"id,omitempty"`
+	// Expected is the DiffID which the configuration lists for the
+	// layer, or empty if the image has more layers than the configuration
+	// lists DiffIDs.
+	Expected digest.Digest `json:"expected,omitempty"`
+	// Actual is the digest of the layer's diff, as it was regenerated.
+	Actual digest.Digest `json:"actual,omitempty"`
+	// Error describes why the layer's diff couldn't be regenerated.
+	Error string `json:"error,omitempty"`
+}
+
+// OK returns true if the layer's diff matched the DiffID.
+func (v LayerVerification) OK() bool {
+	return v.ID != "" && v.Expected != "" && v.Actual == v.Expected && v.Error == ""
+}
+
+// String formats the result for display.
+func (v LayerVerification) String() string {
+	switch {
+	case v.ID == "":
+		return fmt.Sprintf("missing layer: configuration lists %s", v.Expected)
+	case v.Expected == "":
+		return fmt.Sprintf("%s: not listed in configuration", v.ID)
+	case v.Error != "":
+		return fmt.Sprintf("%s: %s", v.ID, v.Error)
+	case v.OK():
+		return fmt.Sprintf("%s: ok", v.ID)
+	}
+	return fmt.Sprintf("%s: expected %s, got %s", v.ID, v.Expected, v.Actual)
+}
+
+// VerifyImageReport lists the results of a call to VerifyImage().
+type VerifyImageReport struct {
+	// Config is the digest of the configuration blob whose DiffIDs the
+	// layers were compared with.
+	Config digest.Digest `json:"config"`
+	// Layers lists the results for each layer, starting with the base
+	// layer.
+	Layers []LayerVerification `json:"layers"`
+}
+
+// OK returns true if every layer matched its DiffID.
+func (r *VerifyImageReport) OK() bool {
+	for _, layer := range r.Layers {
+		if !layer.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *store) VerifyImage(id string) (*VerifyImageReport, error) {
+	image, err := s.Image(id)
+	if err != nil {
+		return nil, err
+	}
+	configDigest, config, err := s.imageConfigWithDiffIDs(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the list of layers, starting with the base layer.
+	var layers []string
+	for next := image.TopLayer; next != ""; {
+		layer, err := s.Layer(next)
+		if err != nil {
+			return nil, errors.Wrapf(err, "locating layer %q", next)
+		}
+		layers = append([]string{layer.ID}, layers...)
+		next = layer.Parent
+	}
+
+	report := &VerifyImageReport{Config: configDigest}
+	diffIDs := config.RootFS.DiffIDs
+	for i := 0; i < len(layers) || i < len(diffIDs); i++ {
+		var result LayerVerification
+		if i < len(diffIDs) {
+			result.Expected = diffIDs[i]
+		}
+		if i < len(layers) {
+			result.ID = layers[i]
+			algorithm := digest.Canonical
+			if result.Expected != "" && result.Expected.Validate() == nil {
+				algorithm = result.Expected.Algorithm()
+			}
+			if result.Actual, err = s.layerDiffID(result.ID, algorithm); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		report.Layers = append(report.Layers, result)
+	}
+	return report, nil
+}
+
+// imageConfigWithDiffIDs finds the image's configuration blob, which is
+// stored as a big data item named after its digest, and which lists the
+// DiffIDs of its layers.
+func (s *store) imageConfigWithDiffIDs(image *Image) (digest.Digest, *ociImageConfig, error) {
+	for _, key := range image.BigDataNames {
+		d, err := digest.Parse(key)
+		if err != nil || !d.Algorithm().Available() {
+			continue
+		}
+		data, err := s.ImageBigData(image.ID, key)
+		if err != nil {
+			return "", nil, err
+		}
+		if d.Algorithm().FromBytes(data) != d {
+			continue
+		}
+		var config ociImageConfig
+		if err := json.Unmarshal(data, &config); err != nil || config.RootFS.Type != "layers" {
+			continue
+		}
+		return d, &config, nil
+	}
+	return "", nil, errors.Wrapf(ErrDigestUnknown, "image with ID %q has no configuration which lists the DiffIDs of its layers", image.ID)
+}
+
+// layerDiffID computes the digest of the layer's uncompressed diff.  The
+// diff is reproduced from the layer's tar-split data if it has any, and
+// generated from its contents if it doesn't.
+func (s *store) layerDiffID(id string, algorithm digest.Algorithm) (digest.Digest, error) {
+	uncompressed := archive.Uncompressed
+	rc, err := s.Diff("", id, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return "", errors.Wrapf(err, "generating diff for layer %q", id)
+	}
+	defer rc.Close()
+	digester := algorithm.Digester()
+	if _, err := io.Copy(digester.Hash(), rc); err != nil {
+		return "", errors.Wrapf(err, "reading diff for layer %q", id)
+	}
+	return digester.Digest(), nil
+}
@@ -0,0 +1,745 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/containers/storage/pkg/truncindex"
+	"github.com/pkg/errors"
+)
+
+// A Volume is a directory which is kept alongside containers, and which
+// outlives them, so that it can be mounted into containers to hold data which
+// shouldn't be lost when they're deleted.
+type Volume struct {
+	// ID is either one which was specified at create-time, or a random
+	// value which was generated by the library.
+	ID string `json:"id"`
+
+	// Names is an optional set of user-defined convenience values.  The
+	// volume can be referred to by its ID or any of its names.  Names are
+	// unique among volumes.
+	Names []string `json:"names,omitempty"`
+
+	// Driver is the name of the VolumeDriver which manages the volume's
+	// contents.
+	Driver string `json:"driver"`
+
+	// Options are the options which were passed to the volume's driver
+	// when the volume was created.
+	Options map[string]string `json:"options,omitempty"`
+
+	// Labels are key/value pairs which we keep for the convenience of the
+	// caller.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Created is the datestamp for when this volume was created.
+	Created time.Time `json:"created,omitempty"`
+
+	// MountCount is the number of times the volume has been mounted
+	// without being unmounted.
+	MountCount int `json:"-"`
+}
+
+// VolumeOptions is used for passing options to a Store's CreateVolume()
+// method.
+type VolumeOptions struct {
+	// Driver is the name of the VolumeDriver which manages the volume's
+	// contents.  The default is "local".
+	Driver string
+	// Options are passed to the driver.  Both of the built-in drivers
+	// accept "uid", "gid", and "mode", which set the ownership and
+	// permissions of the volume's root directory, and the "tmpfs" driver
+	// also accepts "size".  If "uid" and "gid" aren't set and the Store
+	// has ID mappings, the root directory is owned by the mapped root
+	// user.
+	Options map[string]string
+	// Labels are the volume's initial labels.
+	Labels map[string]string
+}
+
+// A VolumeDriver manages the contents of volumes.  Each volume has a
+// directory of its own, which is created before the driver is asked to do
+// anything with it, and which is removed after the volume is deleted.
+type VolumeDriver interface {
+	// Create prepares dir, which is where the volume's contents will be
+	// found while it's mounted, for a new volume.  It should reject
+	// options which it doesn't recognize.
+	Create(dir string, options map[string]string) error
+	// Mount makes the volume's contents available at dir.
+	Mount(dir string, options map[string]string) error
+	// Unmount undoes Mount.
+	Unmount(dir string) error
+}
+
+var (
+	volumeDriversLock sync.Mutex
+	volumeDrivers     = map[string]VolumeDriver{
+		"local": localVolumeDriver{},
+		"tmpfs": tmpfsVolumeDriver{},
+	}
+)
+
+// RegisterVolumeDriver makes a VolumeDriver available, under the specified
+// name, for creating and mounting volumes.  It replaces any driver which was
+// registered with the same name, including the built-in "local" and "tmpfs"
+// drivers.
+func RegisterVolumeDriver(name string, driver VolumeDriver) error {
+	if name == "" || driver == nil {
+		return errors.New("a volume driver needs a name")
+	}
+	volumeDriversLock.Lock()
+	defer volumeDriversLock.Unlock()
+	volumeDrivers[name] = driver
+	return nil
+}
+
+func getVolumeDriver(name string) (VolumeDriver, error) {
+	volumeDriversLock.Lock()
+	defer volumeDriversLock.Unlock()
+	if driver, ok := volumeDrivers[name]; ok {
+		return driver, nil
+	}
+	return nil, errors.Wrapf(ErrVolumeDriverUnknown, "%q", name)
+}
+
+// volumeRootOptions parses the "uid", "gid", and "mode" options, which set
+// the ownership and permissions of a volume's root directory.  The returned
+// IDs are -1 if they aren't set, and the mode is in the form which chmod(2)
+// expects.
+func volumeRootOptions(options map[string]string, allowed ...string) (uid, gid int, mode uint32, err error) {
+	uid, gid, mode = -1, -1, 0755
+	for key, value := range options {
+		switch key {
+		case "uid", "gid":
+			id, err := strconv.Atoi(value)
+			if err != nil || id < 0 {
+				return -1, -1, 0, errors.Errorf("invalid volume option %s=%q", key, value)
+			}
+			if key == "uid" {
+				uid = id
+			} else {
+				gid = id
+			}
+		case "mode":
+			m, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || m&^0o7777 != 0 {
+				return -1, -1, 0, errors.Errorf("invalid volume option %s=%q", key, value)
+			}
+			mode = uint32(m)
+		default:
+			found := false
+			for _, option := range allowed {
+				found = found || key == option
+			}
+			if !found {
+				return -1, -1, 0, errors.Errorf("unsupported volume option %q", key)
+			}
+		}
+	}
+	return uid, gid, mode, nil
+}
+
+// localVolumeDriver keeps a volume's contents in its directory.
+type localVolumeDriver struct{}
+
+func (localVolumeDriver) Create(dir string, options map[string]string) error {
+	uid, gid, mode, err := volumeRootOptions(options)
+	if err != nil {
+		return err
+	}
+	fileMode := os.FileMode(mode & 0o777)
+	for bit, flag := range map[uint32]os.FileMode{0o4000: os.ModeSetuid, 0o2000: os.ModeSetgid, 0o1000: os.ModeSticky} {
+		if mode&bit != 0 {
+			fileMode |= flag
+		}
+	}
+	if err := os.Chmod(dir, fileMode); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		return os.Lchown(dir, uid, gid)
+	}
+	return nil
+}
+
+func (localVolumeDriver) Mount(dir string, options map[string]string) error {
+	return nil
+}
+
+func (localVolumeDriver) Unmount(dir string) error {
+	return nil
+}
+
+// tmpfsVolumeDriver mounts a new tmpfs on a volume's directory each time the
+// volume is first mounted, so its contents are discarded when it's unmounted.
+type tmpfsVolumeDriver struct{}
+
+func (tmpfsVolumeDriver) Create(dir string, options map[string]string) error {
+	_, _, _, err := volumeRootOptions(options, "size")
+	return err
+}
+
+func (tmpfsVolumeDriver) Mount(dir string, options map[string]string) error {
+	uid, gid, mode, err := volumeRootOptions(options, "size")
+	if err != nil {
+		return err
+	}
+	mountOptions := []string{"nodev", "nosuid", fmt.Sprintf("mode=%o", mode)}
+	if uid != -1 {
+		mountOptions = append(mountOptions, fmt.Sprintf("uid=%d", uid))
+	}
+	if gid != -1 {
+		mountOptions = append(mountOptions, fmt.Sprintf("gid=%d", gid))
+	}
+	if size, ok := options["size"]; ok {
+		mountOptions = append(mountOptions, "size="+size)
+	}
+	return mount.Mount("tmpfs", dir, "tmpfs", strings.Join(mountOptions, ","))
+}
+
+func (tmpfsVolumeDriver) Unmount(dir string) error {
+	return mount.Unmount(dir)
+}
+
+// volumeStore keeps records of volumes, and their contents, in a directory
+// alongside those of containers.  How many times each volume is mounted is
+// kept in the run root, so that it's forgotten when the system restarts.
+type volumeStore struct {
+	lockfile Locker
+	dir      string
+	rundir   string
+	volumes  []*Volume
+	idindex  *truncindex.TruncIndex
+	byid     map[string]*Volume
+	byname   map[string]*Volume
+	loadMut  sync.Mutex
+	// records reads and writes the file which holds the records.
+	records recordsFile
+}
+
+func copyVolume(v *Volume) *Volume {
+	return &Volume{
+		ID:         v.ID,
+		Names:      copyStringSlice(v.Names),
+		Driver:     v.Driver,
+		Options:    copyStringStringMap(v.Options),
+		Labels:     copyStringStringMap(v.Labels),
+		Created:    v.Created,
+		MountCount: v.MountCount,
+	}
+}
+
+func newVolumeStore(dir, rundir string, lockfile Locker, writerOptions ioutils.AtomicFileWriterOptions) (*volumeStore, error) {
+	if err := os.MkdirAll(rundir, 0700); err != nil {
+		return nil, err
+	}
+	if lockfile.IsReadWrite() {
+		lockfile.Lock()
+	} else {
+		lockfile.RLock()
+	}
+	defer lockfile.Unlock()
+	vstore := volumeStore{
+		lockfile: lockfile,
+		dir:      dir,
+		rundir:   rundir,
+		records:  recordsFile{options: writerOptions},
+	}
+	if err := vstore.Load(); err != nil {
+		return nil, err
+	}
+	return &vstore, nil
+}
+
+func (r *volumeStore) volumespath() string {
+	return filepath.Join(r.dir, "volumes.json")
+}
+
+func (r *volumeStore) mountspath() string {
+	return filepath.Join(r.rundir, "mounts.json")
+}
+
+// datadir returns the directory where the volume's contents are found.
+func (r *volumeStore) datadir(id string) string {
+	return filepath.Join(r.dir, id, "_data")
+}
+
+func (r *volumeStore) Load() error {
+	var volumes []*Volume
+	if _, err := r.records.decode(r.volumespath(), func() interface{} {
+		volumes = []*Volume{}
+		return &volumes
+	}); err != nil {
+		return err
+	}
+	mounts := make(map[string]int)
+	data, err := ioutil.ReadFile(r.mountspath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &mounts); err != nil {
+			return errors.Wrapf(err, "error decoding %q", r.mountspath())
+		}
+	}
+	idlist := make([]string, 0, len(volumes))
+	ids := make(map[string]*Volume)
+	names := make(map[string]*Volume)
+	for _, volume := range volumes {
+		volume.MountCount = mounts[volume.ID]
+		ids[volume.ID] = volume
+		idlist = append(idlist, volume.ID)
+		for _, name := range volume.Names {
+			names[name] = volume
+		}
+	}
+	r.volumes = volumes
+	r.idindex = truncindex.NewTruncIndex(idlist)
+	r.byid = ids
+	r.byname = names
+	return nil
+}
+
+func (r *volumeStore) Save() error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify the volume store at %q", r.volumespath())
+	}
+	if !r.Locked() {
+		return errors.New("volume store is not locked for writing")
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	jdata, err := json.Marshal(&r.volumes)
+	if err != nil {
+		return err
+	}
+	mounts := make(map[string]int)
+	for _, volume := range r.volumes {
+		if volume.MountCount > 0 {
+			mounts[volume.ID] = volume.MountCount
+		}
+	}
+	mdata, err := json.Marshal(&mounts)
+	if err != nil {
+		return err
+	}
+	defer r.Touch()
+	if err := ioutils.AtomicWriteFile(r.mountspath(), mdata, 0600); err != nil {
+		return err
+	}
+	return r.records.write(r.volumespath(), jdata)
+}
+
+func (r *volumeStore) lookup(id string) (*Volume, bool) {
+	if volume, ok := r.byid[id]; ok {
+		return volume, ok
+	} else if volume, ok := r.byname[id]; ok {
+		return volume, ok
+	} else if longid, err := r.idindex.Get(id); err == nil {
+		volume, ok := r.byid[longid]
+		return volume, ok
+	}
+	return nil, false
+}
+
+func (r *volumeStore) Create(id string, names []string, options *VolumeOptions, rootUID, rootGID int) (_ *Volume, retErr error) {
+	if !r.IsReadWrite() {
+		return nil, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to create new volumes at %q", r.volumespath())
+	}
+	if options == nil {
+		options = &VolumeOptions{}
+	}
+	if id == "" {
+		id = generateID(nil, func(id string) bool {
+			_, ok := r.lookup(id)
+			return ok
+		})
+	} else if err := validateID(id); err != nil {
+		return nil, err
+	}
+	if _, idInUse := r.byid[id]; idInUse {
+		return nil, errors.Wrapf(ErrDuplicateID, "a volume with ID %q already exists", id)
+	}
+	names = dedupeNames(names)
+	for _, name := range names {
+		if volume, nameInUse := r.byname[name]; nameInUse {
+			return nil, errors.Wrapf(ErrDuplicateName, "volume name %q is already associated with volume %q", name, volume.ID)
+		}
+	}
+	driverName := options.Driver
+	if driverName == "" {
+		driverName = "local"
+	}
+	driver, err := getVolumeDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	driverOptions := copyStringStringMap(options.Options)
+	if driverOptions == nil {
+		driverOptions = make(map[string]string)
+	}
+	if _, ok := driverOptions["uid"]; !ok && rootUID != 0 {
+		driverOptions["uid"] = strconv.Itoa(rootUID)
+	}
+	if _, ok := driverOptions["gid"]; !ok && rootGID != 0 {
+		driverOptions["gid"] = strconv.Itoa(rootGID)
+	}
+	datadir := r.datadir(id)
+	if err := os.MkdirAll(datadir, 0700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(filepath.Dir(datadir))
+		}
+	}()
+	if err := driver.Create(datadir, driverOptions); err != nil {
+		return nil, errors.Wrapf(err, "creating volume %q using driver %q", id, driverName)
+	}
+	volume := &Volume{
+		ID:      id,
+		Names:   names,
+		Driver:  driverName,
+		Options: driverOptions,
+		Labels:  copyStringStringMap(options.Labels),
+		Created: time.Now().UTC(),
+	}
+	r.volumes = append(r.volumes, volume)
+	r.idindex.Add(id)
+	r.byid[id] = volume
+	for _, name := range names {
+		r.byname[name] = volume
+	}
+	if err := r.Save(); err != nil {
+		// Forget about it, since the directory is about to go away.
+		delete(r.byid, id)
+		r.idindex.Delete(id)
+		for _, name := range names {
+			delete(r.byname, name)
+		}
+		r.volumes = r.volumes[:len(r.volumes)-1]
+		return nil, err
+	}
+	return copyVolume(volume), nil
+}
+
+func (r *volumeStore) Mount(id string) (string, error) {
+	if !r.IsReadWrite() {
+		return "", errors.Wrapf(ErrStoreIsReadOnly, "not allowed to mount volumes at %q", r.volumespath())
+	}
+	volume, ok := r.lookup(id)
+	if !ok {
+		return "", errors.Wrapf(ErrVolumeUnknown, "error locating volume with ID %q", id)
+	}
+	datadir := r.datadir(volume.ID)
+	if volume.MountCount == 0 {
+		driver, err := getVolumeDriver(volume.Driver)
+		if err != nil {
+			return "", err
+		}
+		if err := driver.Mount(datadir, volume.Options); err != nil {
+			return "", errors.Wrapf(err, "mounting volume %q using driver %q", volume.ID, volume.Driver)
+		}
+	}
+	volume.MountCount++
+	return datadir, r.Save()
+}
+
+func (r *volumeStore) Unmount(id string, force bool) (bool, error) {
+	if !r.IsReadWrite() {
+		return false, errors.Wrapf(ErrStoreIsReadOnly, "not allowed to unmount volumes at %q", r.volumespath())
+	}
+	volume, ok := r.lookup(id)
+	if !ok {
+		return false, errors.Wrapf(ErrVolumeUnknown, "error locating volume with ID %q", id)
+	}
+	if volume.MountCount == 0 {
+		return false, nil
+	}
+	if force {
+		volume.MountCount = 1
+	}
+	if volume.MountCount == 1 {
+		driver, err := getVolumeDriver(volume.Driver)
+		if err != nil {
+			return true, err
+		}
+		if err := driver.Unmount(r.datadir(volume.ID)); err != nil {
+			return true, errors.Wrapf(err, "unmounting volume %q using driver %q", volume.ID, volume.Driver)
+		}
+	}
+	volume.MountCount--
+	return volume.MountCount > 0, r.Save()
+}
+
+func (r *volumeStore) UpdateLabels(id string, set map[string]string, remove []string) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to modify volume labels at %q", r.volumespath())
+	}
+	if volume, ok := r.lookup(id); ok {
+		if updateAnnotations(&volume.Labels, set, remove) {
+			return r.Save()
+		}
+		return nil
+	}
+	return errors.Wrapf(ErrVolumeUnknown, "error locating volume with ID %q", id)
+}
+
+// Delete removes a volume's record, and removes its directory using the
+// trash.
+func (r *volumeStore) Delete(id string, trash *trash) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete volumes at %q", r.volumespath())
+	}
+	volume, ok := r.lookup(id)
+	if !ok {
+		return errors.Wrapf(ErrVolumeUnknown, "error locating volume with ID %q", id)
+	}
+	if volume.MountCount > 0 {
+		return errors.Wrapf(ErrVolumeMounted, "volume %q is mounted", volume.ID)
+	}
+	delete(r.byid, volume.ID)
+	r.idindex.Delete(volume.ID)
+	for _, name := range volume.Names {
+		delete(r.byname, name)
+	}
+	for i, candidate := range r.volumes {
+		if candidate == volume {
+			r.volumes = append(r.volumes[:i], r.volumes[i+1:]...)
+			break
+		}
+	}
+	if err := r.Save(); err != nil {
+		return err
+	}
+	return trash.removeAll(fmt.Sprintf("directory for volume %q", volume.ID), filepath.Join(r.dir, volume.ID))
+}
+
+// Wipe unmounts and deletes every volume.
+func (r *volumeStore) Wipe(trash *trash) error {
+	if !r.IsReadWrite() {
+		return errors.Wrapf(ErrStoreIsReadOnly, "not allowed to delete volumes at %q", r.volumespath())
+	}
+	ids := make([]string, 0, len(r.byid))
+	for id := range r.byid {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if _, err := r.Unmount(id, true); err != nil {
+			return err
+		}
+		if err := r.Delete(id, trash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *volumeStore) Get(id string) (*Volume, error) {
+	if volume, ok := r.lookup(id); ok {
+		return copyVolume(volume), nil
+	}
+	return nil, errors.Wrapf(ErrVolumeUnknown, "error locating volume with ID %q", id)
+}
+
+func (r *volumeStore) Volumes() ([]Volume, error) {
+	volumes := make([]Volume, len(r.volumes))
+	for i := range r.volumes {
+		volumes[i] = *copyVolume(r.volumes[i])
+	}
+	return volumes, nil
+}
+
+func (r *volumeStore) Lock() {
+	r.lockfile.Lock()
+}
+
+func (r *volumeStore) RLock() {
+	r.lockfile.RLock()
+}
+
+func (r *volumeStore) Unlock() {
+	r.lockfile.Unlock()
+}
+
+func (r *volumeStore) Touch() error {
+	return r.lockfile.Touch()
+}
+
+func (r *volumeStore) Modified() (bool, error) {
+	return r.lockfile.Modified()
+}
+
+func (r *volumeStore) IsReadWrite() bool {
+	return r.lockfile.IsReadWrite()
+}
+
+func (r *volumeStore) Locked() bool {
+	return r.lockfile.Locked()
+}
+
+func (r *volumeStore) ReloadIfChanged() error {
+	r.loadMut.Lock()
+	defer r.loadMut.Unlock()
+
+	modified, err := r.Modified()
+	if err == nil && modified {
+		return r.Load()
+	}
+	return err
+}
+
+// getVolumeStore obtains the volume store object used by the Store, reading
+// the volume records if they haven't been read yet.
+func (s *store) getVolumeStore() (*volumeStore, error) {
+	if s.graphRootChanged != nil {
+		return nil, s.graphRootChanged
+	}
+	s.storesLock.Lock()
+	defer s.storesLock.Unlock()
+	if s.volumeStore != nil {
+		return s.volumeStore, nil
+	}
+	if !s.loaded {
+		return nil, ErrLoadError
+	}
+	// Volumes don't depend on the driver, so they're kept in one place.
+	gvpath := filepath.Join(s.catalogGraphRoot(), "volumes")
+	rvpath := filepath.Join(s.catalogRunRoot(), "volumes")
+	var vlock Locker
+	var err error
+	if s.readOnly {
+		if err := os.MkdirAll(rvpath, 0700); err != nil {
+			return nil, err
+		}
+		vlock, err = getReadOnlyStoreLockfile(filepath.Join(gvpath, "volumes.lock"), filepath.Join(rvpath, "volumes.lock"))
+	} else {
+		if err := os.MkdirAll(gvpath, 0700); err != nil {
+			return nil, err
+		}
+		vlock, err = GetLockfile(filepath.Join(gvpath, "volumes.lock"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	vstore, err := newVolumeStore(gvpath, rvpath, vlock, s.writerOptions)
+	if err != nil {
+		return nil, err
+	}
+	s.volumeStore = vstore
+	return s.volumeStore, nil
+}
+
+func (s *store) CreateVolume(id string, names []string, options *VolumeOptions) (*Volume, error) {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return nil, err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id = generateID(s.idGenerator, func(id string) bool {
+			_, ok := vstore.lookup(id)
+			return ok
+		})
+	}
+	rootUID, rootGID, err := idtools.GetRootUIDGID(s.uidMap, s.gidMap)
+	if err != nil {
+		return nil, err
+	}
+	return vstore.Create(id, names, options, rootUID, rootGID)
+}
+
+func (s *store) Volume(id string) (*Volume, error) {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return nil, err
+	}
+	vstore.RLock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return vstore.Get(id)
+}
+
+func (s *store) Volumes() ([]Volume, error) {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return nil, err
+	}
+	vstore.RLock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return vstore.Volumes()
+}
+
+func (s *store) MountVolume(id string) (string, error) {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return "", err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return "", err
+	}
+	return vstore.Mount(id)
+}
+
+func (s *store) UnmountVolume(id string, force bool) (bool, error) {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return false, err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return false, err
+	}
+	return vstore.Unmount(id, force)
+}
+
+func (s *store) UpdateVolumeLabels(id string, set map[string]string, remove []string) error {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return vstore.UpdateLabels(id, set, remove)
+}
+
+func (s *store) DeleteVolume(id string) error {
+	vstore, err := s.getVolumeStore()
+	if err != nil {
+		return err
+	}
+	vstore.Lock()
+	defer vstore.Unlock()
+	if err := vstore.ReloadIfChanged(); err != nil {
+		return err
+	}
+	return vstore.Delete(id, s.backgroundTrash())
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// changeWatchMask selects the events which indicate that a lock file was
+// touched, or that a record file was replaced or edited.
+const changeWatchMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CLOSE_WRITE | unix.IN_CREATE |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// changeWatcher uses inotify to notice when anything in the directories which
+// hold a store's lock files and records changes.
+type changeWatcher struct {
+	file       *os.File
+	changed    int32
+	overflowed int32
+	broken     int32
+}
+
+// newChangeWatcher starts watching the directories.  The watcher starts out
+// reporting that something has changed, since it can't know what happened
+// before it was started.
+func newChangeWatcher(dirs []string) (*changeWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error initializing inotify")
+	}
+	for _, dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, changeWatchMask); err != nil {
+			unix.Close(fd)
+			return nil, errors.Wrapf(err, "error watching %q", dir)
+		}
+	}
+	w := &changeWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changed: 1,
+	}
+	go w.run()
+	return w, nil
+}
+
+// run reads events until the watcher is closed.  Any event means that
+// something changed, but if one of the directories is removed or renamed, we
+// can no longer depend on the watcher.  If events were dropped because the
+// queue overflowed, the watcher still works, but we can't know which changes
+// we missed.
+func (w *changeWatcher) run() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil || n < unix.SizeofInotifyEvent {
+			atomic.StoreInt32(&w.broken, 1)
+			atomic.StoreInt32(&w.changed, 1)
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				atomic.StoreInt32(&w.overflowed, 1)
+			}
+			if event.Mask&(unix.IN_IGNORED|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				atomic.StoreInt32(&w.broken, 1)
+			}
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+		}
+		atomic.StoreInt32(&w.changed, 1)
+	}
+}
+
+// takeChanged returns true if something may have changed since the last time
+// it was called, and whether events were dropped since then, in which case
+// everything should be reloaded.
+func (w *changeWatcher) takeChanged() (changed, overflowed bool) {
+	overflowed = atomic.SwapInt32(&w.overflowed, 0) != 0
+	if atomic.LoadInt32(&w.broken) != 0 {
+		return true, overflowed
+	}
+	return atomic.SwapInt32(&w.changed, 0) != 0 || overflowed, overflowed
+}
+
+// setChanged makes the next call to takeChanged return true, and report that
+// events were dropped if overflowed is set.
+func (w *changeWatcher) setChanged(overflowed bool) {
+	if overflowed {
+		atomic.StoreInt32(&w.overflowed, 1)
+	}
+	atomic.StoreInt32(&w.changed, 1)
+}
+
+// Close stops the watcher.
+func (w *changeWatcher) Close() error {
+	return w.file.Close()
+}
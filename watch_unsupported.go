@@ -0,0 +1,31 @@
+// +build !linux
+
+package storage
+
+import "github.com/pkg/errors"
+
+// changeWatcher would notice when anything in the directories which hold a
+// store's lock files and records changes, but we don't know how to do that
+// here.
+type changeWatcher struct{}
+
+// newChangeWatcher always fails here, so callers fall back to checking each
+// of the lock files.
+func newChangeWatcher(dirs []string) (*changeWatcher, error) {
+	return nil, errors.New("watching for changes is not supported on this platform")
+}
+
+// takeChanged returns true if something may have changed, and whether events
+// were dropped.
+func (w *changeWatcher) takeChanged() (changed, overflowed bool) {
+	return true, false
+}
+
+// setChanged makes the next call to takeChanged return true.
+func (w *changeWatcher) setChanged(overflowed bool) {
+}
+
+// Close stops the watcher.
+func (w *changeWatcher) Close() error {
+	return nil
+}